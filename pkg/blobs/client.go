@@ -36,6 +36,14 @@ type BlobClient interface {
 	// Writer opens the named payload on the requested node for writing.
 	Writer(ctx context.Context, file string) (io.WriteCloser, error)
 
+	// WriteFileIfNotExists writes the named payload on the requested node if
+	// it does not exist, returning false if it does.
+	WriteFileIfNotExists(ctx context.Context, file string, content io.Reader) (created bool, _ error)
+
+	// AppendFile appends the content to the named payload on the requested
+	// node, creating it if it does not exist.
+	AppendFile(ctx context.Context, file string, content io.Reader) error
+
 	// List lists the corresponding filenames from the requested node.
 	// The requested node can be the current node.
 	List(ctx context.Context, pattern string) ([]string, error)
@@ -43,6 +51,10 @@ type BlobClient interface {
 	// Delete deletes the specified file or empty directory from a remote node.
 	Delete(ctx context.Context, file string) error
 
+	// Rename atomically renames the file from to the file to on the requested
+	// node, replacing it if it exists.
+	Rename(ctx context.Context, from, to string) error
+
 	// Stat gets the size (in bytes) of a specified file from a remote node.
 	Stat(ctx context.Context, file string) (*blobspb.BlobStat, error)
 }
@@ -111,6 +123,21 @@ func (c *remoteClient) Writer(ctx context.Context, file string) (io.WriteCloser,
 	return &streamWriter{s: stream, buf: blobspb.StreamChunk{Payload: buf}}, nil
 }
 
+// WriteFileIfNotExists is not supported by the blob service, which has no
+// conditional write.
+func (c *remoteClient) WriteFileIfNotExists(
+	ctx context.Context, file string, content io.Reader,
+) (bool, error) {
+	return false, errors.UnimplementedError(errors.IssueLink{},
+		"conditional writes to the local storage of another node are not supported")
+}
+
+// AppendFile is not supported by the blob service, which has no append.
+func (c *remoteClient) AppendFile(ctx context.Context, file string, content io.Reader) error {
+	return errors.UnimplementedError(errors.IssueLink{},
+		"appending to the local storage of another node is not supported")
+}
+
 func (c *remoteClient) List(ctx context.Context, pattern string) ([]string, error) {
 	resp, err := c.blobClient.List(ctx, &blobspb.GlobRequest{
 		Pattern: pattern,
@@ -128,6 +155,14 @@ func (c *remoteClient) Delete(ctx context.Context, file string) error {
 	return err
 }
 
+func (c *remoteClient) Rename(ctx context.Context, from, to string) error {
+	_, err := c.blobClient.Rename(ctx, &blobspb.RenameRequest{
+		FromFilename: from,
+		ToFilename:   to,
+	})
+	return err
+}
+
 func (c *remoteClient) Stat(ctx context.Context, file string) (*blobspb.BlobStat, error) {
 	resp, err := c.blobClient.Stat(ctx, &blobspb.StatRequest{
 		Filename: file,
@@ -165,6 +200,16 @@ func (c *localClient) Writer(ctx context.Context, file string) (io.WriteCloser,
 	return c.localStorage.Writer(ctx, file)
 }
 
+func (c *localClient) WriteFileIfNotExists(
+	ctx context.Context, file string, content io.Reader,
+) (bool, error) {
+	return c.localStorage.WriteFileIfNotExists(ctx, file, content)
+}
+
+func (c *localClient) AppendFile(ctx context.Context, file string, content io.Reader) error {
+	return c.localStorage.AppendFile(ctx, file, content)
+}
+
 func (c *localClient) List(ctx context.Context, pattern string) ([]string, error) {
 	return c.localStorage.List(pattern)
 }
@@ -173,6 +218,10 @@ func (c *localClient) Delete(ctx context.Context, file string) error {
 	return c.localStorage.Delete(file)
 }
 
+func (c *localClient) Rename(ctx context.Context, from, to string) error {
+	return c.localStorage.Rename(from, to)
+}
+
 func (c *localClient) Stat(ctx context.Context, file string) (*blobspb.BlobStat, error) {
 	return c.localStorage.Stat(file)
 }
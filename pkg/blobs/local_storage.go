@@ -21,6 +21,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/fileutil"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
 )
 
 // LocalStorage wraps all operations with the local file system
@@ -79,6 +80,13 @@ func (l localWriter) Write(p []byte) (int, error) {
 	return l.f.Write(p)
 }
 
+// ReadFrom implements io.ReaderFrom, so that the file can copy from src
+// without an intermediate buffer, e.g. with copy_file_range(2) when src is
+// another file.
+func (l localWriter) ReadFrom(src io.Reader) (int64, error) {
+	return l.f.ReadFrom(src)
+}
+
 func (l localWriter) Close() error {
 	if err := l.ctx.Err(); err != nil {
 		closeErr := l.f.Close()
@@ -130,6 +138,75 @@ func (l *LocalStorage) Writer(ctx context.Context, filename string) (io.WriteClo
 	return localWriter{tmp: tmpFile.Name(), dest: fullPath, f: tmpFile, ctx: ctx}, nil
 }
 
+// WriteFileIfNotExists prepends IO dir to filename and writes the content to
+// that local file if it does not exist. The file is created with O_EXCL, so
+// of several concurrent calls only one creates the file. It returns false,
+// and no error, if the file already exists.
+func (l *LocalStorage) WriteFileIfNotExists(
+	ctx context.Context, filename string, content io.Reader,
+) (created bool, _ error) {
+	fullPath, err := l.prependExternalIODir(filename)
+	if err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	targetDir := filepath.Dir(fullPath)
+	if err = os.MkdirAll(targetDir, 0755); err != nil {
+		return false, errors.Wrapf(err, "creating target local directory %q", targetDir)
+	}
+
+	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if oserror.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.CombineErrors(err, f.Close())
+	if err != nil {
+		// Remove the partially written file so a later call can create it.
+		return false, errors.CombineErrors(err, errors.Wrap(os.Remove(fullPath), "cleaning up"))
+	}
+	return true, nil
+}
+
+// AppendFile prepends IO dir to filename and appends the content to that local
+// file, creating it if it does not exist. The file is opened with O_APPEND, so
+// every write lands at the end of the file, but the content of concurrent
+// appends larger than a single write may be interleaved, and an append which
+// fails may leave part of its content in the file.
+func (l *LocalStorage) AppendFile(ctx context.Context, filename string, content io.Reader) error {
+	fullPath, err := l.prependExternalIODir(filename)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	targetDir := filepath.Dir(fullPath)
+	if err = os.MkdirAll(targetDir, 0755); err != nil {
+		return errors.Wrapf(err, "creating target local directory %q", targetDir)
+	}
+
+	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.CombineErrors(err, f.Close())
+}
+
 // ReadFile prepends IO dir to filename and reads the content of that local file.
 func (l *LocalStorage) ReadFile(
 	filename string, offset int64,
@@ -233,6 +310,27 @@ func (l *LocalStorage) Delete(filename string) error {
 	return os.Remove(fullPath)
 }
 
+// Rename prepends IO dir to both filenames and atomically renames the local
+// file from to the local file to, replacing it if it exists.
+func (l *LocalStorage) Rename(from, to string) error {
+	fromPath, err := l.prependExternalIODir(from)
+	if err != nil {
+		return errors.Wrap(err, "renaming file")
+	}
+	toPath, err := l.prependExternalIODir(to)
+	if err != nil {
+		return errors.Wrap(err, "renaming file")
+	}
+	if _, err := os.Stat(fromPath); err != nil {
+		return err
+	}
+	targetDir := filepath.Dir(toPath)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return errors.Wrapf(err, "creating target local directory %q", targetDir)
+	}
+	return os.Rename(fromPath, toPath)
+}
+
 // Stat prepends IO dir to filename and gets the Stat() of that local file.
 func (l *LocalStorage) Stat(filename string) (*blobspb.BlobStat, error) {
 	fullPath, err := l.prependExternalIODir(filename)
@@ -246,5 +344,5 @@ func (l *LocalStorage) Stat(filename string) (*blobspb.BlobStat, error) {
 	if fi.IsDir() {
 		return nil, errors.Errorf("expected a file but %q is a directory", fi.Name())
 	}
-	return &blobspb.BlobStat{Filesize: fi.Size()}, nil
+	return &blobspb.BlobStat{Filesize: fi.Size(), ModTimeNanos: fi.ModTime().UnixNano()}, nil
 }
@@ -106,6 +106,18 @@ func (s *Service) Delete(
 	return &blobspb.DeleteResponse{}, s.localStorage.Delete(req.Filename)
 }
 
+// Rename implements the gRPC service.
+func (s *Service) Rename(
+	ctx context.Context, req *blobspb.RenameRequest,
+) (*blobspb.RenameResponse, error) {
+	err := s.localStorage.Rename(req.FromFilename, req.ToFilename)
+	if oserror.IsNotExist(err) {
+		// As in Stat, send back a gRPC error the client can recognize.
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &blobspb.RenameResponse{}, err
+}
+
 // Stat implements the gRPC service.
 func (s *Service) Stat(ctx context.Context, req *blobspb.StatRequest) (*blobspb.BlobStat, error) {
 	resp, err := s.localStorage.Stat(req.Filename)
@@ -239,9 +239,11 @@ func runUserFileGet(cmd *cobra.Command, args []string) (resErr error) {
 		return err
 	}
 
-	fullPath := conf.Path
-	conf.Path = cloud.GetPrefixBeforeWildcard(fullPath)
-	pattern := fullPath[len(conf.Path):]
+	prefix, pattern, err := cloud.SplitGlobPattern(conf.Path)
+	if err != nil {
+		return err
+	}
+	conf.Path = prefix
 	displayPath := strings.TrimPrefix(conf.Path, "/")
 
 	f, err := userfile.MakeSQLConnFileTableStorage(ctx, conf, conn.GetDriverConn())
@@ -433,9 +435,11 @@ func listUserFile(ctx context.Context, conn clisqlclient.Conn, glob string) ([]s
 		return nil, err
 	}
 
-	fullPath := conf.Path
-	conf.Path = cloud.GetPrefixBeforeWildcard(fullPath)
-	pattern := fullPath[len(conf.Path):]
+	prefix, pattern, err := cloud.SplitGlobPattern(conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	conf.Path = prefix
 
 	f, err := userfile.MakeSQLConnFileTableStorage(ctx, conf, conn.GetDriverConn())
 	if err != nil {
@@ -510,9 +514,11 @@ func deleteUserFile(ctx context.Context, conn clisqlclient.Conn, glob string) ([
 	// We truncate the path so that we can open one store to first do a listing
 	// with our actual pattern, then pass the found names to delete them using the
 	// same store.
-	fullPath := userFileTableConf.FileTableConfig.Path
-	userFileTableConf.FileTableConfig.Path = cloud.GetPrefixBeforeWildcard(fullPath)
-	pattern := fullPath[len(userFileTableConf.FileTableConfig.Path):]
+	prefix, pattern, err := cloud.SplitGlobPattern(userFileTableConf.FileTableConfig.Path)
+	if err != nil {
+		return nil, err
+	}
+	userFileTableConf.FileTableConfig.Path = prefix
 
 	f, err := userfile.MakeSQLConnFileTableStorage(ctx, userFileTableConf.FileTableConfig, conn.GetDriverConn())
 	if err != nil {
@@ -106,6 +106,8 @@ table_name NOT IN (
 	'predefined_comments',
 	'session_trace',
 	'session_variables',
+	'sql_activity_last_transfer',
+	'sql_activity_transfer_debug',
   'table_spans',
 	'tables',
 	'cluster_statement_statistics',
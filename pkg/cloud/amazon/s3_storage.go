@@ -13,11 +13,16 @@ package amazon
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -166,6 +171,23 @@ var usePutObject = settings.RegisterBoolSetting(
 	false,
 )
 
+var s3MultipartPartSize = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.s3.multipart.part_size",
+	"size of each part of a multipart upload to S3; 0 uses cloudstorage.write_chunk.size",
+	0,
+	settings.IntInRangeOrZeroDisable(5<<20, 5<<30),
+)
+
+var s3MultipartThreshold = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.s3.multipart.threshold",
+	"files larger than this size are uploaded to S3 with a multipart upload, and smaller files "+
+		"are buffered in memory and uploaded with a single request",
+	5<<20,
+	settings.NonNegativeInt,
+)
+
 // roleProvider contains fields about the role that needs to be assumed
 // in order to access the external storage.
 type roleProvider struct {
@@ -247,6 +269,16 @@ var s3ClientCache struct {
 }
 
 var _ cloud.ExternalStorage = &s3Storage{}
+var _ cloud.ChecksumReader = &s3Storage{}
+var _ cloud.OptionsWriter = &s3Storage{}
+var _ cloud.ResumableUploader = &s3Storage{}
+var _ cloud.ConditionalWriter = &s3Storage{}
+var _ cloud.DetailedLister = &s3Storage{}
+var _ cloud.PageLister = &s3Storage{}
+var _ cloud.Copier = &s3Storage{}
+var _ cloud.BatchDeleter = &s3Storage{}
+var _ cloud.Stater = &s3Storage{}
+var _ cloud.AccessChecker = &s3Storage{}
 
 type serverSideEncMode string
 
@@ -521,6 +553,9 @@ func newClient(
 		if conf.region == "" {
 			conf.region = "default-region"
 		}
+		// The STS requests made for assumed roles are sent to the endpoint too, and
+		// need the region before the session is made.
+		opts.Config.Region = aws.String(conf.region)
 
 		client, err := cloud.MakeHTTPClient(settings)
 		if err != nil {
@@ -608,7 +643,7 @@ func newClient(
 
 	c := s3.New(sess)
 	u := s3manager.NewUploader(sess, func(uploader *s3manager.Uploader) {
-		uploader.PartSize = cloud.WriteChunkSize.Get(&settings.SV)
+		uploader.PartSize = s3PartSize(&settings.SV)
 	})
 	return s3Client{client: c, uploader: u}, region, nil
 }
@@ -659,9 +694,10 @@ func (s *s3Storage) Settings() *cluster.Settings {
 }
 
 type putUploader struct {
-	b      *bytes.Buffer
-	client *s3.S3
-	input  *s3.PutObjectInput
+	b        *bytes.Buffer
+	client   *s3.S3
+	input    *s3.PutObjectInput
+	checksum cloud.ChecksumAlgo
 }
 
 func (u *putUploader) Write(p []byte) (int, error) {
@@ -670,70 +706,562 @@ func (u *putUploader) Write(p []byte) (int, error) {
 
 func (u *putUploader) Close() error {
 	u.input.Body = bytes.NewReader(u.b.Bytes())
-	_, err := u.client.PutObject(u.input)
-	return err
+	checksum, err := s3ChecksumOption(u.checksum, u.b.Bytes())
+	if err != nil {
+		return err
+	}
+	req, _ := u.client.PutObjectRequest(u.input)
+	req.ApplyOptions(checksum)
+	return req.Send()
 }
 
-func (s *s3Storage) putUploader(ctx context.Context, basename string) (io.WriteCloser, error) {
+func (s *s3Storage) putUploader(
+	ctx context.Context, basename string, opts cloud.WriteOptions,
+) (io.WriteCloser, error) {
 	client, err := s.getClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	enc := s.encryption(opts)
+	lock := s3ObjectLockOf(opts)
 	buf := bytes.NewBuffer(make([]byte, 0, 4<<20))
 
 	return &putUploader{
 		b: buf,
 		input: &s3.PutObjectInput{
-			Bucket:               s.bucket,
-			Key:                  aws.String(path.Join(s.prefix, basename)),
-			ServerSideEncryption: nilIfEmpty(s.conf.ServerEncMode),
-			SSEKMSKeyId:          nilIfEmpty(s.conf.ServerKMSID),
-			StorageClass:         nilIfEmpty(s.conf.StorageClass),
+			Bucket:                    s.bucket,
+			Key:                       aws.String(path.Join(s.prefix, basename)),
+			ServerSideEncryption:      enc.mode,
+			SSEKMSKeyId:               enc.kmsID,
+			SSECustomerAlgorithm:      enc.customerAlgorithm,
+			SSECustomerKey:            enc.customerKey,
+			StorageClass:              nilIfEmpty(s.storageClass(opts)),
+			ContentType:               nilIfEmpty(opts.ContentType),
+			Metadata:                  metadataToAWS(opts.Metadata),
+			Tagging:                   s3Tagging(opts),
+			ObjectLockMode:            lock.mode,
+			ObjectLockRetainUntilDate: lock.retainUntil,
+			ObjectLockLegalHoldStatus: lock.legalHold,
 		},
-		client: client,
+		client:   client,
+		checksum: opts.ChecksumAlgo,
 	}, nil
 }
 
 func (s *s3Storage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return s.WriterWithOptions(ctx, basename, cloud.WriteOptions{})
+}
+
+// WriterWithOptions implements the cloud.OptionsWriter interface. The
+// storage class and server-side encryption of opts override those of the URI.
+//
+// Objects locked by opts are written with an Object Lock, which requires the
+// bucket to have Object Lock enabled. The bucket retains the locked version of
+// an object when it is overwritten, but writing a locked object over a locked
+// object is rejected with cloud.ErrFileLocked rather than hiding its version
+// behind a new one.
+//
+// Writes verified with a CRC32C or SHA-256 checksum send the checksum of files
+// written with a single request in its x-amz-checksum header, so that s3
+// rejects the request if the bytes it received differ, and stores the
+// checksum. The SDK does not support the trailing checksums of multipart
+// uploads, so their parts are only verified with the Content-MD5 header the
+// SDK computes for each part.
+func (s *s3Storage) WriterWithOptions(
+	ctx context.Context, basename string, opts cloud.WriteOptions,
+) (io.WriteCloser, error) {
+	if err := checkS3SSEOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := cloud.CheckWriteChecksum("s3", opts, cloud.ChecksumCRC32C, cloud.ChecksumSHA256); err != nil {
+		return nil, err
+	}
+	if opts.LocksFile() {
+		if err := s.checkNotLocked(ctx, basename); err != nil {
+			return nil, err
+		}
+	}
 	if usePutObject.Get(&s.settings.SV) {
-		return s.putUploader(ctx, basename)
+		return s.putUploader(ctx, basename, opts)
 	}
 
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 	uploader, err := s.getUploader(ctx)
 	if err != nil {
 		return nil, err
 	}
+	partSize := s3PartSize(&s.settings.SV)
+	enc := s.encryption(opts)
+	lock := s3ObjectLockOf(opts)
 
 	ctx, sp := tracing.ChildSpan(ctx, "s3.Writer")
 	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
-	return cloud.BackgroundPipe(ctx, func(ctx context.Context, r io.Reader) error {
-		defer sp.Finish()
-		// Upload the file to S3.
-		// TODO(dt): test and tune the uploader parameters.
-		_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+	// Files up to the threshold are written with PutObject. Larger files are
+	// written with a multipart upload, which the uploader aborts if the upload
+	// fails, including if the writer is closed after its context is canceled,
+	// so that no parts are left behind.
+	return cloud.ThresholdWriter(ctx, s3MultipartThreshold.Get(&s.settings.SV),
+		func(ctx context.Context, data []byte) error {
+			defer sp.Finish()
+			checksum, err := s3ChecksumOption(opts.ChecksumAlgo, data)
+			if err != nil {
+				return err
+			}
+			_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+				Bucket:                    s.bucket,
+				Key:                       aws.String(path.Join(s.prefix, basename)),
+				Body:                      bytes.NewReader(data),
+				ServerSideEncryption:      enc.mode,
+				SSEKMSKeyId:               enc.kmsID,
+				SSECustomerAlgorithm:      enc.customerAlgorithm,
+				SSECustomerKey:            enc.customerKey,
+				StorageClass:              nilIfEmpty(s.storageClass(opts)),
+				ContentType:               nilIfEmpty(opts.ContentType),
+				Metadata:                  metadataToAWS(opts.Metadata),
+				Tagging:                   s3Tagging(opts),
+				ObjectLockMode:            lock.mode,
+				ObjectLockRetainUntilDate: lock.retainUntil,
+				ObjectLockLegalHoldStatus: lock.legalHold,
+			}, checksum)
+			err = interpretAWSError(err)
+			return errors.Wrap(err, "upload failed")
+		},
+		func(ctx context.Context, r io.Reader) error {
+			defer sp.Finish()
+			_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+				Bucket:                    s.bucket,
+				Key:                       aws.String(path.Join(s.prefix, basename)),
+				Body:                      r,
+				ServerSideEncryption:      enc.mode,
+				SSEKMSKeyId:               enc.kmsID,
+				SSECustomerAlgorithm:      enc.customerAlgorithm,
+				SSECustomerKey:            enc.customerKey,
+				StorageClass:              nilIfEmpty(s.storageClass(opts)),
+				ContentType:               nilIfEmpty(opts.ContentType),
+				Metadata:                  metadataToAWS(opts.Metadata),
+				Tagging:                   s3Tagging(opts),
+				ObjectLockMode:            lock.mode,
+				ObjectLockRetainUntilDate: lock.retainUntil,
+				ObjectLockLegalHoldStatus: lock.legalHold,
+			}, func(u *s3manager.Uploader) {
+				u.PartSize = partSize
+				u.LeavePartsOnError = false
+			})
+			err = interpretAWSError(err)
+			return errors.Wrap(err, "upload failed")
+		}), nil
+}
+
+// s3ChecksumHeader returns the header of the checksum of an object computed
+// with algo, or an empty string if s3 does not support the algorithm.
+func s3ChecksumHeader(algo cloud.ChecksumAlgo) string {
+	switch algo {
+	case cloud.ChecksumCRC32C:
+		return "X-Amz-Checksum-Crc32c"
+	case cloud.ChecksumSHA256:
+		return "X-Amz-Checksum-Sha256"
+	default:
+		return ""
+	}
+}
+
+// s3ChecksumOption returns a request option sending the checksum of data
+// computed with algo, if set, for s3 to verify the body of the request.
+func s3ChecksumOption(algo cloud.ChecksumAlgo, data []byte) (request.Option, error) {
+	if algo == 0 {
+		return func(*request.Request) {}, nil
+	}
+	h, err := algo.NewHash()
+	if err != nil {
+		return nil, err
+	}
+	_, _ = h.Write(data)
+	checksum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set(s3ChecksumHeader(algo), checksum)
+	}, nil
+}
+
+// s3ResumeToken is the JSON encoded token resuming a multipart upload.
+type s3ResumeToken struct {
+	Key      string           `json:"key"`
+	UploadID string           `json:"uploadId"`
+	Parts    []s3UploadedPart `json:"parts"`
+}
+
+// s3UploadedPart is a part of a multipart upload which was uploaded.
+type s3UploadedPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// s3ResumableWriter writes a file with a multipart upload, buffering the
+// written bytes until a part is full and uploading the parts one at a time.
+type s3ResumableWriter struct {
+	ctx      context.Context
+	client   *s3.S3
+	bucket   *string
+	partSize int64
+	enc      s3Encryption
+	token    s3ResumeToken
+	buf      []byte
+	closed   bool
+}
+
+var _ cloud.ResumableWriter = &s3ResumableWriter{}
+
+// ResumableWriter implements the cloud.ResumableUploader interface. The upload
+// is written with the storage class and server-side encryption of the URI.
+// Resuming an upload lists its parts, to verify that the parts of the token
+// were not lost, such as if the upload was aborted.
+func (s *s3Storage) ResumableWriter(
+	ctx context.Context, basename string, token []byte,
+) (cloud.ResumableWriter, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w := &s3ResumableWriter{
+		ctx:      ctx,
+		client:   client,
+		bucket:   s.bucket,
+		partSize: s3PartSize(&s.settings.SV),
+		enc:      s.encryption(cloud.WriteOptions{}),
+		token:    s3ResumeToken{Key: path.Join(s.prefix, basename)},
+	}
+	if token == nil {
+		out, err := client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
 			Bucket:               s.bucket,
-			Key:                  aws.String(path.Join(s.prefix, basename)),
-			Body:                 r,
-			ServerSideEncryption: nilIfEmpty(s.conf.ServerEncMode),
-			SSEKMSKeyId:          nilIfEmpty(s.conf.ServerKMSID),
+			Key:                  aws.String(w.token.Key),
+			ServerSideEncryption: w.enc.mode,
+			SSEKMSKeyId:          w.enc.kmsID,
+			SSECustomerAlgorithm: w.enc.customerAlgorithm,
+			SSECustomerKey:       w.enc.customerKey,
 			StorageClass:         nilIfEmpty(s.conf.StorageClass),
 		})
-		err = interpretAWSError(err)
-		return errors.Wrap(err, "upload failed")
-	}), nil
+		if err != nil {
+			return nil, errors.Wrap(interpretAWSError(err), "failed to create s3 multipart upload")
+		}
+		w.token.UploadID = aws.StringValue(out.UploadId)
+		return w, nil
+	}
+
+	var resumed s3ResumeToken
+	if err := json.Unmarshal(token, &resumed); err != nil {
+		return nil, errors.Wrap(err, "decoding s3 resume token")
+	}
+	if resumed.Key != w.token.Key {
+		return nil, errors.Newf("s3 resume token is for %s, not %s", resumed.Key, w.token.Key)
+	}
+	uploaded := make(map[int64]string)
+	if err := client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:               s.bucket,
+		Key:                  aws.String(resumed.Key),
+		UploadId:             aws.String(resumed.UploadID),
+		SSECustomerAlgorithm: w.enc.customerAlgorithm,
+		SSECustomerKey:       w.enc.customerKey,
+	}, func(page *s3.ListPartsOutput, _ bool) bool {
+		for _, part := range page.Parts {
+			uploaded[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+		return true
+	}); err != nil {
+		return nil, errors.Wrapf(interpretAWSError(err), "failed to resume s3 multipart upload %s", resumed.UploadID)
+	}
+	for _, part := range resumed.Parts {
+		if uploaded[part.Number] != part.ETag {
+			return nil, errors.Newf("part %d of s3 multipart upload %s was not uploaded",
+				part.Number, resumed.UploadID)
+		}
+	}
+	w.token = resumed
+	return w, nil
+}
+
+// Write implements the io.Writer interface, uploading each part once it is
+// full.
+func (w *s3ResumableWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed s3 writer")
+	}
+	w.buf = append(w.buf, p...)
+	for int64(len(w.buf)) >= w.partSize {
+		if err := w.uploadPart(w.buf[:w.partSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[w.partSize:]...)
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads data as the next part of the upload.
+func (w *s3ResumableWriter) uploadPart(data []byte) error {
+	number := int64(len(w.token.Parts)) + 1
+	out, err := w.client.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
+		Bucket:               w.bucket,
+		Key:                  aws.String(w.token.Key),
+		UploadId:             aws.String(w.token.UploadID),
+		PartNumber:           aws.Int64(number),
+		Body:                 bytes.NewReader(data),
+		SSECustomerAlgorithm: w.enc.customerAlgorithm,
+		SSECustomerKey:       w.enc.customerKey,
+	})
+	if err != nil {
+		return errors.Wrapf(interpretAWSError(err), "failed to upload part %d of s3 multipart upload", number)
+	}
+	w.token.Parts = append(w.token.Parts, s3UploadedPart{
+		Number: number,
+		ETag:   aws.StringValue(out.ETag),
+		Size:   int64(len(data)),
+	})
+	return nil
+}
+
+// Close uploads the buffered bytes as the last part and completes the
+// upload. If it fails, the uploaded parts are left behind so that the upload
+// can be resumed.
+func (w *s3ResumableWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	// An upload has at least one part, which may be empty.
+	if len(w.buf) > 0 || len(w.token.Parts) == 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			return err
+		}
+	}
+	parts := make([]*s3.CompletedPart, len(w.token.Parts))
+	for i, part := range w.token.Parts {
+		parts[i] = &s3.CompletedPart{PartNumber: aws.Int64(part.Number), ETag: aws.String(part.ETag)}
+	}
+	_, err := w.client.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          w.bucket,
+		Key:             aws.String(w.token.Key),
+		UploadId:        aws.String(w.token.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return errors.Wrap(interpretAWSError(err), "failed to complete s3 multipart upload")
+}
+
+// ResumeToken implements the cloud.ResumableWriter interface.
+func (w *s3ResumableWriter) ResumeToken() ([]byte, int64, error) {
+	var offset int64
+	for _, part := range w.token.Parts {
+		offset += part.Size
+	}
+	token, err := json.Marshal(w.token)
+	if err != nil {
+		return nil, 0, err
+	}
+	return token, offset, nil
+}
+
+// Abort implements the cloud.ResumableWriter interface.
+func (w *s3ResumableWriter) Abort(ctx context.Context) error {
+	w.closed = true
+	_, err := w.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   w.bucket,
+		Key:      aws.String(w.token.Key),
+		UploadId: aws.String(w.token.UploadID),
+	})
+	return errors.Wrap(interpretAWSError(err), "failed to abort s3 multipart upload")
+}
+
+// s3ObjectLock is the Object Lock of the objects written with some
+// cloud.WriteOptions.
+type s3ObjectLock struct {
+	mode        *string
+	retainUntil *time.Time
+	legalHold   *string
+}
+
+// s3ObjectLockOf returns the Object Lock of objects written with opts. The
+// retention is in compliance mode, so that no user can shorten it.
+func s3ObjectLockOf(opts cloud.WriteOptions) s3ObjectLock {
+	var lock s3ObjectLock
+	if !opts.RetainUntil.IsZero() {
+		lock.mode = aws.String(s3.ObjectLockModeCompliance)
+		lock.retainUntil = aws.Time(opts.RetainUntil)
+	}
+	if opts.LegalHold {
+		lock.legalHold = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	return lock
+}
+
+// checkNotLocked returns an error marked with cloud.ErrFileLocked if the named
+// object exists and is locked by a retention period or a legal hold.
+func (s *s3Storage) checkNotLocked(ctx context.Context, basename string) error {
+	out, err := s.headObject(ctx, basename)
+	if err != nil {
+		if errors.Is(err, cloud.ErrFileDoesNotExist) {
+			return nil
+		}
+		return err
+	}
+	if aws.StringValue(out.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn {
+		return errors.Mark(errors.Newf("s3 object %s is under a legal hold",
+			path.Join(s.prefix, basename)), cloud.ErrFileLocked)
+	}
+	if retainUntil := aws.TimeValue(out.ObjectLockRetainUntilDate); retainUntil.After(timeutil.Now()) {
+		return errors.Mark(errors.Newf("s3 object %s is retained until %s",
+			path.Join(s.prefix, basename), retainUntil), cloud.ErrFileLocked)
+	}
+	return nil
+}
+
+// s3PartSize returns the size of the parts of multipart uploads.
+func s3PartSize(sv *settings.Values) int64 {
+	if partSize := s3MultipartPartSize.Get(sv); partSize != 0 {
+		return partSize
+	}
+	return cloud.WriteChunkSize.Get(sv)
+}
+
+// s3ListPageSize is the number of keys returned by a ListObjectsV2 request.
+const s3ListPageSize = 1000
+
+var _ cloud.CostEstimator = &s3Storage{}
+
+// EstimateListCost implements the cloud.CostEstimator interface. Files are
+// listed with a ListObjectsV2 request per page, which s3 bills as a PUT.
+func (s *s3Storage) EstimateListCost(files int64) (cloud.Cost, error) {
+	return cloud.Cost{WriteRequests: cloud.Batches(files, s3ListPageSize)}, nil
+}
+
+// EstimateReadCost implements the cloud.CostEstimator interface. A file is
+// read with a GET, and its bytes are transferred out of s3.
+func (s *s3Storage) EstimateReadCost(bytes int64) (cloud.Cost, error) {
+	return cloud.Cost{ReadRequests: 1, TransferBytes: bytes}, nil
+}
+
+// EstimateWriteCost implements the cloud.CostEstimator interface. Files up to
+// the multipart threshold are written with a PutObject, and larger ones with
+// a multipart upload, which takes a request to create and complete it in
+// addition to one per part. Transfers into s3 are free.
+func (s *s3Storage) EstimateWriteCost(bytes int64) (cloud.Cost, error) {
+	sv := &s.settings.SV
+	if usePutObject.Get(sv) || bytes <= s3MultipartThreshold.Get(sv) {
+		return cloud.Cost{WriteRequests: 1}, nil
+	}
+	return cloud.Cost{WriteRequests: 2 + cloud.Batches(bytes, s3PartSize(sv))}, nil
+}
+
+// s3Tagging returns the tag set, encoded as URL query parameters, of objects
+// written with opts, or nil if they are not tagged.
+func s3Tagging(opts cloud.WriteOptions) *string {
+	if opts.ExpireAfter <= 0 {
+		return nil
+	}
+	tags := url.Values{cloud.ExpireAfterDaysKey: {cloud.ExpireAfterDays(opts.ExpireAfter)}}
+	return aws.String(tags.Encode())
+}
+
+// storageClass returns the storage class objects written with opts are
+// stored in.
+func (s *s3Storage) storageClass(opts cloud.WriteOptions) string {
+	if opts.StorageClass != "" {
+		return opts.StorageClass
+	}
+	return s.conf.StorageClass
+}
+
+// s3Encryption is the server-side encryption of the requests writing an
+// object.
+type s3Encryption struct {
+	mode, kmsID                    *string
+	customerAlgorithm, customerKey *string
+}
+
+// checkS3SSEOptions returns an error if the server-side encryption options of
+// opts are not supported by s3.
+func checkS3SSEOptions(opts cloud.WriteOptions) error {
+	if err := cloud.CheckSSEOptions(opts); err != nil {
+		return err
+	}
+	switch serverSideEncMode(opts.SSEAlgorithm) {
+	case "", kmsEnc:
+	case aes256Enc:
+		if opts.SSEKMSKeyID != "" {
+			return errors.Newf("KMS key ID cannot be used with %s server side encryption", aes256Enc)
+		}
+	default:
+		return errors.Newf("unsupported server encryption mode %s. "+
+			"Supported values are `aws:kms` and `AES256`.", opts.SSEAlgorithm)
+	}
+	return nil
+}
+
+// encryption returns the server-side encryption of objects written with opts.
+// A customer-provided key replaces the encryption of the URI, while a KMS key
+// ID or algorithm overrides it.
+func (s *s3Storage) encryption(opts cloud.WriteOptions) s3Encryption {
+	if opts.SSECustomerKey != nil {
+		return customerKeyEncryption(opts.SSECustomerKey)
+	}
+	mode, kmsID := s.conf.ServerEncMode, s.conf.ServerKMSID
+	switch {
+	case opts.SSEKMSKeyID != "":
+		mode, kmsID = string(kmsEnc), opts.SSEKMSKeyID
+	case opts.SSEAlgorithm != "" && opts.SSEAlgorithm != mode:
+		mode, kmsID = opts.SSEAlgorithm, ""
+	}
+	return s3Encryption{mode: nilIfEmpty(mode), kmsID: nilIfEmpty(kmsID)}
+}
+
+// customerKeyEncryption returns the encryption of requests using a
+// customer-provided key. The SDK adds the MD5 digest of the key.
+func customerKeyEncryption(key []byte) s3Encryption {
+	if key == nil {
+		return s3Encryption{}
+	}
+	return s3Encryption{
+		customerAlgorithm: aws.String(string(aes256Enc)),
+		customerKey:       aws.String(string(key)),
+	}
+}
+
+// metadataToAWS converts user-defined metadata to the map of the AWS SDK.
+func metadataToAWS(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	return aws.StringMap(metadata)
 }
 
 // openStreamAt opens a stream of object data, starting at offset <pos>.
 // If endPos is non-zero, returns data up to that offset (exclusive).
 func (s *s3Storage) openStreamAt(
-	ctx context.Context, basename string, pos int64, endPos int64,
+	ctx context.Context, basename string, pos int64, endPos int64, customerKey []byte,
+) (*s3.GetObjectOutput, error) {
+	return s.openVersionStreamAt(ctx, basename, "" /* versionID */, pos, endPos, customerKey)
+}
+
+// openVersionStreamAt is like openStreamAt, for the given version of the
+// object, or the current version if versionID is empty.
+func (s *s3Storage) openVersionStreamAt(
+	ctx context.Context, basename, versionID string, pos int64, endPos int64, customerKey []byte,
 ) (*s3.GetObjectOutput, error) {
 	client, err := s.getClient(ctx)
 	if err != nil {
 		return nil, err
 	}
-	req := &s3.GetObjectInput{Bucket: s.bucket, Key: aws.String(path.Join(s.prefix, basename))}
+	enc := customerKeyEncryption(customerKey)
+	req := &s3.GetObjectInput{
+		Bucket:               s.bucket,
+		Key:                  aws.String(path.Join(s.prefix, basename)),
+		SSECustomerAlgorithm: enc.customerAlgorithm,
+		SSECustomerKey:       enc.customerKey,
+	}
+	if versionID != "" {
+		req.VersionId = aws.String(versionID)
+	}
 	if endPos != 0 {
 		if pos >= endPos {
 			return nil, io.EOF
@@ -770,7 +1298,7 @@ func (s *s3Storage) ReadFile(
 		endOffset = opts.Offset + opts.LengthHint
 	}
 
-	stream, err := s.openStreamAt(ctx, basename, opts.Offset, endOffset)
+	stream, err := s.openStreamAt(ctx, basename, opts.Offset, endOffset, opts.SSECustomerKey)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -801,7 +1329,7 @@ func (s *s3Storage) ReadFile(
 		}
 	}
 	opener := func(ctx context.Context, pos int64) (io.ReadCloser, int64, error) {
-		s, err := s.openStreamAt(ctx, basename, pos, endOffset)
+		s, err := s.openStreamAt(ctx, basename, pos, endOffset, opts.SSECustomerKey)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -811,8 +1339,303 @@ func (s *s3Storage) ReadFile(
 		cloud.ResumingReaderRetryOnErrFnForSettings(ctx, s.settings), s3ErrDelay), fileSize, nil
 }
 
+var _ cloud.Versioner = &s3Storage{}
+
+// ReadFileAtVersion implements the cloud.Versioner interface. The version is
+// read with GetObject requests for its version ID.
+func (s *s3Storage) ReadFileAtVersion(
+	ctx context.Context, basename, versionID string, offset int64,
+) (ioctx.ReadCloserCtx, int64, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "s3.ReadFileAtVersion")
+	defer sp.Finish()
+
+	path := path.Join(s.prefix, basename)
+	sp.SetTag("path", attribute.StringValue(path))
+	sp.SetTag("version", attribute.StringValue(versionID))
+
+	stream, err := s.openVersionStreamAt(ctx, basename, versionID, offset, 0 /* endPos */, nil /* customerKey */)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	if offset != 0 {
+		if stream.ContentRange == nil {
+			return nil, 0, errors.New("expected content range for read at offset")
+		}
+		if size, err = cloud.CheckHTTPContentRangeHeader(*stream.ContentRange, offset); err != nil {
+			return nil, 0, err
+		}
+	} else if stream.ContentLength != nil {
+		size = *stream.ContentLength
+	}
+	opener := func(ctx context.Context, pos int64) (io.ReadCloser, int64, error) {
+		s, err := s.openVersionStreamAt(ctx, basename, versionID, pos, 0 /* endPos */, nil /* customerKey */)
+		if err != nil {
+			return nil, 0, err
+		}
+		return s.Body, size, nil
+	}
+	return cloud.NewResumingReader(ctx, opener, stream.Body, offset, size, path,
+		cloud.ResumingReaderRetryOnErrFnForSettings(ctx, s.settings), s3ErrDelay), size, nil
+}
+
+// DeleteVersion implements the cloud.Versioner interface. The version is
+// deleted with a DeleteObject request for its version ID, which, unlike a
+// DeleteObject request without one, does not add a delete marker.
+func (s *s3Storage) DeleteVersion(ctx context.Context, basename, versionID string) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	return timeutil.RunWithTimeout(ctx, "delete s3 object version",
+		cloud.Timeout.Get(&s.settings.SV),
+		func(ctx context.Context) error {
+			_, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket:    s.bucket,
+				Key:       aws.String(path.Join(s.prefix, basename)),
+				VersionId: aws.String(versionID),
+			})
+			return interpretAWSError(err)
+		})
+}
+
+// WriteFileIfNotExists implements the cloud.ConditionalWriter interface. The
+// object is written with a PutObject request with an If-None-Match: *
+// header. S3 compatible services which ignore the header overwrite the
+// object.
+func (s *s3Storage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "s3.WriteFileIfNotExists")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
+
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	req, _ := client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:               s.bucket,
+		Key:                  aws.String(path.Join(s.prefix, basename)),
+		Body:                 content,
+		ServerSideEncryption: nilIfEmpty(s.conf.ServerEncMode),
+		SSEKMSKeyId:          nilIfEmpty(s.conf.ServerKMSID),
+		StorageClass:         nilIfEmpty(s.conf.StorageClass),
+	})
+	req.SetContext(ctx)
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	if err := req.Send(); err != nil {
+		// S3 returns 412 if the object exists, and 409 if a concurrent
+		// conditional write of the object is in progress.
+		var s3err s3.RequestFailure
+		if errors.As(err, &s3err) &&
+			(s3err.StatusCode() == http.StatusPreconditionFailed || s3err.StatusCode() == http.StatusConflict) {
+			return false, nil
+		}
+		err = interpretAWSError(err)
+		return false, errors.Wrap(err, "failed to put s3 object")
+	}
+	return true, nil
+}
+
+// WriteFileIfMatch implements the cloud.ConditionalWriter interface. The object
+// is written with a PutObject request with an If-Match header. S3 compatible
+// services which ignore the header overwrite the object.
+func (s *s3Storage) WriteFileIfMatch(
+	ctx context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	ctx, sp := tracing.ChildSpan(ctx, "s3.WriteFileIfMatch")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
+
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	req, _ := client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:               s.bucket,
+		Key:                  aws.String(path.Join(s.prefix, basename)),
+		Body:                 content,
+		ServerSideEncryption: nilIfEmpty(s.conf.ServerEncMode),
+		SSEKMSKeyId:          nilIfEmpty(s.conf.ServerKMSID),
+		StorageClass:         nilIfEmpty(s.conf.StorageClass),
+	})
+	req.SetContext(ctx)
+	// The ETags returned by Stat and ListDetailed are unquoted.
+	req.HTTPRequest.Header.Set("If-Match", `"`+expectedETag+`"`)
+	if err := req.Send(); err != nil {
+		// S3 returns 412 if the ETag does not match, 404 if the object does
+		// not exist, and 409 if a concurrent conditional write of the object
+		// is in progress.
+		var s3err s3.RequestFailure
+		if errors.As(err, &s3err) {
+			switch s3err.StatusCode() {
+			case http.StatusPreconditionFailed, http.StatusNotFound, http.StatusConflict:
+				return errors.Mark(errors.Wrapf(err, "s3 object %s was not written", basename),
+					cloud.ErrPreconditionFailed)
+			}
+		}
+		err = interpretAWSError(err)
+		return errors.Wrap(err, "failed to put s3 object")
+	}
+	return nil
+}
+
+// ReadFileSuffix implements the cloud.SuffixReader interface. The suffix is
+// requested with a suffix range, and the size of the object is taken from the
+// Content-Range header of the response.
+func (s *s3Storage) ReadFileSuffix(
+	ctx context.Context, basename string, n int64,
+) (io.ReadCloser, int64, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "s3.ReadFileSuffix")
+	defer sp.Finish()
+
+	key := path.Join(s.prefix, basename)
+	sp.SetTag("path", attribute.StringValue(key))
+	// Empty suffix ranges can't be satisfied.
+	if n == 0 {
+		return cloud.ReadFileSuffixFromSize(ctx, s, basename, n)
+	}
+
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=-%d", n)),
+	})
+	if err != nil {
+		// Neither can the suffix ranges of empty objects.
+		if aerr := (awserr.Error)(nil); errors.As(err, &aerr) && aerr.Code() == "InvalidRange" {
+			return cloud.ReadFileSuffixFromSize(ctx, s, basename, n)
+		}
+		err = interpretAWSError(err)
+		if errors.Is(err, cloud.ErrFileDoesNotExist) {
+			err = errors.Wrap(err, "s3 object does not exist")
+		}
+		return nil, 0, errors.Wrap(err, "failed to get s3 object")
+	}
+
+	if out.ContentRange == nil {
+		// S3 compatible services which ignore the range return the whole object.
+		size := aws.Int64Value(out.ContentLength)
+		if size > n {
+			if _, err := io.CopyN(io.Discard, out.Body, size-n); err != nil {
+				_ = out.Body.Close()
+				return nil, 0, errors.Wrap(err, "skipping to the suffix of the s3 object")
+			}
+		}
+		return out.Body, size, nil
+	}
+	h := *out.ContentRange
+	slash := strings.LastIndexByte(h, '/')
+	if slash < 0 {
+		_ = out.Body.Close()
+		return nil, 0, errors.Errorf("malformed Content-Range header: %s", h)
+	}
+	size, err := strconv.ParseInt(h[slash+1:], 10, 64)
+	if err != nil {
+		_ = out.Body.Close()
+		return nil, 0, errors.Errorf("malformed size in Content-Range header: %s", h)
+	}
+	return out.Body, size, nil
+}
+
+// ReadFileWithChecksum implements the cloud.ChecksumReader interface. If
+// expected is nil, the CRC32C or SHA-256 checksum is the one stored by s3 for
+// objects written with WriteOptions.ChecksumAlgo, and the MD5 checksum is
+// taken from the ETag of the object. The ETag is only the MD5 digest of
+// objects which were uploaded in a single part and are not encrypted with
+// SSE-KMS, so other objects need an expected checksum.
+func (s *s3Storage) ReadFileWithChecksum(
+	ctx context.Context, basename string, expected []byte, algo cloud.ChecksumAlgo,
+) (io.ReadCloser, error) {
+	if expected == nil {
+		var err error
+		if expected, err = s.storedChecksum(ctx, basename, algo); err != nil {
+			return nil, err
+		}
+	}
+	return cloud.ReadFileWithChecksumFromReadFile(ctx, s, basename, expected, algo)
+}
+
+// storedChecksum returns the checksum of an object written with a checksum, or
+// the MD5 checksum of a single part upload from its ETag.
+func (s *s3Storage) storedChecksum(
+	ctx context.Context, basename string, algo cloud.ChecksumAlgo,
+) ([]byte, error) {
+	if header := s3ChecksumHeader(algo); header != "" {
+		return s.storedObjectChecksum(ctx, basename, algo, header)
+	}
+	if algo != cloud.ChecksumMD5 {
+		return nil, errors.Newf("s3 does not store %s checksums, an expected checksum is required", algo)
+	}
+	if s.conf.ServerEncMode == "aws:kms" {
+		return nil, errors.New("the ETag of s3 objects encrypted with SSE-KMS is not an md5 checksum")
+	}
+	out, err := s.headObject(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	etag := strings.Trim(aws.StringValue(out.ETag), `"`)
+	if strings.Contains(etag, "-") {
+		return nil, errors.Newf("s3 object %s was uploaded in multiple parts and has no md5 checksum", basename)
+	}
+	checksum, err := hex.DecodeString(etag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "s3 object %s has a malformed ETag %q", basename, etag)
+	}
+	return checksum, nil
+}
+
+// storedObjectChecksum returns the checksum of an object written with the
+// checksum in the given header. Its checksum is only returned if requested.
+func (s *s3Storage) storedObjectChecksum(
+	ctx context.Context, basename string, algo cloud.ChecksumAlgo, header string,
+) ([]byte, error) {
+	var stored string
+	if _, err := s.headObject(ctx, basename, func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.HTTPResponse != nil {
+				stored = r.HTTPResponse.Header.Get(header)
+			}
+		})
+	}); err != nil {
+		return nil, err
+	}
+	if stored == "" {
+		return nil, errors.Newf(
+			"s3 object %s was not written with a %s checksum, an expected checksum is required", basename, algo)
+	}
+	checksum, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return nil, errors.Wrapf(err, "s3 object %s has a malformed %s checksum %q", basename, algo, stored)
+	}
+	return checksum, nil
+}
+
 func (s *s3Storage) List(ctx context.Context, prefix, delim string, fn cloud.ListingFn) error {
-	ctx, sp := tracing.ChildSpan(ctx, "s3.List")
+	return s.list(ctx, "s3.List", prefix, delim, func(info cloud.ObjectInfo) error {
+		return fn(info.Name)
+	})
+}
+
+// ListDetailed implements the cloud.DetailedLister interface. The size,
+// modification time, ETag and storage class of the objects are those of the
+// listing response.
+func (s *s3Storage) ListDetailed(
+	ctx context.Context, prefix, delim string, fn cloud.ListingDetailedFn,
+) error {
+	return s.list(ctx, "s3.ListDetailed", prefix, delim, fn)
+}
+
+func (s *s3Storage) list(
+	ctx context.Context, opName, prefix, delim string, fn cloud.ListingDetailedFn,
+) error {
+	ctx, sp := tracing.ChildSpan(ctx, opName)
 	defer sp.Finish()
 
 	dest := cloud.JoinPathPreservingTrailingSlash(s.prefix, prefix)
@@ -826,12 +1649,21 @@ func (s *s3Storage) List(ctx context.Context, prefix, delim string, fn cloud.Lis
 	var fnErr error
 	pageFn := func(page *s3.ListObjectsOutput, lastPage bool) bool {
 		for _, x := range page.CommonPrefixes {
-			if fnErr = fn(strings.TrimPrefix(*x.Prefix, dest)); fnErr != nil {
+			if fnErr = fn(cloud.ObjectInfo{Name: strings.TrimPrefix(*x.Prefix, dest)}); fnErr != nil {
 				return false
 			}
 		}
 		for _, fileObject := range page.Contents {
-			if fnErr = fn(strings.TrimPrefix(*fileObject.Key, dest)); fnErr != nil {
+			info := cloud.ObjectInfo{
+				Name:    strings.TrimPrefix(*fileObject.Key, dest),
+				Size:    aws.Int64Value(fileObject.Size),
+				ModTime: aws.TimeValue(fileObject.LastModified),
+				ETag:    strings.Trim(aws.StringValue(fileObject.ETag), `"`),
+			}
+			if fileObject.StorageClass != nil {
+				info.Extra = map[string]string{"storage-class": *fileObject.StorageClass}
+			}
+			if fnErr = fn(info); fnErr != nil {
 				return false
 			}
 		}
@@ -860,6 +1692,57 @@ func (s *s3Storage) List(ctx context.Context, prefix, delim string, fn cloud.Lis
 	return fnErr
 }
 
+// ListPage implements the cloud.PageLister interface. The page token is
+// the S3 continuation token.
+func (s *s3Storage) ListPage(
+	ctx context.Context, prefix, delim, pageToken string, maxResults int,
+) ([]string, string, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "s3.ListPage")
+	defer sp.Finish()
+
+	dest := cloud.JoinPathPreservingTrailingSlash(s.prefix, prefix)
+	sp.SetTag("path", attribute.StringValue(dest))
+
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if maxResults <= 0 {
+		maxResults = cloud.DefaultListPageSize
+	}
+	s3Input := &s3.ListObjectsV2Input{
+		Bucket:            s.bucket,
+		Prefix:            aws.String(dest),
+		Delimiter:         nilIfEmpty(delim),
+		MaxKeys:           aws.Int64(int64(maxResults)),
+		ContinuationToken: nilIfEmpty(pageToken),
+	}
+	// See List for the purpose of this toggle.
+	if envutil.EnvOrDefaultBool("COCKROACH_S3_LIST_WITH_PREFIX_SLASH_MARKER", false) {
+		s3Input.StartAfter = aws.String(dest + "/")
+	}
+
+	page, err := client.ListObjectsV2WithContext(ctx, s3Input)
+	if err != nil {
+		err = interpretAWSError(err)
+		return nil, "", errors.Wrap(err, `failed to list s3 bucket`)
+	}
+
+	results := make([]string, 0, len(page.CommonPrefixes)+len(page.Contents))
+	for _, x := range page.CommonPrefixes {
+		results = append(results, strings.TrimPrefix(*x.Prefix, dest))
+	}
+	for _, fileObject := range page.Contents {
+		results = append(results, strings.TrimPrefix(*fileObject.Key, dest))
+	}
+	var nextPageToken string
+	if aws.BoolValue(page.IsTruncated) {
+		nextPageToken = aws.StringValue(page.NextContinuationToken)
+	}
+	return results, nextPageToken, nil
+}
+
 // interpretAWSError attempts to surface safe information that otherwise would be redacted
 func interpretAWSError(err error) error {
 	if err == nil {
@@ -882,8 +1765,17 @@ func interpretAWSError(err error) error {
 			err = errors.Wrapf(err, "%v", code)
 
 			switch code {
+			case "InvalidRequest":
+				// Objects locked by cloud.WriteOptions can only be written to
+				// buckets with Object Lock enabled.
+				if strings.Contains(aerr.Message(), "Object Lock") {
+					err = errors.WithHint(err,
+						"files can only be retained or placed under a legal hold in buckets with Object Lock enabled")
+				}
 			// Relevant 404 errors reported by AWS.
-			case s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchKey:
+			// HeadObject responses have no body, so their 404 errors carry
+			// the generic NotFound code.
+			case s3.ErrCodeNoSuchBucket, s3.ErrCodeNoSuchKey, "NotFound":
 				// nolint:errwrap
 				err = errors.Wrapf(
 					errors.Wrap(cloud.ErrFileDoesNotExist, "s3 object does not exist"),
@@ -897,6 +1789,34 @@ func interpretAWSError(err error) error {
 	return err
 }
 
+// Copy implements the cloud.Copier interface. The object is copied
+// with CopyObject, which is limited to objects of up to 5 GiB.
+func (s *s3Storage) Copy(ctx context.Context, srcBasename, dstBasename string) error {
+	if err := cloud.CheckCopyBasenames(srcBasename, dstBasename); err != nil {
+		return err
+	}
+	ctx, sp := tracing.ChildSpan(ctx, "s3.Copy")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, dstBasename)))
+
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:               s.bucket,
+		Key:                  aws.String(path.Join(s.prefix, dstBasename)),
+		CopySource:           aws.String(url.PathEscape(path.Join(*s.bucket, s.prefix, srcBasename))),
+		ServerSideEncryption: nilIfEmpty(s.conf.ServerEncMode),
+		SSEKMSKeyId:          nilIfEmpty(s.conf.ServerKMSID),
+		StorageClass:         nilIfEmpty(s.conf.StorageClass),
+	}); err != nil {
+		err = interpretAWSError(err)
+		return errors.Wrap(err, "failed to copy s3 object")
+	}
+	return nil
+}
+
 func (s *s3Storage) Delete(ctx context.Context, basename string) error {
 	client, err := s.getClient(ctx)
 	if err != nil {
@@ -913,11 +1833,218 @@ func (s *s3Storage) Delete(ctx context.Context, basename string) error {
 		})
 }
 
-func (s *s3Storage) Size(ctx context.Context, basename string) (int64, error) {
+// s3MaxDeleteObjects is the maximum number of keys of a DeleteObjects request.
+const s3MaxDeleteObjects = 1000
+
+// BatchDelete implements the cloud.BatchDeleter interface. The objects are
+// deleted with DeleteObjects requests of up to 1000 keys. If a request fails
+// as a whole, all the files of the request are reported as failed.
+func (s *s3Storage) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]cloud.DeleteResult, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "s3.BatchDelete")
+	defer sp.Finish()
+
 	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]cloud.DeleteResult, len(basenames))
+	for start := 0; start < len(basenames); start += s3MaxDeleteObjects {
+		end := start + s3MaxDeleteObjects
+		if end > len(basenames) {
+			end = len(basenames)
+		}
+
+		// A key may be passed more than once, but is only sent once.
+		indexes := make(map[string][]int, end-start)
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for i := start; i < end; i++ {
+			results[i].Basename = basenames[i]
+			key := path.Join(s.prefix, basenames[i])
+			if _, ok := indexes[key]; !ok {
+				objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+			}
+			indexes[key] = append(indexes[key], i)
+		}
+
+		var out *s3.DeleteObjectsOutput
+		err := timeutil.RunWithTimeout(ctx, "delete s3 objects",
+			cloud.Timeout.Get(&s.settings.SV),
+			func(ctx context.Context) error {
+				var err error
+				out, err = client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+					Bucket: s.bucket,
+					Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+				})
+				return err
+			})
+		if err != nil {
+			err = errors.Wrap(interpretAWSError(err), "failed to delete s3 objects")
+			for i := start; i < end; i++ {
+				results[i].Err = err
+			}
+			continue
+		}
+		// In quiet mode only the keys which could not be deleted are returned.
+		for _, e := range out.Errors {
+			err := errors.Newf("failed to delete s3 object: %s: %s",
+				aws.StringValue(e.Code), aws.StringValue(e.Message))
+			for _, i := range indexes[aws.StringValue(e.Key)] {
+				results[i].Err = err
+			}
+		}
+	}
+	return results, nil
+}
+
+func (s *s3Storage) Size(ctx context.Context, basename string) (int64, error) {
+	info, err := s.Stat(ctx, basename)
 	if err != nil {
 		return 0, err
 	}
+	return info.Size, nil
+}
+
+// Stat implements the cloud.Stater interface. The storage class and
+// version ID of the object, if any, are returned in ObjectInfo.Extra under
+// "storage-class" and "version-id". S3 does not return the storage class of
+// objects in the STANDARD class.
+func (s *s3Storage) Stat(ctx context.Context, basename string) (cloud.ObjectInfo, error) {
+	out, err := s.headObject(ctx, basename)
+	if err != nil {
+		return cloud.ObjectInfo{}, err
+	}
+	info := cloud.ObjectInfo{
+		Size:        aws.Int64Value(out.ContentLength),
+		ModTime:     aws.TimeValue(out.LastModified),
+		ETag:        strings.Trim(aws.StringValue(out.ETag), `"`),
+		ContentType: aws.StringValue(out.ContentType),
+		Extra:       map[string]string{},
+	}
+	if out.StorageClass != nil {
+		info.Extra["storage-class"] = *out.StorageClass
+	}
+	if out.VersionId != nil {
+		info.Extra["version-id"] = *out.VersionId
+	}
+	for k, v := range out.Metadata {
+		info.Extra[cloud.MetadataExtraPrefix+strings.ToLower(k)] = aws.StringValue(v)
+	}
+	if out.Expiration != nil {
+		info.Extra["expiration"] = *out.Expiration
+	}
+	// The tags of an object are not returned with its headers, so they are
+	// only requested if it has any.
+	if aws.Int64Value(out.TagCount) > 0 {
+		tags, err := s.objectTags(ctx, basename)
+		if err != nil {
+			return cloud.ObjectInfo{}, err
+		}
+		if days, ok := tags[cloud.ExpireAfterDaysKey]; ok {
+			info.Extra[cloud.ExpireAfterDaysKey] = days
+		}
+	}
+	return info, nil
+}
+
+// objectTags returns the tags of the named object.
+func (s *s3Storage) objectTags(ctx context.Context, basename string) (map[string]string, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out *s3.GetObjectTaggingOutput
+	err = timeutil.RunWithTimeout(ctx, "get s3 object tags",
+		cloud.Timeout.Get(&s.settings.SV),
+		func(ctx context.Context) error {
+			var err error
+			out, err = client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+				Bucket: s.bucket,
+				Key:    aws.String(path.Join(s.prefix, basename)),
+			})
+			return err
+		})
+	if err != nil {
+		err = interpretAWSError(err)
+		return nil, errors.Wrap(err, "failed to get s3 object tags")
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, tag := range out.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// CheckAccess implements the cloud.AccessChecker interface, by writing a
+// probe object to the bucket.
+func (s *s3Storage) CheckAccess(ctx context.Context) error {
+	return cloud.CheckAccessWithProbe(ctx, s, isS3AccessDenied)
+}
+
+var _ cloud.WriteValidator = &s3Storage{}
+
+// ValidateWritable implements the cloud.WriteValidator interface, by
+// initiating a multipart upload of the object, with the encryption and storage
+// class of the writes of the storage, and aborting it. The object is not
+// written, and no part is uploaded, so nothing is billed for the upload.
+func (s *s3Storage) ValidateWritable(ctx context.Context, basename string) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	enc := s.encryption(cloud.WriteOptions{})
+	key := aws.String(path.Join(s.prefix, basename))
+	out, err := client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               s.bucket,
+		Key:                  key,
+		ServerSideEncryption: enc.mode,
+		SSEKMSKeyId:          enc.kmsID,
+		SSECustomerAlgorithm: enc.customerAlgorithm,
+		SSECustomerKey:       enc.customerKey,
+		StorageClass:         nilIfEmpty(s.conf.StorageClass),
+	})
+	if err != nil {
+		return cloud.ClassifyAccessError(interpretAWSError(err), isS3AccessDenied, "write to")
+	}
+	if _, err := client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   s.bucket,
+		Key:      key,
+		UploadId: out.UploadId,
+	}); err != nil {
+		return errors.Wrapf(interpretAWSError(err),
+			"failed to abort s3 multipart upload %s of %s", aws.StringValue(out.UploadId), *key)
+	}
+	return nil
+}
+
+// isS3AccessDenied returns whether err is an authentication or authorization
+// failure of an s3 request.
+func isS3AccessDenied(err error) bool {
+	if reqErr := (awserr.RequestFailure)(nil); errors.As(err, &reqErr) {
+		if code := reqErr.StatusCode(); code == http.StatusUnauthorized || code == http.StatusForbidden {
+			return true
+		}
+	}
+	if aerr := (awserr.Error)(nil); errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken",
+			"NoCredentialProviders":
+			return true
+		}
+	}
+	return false
+}
+
+// headObject returns the headers of the named object.
+func (s *s3Storage) headObject(
+	ctx context.Context, basename string, opts ...request.Option,
+) (*s3.HeadObjectOutput, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var out *s3.HeadObjectOutput
 	err = timeutil.RunWithTimeout(ctx, "get s3 object header",
 		cloud.Timeout.Get(&s.settings.SV),
@@ -926,14 +2053,67 @@ func (s *s3Storage) Size(ctx context.Context, basename string) (int64, error) {
 			out, err = client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 				Bucket: s.bucket,
 				Key:    aws.String(path.Join(s.prefix, basename)),
-			})
+			}, opts...)
 			return err
 		})
 	if err != nil {
 		err = interpretAWSError(err)
-		return 0, errors.Wrap(err, "failed to get s3 object headers")
+		return nil, errors.Wrap(err, "failed to get s3 object headers")
+	}
+	return out, nil
+}
+
+var _ cloud.RawClient = &s3Storage{}
+
+// Unwrap implements the cloud.RawClient interface. It returns the *s3.S3
+// client of the storage, which is made if the storage has none cached.
+func (s *s3Storage) Unwrap() any {
+	client, err := s.getClient(context.Background())
+	if err != nil {
+		return nil
 	}
-	return *out.ContentLength, nil
+	return client
+}
+
+var _ cloud.PresignedURLer = &s3Storage{}
+
+// PresignedReadURL implements the cloud.PresignedURLer interface. The URL is
+// signed with the credentials of the storage, which for assumed roles expire
+// after an hour regardless of ttl.
+func (s *s3Storage) PresignedReadURL(
+	ctx context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(path.Join(s.prefix, basename)),
+	})
+	presigned, err := req.Presign(ttl)
+	return presigned, errors.Wrap(interpretAWSError(err), "failed to presign s3 object read")
+}
+
+// PresignedWriteURL implements the cloud.PresignedURLer interface. The server
+// side encryption and storage class of the storage are signed with the URL,
+// so the PUT request must send them in the corresponding x-amz headers.
+func (s *s3Storage) PresignedWriteURL(
+	ctx context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, _ := client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:               s.bucket,
+		Key:                  aws.String(path.Join(s.prefix, basename)),
+		ServerSideEncryption: nilIfEmpty(s.conf.ServerEncMode),
+		SSEKMSKeyId:          nilIfEmpty(s.conf.ServerKMSID),
+		StorageClass:         nilIfEmpty(s.conf.StorageClass),
+	})
+	presigned, err := req.Presign(ttl)
+	return presigned, errors.Wrap(interpretAWSError(err), "failed to presign s3 object write")
 }
 
 func (s *s3Storage) Close() error {
@@ -0,0 +1,231 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// A note on hierarchical namespaces:
+//
+// Storage accounts with a hierarchical namespace (HNS), i.e. Azure Data Lake
+// Storage Gen2 accounts, have real directories. The blob endpoint of these
+// accounts emulates a flat namespace, but its listings do not always match
+// the directories: directories are listed as placeholder blobs, and files
+// nested under directories created through the Data Lake endpoint may be
+// missing from a listing with a delimiter. The listings of these accounts are
+// therefore made with the List Paths API of the Data Lake (dfs) endpoint,
+// which lists the directories themselves. The blob endpoint is still used for
+// every other operation, and for the listings of accounts without a
+// hierarchical namespace.
+
+// dfsAPIVersion is the version of the Data Lake REST API of the requests.
+const dfsAPIVersion = "2020-10-02"
+
+// dfsScope is the scope of the tokens authorizing the requests to the Data
+// Lake endpoint.
+const dfsScope = "https://storage.azure.com/.default"
+
+// dfsSASExpiration is how long the SAS authorizing the listings of accounts
+// authenticated by an account key is valid.
+const dfsSASExpiration = time.Hour
+
+// dfsClient lists the paths of a container through the Data Lake endpoint of
+// the storage account.
+type dfsClient struct {
+	// fileSystemURL is the URL of the container on the Data Lake endpoint.
+	fileSystemURL string
+	pipeline      runtime.Pipeline
+	// sasQuery, if set, returns the SAS query parameters authorizing the
+	// requests, for the accounts authenticated by an account key.
+	sasQuery func() (string, error)
+}
+
+// newDFSClient returns the client of the Data Lake endpoint of the container.
+// The requests are authorized by a token of credential if it is set, and by a
+// SAS signed by the account key of the container client otherwise.
+func newDFSClient(container *container.Client, credential azcore.TokenCredential) *dfsClient {
+	var plOpts runtime.PipelineOptions
+	c := &dfsClient{fileSystemURL: dfsURL(container.URL())}
+	if credential != nil {
+		plOpts.PerRetry = []policy.Policy{runtime.NewBearerTokenPolicy(credential, []string{dfsScope}, nil)}
+	} else {
+		c.sasQuery = func() (string, error) {
+			signed, err := container.GetSASURL(sas.ContainerPermissions{Read: true, List: true},
+				time.Time{} /* start */, timeutil.Now().Add(dfsSASExpiration))
+			if err != nil {
+				return "", err
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				return "", err
+			}
+			return u.RawQuery, nil
+		}
+	}
+	c.pipeline = runtime.NewPipeline("cockroach-azure-dfs", "v1", plOpts, nil /* options */)
+	return c
+}
+
+// dfsURL returns the URL of the Data Lake endpoint corresponding to the URL of
+// the blob endpoint.
+func dfsURL(blobURL string) string {
+	return strings.Replace(blobURL, ".blob.", ".dfs.", 1)
+}
+
+// dfsPath is a path of a List Paths response. The numbers and booleans are
+// encoded as strings.
+type dfsPath struct {
+	Name          string      `json:"name"`
+	IsDirectory   string      `json:"isDirectory"`
+	ContentLength json.Number `json:"contentLength"`
+	LastModified  string      `json:"lastModified"`
+	ETag          string      `json:"etag"`
+}
+
+func (p dfsPath) isDirectory() bool {
+	isDir, _ := strconv.ParseBool(p.IsDirectory)
+	return isDir
+}
+
+// listPaths calls fn with the paths under the directory, or under the root of
+// the container if it is empty. The paths of the subdirectories are listed if
+// recursive is set. A directory which does not exist has no paths.
+func (c *dfsClient) listPaths(
+	ctx context.Context, directory string, recursive bool, fn func(dfsPath) error,
+) error {
+	var continuation string
+	for {
+		query := url.Values{}
+		query.Set("resource", "filesystem")
+		query.Set("recursive", strconv.FormatBool(recursive))
+		if directory != "" {
+			query.Set("directory", directory)
+		}
+		if continuation != "" {
+			query.Set("continuation", continuation)
+		}
+		endpoint := c.fileSystemURL + "?" + query.Encode()
+		if c.sasQuery != nil {
+			sasQuery, err := c.sasQuery()
+			if err != nil {
+				return errors.Wrap(err, "failed to sign azure data lake listing")
+			}
+			endpoint += "&" + sasQuery
+		}
+
+		req, err := runtime.NewRequest(ctx, http.MethodGet, endpoint)
+		if err != nil {
+			return err
+		}
+		req.Raw().Header.Set("x-ms-version", dfsAPIVersion)
+		resp, err := c.pipeline.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			_ = resp.Body.Close()
+			return nil
+		}
+		if !runtime.HasStatusCode(resp, http.StatusOK) {
+			return runtime.NewResponseError(resp)
+		}
+		var body struct {
+			Paths []dfsPath `json:"paths"`
+		}
+		if err := runtime.UnmarshalAsJSON(resp, &body); err != nil {
+			return err
+		}
+		for _, p := range body.Paths {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		if continuation = resp.Header.Get("x-ms-continuation"); continuation == "" {
+			return nil
+		}
+	}
+}
+
+// hierarchicalNamespaceEnabled returns whether the storage account has a
+// hierarchical namespace. The answer is cached once the account was queried.
+// If it can't be, e.g. because the credentials are scoped to the container or
+// the request failed transiently, the account is assumed not to have one, and
+// it is queried again by the next listing.
+func (s *azureStorage) hierarchicalNamespaceEnabled(ctx context.Context) bool {
+	if s.account == nil || s.dfs == nil {
+		return false
+	}
+	s.hns.Lock()
+	defer s.hns.Unlock()
+	if s.hns.known {
+		return s.hns.enabled
+	}
+	info, err := s.account.GetAccountInfo(ctx, &service.GetAccountInfoOptions{})
+	if err != nil {
+		log.Warningf(ctx, "unable to determine if azure account %s has a hierarchical namespace, "+
+			"listing it as a flat namespace: %v", s.conf.AccountName, err)
+		return false
+	}
+	s.hns.known = true
+	s.hns.enabled = info.IsHierarchicalNamespaceEnabled != nil && *info.IsHierarchicalNamespaceEnabled
+	return s.hns.enabled
+}
+
+// listDirectory lists the paths starting with dest through the Data Lake
+// endpoint, naming them as a listing of the blob endpoint would: directories
+// are only listed with the "/" delimiter, with a trailing slash, and files are
+// listed in every subdirectory without a delimiter.
+func (s *azureStorage) listDirectory(
+	ctx context.Context, dest, delim string, fn cloud.ListingDetailedFn,
+) error {
+	// The prefix may end in the middle of a name, in which case the directory
+	// containing the name is listed.
+	directory := strings.TrimSuffix(dest[:strings.LastIndex(dest, "/")+1], "/")
+	recursive := delim == ""
+	return s.dfs.listPaths(ctx, directory, recursive, func(p dfsPath) error {
+		if !strings.HasPrefix(p.Name, dest) || p.Name == dest {
+			return nil
+		}
+		name := strings.TrimPrefix(p.Name, dest)
+		if p.isDirectory() {
+			if recursive {
+				return nil
+			}
+			return fn(cloud.ObjectInfo{Name: name + "/"})
+		}
+		info := cloud.ObjectInfo{Name: name, ETag: p.ETag}
+		if size, err := p.ContentLength.Int64(); err == nil {
+			info.Size = size
+		}
+		if modTime, err := http.ParseTime(p.LastModified); err == nil {
+			info.ModTime = modTime
+		}
+		return fn(info)
+	})
+}
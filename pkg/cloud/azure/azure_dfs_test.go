@@ -0,0 +1,231 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// mockHNSAccount serves the requests of the azure storage of a container of an
+// account with a hierarchical namespace: the account properties, the List
+// Paths API of the Data Lake endpoint and the List Blobs API of the blob
+// endpoint. Like for directories created through the Data Lake endpoint, the
+// blob listing misses the files nested under directories.
+type mockHNSAccount struct {
+	hnsEnabled bool
+	// forbidAccountInfo is set while the account properties are forbidden.
+	forbidAccountInfo atomic.Bool
+	// paths are the paths of the container, including the directories.
+	paths []dfsPath
+	// blobs are the names returned by the blob listing.
+	blobs []string
+	// dfsRequests counts the List Paths requests.
+	dfsRequests int32
+}
+
+// mockListPathsPageSize is the number of paths per List Paths response, small
+// enough for the listings to be paginated.
+const mockListPathsPageSize = 2
+
+func (m *mockHNSAccount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("restype") == "account" && query.Get("comp") == "properties":
+		if m.forbidAccountInfo.Load() {
+			http.Error(w, `{"error":{"code":"AuthorizationPermissionMismatch"}}`, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("x-ms-is-hns-enabled", strconv.FormatBool(m.hnsEnabled))
+		w.WriteHeader(http.StatusOK)
+
+	case query.Get("resource") == "filesystem":
+		atomic.AddInt32(&m.dfsRequests, 1)
+		if r.Header.Get("x-ms-version") == "" {
+			http.Error(w, "missing x-ms-version", http.StatusBadRequest)
+			return
+		}
+		directory := query.Get("directory")
+		recursive := query.Get("recursive") == "true"
+		var paths []dfsPath
+		for _, p := range m.paths {
+			if directory != "" && !strings.HasPrefix(p.Name, directory+"/") {
+				continue
+			}
+			rest := strings.TrimPrefix(strings.TrimPrefix(p.Name, directory), "/")
+			if !recursive && strings.Contains(rest, "/") {
+				continue
+			}
+			paths = append(paths, p)
+		}
+		if directory != "" && len(paths) == 0 {
+			http.Error(w, `{"error":{"code":"PathNotFound"}}`, http.StatusNotFound)
+			return
+		}
+		start := 0
+		if c := query.Get("continuation"); c != "" {
+			var err error
+			if start, err = strconv.Atoi(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		end := start + mockListPathsPageSize
+		if end < len(paths) {
+			w.Header().Set("x-ms-continuation", strconv.Itoa(end))
+		} else {
+			end = len(paths)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Paths []dfsPath `json:"paths"`
+		}{Paths: paths[start:end]})
+
+	case query.Get("restype") == "container" && query.Get("comp") == "list":
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="container"><Blobs>`)
+		for _, name := range m.blobs {
+			if strings.HasPrefix(name, query.Get("prefix")) {
+				fmt.Fprintf(&b, `<Blob><Name>%s</Name><Properties><Content-Length>1</Content-Length></Properties></Blob>`, name)
+			}
+		}
+		b.WriteString(`</Blobs><NextMarker/></EnumerationResults>`)
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(b.String()))
+
+	default:
+		http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func TestAzureHierarchicalNamespaceList(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	file := func(name string, size int) dfsPath {
+		return dfsPath{
+			Name:          name,
+			ContentLength: json.Number(strconv.Itoa(size)),
+			LastModified:  "Mon, 02 Jan 2023 15:04:05 GMT",
+			ETag:          "0x8DB" + strconv.Itoa(size),
+		}
+	}
+	dir := func(name string) dfsPath {
+		return dfsPath{Name: name, IsDirectory: "true", ContentLength: "0"}
+	}
+
+	// The backups written through the Data Lake endpoint are nested in
+	// directories, which the flat blob listing misses.
+	paths := []dfsPath{
+		dir("backups"),
+		dir("backups/2023"),
+		dir("backups/2023/12"),
+		file("backups/2023/12/b.csv", 20),
+		file("backups/2023/a.csv", 10),
+		file("backups/top.csv", 3),
+	}
+	blobs := []string{"backups/top.csv"}
+
+	newStorage := func(t *testing.T, hnsEnabled bool) (*azureStorage, *mockHNSAccount) {
+		account := &mockHNSAccount{hnsEnabled: hnsEnabled, paths: paths, blobs: blobs}
+		srv := httptest.NewServer(account)
+		t.Cleanup(srv.Close)
+
+		svc, err := service.NewClientWithNoCredential(srv.URL, nil)
+		require.NoError(t, err)
+		containerClient := svc.NewContainerClient("container")
+		return &azureStorage{
+			conf:      &cloudpb.ExternalStorage_Azure{AccountName: "account", Container: "container"},
+			account:   svc,
+			container: containerClient,
+			dfs: &dfsClient{
+				fileSystemURL: dfsURL(containerClient.URL()),
+				pipeline:      runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, nil),
+			},
+			prefix:   "backups",
+			settings: cluster.MakeTestingClusterSettings(),
+		}, account
+	}
+
+	list := func(t *testing.T, s *azureStorage, prefix, delim string) []string {
+		var names []string
+		require.NoError(t, s.List(ctx, prefix, delim, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		sort.Strings(names)
+		return names
+	}
+
+	t.Run("hns", func(t *testing.T) {
+		s, account := newStorage(t, true /* hnsEnabled */)
+
+		require.Equal(t, []string{"/2023/12/b.csv", "/2023/a.csv", "/top.csv"}, list(t, s, "", ""))
+		require.Equal(t, []string{"12/", "a.csv"}, list(t, s, "2023/", "/"))
+		require.Equal(t, []string{"12/b.csv", "a.csv"}, list(t, s, "2023/", ""))
+		// A prefix ending in the middle of a name lists the names starting with
+		// it in the containing directory.
+		require.Equal(t, []string{"2/"}, list(t, s, "2023/1", "/"))
+		require.Empty(t, list(t, s, "missing/", "/"))
+		require.NotZero(t, atomic.LoadInt32(&account.dfsRequests))
+
+		var infos []cloud.ObjectInfo
+		require.NoError(t, s.ListDetailed(ctx, "2023/", "/", func(info cloud.ObjectInfo) error {
+			infos = append(infos, info)
+			return nil
+		}))
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+		require.Len(t, infos, 2)
+		require.Equal(t, "12/", infos[0].Name)
+		require.Equal(t, "a.csv", infos[1].Name)
+		require.Equal(t, int64(10), infos[1].Size)
+		require.Equal(t, "0x8DB10", infos[1].ETag)
+		require.Equal(t, 2023, infos[1].ModTime.Year())
+	})
+
+	t.Run("flat", func(t *testing.T) {
+		s, account := newStorage(t, false /* hnsEnabled */)
+
+		// Accounts without a hierarchical namespace are listed through the blob
+		// endpoint.
+		require.Equal(t, []string{"/top.csv"}, list(t, s, "", ""))
+		require.Zero(t, atomic.LoadInt32(&account.dfsRequests))
+	})
+
+	t.Run("account-info-failure", func(t *testing.T) {
+		s, account := newStorage(t, true /* hnsEnabled */)
+
+		// The account is listed as a flat namespace while its properties can't
+		// be read, and its namespace is detected once they can.
+		account.forbidAccountInfo.Store(true)
+		require.Equal(t, []string{"/top.csv"}, list(t, s, "", ""))
+		require.Zero(t, atomic.LoadInt32(&account.dfsRequests))
+		account.forbidAccountInfo.Store(false)
+		require.Equal(t, []string{"/2023/12/b.csv", "/2023/a.csv", "/top.csv"}, list(t, s, "", ""))
+		require.NotZero(t, atomic.LoadInt32(&account.dfsRequests))
+	})
+}
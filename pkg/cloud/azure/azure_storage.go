@@ -11,19 +11,27 @@
 package azure
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/cockroachdb/cockroach/pkg/base"
@@ -33,6 +41,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/errors"
@@ -105,6 +115,23 @@ const (
 	deprecatedExternalConnectionScheme = "azure-storage"
 )
 
+var azureMultipartPartSize = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.azure.multipart.part_size",
+	"size of each block of a staged upload to Azure; 0 uses cloudstorage.write_chunk.size",
+	0,
+	settings.IntInRangeOrZeroDisable(1, 4000<<20),
+)
+
+var azureMultipartThreshold = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.azure.multipart.threshold",
+	"files larger than this size are uploaded to Azure in staged blocks, and smaller files "+
+		"are buffered in memory and uploaded with a single request",
+	5<<20,
+	settings.IntInRange(0, 5000<<20),
+)
+
 func azureAuthMethod(uri *url.URL, consumeURI *cloud.ConsumeURL) (cloudpb.AzureAuth, error) {
 	authParam := consumeURI.ConsumeParam(cloud.AuthParam)
 	switch authParam {
@@ -203,12 +230,31 @@ func parseAzureURL(
 type azureStorage struct {
 	conf      *cloudpb.ExternalStorage_Azure
 	ioConf    base.ExternalIODirConfig
+	account   *service.Client
 	container *container.Client
-	prefix    string
-	settings  *cluster.Settings
+	// dfs lists the container of accounts with a hierarchical namespace.
+	dfs      *dfsClient
+	prefix   string
+	settings *cluster.Settings
+
+	// hns caches whether the account has a hierarchical namespace, once the
+	// account was successfully queried.
+	hns struct {
+		syncutil.Mutex
+		known   bool
+		enabled bool
+	}
 }
 
 var _ cloud.ExternalStorage = &azureStorage{}
+var _ cloud.OptionsWriter = &azureStorage{}
+var _ cloud.ConditionalWriter = &azureStorage{}
+var _ cloud.DetailedLister = &azureStorage{}
+var _ cloud.PageLister = &azureStorage{}
+var _ cloud.Copier = &azureStorage{}
+var _ cloud.BatchDeleter = &azureStorage{}
+var _ cloud.Stater = &azureStorage{}
+var _ cloud.AccessChecker = &azureStorage{}
 
 func makeAzureStorage(
 	_ context.Context, args cloud.ExternalStorageContext, dest cloudpb.ExternalStorage,
@@ -228,6 +274,8 @@ func makeAzureStorage(
 	}
 
 	var azClient *service.Client
+	// tokenCredential is set if the account is not authenticated by a key.
+	var tokenCredential azcore.TokenCredential
 	switch conf.Auth {
 	case cloudpb.AzureAuth_LEGACY:
 		credential, err := azblob.NewSharedKeyCredential(conf.AccountName, conf.AccountKey)
@@ -243,6 +291,7 @@ func makeAzureStorage(
 		if err != nil {
 			return nil, errors.Wrap(err, "azure client secret credential")
 		}
+		tokenCredential = credential
 		azClient, err = service.NewClient(u.String(), credential, nil)
 		if err != nil {
 			return nil, err
@@ -267,6 +316,7 @@ func makeAzureStorage(
 		if err != nil {
 			return nil, errors.Wrap(err, "azure default credential")
 		}
+		tokenCredential = credential
 		azClient, err = service.NewClient(u.String(), credential, nil)
 		if err != nil {
 			return nil, err
@@ -276,10 +326,13 @@ func makeAzureStorage(
 		return nil, errors.Errorf("unsupported value %s for %s", conf.Auth, cloud.AuthParam)
 	}
 
+	containerClient := azClient.NewContainerClient(conf.Container)
 	return &azureStorage{
 		conf:      conf,
 		ioConf:    args.IOConf,
-		container: azClient.NewContainerClient(conf.Container),
+		account:   azClient,
+		container: containerClient,
+		dfs:       newDFSClient(containerClient, tokenCredential),
 		prefix:    conf.Prefix,
 		settings:  args.Settings,
 	}, nil
@@ -308,17 +361,278 @@ func (s *azureStorage) Settings() *cluster.Settings {
 }
 
 func (s *azureStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return s.WriterWithOptions(ctx, basename, cloud.WriteOptions{})
+}
+
+// WriterWithOptions implements the cloud.OptionsWriter interface. The
+// storage class of opts is the access tier of the blob, and its KMS key ID the
+// encryption scope of the blob.
+//
+// Blobs locked by opts are written with a locked immutability policy or a
+// legal hold, which require the container to have version-level immutability
+// support enabled. Writing over a locked blob is rejected by the service with
+// cloud.ErrFileLocked. Writes cannot be verified with checksums.
+func (s *azureStorage) WriterWithOptions(
+	ctx context.Context, basename string, opts cloud.WriteOptions,
+) (io.WriteCloser, error) {
+	if err := cloud.CheckSSEOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := cloud.CheckWriteChecksum("azure", opts); err != nil {
+		return nil, err
+	}
 	ctx, sp := tracing.ChildSpan(ctx, "azure.Writer")
 	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
+	uploadOpts := &azblob.UploadStreamOptions{
+		BlockSize:   azurePartSize(&s.settings.SV),
+		Concurrency: int(maxConcurrentUploadBuffers.Get(&s.settings.SV)),
+		Metadata:    opts.Metadata,
+	}
+	putOpts := &blockblob.UploadOptions{Metadata: opts.Metadata}
+	if opts.ContentType != "" {
+		uploadOpts.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &opts.ContentType}
+		putOpts.HTTPHeaders = uploadOpts.HTTPHeaders
+	}
+	if opts.StorageClass != "" {
+		tier := blob.AccessTier(opts.StorageClass)
+		uploadOpts.AccessTier = &tier
+		putOpts.Tier = &tier
+	}
+	if opts.SSEKMSKeyID != "" {
+		uploadOpts.CpkScopeInfo = &blob.CpkScopeInfo{EncryptionScope: &opts.SSEKMSKeyID}
+		putOpts.CpkScopeInfo = uploadOpts.CpkScopeInfo
+	}
+	uploadOpts.CpkInfo = customerKeyInfo(opts.SSECustomerKey)
+	putOpts.CpkInfo = uploadOpts.CpkInfo
+	if opts.ExpireAfter > 0 {
+		uploadOpts.Tags = map[string]string{
+			cloud.ExpireAfterDaysKey: cloud.ExpireAfterDays(opts.ExpireAfter),
+		}
+		putOpts.Tags = uploadOpts.Tags
+	}
+	if !opts.RetainUntil.IsZero() {
+		mode := blob.ImmutabilityPolicySettingLocked
+		putOpts.ImmutabilityPolicyMode = &mode
+		putOpts.ImmutabilityPolicyExpiryTime = &opts.RetainUntil
+	}
+	if opts.LegalHold {
+		putOpts.LegalHold = &opts.LegalHold
+	}
 	blob := s.getBlob(basename)
-	return cloud.BackgroundPipe(ctx, func(ctx context.Context, r io.Reader) error {
-		defer sp.Finish()
-		_, err := blob.UploadStream(ctx, r, &azblob.UploadStreamOptions{
-			BlockSize:   cloud.WriteChunkSize.Get(&s.settings.SV),
-			Concurrency: int(maxConcurrentUploadBuffers.Get(&s.settings.SV)),
-		})
-		return err
-	}), nil
+	// Files up to the threshold are written with Put Blob. Larger files are
+	// staged in blocks which are committed once the upload completes. Azure has
+	// no request to abort an upload: the staged blocks of an upload which is
+	// never committed are garbage collected by the service after a week.
+	return cloud.ThresholdWriter(ctx, azureMultipartThreshold.Get(&s.settings.SV),
+		func(ctx context.Context, data []byte) error {
+			defer sp.Finish()
+			_, err := blob.Upload(ctx, streaming.NopCloser(bytes.NewReader(data)), putOpts)
+			return interpretAzureWriteError(err)
+		},
+		func(ctx context.Context, r io.Reader) error {
+			defer sp.Finish()
+			if _, err := blob.UploadStream(ctx, r, uploadOpts); err != nil {
+				return interpretAzureWriteError(err)
+			}
+			// Staged uploads cannot set the immutability policy or the legal
+			// hold when the block list is committed, so the blob is locked
+			// once it is written.
+			return lockBlob(ctx, blob, opts)
+		}), nil
+}
+
+// lockBlob sets the immutability policy and the legal hold of the blob
+// locked by opts.
+func lockBlob(ctx context.Context, b *blockblob.Client, opts cloud.WriteOptions) error {
+	if !opts.RetainUntil.IsZero() {
+		mode := blob.ImmutabilityPolicySettingLocked
+		if _, err := b.SetImmutabilityPolicy(ctx, opts.RetainUntil,
+			&blob.SetImmutabilityPolicyOptions{Mode: &mode}); err != nil {
+			return errors.Wrap(err, "failed to set the immutability policy of azure blob")
+		}
+	}
+	if opts.LegalHold {
+		if _, err := b.SetLegalHold(ctx, true, nil /* options */); err != nil {
+			return errors.Wrap(err, "failed to set the legal hold of azure blob")
+		}
+	}
+	return nil
+}
+
+// interpretAzureWriteError marks the errors of writes rejected because the
+// existing blob is locked by an immutability policy or a legal hold with
+// cloud.ErrFileLocked.
+func interpretAzureWriteError(err error) error {
+	if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) {
+		switch azerr.ErrorCode {
+		case "BlobImmutableDueToPolicy", "BlobImmutableDueToLegalHold":
+			return errors.Mark(err, cloud.ErrFileLocked)
+		}
+	}
+	return err
+}
+
+// customerKeyInfo returns the headers of requests using a customer-provided
+// key, or nil if key is not set.
+func customerKeyInfo(key []byte) *blob.CpkInfo {
+	if key == nil {
+		return nil
+	}
+	hash := sha256.Sum256(key)
+	alg := blob.EncryptionAlgorithmTypeAES256
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	encodedHash := base64.StdEncoding.EncodeToString(hash[:])
+	return &blob.CpkInfo{
+		EncryptionAlgorithm: &alg,
+		EncryptionKey:       &encodedKey,
+		EncryptionKeySHA256: &encodedHash,
+	}
+}
+
+// azurePartSize returns the size of the blocks of staged uploads.
+func azurePartSize(sv *settings.Values) int64 {
+	if partSize := azureMultipartPartSize.Get(sv); partSize != 0 {
+		return partSize
+	}
+	return cloud.WriteChunkSize.Get(sv)
+}
+
+// azureListPageSize is the number of blobs returned by a List Blobs request.
+const azureListPageSize = 5000
+
+var _ cloud.CostEstimator = &azureStorage{}
+
+// EstimateListCost implements the cloud.CostEstimator interface. Files are
+// listed with a List Blobs request per page, which azure bills as a write.
+func (s *azureStorage) EstimateListCost(files int64) (cloud.Cost, error) {
+	return cloud.Cost{WriteRequests: cloud.Batches(files, azureListPageSize)}, nil
+}
+
+// EstimateReadCost implements the cloud.CostEstimator interface. A file is
+// read with a Get Blob, and its bytes are transferred out of azure.
+func (s *azureStorage) EstimateReadCost(bytes int64) (cloud.Cost, error) {
+	return cloud.Cost{ReadRequests: 1, TransferBytes: bytes}, nil
+}
+
+// EstimateWriteCost implements the cloud.CostEstimator interface. Files up to
+// the multipart threshold are written with a Put Blob, and larger ones are
+// staged with a Put Block per block and committed with a Put Block List.
+// Transfers into azure are free.
+func (s *azureStorage) EstimateWriteCost(bytes int64) (cloud.Cost, error) {
+	sv := &s.settings.SV
+	if bytes <= azureMultipartThreshold.Get(sv) {
+		return cloud.Cost{WriteRequests: 1}, nil
+	}
+	return cloud.Cost{WriteRequests: 1 + cloud.Batches(bytes, azurePartSize(sv))}, nil
+}
+
+// WriteFileIfNotExists implements the cloud.ConditionalWriter interface. The
+// blob is uploaded with an If-None-Match: * access condition, which is checked
+// when the block list is committed.
+func (s *azureStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "azure.WriteFileIfNotExists")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
+
+	ifNoneMatch := azcore.ETagAny
+	_, err := s.getBlob(basename).UploadStream(ctx, content, &azblob.UploadStreamOptions{
+		BlockSize:   cloud.WriteChunkSize.Get(&s.settings.SV),
+		Concurrency: int(maxConcurrentUploadBuffers.Get(&s.settings.SV)),
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &ifNoneMatch},
+		},
+	})
+	if err != nil {
+		if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) {
+			if azerr.ErrorCode == "BlobAlreadyExists" || azerr.ErrorCode == "ConditionNotMet" {
+				return false, nil
+			}
+		}
+		return false, errors.Wrap(err, "failed to upload azure blob")
+	}
+	return true, nil
+}
+
+// WriteFileIfMatch implements the cloud.ConditionalWriter interface. The blob
+// is uploaded with an If-Match access condition, which is checked when the
+// block list is committed.
+func (s *azureStorage) WriteFileIfMatch(
+	ctx context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	ctx, sp := tracing.ChildSpan(ctx, "azure.WriteFileIfMatch")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
+
+	ifMatch := azcore.ETag(expectedETag)
+	_, err := s.getBlob(basename).UploadStream(ctx, content, &azblob.UploadStreamOptions{
+		BlockSize:   cloud.WriteChunkSize.Get(&s.settings.SV),
+		Concurrency: int(maxConcurrentUploadBuffers.Get(&s.settings.SV)),
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: &ifMatch},
+		},
+	})
+	if err != nil {
+		if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) {
+			if azerr.ErrorCode == "ConditionNotMet" || azerr.ErrorCode == "BlobNotFound" {
+				return errors.Mark(errors.Wrapf(err, "azure blob %s was not written", basename),
+					cloud.ErrPreconditionFailed)
+			}
+		}
+		return errors.Wrap(err, "failed to upload azure blob")
+	}
+	return nil
+}
+
+// azureAppendBlockSize is the maximum size of a block appended to an append
+// blob.
+const azureAppendBlockSize = 4 << 20
+
+var _ cloud.Appender = &azureStorage{}
+
+// AppendFile implements the cloud.Appender interface. The file is an append
+// blob, which is created if it does not exist, and the content is appended to
+// it in blocks of up to 4 MiB. Each block is appended atomically, and the
+// blocks of concurrent appends are ordered by the service, but the content of
+// an append larger than a block may be interleaved with the blocks of
+// concurrent appends, and an append which fails may leave some of its blocks
+// behind. Block blobs, which are written by Writer, cannot be appended to.
+func (s *azureStorage) AppendFile(ctx context.Context, basename string, content io.Reader) error {
+	ctx, sp := tracing.ChildSpan(ctx, "azure.AppendFile")
+	defer sp.Finish()
+	name := path.Join(s.prefix, basename)
+	sp.SetTag("path", attribute.StringValue(name))
+
+	appendBlob := s.container.NewAppendBlobClient(name)
+	ifNoneMatch := azcore.ETagAny
+	if _, err := appendBlob.Create(ctx, &appendblob.CreateOptions{
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &ifNoneMatch},
+		},
+	}); err != nil {
+		// The blob already exists if the condition is not met.
+		azerr := (*azcore.ResponseError)(nil)
+		if !errors.As(err, &azerr) ||
+			(azerr.ErrorCode != "BlobAlreadyExists" && azerr.ErrorCode != "ConditionNotMet") {
+			return errors.Wrapf(interpretAzureWriteError(err), "failed to create azure append blob %s", basename)
+		}
+	}
+	buf := make([]byte, azureAppendBlockSize)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			if _, err := appendBlob.AppendBlock(ctx, streaming.NopCloser(bytes.NewReader(buf[:n])), nil); err != nil {
+				return errors.Wrapf(interpretAzureWriteError(err), "failed to append to azure blob %s", basename)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func (s *azureStorage) ReadFile(
@@ -327,8 +641,10 @@ func (s *azureStorage) ReadFile(
 	ctx, sp := tracing.ChildSpan(ctx, "azure.ReadFile")
 	defer sp.Finish()
 	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, basename)))
-	resp, err := s.getBlob(basename).DownloadStream(ctx, &azblob.DownloadStreamOptions{Range: azblob.
-		HTTPRange{Offset: opts.Offset}})
+	resp, err := s.getBlob(basename).DownloadStream(ctx, &azblob.DownloadStreamOptions{
+		Range:   azblob.HTTPRange{Offset: opts.Offset, Count: opts.LengthHint},
+		CpkInfo: customerKeyInfo(opts.SSECustomerKey),
+	})
 	if err != nil {
 		if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) {
 			if azerr.ErrorCode == "BlobNotFound" {
@@ -344,7 +660,7 @@ func (s *azureStorage) ReadFile(
 	}
 
 	if !opts.NoFileSize {
-		if opts.Offset == 0 {
+		if opts.Offset == 0 && opts.LengthHint == 0 {
 			fileSize = *resp.ContentLength
 		} else {
 			fileSize, err = cloud.CheckHTTPContentRangeHeader(*resp.ContentRange, opts.Offset)
@@ -358,12 +674,36 @@ func (s *azureStorage) ReadFile(
 }
 
 func (s *azureStorage) List(ctx context.Context, prefix, delim string, fn cloud.ListingFn) error {
-	ctx, sp := tracing.ChildSpan(ctx, "azure.List")
+	return s.list(ctx, "azure.List", prefix, delim, func(info cloud.ObjectInfo) error {
+		return fn(info.Name)
+	})
+}
+
+// ListDetailed implements the cloud.DetailedLister interface. The size,
+// modification time, ETag, content type and access tier of the blobs are those
+// of the listing response.
+func (s *azureStorage) ListDetailed(
+	ctx context.Context, prefix, delim string, fn cloud.ListingDetailedFn,
+) error {
+	return s.list(ctx, "azure.ListDetailed", prefix, delim, fn)
+}
+
+func (s *azureStorage) list(
+	ctx context.Context, opName, prefix, delim string, fn cloud.ListingDetailedFn,
+) error {
+	ctx, sp := tracing.ChildSpan(ctx, opName)
 	defer sp.Finish()
 
 	dest := cloud.JoinPathPreservingTrailingSlash(s.prefix, prefix)
 	sp.SetTag("path", attribute.StringValue(dest))
 
+	// The directories of accounts with a hierarchical namespace are listed
+	// through the Data Lake endpoint, which can list the paths for the "/"
+	// delimiter or without one.
+	if (delim == "" || delim == "/") && s.hierarchicalNamespaceEnabled(ctx) {
+		return s.listDirectory(ctx, dest, delim, fn)
+	}
+
 	pager := s.container.NewListBlobsHierarchyPager(delim, &container.ListBlobsHierarchyOptions{Prefix: &dest})
 	for pager.More() {
 		response, err := pager.NextPage(ctx)
@@ -372,12 +712,30 @@ func (s *azureStorage) List(ctx context.Context, prefix, delim string, fn cloud.
 			return errors.Wrap(err, "unable to list files for specified blob")
 		}
 		for _, blob := range response.Segment.BlobPrefixes {
-			if err := fn(strings.TrimPrefix(*blob.Name, dest)); err != nil {
+			if err := fn(cloud.ObjectInfo{Name: strings.TrimPrefix(*blob.Name, dest)}); err != nil {
 				return err
 			}
 		}
 		for _, blob := range response.Segment.BlobItems {
-			if err := fn(strings.TrimPrefix(*blob.Name, dest)); err != nil {
+			info := cloud.ObjectInfo{Name: strings.TrimPrefix(*blob.Name, dest)}
+			if props := blob.Properties; props != nil {
+				if props.ContentLength != nil {
+					info.Size = *props.ContentLength
+				}
+				if props.LastModified != nil {
+					info.ModTime = *props.LastModified
+				}
+				if props.ETag != nil {
+					info.ETag = string(*props.ETag)
+				}
+				if props.ContentType != nil {
+					info.ContentType = *props.ContentType
+				}
+				if props.AccessTier != nil {
+					info.Extra = map[string]string{"access-tier": string(*props.AccessTier)}
+				}
+			}
+			if err := fn(info); err != nil {
 				return err
 			}
 		}
@@ -385,6 +743,100 @@ func (s *azureStorage) List(ctx context.Context, prefix, delim string, fn cloud.
 	return nil
 }
 
+// ListPage implements the cloud.PageLister interface. The page token is
+// the Azure continuation marker.
+func (s *azureStorage) ListPage(
+	ctx context.Context, prefix, delim, pageToken string, maxResults int,
+) ([]string, string, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "azure.ListPage")
+	defer sp.Finish()
+
+	dest := cloud.JoinPathPreservingTrailingSlash(s.prefix, prefix)
+	sp.SetTag("path", attribute.StringValue(dest))
+
+	if maxResults <= 0 {
+		maxResults = cloud.DefaultListPageSize
+	}
+	pageSize := int32(maxResults)
+	opts := &container.ListBlobsHierarchyOptions{Prefix: &dest, MaxResults: &pageSize}
+	if pageToken != "" {
+		opts.Marker = &pageToken
+	}
+	pager := s.container.NewListBlobsHierarchyPager(delim, opts)
+	if !pager.More() {
+		return nil, "", nil
+	}
+	response, err := pager.NextPage(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unable to list files for specified blob")
+	}
+	results := make([]string, 0, len(response.Segment.BlobPrefixes)+len(response.Segment.BlobItems))
+	for _, blob := range response.Segment.BlobPrefixes {
+		results = append(results, strings.TrimPrefix(*blob.Name, dest))
+	}
+	for _, blob := range response.Segment.BlobItems {
+		results = append(results, strings.TrimPrefix(*blob.Name, dest))
+	}
+	var nextPageToken string
+	if response.NextMarker != nil {
+		nextPageToken = *response.NextMarker
+	}
+	return results, nextPageToken, nil
+}
+
+// azureCopyPollOptions controls how often Copy checks the status of a pending
+// copy.
+var azureCopyPollOptions = retry.Options{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+}
+
+// Copy implements the cloud.Copier interface. The blob is copied with
+// Copy Blob, which is asynchronous for large blobs, so Copy waits until the
+// copy is no longer pending.
+func (s *azureStorage) Copy(ctx context.Context, srcBasename, dstBasename string) error {
+	if err := cloud.CheckCopyBasenames(srcBasename, dstBasename); err != nil {
+		return err
+	}
+	ctx, sp := tracing.ChildSpan(ctx, "azure.Copy")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(s.prefix, dstBasename)))
+
+	dst := s.getBlob(dstBasename)
+	resp, err := dst.StartCopyFromURL(ctx, s.getBlob(srcBasename).URL(), nil)
+	if err != nil {
+		if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) {
+			if azerr.ErrorCode == "CannotVerifyCopySource" || azerr.ErrorCode == "BlobNotFound" {
+				// nolint:errwrap
+				return errors.Wrapf(
+					errors.Wrap(cloud.ErrFileDoesNotExist, "azure blob does not exist"),
+					"%v",
+					err.Error(),
+				)
+			}
+		}
+		return errors.Wrap(err, "failed to start azure copy")
+	}
+
+	status := resp.CopyStatus
+	for r := retry.StartWithCtx(ctx, azureCopyPollOptions); status != nil &&
+		*status == blob.CopyStatusTypePending && r.Next(); {
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "get azure copy status")
+		}
+		status = props.CopyStatus
+	}
+	if status == nil || *status == blob.CopyStatusTypeSuccess {
+		return nil
+	}
+	if *status == blob.CopyStatusTypePending {
+		return errors.Wrap(ctx.Err(), "waiting for azure copy")
+	}
+	return errors.Newf("azure copy %s", *status)
+}
+
 func (s *azureStorage) Delete(ctx context.Context, basename string) error {
 	err := timeutil.RunWithTimeout(ctx, "delete azure file", cloud.Timeout.Get(&s.settings.SV),
 		func(ctx context.Context) error {
@@ -394,18 +846,155 @@ func (s *azureStorage) Delete(ctx context.Context, basename string) error {
 	return errors.Wrap(err, "delete file")
 }
 
+// BatchDelete implements the cloud.BatchDeleter interface. This version of
+// the Go client has no blob batch request, so the blobs are deleted
+// concurrently.
+func (s *azureStorage) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]cloud.DeleteResult, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "azure.BatchDelete")
+	defer sp.Finish()
+
+	return cloud.BatchDeleteWithDelete(ctx, basenames, cloud.DefaultBatchDeleteConcurrency,
+		func(ctx context.Context, basename string) error {
+			err := s.Delete(ctx, basename)
+			if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) && azerr.ErrorCode == "BlobNotFound" {
+				return nil
+			}
+			return err
+		})
+}
+
 func (s *azureStorage) Size(ctx context.Context, basename string) (int64, error) {
+	info, err := s.Stat(ctx, basename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Stat implements the cloud.Stater interface. The access tier and
+// version ID of the blob, if any, are returned in ObjectInfo.Extra under
+// "access-tier" and "version-id".
+func (s *azureStorage) Stat(ctx context.Context, basename string) (cloud.ObjectInfo, error) {
 	var props blob.GetPropertiesResponse
-	err := timeutil.RunWithTimeout(ctx, "size azure file", cloud.Timeout.Get(&s.settings.SV),
+	err := timeutil.RunWithTimeout(ctx, "stat azure file", cloud.Timeout.Get(&s.settings.SV),
 		func(ctx context.Context) error {
 			var err error
 			props, err = s.getBlob(basename).GetProperties(ctx, nil)
 			return err
 		})
 	if err != nil {
-		return 0, errors.Wrap(err, "get file properties")
+		if azerr := (*azcore.ResponseError)(nil); errors.As(err, &azerr) && azerr.ErrorCode == "BlobNotFound" {
+			// nolint:errwrap
+			return cloud.ObjectInfo{}, errors.Wrapf(
+				errors.Wrap(cloud.ErrFileDoesNotExist, "azure blob does not exist"),
+				"%v",
+				err.Error(),
+			)
+		}
+		return cloud.ObjectInfo{}, errors.Wrap(err, "get file properties")
+	}
+	info := cloud.ObjectInfo{Extra: map[string]string{}}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.ModTime = *props.LastModified
+	}
+	if props.ETag != nil {
+		info.ETag = string(*props.ETag)
+	}
+	if props.ContentType != nil {
+		info.ContentType = *props.ContentType
+	}
+	if props.AccessTier != nil {
+		info.Extra["access-tier"] = *props.AccessTier
+	}
+	if props.VersionID != nil {
+		info.Extra["version-id"] = *props.VersionID
+	}
+	for k, v := range props.Metadata {
+		info.Extra[cloud.MetadataExtraPrefix+strings.ToLower(k)] = v
+	}
+	// The index tags of a blob are not returned with its properties, so they
+	// are only requested if it has any.
+	if props.TagCount != nil && *props.TagCount > 0 {
+		var tags blob.GetTagsResponse
+		err := timeutil.RunWithTimeout(ctx, "get azure blob tags", cloud.Timeout.Get(&s.settings.SV),
+			func(ctx context.Context) error {
+				var err error
+				tags, err = s.getBlob(basename).GetTags(ctx, nil)
+				return err
+			})
+		if err != nil {
+			return cloud.ObjectInfo{}, errors.Wrap(err, "get blob tags")
+		}
+		for _, tag := range tags.BlobTagSet {
+			if tag.Key != nil && tag.Value != nil && *tag.Key == cloud.ExpireAfterDaysKey {
+				info.Extra[cloud.ExpireAfterDaysKey] = *tag.Value
+			}
+		}
+	}
+	return info, nil
+}
+
+// CheckAccess implements the cloud.AccessChecker interface, by writing a
+// probe blob to the container.
+func (s *azureStorage) CheckAccess(ctx context.Context) error {
+	return cloud.CheckAccessWithProbe(ctx, s, isAzureAccessDenied)
+}
+
+var _ cloud.WriteValidator = &azureStorage{}
+
+// ValidateWritable implements the cloud.WriteValidator interface, by writing
+// and deleting an empty probe blob next to the blob.
+func (s *azureStorage) ValidateWritable(ctx context.Context, basename string) error {
+	return cloud.ValidateWritableWithProbe(ctx, s, basename, isAzureAccessDenied)
+}
+
+// isAzureAccessDenied returns whether err is an authentication or authorization
+// failure of an azure request.
+func isAzureAccessDenied(err error) bool {
+	azerr := (*azcore.ResponseError)(nil)
+	return errors.As(err, &azerr) &&
+		(azerr.StatusCode == http.StatusUnauthorized || azerr.StatusCode == http.StatusForbidden)
+}
+
+var _ cloud.PresignedURLer = &azureStorage{}
+
+// PresignedReadURL implements the cloud.PresignedURLer interface.
+func (s *azureStorage) PresignedReadURL(
+	_ context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return s.sasURL(basename, sas.BlobPermissions{Read: true}, ttl)
+}
+
+// PresignedWriteURL implements the cloud.PresignedURLer interface. The blob
+// must be written with a single Put Blob request.
+func (s *azureStorage) PresignedWriteURL(
+	_ context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return s.sasURL(basename, sas.BlobPermissions{Create: true, Write: true}, ttl)
+}
+
+// sasURL returns the URL of the named blob with a service SAS granting the
+// permissions until ttl elapses. A service SAS is signed with the account key,
+// so it is only supported if the storage authenticates with one.
+func (s *azureStorage) sasURL(
+	basename string, permissions sas.BlobPermissions, ttl time.Duration,
+) (string, error) {
+	if s.conf.Auth != cloudpb.AzureAuth_LEGACY {
+		return "", errors.UnimplementedErrorf(errors.IssueLink{},
+			"azure presigned URLs require an account key, set with %s", AzureAccountKeyParam)
+	}
+	name := path.Join(s.prefix, basename)
+	signed, err := s.container.NewBlobClient(name).GetSASURL(
+		permissions, time.Time{} /* start */, timeutil.Now().Add(ttl))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to sign azure URL for %q", name)
 	}
-	return *props.ContentLength, nil
+	return signed, nil
 }
 
 // Close is part of the cloud.ExternalStorage interface.
@@ -0,0 +1,101 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+)
+
+var readBufferSize = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.read.buffer_size",
+	"the size of the buffer external storage files are read into, which bounds the size of the "+
+		"reads from the storage provider; 0 leaves the buffering to the provider's client",
+	0,
+)
+
+// bufferedReader is a reader of a file which reads it in chunks of up to the
+// size of its buffer. Reads of at least the size of the buffer are not
+// buffered.
+type bufferedReader struct {
+	r   ioctx.ReadCloserCtx
+	buf []byte
+	// pos and end are the bounds of the buffered bytes which were not read.
+	pos, end int
+	err      error
+}
+
+var _ ioctx.ReadCloserCtx = &bufferedReader{}
+var _ ioctx.WriterToCtx = &bufferedReader{}
+
+// newBufferedReader returns a reader of r buffering its reads in a buffer of
+// size bytes, or r itself if size is not positive.
+func newBufferedReader(r ioctx.ReadCloserCtx, size int64) ioctx.ReadCloserCtx {
+	if size <= 0 {
+		return r
+	}
+	return &bufferedReader{r: r, buf: make([]byte, size)}
+}
+
+// Read implements the ioctx.ReaderCtx interface.
+func (b *bufferedReader) Read(ctx context.Context, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.pos == b.end {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if len(p) >= len(b.buf) {
+			return b.r.Read(ctx, p)
+		}
+		b.pos = 0
+		b.end, b.err = b.r.Read(ctx, b.buf)
+		if b.end == 0 {
+			return 0, b.err
+		}
+	}
+	n := copy(p, b.buf[b.pos:b.end])
+	b.pos += n
+	return n, nil
+}
+
+// WriteTo implements the ioctx.WriterToCtx interface. The buffered bytes are
+// written first, and the rest of the file is written by the underlying reader,
+// without going through the buffer.
+func (b *bufferedReader) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	var written int64
+	if b.pos < b.end {
+		n, err := w.Write(b.buf[b.pos:b.end])
+		b.pos += n
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if b.err != nil {
+		if b.err == io.EOF {
+			return written, nil
+		}
+		return written, b.err
+	}
+	n, err := ioctx.WriteTo(ctx, b.r, w)
+	return written + n, err
+}
+
+// Close implements the ioctx.ReadCloserCtx interface.
+func (b *bufferedReader) Close(ctx context.Context) error {
+	return b.r.Close(ctx)
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkRecordingStorage is an ExternalStorage with a single file, whose
+// readers record the sizes of the reads they are asked for.
+type chunkRecordingStorage struct {
+	ExternalStorage
+	data  []byte
+	reads []int
+}
+
+type chunkRecordingReader struct {
+	s    *chunkRecordingStorage
+	data []byte
+}
+
+func (r *chunkRecordingReader) Read(_ context.Context, p []byte) (int, error) {
+	r.s.reads = append(r.s.reads, len(p))
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *chunkRecordingReader) Close(context.Context) error {
+	return nil
+}
+
+func (s *chunkRecordingStorage) ReadFile(
+	_ context.Context, _ string, _ ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	return &chunkRecordingReader{s: s, data: s.data}, int64(len(s.data)), nil
+}
+
+func TestReadBufferSize(t *testing.T) {
+	ctx := context.Background()
+	s := &chunkRecordingStorage{data: []byte("0123456789abcdefghij")}
+	es := &esWrapper{
+		ExternalStorage: s,
+		metricsRecorder: newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown),
+		readBufferSize:  8,
+	}
+
+	// readAll reads the file in reads of readSize bytes, returning the sizes of
+	// the reads of the file asked to the storage.
+	readAll := func(opts ReadOptions, readSize int) []int {
+		s.reads = nil
+		r, _, err := es.ReadFile(ctx, "file", opts)
+		require.NoError(t, err)
+		var read []byte
+		p := make([]byte, readSize)
+		for {
+			n, err := r.Read(ctx, p)
+			read = append(read, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.NoError(t, r.Close(ctx))
+		require.Equal(t, s.data, read)
+		return s.reads
+	}
+
+	// Small reads are served from chunks of the configured buffer size.
+	require.Equal(t, []int{8, 8, 8, 8}, readAll(ReadOptions{}, 3))
+	// The read options override the configured size.
+	require.Equal(t, []int{4, 4, 4, 4, 4, 4}, readAll(ReadOptions{BufferSize: 4}, 1))
+	// Reads at least as large as the buffer are not buffered.
+	require.Equal(t, []int{16, 16, 16}, readAll(ReadOptions{}, 16))
+
+	// Without a buffer, the storage is asked for the sizes of the reads.
+	es.readBufferSize = 0
+	require.Equal(t, []int{3, 3, 3, 3, 3, 3, 3, 3}, readAll(ReadOptions{}, 3))
+}
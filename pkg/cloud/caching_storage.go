@@ -0,0 +1,370 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+// cachedStatOverhead is the number of bytes the cached metadata of a file is
+// accounted for, on top of its name.
+const cachedStatOverhead = 128
+
+// cachingStorage is an ExternalStorage which caches the contents and metadata
+// of small files read from the wrapped ExternalStorage.
+type cachingStorage struct {
+	ExternalStorage
+	maxBytes      int64
+	maxObjectSize int64
+
+	mu struct {
+		syncutil.Mutex
+		cache *cache.UnorderedCache
+		// bytes is the size of the cached entries.
+		bytes int64
+		// gen is incremented whenever entries are invalidated, so that reads
+		// which were in flight do not cache what they read.
+		gen int64
+	}
+}
+
+var _ ExternalStorage = &cachingStorage{}
+
+// cacheKey is the key of the cached contents of a file, or of its metadata if
+// stat is set.
+type cacheKey struct {
+	basename string
+	stat     bool
+}
+
+// NewCachingExternalStorage returns an ExternalStorage which caches the
+// contents of the files of up to maxObjectSize bytes read from inner, and the
+// metadata returned by Stat, in an LRU cache of up to maxBytes. Repeated reads
+// of small files, such as manifests, are then served from memory.
+//
+// Files written, copied onto, renamed or deleted through the returned storage
+// are removed from the cache, but changes made through other storage are not
+// seen until the files are evicted, so it is only suitable for files which are
+// not modified concurrently.
+func NewCachingExternalStorage(
+	inner ExternalStorage, maxBytes, maxObjectSize int64,
+) ExternalStorage {
+	c := &cachingStorage{
+		ExternalStorage: inner,
+		maxBytes:        maxBytes,
+		maxObjectSize:   maxObjectSize,
+	}
+	c.mu.cache = cache.NewUnorderedCache(cache.Config{
+		Policy: cache.CacheLRU,
+		ShouldEvict: func(_ int, _, _ interface{}) bool {
+			return c.mu.bytes > c.maxBytes
+		},
+		OnEvicted: func(key, value interface{}) {
+			c.mu.bytes -= cacheEntrySize(key.(cacheKey), value)
+		},
+	})
+	return c
+}
+
+func cacheEntrySize(key cacheKey, value interface{}) int64 {
+	if key.stat {
+		return int64(len(key.basename)) + cachedStatOverhead
+	}
+	return int64(len(key.basename) + len(value.([]byte)))
+}
+
+func (c *cachingStorage) get(key cacheKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.cache.Get(key)
+}
+
+// add caches value, unless entries were invalidated since gen.
+func (c *cachingStorage) add(key cacheKey, value interface{}, gen int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.gen != gen {
+		return
+	}
+	// Replacing the value of an entry does not evict it, so remove it first to
+	// account for the new size.
+	c.mu.cache.Del(key)
+	c.mu.bytes += cacheEntrySize(key, value)
+	c.mu.cache.Add(key, value)
+}
+
+func (c *cachingStorage) generation() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.gen
+}
+
+// invalidate removes the entries of the named files from the cache.
+func (c *cachingStorage) invalidate(basenames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.gen++
+	for _, basename := range basenames {
+		c.mu.cache.Del(cacheKey{basename: basename})
+		c.mu.cache.Del(cacheKey{basename: basename, stat: true})
+	}
+}
+
+func (c *cachingStorage) cachedData(basename string) ([]byte, bool) {
+	data, ok := c.get(cacheKey{basename: basename})
+	if !ok {
+		return nil, false
+	}
+	return data.([]byte), true
+}
+
+// ReadFile implements the ExternalStorage interface. Files read in full are
+// cached if they are small enough; reads of cached files at an offset are
+// also served from the cache.
+func (c *cachingStorage) ReadFile(
+	ctx context.Context, basename string, opts ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	if opts.SSECustomerKey != nil {
+		// Reads of files encrypted with a customer-provided key must be checked
+		// against the key by the storage.
+		return c.ExternalStorage.ReadFile(ctx, basename, opts)
+	}
+	if data, ok := c.cachedData(basename); ok {
+		return ioctx.NopCloser(ioctx.ReaderAdapter(bytes.NewReader(
+			sliceData(data, opts.Offset, opts.LengthHint)))), int64(len(data)), nil
+	}
+	if opts.Offset != 0 || opts.LengthHint != 0 {
+		return c.ExternalStorage.ReadFile(ctx, basename, opts)
+	}
+
+	gen := c.generation()
+	r, size, err := c.ExternalStorage.ReadFile(ctx, basename, ReadOptions{})
+	if err != nil || size > c.maxObjectSize {
+		return r, size, err
+	}
+	data, err := ioctx.ReadAll(ctx, r)
+	err = errors.CombineErrors(err, r.Close(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	c.add(cacheKey{basename: basename}, data, gen)
+	return ioctx.NopCloser(ioctx.ReaderAdapter(bytes.NewReader(data))), size, nil
+}
+
+// sliceData returns the length bytes of data from offset, or all the bytes
+// from offset if length is 0.
+func sliceData(data []byte, offset, length int64) []byte {
+	if offset >= int64(len(data)) {
+		return nil
+	}
+	data = data[offset:]
+	if length != 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return data
+}
+
+// ReadFileAtWithLength implements the RangeReader interface. Ranges of
+// cached files are served from the cache.
+func (c *cachingStorage) ReadFileAtWithLength(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	if data, ok := c.cachedData(basename); ok {
+		return io.NopCloser(bytes.NewReader(sliceData(data, offset, length))), nil
+	}
+	return ReadFileAtWithLength(ctx, c.ExternalStorage, basename, offset, length)
+}
+
+// Stat implements the Stater interface. The metadata of the files is
+// cached whatever their size.
+func (c *cachingStorage) Stat(ctx context.Context, basename string) (ObjectInfo, error) {
+	key := cacheKey{basename: basename, stat: true}
+	if info, ok := c.get(key); ok {
+		return info.(ObjectInfo), nil
+	}
+	gen := c.generation()
+	info, err := Stat(ctx, c.ExternalStorage, basename)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	c.add(key, info, gen)
+	return info, nil
+}
+
+func (c *cachingStorage) Size(ctx context.Context, basename string) (int64, error) {
+	if data, ok := c.cachedData(basename); ok {
+		return int64(len(data)), nil
+	}
+	info, err := c.Stat(ctx, basename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Exists implements the ExistenceChecker interface. Files whose contents or
+// metadata are cached exist.
+func (c *cachingStorage) Exists(ctx context.Context, basename string) (bool, error) {
+	if _, ok := c.cachedData(basename); ok {
+		return true, nil
+	}
+	if _, ok := c.get(cacheKey{basename: basename, stat: true}); ok {
+		return true, nil
+	}
+	return Exists(ctx, c.ExternalStorage, basename)
+}
+
+func (c *cachingStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	c.invalidate(basename)
+	w, err := c.ExternalStorage.Writer(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingWriter{WriteCloser: w, c: c, basename: basename}, nil
+}
+
+// WriterWithOptions implements the OptionsWriter interface.
+func (c *cachingStorage) WriterWithOptions(
+	ctx context.Context, basename string, opts WriteOptions,
+) (io.WriteCloser, error) {
+	c.invalidate(basename)
+	w, err := WriterWithOptions(ctx, c.ExternalStorage, basename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingWriter{WriteCloser: w, c: c, basename: basename}, nil
+}
+
+// invalidatingWriter removes the file it writes from the cache once it is
+// written, in case it was read while it was being written.
+type invalidatingWriter struct {
+	io.WriteCloser
+	c        *cachingStorage
+	basename string
+}
+
+func (w *invalidatingWriter) Close() error {
+	defer w.c.invalidate(w.basename)
+	return w.WriteCloser.Close()
+}
+
+// ResumableWriter implements the ResumableUploader interface if the wrapped
+// storage does.
+func (c *cachingStorage) ResumableWriter(
+	ctx context.Context, basename string, token []byte,
+) (ResumableWriter, error) {
+	c.invalidate(basename)
+	w, err := OpenResumableWriter(ctx, c.ExternalStorage, basename, token)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingResumableWriter{ResumableWriter: w, c: c, basename: basename}, nil
+}
+
+// invalidatingResumableWriter is like invalidatingWriter, for a
+// ResumableWriter.
+type invalidatingResumableWriter struct {
+	ResumableWriter
+	c        *cachingStorage
+	basename string
+}
+
+func (w *invalidatingResumableWriter) Close() error {
+	defer w.c.invalidate(w.basename)
+	return w.ResumableWriter.Close()
+}
+
+// WriteFileIfNotExists implements the ConditionalWriter interface if the
+// wrapped storage does.
+func (c *cachingStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	defer c.invalidate(basename)
+	return WriteFileIfNotExists(ctx, c.ExternalStorage, basename, content)
+}
+
+// WriteFileIfMatch implements the ConditionalWriter interface if the wrapped
+// storage does.
+func (c *cachingStorage) WriteFileIfMatch(
+	ctx context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	defer c.invalidate(basename)
+	return WriteFileIfMatch(ctx, c.ExternalStorage, basename, expectedETag, content)
+}
+
+// WriteStream implements the StreamWriter interface.
+func (c *cachingStorage) WriteStream(
+	ctx context.Context, basename string, r io.Reader, size int64,
+) error {
+	c.invalidate(basename)
+	defer c.invalidate(basename)
+	return WriteStream(ctx, c.ExternalStorage, basename, r, size)
+}
+
+// Copy implements the Copier interface.
+func (c *cachingStorage) Copy(ctx context.Context, srcBasename, dstBasename string) error {
+	defer c.invalidate(dstBasename)
+	return Copy(ctx, c.ExternalStorage, srcBasename, dstBasename)
+}
+
+// Rename implements the Renamer interface.
+func (c *cachingStorage) Rename(ctx context.Context, oldBasename, newBasename string) error {
+	defer c.invalidate(oldBasename, newBasename)
+	return Rename(ctx, c.ExternalStorage, oldBasename, newBasename)
+}
+
+func (c *cachingStorage) Delete(ctx context.Context, basename string) error {
+	defer c.invalidate(basename)
+	return c.ExternalStorage.Delete(ctx, basename)
+}
+
+// BatchDelete implements the BatchDeleter interface.
+func (c *cachingStorage) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]DeleteResult, error) {
+	defer c.invalidate(basenames...)
+	return BatchDelete(ctx, c.ExternalStorage, basenames)
+}
+
+// ReadFileWithChecksum implements the ChecksumReader interface. The file is
+// read from the wrapped storage, since its checksum is computed as it is read.
+func (c *cachingStorage) ReadFileWithChecksum(
+	ctx context.Context, basename string, expected []byte, algo ChecksumAlgo,
+) (io.ReadCloser, error) {
+	return ReadFileWithChecksum(ctx, c.ExternalStorage, basename, expected, algo)
+}
+
+// ListDetailed implements the DetailedLister interface. Listings are not
+// cached.
+func (c *cachingStorage) ListDetailed(
+	ctx context.Context, prefix, delimiter string, fn ListingDetailedFn,
+) error {
+	return ListDetailed(ctx, c.ExternalStorage, prefix, delimiter, fn)
+}
+
+// ListPage implements the PageLister interface. Listings are not cached.
+func (c *cachingStorage) ListPage(
+	ctx context.Context, prefix, delimiter, pageToken string, maxResults int,
+) ([]string, string, error) {
+	return ListPage(ctx, c.ExternalStorage, prefix, delimiter, pageToken, maxResults)
+}
+
+// CheckAccess implements the AccessChecker interface.
+func (c *cachingStorage) CheckAccess(ctx context.Context) error {
+	return CheckAccess(ctx, c.ExternalStorage)
+}
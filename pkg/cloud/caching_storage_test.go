@@ -0,0 +1,175 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage is an ExternalStorage of files held in memory which counts
+// the reads and stats of the files.
+type countingStorage struct {
+	ExternalStorage
+	files        map[string][]byte
+	reads, stats int
+}
+
+func (s *countingStorage) ReadFile(
+	_ context.Context, basename string, opts ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	s.reads++
+	data, ok := s.files[basename]
+	if !ok {
+		return nil, 0, ErrFileDoesNotExist
+	}
+	return ioctx.NopCloser(ioctx.ReaderAdapter(bytes.NewReader(data[opts.Offset:]))),
+		int64(len(data)), nil
+}
+
+func (s *countingStorage) ReadFileAtWithLength(
+	_ context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	s.reads++
+	return io.NopCloser(bytes.NewReader(s.files[basename][offset : offset+length])), nil
+}
+
+func (s *countingStorage) Stat(_ context.Context, basename string) (ObjectInfo, error) {
+	s.stats++
+	data, ok := s.files[basename]
+	if !ok {
+		return ObjectInfo{}, ErrFileDoesNotExist
+	}
+	return ObjectInfo{Size: int64(len(data))}, nil
+}
+
+type bufferWriter struct {
+	bytes.Buffer
+	s        *countingStorage
+	basename string
+}
+
+func (w *bufferWriter) Close() error {
+	w.s.files[w.basename] = w.Bytes()
+	return nil
+}
+
+func (s *countingStorage) Writer(_ context.Context, basename string) (io.WriteCloser, error) {
+	return &bufferWriter{s: s, basename: basename}, nil
+}
+
+func (s *countingStorage) Delete(_ context.Context, basename string) error {
+	delete(s.files, basename)
+	return nil
+}
+
+func TestCachingExternalStorage(t *testing.T) {
+	ctx := context.Background()
+
+	readFile := func(t *testing.T, s ExternalStorage, basename string) []byte {
+		r, _, err := s.ReadFile(ctx, basename, ReadOptions{})
+		require.NoError(t, err)
+		data, err := ioctx.ReadAll(ctx, r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close(ctx))
+		return data
+	}
+	newStorage := func(maxBytes int64) (*countingStorage, ExternalStorage) {
+		inner := &countingStorage{files: map[string][]byte{
+			"manifest": []byte("manifest"),
+			"footer":   []byte("footer"),
+			"large":    bytes.Repeat([]byte("x"), 1024),
+		}}
+		return inner, NewCachingExternalStorage(inner, maxBytes, 512 /* maxObjectSize */)
+	}
+
+	t.Run("cached-read", func(t *testing.T) {
+		inner, s := newStorage(1 << 20)
+		require.Equal(t, []byte("manifest"), readFile(t, s, "manifest"))
+		require.Equal(t, 1, inner.reads)
+		require.Equal(t, []byte("manifest"), readFile(t, s, "manifest"))
+		require.Equal(t, 1, inner.reads)
+
+		// Ranges of the cached file are served from the cache too.
+		r, err := ReadFileAtWithLength(ctx, s, "manifest", 2, 3)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("nif"), data)
+		r2, _, err := s.ReadFile(ctx, "manifest", ReadOptions{Offset: 4})
+		require.NoError(t, err)
+		data, err = ioctx.ReadAll(ctx, r2)
+		require.NoError(t, err)
+		require.Equal(t, []byte("fest"), data)
+		require.Equal(t, 1, inner.reads)
+
+		size, err := s.Size(ctx, "manifest")
+		require.NoError(t, err)
+		require.Equal(t, int64(len("manifest")), size)
+		require.Zero(t, inner.stats)
+	})
+
+	t.Run("large-files-not-cached", func(t *testing.T) {
+		inner, s := newStorage(1 << 20)
+		readFile(t, s, "large")
+		readFile(t, s, "large")
+		require.Equal(t, 2, inner.reads)
+	})
+
+	t.Run("cached-stat", func(t *testing.T) {
+		inner, s := newStorage(1 << 20)
+		for i := 0; i < 2; i++ {
+			info, err := Stat(ctx, s, "large")
+			require.NoError(t, err)
+			require.Equal(t, int64(1024), info.Size)
+		}
+		require.Equal(t, 1, inner.stats)
+	})
+
+	t.Run("write-invalidates", func(t *testing.T) {
+		inner, s := newStorage(1 << 20)
+		readFile(t, s, "manifest")
+		_, err := Stat(ctx, s, "manifest")
+		require.NoError(t, err)
+
+		require.NoError(t, WriteFile(ctx, s, "manifest", bytes.NewReader([]byte("updated"))))
+		require.Equal(t, []byte("updated"), readFile(t, s, "manifest"))
+		require.Equal(t, 2, inner.reads)
+		info, err := Stat(ctx, s, "manifest")
+		require.NoError(t, err)
+		require.Equal(t, int64(len("updated")), info.Size)
+		require.Equal(t, 2, inner.stats)
+	})
+
+	t.Run("delete-invalidates", func(t *testing.T) {
+		_, s := newStorage(1 << 20)
+		readFile(t, s, "manifest")
+		require.NoError(t, s.Delete(ctx, "manifest"))
+		_, _, err := s.ReadFile(ctx, "manifest", ReadOptions{})
+		require.ErrorIs(t, err, ErrFileDoesNotExist)
+	})
+
+	t.Run("evicts-least-recently-used", func(t *testing.T) {
+		// The cache only has room for one of the files.
+		inner, s := newStorage(int64(len("manifest") * 2))
+		readFile(t, s, "manifest")
+		readFile(t, s, "footer")
+		readFile(t, s, "footer")
+		require.Equal(t, 2, inner.reads)
+		readFile(t, s, "manifest")
+		require.Equal(t, 3, inner.reads)
+	})
+}
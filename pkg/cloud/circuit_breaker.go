@@ -0,0 +1,293 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+var circuitBreakerFailureThreshold = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.circuit_breaker.failure_threshold",
+	"the number of consecutive operations on an external storage host which fail with a transient "+
+		"error after which the operations on the host fail fast, until an operation probing the host "+
+		"succeeds; 0 disables the circuit breaker",
+	0,
+	settings.NonNegativeInt,
+)
+
+var circuitBreakerOpenDuration = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.circuit_breaker.open_duration",
+	"the time the operations on an external storage host fail fast once its circuit breaker opens, "+
+		"after which a single operation is let through to probe the host",
+	30*time.Second,
+	settings.PositiveDuration,
+)
+
+// ErrCircuitOpen is returned by the operations on an external storage host
+// which failed fast since the circuit breaker of the host is open. See
+// cloudstorage.circuit_breaker.failure_threshold.
+var ErrCircuitOpen = errors.New("external storage circuit breaker is open")
+
+// circuitBreaker counts the consecutive operations on an external storage
+// host which failed with a transient error. Once there are
+// cloudstorage.circuit_breaker.failure_threshold of them, the breaker opens,
+// and the operations fail fast with ErrCircuitOpen rather than waiting for
+// their timeouts. After cloudstorage.circuit_breaker.open_duration, the breaker
+// is half-open: the next operation probes the host while the others still
+// fail fast. The breaker closes if the probe succeeds, and opens again
+// otherwise.
+type circuitBreaker struct {
+	host string
+	now  func() time.Time
+
+	mu struct {
+		syncutil.Mutex
+		// failures is the number of consecutive failed operations.
+		failures int64
+		// openedAt is when the breaker last opened.
+		openedAt time.Time
+		// probing is set while an operation probes the host.
+		probing bool
+		// lastErr is the error of the last failed operation.
+		lastErr error
+	}
+}
+
+func newCircuitBreaker(host string) *circuitBreaker {
+	return &circuitBreaker{host: host, now: timeutil.Now}
+}
+
+// circuitBreakers are the circuit breakers of the external storage hosts of
+// the process, which are shared by all the storage of a host.
+var circuitBreakers struct {
+	syncutil.Mutex
+	m map[string]*circuitBreaker
+}
+
+// hostCircuitBreaker returns the circuit breaker of the host of the storage
+// config, or nil if the storage is not on a remote host.
+func hostCircuitBreaker(conf cloudpb.ExternalStorage) *circuitBreaker {
+	host := circuitBreakerHost(conf)
+	if host == "" {
+		return nil
+	}
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+	b, ok := circuitBreakers.m[host]
+	if !ok {
+		if circuitBreakers.m == nil {
+			circuitBreakers.m = make(map[string]*circuitBreaker)
+		}
+		b = newCircuitBreaker(host)
+		circuitBreakers.m[host] = b
+	}
+	return b
+}
+
+// circuitBreakerHost returns the host the requests of the storage config are
+// sent to, or an empty string if they are not sent to a remote host. Buckets
+// of the same provider may be served by different regions, so the buckets are
+// hosts of their own.
+func circuitBreakerHost(conf cloudpb.ExternalStorage) string {
+	switch conf.Provider {
+	case cloudpb.ExternalStorageProvider_s3:
+		if conf.S3Config == nil {
+			return ""
+		}
+		if conf.S3Config.Endpoint != "" {
+			return hostOf(conf.S3Config.Endpoint)
+		}
+		return "s3/" + conf.S3Config.Bucket
+	case cloudpb.ExternalStorageProvider_gs:
+		if conf.GoogleCloudConfig == nil {
+			return ""
+		}
+		return "gs/" + conf.GoogleCloudConfig.Bucket
+	case cloudpb.ExternalStorageProvider_azure:
+		if conf.AzureConfig == nil {
+			return ""
+		}
+		return "azure/" + conf.AzureConfig.AccountName
+	case cloudpb.ExternalStorageProvider_http:
+		return hostOf(conf.HttpPath.BaseUri)
+	case cloudpb.ExternalStorageProvider_custom:
+		return hostOf(conf.URI)
+	default:
+		return ""
+	}
+}
+
+// hostOf returns the host of the URI, or the URI itself if it has none.
+func hostOf(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return uri
+}
+
+// allow returns ErrCircuitOpen if the breaker is open, and whether the
+// operation probes the host otherwise, in which case its outcome must be
+// reported.
+func (b *circuitBreaker) allow(sv *settings.Values) (probe bool, _ error) {
+	threshold := circuitBreakerFailureThreshold.Get(sv)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if threshold == 0 || b.mu.failures < threshold {
+		return false, nil
+	}
+	if b.mu.probing || b.openLocked(sv) {
+		return false, b.errLocked()
+	}
+	b.mu.probing = true
+	return true, nil
+}
+
+// check returns ErrCircuitOpen if the breaker is open, without probing the
+// host once it is half-open. It is used by the operations whose outcome does
+// not show whether the host is up, such as opening a writer, which may not
+// send any request until it is written to.
+func (b *circuitBreaker) check(sv *settings.Values) error {
+	threshold := circuitBreakerFailureThreshold.Get(sv)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if threshold == 0 || b.mu.failures < threshold || !b.openLocked(sv) {
+		return nil
+	}
+	return b.errLocked()
+}
+
+// openLocked returns whether the breaker opened less than
+// cloudstorage.circuit_breaker.open_duration ago.
+func (b *circuitBreaker) openLocked(sv *settings.Values) bool {
+	return b.now().Sub(b.mu.openedAt) < circuitBreakerOpenDuration.Get(sv)
+}
+
+func (b *circuitBreaker) errLocked() error {
+	return errors.Wrapf(ErrCircuitOpen, "%s failed %d consecutive operations, last with: %v",
+		b.host, b.mu.failures, b.mu.lastErr)
+}
+
+// report records the outcome of an operation allowed by the breaker. Only
+// transient errors count as failures of the host: the other errors, such as
+// for files which do not exist, show the host is up.
+func (b *circuitBreaker) report(ctx context.Context, sv *settings.Values, probe bool, err error) {
+	threshold := circuitBreakerFailureThreshold.Get(sv)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.mu.probing = false
+	}
+	if threshold == 0 {
+		b.mu.failures = 0
+		return
+	}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The operation was canceled by its caller, which says nothing about
+		// the host.
+	case err != nil && IsRetryableError(err):
+		b.mu.failures++
+		b.mu.lastErr = err
+		if b.mu.failures == threshold || (probe && b.mu.failures > threshold) {
+			b.mu.openedAt = b.now()
+			log.Warningf(ctx, "external storage circuit breaker of %s opened after %d consecutive failures: %v",
+				b.host, b.mu.failures, err)
+		}
+	default:
+		if b.mu.failures >= threshold {
+			log.Infof(ctx, "external storage circuit breaker of %s closed", b.host)
+		}
+		b.mu.failures = 0
+		b.mu.lastErr = nil
+	}
+}
+
+// withCircuitBreaker runs fn, which runs an operation on the storage, unless
+// the circuit breaker of the host of the storage is open, and reports its
+// outcome to the breaker.
+func (e *esWrapper) withCircuitBreaker(ctx context.Context, fn func() error) error {
+	if e.breaker == nil || e.sv == nil {
+		return fn()
+	}
+	probe, err := e.breaker.allow(e.sv)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	e.breaker.report(ctx, e.sv, probe, err)
+	return err
+}
+
+// checkCircuitBreaker returns ErrCircuitOpen if the circuit breaker of the
+// host of the storage is open.
+func (e *esWrapper) checkCircuitBreaker() error {
+	if e.breaker == nil || e.sv == nil {
+		return nil
+	}
+	return e.breaker.check(e.sv)
+}
+
+// reportToCircuitBreaker reports the outcome of an operation which was only
+// checked against the circuit breaker, rather than allowed by it, such as a
+// write, to the breaker.
+func (e *esWrapper) reportToCircuitBreaker(ctx context.Context, err error) {
+	if e.breaker == nil || e.sv == nil {
+		return
+	}
+	e.breaker.report(ctx, e.sv, false /* probe */, err)
+}
+
+// circuitBreakerWriter reports the outcome of the writes of a writer to the
+// circuit breaker of the storage when it is closed, since the failures of an
+// upload are only known once it completes.
+type circuitBreakerWriter struct {
+	io.WriteCloser
+	// ctx is the context of the caller, so that writes canceled by the caller
+	// are not reported as failures of the host.
+	ctx context.Context
+	e   *esWrapper
+	// err is the first error of the writes, if any.
+	err error
+}
+
+func (w *circuitBreakerWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *circuitBreakerWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := readFrom(w.WriteCloser, src)
+	if w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *circuitBreakerWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.e.reportToCircuitBreaker(w.ctx, errors.CombineErrors(w.err, err))
+	return err
+}
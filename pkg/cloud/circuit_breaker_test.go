@@ -0,0 +1,189 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// unavailableStorage is an ExternalStorage whose size operations fail with
+// err, like those of a host which is down.
+type unavailableStorage struct {
+	ExternalStorage
+	calls int
+	err   error
+}
+
+func (s *unavailableStorage) Size(context.Context, string) (int64, error) {
+	s.calls++
+	return 1, s.err
+}
+
+// failingWriter is a writer whose upload fails with err when it is closed.
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *failingWriter) Close() error                { return w.err }
+
+func (s *unavailableStorage) Writer(context.Context, string) (io.WriteCloser, error) {
+	s.calls++
+	return &failingWriter{err: s.err}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	st := cluster.MakeTestingClusterSettings()
+	circuitBreakerFailureThreshold.Override(ctx, &st.SV, 3)
+	circuitBreakerOpenDuration.Override(ctx, &st.SV, time.Minute)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := newCircuitBreaker("host")
+	breaker.now = func() time.Time { return now }
+
+	unavailable := errors.Mark(errors.New("unavailable"), ErrOperationTimeout)
+	fake := &unavailableStorage{err: unavailable}
+	es := &esWrapper{
+		ExternalStorage: fake,
+		metricsRecorder: newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown),
+		breaker:         breaker,
+		sv:              &st.SV,
+	}
+
+	// Files which do not exist show the host is up, so they reset the count of
+	// consecutive failures.
+	for i := 0; i < 2; i++ {
+		_, err := es.Size(ctx, "file")
+		require.ErrorIs(t, err, unavailable)
+	}
+	fake.err = errors.Wrap(ErrFileDoesNotExist, "file")
+	_, err := es.Size(ctx, "file")
+	require.ErrorIs(t, err, ErrFileDoesNotExist)
+	fake.err = unavailable
+	for i := 0; i < 2; i++ {
+		_, err := es.Size(ctx, "file")
+		require.ErrorIs(t, err, unavailable)
+	}
+	require.Equal(t, 5, fake.calls)
+
+	// The third consecutive failure opens the breaker, after which the
+	// operations fail fast without reaching the storage.
+	_, err = es.Size(ctx, "file")
+	require.ErrorIs(t, err, unavailable)
+	require.Equal(t, 6, fake.calls)
+	for i := 0; i < 3; i++ {
+		_, err := es.Size(ctx, "file")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+	}
+	_, err = es.Writer(ctx, "file")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 6, fake.calls)
+
+	// Once the breaker is half-open, a single operation probes the storage. It
+	// fails, so the breaker opens again.
+	now = now.Add(time.Minute)
+	_, err = es.Size(ctx, "file")
+	require.ErrorIs(t, err, unavailable)
+	require.Equal(t, 7, fake.calls)
+	_, err = es.Size(ctx, "file")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 7, fake.calls)
+
+	// The next probe succeeds, so the breaker closes.
+	now = now.Add(time.Minute)
+	fake.err = nil
+	_, err = es.Size(ctx, "file")
+	require.NoError(t, err)
+	_, err = es.Size(ctx, "file")
+	require.NoError(t, err)
+	require.Equal(t, 9, fake.calls)
+
+	// The failures of the uploads of writers, which are only known once they
+	// are closed, count as failures of the host.
+	fake.err = unavailable
+	for i := 0; i < 3; i++ {
+		w, err := es.Writer(ctx, "file")
+		require.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		require.NoError(t, err)
+		require.ErrorIs(t, w.Close(), unavailable)
+	}
+	_, err = es.Size(ctx, "file")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 12, fake.calls)
+
+	// A zero threshold disables the breaker.
+	circuitBreakerFailureThreshold.Override(ctx, &st.SV, 0)
+	fake.err = unavailable
+	for i := 0; i < 5; i++ {
+		_, err := es.Size(ctx, "file")
+		require.ErrorIs(t, err, unavailable)
+	}
+	require.Equal(t, 17, fake.calls)
+}
+
+func TestCircuitBreakerHost(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		conf cloudpb.ExternalStorage
+		host string
+	}{
+		{
+			conf: cloudpb.ExternalStorage{
+				Provider: cloudpb.ExternalStorageProvider_s3,
+				S3Config: &cloudpb.ExternalStorage_S3{Bucket: "bucket"},
+			},
+			host: "s3/bucket",
+		},
+		{
+			conf: cloudpb.ExternalStorage{
+				Provider: cloudpb.ExternalStorageProvider_s3,
+				S3Config: &cloudpb.ExternalStorage_S3{Bucket: "bucket", Endpoint: "https://minio:9000"},
+			},
+			host: "minio:9000",
+		},
+		{
+			conf: cloudpb.ExternalStorage{
+				Provider:          cloudpb.ExternalStorageProvider_gs,
+				GoogleCloudConfig: &cloudpb.ExternalStorage_GCS{Bucket: "bucket"},
+			},
+			host: "gs/bucket",
+		},
+		{
+			conf: cloudpb.ExternalStorage{
+				Provider: cloudpb.ExternalStorageProvider_http,
+				HttpPath: cloudpb.ExternalStorage_Http{BaseUri: "http://host:8080/path"},
+			},
+			host: "host:8080",
+		},
+		{
+			conf: cloudpb.ExternalStorage{Provider: cloudpb.ExternalStorageProvider_nodelocal},
+			host: "",
+		},
+	} {
+		t.Run(tc.conf.Provider.String(), func(t *testing.T) {
+			require.Equal(t, tc.host, circuitBreakerHost(tc.conf))
+		})
+	}
+}
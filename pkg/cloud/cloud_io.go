@@ -11,12 +11,26 @@
 package cloud
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -30,7 +44,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/sysutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/cockroachdb/errors"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Timeout is a cluster setting used for cloud storage interactions.
@@ -191,9 +207,16 @@ type ResumingReader struct {
 	RetryOnErrFn func(error) bool // custom retry-on-error function
 	// ErrFn injects a delay between retries on errors. nil means no delay.
 	ErrFn func(error) time.Duration
+	// MaxAttempts, if positive, is the maximum number of attempts of a Read
+	// which fails with an error RetryOnErrFn retries, each reopening the file
+	// at the offset read so far. It defaults to maxNoProgressReads retries.
+	// The storage returned by MakeExternalStorage sets it from its
+	// RetryConfig.
+	MaxAttempts int
 }
 
 var _ ioctx.ReadCloserCtx = &ResumingReader{}
+var _ ioctx.WriterToCtx = &ResumingReader{}
 
 // NewResumingReader returns a ResumingReader instance. Reader does not have to
 // be provided, and will be created with the opener if it's not provided. Size
@@ -278,7 +301,7 @@ func (r *ResumingReader) Read(ctx context.Context, p []byte) (int, error) {
 
 		// Use the configured retry-on-error decider to check for a resumable error.
 		if r.RetryOnErrFn(lastErr) {
-			if retries >= maxNoProgressReads {
+			if retries >= r.maxRetries() {
 				return read, errors.Wrapf(lastErr, "multiple Read calls (%d) return no data", retries)
 			}
 			log.Errorf(ctx, "Retry IO error: %s", lastErr)
@@ -297,6 +320,96 @@ func (r *ResumingReader) Read(ctx context.Context, p []byte) (int, error) {
 	return read, lastErr
 }
 
+// WriteTo implements ioctx.WriterToCtx. It copies the rest of the file from
+// the opened reader to w with io.Copy, so the WriteTo method of the reader,
+// if it implements io.WriterTo, is used instead of an intermediate buffer. The
+// copy is resumed at the position written so far on the read errors
+// RetryOnErrFn retries, like Read. Errors writing to w are not retried.
+func (r *ResumingReader) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "cloud.ResumingReader.WriteTo")
+	defer sp.Finish()
+
+	pw := &positionWriter{w: w, pos: &r.Pos}
+	for retries := 0; ; retries++ {
+		var lastErr error
+		if r.Reader == nil {
+			lastErr = r.Open(ctx)
+		}
+
+		if lastErr == nil {
+			pos := r.Pos
+			_, copyErr := io.Copy(pw, r.Reader)
+			if pw.err != nil || copyErr == nil {
+				return pw.n, pw.err
+			}
+			if r.Size > 0 && r.Pos == r.Size {
+				log.Warningf(ctx, "read %s ignoring read error received after completed read (%d): %v", r.Filename, r.Pos, copyErr)
+				return pw.n, nil
+			}
+			if r.Pos > pos {
+				// Only the retries which make no progress are limited.
+				retries = 0
+			}
+			lastErr = errors.Wrapf(copyErr, "read %s", r.Filename)
+		}
+
+		if lastErr == io.EOF {
+			// Open returns io.EOF when the whole file was read.
+			return pw.n, nil
+		}
+		if !errors.Is(lastErr, io.ErrUnexpectedEOF) {
+			log.Errorf(ctx, "%s", lastErr)
+		}
+		if !r.RetryOnErrFn(lastErr) {
+			return pw.n, lastErr
+		}
+		if retries >= r.maxRetries() {
+			return pw.n, errors.Wrapf(lastErr, "multiple reads (%d) return no data", retries)
+		}
+		log.Errorf(ctx, "Retry IO error: %s", lastErr)
+		if r.Reader != nil {
+			r.Reader.Close()
+		}
+		r.Reader = nil
+	}
+}
+
+// positionWriter is a writer which advances the position of a ResumingReader
+// by the bytes written to w, and records the error of w, which distinguishes
+// it from the read errors.
+type positionWriter struct {
+	w   io.Writer
+	pos *int64
+	n   int64
+	err error
+}
+
+func (p *positionWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	*p.pos += int64(n)
+	p.n += int64(n)
+	p.err = err
+	return n, err
+}
+
+// readFrom copies src to w with the ReadFrom method of w if it implements
+// io.ReaderFrom, and with io.Copy otherwise. It is used by the writers which
+// wrap another writer to forward their ReadFrom to it.
+func readFrom(w io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w, src)
+}
+
+// maxRetries returns the maximum number of retries of a Read.
+func (r *ResumingReader) maxRetries() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts - 1
+	}
+	return maxNoProgressReads
+}
+
 // Close implements io.Closer.
 func (r *ResumingReader) Close(ctx context.Context) error {
 	if r.Reader != nil {
@@ -380,9 +493,235 @@ func (s *backgroundPipe) Close() error {
 	return errors.CombineErrors(err, s.grp.Wait())
 }
 
+// ThresholdWriter returns a writer which buffers the written bytes until more
+// than threshold bytes are written. If the writer is closed first, the file is
+// written with a single request by put. Otherwise the buffered and following
+// bytes are streamed to upload, which writes the file with a multipart upload
+// in the background, like BackgroundPipe.
+//
+// If ctx is canceled before Close, put is not called, and the reader of
+// upload returns an error, on which upload must abort the multipart upload so
+// that its parts are not left behind.
+func ThresholdWriter(
+	ctx context.Context,
+	threshold int64,
+	put func(ctx context.Context, data []byte) error,
+	upload func(ctx context.Context, r io.Reader) error,
+) io.WriteCloser {
+	return &thresholdWriter{ctx: ctx, threshold: threshold, put: put, upload: upload}
+}
+
+type thresholdWriter struct {
+	ctx       context.Context
+	threshold int64
+	put       func(ctx context.Context, data []byte) error
+	upload    func(ctx context.Context, r io.Reader) error
+
+	buf bytes.Buffer
+	// multipart is set once the writer switched to a multipart upload.
+	multipart io.WriteCloser
+}
+
+var _ io.WriteCloser = &thresholdWriter{}
+
+func (w *thresholdWriter) Write(p []byte) (int, error) {
+	if w.multipart != nil {
+		return w.multipart.Write(p)
+	}
+	if int64(w.buf.Len()+len(p)) <= w.threshold {
+		return w.buf.Write(p)
+	}
+	w.multipart = BackgroundPipe(w.ctx, w.upload)
+	if _, err := w.multipart.Write(w.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buf = bytes.Buffer{}
+	return w.multipart.Write(p)
+}
+
+func (w *thresholdWriter) Close() error {
+	if w.multipart != nil {
+		return w.multipart.Close()
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return w.put(w.ctx, w.buf.Bytes())
+}
+
+// SSECustomerKeySize is the length of the keys of
+// WriteOptions.SSECustomerKey, which are 256-bit AES keys.
+const SSECustomerKeySize = 32
+
+// ExpireAfterDays returns the value of the ExpireAfterDaysKey tag of a file
+// written with the given WriteOptions.ExpireAfter, which is rounded up to
+// whole days since lifecycle rules expire files by the day.
+func ExpireAfterDays(expireAfter time.Duration) string {
+	const day = 24 * time.Hour
+	return strconv.FormatInt(int64((expireAfter+day-1)/day), 10)
+}
+
+// CheckSSEOptions returns an error if the server-side encryption options of
+// opts are inconsistent.
+func CheckSSEOptions(opts WriteOptions) error {
+	if opts.SSECustomerKey == nil {
+		return nil
+	}
+	if len(opts.SSECustomerKey) != SSECustomerKeySize {
+		return errors.Newf("customer-provided encryption key must be %d bytes, got %d",
+			SSECustomerKeySize, len(opts.SSECustomerKey))
+	}
+	if opts.SSEKMSKeyID != "" || opts.SSEAlgorithm != "" {
+		return errors.New("customer-provided encryption key cannot be combined with a KMS key or algorithm")
+	}
+	return nil
+}
+
+// CheckNoFileLock returns an error if opts lock the file, for the storage of
+// the named provider, which cannot lock files. Files written to comply with a
+// retention policy must not silently be left unlocked.
+func CheckNoFileLock(provider string, opts WriteOptions) error {
+	if !opts.LocksFile() {
+		return nil
+	}
+	return errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not support retention periods or legal holds", provider)
+}
+
+// CheckWriteChecksum returns an error if opts request a checksum verifying the
+// write which the storage of the named provider does not support, i.e. one
+// which is not in supported. Files written for end-to-end integrity must not
+// silently be written unverified.
+func CheckWriteChecksum(provider string, opts WriteOptions, supported ...ChecksumAlgo) error {
+	if opts.ChecksumAlgo == 0 {
+		return nil
+	}
+	for _, algo := range supported {
+		if opts.ChecksumAlgo == algo {
+			return nil
+		}
+	}
+	return errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not support verifying writes with %s checksums", provider, opts.ChecksumAlgo)
+}
+
+// WriterWithOptions returns a writer for the named file of es which writes
+// the file with opts. If es does not implement OptionsWriter, the file is
+// written with WriterWithOptionsFromWriter.
+func WriterWithOptions(
+	ctx context.Context, es ExternalStorage, basename string, opts WriteOptions,
+) (io.WriteCloser, error) {
+	if w, ok := es.(OptionsWriter); ok {
+		return w.WriterWithOptions(ctx, basename, opts)
+	}
+	return WriterWithOptionsFromWriter(ctx, es, basename, opts)
+}
+
+// WriterWithOptionsFromWriter implements OptionsWriter.WriterWithOptions for
+// storage which does not store the content type, metadata or storage class of
+// files, by ignoring them and opening a Writer. Such storage cannot lock files
+// or verify writes with checksums, so an error is returned if opts request it.
+func WriterWithOptionsFromWriter(
+	ctx context.Context, es ExternalStorage, basename string, opts WriteOptions,
+) (io.WriteCloser, error) {
+	provider := es.Conf().Provider.String()
+	if err := CheckNoFileLock(provider, opts); err != nil {
+		return nil, err
+	}
+	if err := CheckWriteChecksum(provider, opts); err != nil {
+		return nil, err
+	}
+	return es.Writer(ctx, basename)
+}
+
 // WriteFile is a helper for writing the content of a Reader to the given path
 // of an ExternalStorage.
 func WriteFile(ctx context.Context, dest ExternalStorage, basename string, src io.Reader) error {
+	return writeFile(ctx, dest, basename, src, dest.Writer)
+}
+
+// WriteFileWithOptions is like WriteFile, but the file is written with the
+// given WriteOptions.
+func WriteFileWithOptions(
+	ctx context.Context, dest ExternalStorage, basename string, src io.Reader, opts WriteOptions,
+) error {
+	return writeFile(ctx, dest, basename, src,
+		func(ctx context.Context, basename string) (io.WriteCloser, error) {
+			return WriterWithOptions(ctx, dest, basename, opts)
+		})
+}
+
+// WriteStream writes the size bytes read from r to the named file of es.
+// Unlike WriteFileIfNotExists, r need not be seekable. An error is returned if
+// r does not have exactly size bytes. Callers which do not know the size of
+// the file use Writer. If es does not implement StreamWriter, the file is
+// written with WriteStreamWithWriter.
+//
+// The storage returned by MakeExternalStorage only retries the write if r is
+// an io.Seeker, by seeking back to where the write started, since the bytes
+// read from r are not buffered beyond the parts of an upload.
+func WriteStream(
+	ctx context.Context, es ExternalStorage, basename string, r io.Reader, size int64,
+) error {
+	if w, ok := es.(StreamWriter); ok {
+		return w.WriteStream(ctx, basename, r, size)
+	}
+	return WriteStreamWithWriter(ctx, es, basename, r, size)
+}
+
+// WriteStreamWithWriter implements StreamWriter.WriteStream for storage which
+// does not need the size of a file up front, by copying r to a Writer of the
+// file. The file is not written if r does not have size bytes.
+func WriteStreamWithWriter(
+	ctx context.Context, dest ExternalStorage, basename string, r io.Reader, size int64,
+) error {
+	return WriteFile(ctx, dest, basename, NewSizeCheckingReader(r, size))
+}
+
+// NewSizeCheckingReader returns a reader of the size bytes of r, which fails
+// if r has fewer or more bytes.
+func NewSizeCheckingReader(r io.Reader, size int64) io.Reader {
+	return &sizeCheckingReader{r: r, size: size, remaining: size}
+}
+
+type sizeCheckingReader struct {
+	r               io.Reader
+	size, remaining int64
+}
+
+func (s *sizeCheckingReader) Read(p []byte) (int, error) {
+	if s.remaining == 0 {
+		// Check that r ends where it should.
+		var b [1]byte
+		n, err := io.ReadFull(s.r, b[:])
+		if n > 0 {
+			return 0, errors.Newf("stream is longer than its size of %d bytes", s.size)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+	if err == io.EOF {
+		if s.remaining > 0 {
+			return n, errors.Newf("stream ended %d bytes short of its size of %d bytes",
+				s.remaining, s.size)
+		}
+		// The next read checks that r has no more bytes.
+		err = nil
+	}
+	return n, err
+}
+
+func writeFile(
+	ctx context.Context,
+	dest ExternalStorage,
+	basename string,
+	src io.Reader,
+	openWriter func(ctx context.Context, basename string) (io.WriteCloser, error),
+) error {
 	var span *tracing.Span
 	ctx, span = tracing.ChildSpan(ctx, fmt.Sprintf("%s.WriteFile", dest.Conf().Provider.String()))
 	defer span.Finish()
@@ -391,7 +730,7 @@ func WriteFile(ctx context.Context, dest ExternalStorage, basename string, src i
 	ctx, cancel = context.WithCancel(ctx)
 	defer cancel()
 
-	w, err := dest.Writer(ctx, basename)
+	w, err := openWriter(ctx, basename)
 	if err != nil {
 		return errors.Wrap(err, "opening object for writing")
 	}
@@ -402,3 +741,1323 @@ func WriteFile(ctx context.Context, dest ExternalStorage, basename string, src i
 	}
 	return errors.Wrap(w.Close(), "closing object")
 }
+
+// DefaultListPageSize is the number of names returned by ListPage when the
+// caller does not specify a page size.
+const DefaultListPageSize = 1000
+
+// ListPage returns a page of at most maxResults of the names List returns for
+// the prefix and delimiter of es, and the token of the next page, which is
+// empty after the last page. See PageLister. If es does not implement
+// PageLister, the page is listed with ListPageFromList.
+func ListPage(
+	ctx context.Context,
+	es ExternalStorage,
+	prefix, delimiter, pageToken string,
+	maxResults int,
+) (results []string, nextPageToken string, err error) {
+	if l, ok := es.(PageLister); ok {
+		return l.ListPage(ctx, prefix, delimiter, pageToken, maxResults)
+	}
+	return ListPageFromList(ctx, es, prefix, delimiter, pageToken, maxResults)
+}
+
+// ListPageFromList implements PageLister.ListPage on top of
+// ExternalStorage.List for implementations that cannot page natively. The
+// names are returned in sorted order and the page token is the last name of
+// the previous page; the next page starts at the first name sorted after it.
+// Every page lists the whole prefix, so this is only suitable for storage
+// where listing is cheap.
+func ListPageFromList(
+	ctx context.Context,
+	es ExternalStorage,
+	prefix, delimiter, pageToken string,
+	maxResults int,
+) ([]string, string, error) {
+	if maxResults <= 0 {
+		maxResults = DefaultListPageSize
+	}
+	var names []string
+	if err := es.List(ctx, prefix, delimiter, func(name string) error {
+		if pageToken == "" || name > pageToken {
+			names = append(names, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	sort.Strings(names)
+	if len(names) <= maxResults {
+		return names, "", nil
+	}
+	names = names[:maxResults]
+	return names, names[len(names)-1], nil
+}
+
+// ListSorted returns the names List returns for the prefix and delimiter, in
+// ascending lexicographic order, e.g. for a UI paginating a listing. See
+// ListSortedWithPageSize.
+func ListSorted(ctx context.Context, es ExternalStorage, prefix, delimiter string) ([]string, error) {
+	return ListSortedWithPageSize(ctx, es, prefix, delimiter, 0 /* pageSize */)
+}
+
+// ListSortedWithPageSize is like ListSorted, but lists pageSize names at a
+// time with ListPage; the storage picks the page size if it is not positive.
+// Each page is sorted, since not all storage returns its pages in order, and
+// the sorted pages are merged, dropping the names returned by more than one
+// page, such as the prefixes grouped by the delimiter.
+//
+// All the names are held in memory until the listing completes, and a listing
+// of n names in p pages takes O(n log p) comparisons to merge, on top of the
+// p listing requests, so very large listings should rather use List, which
+// streams the names in the order of the storage.
+func ListSortedWithPageSize(
+	ctx context.Context, es ExternalStorage, prefix, delimiter string, pageSize int,
+) ([]string, error) {
+	var pages sortedListPages
+	var total int
+	for pageToken := ""; ; {
+		names, nextPageToken, err := ListPage(ctx, es, prefix, delimiter, pageToken, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			pages = append(pages, names)
+			total += len(names)
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+
+	sorted := make([]string, 0, total)
+	heap.Init(&pages)
+	for pages.Len() > 0 {
+		name := pages[0][0]
+		if len(sorted) == 0 || sorted[len(sorted)-1] != name {
+			sorted = append(sorted, name)
+		}
+		if pages[0] = pages[0][1:]; len(pages[0]) == 0 {
+			heap.Pop(&pages)
+		} else {
+			heap.Fix(&pages, 0)
+		}
+	}
+	return sorted, nil
+}
+
+// sortedListPages is a heap of sorted pages of names, ordered by their first
+// names, used to merge the pages in order.
+type sortedListPages [][]string
+
+var _ heap.Interface = (*sortedListPages)(nil)
+
+func (p sortedListPages) Len() int           { return len(p) }
+func (p sortedListPages) Less(i, j int) bool { return p[i][0] < p[j][0] }
+func (p sortedListPages) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (p *sortedListPages) Push(x any) { *p = append(*p, x.([]string)) }
+
+func (p *sortedListPages) Pop() any {
+	old := *p
+	page := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return page
+}
+
+// ListTree enumerates the tree of files and directories under prefix, which
+// is treated as a directory, down to maxDepth levels; a maxDepth of 0 lists
+// the whole tree. Directories are the common prefixes of files up to a slash,
+// as grouped by ExternalStorage.List.
+//
+// The entries are passed to fn depth-first, sorted by name within each
+// directory, with each directory passed before its contents. Directories at
+// maxDepth are passed but not descended into. Each directory is listed with a
+// separate call to List, which returns all of its pages.
+func ListTree(
+	ctx context.Context, es ExternalStorage, prefix string, maxDepth int, fn ListTreeFn,
+) error {
+	if maxDepth < 0 {
+		return errors.Newf("max depth must not be negative: %d", maxDepth)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return listTree(ctx, es, prefix, "", 1, maxDepth, fn)
+}
+
+func listTree(
+	ctx context.Context,
+	es ExternalStorage,
+	prefix, dir string,
+	depth, maxDepth int,
+	fn ListTreeFn,
+) error {
+	var names []string
+	if err := es.List(ctx, prefix+dir, "/", func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := TreeEntry{Path: dir + name, IsDir: strings.HasSuffix(name, "/"), Depth: depth}
+		if err := fn(entry); err != nil {
+			return err
+		}
+		if entry.IsDir && (maxDepth == 0 || depth < maxDepth) {
+			if err := listTree(ctx, es, prefix, entry.Path, depth+1, maxDepth, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DiffPrefixes compares the files under srcPrefix of src with those under
+// dstPrefix of dst, by their names relative to the prefixes, and returns the
+// names of the files which are only in src, which differ, and which are only
+// in dst, in sorted order. Files differ if their sizes differ, or unless they
+// have the same ETag, if the file in src was modified after the one in dst,
+// i.e. after it was last synced. ETags are not required to match, since the
+// ETags of identical files differ between providers and upload methods.
+//
+// Both prefixes are listed at the same time and their listings are merged as
+// they are streamed, which relies on the storage listing files in sorted
+// order, so that the listings are not held in memory.
+func DiffPrefixes(
+	ctx context.Context, src, dst ExternalStorage, srcPrefix, dstPrefix string,
+) (added, changed, removed []string, err error) {
+	differ := func(s, d ObjectInfo) bool {
+		if s.Size != d.Size {
+			return true
+		}
+		if s.ETag != "" && s.ETag == d.ETag {
+			return false
+		}
+		return s.ModTime.After(d.ModTime)
+	}
+
+	g := ctxgroup.WithContext(ctx)
+	list := func(es ExternalStorage, prefix string) <-chan ObjectInfo {
+		ch := make(chan ObjectInfo, 64)
+		g.GoCtx(func(ctx context.Context) error {
+			defer close(ch)
+			var prev string
+			return ListDetailed(ctx, es, prefix, "", func(info ObjectInfo) error {
+				if prev != "" && info.Name <= prev {
+					return errors.Newf("listing of %s is not sorted: %s after %s", prefix, info.Name, prev)
+				}
+				prev = info.Name
+				select {
+				case ch <- info:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		})
+		return ch
+	}
+	srcFiles, dstFiles := list(src, srcPrefix), list(dst, dstPrefix)
+	g.GoCtx(func(ctx context.Context) error {
+		s, sOK := <-srcFiles
+		d, dOK := <-dstFiles
+		for sOK || dOK {
+			switch {
+			case !dOK || (sOK && s.Name < d.Name):
+				added = append(added, s.Name)
+				s, sOK = <-srcFiles
+			case !sOK || d.Name < s.Name:
+				removed = append(removed, d.Name)
+				d, dOK = <-dstFiles
+			default:
+				if differ(s, d) {
+					changed = append(changed, s.Name)
+				}
+				s, sOK = <-srcFiles
+				d, dOK = <-dstFiles
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return nil, nil, nil, err
+	}
+	return added, changed, removed, nil
+}
+
+// ListPrefixes returns the sub-prefixes of prefix, i.e. the names of the
+// "directories" directly under prefix, which are the names the storage groups
+// up to the delimiter, in sorted order. The prefixes are returned by a single
+// listing, in which the storage groups the files of each sub-prefix, so they
+// are not enumerated; the files directly under prefix are skipped.
+func ListPrefixes(
+	ctx context.Context, es ExternalStorage, prefix, delimiter string,
+) ([]string, error) {
+	if delimiter == "" {
+		return nil, errors.New("listing prefixes requires a delimiter")
+	}
+	var prefixes []string
+	if err := es.List(ctx, prefix, delimiter, func(name string) error {
+		if strings.HasSuffix(name, delimiter) {
+			prefixes = append(prefixes, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// ListDetailed is like ExternalStorage.List, but calls fn with the ObjectInfo
+// of each file of es. See DetailedLister. If es does not implement
+// DetailedLister, the files are listed with ListDetailedWithStat.
+func ListDetailed(
+	ctx context.Context, es ExternalStorage, prefix, delimiter string, fn ListingDetailedFn,
+) error {
+	if l, ok := es.(DetailedLister); ok {
+		return l.ListDetailed(ctx, prefix, delimiter, fn)
+	}
+	return ListDetailedWithStat(ctx, es, prefix, delimiter, fn)
+}
+
+// ListDetailedWithStat implements DetailedLister.ListDetailed for
+// implementations whose listings only return names, by calling Stat on each of
+// the listed files.
+func ListDetailedWithStat(
+	ctx context.Context, es ExternalStorage, prefix, delimiter string, fn ListingDetailedFn,
+) error {
+	return es.List(ctx, prefix, delimiter, func(name string) error {
+		if delimiter != "" && strings.HasSuffix(name, delimiter) {
+			return fn(ObjectInfo{Name: name})
+		}
+		// The listed names are relative to the prefix as a string, rather than
+		// as a path.
+		info, err := Stat(ctx, es, path.Clean(prefix+name))
+		if err != nil {
+			if errors.Is(err, ErrFileDoesNotExist) {
+				// The file was deleted after it was listed.
+				return nil
+			}
+			return errors.Wrapf(err, "stat of listed file %s", name)
+		}
+		info.Name = name
+		return fn(info)
+	})
+}
+
+// Stat returns the metadata of the named file of es. If es does not implement
+// Stater, only the size of the file is returned, as by StatFromSize.
+//
+// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+func Stat(ctx context.Context, es ExternalStorage, basename string) (ObjectInfo, error) {
+	if s, ok := es.(Stater); ok {
+		return s.Stat(ctx, basename)
+	}
+	return StatFromSize(ctx, es, basename)
+}
+
+// StatFromSize implements Stater.Stat for storage which only knows the size
+// of its files, by calling ExternalStorage.Size.
+func StatFromSize(ctx context.Context, es ExternalStorage, basename string) (ObjectInfo, error) {
+	size, err := es.Size(ctx, basename)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: size}, nil
+}
+
+// Exists returns whether the named file of es exists, using a metadata
+// request rather than opening a reader of the file. A file which does not
+// exist is not an error: the error is only set if its existence could not be
+// determined, such as if the storage denied the request. If es does not
+// implement ExistenceChecker, the file is checked with ExistsWithStat.
+func Exists(ctx context.Context, es ExternalStorage, basename string) (bool, error) {
+	if c, ok := es.(ExistenceChecker); ok {
+		return c.Exists(ctx, basename)
+	}
+	return ExistsWithStat(ctx, es, basename)
+}
+
+// ExistsWithStat implements ExistenceChecker.Exists on top of Stat, which
+// only reads the metadata of the file.
+func ExistsWithStat(ctx context.Context, es ExternalStorage, basename string) (bool, error) {
+	if _, err := Stat(ctx, es, basename); err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckAccess verifies that es can be written to, read from and deleted from
+// with its credentials, such as before starting a long job writing to it, by
+// writing, reading back and deleting a small probe file under its prefix. The
+// returned error is marked with ErrAccessDenied if the storage rejected the
+// credentials or denied one of the requests, and with ErrUnreachable if the
+// storage could not be reached. If es does not implement AccessChecker, the
+// access is checked with CheckAccessWithProbe.
+func CheckAccess(ctx context.Context, es ExternalStorage) error {
+	if c, ok := es.(AccessChecker); ok {
+		return c.CheckAccess(ctx)
+	}
+	return CheckAccessWithProbe(ctx, es, nil /* isAccessDenied */)
+}
+
+// accessProbePrefix is the prefix of the name of the probe files written by
+// CheckAccessWithProbe, which is followed by a random suffix so that
+// concurrent checks of the same storage do not interfere.
+const accessProbePrefix = ".crdb-access-probe-"
+
+// accessProbeContent is the content of the probe files written by
+// CheckAccessWithProbe.
+var accessProbeContent = []byte("cockroachdb access probe")
+
+// CheckAccessWithProbe implements AccessChecker.CheckAccess by writing,
+// reading back and deleting a probe file. isAccessDenied reports whether an
+// error of the storage is an authentication or authorization failure; it may
+// be nil if errors are already marked with ErrAccessDenied.
+func CheckAccessWithProbe(
+	ctx context.Context, es ExternalStorage, isAccessDenied func(error) bool,
+) error {
+	classify := func(err error, op string) error {
+		return ClassifyAccessError(err, isAccessDenied, op)
+	}
+
+	basename := accessProbePrefix + uuid.MakeV4().String()
+	if err := WriteFile(ctx, es, basename, bytes.NewReader(accessProbeContent)); err != nil {
+		return classify(err, "write to")
+	}
+	r, _, err := es.ReadFile(ctx, basename, ReadOptions{NoFileSize: true})
+	if err != nil {
+		return errors.CombineErrors(classify(err, "read from"), es.Delete(ctx, basename))
+	}
+	content, err := ioctx.ReadAll(ctx, r)
+	err = errors.CombineErrors(err, r.Close(ctx))
+	if err != nil {
+		return errors.CombineErrors(classify(err, "read from"), es.Delete(ctx, basename))
+	}
+	if !bytes.Equal(content, accessProbeContent) {
+		return errors.CombineErrors(
+			errors.Newf("probe file %s read back with unexpected content", basename),
+			es.Delete(ctx, basename))
+	}
+	if err := es.Delete(ctx, basename); err != nil {
+		return classify(err, "delete from")
+	}
+	return nil
+}
+
+// ClassifyAccessError marks err, returned by the storage when it tried to op
+// the destination, e.g. "write to", with ErrAccessDenied if it is an
+// authentication or authorization failure, and with ErrUnreachable if the
+// storage could not be reached, and wraps it with an explanation.
+// isAccessDenied reports whether an error of the storage is an authentication
+// or authorization failure; it may be nil if errors are already marked with
+// ErrAccessDenied.
+func ClassifyAccessError(err error, isAccessDenied func(error) bool, op string) error {
+	switch {
+	case errors.Is(err, ErrAccessDenied):
+	case isAccessDenied != nil && isAccessDenied(err):
+		err = errors.Mark(err, ErrAccessDenied)
+	case isNetworkError(err):
+		err = errors.Mark(err, ErrUnreachable)
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		return errors.Wrapf(err, "access denied: cannot %s the destination; "+
+			"check its credentials and permissions", op)
+	}
+	if errors.Is(err, ErrUnreachable) {
+		return errors.Wrapf(err, "cannot reach the destination to %s it", op)
+	}
+	return errors.Wrapf(err, "cannot %s the destination", op)
+}
+
+// ValidateWritable checks that the named file can be written, e.g. before a
+// large backup is written to it, without writing the file. Unlike
+// CheckAccess, which checks the access to the storage as a
+// whole, the permissions of the file itself are checked. The errors of files
+// which cannot be written are marked with ErrAccessDenied. Storage which does
+// not implement WriteValidator is validated with ValidateWritableWithProbe.
+func ValidateWritable(ctx context.Context, es ExternalStorage, basename string) error {
+	if v, ok := es.(WriteValidator); ok {
+		return v.ValidateWritable(ctx, basename)
+	}
+	return ValidateWritableWithProbe(ctx, es, basename, nil /* isAccessDenied */)
+}
+
+// ValidateWritableWithProbe implements WriteValidator by writing and deleting
+// an empty probe file whose name is the basename followed by a random suffix,
+// so that the file itself, if it exists, is not modified, while the probe is
+// still covered by the permissions granted on the prefixes of the basename.
+// isAccessDenied is as for CheckAccessWithProbe.
+func ValidateWritableWithProbe(
+	ctx context.Context, es ExternalStorage, basename string, isAccessDenied func(error) bool,
+) error {
+	probe := basename + accessProbePrefix + uuid.MakeV4().String()
+	if err := WriteFile(ctx, es, probe, bytes.NewReader(nil)); err != nil {
+		return ClassifyAccessError(err, isAccessDenied, "write to")
+	}
+	if err := es.Delete(ctx, probe); err != nil {
+		return ClassifyAccessError(err, isAccessDenied, "delete from")
+	}
+	return nil
+}
+
+// isNetworkError returns whether err is a failure to reach a remote storage,
+// such as a failed DNS resolution, a refused connection or a timeout.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// ReadFileAtWithLength returns a Reader for exactly length bytes of the named
+// file of es starting at offset. The reader returns io.ErrUnexpectedEOF if the
+// file ends before offset+length. If es does not implement RangeReader, the
+// range is read with ReadFileAtWithLengthFromReadFile.
+//
+// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+func ReadFileAtWithLength(
+	ctx context.Context, es ExternalStorage, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	if r, ok := es.(RangeReader); ok {
+		return r.ReadFileAtWithLength(ctx, basename, offset, length)
+	}
+	return ReadFileAtWithLengthFromReadFile(ctx, es, basename, offset, length)
+}
+
+// ReadFileAtWithLengthFromReadFile implements RangeReader.ReadFileAtWithLength
+// on top of ExternalStorage.ReadFile, passing the length as the
+// ReadOptions.LengthHint so that backends which support it issue a bounded
+// range request. Like an io.SectionReader, the returned reader stops after
+// length bytes even if the backend produces more, and it returns
+// io.ErrUnexpectedEOF if the file ends before length bytes are read.
+func ReadFileAtWithLengthFromReadFile(
+	ctx context.Context, es ExternalStorage, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, errors.Newf("invalid range: offset %d, length %d", offset, length)
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	r, _, err := es.ReadFile(ctx, basename, ReadOptions{
+		Offset:     offset,
+		LengthHint: length,
+		NoFileSize: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReader{ctx: ctx, r: r, remaining: length}, nil
+}
+
+// rangeReader adapts the ioctx.ReadCloserCtx returned by ReadFile to an
+// io.ReadCloser which produces exactly remaining bytes.
+type rangeReader struct {
+	ctx       context.Context
+	r         ioctx.ReadCloserCtx
+	remaining int64
+}
+
+var _ io.ReadCloser = &rangeReader{}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(r.ctx, p)
+	r.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && r.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == nil && r.remaining == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Close() error {
+	return r.r.Close(r.ctx)
+}
+
+// CheckCopyBasenames returns an error if copying srcBasename to dstBasename
+// would copy a file onto itself.
+func CheckCopyBasenames(srcBasename, dstBasename string) error {
+	if path.Clean(srcBasename) == path.Clean(dstBasename) {
+		return errors.Newf("cannot copy %q onto itself", srcBasename)
+	}
+	return nil
+}
+
+// Rename renames oldBasename to newBasename of es, replacing newBasename if
+// it exists. Renaming a file onto itself is an error. If es does not implement
+// Renamer, the file is renamed with RenameWithCopy: readers may briefly see
+// both names, and a failure between the two steps leaves both files in place.
+//
+// ErrFileDoesNotExist is raised if `oldBasename` cannot be located in
+// storage, including if it disappears during the rename.
+func Rename(ctx context.Context, es ExternalStorage, oldBasename, newBasename string) error {
+	if r, ok := es.(Renamer); ok {
+		return r.Rename(ctx, oldBasename, newBasename)
+	}
+	return RenameWithCopy(ctx, es, oldBasename, newBasename)
+}
+
+// RenameWithCopy implements Renamer.Rename for implementations that cannot
+// rename natively, by copying oldBasename to newBasename and then deleting
+// oldBasename. The rename is not atomic.
+func RenameWithCopy(ctx context.Context, es ExternalStorage, oldBasename, newBasename string) error {
+	if err := CheckCopyBasenames(oldBasename, newBasename); err != nil {
+		return err
+	}
+	// Copy raises ErrFileDoesNotExist if the source is missing, including if
+	// it was deleted after the rename started.
+	if err := Copy(ctx, es, oldBasename, newBasename); err != nil {
+		return errors.Wrapf(err, "copying %s to %s", oldBasename, newBasename)
+	}
+	if err := es.Delete(ctx, oldBasename); err != nil {
+		return errors.Wrapf(err, "deleting %s after copying it to %s", oldBasename, newBasename)
+	}
+	return nil
+}
+
+// Copy copies the contents of srcBasename of es to dstBasename, replacing
+// dstBasename if it exists. Copying a file onto itself is an error. If es does
+// not implement Copier, the contents are streamed through this node with
+// CopyFromReadFile.
+//
+// ErrFileDoesNotExist is raised if `srcBasename` cannot be located in
+// storage.
+func Copy(ctx context.Context, es ExternalStorage, srcBasename, dstBasename string) error {
+	if c, ok := es.(Copier); ok {
+		return c.Copy(ctx, srcBasename, dstBasename)
+	}
+	return CopyFromReadFile(ctx, es, srcBasename, dstBasename)
+}
+
+// CopyFromReadFile implements Copier.Copy for implementations that
+// cannot copy natively, by reading the source and writing its contents to the
+// destination. All the bytes of the file go through this node.
+func CopyFromReadFile(
+	ctx context.Context, es ExternalStorage, srcBasename, dstBasename string,
+) error {
+	if err := CheckCopyBasenames(srcBasename, dstBasename); err != nil {
+		return err
+	}
+	r, _, err := es.ReadFile(ctx, srcBasename, ReadOptions{NoFileSize: true})
+	if err != nil {
+		return err
+	}
+	defer r.Close(ctx)
+	return WriteFile(ctx, es, dstBasename, ioctx.ReaderCtxAdapter(ctx, r))
+}
+
+// String implements fmt.Stringer.
+func (a ChecksumAlgo) String() string {
+	switch a {
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumSHA256:
+		return "sha256"
+	case ChecksumMD5:
+		return "md5"
+	default:
+		return fmt.Sprintf("ChecksumAlgo(%d)", int(a))
+	}
+}
+
+// NewHash returns a hash computing the checksum.
+func (a ChecksumAlgo) NewHash() (hash.Hash, error) {
+	switch a {
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	default:
+		return nil, errors.Newf("unsupported checksum algorithm %s", a)
+	}
+}
+
+// ReadFileWithChecksum returns a Reader for the named file of es which
+// computes the checksum of the file with algo as it is read. Close returns an
+// error wrapping ErrChecksumMismatch if the checksum differs from expected, or
+// an error if the file was not read to the end. If expected is nil, the
+// checksum stored by the provider is used. If es does not implement
+// ChecksumReader, no checksum is stored, so expected must be set.
+//
+// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+func ReadFileWithChecksum(
+	ctx context.Context, es ExternalStorage, basename string, expected []byte, algo ChecksumAlgo,
+) (io.ReadCloser, error) {
+	if r, ok := es.(ChecksumReader); ok {
+		return r.ReadFileWithChecksum(ctx, basename, expected, algo)
+	}
+	return ReadFileWithChecksumFromReadFile(ctx, es, basename, expected, algo)
+}
+
+// ReadFileWithChecksumFromReadFile implements
+// ChecksumReader.ReadFileWithChecksum on top of ExternalStorage.ReadFile for
+// implementations that do not store checksums, so expected must be set.
+// Implementations that store checksums look up the expected checksum when it
+// is nil before calling this.
+func ReadFileWithChecksumFromReadFile(
+	ctx context.Context, es ExternalStorage, basename string, expected []byte, algo ChecksumAlgo,
+) (io.ReadCloser, error) {
+	if expected == nil {
+		return nil, errors.Newf(
+			"%s storage does not store checksums, an expected %s checksum is required",
+			es.Conf().Provider, algo)
+	}
+	h, err := algo.NewHash()
+	if err != nil {
+		return nil, err
+	}
+	if len(expected) != h.Size() {
+		return nil, errors.Newf("expected %s checksum has %d bytes, not %d", algo, len(expected), h.Size())
+	}
+	r, _, err := es.ReadFile(ctx, basename, ReadOptions{NoFileSize: true})
+	if err != nil {
+		return nil, err
+	}
+	return &checksumReader{
+		ctx:      ctx,
+		r:        r,
+		basename: basename,
+		algo:     algo,
+		h:        h,
+		expected: expected,
+	}, nil
+}
+
+// checksumReader adapts the ioctx.ReadCloserCtx returned by ReadFile to an
+// io.ReadCloser which hashes the bytes as they are read, and verifies the
+// checksum on Close.
+type checksumReader struct {
+	ctx      context.Context
+	r        ioctx.ReadCloserCtx
+	basename string
+	algo     ChecksumAlgo
+	h        hash.Hash
+	expected []byte
+	eof      bool
+}
+
+var _ io.ReadCloser = &checksumReader{}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(r.ctx, p)
+	// hash.Hash.Write never returns an error.
+	_, _ = r.h.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	if err := r.r.Close(r.ctx); err != nil {
+		return err
+	}
+	if !r.eof {
+		return errors.Newf("%s closed before the %s checksum could be verified", r.basename, r.algo)
+	}
+	if actual := r.h.Sum(nil); !bytes.Equal(actual, r.expected) {
+		return errors.Wrapf(ErrChecksumMismatch, "%s checksum of %s is %x, expected %x",
+			r.algo, r.basename, actual, r.expected)
+	}
+	return nil
+}
+
+// Keys of the metadata with which WriterWithCompression and
+// WriteFileWithCompression write compressed files.
+const (
+	compressionMetadataKey      = "crdb-compression"
+	uncompressedSizeMetadataKey = "crdb-uncompressed-size"
+)
+
+// The leading bytes of the gzip and zstd formats, used by ReadFileDecompressed
+// to detect how a file is compressed.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// String implements fmt.Stringer.
+func (c CompressionCodec) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("CompressionCodec(%d)", int(c))
+	}
+}
+
+func (c CompressionCodec) contentType() string {
+	switch c {
+	case CompressionGzip:
+		return "application/gzip"
+	case CompressionZstd:
+		return "application/zstd"
+	default:
+		return ""
+	}
+}
+
+// newWriter returns a writer which compresses the bytes written to it into w.
+func (c CompressionCodec) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, errors.Newf("unsupported compression codec %s", c)
+	}
+}
+
+// WriterWithCompression returns a writer for the named file which compresses
+// the bytes written to it with codec. The file is written uncompressed if
+// codec is CompressionNone. The uncompressed size of the file is not known
+// when it is opened, so, unlike WriteFileWithCompression, it is not recorded
+// in the metadata of the file.
+func WriterWithCompression(
+	ctx context.Context, es ExternalStorage, basename string, codec CompressionCodec,
+) (io.WriteCloser, error) {
+	return writerWithCompression(ctx, es, basename, codec, -1 /* uncompressedSize */)
+}
+
+func writerWithCompression(
+	ctx context.Context,
+	es ExternalStorage,
+	basename string,
+	codec CompressionCodec,
+	uncompressedSize int64,
+) (io.WriteCloser, error) {
+	if codec == CompressionNone {
+		return es.Writer(ctx, basename)
+	}
+	opts := WriteOptions{
+		ContentType: codec.contentType(),
+		Metadata:    map[string]string{compressionMetadataKey: codec.String()},
+	}
+	if uncompressedSize >= 0 {
+		opts.Metadata[uncompressedSizeMetadataKey] = strconv.FormatInt(uncompressedSize, 10)
+	}
+	w, err := WriterWithOptions(ctx, es, basename, opts)
+	if err != nil {
+		return nil, err
+	}
+	cw, err := codec.newWriter(w)
+	if err != nil {
+		return nil, errors.CombineErrors(err, w.Close())
+	}
+	return &compressingWriter{cw: cw, w: w}, nil
+}
+
+// compressingWriter closes the compressor, which flushes the compressed bytes,
+// before closing the writer of the file.
+type compressingWriter struct {
+	cw io.WriteCloser
+	w  io.WriteCloser
+}
+
+var _ io.WriteCloser = &compressingWriter{}
+
+func (c *compressingWriter) Write(p []byte) (int, error) {
+	return c.cw.Write(p)
+}
+
+func (c *compressingWriter) Close() error {
+	if err := c.cw.Close(); err != nil {
+		return errors.CombineErrors(err, c.w.Close())
+	}
+	return c.w.Close()
+}
+
+// WriteFileWithCompression is like WriteFile, but the file is compressed with
+// codec. The uncompressed size of src is recorded in the metadata of the file,
+// where the storage keeps metadata, and is reported by Stat as the
+// UncompressedSize of the file.
+func WriteFileWithCompression(
+	ctx context.Context,
+	dest ExternalStorage,
+	basename string,
+	src io.ReadSeeker,
+	codec CompressionCodec,
+) error {
+	pos, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	return writeFile(ctx, dest, basename, src,
+		func(ctx context.Context, basename string) (io.WriteCloser, error) {
+			return writerWithCompression(ctx, dest, basename, codec, end-pos)
+		})
+}
+
+// ReadFileDecompressed reads the named file, decompressing it if it starts
+// with the header of a supported compression format, and returns the codec
+// with which it was compressed. A file which is not compressed is returned as
+// is, with CompressionNone, unless its contents happen to start with a
+// compression header.
+func ReadFileDecompressed(
+	ctx context.Context, es ExternalStorage, basename string,
+) (io.ReadCloser, CompressionCodec, error) {
+	r, _, err := es.ReadFile(ctx, basename, ReadOptions{NoFileSize: true})
+	if err != nil {
+		return nil, CompressionNone, err
+	}
+	br := bufio.NewReader(ioctx.ReaderCtxAdapter(ctx, r))
+	// Files shorter than the headers are not compressed, so io.EOF is expected.
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, CompressionNone, errors.CombineErrors(err, r.Close(ctx))
+	}
+
+	dr := &decompressingReader{ctx: ctx, r: r, dr: br}
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, CompressionNone, errors.CombineErrors(
+				errors.Wrapf(err, "reading gzip header of %s", basename), r.Close(ctx))
+		}
+		dr.dr = gr
+		return dr, CompressionGzip, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, CompressionNone, errors.CombineErrors(
+				errors.Wrapf(err, "reading zstd header of %s", basename), r.Close(ctx))
+		}
+		dr.dr = zr
+		dr.closeFn = zr.Close
+		return dr, CompressionZstd, nil
+	default:
+		return dr, CompressionNone, nil
+	}
+}
+
+// decompressingReader adapts the ioctx.ReadCloserCtx returned by ReadFile to
+// an io.ReadCloser which reads through a decompressor.
+type decompressingReader struct {
+	ctx context.Context
+	r   ioctx.ReadCloserCtx
+	dr  io.Reader
+	// closeFn, if set, releases the resources of the decompressor.
+	closeFn func()
+}
+
+var _ io.ReadCloser = &decompressingReader{}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	return r.dr.Read(p)
+}
+
+func (r *decompressingReader) Close() error {
+	if r.closeFn != nil {
+		r.closeFn()
+	}
+	return r.r.Close(r.ctx)
+}
+
+// uncompressedSize returns the uncompressed size recorded in the metadata of
+// a file by WriteFileWithCompression, or -1 if there is none.
+func uncompressedSize(info ObjectInfo) int64 {
+	s, ok := info.Extra[MetadataExtraPrefix+uncompressedSizeMetadataKey]
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// DefaultBatchDeleteConcurrency is the number of concurrent deletions issued
+// by BatchDelete on storage without a batch delete request.
+const DefaultBatchDeleteConcurrency = 16
+
+// BatchDelete removes the named files of es. It returns a DeleteResult for
+// each of the basenames, in the same order, so that the failure to delete some
+// files does not prevent the deletion of the others. Deleting a file which
+// does not exist is not an error. The returned error is only set if the batch
+// as a whole failed, in which case the results are nil. If es does not
+// implement BatchDeleter, the files are deleted one at a time.
+func BatchDelete(ctx context.Context, es ExternalStorage, basenames []string) ([]DeleteResult, error) {
+	if d, ok := es.(BatchDeleter); ok {
+		return d.BatchDelete(ctx, basenames)
+	}
+	return BatchDeleteWithDelete(ctx, basenames, 1 /* concurrency */, es.Delete)
+}
+
+// BatchDeleteWithDelete implements BatchDeleter.BatchDelete for
+// implementations without a batch delete request, by calling deleteFn for
+// each of the basenames with up to concurrency calls in flight. Errors
+// wrapping ErrFileDoesNotExist are not reported.
+func BatchDeleteWithDelete(
+	ctx context.Context,
+	basenames []string,
+	concurrency int,
+	deleteFn func(ctx context.Context, basename string) error,
+) ([]DeleteResult, error) {
+	results := make([]DeleteResult, len(basenames))
+	deleteOne := func(ctx context.Context, i int) {
+		err := deleteFn(ctx, basenames[i])
+		if errors.Is(err, ErrFileDoesNotExist) {
+			err = nil
+		}
+		results[i] = DeleteResult{Basename: basenames[i], Err: err}
+	}
+
+	if concurrency <= 1 {
+		for i := range basenames {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			deleteOne(ctx, i)
+		}
+		return results, nil
+	}
+
+	next := make(chan int)
+	g := ctxgroup.WithContext(ctx)
+	for w := 0; w < concurrency && w < len(basenames); w++ {
+		g.GoCtx(func(ctx context.Context) error {
+			for i := range next {
+				deleteOne(ctx, i)
+			}
+			return nil
+		})
+	}
+	var err error
+	for i := range basenames {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	if err = errors.CombineErrors(err, g.Wait()); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// UploadDir writes the files of the local directory tree rooted at localRoot
+// to store, each under destPrefix joined with its path relative to localRoot,
+// with up to concurrency uploads in flight. The first failed upload cancels
+// the uploads in flight and is returned.
+func UploadDir(
+	ctx context.Context, store ExternalStorage, localRoot, destPrefix string, concurrency int,
+) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	uploadOne := func(ctx context.Context, localPath string) error {
+		rel, err := filepath.Rel(localRoot, localPath)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		basename := path.Join(destPrefix, filepath.ToSlash(rel))
+		return errors.Wrapf(WriteFile(ctx, store, basename, f), "uploading %s", localPath)
+	}
+
+	next := make(chan string)
+	g := ctxgroup.WithContext(ctx)
+	for w := 0; w < concurrency; w++ {
+		g.GoCtx(func(ctx context.Context) error {
+			for localPath := range next {
+				if err := uploadOne(ctx, localPath); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	g.GoCtx(func(ctx context.Context) error {
+		defer close(next)
+		return filepath.WalkDir(localRoot, func(localPath string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			select {
+			case next <- localPath:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	})
+	return g.Wait()
+}
+
+// PresignedReadURL returns a URL which can be used to read the named file of
+// es until ttl elapses. If es does not implement PresignedURLer, an error for
+// which errors.IsUnimplementedError is true is returned.
+func PresignedReadURL(
+	ctx context.Context, es ExternalStorage, basename string, ttl time.Duration,
+) (string, error) {
+	p, err := presignedURLer(es, ttl)
+	if err != nil {
+		return "", err
+	}
+	return p.PresignedReadURL(ctx, basename, ttl)
+}
+
+// PresignedWriteURL returns a URL which can be used to write the named file
+// of es until ttl elapses. If es does not implement PresignedURLer, an error
+// for which errors.IsUnimplementedError is true is returned.
+func PresignedWriteURL(
+	ctx context.Context, es ExternalStorage, basename string, ttl time.Duration,
+) (string, error) {
+	p, err := presignedURLer(es, ttl)
+	if err != nil {
+		return "", err
+	}
+	return p.PresignedWriteURL(ctx, basename, ttl)
+}
+
+func presignedURLer(es ExternalStorage, ttl time.Duration) (PresignedURLer, error) {
+	if ttl <= 0 {
+		return nil, errors.Newf("presigned URL ttl must be positive, got %s", ttl)
+	}
+	p, ok := es.(PresignedURLer)
+	if !ok {
+		return nil, errors.UnimplementedErrorf(errors.IssueLink{},
+			"%s storage does not support presigned URLs", es.Conf().Provider)
+	}
+	return p, nil
+}
+
+// RawClientOf returns the client of the provider's SDK of es. If es does not
+// implement RawClient, or can't make its client, an error for which
+// errors.IsUnimplementedError is true is returned.
+func RawClientOf(es ExternalStorage) (any, error) {
+	if r, ok := es.(RawClient); ok {
+		if client := r.Unwrap(); client != nil {
+			return client, nil
+		}
+	}
+	return nil, errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not expose its client", es.Conf().Provider)
+}
+
+// OpenResumableWriter returns the writer of a multipart upload of the named
+// file of es which can be resumed after it was interrupted. See
+// ResumableUploader. If es does not implement ResumableUploader, an error for
+// which errors.IsUnimplementedError is true is returned.
+func OpenResumableWriter(
+	ctx context.Context, es ExternalStorage, basename string, token []byte,
+) (ResumableWriter, error) {
+	if u, ok := es.(ResumableUploader); ok {
+		return u.ResumableWriter(ctx, basename, token)
+	}
+	return nil, errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not support resumable uploads", es.Conf().Provider)
+}
+
+// WriteFileIfNotExists atomically writes content to the named file of es if
+// no file with that name exists, and returns created=false, and no error, if
+// it already exists. See ConditionalWriter. If es does not implement
+// ConditionalWriter, an error for which errors.IsUnimplementedError is true is
+// returned.
+func WriteFileIfNotExists(
+	ctx context.Context, es ExternalStorage, basename string, content io.ReadSeeker,
+) (created bool, err error) {
+	if w, ok := es.(ConditionalWriter); ok {
+		return w.WriteFileIfNotExists(ctx, basename, content)
+	}
+	return false, errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not support conditional writes", es.Conf().Provider)
+}
+
+// WriteFileIfMatch atomically replaces the content of the named file of es if
+// its current ETag is expectedETag, and otherwise returns an error marked with
+// ErrPreconditionFailed. See ConditionalWriter. If es does not implement
+// ConditionalWriter, an error for which errors.IsUnimplementedError is true is
+// returned.
+func WriteFileIfMatch(
+	ctx context.Context, es ExternalStorage, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	if w, ok := es.(ConditionalWriter); ok {
+		return w.WriteFileIfMatch(ctx, basename, expectedETag, content)
+	}
+	return errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not support conditional writes", es.Conf().Provider)
+}
+
+// AppendFile appends content to the named file of es, creating it if it does
+// not exist. If es does not implement Appender, an error for which
+// errors.IsUnimplementedError is true is returned.
+func AppendFile(ctx context.Context, es ExternalStorage, basename string, content io.Reader) error {
+	if a, ok := es.(Appender); ok {
+		return a.AppendFile(ctx, basename, content)
+	}
+	return errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not support appending to files", es.Conf().Provider)
+}
+
+// ReadFileAtVersion returns a reader of the given version of the named file of
+// es, starting at offset, and the size of the version. If es does not
+// implement Versioner, an error for which errors.IsUnimplementedError is true
+// is returned.
+func ReadFileAtVersion(
+	ctx context.Context, es ExternalStorage, basename, versionID string, offset int64,
+) (ioctx.ReadCloserCtx, int64, error) {
+	v, err := versioner(es, versionID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v.ReadFileAtVersion(ctx, basename, versionID, offset)
+}
+
+// DeleteVersion deletes the given version of the named file of es. If es does
+// not implement Versioner, an error for which errors.IsUnimplementedError is
+// true is returned.
+func DeleteVersion(ctx context.Context, es ExternalStorage, basename, versionID string) error {
+	v, err := versioner(es, versionID)
+	if err != nil {
+		return err
+	}
+	return v.DeleteVersion(ctx, basename, versionID)
+}
+
+// versioner returns es as a Versioner. The version ID is required, since
+// the providers apply the requests without one to the current version.
+func versioner(es ExternalStorage, versionID string) (Versioner, error) {
+	v, ok := es.(Versioner)
+	if !ok {
+		return nil, errors.UnimplementedErrorf(errors.IssueLink{},
+			"%s storage does not support object versions", es.Conf().Provider)
+	}
+	if versionID == "" {
+		return nil, errors.New("version ID is required")
+	}
+	return v, nil
+}
+
+// Add returns the sum of the costs.
+func (c Cost) Add(other Cost) Cost {
+	return Cost{
+		WriteRequests: c.WriteRequests + other.WriteRequests,
+		ReadRequests:  c.ReadRequests + other.ReadRequests,
+		TransferBytes: c.TransferBytes + other.TransferBytes,
+	}
+}
+
+// costEstimator returns es as a CostEstimator, or an error for which
+// errors.IsUnimplementedError is true if it is not one.
+func costEstimator(es ExternalStorage) (CostEstimator, error) {
+	if c, ok := es.(CostEstimator); ok {
+		return c, nil
+	}
+	return nil, errors.UnimplementedErrorf(errors.IssueLink{},
+		"%s storage does not estimate the cost of its operations", es.Conf().Provider)
+}
+
+// EstimateListCost estimates the cost of listing the given number of files of
+// es. If es does not implement CostEstimator, an error for which
+// errors.IsUnimplementedError is true is returned.
+func EstimateListCost(es ExternalStorage, files int64) (Cost, error) {
+	c, err := costEstimator(es)
+	if err != nil {
+		return Cost{}, err
+	}
+	return c.EstimateListCost(files)
+}
+
+// EstimateReadCost is like EstimateListCost, for reading a file of the given
+// size.
+func EstimateReadCost(es ExternalStorage, bytes int64) (Cost, error) {
+	c, err := costEstimator(es)
+	if err != nil {
+		return Cost{}, err
+	}
+	return c.EstimateReadCost(bytes)
+}
+
+// EstimateWriteCost is like EstimateListCost, for writing a file of the given
+// size.
+func EstimateWriteCost(es ExternalStorage, bytes int64) (Cost, error) {
+	c, err := costEstimator(es)
+	if err != nil {
+		return Cost{}, err
+	}
+	return c.EstimateWriteCost(bytes)
+}
+
+// Batches returns the number of batches of up to batchSize items n items are
+// processed in, such as the pages of a listing or the parts of an upload,
+// which is at least one since even an empty listing takes a request.
+func Batches(n, batchSize int64) int64 {
+	if n <= 0 || batchSize <= 0 {
+		return 1
+	}
+	return (n + batchSize - 1) / batchSize
+}
+
+// ReadFileSuffix returns a reader of the last n bytes of the named file of es,
+// or of the whole file if it is shorter, and the size of the file, e.g. to
+// read the footer of a file. If es implements SuffixReader the suffix is read
+// with a single request, otherwise with ReadFileSuffixFromSize.
+func ReadFileSuffix(
+	ctx context.Context, es ExternalStorage, basename string, n int64,
+) (io.ReadCloser, int64, error) {
+	if n < 0 {
+		return nil, 0, errors.Newf("invalid suffix length %d", n)
+	}
+	if s, ok := es.(SuffixReader); ok {
+		return s.ReadFileSuffix(ctx, basename, n)
+	}
+	return ReadFileSuffixFromSize(ctx, es, basename, n)
+}
+
+// ReadFileSuffixFromSize implements SuffixReader.ReadFileSuffix for backends
+// which can't request a suffix: the size of the file is looked up with
+// ExternalStorage.Size and the suffix is read with ReadFileAtWithLength.
+func ReadFileSuffixFromSize(
+	ctx context.Context, es ExternalStorage, basename string, n int64,
+) (io.ReadCloser, int64, error) {
+	size, err := es.Size(ctx, basename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n > size {
+		n = size
+	}
+	r, err := ReadFileAtWithLength(ctx, es, basename, size-n, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, size, nil
+}
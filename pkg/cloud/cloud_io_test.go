@@ -11,13 +11,17 @@
 package cloud
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"strings"
 	"syscall"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
@@ -187,6 +191,53 @@ func TestResumingReaderErrorOnLastRead(t *testing.T) {
 	require.Equal(t, 1, ep.attempts)
 }
 
+// TestResumingReaderMaxAttempts tests that MaxAttempts bounds the number of
+// times a Read failing with a resumable error reopens the file.
+func TestResumingReaderMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+
+	const data = "hello world"
+	for _, tc := range []struct {
+		maxAttempts int
+		// attempts is the number of attempts allowed by maxAttempts.
+		attempts int
+	}{
+		{maxAttempts: 0, attempts: maxNoProgressReads + 1},
+		{maxAttempts: 1, attempts: 1},
+		{maxAttempts: 2, attempts: 2},
+		{maxAttempts: 6, attempts: 6},
+	} {
+		for _, failures := range []int{tc.attempts - 1, tc.attempts} {
+			t.Run(fmt.Sprintf("max=%d/failures=%d", tc.maxAttempts, failures), func(t *testing.T) {
+				var opens int
+				opener := func(ctx context.Context, pos int64) (io.ReadCloser, int64, error) {
+					opens++
+					if opens <= failures {
+						return &fakeReaderWithKnobs{
+							reader: strings.NewReader(""),
+							afterReadKnob: func(int, error) error {
+								return syscall.ECONNRESET
+							},
+						}, int64(len(data)), nil
+					}
+					return io.NopCloser(strings.NewReader(data[pos:])), int64(len(data)), nil
+				}
+				reader := NewResumingReader(ctx, opener, nil, 0, 0, "", nil, nil)
+				reader.MaxAttempts = tc.maxAttempts
+				actual, err := ioctx.ReadAll(ctx, reader)
+				if failures < tc.attempts {
+					require.NoError(t, err)
+					require.Equal(t, data, string(actual))
+					require.Equal(t, failures+1, opens)
+				} else {
+					require.ErrorIs(t, err, syscall.ECONNRESET)
+					require.Equal(t, tc.attempts, opens)
+				}
+			})
+		}
+	}
+}
+
 // fakeReaderWithKnobs is a wrapper around an io.Reader that allows for
 // additional knobs to be injected into Read calls.
 type fakeReaderWithKnobs struct {
@@ -258,3 +309,330 @@ func (p *nErrorsProducer) maybeProduceErr() error {
 	}
 	return nil
 }
+
+// fakeMultipartStore records the writes of a ThresholdWriter, keeping the
+// parts of a multipart upload until it completes or is aborted.
+type fakeMultipartStore struct {
+	partSize int
+	object   []byte
+	parts    [][]byte
+	puts     int
+	uploads  int
+}
+
+func (f *fakeMultipartStore) put(_ context.Context, data []byte) error {
+	f.puts++
+	f.object = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *fakeMultipartStore) upload(_ context.Context, r io.Reader) error {
+	f.uploads++
+	for {
+		part := make([]byte, f.partSize)
+		n, err := io.ReadFull(r, part)
+		if n > 0 {
+			f.parts = append(f.parts, part[:n])
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			// Abort the upload.
+			f.parts = nil
+			return err
+		}
+	}
+	f.object = nil
+	for _, part := range f.parts {
+		f.object = append(f.object, part...)
+	}
+	f.parts = nil
+	return nil
+}
+
+func TestThresholdWriter(t *testing.T) {
+	const threshold = 10
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	write := func(t *testing.T, ctx context.Context, f *fakeMultipartStore, n int) io.WriteCloser {
+		w := ThresholdWriter(ctx, threshold, f.put, f.upload)
+		for i := 0; i < n; i += 4 {
+			end := i + 4
+			if end > n {
+				end = n
+			}
+			_, err := w.Write(payload[i:end])
+			require.NoError(t, err)
+		}
+		return w
+	}
+
+	t.Run("below-threshold", func(t *testing.T) {
+		f := &fakeMultipartStore{partSize: 4}
+		require.NoError(t, write(t, context.Background(), f, threshold).Close())
+		require.Equal(t, 1, f.puts)
+		require.Equal(t, 0, f.uploads)
+		require.Equal(t, payload[:threshold], f.object)
+	})
+
+	t.Run("above-threshold", func(t *testing.T) {
+		f := &fakeMultipartStore{partSize: 4}
+		require.NoError(t, write(t, context.Background(), f, len(payload)).Close())
+		require.Equal(t, 0, f.puts)
+		require.Equal(t, 1, f.uploads)
+		require.Equal(t, payload, f.object)
+		require.Empty(t, f.parts)
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		for _, n := range []int{threshold, len(payload)} {
+			f := &fakeMultipartStore{partSize: 4}
+			ctx, cancel := context.WithCancel(context.Background())
+			w := write(t, ctx, f, n)
+			cancel()
+			require.ErrorIs(t, w.Close(), context.Canceled)
+			require.Equal(t, 0, f.puts)
+			require.Nil(t, f.object)
+			require.Empty(t, f.parts, "aborted upload left parts behind")
+		}
+	})
+}
+
+// statStorage is an ExternalStorage whose Stat returns err for every file but
+// exists.
+type statStorage struct {
+	ExternalStorage
+	exists string
+	err    error
+}
+
+func (s *statStorage) Stat(_ context.Context, basename string) (ObjectInfo, error) {
+	if basename == s.exists {
+		return ObjectInfo{Size: 1}, nil
+	}
+	return ObjectInfo{}, s.err
+}
+
+func TestExistsWithStat(t *testing.T) {
+	ctx := context.Background()
+
+	s := &statStorage{exists: "present", err: errors.Wrap(ErrFileDoesNotExist, "missing")}
+	exists, err := ExistsWithStat(ctx, s, "present")
+	require.NoError(t, err)
+	require.True(t, exists)
+	exists, err = ExistsWithStat(ctx, s, "absent")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// A failure to read the metadata of the file does not say it is absent.
+	s.err = errors.Wrap(os.ErrPermission, "AccessDenied")
+	exists, err = ExistsWithStat(ctx, s, "denied")
+	require.ErrorIs(t, err, os.ErrPermission)
+	require.False(t, exists)
+}
+
+// probeStorage is an ExternalStorage whose writes fail with writeErr, which
+// records the files it writes and deletes.
+type probeStorage struct {
+	ExternalStorage
+	writeErr         error
+	written, deleted []string
+}
+
+func (s *probeStorage) Conf() cloudpb.ExternalStorage { return cloudpb.ExternalStorage{} }
+
+func (s *probeStorage) Writer(_ context.Context, basename string) (io.WriteCloser, error) {
+	if s.writeErr != nil {
+		return nil, s.writeErr
+	}
+	s.written = append(s.written, basename)
+	return nopWriteCloser{io.Discard}, nil
+}
+
+func (s *probeStorage) Delete(_ context.Context, basename string) error {
+	s.deleted = append(s.deleted, basename)
+	return nil
+}
+
+func TestValidateWritableWithProbe(t *testing.T) {
+	ctx := context.Background()
+
+	// The probe is written next to the file, and deleted.
+	s := &probeStorage{}
+	require.NoError(t, ValidateWritable(ctx, s, "dir/backup"))
+	require.Len(t, s.written, 1)
+	require.True(t, strings.HasPrefix(s.written[0], "dir/backup"+accessProbePrefix), s.written[0])
+	require.Equal(t, s.written, s.deleted)
+
+	// The errors of the writes are classified.
+	denied := errors.New("403 Forbidden")
+	s = &probeStorage{writeErr: denied}
+	err := ValidateWritableWithProbe(ctx, s, "backup", func(err error) bool { return errors.Is(err, denied) })
+	require.ErrorIs(t, err, ErrAccessDenied)
+	require.Empty(t, s.deleted)
+
+	s = &probeStorage{writeErr: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	err = ValidateWritable(ctx, s, "backup")
+	require.ErrorIs(t, err, ErrUnreachable)
+	require.False(t, errors.Is(err, ErrAccessDenied))
+
+	s = &probeStorage{writeErr: errors.New("boom")}
+	err = ValidateWritable(ctx, s, "backup")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrAccessDenied))
+	require.False(t, errors.Is(err, ErrUnreachable))
+}
+
+// writerToFile is a file whose reader implements io.WriterTo, and counts the
+// calls to Read and WriteTo to tell which path a copy took. Its WriteTo
+// returns err once it wrote all of its content.
+type writerToFile struct {
+	r        io.Reader
+	err      error
+	reads    *int
+	writeTos *int
+}
+
+func (f *writerToFile) Read(p []byte) (int, error) {
+	*f.reads++
+	return f.r.Read(p)
+}
+
+func (f *writerToFile) WriteTo(w io.Writer) (int64, error) {
+	*f.writeTos++
+	n, err := io.Copy(w, f.r)
+	if err == nil {
+		err = f.err
+	}
+	return n, err
+}
+
+func (f *writerToFile) Close() error { return nil }
+
+// TestReaderWriteTo verifies that io.Copy from the readers returned by ReadFile
+// uses the WriteTo method of the reader of the file, rather than copying
+// through a buffer, and that the copy is resumed after a resumable error.
+func TestReaderWriteTo(t *testing.T) {
+	ctx := context.Background()
+
+	data := strings.Repeat("0123456789", 1000)
+	for _, tc := range []struct {
+		name string
+		// failAt, if positive, is the position at which the first open of the
+		// file fails with a resumable error.
+		failAt int
+		// readFirst is the number of bytes read with Read before the copy.
+		readFirst int
+	}{
+		{name: "copy"},
+		{name: "resumed", failAt: len(data) / 2},
+		{name: "buffered", readFirst: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opens, reads, writeTos int
+			opener := func(ctx context.Context, pos int64) (io.ReadCloser, int64, error) {
+				opens++
+				f := &writerToFile{r: strings.NewReader(data[pos:]), reads: &reads, writeTos: &writeTos}
+				if opens == 1 && tc.failAt > 0 {
+					f.r = strings.NewReader(data[pos:tc.failAt])
+					f.err = syscall.ECONNRESET
+				}
+				return f, int64(len(data)), nil
+			}
+			// The file is read through the readers ReadFile wraps it in.
+			var r ioctx.ReadCloserCtx = NewResumingReader(ctx, opener, nil, 0, 0, "", nil, nil)
+			r = newBufferedReader(r, 16)
+			r = &timeoutReader{r: r, ctx: ctx, cancel: func() {}}
+			r = newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown).Reader(ctx, nil, r)
+			r = &releasingReader{r: r}
+
+			first := make([]byte, tc.readFirst)
+			_, err := io.ReadFull(ioctx.ReaderCtxAdapter(ctx, r), first)
+			require.NoError(t, err)
+			readsBeforeCopy := reads
+
+			var buf strings.Builder
+			n, err := io.Copy(&buf, ioctx.ReaderCtxAdapter(ctx, r))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)-tc.readFirst), n)
+			require.Equal(t, data, string(first)+buf.String())
+			require.Equal(t, readsBeforeCopy, reads)
+			if tc.failAt > 0 {
+				require.Equal(t, 2, opens)
+				require.Equal(t, 2, writeTos)
+			} else {
+				require.Equal(t, 1, opens)
+				require.Equal(t, 1, writeTos)
+			}
+		})
+	}
+}
+
+// readerFromWriter is a writer which implements io.ReaderFrom, and counts the
+// calls to Write and ReadFrom to tell which path a copy took.
+type readerFromWriter struct {
+	buf       strings.Builder
+	writes    int
+	readFroms int
+}
+
+func (w *readerFromWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *readerFromWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.readFroms++
+	return io.Copy(&w.buf, src)
+}
+
+func (w *readerFromWriter) Close() error { return nil }
+
+// TestWriterReadFrom verifies that io.Copy to the writers returned by Writer
+// uses the ReadFrom method of the writer of the file.
+func TestWriterReadFrom(t *testing.T) {
+	ctx := context.Background()
+
+	data := strings.Repeat("0123456789", 1000)
+	sentinel := &readerFromWriter{}
+	// The file is written through the writers Writer wraps it in.
+	var w io.WriteCloser = &timeoutWriter{w: sentinel, ctx: ctx, cancel: func() {}}
+	w = newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown).Writer(ctx, nil, w)
+	w = &spanWriter{WriteCloser: w}
+	w = &releasingWriter{WriteCloser: w}
+
+	// Hide the WriteTo method of the strings.Reader, which io.Copy prefers.
+	n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader(data)})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, sentinel.buf.String())
+	require.Equal(t, 1, sentinel.readFroms)
+	require.Zero(t, sentinel.writes)
+}
+
+// BenchmarkReaderCopy compares copying a file from a reader returned by
+// ReadFile through its WriteTo method and through a buffer.
+func BenchmarkReaderCopy(b *testing.B) {
+	ctx := context.Background()
+
+	data := []byte(strings.Repeat("0123456789", 1<<20))
+	for _, writeTo := range []bool{false, true} {
+		b.Run(fmt.Sprintf("writeTo=%t", writeTo), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				opener := func(ctx context.Context, pos int64) (io.ReadCloser, int64, error) {
+					return io.NopCloser(bytes.NewReader(data[pos:])), int64(len(data)), nil
+				}
+				r := NewResumingReader(ctx, opener, nil, 0, 0, "", nil, nil)
+				src := ioctx.ReaderCtxAdapter(ctx, r)
+				if !writeTo {
+					src = struct{ io.Reader }{src}
+				}
+				if _, err := io.Copy(io.Discard, src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
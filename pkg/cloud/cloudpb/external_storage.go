@@ -55,6 +55,13 @@ func (m *ExternalStorage) AccessIsWithExplicitAuth() bool {
 	case ExternalStorageProvider_nodelocal:
 		// The node's local filesystem is obviously accessed implicitly as the node.
 		return false
+	case ExternalStorageProvider_mem:
+		// Files in memory are shared by every user of the node's process.
+		return false
+	case ExternalStorageProvider_custom:
+		// Storage registered outside this package may use the node's implicit
+		// access.
+		return false
 	case ExternalStorageProvider_external:
 		// External Connections have a `USAGE` privilege that determines if a user
 		// has the appropriate privileges to use the underlying resource.
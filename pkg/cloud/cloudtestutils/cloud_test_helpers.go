@@ -20,10 +20,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/blobs"
@@ -33,6 +35,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/sysutil"
@@ -244,11 +247,332 @@ func CheckExportStore(
 			}
 		})
 
+		t.Run("read-at-with-length", func(t *testing.T) {
+			for _, tc := range []struct {
+				offset, length int64
+			}{
+				{0, 0},
+				{0, 1},
+				{0, size},
+				{1, 1024},
+				{size - 1, 1},
+				{size / 2, size / 2},
+				{rng.Int63n(size / 2), 1 + rng.Int63n(size/2)},
+			} {
+				t.Logf("read %d of file at %d", tc.length, tc.offset)
+				reader, err := cloud.ReadFileAtWithLength(ctx, s, testingFilename, tc.offset, tc.length)
+				require.NoError(t, err)
+				got, err := io.ReadAll(reader)
+				require.NoError(t, err)
+				require.NoError(t, reader.Close())
+				require.Equal(t, testingContent[tc.offset:tc.offset+tc.length], got)
+			}
+
+			// Reading past the end of the file returns the available bytes and an
+			// error.
+			reader, err := cloud.ReadFileAtWithLength(ctx, s, testingFilename, size-10, 20)
+			require.NoError(t, err)
+			got, err := io.ReadAll(reader)
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			require.NoError(t, reader.Close())
+			require.Equal(t, testingContent[size-10:], got)
+		})
+
+		require.NoError(t, s.Delete(ctx, testingFilename))
+	})
+	// Backends with a server-side copy exercise it here, the others exercise
+	// the stream-through copy.
+	t.Run("copy", func(t *testing.T) {
+		const srcFilename, dstFilename = "copy-src", "copy-dst"
+		testingContent := randutil.RandBytes(rng, 1024*1024)
+		require.NoError(t, cloud.WriteFile(ctx, s, srcFilename, bytes.NewReader(testingContent)))
+		require.NoError(t, cloud.WriteFile(ctx, s, dstFilename, bytes.NewReader([]byte("overwritten"))))
+
+		require.NoError(t, cloud.Copy(ctx, s, srcFilename, dstFilename))
+		for _, name := range []string{srcFilename, dstFilename} {
+			res, _, err := s.ReadFile(ctx, name, cloud.ReadOptions{NoFileSize: true})
+			require.NoError(t, err)
+			content, err := ioctx.ReadAll(ctx, res)
+			require.NoError(t, err)
+			require.NoError(t, res.Close(ctx))
+			require.Equal(t, testingContent, content, "wrong content in %s", name)
+		}
+
+		// Copying a file onto itself is rejected and leaves the file unchanged.
+		require.Error(t, cloud.Copy(ctx, s, srcFilename, srcFilename))
+		res, _, err := s.ReadFile(ctx, srcFilename, cloud.ReadOptions{NoFileSize: true})
+		require.NoError(t, err)
+		content, err := ioctx.ReadAll(ctx, res)
+		require.NoError(t, err)
+		require.NoError(t, res.Close(ctx))
+		require.Equal(t, testingContent, content)
+
+		err = cloud.Copy(ctx, s, "file does not exist", dstFilename)
+		require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "Expected a file does not exist error but returned %s", err)
+
+		require.NoError(t, s.Delete(ctx, srcFilename))
+		require.NoError(t, s.Delete(ctx, dstFilename))
+	})
+	t.Run("rename", func(t *testing.T) {
+		const oldFilename, newFilename = "rename-old", "rename-new"
+		testingContent := randutil.RandBytes(rng, 1024*1024)
+		require.NoError(t, cloud.WriteFile(ctx, s, oldFilename, bytes.NewReader(testingContent)))
+		require.NoError(t, cloud.WriteFile(ctx, s, newFilename, bytes.NewReader([]byte("overwritten"))))
+
+		require.NoError(t, cloud.Rename(ctx, s, oldFilename, newFilename))
+		_, _, err := s.ReadFile(ctx, oldFilename, cloud.ReadOptions{NoFileSize: true})
+		require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "Expected a file does not exist error but returned %s", err)
+		res, _, err := s.ReadFile(ctx, newFilename, cloud.ReadOptions{NoFileSize: true})
+		require.NoError(t, err)
+		content, err := ioctx.ReadAll(ctx, res)
+		require.NoError(t, err)
+		require.NoError(t, res.Close(ctx))
+		require.Equal(t, testingContent, content)
+
+		err = cloud.Rename(ctx, s, "file does not exist", oldFilename)
+		require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "Expected a file does not exist error but returned %s", err)
+
+		require.NoError(t, s.Delete(ctx, newFilename))
+	})
+	t.Run("batch-delete", func(t *testing.T) {
+		var existing []string
+		for i := 0; i < 5; i++ {
+			name := fmt.Sprintf("batch-delete-%d", i)
+			require.NoError(t, cloud.WriteFile(ctx, s, name, bytes.NewReader([]byte(name))))
+			existing = append(existing, name)
+		}
+		basenames := []string{
+			existing[0], "batch-delete-missing-0", existing[1], existing[2],
+			"batch-delete-missing-1", existing[3], existing[4],
+		}
+
+		results, err := cloud.BatchDelete(ctx, s, basenames)
+		require.NoError(t, err)
+		require.Len(t, results, len(basenames))
+		for i, res := range results {
+			require.Equal(t, basenames[i], res.Basename)
+			require.NoError(t, res.Err, "deleting %s", res.Basename)
+		}
+		for _, name := range existing {
+			_, _, err := s.ReadFile(ctx, name, cloud.ReadOptions{NoFileSize: true})
+			require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "expected %s to be deleted, got %v", name, err)
+		}
+
+		results, err = cloud.BatchDelete(ctx, s, nil)
+		require.NoError(t, err)
+		require.Empty(t, results)
+	})
+	t.Run("write-if-not-exists", func(t *testing.T) {
+		const testingFilename = "if-not-exists"
+		created, err := cloud.WriteFileIfNotExists(ctx, s, testingFilename, bytes.NewReader([]byte("first")))
+		if errors.IsUnimplementedError(err) {
+			skip.IgnoreLintf(t, "conditional writes are not supported: %v", err)
+		}
+		require.NoError(t, err)
+		require.True(t, created)
+
+		// The second write conflicts with the existing file and leaves it
+		// unchanged.
+		created, err = cloud.WriteFileIfNotExists(ctx, s, testingFilename, bytes.NewReader([]byte("second")))
+		require.NoError(t, err)
+		require.False(t, created)
+
+		res, _, err := s.ReadFile(ctx, testingFilename, cloud.ReadOptions{NoFileSize: true})
+		require.NoError(t, err)
+		content, err := ioctx.ReadAll(ctx, res)
+		require.NoError(t, err)
+		require.NoError(t, res.Close(ctx))
+		require.Equal(t, []byte("first"), content)
+
+		// The file can be created again once it is deleted.
+		require.NoError(t, s.Delete(ctx, testingFilename))
+		created, err = cloud.WriteFileIfNotExists(ctx, s, testingFilename, bytes.NewReader([]byte("third")))
+		require.NoError(t, err)
+		require.True(t, created)
 		require.NoError(t, s.Delete(ctx, testingFilename))
 	})
 	if skipSingleFile {
 		return
 	}
+	t.Run("check-access", func(t *testing.T) {
+		require.NoError(t, cloud.CheckAccess(ctx, s))
+
+		// The probe file is deleted once the access is checked.
+		err := s.List(ctx, "", "", func(name string) error {
+			if strings.Contains(name, "access-probe") {
+				return errors.Newf("probe file %s was left behind", name)
+			}
+			return nil
+		})
+		if !errors.Is(err, cloud.ErrListingUnsupported) {
+			require.NoError(t, err)
+		}
+	})
+	t.Run("write-if-match", func(t *testing.T) {
+		const testingFilename = "if-match"
+		require.NoError(t, cloud.WriteFile(ctx, s, testingFilename, bytes.NewReader([]byte("first"))))
+		defer func() { require.NoError(t, s.Delete(ctx, testingFilename)) }()
+		readContent := func() []byte {
+			res, _, err := s.ReadFile(ctx, testingFilename, cloud.ReadOptions{NoFileSize: true})
+			require.NoError(t, err)
+			content, err := ioctx.ReadAll(ctx, res)
+			require.NoError(t, err)
+			require.NoError(t, res.Close(ctx))
+			return content
+		}
+
+		info, err := cloud.Stat(ctx, s, testingFilename)
+		if errors.IsUnimplementedError(err) {
+			skip.IgnoreLintf(t, "stat is not supported: %v", err)
+		}
+		require.NoError(t, err)
+		staleETag := info.ETag
+
+		// A write with the current ETag replaces the file.
+		err = cloud.WriteFileIfMatch(ctx, s, testingFilename, staleETag, bytes.NewReader([]byte("second")))
+		if errors.IsUnimplementedError(err) {
+			skip.IgnoreLintf(t, "conditional writes are not supported: %v", err)
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte("second"), readContent())
+
+		// The ETag changed with the write, so a write with the previous ETag is
+		// rejected and leaves the file unchanged.
+		err = cloud.WriteFileIfMatch(ctx, s, testingFilename, staleETag, bytes.NewReader([]byte("third")))
+		require.True(t, errors.Is(err, cloud.ErrPreconditionFailed), "expected precondition failure, got %v", err)
+		require.Equal(t, []byte("second"), readContent())
+	})
+	t.Run("stat", func(t *testing.T) {
+		const testingFilename = "stat-file"
+		testingContent := randutil.RandBytes(rng, 1024)
+		require.NoError(t, cloud.WriteFile(ctx, s, testingFilename, bytes.NewReader(testingContent)))
+
+		info, err := cloud.Stat(ctx, s, testingFilename)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(testingContent)), info.Size)
+		require.False(t, info.ModTime.IsZero(), "expected a modification time")
+
+		_, err = cloud.Stat(ctx, s, "file does not exist")
+		require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "Expected a file does not exist error but returned %s", err)
+
+		require.NoError(t, s.Delete(ctx, testingFilename))
+	})
+	t.Run("write-stream", func(t *testing.T) {
+		const filename = "write-stream"
+		content := randutil.RandBytes(rng, 1024*1024)
+		// The stream is not seekable, like the output of a generator.
+		stream := func(b []byte) io.Reader { return struct{ io.Reader }{bytes.NewReader(b)} }
+		require.NoError(t, cloud.WriteStream(ctx, s, filename, stream(content), int64(len(content))))
+		res, _, err := s.ReadFile(ctx, filename, cloud.ReadOptions{NoFileSize: true})
+		require.NoError(t, err)
+		got, err := ioctx.ReadAll(ctx, res)
+		require.NoError(t, err)
+		require.NoError(t, res.Close(ctx))
+		require.Equal(t, content, got)
+
+		// Streams which do not have the given size fail.
+		require.Error(t, cloud.WriteStream(ctx, s, "write-stream-short", stream(content[:100]), 101))
+		require.Error(t, cloud.WriteStream(ctx, s, "write-stream-long", stream(content[:100]), 99))
+		require.NoError(t, s.Delete(ctx, filename))
+	})
+	t.Run("exists", func(t *testing.T) {
+		const filename = "exists-file"
+		require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader([]byte("exists"))))
+		exists, err := cloud.Exists(ctx, s, filename)
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		for _, name := range []string{"exists-missing", "exists-missing/nested"} {
+			exists, err = cloud.Exists(ctx, s, name)
+			require.NoError(t, err)
+			require.False(t, exists, name)
+		}
+
+		require.NoError(t, s.Delete(ctx, filename))
+		exists, err = cloud.Exists(ctx, s, filename)
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+	t.Run("write-with-options", func(t *testing.T) {
+		const testingFilename = "write-with-options"
+		opts := cloud.WriteOptions{
+			ContentType: "application/json",
+			Metadata:    map[string]string{"crdbtest": "some-value"},
+		}
+		testingContent := []byte(`{"hello": "world"}`)
+		require.NoError(t, cloud.WriteFileWithOptions(ctx, s, testingFilename, bytes.NewReader(testingContent), opts))
+
+		info, err := cloud.Stat(ctx, s, testingFilename)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(testingContent)), info.Size)
+		switch conf.Provider {
+		case cloudpb.ExternalStorageProvider_s3, cloudpb.ExternalStorageProvider_gs,
+			cloudpb.ExternalStorageProvider_azure:
+			require.Equal(t, opts.ContentType, info.ContentType)
+			require.Equal(t, "some-value", info.Extra[cloud.MetadataExtraPrefix+"crdbtest"])
+		}
+
+		require.NoError(t, s.Delete(ctx, testingFilename))
+	})
+	t.Run("compression", func(t *testing.T) {
+		// Repeat a random block so that the large file compresses.
+		block := randutil.RandBytes(rng, 64<<10)
+		large := bytes.Repeat(block, 80)
+		for _, codec := range []cloud.CompressionCodec{cloud.CompressionGzip, cloud.CompressionZstd} {
+			for _, tc := range []struct {
+				name    string
+				content []byte
+			}{
+				{name: "empty", content: nil},
+				{name: "large", content: large},
+			} {
+				t.Run(fmt.Sprintf("%s/%s", codec, tc.name), func(t *testing.T) {
+					testingFilename := fmt.Sprintf("compressed-%s-%s", codec, tc.name)
+					w, err := cloud.WriterWithCompression(ctx, s, testingFilename, codec)
+					require.NoError(t, err)
+					_, err = w.Write(tc.content)
+					require.NoError(t, err)
+					require.NoError(t, w.Close())
+
+					r, readCodec, err := cloud.ReadFileDecompressed(ctx, s, testingFilename)
+					require.NoError(t, err)
+					content, err := io.ReadAll(r)
+					require.NoError(t, err)
+					require.NoError(t, r.Close())
+					require.Equal(t, codec, readCodec)
+					require.Equal(t, len(tc.content), len(content))
+					require.True(t, bytes.Equal(tc.content, content), "wrong decompressed content")
+
+					// Size reports the compressed size of the file.
+					raw, _, err := s.ReadFile(ctx, testingFilename, cloud.ReadOptions{NoFileSize: true})
+					require.NoError(t, err)
+					compressed, err := ioctx.ReadAll(ctx, raw)
+					require.NoError(t, err)
+					require.NoError(t, raw.Close(ctx))
+					size, err := s.Size(ctx, testingFilename)
+					require.NoError(t, err)
+					require.Equal(t, int64(len(compressed)), size)
+					if len(tc.content) > 0 {
+						require.Less(t, size, int64(len(tc.content)))
+					}
+
+					// The uncompressed size is recorded by WriteFileWithCompression
+					// where the storage keeps metadata.
+					require.NoError(t, cloud.WriteFileWithCompression(ctx, s, testingFilename,
+						bytes.NewReader(tc.content), codec))
+					info, err := cloud.Stat(ctx, s, testingFilename)
+					require.NoError(t, err)
+					switch conf.Provider {
+					case cloudpb.ExternalStorageProvider_s3, cloudpb.ExternalStorageProvider_gs,
+						cloudpb.ExternalStorageProvider_azure, cloudpb.ExternalStorageProvider_mem:
+						require.Equal(t, int64(len(tc.content)), info.UncompressedSize)
+					}
+
+					require.NoError(t, s.Delete(ctx, testingFilename))
+				})
+			}
+		}
+	})
 	t.Run("read-single-file-by-uri", func(t *testing.T) {
 		const testingFilename = "A"
 		if err := cloud.WriteFile(ctx, s, testingFilename, bytes.NewReader([]byte("aaa"))); err != nil {
@@ -386,78 +710,80 @@ func CheckListFilesCanonical(
 		return out
 	}
 
+	listTests := []struct {
+		name      string
+		uri       string
+		prefix    string
+		delimiter string
+		expected  []string
+	}{
+		{
+			"root",
+			storeURI,
+			"",
+			"",
+			foreach(fileNames, func(s string) string { return "/" + s }),
+		},
+		{
+			"file-slash-numbers-slash",
+			storeURI,
+			"file/numbers/",
+			"",
+			[]string{"data1.csv", "data2.csv", "data3.csv"},
+		},
+		{
+			"root-slash",
+			storeURI,
+			"/",
+			"",
+			foreach(fileNames, func(s string) string { return s }),
+		},
+		{
+			"file",
+			storeURI,
+			"file",
+			"",
+			foreach(fileNames, func(s string) string { return strings.TrimPrefix(s, "file") }),
+		},
+		{
+			"file-slash",
+			storeURI,
+			"file/",
+			"",
+			foreach(fileNames, func(s string) string { return strings.TrimPrefix(s, "file/") }),
+		},
+		{
+			"slash-f",
+			storeURI,
+			"/f",
+			"",
+			foreach(fileNames, func(s string) string { return strings.TrimPrefix(s, "f") }),
+		},
+		{
+			"nothing",
+			storeURI,
+			"nothing",
+			"",
+			nil,
+		},
+		{
+			"delim-slash-file-slash",
+			storeURI,
+			"file/",
+			"/",
+			[]string{"abc/", "letters/", "numbers/"},
+		},
+		{
+			"delim-data",
+			storeURI,
+			"",
+			"data",
+			[]string{"/file/abc/A.csv", "/file/abc/B.csv", "/file/abc/C.csv", "/file/letters/data", "/file/numbers/data"},
+		},
+	}
+
 	t.Run("List", func(t *testing.T) {
-		for _, tc := range []struct {
-			name      string
-			uri       string
-			prefix    string
-			delimiter string
-			expected  []string
-		}{
-			{
-				"root",
-				storeURI,
-				"",
-				"",
-				foreach(fileNames, func(s string) string { return "/" + s }),
-			},
-			{
-				"file-slash-numbers-slash",
-				storeURI,
-				"file/numbers/",
-				"",
-				[]string{"data1.csv", "data2.csv", "data3.csv"},
-			},
-			{
-				"root-slash",
-				storeURI,
-				"/",
-				"",
-				foreach(fileNames, func(s string) string { return s }),
-			},
-			{
-				"file",
-				storeURI,
-				"file",
-				"",
-				foreach(fileNames, func(s string) string { return strings.TrimPrefix(s, "file") }),
-			},
-			{
-				"file-slash",
-				storeURI,
-				"file/",
-				"",
-				foreach(fileNames, func(s string) string { return strings.TrimPrefix(s, "file/") }),
-			},
-			{
-				"slash-f",
-				storeURI,
-				"/f",
-				"",
-				foreach(fileNames, func(s string) string { return strings.TrimPrefix(s, "f") }),
-			},
-			{
-				"nothing",
-				storeURI,
-				"nothing",
-				"",
-				nil,
-			},
-			{
-				"delim-slash-file-slash",
-				storeURI,
-				"file/",
-				"/",
-				[]string{"abc/", "letters/", "numbers/"},
-			},
-			{
-				"delim-data",
-				storeURI,
-				"",
-				"data",
-				[]string{"/file/abc/A.csv", "/file/abc/B.csv", "/file/abc/C.csv", "/file/letters/data", "/file/numbers/data"},
-			},
-		} {
+		for _, tc := range listTests {
 			t.Run(tc.name, func(t *testing.T) {
 				s := storeFromURI(ctx, t, tc.uri, clientFactory, user, db, testSettings)
 				var actual []string
@@ -471,6 +797,113 @@ func CheckListFilesCanonical(
 		}
 	})
 
+	t.Run("ListDetailed", func(t *testing.T) {
+		for _, tc := range listTests {
+			t.Run(tc.name, func(t *testing.T) {
+				s := storeFromURI(ctx, t, tc.uri, clientFactory, user, db, testSettings)
+				var actual []string
+				require.NoError(t, cloud.ListDetailed(ctx, s, tc.prefix, tc.delimiter, func(info cloud.ObjectInfo) error {
+					actual = append(actual, info.Name)
+					if tc.delimiter != "" && strings.HasSuffix(info.Name, tc.delimiter) {
+						return nil
+					}
+					stat, err := cloud.Stat(ctx, s, path.Clean(tc.prefix+info.Name))
+					require.NoError(t, err)
+					require.Equal(t, stat.Size, info.Size, info.Name)
+					require.Equal(t, stat.ETag, info.ETag, info.Name)
+					// Some stores return the modification time in an HTTP date, which
+					// has a precision of a second, but list it more precisely.
+					require.WithinDuration(t, stat.ModTime, info.ModTime, time.Second, info.Name)
+					return nil
+				}))
+				sort.Strings(actual)
+				require.Equal(t, tc.expected, actual)
+			})
+		}
+	})
+
+	t.Run("ListTree", func(t *testing.T) {
+		s := storeFromURI(ctx, t, storeURI, clientFactory, user, db, testSettings)
+		defer s.Close()
+
+		type entry struct {
+			path  string
+			isDir bool
+			depth int
+		}
+		listTree := func(prefix string, maxDepth int) []entry {
+			var res []entry
+			require.NoError(t, cloud.ListTree(ctx, s, prefix, maxDepth, func(e cloud.TreeEntry) error {
+				res = append(res, entry{e.Path, e.IsDir, e.Depth})
+				return nil
+			}))
+			return res
+		}
+		full := []entry{{"abc/", true, 1}}
+		for _, f := range []string{"A.csv", "B.csv", "C.csv"} {
+			full = append(full, entry{"abc/" + f, false, 2})
+		}
+		full = append(full, entry{"letters/", true, 1})
+		for _, f := range []string{"dataA.csv", "dataB.csv", "dataC.csv"} {
+			full = append(full, entry{"letters/" + f, false, 2})
+		}
+		full = append(full, entry{"numbers/", true, 1})
+		for _, f := range []string{"data1.csv", "data2.csv", "data3.csv"} {
+			full = append(full, entry{"numbers/" + f, false, 2})
+		}
+
+		require.Equal(t, full, listTree("file", 0))
+		require.Equal(t, full, listTree("file/", 2))
+		require.Equal(t, []entry{{"abc/", true, 1}, {"letters/", true, 1}, {"numbers/", true, 1}},
+			listTree("file", 1))
+		require.Equal(t, []entry{{"file/", true, 1}}, listTree("", 1))
+		require.Equal(t, []entry{{"data1.csv", false, 1}, {"data2.csv", false, 1}, {"data3.csv", false, 1}},
+			listTree("file/numbers", 0))
+		require.Empty(t, listTree("nothing", 0))
+
+		// Errors returned by the callback stop the listing.
+		var calls int
+		stop := errors.New("stop")
+		require.ErrorIs(t, cloud.ListTree(ctx, s, "file", 0, func(cloud.TreeEntry) error {
+			calls++
+			return stop
+		}), stop)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("ListPage", func(t *testing.T) {
+		for _, tc := range listTests {
+			t.Run(tc.name, func(t *testing.T) {
+				s := storeFromURI(ctx, t, tc.uri, clientFactory, user, db, testSettings)
+				var listed []string
+				require.NoError(t, s.List(ctx, tc.prefix, tc.delimiter, func(f string) error {
+					listed = append(listed, f)
+					return nil
+				}))
+
+				// Page through the listing with a page size that does not divide
+				// the number of files.
+				const maxResults = 2
+				var paged []string
+				var pageToken string
+				for pages := 0; ; pages++ {
+					require.LessOrEqual(t, pages, len(fileNames), "listing did not terminate")
+					results, nextPageToken, err := cloud.ListPage(ctx, s, tc.prefix, tc.delimiter, pageToken, maxResults)
+					require.NoError(t, err)
+					require.LessOrEqual(t, len(results), maxResults)
+					paged = append(paged, results...)
+					if nextPageToken == "" {
+						break
+					}
+					pageToken = nextPageToken
+				}
+				sort.Strings(listed)
+				sort.Strings(paged)
+				require.Equal(t, listed, paged)
+			})
+		}
+	})
+
 	for _, fileName := range fileNames {
 		file := storeFromURI(ctx, t, storeURI, clientFactory, user, db, testSettings)
 		if err := file.Delete(ctx, fileName); err != nil {
@@ -552,7 +985,7 @@ func CheckAntagonisticRead(
 }
 
 // CheckNoPermission checks that we do not have permission to list the external
-// storage at storeURI.
+// storage at storeURI, and that checking its access reports it.
 func CheckNoPermission(
 	t *testing.T,
 	storeURI string,
@@ -583,6 +1016,17 @@ func CheckNoPermission(
 	}
 
 	require.Regexp(t, "(failed|unable) to list", err)
+
+	err = cloud.CheckAccess(ctx, s)
+	require.True(t, errors.Is(err, cloud.ErrAccessDenied), "expected access denied, got %v", err)
+	CheckNotWritable(t, s, "backup")
+}
+
+// CheckNotWritable checks that validating that the named file of the storage
+// is writable reports that the access is denied.
+func CheckNotWritable(t *testing.T, s cloud.ExternalStorage, basename string) {
+	err := cloud.ValidateWritable(context.Background(), s, basename)
+	require.True(t, errors.Is(err, cloud.ErrAccessDenied), "expected access denied, got %v", err)
 }
 
 // IsImplicitAuthConfigured returns true if the `GOOGLE_APPLICATION_CREDENTIALS`
@@ -0,0 +1,413 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudtestutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// ExternalStorageFactory returns an ExternalStorage whose base path is
+// basePath, relative to the root of the storage under test. Storage returned
+// for the same root must share its files, so that a file written through one
+// can be read through another. The suite closes the returned storage.
+type ExternalStorageFactory func(t *testing.T, basePath string) cloud.ExternalStorage
+
+// RunConformanceSuite runs the tests of the contract of the ExternalStorage
+// interface against the storage returned by factory, so that implementations
+// which do not live in this repository can be validated by a single call.
+// The files are written under a base path unique to the run.
+func RunConformanceSuite(t *testing.T, factory ExternalStorageFactory) {
+	ctx := context.Background()
+	root := fmt.Sprintf("conformance-%d", NewTestID())
+	open := func(t *testing.T, basePath string) cloud.ExternalStorage {
+		s := factory(t, path.Join(root, basePath))
+		t.Cleanup(func() { _ = s.Close() })
+		return s
+	}
+	readAll := func(t *testing.T, s cloud.ExternalStorage, basename string) []byte {
+		r, _, err := s.ReadFile(ctx, basename, cloud.ReadOptions{NoFileSize: true})
+		require.NoError(t, err)
+		defer r.Close(ctx)
+		content, err := ioctx.ReadAll(ctx, r)
+		require.NoError(t, err)
+		return content
+	}
+	list := func(t *testing.T, s cloud.ExternalStorage, prefix, delimiter string) []string {
+		var names []string
+		require.NoError(t, s.List(ctx, prefix, delimiter, func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		sort.Strings(names)
+		return names
+	}
+
+	rng, _ := randutil.NewTestRand()
+
+	t.Run("read-at", func(t *testing.T) {
+		s := open(t, "read-at")
+		const filename = "data"
+		content := randutil.RandBytes(rng, 1<<10)
+		require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader(content)))
+
+		for _, offset := range []int64{0, 1, 512, int64(len(content)) - 1, int64(len(content))} {
+			t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
+				r, size, err := s.ReadFile(ctx, filename, cloud.ReadOptions{Offset: offset})
+				require.NoError(t, err)
+				defer r.Close(ctx)
+				require.Equal(t, int64(len(content)), size)
+				read, err := ioctx.ReadAll(ctx, r)
+				require.NoError(t, err)
+				require.Equal(t, content[offset:], read)
+			})
+		}
+
+		r, err := cloud.ReadFileAtWithLength(ctx, s, filename, 100, 200)
+		require.NoError(t, err)
+		read, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, content[100:300], read)
+
+		// Reading past the end of the file is an unexpected EOF.
+		r, err = cloud.ReadFileAtWithLength(ctx, s, filename, int64(len(content))-10, 20)
+		if err == nil {
+			_, err = io.ReadAll(r)
+			require.NoError(t, r.Close())
+		}
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "expected an unexpected EOF, got %v", err)
+
+		require.NoError(t, s.Delete(ctx, filename))
+	})
+
+	t.Run("read-suffix", func(t *testing.T) {
+		s := open(t, "read-suffix")
+		const filename = "data"
+		content := randutil.RandBytes(rng, 1<<10)
+		require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader(content)))
+		full := readAll(t, s, filename)
+
+		for _, n := range []int64{0, 1, 100, int64(len(content)), int64(len(content)) + 10} {
+			t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
+				r, size, err := cloud.ReadFileSuffix(ctx, s, filename, n)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(full)), size)
+				read, err := io.ReadAll(r)
+				require.NoError(t, err)
+				require.NoError(t, r.Close())
+				start := len(full) - int(n)
+				if start < 0 {
+					start = 0
+				}
+				require.Equal(t, full[start:], read)
+			})
+		}
+
+		// The suffix of an empty file is empty.
+		require.NoError(t, cloud.WriteFile(ctx, s, "empty", bytes.NewReader(nil)))
+		r, size, err := cloud.ReadFileSuffix(ctx, s, "empty", 10)
+		require.NoError(t, err)
+		require.Zero(t, size)
+		read, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Empty(t, read)
+
+		_, _, err = cloud.ReadFileSuffix(ctx, s, "missing", 10)
+		require.ErrorIs(t, err, cloud.ErrFileDoesNotExist)
+
+		require.NoError(t, s.Delete(ctx, filename))
+		require.NoError(t, s.Delete(ctx, "empty"))
+	})
+
+	t.Run("list-delimiter", func(t *testing.T) {
+		s := open(t, "list-delimiter")
+		files := []string{"dir/a/1.csv", "dir/a/2.csv", "dir/b/3.csv", "dir/top.csv", "other.csv"}
+		for _, f := range files {
+			require.NoError(t, cloud.WriteFile(ctx, s, f, bytes.NewReader([]byte(f))))
+		}
+
+		// Names sharing a prefix before the delimiter are grouped into that
+		// prefix, and names are relative to the listed prefix.
+		require.Equal(t, []string{"a/", "b/", "top.csv"}, list(t, s, "dir/", "/"))
+		require.Equal(t, []string{"1.csv", "2.csv"}, list(t, s, "dir/a/", "/"))
+		require.Equal(t, []string{"a/1.csv", "a/2.csv", "b/3.csv", "top.csv"}, list(t, s, "dir/", ""))
+		require.Empty(t, list(t, s, "nothing/", "/"))
+
+		for _, f := range files {
+			require.NoError(t, s.Delete(ctx, f))
+		}
+	})
+
+	t.Run("list-prefixes", func(t *testing.T) {
+		s := open(t, "list-prefixes")
+		files := []string{
+			"backups/2023/01/full.sst", "backups/2023/02/inc.sst", "backups/2024/full.sst",
+			"backups/2024/12/inc.sst", "backups/LATEST", "backups/index/manifest", "top.sst",
+		}
+		for _, f := range files {
+			require.NoError(t, cloud.WriteFile(ctx, s, f, bytes.NewReader([]byte(f))))
+		}
+
+		// Only the sub-prefixes directly under the prefix are returned, without
+		// the files next to them or in them.
+		prefixes, err := cloud.ListPrefixes(ctx, s, "backups/", "/")
+		require.NoError(t, err)
+		require.Equal(t, []string{"2023/", "2024/", "index/"}, prefixes)
+		prefixes, err = cloud.ListPrefixes(ctx, s, "backups/2024/", "/")
+		require.NoError(t, err)
+		require.Equal(t, []string{"12/"}, prefixes)
+		prefixes, err = cloud.ListPrefixes(ctx, s, "backups/2023/01/", "/")
+		require.NoError(t, err)
+		require.Empty(t, prefixes)
+		prefixes, err = cloud.ListPrefixes(ctx, s, "nothing/", "/")
+		require.NoError(t, err)
+		require.Empty(t, prefixes)
+		_, err = cloud.ListPrefixes(ctx, s, "backups/", "")
+		require.Error(t, err)
+
+		for _, f := range files {
+			require.NoError(t, s.Delete(ctx, f))
+		}
+	})
+
+	t.Run("list-sorted", func(t *testing.T) {
+		s := open(t, "list-sorted")
+		files := []string{"dir/b/2", "dir/c", "dir/a/1", "dir/b/1", "dir/a/2", "dir/d", "dir/a/3"}
+		for _, f := range files {
+			require.NoError(t, cloud.WriteFile(ctx, s, f, bytes.NewReader([]byte(f))))
+		}
+
+		// The names are sorted across the pages of the listing, whatever the
+		// page size, and the grouped prefixes are returned once.
+		for _, pageSize := range []int{0, 1, 2, 3} {
+			names, err := cloud.ListSortedWithPageSize(ctx, s, "dir/", "", pageSize)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a/1", "a/2", "a/3", "b/1", "b/2", "c", "d"}, names)
+			names, err = cloud.ListSortedWithPageSize(ctx, s, "dir/a/", "", pageSize)
+			require.NoError(t, err)
+			require.Equal(t, []string{"1", "2", "3"}, names)
+			names, err = cloud.ListSortedWithPageSize(ctx, s, "dir/", "/", pageSize)
+			require.NoError(t, err)
+			require.Equal(t, []string{"a/", "b/", "c", "d"}, names)
+		}
+		names, err := cloud.ListSorted(ctx, s, "nothing/", "")
+		require.NoError(t, err)
+		require.Empty(t, names)
+
+		for _, f := range files {
+			require.NoError(t, s.Delete(ctx, f))
+		}
+	})
+
+	// Validating that a file is writable neither writes nor modifies it, and
+	// leaves no probe behind.
+	t.Run("validate-writable", func(t *testing.T) {
+		s := open(t, "validate-writable")
+		require.NoError(t, cloud.ValidateWritable(ctx, s, "dir/new"))
+		exists, err := cloud.Exists(ctx, s, "dir/new")
+		require.NoError(t, err)
+		require.False(t, exists)
+
+		require.NoError(t, cloud.WriteFile(ctx, s, "dir/existing", bytes.NewReader([]byte("content"))))
+		require.NoError(t, cloud.ValidateWritable(ctx, s, "dir/existing"))
+		require.Equal(t, []byte("content"), readAll(t, s, "dir/existing"))
+		require.Equal(t, []string{"/dir/existing"}, list(t, s, "", ""))
+		require.NoError(t, s.Delete(ctx, "dir/existing"))
+	})
+
+	// Appended content is readable after the existing content, in the order it
+	// was appended, on the storage which supports appending.
+	t.Run("append", func(t *testing.T) {
+		s := open(t, "append")
+		const filename = "log"
+		err := cloud.AppendFile(ctx, s, filename, bytes.NewReader([]byte("first|")))
+		if errors.IsUnimplementedError(err) {
+			skip.IgnoreLintf(t, "appending is not supported: %v", err)
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte("first|"), readAll(t, s, filename))
+
+		content := []byte("first|")
+		for _, chunk := range [][]byte{[]byte("second|"), {}, randutil.RandBytes(rng, 1<<10)} {
+			require.NoError(t, cloud.AppendFile(ctx, s, filename, bytes.NewReader(chunk)))
+			content = append(content, chunk...)
+			require.Equal(t, content, readAll(t, s, filename))
+		}
+		size, err := s.Size(ctx, filename)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), size)
+		require.NoError(t, s.Delete(ctx, filename))
+	})
+
+	// Versions require a bucket with versioning enabled, so only backends
+	// without versioning are checked: they report it as unsupported.
+	t.Run("versions", func(t *testing.T) {
+		s := open(t, "versions")
+		if _, _, err := cloud.ReadFileAtVersion(ctx, s, "file", "1", 0); !errors.IsUnimplementedError(err) {
+			skip.IgnoreLint(t, "versions are tested by the tests of the provider")
+		}
+		err := cloud.DeleteVersion(ctx, s, "file", "1")
+		require.True(t, errors.IsUnimplementedError(err), "expected an unimplemented error, got %v", err)
+	})
+
+	// Glob patterns, as accepted by IMPORT, are expanded by listing the storage
+	// of the path before the first wildcard and matching the listed names.
+	t.Run("list-glob", func(t *testing.T) {
+		s := open(t, "list-glob")
+		files := []string{"a.csv", "b.csv", "c.txt", "sub/d.csv"}
+		for _, f := range files {
+			require.NoError(t, cloud.WriteFile(ctx, s, f, bytes.NewReader([]byte(f))))
+		}
+
+		var matched []string
+		for _, name := range list(t, s, "", "") {
+			ok, err := path.Match("/*.csv", name)
+			require.NoError(t, err)
+			if ok {
+				matched = append(matched, name)
+			}
+		}
+		require.Equal(t, []string{"/a.csv", "/b.csv"}, matched)
+
+		for _, f := range files {
+			require.NoError(t, s.Delete(ctx, f))
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := open(t, "delete")
+		const filename = "data"
+		require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader([]byte("data"))))
+		exists, err := cloud.Exists(ctx, s, filename)
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		require.NoError(t, s.Delete(ctx, filename))
+		exists, err = cloud.Exists(ctx, s, filename)
+		require.NoError(t, err)
+		require.False(t, exists)
+		_, _, err = s.ReadFile(ctx, filename, cloud.ReadOptions{NoFileSize: true})
+		require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "expected a file does not exist error, got %v", err)
+		require.Empty(t, list(t, s, "", ""))
+	})
+
+	t.Run("size", func(t *testing.T) {
+		s := open(t, "size")
+		for _, size := range []int{0, 1, 1 << 10, 5 << 20} {
+			filename := fmt.Sprintf("data-%d", size)
+			content := randutil.RandBytes(rng, size)
+			require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader(content)))
+			actual, err := s.Size(ctx, filename)
+			require.NoError(t, err)
+			require.Equal(t, int64(size), actual)
+			require.NoError(t, s.Delete(ctx, filename))
+		}
+	})
+
+	t.Run("empty-file", func(t *testing.T) {
+		s := open(t, "empty-file")
+		const filename = "empty"
+		require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader(nil)))
+
+		r, size, err := s.ReadFile(ctx, filename, cloud.ReadOptions{})
+		require.NoError(t, err)
+		require.Zero(t, size)
+		content, err := ioctx.ReadAll(ctx, r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close(ctx))
+		require.Empty(t, content)
+
+		actual, err := s.Size(ctx, filename)
+		require.NoError(t, err)
+		require.Zero(t, actual)
+		exists, err := cloud.Exists(ctx, s, filename)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.Equal(t, []string{"/" + filename}, list(t, s, "", ""))
+
+		require.NoError(t, s.Delete(ctx, filename))
+	})
+
+	// A writer must be closed for the file to be written, and when writing or
+	// closing fails no partial file may be left behind.
+	t.Run("writer-close", func(t *testing.T) {
+		s := open(t, "writer-close")
+		const filename = "data"
+		content := randutil.RandBytes(rng, 1<<10)
+
+		w, err := s.Writer(ctx, filename)
+		require.NoError(t, err)
+		_, err = w.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.Equal(t, content, readAll(t, s, filename))
+		require.NoError(t, s.Delete(ctx, filename))
+
+		// The writer of a canceled context may fail on Writer, Write or Close,
+		// but a file is only visible if it was written in full.
+		canceledCtx, cancel := context.WithCancel(ctx)
+		w, err = s.Writer(canceledCtx, filename)
+		if err == nil {
+			cancel()
+			_, err = w.Write(content)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		cancel()
+		exists, existsErr := cloud.Exists(ctx, s, filename)
+		require.NoError(t, existsErr)
+		if err != nil {
+			require.False(t, exists, "a failed write left a file behind: %v", err)
+		} else {
+			require.True(t, exists)
+			require.Equal(t, content, readAll(t, s, filename))
+			require.NoError(t, s.Delete(ctx, filename))
+		}
+	})
+
+	// The storage of the path of a file refers to the file by an empty
+	// filename, as documented on the ExternalStorage interface.
+	t.Run("empty-filename-is-base-path", func(t *testing.T) {
+		dir := open(t, "single-file")
+		file := open(t, "single-file/data")
+		content := []byte("single file")
+
+		require.NoError(t, cloud.WriteFile(ctx, file, "", bytes.NewReader(content)))
+		require.Equal(t, content, readAll(t, dir, "data"))
+		require.Equal(t, content, readAll(t, file, ""))
+		size, err := file.Size(ctx, "")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), size)
+		exists, err := cloud.Exists(ctx, file, "")
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		require.NoError(t, file.Delete(ctx, ""))
+		exists, err = cloud.Exists(ctx, dir, "data")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+}
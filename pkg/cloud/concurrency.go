@@ -0,0 +1,113 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/quotapool"
+)
+
+var maxConcurrentOps = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.max_concurrent_ops",
+	"the maximum number of concurrent operations of a node on external storage, across all "+
+		"providers, where open readers and writers count until they are closed; 0 disables the limit",
+	0,
+	settings.NonNegativeInt,
+)
+
+// makeOpsLimiter makes the limiter of the concurrent operations of a node on
+// external storage, and sets it up to be updated when the setting changes.
+// Operations which wait for a slot are granted one in the order they asked for
+// it. Callers which wait for an operation while holding a slot, e.g. by reading
+// files while listing them, rely on the limit exceeding their own concurrency.
+func makeOpsLimiter(sv *settings.Values) *quotapool.IntPool {
+	capacity := func() uint64 {
+		if n := maxConcurrentOps.Get(sv); n > 0 {
+			return uint64(n)
+		}
+		return math.MaxInt32
+	}
+	lim := quotapool.NewIntPool(string(maxConcurrentOps.Name()), capacity())
+	maxConcurrentOps.SetOnChange(sv, func(ctx context.Context) {
+		lim.UpdateCapacity(capacity())
+	})
+	return lim
+}
+
+// opSlot is a slot of the concurrent operations of a node, which is released
+// once, when the operation completes. A nil slot does nothing.
+type opSlot struct {
+	once  sync.Once
+	alloc *quotapool.IntAlloc
+}
+
+func (s *opSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(s.alloc.Release)
+}
+
+// acquireOp waits for a slot of the concurrent operations of the node, or
+// until ctx is canceled.
+func (e *esWrapper) acquireOp(ctx context.Context) (*opSlot, error) {
+	if e.lim.ops == nil {
+		return nil, nil
+	}
+	alloc, err := e.lim.ops.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &opSlot{alloc: alloc}, nil
+}
+
+// releasingReader is a reader which holds a slot of the concurrent operations
+// of the node until it is closed.
+type releasingReader struct {
+	r    ioctx.ReadCloserCtx
+	slot *opSlot
+}
+
+func (r *releasingReader) Read(ctx context.Context, p []byte) (int, error) {
+	return r.r.Read(ctx, p)
+}
+
+func (r *releasingReader) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	return ioctx.WriteTo(ctx, r.r, w)
+}
+
+func (r *releasingReader) Close(ctx context.Context) error {
+	defer r.slot.release()
+	return r.r.Close(ctx)
+}
+
+// releasingWriter is a writer which holds a slot of the concurrent operations
+// of the node until it is closed.
+type releasingWriter struct {
+	io.WriteCloser
+	slot *opSlot
+}
+
+func (w *releasingWriter) ReadFrom(src io.Reader) (int64, error) {
+	return readFrom(w.WriteCloser, src)
+}
+
+func (w *releasingWriter) Close() error {
+	defer w.slot.release()
+	return w.WriteCloser.Close()
+}
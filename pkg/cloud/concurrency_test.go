@@ -0,0 +1,212 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// inFlightStorage is an ExternalStorage whose operations take a while, and
+// which records how many of them are in flight at most. Open readers and
+// writers count as in flight until they are closed.
+type inFlightStorage struct {
+	ExternalStorage
+	inFlight, maxInFlight atomic.Int64
+}
+
+func (s *inFlightStorage) start() {
+	n := s.inFlight.Add(1)
+	for {
+		prev := s.maxInFlight.Load()
+		if n <= prev || s.maxInFlight.CompareAndSwap(prev, n) {
+			return
+		}
+	}
+}
+
+func (s *inFlightStorage) finish() {
+	s.inFlight.Add(-1)
+}
+
+func (s *inFlightStorage) Delete(ctx context.Context, _ string) error {
+	s.start()
+	defer s.finish()
+	select {
+	case <-time.After(time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inFlightReader finishes the operation of its storage when it is closed.
+type inFlightReader struct {
+	s *inFlightStorage
+}
+
+func (r *inFlightReader) Read(context.Context, []byte) (int, error) { return 0, io.EOF }
+
+func (r *inFlightReader) Close(context.Context) error {
+	r.s.finish()
+	return nil
+}
+
+func (s *inFlightStorage) ReadFile(
+	_ context.Context, _ string, _ ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	s.start()
+	return &inFlightReader{s: s}, 0, nil
+}
+
+// ReadFileAtWithLength implements the RangeReader interface.
+func (s *inFlightStorage) ReadFileAtWithLength(
+	ctx context.Context, basename string, _, _ int64,
+) (io.ReadCloser, error) {
+	r, _, err := s.ReadFile(ctx, basename, ReadOptions{})
+	return &ctxReadCloser{ctx: ctx, r: r}, err
+}
+
+// Copy implements the Copier interface.
+func (s *inFlightStorage) Copy(ctx context.Context, _, dstBasename string) error {
+	return s.Delete(ctx, dstBasename)
+}
+
+func (s *inFlightStorage) ReadFileAtVersion(
+	_ context.Context, _, _ string, _ int64,
+) (ioctx.ReadCloserCtx, int64, error) {
+	s.start()
+	return &inFlightReader{s: s}, 0, nil
+}
+
+func (s *inFlightStorage) DeleteVersion(ctx context.Context, basename, _ string) error {
+	return s.Delete(ctx, basename)
+}
+
+func TestMaxConcurrentOps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	const limit = 3
+	st := cluster.MakeTestingClusterSettings()
+	maxConcurrentOps.Override(ctx, &st.SV, limit)
+	ops := makeOpsLimiter(&st.SV)
+	fake := &inFlightStorage{}
+	es := &esWrapper{
+		ExternalStorage: fake,
+		lim:             rwLimiter{ops: ops},
+		metricsRecorder: newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown),
+	}
+
+	t.Run("in-flight", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errCh := make(chan error, 10*limit)
+		for i := 0; i < 10*limit; i++ {
+			wg.Add(1)
+			go func(op int) {
+				defer wg.Done()
+				// The operations of the optional interfaces the storage
+				// implements natively are limited like the others.
+				switch op {
+				case 0:
+					errCh <- es.Delete(ctx, "file")
+				case 1:
+					errCh <- es.Copy(ctx, "file", "copy")
+				case 2:
+					r, _, err := es.ReadFile(ctx, "file", ReadOptions{})
+					if err != nil {
+						errCh <- err
+						return
+					}
+					time.Sleep(time.Millisecond)
+					errCh <- r.Close(ctx)
+				case 3:
+					r, err := es.ReadFileAtWithLength(ctx, "file", 0 /* offset */, 1 /* length */)
+					if err != nil {
+						errCh <- err
+						return
+					}
+					time.Sleep(time.Millisecond)
+					errCh <- r.Close()
+				}
+			}(i % 4)
+		}
+		wg.Wait()
+		close(errCh)
+		for err := range errCh {
+			require.NoError(t, err)
+		}
+		require.LessOrEqual(t, fake.maxInFlight.Load(), int64(limit))
+		require.Zero(t, fake.inFlight.Load())
+		require.Equal(t, uint64(limit), ops.ApproximateQuota())
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		// Open readers hold all the slots, so operations wait for one until
+		// their context is canceled.
+		var readers []ioctx.ReadCloserCtx
+		for i := 0; i < limit; i++ {
+			r, _, err := es.ReadFile(ctx, "file", ReadOptions{})
+			require.NoError(t, err)
+			readers = append(readers, r)
+		}
+		cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, es.Delete(cancelCtx, "file"), context.DeadlineExceeded)
+		_, _, err := es.ReadFile(cancelCtx, "file", ReadOptions{})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// Closing a reader releases its slot.
+		require.NoError(t, readers[0].Close(ctx))
+		require.NoError(t, es.Delete(ctx, "file"))
+		for _, r := range readers[1:] {
+			require.NoError(t, r.Close(ctx))
+		}
+		require.Equal(t, uint64(limit), ops.ApproximateQuota())
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		// Readers of versions of files hold a slot until they are closed, like
+		// those of ReadFile.
+		var readers []ioctx.ReadCloserCtx
+		for i := 0; i < limit; i++ {
+			r, _, err := es.ReadFileAtVersion(ctx, "file", "version", 0 /* offset */)
+			require.NoError(t, err)
+			readers = append(readers, r)
+		}
+		cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, es.Delete(cancelCtx, "file"), context.DeadlineExceeded)
+		for _, r := range readers {
+			require.NoError(t, r.Close(ctx))
+		}
+		require.Zero(t, fake.inFlight.Load())
+		require.Equal(t, uint64(limit), ops.ApproximateQuota())
+	})
+
+	t.Run("setting", func(t *testing.T) {
+		maxConcurrentOps.Override(ctx, &st.SV, 1)
+		require.Equal(t, uint64(1), ops.Capacity())
+		// A limit of 0 does not limit.
+		maxConcurrentOps.Override(ctx, &st.SV, 0)
+		require.Greater(t, ops.Capacity(), uint64(10*limit))
+	})
+}
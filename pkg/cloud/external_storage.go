@@ -15,6 +15,7 @@ import (
 	"database/sql/driver"
 	"io"
 	"net/url"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/blobs"
@@ -40,6 +41,16 @@ import (
 // `filepath.Join` to concatenate their base path with the provided filename
 // will find its semantics well suited to this -- it elides empty components and
 // does not append surplus slashes.
+//
+// The capabilities which only some storage has are optional interfaces, such
+// as RangeReader or PresignedURLer. Callers use the function of this package
+// named after the method of each, such as ReadFileAtWithLength, rather than a
+// type assertion: the wrappers of this package, such as the storage returned by
+// MakeExternalStorage, implement every optional interface whatever the storage
+// they wrap, so that the interfaces reach the storage through them. A wrapper
+// falls back to a generic implementation, or returns an error for which
+// errors.IsUnimplementedError is true, if the storage it wraps lacks the
+// capability.
 type ExternalStorage interface {
 	io.Closer
 
@@ -82,7 +93,12 @@ type ExternalStorage interface {
 	// error, iteration is stopped it is returned. If delimiter is non-empty
 	// names which have the same prefix, prior to the delimiter, are grouped
 	// into a single result which is that prefix. The order that results are
-	// passed to the callback is undefined.
+	// passed to the callback is undefined; ListSorted returns the results in
+	// lexicographic order.
+	//
+	// The passed function returns ErrStopListing to stop the iteration once it
+	// found what it was listing for, in which case the storage returned by
+	// MakeExternalStorage returns nil rather than the error.
 	List(ctx context.Context, prefix, delimiter string, fn ListingFn) error
 
 	// Delete removes the named file from the store.
@@ -106,11 +122,546 @@ type ReadOptions struct {
 	// NoFileSize is set if the ReadFile caller is not interested in the fileSize
 	// return value (potentially making the call more efficient).
 	NoFileSize bool
+
+	// SSECustomerKey is the customer-provided key the file was written with, if
+	// it was written with WriteOptions.SSECustomerKey. Files encrypted with a
+	// key managed by the provider are read without it.
+	SSECustomerKey []byte
+
+	// BufferSize, if positive, overrides the size of the buffer the storage
+	// returned by MakeExternalStorage reads the file into, which is set by the
+	// cloudstorage.read.buffer_size cluster setting. Small buffers suit the
+	// reads of small files over high-latency links.
+	BufferSize int64
+}
+
+// ResumableWriter is the writer of a multipart upload returned by
+// OpenResumableWriter. Unlike a writer returned by Writer, it
+// leaves the uploaded parts behind if it is not closed or closing fails, so
+// that the upload can be resumed, until the upload is resumed and completed,
+// or aborted.
+type ResumableWriter interface {
+	io.WriteCloser
+
+	// ResumeToken returns a token resuming the upload after the parts uploaded
+	// so far, along with the offset in the file the resumed upload is written
+	// from, which is the total size of those parts. Bytes written but not yet
+	// uploaded in a part are not covered by the token. Callers persist the
+	// token, e.g. in their job record, to resume the upload after a restart.
+	ResumeToken() (token []byte, offset int64, err error)
+
+	// Abort aborts the upload, deleting its uploaded parts.
+	Abort(ctx context.Context) error
+}
+
+// WriteOptions are the options of a file written by
+// WriterWithOptions. The zero value writes the file with the
+// defaults of the storage.
+type WriteOptions struct {
+	// ContentType is the MIME type of the file.
+	ContentType string
+	// Metadata is user-defined metadata stored with the file. Keys should be
+	// lower-case ASCII identifiers, since providers restrict the characters of
+	// keys and do not all preserve their case.
+	Metadata map[string]string
+	// StorageClass is the provider-specific storage class, or access tier, of
+	// the file. It overrides the storage class configured for the storage.
+	StorageClass string
+
+	// SSEAlgorithm is the server-side encryption algorithm of the file on s3,
+	// either "AES256" or "aws:kms". It overrides the encryption mode
+	// configured for the storage.
+	SSEAlgorithm string
+	// SSEKMSKeyID is the customer-managed key the file is encrypted with by the
+	// provider: the KMS key ID on s3 (which implies "aws:kms"), the Cloud KMS
+	// key name on gcs, or the encryption scope on azure.
+	SSEKMSKeyID string
+	// SSECustomerKey is a 256-bit AES key the provider encrypts the file with
+	// without storing it. The file can then only be read with the same key in
+	// ReadOptions.SSECustomerKey. It cannot be combined with SSEKMSKeyID.
+	//
+	// Storage which does not encrypt files at rest ignores the server-side
+	// encryption options.
+	SSECustomerKey []byte
+
+	// ExpireAfter, if positive, marks the file as temporary so that a
+	// lifecycle rule of the bucket can delete it once ExpireAfter has elapsed,
+	// e.g. if the job writing it dies before cleaning it up. The storage does
+	// not delete the file itself. On s3 and azure the file is tagged with
+	// ExpireAfterDaysKey and the duration in days, rounded up, and on gcs its
+	// custom time is set to the time it expires at, for a daysSinceCustomTime
+	// condition. Stat records the tag under ExpireAfterDaysKey, and the custom
+	// time under "custom-time", in ObjectInfo.Extra.
+	// Storage without lifecycle rules ignores it.
+	ExpireAfter time.Duration
+
+	// RetainUntil, if set, locks the file in write-once-read-many mode until
+	// then, so that it cannot be overwritten or deleted before, even with the
+	// credentials which wrote it. On s3 the object is written with an Object
+	// Lock retention in compliance mode, and on azure the blob with a locked
+	// immutability policy, which require the bucket or container to support
+	// them; the write fails otherwise. Storage which cannot lock files returns
+	// an error instead of ignoring it.
+	RetainUntil time.Time
+	// LegalHold, if set, places a legal hold on the file, which locks it like
+	// RetainUntil until the hold is removed from the file out of band.
+	LegalHold bool
+
+	// ChecksumAlgo, if set, is the algorithm of a checksum of the file which
+	// is computed as it is written, without buffering the whole file first,
+	// and sent to the provider so that it verifies the bytes it received and
+	// rejects the write if they differ. The provider stores the checksum, so
+	// that ReadFileWithChecksum can verify reads against it. Storage which
+	// cannot verify writes with the algorithm returns an error instead of
+	// ignoring it.
+	ChecksumAlgo ChecksumAlgo
+}
+
+// LocksFile returns whether the file is written with a retention period or a
+// legal hold.
+func (o WriteOptions) LocksFile() bool {
+	return !o.RetainUntil.IsZero() || o.LegalHold
+}
+
+// ExpireAfterDaysKey is the key of the tag, and of ObjectInfo.Extra, holding
+// the number of days after which a file written with WriteOptions.ExpireAfter
+// expires.
+const ExpireAfterDaysKey = "expire-after-days"
+
+// MetadataExtraPrefix is the prefix of the keys of ObjectInfo.Extra which hold
+// the user-defined metadata of a file, followed by the lower-cased metadata
+// key.
+const MetadataExtraPrefix = "metadata."
+
+// ObjectInfo is the metadata of a file returned by Stat.
+// Fields which a storage does not record are left empty.
+type ObjectInfo struct {
+	// Name is the name of the file relative to the listed prefix. It is only
+	// set by ListDetailed.
+	Name string
+	// Size is the length of the file in bytes.
+	Size int64
+	// ModTime is the time the file was last modified.
+	ModTime time.Time
+	// ETag is an opaque identifier of the version of the file, which changes
+	// when the file is rewritten.
+	ETag string
+	// ContentType is the MIME type of the file.
+	ContentType string
+	// UncompressedSize is the length of the contents of a file written by
+	// WriteFileWithCompression once they are decompressed, or -1 if it is not
+	// known. It is only set by the storage returned by MakeExternalStorage.
+	UncompressedSize int64
+	// Extra holds provider-specific metadata of the file, such as its storage
+	// class, and its user-defined metadata under MetadataExtraPrefix.
+	Extra map[string]string
+}
+
+// DeleteResult is the result of the deletion of a file by BatchDelete.
+type DeleteResult struct {
+	Basename string
+	// Err is set if the file could not be deleted.
+	Err error
+}
+
+// ChecksumAlgo is a checksum algorithm supported by ReadFileWithChecksum.
+type ChecksumAlgo int
+
+const (
+	// ChecksumCRC32C is the CRC32 checksum with the Castagnoli polynomial, as
+	// a 4 byte big-endian value.
+	ChecksumCRC32C ChecksumAlgo = iota + 1
+	// ChecksumSHA256 is the SHA-256 digest.
+	ChecksumSHA256
+	// ChecksumMD5 is the MD5 digest.
+	ChecksumMD5
+)
+
+// CompressionCodec is a compression format supported by WriterWithCompression
+// and ReadFileDecompressed.
+type CompressionCodec int
+
+const (
+	// CompressionNone writes the file uncompressed.
+	CompressionNone CompressionCodec = iota
+	// CompressionGzip compresses the file with gzip.
+	CompressionGzip
+	// CompressionZstd compresses the file with zstd.
+	CompressionZstd
+)
+
+// RangeReader is implemented by ExternalStorage which can read a range of a
+// file with a bounded request. See ReadFileAtWithLength.
+//
+// A successful type assertion does not mean the range is read with a bounded
+// request: wrappers read it with ReadFile if the storage they wrap is not a
+// RangeReader.
+type RangeReader interface {
+	// ReadFileAtWithLength returns a Reader for exactly length bytes of the
+	// requested name starting at offset. The reader returns
+	// io.ErrUnexpectedEOF if the file ends before offset+length.
+	//
+	// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+	ReadFileAtWithLength(ctx context.Context, basename string, offset, length int64) (io.ReadCloser, error)
+}
+
+// ChecksumReader is implemented by ExternalStorage which stores the checksums
+// of its files, so they can be verified as the files are read. See
+// ReadFileWithChecksum.
+//
+// A successful type assertion does not mean the storage stores checksums:
+// if the storage they wrap does not, wrappers verify the file against the
+// expected checksum, and fail if none is given.
+type ChecksumReader interface {
+	// ReadFileWithChecksum returns a Reader for the requested name which
+	// computes the checksum of the file with algo as it is read. Close returns
+	// an error wrapping ErrChecksumMismatch if the checksum differs from
+	// expected, or an error if the file was not read to the end. If expected is
+	// nil, the checksum stored by the provider is used; implementations which
+	// do not store a checksum for algo return an error.
+	//
+	// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+	ReadFileWithChecksum(ctx context.Context, basename string, expected []byte, algo ChecksumAlgo) (io.ReadCloser, error)
+}
+
+// OptionsWriter is implemented by ExternalStorage which can write files with
+// WriteOptions. See WriterWithOptions.
+//
+// Wrappers implement OptionsWriter even if the storage they wrap does not, in
+// which case the options are handled as by WriterWithOptionsFromWriter.
+type OptionsWriter interface {
+	// WriterWithOptions is like Writer, but the file is written with the
+	// content type, metadata and storage class of opts. Storage which does not
+	// support one of the options silently ignores it.
+	WriterWithOptions(ctx context.Context, basename string, opts WriteOptions) (io.WriteCloser, error)
+}
+
+// ResumableUploader is implemented by ExternalStorage which can resume an
+// interrupted upload. See OpenResumableWriter.
+//
+// Wrappers implement ResumableUploader whatever they wrap, so callers detect
+// the support of resumable uploads by the errors.IsUnimplementedError of the
+// error of OpenResumableWriter rather than by a type assertion.
+type ResumableUploader interface {
+	// ResumableWriter is like Writer, but returns the writer of a multipart
+	// upload which can be resumed after it was interrupted, e.g. by the restart
+	// of the node writing it, without uploading its completed parts again. If
+	// token is nil a new upload is started. Otherwise token is a token
+	// returned by ResumeToken for an earlier writer of the same file, and only
+	// the bytes of the file after the offset returned with it are written to
+	// the resumed writer.
+	ResumableWriter(ctx context.Context, basename string, token []byte) (ResumableWriter, error)
+}
+
+// ConditionalWriter is implemented by ExternalStorage which can make a write
+// conditional on the current state of the file, so callers can coordinate
+// concurrent writers. See WriteFileIfNotExists and WriteFileIfMatch.
+//
+// Wrappers implement ConditionalWriter whatever they wrap: the writes of
+// storage which cannot make them conditional fail with an error for which
+// errors.IsUnimplementedError is true.
+type ConditionalWriter interface {
+	// WriteFileIfNotExists atomically writes content to the requested name if
+	// no file with that name exists. It returns created=false, and no error,
+	// if the file already exists, so callers can detect contention. The content
+	// is a ReadSeeker so that implementations can retry the request.
+	WriteFileIfNotExists(ctx context.Context, basename string, content io.ReadSeeker) (created bool, err error)
+
+	// WriteFileIfMatch atomically replaces the content of the requested file
+	// if its current ETag, as returned by Stat or ListDetailed, is
+	// expectedETag. An error marked with ErrPreconditionFailed is returned if
+	// the file was changed since, or no longer exists, so callers can
+	// coordinate concurrent updates of a file by reading it again and
+	// retrying.
+	WriteFileIfMatch(ctx context.Context, basename string, expectedETag string, content io.ReadSeeker) error
+}
+
+// StreamWriter is implemented by ExternalStorage which needs the length of a
+// file up front, such as for a Content-Length header. See WriteStream.
+//
+// Wrappers implement StreamWriter even if the storage they wrap does not, in
+// which case the stream is written with WriteStreamWithWriter.
+type StreamWriter interface {
+	// WriteStream writes the size bytes read from r to the named file. An
+	// error is returned if r does not have exactly size bytes.
+	WriteStream(ctx context.Context, basename string, r io.Reader, size int64) error
+}
+
+// DetailedLister is implemented by ExternalStorage whose listings return the
+// metadata of the listed files, such as object stores. See ListDetailed.
+//
+// Wrappers implement DetailedLister even if the storage they wrap does not, in
+// which case the metadata of each listed file is read with Stat.
+type DetailedLister interface {
+	// ListDetailed is like List, but calls the passed function with the
+	// ObjectInfo of each file, whose Name is the name List returns. Names
+	// grouped by the delimiter are passed with only their Name set. Like for
+	// List, the passed function can stop the iteration with ErrStopListing.
+	ListDetailed(ctx context.Context, prefix, delimiter string, fn ListingDetailedFn) error
+}
+
+// PageLister is implemented by ExternalStorage which can page its listings
+// natively. See ListPage.
+//
+// Wrappers implement PageLister even if the storage they wrap does not, in
+// which case the pages are listed with ListPageFromList.
+type PageLister interface {
+	// ListPage is like List, but returns at most maxResults names at a time so
+	// a listing can be resumed. The listing starts at the beginning if
+	// pageToken is empty, and otherwise after the page which returned
+	// pageToken as its nextPageToken. An empty nextPageToken indicates that
+	// there are no more results. If maxResults is not positive, the
+	// implementation picks the page size. Implementations document the format
+	// of their tokens. Concatenating all the pages yields the same names as
+	// List, though not necessarily in the same order.
+	ListPage(
+		ctx context.Context, prefix, delimiter, pageToken string, maxResults int,
+	) (results []string, nextPageToken string, err error)
+}
+
+// Copier is implemented by ExternalStorage which can copy a file without
+// streaming its contents through this node. See Copy.
+//
+// A successful type assertion does not mean the copy is server-side: wrappers
+// stream the file through this node if the storage they wrap is not a Copier.
+type Copier interface {
+	// Copy copies the contents of srcBasename to dstBasename, replacing
+	// dstBasename if it exists. Copying a file onto itself is an error.
+	//
+	// ErrFileDoesNotExist is raised if `srcBasename` cannot be located in
+	// storage.
+	Copy(ctx context.Context, srcBasename, dstBasename string) error
+}
+
+// Renamer is implemented by ExternalStorage which can rename a file
+// atomically, such as nodelocal, userfile and mem storage. See Rename.
+//
+// A successful type assertion does not mean the rename is atomic: wrappers copy
+// and delete the file if the storage they wrap is not a Renamer.
+type Renamer interface {
+	// Rename renames oldBasename to newBasename, replacing newBasename if it
+	// exists. Renaming a file onto itself is an error.
+	//
+	// ErrFileDoesNotExist is raised if `oldBasename` cannot be located in
+	// storage, including if it disappears during the rename.
+	Rename(ctx context.Context, oldBasename, newBasename string) error
+}
+
+// BatchDeleter is implemented by ExternalStorage which can delete several
+// files with fewer requests than deleting them one at a time. See
+// BatchDelete.
+//
+// Wrappers implement BatchDeleter even if the storage they wrap does not, in
+// which case the files are deleted one at a time.
+type BatchDeleter interface {
+	// BatchDelete removes the named files from the store. It returns a
+	// DeleteResult for each of the basenames, in the same order, so that the
+	// failure to delete some files does not prevent the deletion of the
+	// others. Deleting a file which does not exist is not an error. The
+	// returned error is only set if the batch as a whole failed, in which case
+	// the results are nil.
+	BatchDelete(ctx context.Context, basenames []string) ([]DeleteResult, error)
+}
+
+// Stater is implemented by ExternalStorage which can read the metadata of a
+// file beyond its size. See Stat.
+//
+// Wrappers implement Stater even if the storage they wrap does not, in which
+// case only the size of the file is returned.
+type Stater interface {
+	// Stat returns the metadata of the named file.
+	//
+	// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+	Stat(ctx context.Context, basename string) (ObjectInfo, error)
+}
+
+// ExistenceChecker is implemented by ExternalStorage which can check whether a
+// file exists more cheaply than by reading its metadata. See Exists.
+//
+// Wrappers implement ExistenceChecker even if the storage they wrap does not,
+// in which case the file is checked with ExistsWithStat.
+type ExistenceChecker interface {
+	// Exists returns whether the named file exists. A file which does not
+	// exist is not an error: the error is only set if its existence could not
+	// be determined, such as if the storage denied the request.
+	Exists(ctx context.Context, basename string) (bool, error)
+}
+
+// AccessChecker is implemented by ExternalStorage which checks its access
+// itself, such as to classify the errors of its provider. See CheckAccess.
+//
+// Wrappers implement AccessChecker even if the storage they wrap does not, in
+// which case the access is checked with CheckAccessWithProbe.
+type AccessChecker interface {
+	// CheckAccess verifies that the storage can be written to, read from and
+	// deleted from with its credentials. The returned error is marked with
+	// ErrAccessDenied if the storage rejected the credentials or denied one of
+	// the requests, and with ErrUnreachable if the storage could not be
+	// reached.
+	CheckAccess(ctx context.Context) error
+}
+
+// PresignedURLer is implemented by ExternalStorage which can grant a client
+// temporary access to a file through a presigned URL, so that the contents of
+// the file are not proxied through the cluster. The URL is signed with the
+// credentials of the storage, so it grants whatever access they grant to the
+// file to anyone who holds it.
+//
+// Wrappers implement PresignedURLer whatever they wrap, so callers detect the
+// support of presigned URLs by the errors.IsUnimplementedError of the error of
+// PresignedReadURL or PresignedWriteURL rather than by a type assertion.
+type PresignedURLer interface {
+	// PresignedReadURL returns a URL which can be used to read the named file
+	// with an HTTP GET request until ttl elapses.
+	PresignedReadURL(ctx context.Context, basename string, ttl time.Duration) (string, error)
+
+	// PresignedWriteURL returns a URL which can be used to write the named file
+	// with an HTTP PUT request until ttl elapses.
+	PresignedWriteURL(ctx context.Context, basename string, ttl time.Duration) (string, error)
+}
+
+// RawClient is implemented by ExternalStorage which can return the client of
+// the provider's SDK it uses, for the provider-specific operations which
+// ExternalStorage does not cover, such as tagging S3 objects. Callers
+// type-assert the client to the type of the provider's SDK. The client is
+// best-effort: it is not bound to the prefix of the storage, and operations
+// made with it bypass the retries, timeouts, limits and metrics of the storage
+// returned by MakeExternalStorage.
+//
+// Wrappers implement RawClient whatever they wrap, and their Unwrap returns nil
+// if the storage they wrap does not expose its client, so callers use
+// RawClientOf rather than a type assertion.
+type RawClient interface {
+	// Unwrap returns the client of the provider's SDK, or nil if it can't be
+	// made.
+	Unwrap() any
+}
+
+// SuffixReader is implemented by ExternalStorage which can read the end of a
+// file with a single request, such as a suffix range request, without looking
+// up the size of the file first.
+//
+// Wrappers implement SuffixReader even if the storage they wrap does not, in
+// which case the size of the file is looked up before reading its end, with
+// ReadFileSuffixFromSize.
+type SuffixReader interface {
+	// ReadFileSuffix returns a reader of the last n bytes of the named file, or
+	// of the whole file if it is shorter, and the size of the file.
+	//
+	// ErrFileDoesNotExist is raised if `basename` cannot be located in storage.
+	ReadFileSuffix(ctx context.Context, basename string, n int64) (io.ReadCloser, int64, error)
+}
+
+// Appender is implemented by ExternalStorage which can append to an existing
+// file without rewriting it, such as sinks which write a log of records. S3
+// has no native append, so s3 storage does not implement it.
+//
+// Wrappers implement Appender whatever they wrap: the appends of storage which
+// cannot append fail with an error for which errors.IsUnimplementedError is
+// true.
+type Appender interface {
+	// AppendFile appends content to the named file, creating it if it does not
+	// exist. Whether the content is appended atomically, and how concurrent
+	// appends are ordered, depends on the provider, and is documented by each
+	// implementation. Appending to a file which was not created by AppendFile
+	// may not be supported.
+	AppendFile(ctx context.Context, basename string, content io.Reader) error
+}
+
+// WriteValidator is implemented by the ExternalStorage which can check that a
+// file can be written without writing it. See ValidateWritable.
+//
+// Wrappers implement WriteValidator even if the storage they wrap does not, in
+// which case the file is validated with ValidateWritableWithProbe.
+type WriteValidator interface {
+	// ValidateWritable returns nil if the named file can be written, and an
+	// error marked with ErrAccessDenied if the storage is not allowed to write
+	// it. The file is neither written nor modified.
+	ValidateWritable(ctx context.Context, basename string) error
+}
+
+// Versioner is implemented by ExternalStorage which can read and delete the
+// previous versions of the files of a bucket with versioning enabled, such as
+// to recover a file which was overwritten by mistake. The version IDs are the
+// object version IDs of S3 and the object generations of GCS.
+//
+// Wrappers implement Versioner whatever they wrap: the version operations of
+// storage without versions fail with an error for which
+// errors.IsUnimplementedError is true.
+type Versioner interface {
+	// ReadFileAtVersion returns a reader of the given version of the named
+	// file, starting at offset, and the size of the version.
+	//
+	// ErrFileDoesNotExist is raised if the version cannot be located.
+	ReadFileAtVersion(
+		ctx context.Context, basename, versionID string, offset int64,
+	) (ioctx.ReadCloserCtx, int64, error)
+	// DeleteVersion permanently deletes the given version of the named file.
+	// The other versions of the file, including the current one if it is not
+	// the deleted version, are not affected.
+	DeleteVersion(ctx context.Context, basename, versionID string) error
+}
+
+// Cost is an estimate of the cost of operations on external storage, in the
+// units providers bill them in rather than in dollars, since prices vary by
+// provider, region, storage class and contract.
+type Cost struct {
+	// WriteRequests is the number of requests billed at the rate of writes,
+	// which providers also bill listings at: PUT, POST, COPY and LIST requests
+	// on s3, class A operations on gcs, and write and list operations on azure.
+	WriteRequests int64
+	// ReadRequests is the number of requests billed at the rate of reads: GET
+	// and HEAD requests on s3, class B operations on gcs, and read operations
+	// on azure.
+	ReadRequests int64
+	// TransferBytes is the number of bytes transferred out of the provider,
+	// which are billed as data transfer unless the cluster runs in the same
+	// region.
+	TransferBytes int64
+}
+
+// CostEstimator is implemented by ExternalStorage which can estimate the cost
+// of its operations from the pricing model of its provider, e.g. to estimate
+// the cost of a backup before running it. The estimates are approximate: they
+// assume that operations succeed on their first attempt.
+//
+// Wrappers implement CostEstimator whatever they wrap: the estimates of storage
+// without a pricing model fail with an error for which
+// errors.IsUnimplementedError is true.
+type CostEstimator interface {
+	// EstimateListCost estimates the cost of listing the given number of
+	// files.
+	EstimateListCost(files int64) (Cost, error)
+	// EstimateReadCost estimates the cost of reading a file of the given
+	// size.
+	EstimateReadCost(bytes int64) (Cost, error)
+	// EstimateWriteCost estimates the cost of writing a file of the given
+	// size.
+	EstimateWriteCost(bytes int64) (Cost, error)
 }
 
 // ListingFn describes functions passed to ExternalStorage.ListFiles.
 type ListingFn func(string) error
 
+// ListingDetailedFn describes functions passed to ListDetailed.
+type ListingDetailedFn func(ObjectInfo) error
+
+// TreeEntry is an entry of the tree of files listed by ListTree.
+type TreeEntry struct {
+	// Path is the path of the entry relative to the listed prefix. The paths
+	// of directories end with a slash.
+	Path string
+	// IsDir is set if the entry is a directory, which is the common prefix of
+	// the files below it rather than a file.
+	IsDir bool
+	// Depth is the depth of the entry, starting at 1 for the entries directly
+	// under the listed prefix.
+	Depth int
+}
+
+// ListTreeFn describes functions passed to ListTree.
+type ListTreeFn func(TreeEntry) error
+
 // ExternalStorageFactory describes a factory function for ExternalStorage.
 type ExternalStorageFactory func(ctx context.Context, dest cloudpb.ExternalStorage, opts ...ExternalStorageOption) (ExternalStorage, error)
 
@@ -130,12 +681,43 @@ type SQLConnI interface {
 // This error is raised by the ReadFile method.
 var ErrFileDoesNotExist = errors.New("external_storage: file doesn't exist")
 
+// ErrChecksumMismatch is a sentinel error for indicating that the checksum of
+// the contents of a file differs from the expected checksum. This error is
+// raised when closing the reader returned by ReadFileWithChecksum.
+var ErrChecksumMismatch = errors.New("external_storage: checksum mismatch")
+
+// ErrPreconditionFailed is a sentinel error for indicating that a conditional
+// write was not made because the ETag of the file did not match the expected
+// ETag. This error is raised by the WriteFileIfMatch method.
+var ErrPreconditionFailed = errors.New("external_storage: precondition failed")
+
+// ErrFileLocked is a sentinel error for indicating that a file could not be
+// written because the existing file is locked by a retention period or a
+// legal hold, as set by WriteOptions.RetainUntil and WriteOptions.LegalHold.
+var ErrFileLocked = errors.New("external_storage: file is locked")
+
+// ErrAccessDenied is a sentinel error for indicating that the storage
+// rejected the credentials it was configured with, or that they do not grant
+// the permissions a request needed. This error is raised by the CheckAccess
+// method.
+var ErrAccessDenied = errors.New("external_storage: access denied")
+
+// ErrUnreachable is a sentinel error for indicating that the storage could not
+// be reached over the network. This error is raised by the CheckAccess method.
+var ErrUnreachable = errors.New("external_storage: unreachable")
+
 // ErrListingUnsupported is a marker for indicating listing is unsupported.
 var ErrListingUnsupported = errors.New("listing is not supported")
 
 // ErrListingDone is a marker for indicating listing is done.
 var ErrListingDone = errors.New("listing is done")
 
+// ErrStopListing is a sentinel error returned by the functions passed to List
+// and ListDetailed to stop the iteration early without failing the listing.
+// Unlike other errors, including ErrListingDone, it is not returned by the
+// listing of the storage returned by MakeExternalStorage.
+var ErrStopListing = errors.New("external_storage: stop listing")
+
 // RedactedParams is a helper for making a set of param names to redact in URIs.
 func RedactedParams(strs ...string) map[string]struct{} {
 	if len(strs) == 0 {
@@ -176,6 +758,8 @@ type ExternalStorageContext struct {
 type ExternalStorageOptions struct {
 	ioAccountingInterceptor  ReadWriterInterceptor
 	AzureStorageTestingKnobs base.ModuleTestingKnobs
+	// retryConfig overrides the RetryConfig of the cluster settings.
+	retryConfig *RetryConfig
 }
 
 // ExternalStorageConstructor is a function registered to create instances
@@ -13,9 +13,14 @@ package gcp
 import (
 	"context"
 	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,10 +34,12 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/cockroachdb/errors"
 	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/http2"
 	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/impersonate"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
@@ -66,6 +73,28 @@ var gcsChunkingEnabled = settings.RegisterBoolSetting(
 	true, /* default */
 )
 
+// gcsMultipartPartSize is the size of the chunks of resumable uploads to Google
+// Cloud Storage.
+var gcsMultipartPartSize = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.gs.multipart.part_size",
+	"size of each chunk of a resumable upload to Google Cloud Storage; "+
+		"0 uses cloudstorage.write_chunk.size",
+	0,
+	settings.NonNegativeInt,
+)
+
+// gcsMultipartThreshold is the size above which files are written to Google
+// Cloud Storage with a resumable upload.
+var gcsMultipartThreshold = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.gs.multipart.threshold",
+	"files larger than this size are uploaded to Google Cloud Storage with a resumable upload, "+
+		"and smaller files are buffered in memory and uploaded with a single request",
+	5<<20,
+	settings.NonNegativeInt,
+)
+
 // gcsChunkRetryTimeout is used to configure the per-chunk retry deadline when
 // uploading chunks to Google Cloud Storage.
 var gcsChunkRetryTimeout = settings.RegisterDurationSetting(
@@ -112,6 +141,15 @@ type gcsStorage struct {
 }
 
 var _ cloud.ExternalStorage = &gcsStorage{}
+var _ cloud.ChecksumReader = &gcsStorage{}
+var _ cloud.OptionsWriter = &gcsStorage{}
+var _ cloud.ConditionalWriter = &gcsStorage{}
+var _ cloud.DetailedLister = &gcsStorage{}
+var _ cloud.PageLister = &gcsStorage{}
+var _ cloud.Copier = &gcsStorage{}
+var _ cloud.BatchDeleter = &gcsStorage{}
+var _ cloud.Stater = &gcsStorage{}
+var _ cloud.AccessChecker = &gcsStorage{}
 
 func (g *gcsStorage) Conf() cloudpb.ExternalStorage {
 	return cloudpb.ExternalStorage{
@@ -254,28 +292,333 @@ func createImpersonateCredentials(
 }
 
 func (g *gcsStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return g.WriterWithOptions(ctx, basename, cloud.WriteOptions{})
+}
+
+// WriterWithOptions implements the cloud.OptionsWriter interface. Files up
+// to cloudstorage.gs.multipart.threshold are written with a single request,
+// and larger files with a resumable upload in chunks of
+// cloudstorage.gs.multipart.part_size. The KMS key ID of opts is the Cloud KMS
+// key the object is encrypted with, and its customer-provided key a
+// customer-supplied encryption key.
+//
+// Writes verified with a CRC32C checksum send the checksum of files written
+// with a single request along with it, so that gcs rejects the request if the
+// bytes it received differ. The checksum of a resumable upload is only known
+// once its last chunk is written, after gcs committed the object, so it is
+// compared to the checksum gcs computed and the object is deleted if they
+// differ.
+func (g *gcsStorage) WriterWithOptions(
+	ctx context.Context, basename string, opts cloud.WriteOptions,
+) (io.WriteCloser, error) {
+	if err := cloud.CheckSSEOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := cloud.CheckNoFileLock("gcs", opts); err != nil {
+		return nil, err
+	}
+	if err := cloud.CheckWriteChecksum("gcs", opts, cloud.ChecksumCRC32C); err != nil {
+		return nil, err
+	}
 	_, sp := tracing.ChildSpan(ctx, "gcs.Writer")
 	defer sp.Finish()
 	sp.SetTag("path", attribute.StringValue(path.Join(g.prefix, basename)))
 
-	w := g.bucket.Object(path.Join(g.prefix, basename)).NewWriter(ctx)
-	w.ChunkSize = int(cloud.WriteChunkSize.Get(&g.settings.SV))
+	newWriter := func(ctx context.Context, chunkSize int) *gcs.Writer {
+		w := g.object(basename, opts.SSECustomerKey).NewWriter(ctx)
+		w.ChunkSize = chunkSize
+		w.ChunkRetryDeadline = gcsChunkRetryTimeout.Get(&g.settings.SV)
+		w.ContentType = opts.ContentType
+		w.Metadata = opts.Metadata
+		w.StorageClass = opts.StorageClass
+		w.KMSKeyName = opts.SSEKMSKeyID
+		if opts.ExpireAfter > 0 {
+			w.CustomTime = timeutil.Now().Add(opts.ExpireAfter)
+		}
+		return w
+	}
+	chunkSize := int(gcsPartSize(&g.settings.SV))
 	if !gcsChunkingEnabled.Get(&g.settings.SV) {
-		w.ChunkSize = 0
+		chunkSize = 0
+	}
+	return cloud.ThresholdWriter(ctx, gcsMultipartThreshold.Get(&g.settings.SV),
+		func(ctx context.Context, data []byte) error {
+			// A ChunkSize of 0 uploads the file with a single request.
+			w := newWriter(ctx, 0)
+			if opts.ChecksumAlgo == cloud.ChecksumCRC32C {
+				w.CRC32C = crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+				w.SendCRC32C = true
+			}
+			if _, err := w.Write(data); err != nil {
+				return errors.CombineErrors(err, w.Close())
+			}
+			return w.Close()
+		},
+		func(ctx context.Context, r io.Reader) error {
+			// Cancelling the context is the only way to abort a gcs write, which
+			// abandons the resumable upload.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			w := newWriter(ctx, chunkSize)
+			var h hash.Hash32
+			if opts.ChecksumAlgo == cloud.ChecksumCRC32C {
+				h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+				r = io.TeeReader(r, h)
+			}
+			if _, err := io.Copy(w, r); err != nil {
+				cancel()
+				return errors.CombineErrors(err, w.Close())
+			}
+			if err := w.Close(); err != nil {
+				return err
+			}
+			if h != nil && w.Attrs().CRC32C != h.Sum32() {
+				object := path.Join(g.prefix, basename)
+				err := errors.Wrapf(cloud.ErrChecksumMismatch,
+					"gcs object %q has crc32c checksum %08x, written %08x", object, w.Attrs().CRC32C, h.Sum32())
+				return errors.CombineErrors(err, g.bucket.Object(object).Delete(ctx))
+			}
+			return nil
+		}), nil
+}
+
+// gcsPartSize returns the size of the chunks of resumable uploads.
+func gcsPartSize(sv *settings.Values) int64 {
+	if partSize := gcsMultipartPartSize.Get(sv); partSize != 0 {
+		return partSize
 	}
-	w.ChunkRetryDeadline = gcsChunkRetryTimeout.Get(&g.settings.SV)
-	return w, nil
+	return cloud.WriteChunkSize.Get(sv)
+}
+
+// gcsListPageSize is the number of objects returned by a list request.
+const gcsListPageSize = 1000
+
+var _ cloud.CostEstimator = &gcsStorage{}
+
+// EstimateListCost implements the cloud.CostEstimator interface. Files are
+// listed with a request per page, which are class A operations.
+func (g *gcsStorage) EstimateListCost(files int64) (cloud.Cost, error) {
+	return cloud.Cost{WriteRequests: cloud.Batches(files, gcsListPageSize)}, nil
+}
+
+// EstimateReadCost implements the cloud.CostEstimator interface. A file is
+// read with a class B operation, and its bytes are transferred out of gcs.
+func (g *gcsStorage) EstimateReadCost(bytes int64) (cloud.Cost, error) {
+	return cloud.Cost{ReadRequests: 1, TransferBytes: bytes}, nil
+}
+
+// EstimateWriteCost implements the cloud.CostEstimator interface. Files up to
+// the multipart threshold, or all of them if chunking is disabled, are
+// uploaded with a single request, and larger ones with a resumable upload,
+// which takes a request to start it in addition to one per chunk. Transfers
+// into gcs are free.
+func (g *gcsStorage) EstimateWriteCost(bytes int64) (cloud.Cost, error) {
+	sv := &g.settings.SV
+	if !gcsChunkingEnabled.Get(sv) || bytes <= gcsMultipartThreshold.Get(sv) {
+		return cloud.Cost{WriteRequests: 1}, nil
+	}
+	return cloud.Cost{WriteRequests: 1 + cloud.Batches(bytes, gcsPartSize(sv))}, nil
+}
+
+// WriteFileIfNotExists implements the cloud.ConditionalWriter interface. The
+// object is written with the DoesNotExist precondition, which sends
+// ifGenerationMatch=0.
+func (g *gcsStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.WriteFileIfNotExists")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(g.prefix, basename)))
+
+	// Cancelling the context is the only way to abort a gcs write.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := g.bucket.Object(path.Join(g.prefix, basename)).
+		If(gcs.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if _, err := io.Copy(w, content); err != nil {
+		cancel()
+		return false, errors.CombineErrors(err, w.Close())
+	}
+	if err := w.Close(); err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "unable to write gcs object")
+	}
+	return true, nil
+}
+
+// WriteFileIfMatch implements the cloud.ConditionalWriter interface. GCS
+// preconditions are on the generation of the object rather than its ETag, so
+// the generation of the object is read and checked to have the expected ETag,
+// and the object is written with a GenerationMatch precondition on it, which
+// sends ifGenerationMatch.
+func (g *gcsStorage) WriteFileIfMatch(
+	ctx context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.WriteFileIfMatch")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(g.prefix, basename)))
+
+	object := g.bucket.Object(path.Join(g.prefix, basename))
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return errors.Mark(errors.Wrapf(err, "gcs object %s was not written", basename),
+				cloud.ErrPreconditionFailed)
+		}
+		return errors.Wrap(err, "unable to get gcs object attributes")
+	}
+	if attrs.Etag != expectedETag {
+		return errors.Wrapf(cloud.ErrPreconditionFailed,
+			"gcs object %s has ETag %q, expected %q", basename, attrs.Etag, expectedETag)
+	}
+
+	// Cancelling the context is the only way to abort a gcs write.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := object.If(gcs.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+	if _, err := io.Copy(w, content); err != nil {
+		cancel()
+		return errors.CombineErrors(err, w.Close())
+	}
+	if err := w.Close(); err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			return errors.Mark(errors.Wrapf(err, "gcs object %s was not written", basename),
+				cloud.ErrPreconditionFailed)
+		}
+		return errors.Wrap(err, "unable to write gcs object")
+	}
+	return nil
+}
+
+var _ cloud.Appender = &gcsStorage{}
+
+// AppendFile implements the cloud.Appender interface. GCS objects cannot be
+// modified, so the content is written to a temporary object next to the file,
+// which is composed with the file into a new generation of the file, and then
+// deleted. The compose has a precondition on the generation of the file, so
+// each append is atomic: an append which fails leaves the file as it was, and
+// an append which loses a race with a concurrent append composes the file
+// again with the new generation.
+func (g *gcsStorage) AppendFile(ctx context.Context, basename string, content io.Reader) error {
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.AppendFile")
+	defer sp.Finish()
+	name := path.Join(g.prefix, basename)
+	sp.SetTag("path", attribute.StringValue(name))
+
+	object := g.bucket.Object(name)
+	tmp := g.bucket.Object(name + ".append-" + uuid.MakeV4().String())
+	if err := func() error {
+		// Cancelling the context is the only way to abort a gcs write.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		w := tmp.NewWriter(ctx)
+		if _, err := io.Copy(w, content); err != nil {
+			cancel()
+			return errors.CombineErrors(err, w.Close())
+		}
+		return w.Close()
+	}(); err != nil {
+		return errors.Wrap(err, "unable to write gcs object")
+	}
+
+	err := func() error {
+		for {
+			// The file is created from the temporary object if it does not exist.
+			sources := []*gcs.ObjectHandle{tmp}
+			conds := gcs.Conditions{DoesNotExist: true}
+			attrs, err := object.Attrs(ctx)
+			if err == nil {
+				sources = []*gcs.ObjectHandle{object, tmp}
+				conds = gcs.Conditions{GenerationMatch: attrs.Generation}
+			} else if !errors.Is(err, gcs.ErrObjectNotExist) {
+				return errors.Wrap(err, "unable to get gcs object attributes")
+			}
+			_, err = object.If(conds).ComposerFrom(sources...).Run(ctx)
+			var gerr *googleapi.Error
+			if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+				// A concurrent append changed the file.
+				continue
+			}
+			return errors.Wrapf(err, "unable to append to gcs object %s", basename)
+		}
+	}()
+	return errors.CombineErrors(err, errors.Wrap(tmp.Delete(ctx), "unable to delete gcs object"))
+}
+
+// object returns the handle of the named object, which is encrypted with
+// customerKey if it is set.
+func (g *gcsStorage) object(basename string, customerKey []byte) *gcs.ObjectHandle {
+	o := g.bucket.Object(path.Join(g.prefix, basename))
+	if customerKey != nil {
+		o = o.Key(customerKey)
+	}
+	return o
 }
 
 func (g *gcsStorage) ReadFile(
 	ctx context.Context, basename string, opts cloud.ReadOptions,
 ) (ioctx.ReadCloserCtx, int64, error) {
-	object := path.Join(g.prefix, basename)
-
 	ctx, sp := tracing.ChildSpan(ctx, "gcs.ReadFile")
 	defer sp.Finish()
 	sp.SetTag("path", attribute.StringValue(path.Join(g.prefix, basename)))
 
+	return g.readFile(ctx, basename, -1 /* generation */, opts)
+}
+
+var _ cloud.Versioner = &gcsStorage{}
+
+// ReadFileAtVersion implements the cloud.Versioner interface. The version ID
+// is the generation of the object.
+func (g *gcsStorage) ReadFileAtVersion(
+	ctx context.Context, basename, versionID string, offset int64,
+) (ioctx.ReadCloserCtx, int64, error) {
+	generation, err := parseGeneration(versionID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.ReadFileAtVersion")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(g.prefix, basename)))
+	sp.SetTag("version", attribute.StringValue(versionID))
+
+	return g.readFile(ctx, basename, generation, cloud.ReadOptions{Offset: offset})
+}
+
+// DeleteVersion implements the cloud.Versioner interface. The version ID is
+// the generation of the object.
+func (g *gcsStorage) DeleteVersion(ctx context.Context, basename, versionID string) error {
+	generation, err := parseGeneration(versionID)
+	if err != nil {
+		return err
+	}
+	return timeutil.RunWithTimeout(ctx, "delete gcs file version",
+		cloud.Timeout.Get(&g.settings.SV),
+		func(ctx context.Context) error {
+			return g.bucket.Object(path.Join(g.prefix, basename)).Generation(generation).Delete(ctx)
+		})
+}
+
+// parseGeneration parses a version ID into the generation of an object.
+func parseGeneration(versionID string) (int64, error) {
+	generation, err := strconv.ParseInt(versionID, 10, 64)
+	if err != nil || generation <= 0 {
+		return 0, errors.Newf("invalid gcs object generation %q", versionID)
+	}
+	return generation, nil
+}
+
+// readFile reads the given generation of the object, or its current
+// generation if generation is negative.
+func (g *gcsStorage) readFile(
+	ctx context.Context, basename string, generation int64, opts cloud.ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	object := path.Join(g.prefix, basename)
+
 	endPos := int64(0)
 	if opts.LengthHint != 0 {
 		endPos = opts.Offset + opts.LengthHint
@@ -290,7 +633,11 @@ func (g *gcsStorage) ReadFile(
 					return nil, 0, io.EOF
 				}
 			}
-			r, err := g.bucket.Object(object).NewRangeReader(ctx, pos, length)
+			o := g.object(basename, opts.SSECustomerKey)
+			if generation >= 0 {
+				o = o.Generation(generation)
+			}
+			r, err := o.NewRangeReader(ctx, pos, length)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -322,9 +669,61 @@ func (g *gcsStorage) ReadFile(
 	return r, r.Reader.(*gcs.Reader).Attrs.Size, nil
 }
 
+// ReadFileWithChecksum implements the cloud.ChecksumReader interface. If
+// expected is nil, the CRC32C or MD5 checksum is taken from the attributes of
+// the object. Composite objects only have a CRC32C checksum.
+func (g *gcsStorage) ReadFileWithChecksum(
+	ctx context.Context, basename string, expected []byte, algo cloud.ChecksumAlgo,
+) (io.ReadCloser, error) {
+	if expected == nil {
+		object := path.Join(g.prefix, basename)
+		attrs, err := g.bucket.Object(object).Attrs(ctx)
+		if err != nil {
+			if errors.Is(err, gcs.ErrObjectNotExist) {
+				// nolint:errwrap
+				return nil, errors.Wrapf(
+					errors.Wrapf(cloud.ErrFileDoesNotExist, "gcs object %q does not exist", object),
+					"%v",
+					err.Error(),
+				)
+			}
+			return nil, errors.Wrap(err, "unable to get gcs object attributes")
+		}
+		switch algo {
+		case cloud.ChecksumCRC32C:
+			expected = make([]byte, 4)
+			binary.BigEndian.PutUint32(expected, attrs.CRC32C)
+		case cloud.ChecksumMD5:
+			if len(attrs.MD5) == 0 {
+				return nil, errors.Newf("gcs object %q has no md5 checksum", object)
+			}
+			expected = attrs.MD5
+		default:
+			return nil, errors.Newf("gcs does not store %s checksums, an expected checksum is required", algo)
+		}
+	}
+	return cloud.ReadFileWithChecksumFromReadFile(ctx, g, basename, expected, algo)
+}
+
 func (g *gcsStorage) List(ctx context.Context, prefix, delim string, fn cloud.ListingFn) error {
+	return g.list(ctx, "gcs.List", prefix, delim, func(info cloud.ObjectInfo) error {
+		return fn(info.Name)
+	})
+}
+
+// ListDetailed implements the cloud.DetailedLister interface. The listing
+// returns the same attributes of the objects as Stat.
+func (g *gcsStorage) ListDetailed(
+	ctx context.Context, prefix, delim string, fn cloud.ListingDetailedFn,
+) error {
+	return g.list(ctx, "gcs.ListDetailed", prefix, delim, fn)
+}
+
+func (g *gcsStorage) list(
+	ctx context.Context, opName, prefix, delim string, fn cloud.ListingDetailedFn,
+) error {
 	dest := cloud.JoinPathPreservingTrailingSlash(g.prefix, prefix)
-	ctx, sp := tracing.ChildSpan(ctx, "gcs.List")
+	ctx, sp := tracing.ChildSpan(ctx, opName)
 	defer sp.Finish()
 	sp.SetTag("path", attribute.StringValue(dest))
 
@@ -337,14 +736,73 @@ func (g *gcsStorage) List(ctx context.Context, prefix, delim string, fn cloud.Li
 		if err != nil {
 			return errors.Wrap(err, "unable to list files in gcs bucket")
 		}
+		var info cloud.ObjectInfo
+		if attrs.Name == "" {
+			info.Name = strings.TrimPrefix(attrs.Prefix, dest)
+		} else {
+			info = objectInfo(attrs)
+			info.Name = strings.TrimPrefix(attrs.Name, dest)
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+}
+
+// ListPage implements the cloud.PageLister interface. The page token is
+// the GCS page token.
+func (g *gcsStorage) ListPage(
+	ctx context.Context, prefix, delim, pageToken string, maxResults int,
+) ([]string, string, error) {
+	dest := cloud.JoinPathPreservingTrailingSlash(g.prefix, prefix)
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.ListPage")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(dest))
+
+	if maxResults <= 0 {
+		maxResults = cloud.DefaultListPageSize
+	}
+	it := g.bucket.Objects(ctx, &gcs.Query{Prefix: dest, Delimiter: delim})
+	var page []*gcs.ObjectAttrs
+	nextPageToken, err := iterator.NewPager(it, maxResults, pageToken).NextPage(&page)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unable to list files in gcs bucket")
+	}
+	results := make([]string, 0, len(page))
+	for _, attrs := range page {
 		name := attrs.Name
 		if name == "" {
 			name = attrs.Prefix
 		}
-		if err := fn(strings.TrimPrefix(name, dest)); err != nil {
-			return err
+		results = append(results, strings.TrimPrefix(name, dest))
+	}
+	return results, nextPageToken, nil
+}
+
+// Copy implements the cloud.Copier interface. The object is copied
+// with the rewrite API.
+func (g *gcsStorage) Copy(ctx context.Context, srcBasename, dstBasename string) error {
+	if err := cloud.CheckCopyBasenames(srcBasename, dstBasename); err != nil {
+		return err
+	}
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.Copy")
+	defer sp.Finish()
+	sp.SetTag("path", attribute.StringValue(path.Join(g.prefix, dstBasename)))
+
+	src := g.bucket.Object(path.Join(g.prefix, srcBasename))
+	dst := g.bucket.Object(path.Join(g.prefix, dstBasename))
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			// nolint:errwrap
+			return errors.Wrapf(
+				errors.Wrapf(cloud.ErrFileDoesNotExist, "gcs object %q does not exist", src.ObjectName()),
+				"%v",
+				err.Error(),
+			)
 		}
+		return errors.Wrap(err, "unable to copy gcs object")
 	}
+	return nil
 }
 
 func (g *gcsStorage) Delete(ctx context.Context, basename string) error {
@@ -355,20 +813,132 @@ func (g *gcsStorage) Delete(ctx context.Context, basename string) error {
 		})
 }
 
+// BatchDelete implements the cloud.BatchDeleter interface. The Go client
+// has no batch request, so the objects are deleted concurrently.
+func (g *gcsStorage) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]cloud.DeleteResult, error) {
+	ctx, sp := tracing.ChildSpan(ctx, "gcs.BatchDelete")
+	defer sp.Finish()
+
+	return cloud.BatchDeleteWithDelete(ctx, basenames, cloud.DefaultBatchDeleteConcurrency,
+		func(ctx context.Context, basename string) error {
+			if err := g.Delete(ctx, basename); err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+				return err
+			}
+			return nil
+		})
+}
+
 func (g *gcsStorage) Size(ctx context.Context, basename string) (int64, error) {
-	var r *gcs.Reader
-	if err := timeutil.RunWithTimeout(ctx, "size gcs file",
+	info, err := g.Stat(ctx, basename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Stat implements the cloud.Stater interface. The storage class and
+// generation of the object are returned in ObjectInfo.Extra under
+// "storage-class" and "generation".
+func (g *gcsStorage) Stat(ctx context.Context, basename string) (cloud.ObjectInfo, error) {
+	object := path.Join(g.prefix, basename)
+	var attrs *gcs.ObjectAttrs
+	if err := timeutil.RunWithTimeout(ctx, "stat gcs file",
 		cloud.Timeout.Get(&g.settings.SV),
 		func(ctx context.Context) error {
 			var err error
-			r, err = g.bucket.Object(path.Join(g.prefix, basename)).NewReader(ctx)
+			attrs, err = g.bucket.Object(object).Attrs(ctx)
 			return err
 		}); err != nil {
-		return 0, err
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			// nolint:errwrap
+			return cloud.ObjectInfo{}, errors.Wrapf(
+				errors.Wrapf(cloud.ErrFileDoesNotExist, "gcs object %q does not exist", object),
+				"%v",
+				err.Error(),
+			)
+		}
+		return cloud.ObjectInfo{}, errors.Wrap(err, "unable to get gcs object attributes")
+	}
+	return objectInfo(attrs), nil
+}
+
+// CheckAccess implements the cloud.AccessChecker interface, by writing a
+// probe object to the bucket.
+func (g *gcsStorage) CheckAccess(ctx context.Context) error {
+	return cloud.CheckAccessWithProbe(ctx, g, isGCSAccessDenied)
+}
+
+var _ cloud.WriteValidator = &gcsStorage{}
+
+// ValidateWritable implements the cloud.WriteValidator interface, by writing
+// and deleting an empty probe object next to the object.
+func (g *gcsStorage) ValidateWritable(ctx context.Context, basename string) error {
+	return cloud.ValidateWritableWithProbe(ctx, g, basename, isGCSAccessDenied)
+}
+
+// isGCSAccessDenied returns whether err is an authentication or authorization
+// failure of a gcs request.
+func isGCSAccessDenied(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) &&
+		(gerr.Code == http.StatusUnauthorized || gerr.Code == http.StatusForbidden)
+}
+
+// objectInfo returns the cloud.ObjectInfo of an object with the given
+// attributes.
+func objectInfo(attrs *gcs.ObjectAttrs) cloud.ObjectInfo {
+	info := cloud.ObjectInfo{
+		Size:        attrs.Size,
+		ModTime:     attrs.Updated,
+		ETag:        attrs.Etag,
+		ContentType: attrs.ContentType,
+		Extra: map[string]string{
+			"storage-class": attrs.StorageClass,
+			"generation":    strconv.FormatInt(attrs.Generation, 10),
+		},
+	}
+	if !attrs.CustomTime.IsZero() {
+		info.Extra["custom-time"] = attrs.CustomTime.UTC().Format(time.RFC3339)
+	}
+	for k, v := range attrs.Metadata {
+		info.Extra[cloud.MetadataExtraPrefix+strings.ToLower(k)] = v
+	}
+	return info
+}
+
+var _ cloud.PresignedURLer = &gcsStorage{}
+
+// PresignedReadURL implements the cloud.PresignedURLer interface.
+func (g *gcsStorage) PresignedReadURL(
+	_ context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return g.signedURL(http.MethodGet, basename, ttl)
+}
+
+// PresignedWriteURL implements the cloud.PresignedURLer interface.
+func (g *gcsStorage) PresignedWriteURL(
+	_ context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return g.signedURL(http.MethodPut, basename, ttl)
+}
+
+// signedURL returns a V4 signed URL for the method on the named object. The
+// URL is signed with the private key of the service account credentials of
+// the storage if they have one, and otherwise with the IAM signBlob API, so
+// storage authenticated with a bare access token cannot sign URLs.
+func (g *gcsStorage) signedURL(method, basename string, ttl time.Duration) (string, error) {
+	object := path.Join(g.prefix, basename)
+	signed, err := g.bucket.SignedURL(object, &gcs.SignedURLOptions{
+		Scheme:  gcs.SigningSchemeV4,
+		Method:  method,
+		Expires: timeutil.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to sign gcs URL for %q", object)
 	}
-	sz := r.Attrs.Size
-	_ = r.Close()
-	return sz, nil
+	return signed, nil
 }
 
 func (g *gcsStorage) Close() error {
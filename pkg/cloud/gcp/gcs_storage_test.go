@@ -17,6 +17,8 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -501,3 +503,72 @@ func TestReadFileAtReturnsSize(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, int64(len(data)), rr.Size)
 }
+
+// TestGCSObjectVersions tests that the generations of an object of a bucket
+// with object versioning enabled are read and deleted individually.
+func TestGCSObjectVersions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Invalid generations are rejected before any request is made.
+	g := &gcsStorage{}
+	ctx := context.Background()
+	for _, versionID := range []string{"", "v1", "0", "-1"} {
+		_, _, err := g.ReadFileAtVersion(ctx, "file", versionID, 0)
+		require.ErrorContains(t, err, "invalid gcs object generation")
+		require.ErrorContains(t, g.DeleteVersion(ctx, "file", versionID), "invalid gcs object generation")
+	}
+
+	if !cloudtestutils.IsImplicitAuthConfigured() {
+		skip.IgnoreLint(t, "implicit auth is not configured")
+	}
+	bucket := os.Getenv("GOOGLE_VERSIONED_BUCKET")
+	if bucket == "" {
+		skip.IgnoreLint(t, "GOOGLE_VERSIONED_BUCKET env var must be set")
+	}
+
+	testID := cloudtestutils.NewTestID()
+	gsURI := fmt.Sprintf("gs://%s/%s-%d?AUTH=implicit", bucket, "object-versions", testID)
+	conf, err := cloud.ExternalStorageConfFromURI(gsURI, username.RootUserName())
+	require.NoError(t, err)
+	s, err := makeGCSStorage(ctx, cloud.ExternalStorageContext{
+		Settings:        cluster.MakeTestingClusterSettings(),
+		MetricsRecorder: cloud.NilMetrics,
+	}, conf)
+	require.NoError(t, err)
+	defer s.Close()
+	gs := s.(*gcsStorage)
+
+	const file = "file"
+	var generations []string
+	for _, content := range []string{"old content", "new content"} {
+		require.NoError(t, cloud.WriteFile(ctx, s, file, strings.NewReader(content)))
+		attrs, err := gs.bucket.Object(path.Join(gs.prefix, file)).Attrs(ctx)
+		require.NoError(t, err)
+		generations = append(generations, strconv.FormatInt(attrs.Generation, 10))
+	}
+	defer func() {
+		for _, generation := range generations {
+			_ = s.(cloud.Versioner).DeleteVersion(ctx, file, generation)
+		}
+	}()
+
+	// The previous generation is read rather than the current one.
+	r, size, err := cloud.ReadFileAtVersion(ctx, s, file, generations[0], 4)
+	require.NoError(t, err)
+	read, err := ioctx.ReadAll(ctx, r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx))
+	require.Equal(t, "content", string(read))
+	require.Equal(t, int64(len("old content")), size)
+
+	// Deleting the previous generation leaves the current one.
+	require.NoError(t, cloud.DeleteVersion(ctx, s, file, generations[0]))
+	_, _, err = cloud.ReadFileAtVersion(ctx, s, file, generations[0], 0)
+	require.True(t, errors.Is(err, cloud.ErrFileDoesNotExist), "expected a file does not exist error, got %v", err)
+	r, _, err = s.ReadFile(ctx, file, cloud.ReadOptions{})
+	require.NoError(t, err)
+	read, err = ioctx.ReadAll(ctx, r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx))
+	require.Equal(t, "new content", string(read))
+}
@@ -50,6 +50,11 @@ type httpStorage struct {
 }
 
 var _ cloud.ExternalStorage = &httpStorage{}
+var _ cloud.OptionsWriter = &httpStorage{}
+var _ cloud.StreamWriter = &httpStorage{}
+var _ cloud.DetailedLister = &httpStorage{}
+var _ cloud.PageLister = &httpStorage{}
+var _ cloud.Stater = &httpStorage{}
 
 type retryableHTTPError struct {
 	cause error
@@ -59,6 +64,10 @@ func (e *retryableHTTPError) Error() string {
 	return fmt.Sprintf("retryable http error: %s", e.cause)
 }
 
+func (e *retryableHTTPError) Unwrap() error {
+	return e.cause
+}
+
 // MakeHTTPStorage returns an instance of HTTPStorage ExternalStorage.
 func MakeHTTPStorage(
 	ctx context.Context, args cloud.ExternalStorageContext, dest cloudpb.ExternalStorage,
@@ -109,10 +118,13 @@ func (h *httpStorage) Settings() *cluster.Settings {
 }
 
 func (h *httpStorage) openStreamAt(
-	ctx context.Context, url string, pos int64,
+	ctx context.Context, url string, pos int64, endPos int64,
 ) (*http.Response, error) {
 	var headers map[string]string
-	if pos > 0 {
+	if endPos > 0 {
+		// Range header end position is inclusive.
+		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", pos, endPos-1)}
+	} else if pos > 0 {
 		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-", pos)}
 	}
 
@@ -138,13 +150,18 @@ func (h *httpStorage) openStreamAt(
 func (h *httpStorage) ReadFile(
 	ctx context.Context, basename string, opts cloud.ReadOptions,
 ) (_ ioctx.ReadCloserCtx, fileSize int64, _ error) {
-	stream, err := h.openStreamAt(ctx, basename, opts.Offset)
+	endPos := int64(0)
+	if opts.LengthHint != 0 {
+		endPos = opts.Offset + opts.LengthHint
+	}
+
+	stream, err := h.openStreamAt(ctx, basename, opts.Offset, endPos)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	var size int64
-	if opts.Offset == 0 {
+	if opts.Offset == 0 && endPos == 0 {
 		size = stream.ContentLength
 	} else {
 		size, err = cloud.CheckHTTPContentRangeHeader(stream.Header.Get("Content-Range"), opts.Offset)
@@ -156,7 +173,7 @@ func (h *httpStorage) ReadFile(
 	canResume := stream.Header.Get("Accept-Ranges") == "bytes"
 	if canResume {
 		opener := func(ctx context.Context, pos int64) (io.ReadCloser, int64, error) {
-			s, err := h.openStreamAt(ctx, basename, pos)
+			s, err := h.openStreamAt(ctx, basename, pos, endPos)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -169,16 +186,59 @@ func (h *httpStorage) ReadFile(
 }
 
 func (h *httpStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return h.WriterWithOptions(ctx, basename, cloud.WriteOptions{})
+}
+
+// WriterWithOptions implements the cloud.OptionsWriter interface. The
+// content type is sent as the Content-Type header of the PUT request, and the
+// metadata and storage class are ignored. Files cannot be locked or verified
+// with checksums.
+func (h *httpStorage) WriterWithOptions(
+	ctx context.Context, basename string, opts cloud.WriteOptions,
+) (io.WriteCloser, error) {
+	if err := cloud.CheckNoFileLock("http", opts); err != nil {
+		return nil, err
+	}
+	if err := cloud.CheckWriteChecksum("http", opts); err != nil {
+		return nil, err
+	}
+	var headers map[string]string
+	if opts.ContentType != "" {
+		headers = map[string]string{"Content-Type": opts.ContentType}
+	}
 	return cloud.BackgroundPipe(ctx, func(ctx context.Context, r io.Reader) error {
-		_, err := h.reqNoBody(ctx, "PUT", basename, r)
+		resp, err := h.req(ctx, "PUT", basename, r, headers)
+		if resp != nil {
+			resp.Body.Close()
+		}
 		return err
 	}), nil
 }
 
+// WriteStream implements the cloud.StreamWriter interface. The file is
+// written with a single PUT request with a Content-Length header of size.
+func (h *httpStorage) WriteStream(
+	ctx context.Context, basename string, r io.Reader, size int64,
+) error {
+	resp, err := h.reqWithLength(ctx, "PUT", basename, cloud.NewSizeCheckingReader(r, size), size, nil)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
 func (h *httpStorage) List(_ context.Context, _, _ string, _ cloud.ListingFn) error {
 	return errors.Mark(errors.New("http storage does not support listing"), cloud.ErrListingUnsupported)
 }
 
+func (h *httpStorage) ListDetailed(_ context.Context, _, _ string, _ cloud.ListingDetailedFn) error {
+	return errors.Mark(errors.New("http storage does not support listing"), cloud.ErrListingUnsupported)
+}
+
+func (h *httpStorage) ListPage(_ context.Context, _, _, _ string, _ int) ([]string, string, error) {
+	return nil, "", errors.Mark(errors.New("http storage does not support listing"), cloud.ErrListingUnsupported)
+}
+
 func (h *httpStorage) Delete(ctx context.Context, basename string) error {
 	return timeutil.RunWithTimeout(ctx, fmt.Sprintf("DELETE %s", basename),
 		cloud.Timeout.Get(&h.settings.SV), func(ctx context.Context) error {
@@ -188,6 +248,17 @@ func (h *httpStorage) Delete(ctx context.Context, basename string) error {
 }
 
 func (h *httpStorage) Size(ctx context.Context, basename string) (int64, error) {
+	info, err := h.Stat(ctx, basename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Stat implements the cloud.Stater interface. The metadata is read
+// from the headers of a HEAD request; ModTime is only set if the server
+// returns a Last-Modified header.
+func (h *httpStorage) Stat(ctx context.Context, basename string) (cloud.ObjectInfo, error) {
 	var resp *http.Response
 	if err := timeutil.RunWithTimeout(ctx, fmt.Sprintf("HEAD %s", basename),
 		cloud.Timeout.Get(&h.settings.SV), func(ctx context.Context) error {
@@ -195,12 +266,24 @@ func (h *httpStorage) Size(ctx context.Context, basename string) (int64, error)
 			resp, err = h.reqNoBody(ctx, "HEAD", basename, nil)
 			return err
 		}); err != nil {
-		return 0, err
+		return cloud.ObjectInfo{}, err
 	}
 	if resp.ContentLength < 0 {
-		return 0, errors.Errorf("bad ContentLength: %d", resp.ContentLength)
+		return cloud.ObjectInfo{}, errors.Errorf("bad ContentLength: %d", resp.ContentLength)
 	}
-	return resp.ContentLength, nil
+	info := cloud.ObjectInfo{
+		Size:        resp.ContentLength,
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		modTime, err := http.ParseTime(lastModified)
+		if err != nil {
+			return cloud.ObjectInfo{}, errors.Wrapf(err, "bad Last-Modified: %q", lastModified)
+		}
+		info.ModTime = modTime
+	}
+	return info, nil
 }
 
 func (h *httpStorage) Close() error {
@@ -220,6 +303,19 @@ func (h *httpStorage) reqNoBody(
 
 func (h *httpStorage) req(
 	ctx context.Context, method, file string, body io.Reader, headers map[string]string,
+) (*http.Response, error) {
+	return h.reqWithLength(ctx, method, file, body, 0 /* contentLength */, headers)
+}
+
+// reqWithLength is like req, but the request has a Content-Length header of
+// contentLength if it is positive, rather than being sent in chunks if the
+// length of body is not known.
+func (h *httpStorage) reqWithLength(
+	ctx context.Context,
+	method, file string,
+	body io.Reader,
+	contentLength int64,
+	headers map[string]string,
 ) (*http.Response, error) {
 	dest := *h.base
 	if hosts := len(h.hosts); hosts > 1 {
@@ -240,6 +336,9 @@ func (h *httpStorage) req(
 		return nil, errors.Wrapf(err, "error constructing request %s %q", method, url)
 	}
 	req = req.WithContext(ctx)
+	if contentLength > 0 {
+		req.ContentLength = contentLength
+	}
 
 	for key, val := range headers {
 		req.Header.Add(key, val)
@@ -269,6 +368,9 @@ func (h *httpStorage) req(
 				err.Error(),
 			)
 		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			err = errors.Mark(err, cloud.ErrAccessDenied)
+		}
 		return nil, err
 	}
 	return resp, nil
@@ -40,6 +40,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -493,3 +495,76 @@ func TestReadFileAtReturnsSize(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, int64(len(data)), rr.Size)
 }
+
+func TestHttpCheckAccess(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	testSettings := cluster.MakeTestingClusterSettings()
+
+	// The server stores the files written to it, unless it is read-only, in
+	// which case it rejects writes like a server denying the credentials of the
+	// client.
+	makeStore := func(t *testing.T, readOnly bool) (cloud.ExternalStorage, *httptest.Server) {
+		var mu syncutil.Mutex
+		files := make(map[string][]byte)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch r.Method {
+			case "PUT":
+				if readOnly {
+					http.Error(w, "read-only", http.StatusForbidden)
+					return
+				}
+				data, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				files[r.URL.Path] = data
+				w.WriteHeader(201)
+			case "GET":
+				data, ok := files[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = w.Write(data)
+			case "DELETE":
+				delete(files, r.URL.Path)
+				w.WriteHeader(204)
+			default:
+				http.Error(w, "unsupported method "+r.Method, 400)
+			}
+		}))
+		conf := cloudpb.ExternalStorage{HttpPath: cloudpb.ExternalStorage_Http{BaseUri: srv.URL}}
+		store, err := MakeHTTPStorage(ctx, cloud.ExternalStorageContext{Settings: testSettings}, conf)
+		require.NoError(t, err)
+		return store, srv
+	}
+
+	t.Run("writable", func(t *testing.T) {
+		store, srv := makeStore(t, false /* readOnly */)
+		defer srv.Close()
+		defer store.Close()
+		require.NoError(t, cloud.CheckAccess(ctx, store))
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		store, srv := makeStore(t, true /* readOnly */)
+		defer srv.Close()
+		defer store.Close()
+		err := cloud.CheckAccess(ctx, store)
+		require.True(t, errors.Is(err, cloud.ErrAccessDenied), "expected access denied, got %v", err)
+		require.False(t, errors.Is(err, cloud.ErrUnreachable))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		store, srv := makeStore(t, false /* readOnly */)
+		defer store.Close()
+		srv.Close()
+		err := cloud.CheckAccess(ctx, store)
+		require.True(t, errors.Is(err, cloud.ErrUnreachable), "expected unreachable, got %v", err)
+		require.False(t, errors.Is(err, cloud.ErrAccessDenied))
+	})
+}
@@ -17,6 +17,7 @@ import (
 	"math"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/blobs"
@@ -44,6 +45,10 @@ var confParsers = map[string]ExternalStorageURIParser{}
 // of instances of that external storage.
 var implementations = map[cloudpb.ExternalStorageProvider]ExternalStorageConstructor{}
 
+// schemeFactories maps the URI schemes registered with
+// RegisterExternalStorageScheme to their factories.
+var schemeFactories = map[string]SchemeFactory{}
+
 // rateAndBurstSettings represents a pair of byteSizeSettings used to configure
 // the rate a burst properties of a quotapool.RateLimiter.
 type rateAndBurstSettings struct {
@@ -108,6 +113,9 @@ func RegisterExternalStorageProvider(
 		if _, ok := confParsers[scheme]; ok {
 			panic(fmt.Sprintf("external storage provider already registered for %s", scheme))
 		}
+		if _, ok := schemeFactories[scheme]; ok {
+			panic(fmt.Sprintf("external storage scheme already registered for %s", scheme))
+		}
 		confParsers[scheme] = parseFn
 		for param := range redactedParams {
 			redactedQueryParams[param] = struct{}{}
@@ -126,6 +134,77 @@ func RegisterExternalStorageProvider(
 	}
 }
 
+// SchemeFactory parses the URIs of a scheme registered with
+// RegisterExternalStorageScheme, and constructs the ExternalStorage of the
+// configs it parses.
+type SchemeFactory struct {
+	// ParseURI parses a URI of the scheme into its settings, which are kept in
+	// the Params of the CustomConfig of the ExternalStorage config.
+	ParseURI func(ExternalStorageURIContext, *url.URL) (map[string]string, error)
+	// Construct constructs the ExternalStorage of a config parsed by ParseURI.
+	Construct ExternalStorageConstructor
+	// RedactedParams are the query parameters of the URIs of the scheme which
+	// are redacted when the URIs are displayed.
+	RedactedParams map[string]struct{}
+}
+
+// RegisterExternalStorageScheme registers the factory of an external storage
+// URI scheme, so that storage implemented outside this package can be created
+// from URIs without a provider of its own. The storage of the scheme has the
+// `custom` provider, and shares its limiters. It should be called from an init
+// function, and panics if the scheme is already registered.
+func RegisterExternalStorageScheme(scheme string, factory SchemeFactory) {
+	if factory.ParseURI == nil || factory.Construct == nil {
+		panic(fmt.Sprintf("incomplete external storage factory registered for %s", scheme))
+	}
+	if _, ok := confParsers[scheme]; ok {
+		panic(fmt.Sprintf("external storage provider already registered for %s", scheme))
+	}
+	if _, ok := schemeFactories[scheme]; ok {
+		panic(fmt.Sprintf("external storage scheme already registered for %s", scheme))
+	}
+	schemeFactories[scheme] = factory
+	for param := range factory.RedactedParams {
+		redactedQueryParams[param] = struct{}{}
+	}
+}
+
+// parseCustomURI parses a URI of a scheme registered with
+// RegisterExternalStorageScheme.
+func parseCustomURI(
+	uriCtx ExternalStorageURIContext, uri *url.URL, factory SchemeFactory,
+) (cloudpb.ExternalStorage, error) {
+	params, err := factory.ParseURI(uriCtx, uri)
+	if err != nil {
+		return cloudpb.ExternalStorage{}, err
+	}
+	return cloudpb.ExternalStorage{
+		Provider: cloudpb.ExternalStorageProvider_custom,
+		CustomConfig: cloudpb.ExternalStorage_Custom{
+			Scheme: uri.Scheme,
+			Params: params,
+		},
+		URI: uri.String(),
+	}, nil
+}
+
+// makeCustomStorage constructs the storage of the `custom` provider with the
+// factory registered for the scheme of its config.
+func makeCustomStorage(
+	ctx context.Context, args ExternalStorageContext, dest cloudpb.ExternalStorage,
+) (ExternalStorage, error) {
+	factory, ok := schemeFactories[dest.CustomConfig.Scheme]
+	if !ok {
+		return nil, errors.Errorf("unsupported storage scheme: %q", dest.CustomConfig.Scheme)
+	}
+	return factory.Construct(ctx, args, dest)
+}
+
+func init() {
+	RegisterExternalStorageProvider(cloudpb.ExternalStorageProvider_custom,
+		nil /* parseFn */, makeCustomStorage, nil /* redactedParams */)
+}
+
 // ExternalStorageConfFromURI generates an ExternalStorage config from a URI string.
 func ExternalStorageConfFromURI(
 	path string, user username.SQLUsername,
@@ -137,6 +216,9 @@ func ExternalStorageConfFromURI(
 	if fn, ok := confParsers[uri.Scheme]; ok {
 		return fn(ExternalStorageURIContext{CurrentUser: user}, uri)
 	}
+	if factory, ok := schemeFactories[uri.Scheme]; ok {
+		return parseCustomURI(ExternalStorageURIContext{CurrentUser: user}, uri, factory)
+	}
 	// TODO(adityamaru): Link dedicated ExternalStorage scheme docs once ready.
 	return cloudpb.ExternalStorage{}, errors.Errorf("unsupported storage scheme: %q - refer to docs to find supported"+
 		" storage schemes", uri.Scheme)
@@ -209,11 +291,31 @@ func MakeExternalStorage(
 			return e, nil
 		}
 
+		var retryConfig RetryConfig
+		if options.retryConfig != nil {
+			retryConfig = *options.retryConfig
+		} else if settings != nil {
+			retryConfig = RetryConfigFromSettings(&settings.SV)
+		}
+		var timeouts OpTimeouts
+		var bufferSize int64
+		var sv *settings.Values
+		if settings != nil {
+			timeouts = OpTimeoutsFromSettings(&settings.SV)
+			bufferSize = readBufferSize.Get(&settings.SV)
+			sv = &settings.SV
+		}
+
 		return &esWrapper{
 			ExternalStorage: e,
 			lim:             limiters[dest.Provider],
 			ioRecorder:      options.ioAccountingInterceptor,
-			metricsRecorder: newMetricsReadWriter(cloudMetrics),
+			metricsRecorder: newMetricsReadWriter(cloudMetrics, dest.Provider),
+			retry:           retryConfig,
+			timeouts:        timeouts,
+			readBufferSize:  bufferSize,
+			breaker:         hostCircuitBreaker(dest),
+			sv:              sv,
 		}, nil
 	}
 
@@ -222,10 +324,14 @@ func MakeExternalStorage(
 
 type rwLimiter struct {
 	read, write *quotapool.RateLimiter
+	// ops, if set, limits the number of concurrent operations. It is shared by
+	// the limiters of all the providers of a server.
+	ops *quotapool.IntPool
 }
 
 // Limiters represents a collection of rate limiters for a given server to use
-// when interacting with the providers in the collection.
+// when interacting with the providers in the collection, along with the
+// limiter of the concurrent operations of the server across all providers.
 type Limiters map[cloudpb.ExternalStorageProvider]rwLimiter
 
 func makeLimiter(
@@ -254,9 +360,10 @@ func makeLimiter(
 // once per server at creation.
 func MakeLimiters(ctx context.Context, sv *settings.Values) Limiters {
 	m := make(Limiters, len(limiterSettings))
+	ops := makeOpsLimiter(sv)
 	for k := range limiterSettings {
 		l := limiterSettings[k]
-		m[k] = rwLimiter{read: makeLimiter(ctx, sv, l.read), write: makeLimiter(ctx, sv, l.write)}
+		m[k] = rwLimiter{read: makeLimiter(ctx, sv, l.read), write: makeLimiter(ctx, sv, l.write), ops: ops}
 	}
 	return m
 }
@@ -267,6 +374,35 @@ type esWrapper struct {
 	lim             rwLimiter
 	ioRecorder      ReadWriterInterceptor
 	metricsRecorder ReadWriterInterceptor
+	retry           RetryConfig
+	timeouts        OpTimeouts
+	// readBufferSize is the size of the buffer files are read into, unless
+	// overridden by ReadOptions.BufferSize. Files are not buffered if it is not
+	// positive.
+	readBufferSize int64
+	// breaker is the circuit breaker of the host of the storage, if it is on a
+	// remote host. It is configured by the settings sv.
+	breaker *circuitBreaker
+	sv      *settings.Values
+}
+
+// run runs the named operation with retries, in the span of the tag of ctx, if
+// any. Each attempt holds a slot of the concurrent operations of the node, and
+// is bounded by the timeout of the operation once it has the slot.
+func (e *esWrapper) run(ctx context.Context, opName string, fn func(context.Context) error) error {
+	ctx, sp := startTaggedOp(ctx, opName)
+	defer sp.Finish()
+	timeout := e.timeouts.forOp(opName)
+	return e.withCircuitBreaker(ctx, func() error {
+		return e.retry.run(ctx, opName, func(ctx context.Context) error {
+			slot, err := e.acquireOp(ctx)
+			if err != nil {
+				return err
+			}
+			defer slot.release()
+			return runWithTimeout(ctx, opName, timeout, fn)
+		})
+	})
 }
 
 func (e *esWrapper) wrapReader(ctx context.Context, r ioctx.ReadCloserCtx) ioctx.ReadCloserCtx {
@@ -296,21 +432,572 @@ func (e *esWrapper) wrapWriter(ctx context.Context, w io.WriteCloser) io.WriteCl
 func (e *esWrapper) ReadFile(
 	ctx context.Context, basename string, opts ReadOptions,
 ) (ioctx.ReadCloserCtx, int64, error) {
-	r, s, err := e.ExternalStorage.ReadFile(ctx, basename, opts)
+	bufferSize := e.readBufferSize
+	if opts.BufferSize > 0 {
+		bufferSize = opts.BufferSize
+	}
+	return e.openReader(ctx, bufferSize, func(ctx context.Context) (ioctx.ReadCloserCtx, int64, error) {
+		return e.ExternalStorage.ReadFile(ctx, basename, opts)
+	})
+}
+
+// openReader opens a reader of the wrapped storage with open, with retries.
+// The reader holds a slot of the concurrent operations of the node until it is
+// closed, and its reads are buffered into a buffer of bufferSize, bounded by
+// the read timeout, limited and recorded.
+func (e *esWrapper) openReader(
+	ctx context.Context,
+	bufferSize int64,
+	open func(context.Context) (ioctx.ReadCloserCtx, int64, error),
+) (ioctx.ReadCloserCtx, int64, error) {
+	ctx, sp := startTaggedOp(ctx, "read")
+	defer sp.Finish()
+	// The reader holds a slot of the concurrent operations of the node until
+	// it is closed.
+	slot, err := e.acquireOp(ctx)
 	if err != nil {
-		return r, s, err
+		return nil, 0, err
+	}
+	// The reader reads with the context it is opened with, so the read timeout
+	// covers the whole read, until the reader is closed.
+	readCtx, cancel := withTimeout(ctx, e.timeouts.Read)
+	var r ioctx.ReadCloserCtx
+	var s int64
+	if err := e.withCircuitBreaker(ctx, func() error {
+		return e.retry.run(readCtx, "read", func(ctx context.Context) error {
+			var err error
+			r, s, err = open(ctx)
+			return err
+		})
+	}); err != nil {
+		cancel()
+		slot.release()
+		return nil, 0, markTimeout(ctx, err)
+	}
+	// Readers which resume reads interrupted by a transient error retry as
+	// many times as the other operations.
+	if rr, ok := r.(*ResumingReader); ok && e.retry.MaxAttempts > 0 {
+		rr.MaxAttempts = e.retry.MaxAttempts
+	}
+	r = newBufferedReader(r, bufferSize)
+	if e.timeouts.Read > 0 {
+		r = &timeoutReader{r: r, ctx: ctx, cancel: cancel}
 	}
 
-	return e.wrapReader(ctx, r), s, nil
+	r = e.wrapReader(ctx, r)
+	if slot != nil {
+		r = &releasingReader{r: r, slot: slot}
+	}
+	return r, s, nil
 }
 
+// Writer opens the writer with retries. The writes themselves are not
+// retried, since the written data is not buffered. The span of the tag of ctx,
+// if any, and the write timeout cover the writes, until the writer is closed.
+// The writer holds a slot of the concurrent operations of the node until then.
 func (e *esWrapper) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
-	w, err := e.ExternalStorage.Writer(ctx, basename)
+	w, _, err := e.openWriter(ctx, func(ctx context.Context) (io.WriteCloser, error) {
+		return e.ExternalStorage.Writer(ctx, basename)
+	})
+	return w, err
+}
+
+// openWriter opens a writer, and returns the slot of the concurrent operations
+// of the node it holds, if any, which is released when the writer is closed.
+// Opening the writer may not send any request, so it does not probe the host
+// while the circuit breaker is half-open, but the failures of the open and of
+// the writes are reported to the breaker.
+func (e *esWrapper) openWriter(
+	ctx context.Context, open func(context.Context) (io.WriteCloser, error),
+) (io.WriteCloser, *opSlot, error) {
+	if err := e.checkCircuitBreaker(); err != nil {
+		return nil, nil, err
+	}
+	ctx, sp := startTaggedOp(ctx, "write")
+	slot, err := e.acquireOp(ctx)
+	if err != nil {
+		sp.Finish()
+		return nil, nil, err
+	}
+	writeCtx, cancel := withTimeout(ctx, e.timeouts.Write)
+	var w io.WriteCloser
+	if err := e.retry.run(writeCtx, "write", func(ctx context.Context) error {
+		var err error
+		w, err = open(ctx)
+		return err
+	}); err != nil {
+		cancel()
+		sp.Finish()
+		slot.release()
+		err = markTimeout(ctx, err)
+		e.reportToCircuitBreaker(ctx, err)
+		return nil, nil, err
+	}
+	if e.timeouts.Write > 0 {
+		w = &timeoutWriter{w: w, ctx: ctx, cancel: cancel}
+	}
+	if e.breaker != nil {
+		w = &circuitBreakerWriter{WriteCloser: w, ctx: ctx, e: e}
+	}
+
+	w = finishSpanOnClose(e.wrapWriter(ctx, w), sp)
+	if slot != nil {
+		w = &releasingWriter{WriteCloser: w, slot: slot}
+	}
+	return w, slot, nil
+}
+
+// WriterWithOptions implements the OptionsWriter interface. It is like
+// Writer, but opens the writer with opts.
+func (e *esWrapper) WriterWithOptions(
+	ctx context.Context, basename string, opts WriteOptions,
+) (io.WriteCloser, error) {
+	w, _, err := e.openWriter(ctx, func(ctx context.Context) (io.WriteCloser, error) {
+		return WriterWithOptions(ctx, e.ExternalStorage, basename, opts)
+	})
+	return w, err
+}
+
+// ResumableWriter implements the ResumableUploader interface if the wrapped
+// storage does. It is like Writer, but opens a ResumableWriter.
+func (e *esWrapper) ResumableWriter(
+	ctx context.Context, basename string, token []byte,
+) (ResumableWriter, error) {
+	var rw ResumableWriter
+	w, slot, err := e.openWriter(ctx, func(ctx context.Context) (io.WriteCloser, error) {
+		var err error
+		rw, err = OpenResumableWriter(ctx, e.ExternalStorage, basename, token)
+		if err != nil {
+			return nil, err
+		}
+		return rw, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return &wrappedResumableWriter{WriteCloser: w, rw: rw, slot: slot}, nil
+}
+
+// wrappedResumableWriter is a ResumableWriter whose writes go through the
+// limiter and recorders of the esWrapper.
+type wrappedResumableWriter struct {
+	io.WriteCloser
+	rw ResumableWriter
+	// slot is released when the writer is closed or aborted.
+	slot *opSlot
+}
+
+func (w *wrappedResumableWriter) ResumeToken() ([]byte, int64, error) {
+	return w.rw.ResumeToken()
+}
+
+func (w *wrappedResumableWriter) Abort(ctx context.Context) error {
+	defer w.slot.release()
+	return w.rw.Abort(ctx)
+}
+
+// WriteStream implements the StreamWriter interface. It retries the write if
+// r can seek back to where the write started. Otherwise only a single attempt is made, since the bytes already
+// read from r are lost.
+func (e *esWrapper) WriteStream(
+	ctx context.Context, basename string, r io.Reader, size int64,
+) error {
+	seeker, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	attempted := false
+	return e.run(ctx, "write", func(ctx context.Context) error {
+		if attempted {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return errors.Mark(err, errNotRetryable)
+			}
+		}
+		attempted = true
+		// The bytes read from r are passed to a discarded writer so that they
+		// are limited and recorded like those of Writer.
+		w := e.wrapWriter(ctx, nopWriteCloser{io.Discard})
+		err := WriteStream(ctx, e.ExternalStorage, basename, io.TeeReader(r, w), size)
+		err = errors.CombineErrors(err, w.Close())
+		if err != nil && !seekable {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return err
+	})
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// teeReadSeeker is an io.ReadSeeker which writes the bytes read from it to w,
+// like an io.TeeReader which can seek, so that storage can seek back to retry
+// a request.
+type teeReadSeeker struct {
+	io.ReadSeeker
+	w io.Writer
+}
+
+func (t *teeReadSeeker) Read(p []byte) (int, error) {
+	n, err := t.ReadSeeker.Read(p)
+	if n > 0 {
+		if n, err := t.w.Write(p[:n]); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// List retries the listing as long as no results were passed to fn. A listing
+// stopped by fn returning ErrStopListing succeeds.
+func (e *esWrapper) List(ctx context.Context, prefix, delimiter string, fn ListingFn) error {
+	return e.run(ctx, "list", func(ctx context.Context) error {
+		listed := false
+		err := e.ExternalStorage.List(ctx, prefix, delimiter, func(name string) error {
+			listed = true
+			return fn(name)
+		})
+		if errors.Is(err, ErrStopListing) {
+			return nil
+		}
+		if err != nil && listed {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return err
+	})
+}
+
+// ListDetailed implements the DetailedLister interface. It retries the listing
+// as long as no results were passed to fn. A listing stopped by fn returning
+// ErrStopListing succeeds.
+func (e *esWrapper) ListDetailed(
+	ctx context.Context, prefix, delimiter string, fn ListingDetailedFn,
+) error {
+	return e.run(ctx, "list", func(ctx context.Context) error {
+		listed := false
+		err := ListDetailed(ctx, e.ExternalStorage, prefix, delimiter, func(info ObjectInfo) error {
+			listed = true
+			return fn(info)
+		})
+		if errors.Is(err, ErrStopListing) {
+			return nil
+		}
+		if err != nil && listed {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return err
+	})
+}
+
+// ListPage implements the PageLister interface, with retries.
+func (e *esWrapper) ListPage(
+	ctx context.Context, prefix, delimiter, pageToken string, maxResults int,
+) (results []string, nextPageToken string, err error) {
+	err = e.run(ctx, "list", func(ctx context.Context) error {
+		var err error
+		results, nextPageToken, err = ListPage(ctx, e.ExternalStorage, prefix, delimiter, pageToken, maxResults)
+		return err
+	})
+	return results, nextPageToken, err
+}
+
+func (e *esWrapper) Delete(ctx context.Context, basename string) error {
+	return e.run(ctx, "delete", func(ctx context.Context) error {
+		return e.ExternalStorage.Delete(ctx, basename)
+	})
+}
+
+func (e *esWrapper) Size(ctx context.Context, basename string) (int64, error) {
+	var size int64
+	err := e.run(ctx, "size", func(ctx context.Context) error {
+		var err error
+		size, err = e.ExternalStorage.Size(ctx, basename)
+		return err
+	})
+	return size, err
+}
+
+// PresignedReadURL implements the PresignedURLer interface if the wrapped
+// storage does.
+func (e *esWrapper) PresignedReadURL(
+	ctx context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return PresignedReadURL(ctx, e.ExternalStorage, basename, ttl)
+}
+
+// PresignedWriteURL implements the PresignedURLer interface if the wrapped
+// storage does.
+func (e *esWrapper) PresignedWriteURL(
+	ctx context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return PresignedWriteURL(ctx, e.ExternalStorage, basename, ttl)
+}
+
+// Unwrap implements the RawClient interface if the wrapped storage does.
+func (e *esWrapper) Unwrap() any {
+	client, _ := RawClientOf(e.ExternalStorage)
+	return client
+}
+
+// AppendFile implements the Appender interface if the wrapped storage does.
+// Appends are not idempotent, so they are not retried.
+func (e *esWrapper) AppendFile(ctx context.Context, basename string, content io.Reader) error {
+	return e.run(ctx, "append", func(ctx context.Context) error {
+		// The bytes read from content are passed to a discarded writer so that
+		// they are limited and recorded like those of Writer.
+		w := e.wrapWriter(ctx, nopWriteCloser{io.Discard})
+		err := AppendFile(ctx, e.ExternalStorage, basename, io.TeeReader(content, w))
+		if err = errors.CombineErrors(err, w.Close()); err != nil {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return nil
+	})
+}
+
+// ReadFileAtVersion implements the Versioner interface if the wrapped storage
+// does. The reader is opened and read like those of ReadFile.
+func (e *esWrapper) ReadFileAtVersion(
+	ctx context.Context, basename, versionID string, offset int64,
+) (ioctx.ReadCloserCtx, int64, error) {
+	return e.openReader(ctx, e.readBufferSize, func(ctx context.Context) (ioctx.ReadCloserCtx, int64, error) {
+		return ReadFileAtVersion(ctx, e.ExternalStorage, basename, versionID, offset)
+	})
+}
+
+// DeleteVersion implements the Versioner interface if the wrapped storage
+// does.
+func (e *esWrapper) DeleteVersion(ctx context.Context, basename, versionID string) error {
+	return e.run(ctx, "delete", func(ctx context.Context) error {
+		return DeleteVersion(ctx, e.ExternalStorage, basename, versionID)
+	})
+}
+
+// ValidateWritable implements the WriteValidator interface, by validating the
+// file on the wrapped storage with retries.
+func (e *esWrapper) ValidateWritable(ctx context.Context, basename string) error {
+	return e.run(ctx, "write", func(ctx context.Context) error {
+		return ValidateWritable(ctx, e.ExternalStorage, basename)
+	})
+}
+
+// EstimateListCost implements the CostEstimator interface if the wrapped
+// storage does.
+func (e *esWrapper) EstimateListCost(files int64) (Cost, error) {
+	return EstimateListCost(e.ExternalStorage, files)
+}
+
+// EstimateReadCost implements the CostEstimator interface if the wrapped
+// storage does.
+func (e *esWrapper) EstimateReadCost(bytes int64) (Cost, error) {
+	return EstimateReadCost(e.ExternalStorage, bytes)
+}
+
+// EstimateWriteCost implements the CostEstimator interface if the wrapped
+// storage does.
+func (e *esWrapper) EstimateWriteCost(bytes int64) (Cost, error) {
+	return EstimateWriteCost(e.ExternalStorage, bytes)
+}
 
-	return e.wrapWriter(ctx, w), nil
+// ReadFileSuffix implements the SuffixReader interface. If the wrapped storage
+// does, its reader is opened and read like those of ReadFile. Otherwise the
+// size of the file is looked up with Size, and the suffix read with ReadFile.
+func (e *esWrapper) ReadFileSuffix(
+	ctx context.Context, basename string, n int64,
+) (io.ReadCloser, int64, error) {
+	s, ok := e.ExternalStorage.(SuffixReader)
+	if !ok {
+		return ReadFileSuffixFromSize(ctx, e, basename, n)
+	}
+	return e.openReadCloser(ctx, func(ctx context.Context) (io.ReadCloser, int64, error) {
+		return s.ReadFileSuffix(ctx, basename, n)
+	})
+}
+
+// openReadCloser is like openReader, for the readers of the optional
+// interfaces which return an io.ReadCloser.
+func (e *esWrapper) openReadCloser(
+	ctx context.Context, open func(context.Context) (io.ReadCloser, int64, error),
+) (io.ReadCloser, int64, error) {
+	r, size, err := e.openReader(ctx, e.readBufferSize, func(ctx context.Context) (ioctx.ReadCloserCtx, int64, error) {
+		r, size, err := open(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioctx.ReadCloserAdapter(r), size, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &ctxReadCloser{ctx: ctx, r: r}, size, nil
+}
+
+// Stat implements the Stater interface, with retries.
+func (e *esWrapper) Stat(ctx context.Context, basename string) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := e.run(ctx, "stat", func(ctx context.Context) error {
+		var err error
+		info, err = Stat(ctx, e.ExternalStorage, basename)
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.UncompressedSize = uncompressedSize(info)
+	return info, nil
+}
+
+// Exists implements the ExistenceChecker interface, with retries.
+func (e *esWrapper) Exists(ctx context.Context, basename string) (bool, error) {
+	var exists bool
+	err := e.run(ctx, "exists", func(ctx context.Context) error {
+		var err error
+		exists, err = Exists(ctx, e.ExternalStorage, basename)
+		return err
+	})
+	return exists, err
+}
+
+// ReadFileAtWithLength implements the RangeReader interface. If the wrapped
+// storage does, its reader is opened and read like those of ReadFile.
+// Otherwise the range is read with ReadFile.
+func (e *esWrapper) ReadFileAtWithLength(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	rr, ok := e.ExternalStorage.(RangeReader)
+	if !ok {
+		return ReadFileAtWithLengthFromReadFile(ctx, e, basename, offset, length)
+	}
+	r, _, err := e.openReadCloser(ctx, func(ctx context.Context) (io.ReadCloser, int64, error) {
+		r, err := rr.ReadFileAtWithLength(ctx, basename, offset, length)
+		return r, 0, err
+	})
+	return r, err
+}
+
+// ReadFileWithChecksum implements the ChecksumReader interface. If the wrapped
+// storage does, its reader is opened and read like those of ReadFile.
+// Otherwise the file is read with ReadFile.
+func (e *esWrapper) ReadFileWithChecksum(
+	ctx context.Context, basename string, expected []byte, algo ChecksumAlgo,
+) (io.ReadCloser, error) {
+	cr, ok := e.ExternalStorage.(ChecksumReader)
+	if !ok {
+		return ReadFileWithChecksumFromReadFile(ctx, e, basename, expected, algo)
+	}
+	r, _, err := e.openReadCloser(ctx, func(ctx context.Context) (io.ReadCloser, int64, error) {
+		r, err := cr.ReadFileWithChecksum(ctx, basename, expected, algo)
+		return r, 0, err
+	})
+	return r, err
+}
+
+// WriteFileIfNotExists implements the ConditionalWriter interface if the
+// wrapped storage does. The write is not retried, since an attempt which
+// failed after creating the file would be retried as a lost race.
+func (e *esWrapper) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	var created bool
+	err := e.run(ctx, "write", func(ctx context.Context) error {
+		// The bytes read from content are passed to a discarded writer so that
+		// they are limited and recorded like those of Writer.
+		w := e.wrapWriter(ctx, nopWriteCloser{io.Discard})
+		var err error
+		created, err = WriteFileIfNotExists(ctx, e.ExternalStorage, basename, &teeReadSeeker{ReadSeeker: content, w: w})
+		if err = errors.CombineErrors(err, w.Close()); err != nil {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// WriteFileIfMatch implements the ConditionalWriter interface if the wrapped
+// storage does. The write is not retried, since an attempt which failed after
+// replacing the file would be retried as a lost race.
+func (e *esWrapper) WriteFileIfMatch(
+	ctx context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	return e.run(ctx, "write", func(ctx context.Context) error {
+		// The bytes read from content are limited and recorded like those of
+		// Writer.
+		w := e.wrapWriter(ctx, nopWriteCloser{io.Discard})
+		err := WriteFileIfMatch(ctx, e.ExternalStorage, basename, expectedETag, &teeReadSeeker{ReadSeeker: content, w: w})
+		if err = errors.CombineErrors(err, w.Close()); err != nil {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return nil
+	})
+}
+
+// Copy implements the Copier interface. If the wrapped storage does, its copy
+// is run with retries. Otherwise the file is copied with the reads and writes
+// of the wrapper.
+func (e *esWrapper) Copy(ctx context.Context, srcBasename, dstBasename string) error {
+	c, ok := e.ExternalStorage.(Copier)
+	if !ok {
+		return CopyFromReadFile(ctx, e, srcBasename, dstBasename)
+	}
+	return e.run(ctx, "copy", func(ctx context.Context) error {
+		return c.Copy(ctx, srcBasename, dstBasename)
+	})
+}
+
+// Rename implements the Renamer interface. If the wrapped storage does, its
+// rename is run like the other operations, but is not retried, since an
+// attempt which failed after renaming the file would be retried on a file
+// which no longer exists. Otherwise the file is copied and deleted by the
+// wrapper, whose copy and delete are retried.
+func (e *esWrapper) Rename(ctx context.Context, oldBasename, newBasename string) error {
+	r, ok := e.ExternalStorage.(Renamer)
+	if !ok {
+		return RenameWithCopy(ctx, e, oldBasename, newBasename)
+	}
+	return e.run(ctx, "rename", func(ctx context.Context) error {
+		if err := r.Rename(ctx, oldBasename, newBasename); err != nil {
+			return errors.Mark(err, errNotRetryable)
+		}
+		return nil
+	})
+}
+
+// BatchDelete implements the BatchDeleter interface. If the wrapped storage
+// does, its batch deletion is run with retries. Otherwise the files are
+// deleted one at a time with Delete.
+func (e *esWrapper) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]DeleteResult, error) {
+	d, ok := e.ExternalStorage.(BatchDeleter)
+	if !ok {
+		return BatchDeleteWithDelete(ctx, basenames, 1 /* concurrency */, e.Delete)
+	}
+	var results []DeleteResult
+	err := e.run(ctx, "delete", func(ctx context.Context) error {
+		var err error
+		results, err = d.BatchDelete(ctx, basenames)
+		return err
+	})
+	return results, err
+}
+
+// CheckAccess implements the AccessChecker interface. If the wrapped storage
+// does, its check is run with retries. Otherwise the probe file is written,
+// read and deleted with the wrapper.
+func (e *esWrapper) CheckAccess(ctx context.Context) error {
+	c, ok := e.ExternalStorage.(AccessChecker)
+	if !ok {
+		return CheckAccessWithProbe(ctx, e, nil /* isAccessDenied */)
+	}
+	return e.run(ctx, "check_access", func(ctx context.Context) error {
+		return c.CheckAccess(ctx)
+	})
 }
 
 type limitedReader struct {
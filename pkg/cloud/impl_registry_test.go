@@ -0,0 +1,143 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// namesStorage is an ExternalStorage listing names, which stops listing on
+// the first error of the listing function, like the storage implementations.
+type namesStorage struct {
+	ExternalStorage
+	names []string
+}
+
+func (s *namesStorage) List(_ context.Context, _, _ string, fn ListingFn) error {
+	for _, name := range s.names {
+		if err := fn(name); err != nil {
+			return errors.Wrap(err, "listing")
+		}
+	}
+	return nil
+}
+
+func (s *namesStorage) ListDetailed(_ context.Context, _, _ string, fn ListingDetailedFn) error {
+	return s.List(context.Background(), "", "", func(name string) error {
+		return fn(ObjectInfo{Name: name})
+	})
+}
+
+func TestStopListing(t *testing.T) {
+	ctx := context.Background()
+	es := &esWrapper{ExternalStorage: &namesStorage{names: []string{"a", "b", "c", "d"}}}
+
+	// Stopping the listing once the name looked for is found returns no error,
+	// and the names after it are not listed.
+	var listed []string
+	require.NoError(t, es.List(ctx, "", "", func(name string) error {
+		listed = append(listed, name)
+		if name == "b" {
+			return ErrStopListing
+		}
+		return nil
+	}))
+	require.Equal(t, []string{"a", "b"}, listed)
+
+	var infos []string
+	require.NoError(t, ListDetailed(ctx, es, "", "", func(info ObjectInfo) error {
+		infos = append(infos, info.Name)
+		return ErrStopListing
+	}))
+	require.Equal(t, []string{"a"}, infos)
+
+	// Other errors, including ErrListingDone, are still returned.
+	err := es.List(ctx, "", "", func(string) error { return ErrListingDone })
+	require.ErrorIs(t, err, ErrListingDone)
+	injected := errors.New("injected")
+	err = ListDetailed(ctx, es, "", "", func(ObjectInfo) error { return injected })
+	require.ErrorIs(t, err, injected)
+}
+
+// schemeStorage is the ExternalStorage of a scheme registered by a test.
+type schemeStorage struct {
+	ExternalStorage
+	conf cloudpb.ExternalStorage
+}
+
+func (s *schemeStorage) Conf() cloudpb.ExternalStorage {
+	return s.conf
+}
+
+func (s *schemeStorage) Close() error {
+	return nil
+}
+
+func TestRegisterExternalStorageScheme(t *testing.T) {
+	ctx := context.Background()
+	const scheme = "myscheme"
+	factory := SchemeFactory{
+		ParseURI: func(_ ExternalStorageURIContext, uri *url.URL) (map[string]string, error) {
+			if uri.Host == "" {
+				return nil, errors.New("bucket is required")
+			}
+			return map[string]string{"bucket": uri.Host, "key": uri.Query().Get("MYSCHEME_KEY")}, nil
+		},
+		Construct: func(
+			_ context.Context, _ ExternalStorageContext, dest cloudpb.ExternalStorage,
+		) (ExternalStorage, error) {
+			return &schemeStorage{conf: dest}, nil
+		},
+		RedactedParams: map[string]struct{}{"MYSCHEME_KEY": {}},
+	}
+	RegisterExternalStorageScheme(scheme, factory)
+	defer func() {
+		delete(schemeFactories, scheme)
+		delete(redactedQueryParams, "MYSCHEME_KEY")
+	}()
+
+	// Registering the scheme again panics.
+	require.Panics(t, func() { RegisterExternalStorageScheme(scheme, factory) })
+	require.Panics(t, func() {
+		RegisterExternalStorageProvider(cloudpb.ExternalStorageProvider_mem, nil, nil, nil, scheme)
+	})
+
+	uri := "myscheme://bucket/path?MYSCHEME_KEY=secret"
+	conf, err := ExternalStorageConfFromURI(uri, username.RootUserName())
+	require.NoError(t, err)
+	require.Equal(t, cloudpb.ExternalStorageProvider_custom, conf.Provider)
+	require.Equal(t, cloudpb.ExternalStorage_Custom{
+		Scheme: scheme,
+		Params: map[string]string{"bucket": "bucket", "key": "secret"},
+	}, conf.CustomConfig)
+	sanitized, err := SanitizeExternalStorageURI(uri, nil /* extraParams */)
+	require.NoError(t, err)
+	require.Equal(t, "myscheme://bucket/path?MYSCHEME_KEY=redacted", sanitized)
+
+	s, err := ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, cluster.MakeTestingClusterSettings(),
+		nil /* blobClientFactory */, username.RootUserName(), nil /* db */, nil /* limiters */, MakeMetrics())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	require.Equal(t, conf, s.Conf())
+
+	// Errors parsing the URI are returned.
+	_, err = ExternalStorageConfFromURI("myscheme:///path", username.RootUserName())
+	require.ErrorContains(t, err, "bucket is required")
+}
@@ -0,0 +1,322 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/quotapool"
+	"github.com/cockroachdb/errors"
+)
+
+// limitedStorage is an ExternalStorage which limits the rate of the bytes read
+// from and written to the wrapped ExternalStorage.
+type limitedStorage struct {
+	ExternalStorage
+	lim rwLimiter
+}
+
+var _ ExternalStorage = &limitedStorage{}
+
+// NewLimitedExternalStorage returns an ExternalStorage which limits the bytes
+// read from and written to inner to the given number of bytes per second,
+// with bursts of up to one second of transfer. A limit which is not positive
+// does not limit.
+func NewLimitedExternalStorage(
+	inner ExternalStorage, readBytesPerSec, writeBytesPerSec int64,
+) ExternalStorage {
+	return NewLimitedExternalStorageWithLimiters(inner,
+		newBytesRateLimiter("cloud.limited_storage.read", readBytesPerSec),
+		newBytesRateLimiter("cloud.limited_storage.write", writeBytesPerSec))
+}
+
+// NewLimitedExternalStorageWithLimiters is like NewLimitedExternalStorage, but
+// the rates are limited by the given limiters, which may be shared with other
+// storage. A nil limiter does not limit. The limits can be changed with
+// RateLimiter.UpdateLimit while files are being read or written, for instance
+// when a cluster setting changes.
+func NewLimitedExternalStorageWithLimiters(
+	inner ExternalStorage, read, write *quotapool.RateLimiter,
+) ExternalStorage {
+	return &limitedStorage{
+		ExternalStorage: inner,
+		lim:             rwLimiter{read: read, write: write},
+	}
+}
+
+func newBytesRateLimiter(name string, bytesPerSec int64) *quotapool.RateLimiter {
+	if bytesPerSec <= 0 {
+		return quotapool.NewRateLimiter(name, quotapool.Inf(), math.MaxInt64)
+	}
+	return quotapool.NewRateLimiter(name, quotapool.Limit(bytesPerSec), bytesPerSec)
+}
+
+func (l *limitedStorage) limitReader(r ioctx.ReadCloserCtx) ioctx.ReadCloserCtx {
+	if l.lim.read == nil {
+		return r
+	}
+	return &limitedReader{r: r, lim: l.lim.read}
+}
+
+func (l *limitedStorage) ReadFile(
+	ctx context.Context, basename string, opts ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	r, size, err := l.ExternalStorage.ReadFile(ctx, basename, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return l.limitReader(r), size, nil
+}
+
+// ReadFileAtWithLength implements the RangeReader interface. The reads are
+// limited like those of ReadFile.
+func (l *limitedStorage) ReadFileAtWithLength(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	r, err := ReadFileAtWithLength(ctx, l.ExternalStorage, basename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &ctxReadCloser{ctx: ctx, r: l.limitReader(ioctx.ReadCloserAdapter(r))}, nil
+}
+
+// ReadFileWithChecksum implements the ChecksumReader interface. The reads are
+// limited like those of ReadFile.
+func (l *limitedStorage) ReadFileWithChecksum(
+	ctx context.Context, basename string, expected []byte, algo ChecksumAlgo,
+) (io.ReadCloser, error) {
+	r, err := ReadFileWithChecksum(ctx, l.ExternalStorage, basename, expected, algo)
+	if err != nil {
+		return nil, err
+	}
+	return &ctxReadCloser{ctx: ctx, r: l.limitReader(ioctx.ReadCloserAdapter(r))}, nil
+}
+
+func (l *limitedStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	w, err := l.ExternalStorage.Writer(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	return l.limitWriter(ctx, w), nil
+}
+
+// WriterWithOptions implements the OptionsWriter interface. The writes are
+// limited like those of Writer.
+func (l *limitedStorage) WriterWithOptions(
+	ctx context.Context, basename string, opts WriteOptions,
+) (io.WriteCloser, error) {
+	w, err := WriterWithOptions(ctx, l.ExternalStorage, basename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return l.limitWriter(ctx, w), nil
+}
+
+// WriteStream implements the StreamWriter interface. The bytes read from r
+// are limited like those of Writer.
+func (l *limitedStorage) WriteStream(
+	ctx context.Context, basename string, r io.Reader, size int64,
+) error {
+	if l.lim.write == nil {
+		return WriteStream(ctx, l.ExternalStorage, basename, r, size)
+	}
+	w := l.limitWriter(ctx, nopWriteCloser{io.Discard})
+	err := WriteStream(ctx, l.ExternalStorage, basename, io.TeeReader(r, w), size)
+	return errors.CombineErrors(err, w.Close())
+}
+
+// ResumableWriter implements the ResumableUploader interface if the wrapped
+// storage does. The writes are not limited.
+func (l *limitedStorage) ResumableWriter(
+	ctx context.Context, basename string, token []byte,
+) (ResumableWriter, error) {
+	return OpenResumableWriter(ctx, l.ExternalStorage, basename, token)
+}
+
+// WriteFileIfNotExists implements the ConditionalWriter interface if the
+// wrapped storage does. The written content is not limited.
+func (l *limitedStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	return WriteFileIfNotExists(ctx, l.ExternalStorage, basename, content)
+}
+
+// WriteFileIfMatch implements the ConditionalWriter interface if the wrapped
+// storage does. The written content is not limited.
+func (l *limitedStorage) WriteFileIfMatch(
+	ctx context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	return WriteFileIfMatch(ctx, l.ExternalStorage, basename, expectedETag, content)
+}
+
+// ListDetailed implements the DetailedLister interface.
+func (l *limitedStorage) ListDetailed(
+	ctx context.Context, prefix, delimiter string, fn ListingDetailedFn,
+) error {
+	return ListDetailed(ctx, l.ExternalStorage, prefix, delimiter, fn)
+}
+
+// ListPage implements the PageLister interface.
+func (l *limitedStorage) ListPage(
+	ctx context.Context, prefix, delimiter, pageToken string, maxResults int,
+) ([]string, string, error) {
+	return ListPage(ctx, l.ExternalStorage, prefix, delimiter, pageToken, maxResults)
+}
+
+// Copy implements the Copier interface. Copies are not limited.
+func (l *limitedStorage) Copy(ctx context.Context, srcBasename, dstBasename string) error {
+	return Copy(ctx, l.ExternalStorage, srcBasename, dstBasename)
+}
+
+// Rename implements the Renamer interface.
+func (l *limitedStorage) Rename(ctx context.Context, oldBasename, newBasename string) error {
+	return Rename(ctx, l.ExternalStorage, oldBasename, newBasename)
+}
+
+// BatchDelete implements the BatchDeleter interface.
+func (l *limitedStorage) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]DeleteResult, error) {
+	return BatchDelete(ctx, l.ExternalStorage, basenames)
+}
+
+// Stat implements the Stater interface.
+func (l *limitedStorage) Stat(ctx context.Context, basename string) (ObjectInfo, error) {
+	return Stat(ctx, l.ExternalStorage, basename)
+}
+
+// Exists implements the ExistenceChecker interface.
+func (l *limitedStorage) Exists(ctx context.Context, basename string) (bool, error) {
+	return Exists(ctx, l.ExternalStorage, basename)
+}
+
+// CheckAccess implements the AccessChecker interface.
+func (l *limitedStorage) CheckAccess(ctx context.Context) error {
+	return CheckAccess(ctx, l.ExternalStorage)
+}
+
+func (l *limitedStorage) limitWriter(ctx context.Context, w io.WriteCloser) io.WriteCloser {
+	if l.lim.write == nil {
+		return w
+	}
+	return &limitedWriter{w: w, ctx: ctx, lim: l.lim.write}
+}
+
+// PresignedReadURL implements the PresignedURLer interface if the wrapped
+// storage does. Reads through the URL are not limited.
+func (l *limitedStorage) PresignedReadURL(
+	ctx context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return PresignedReadURL(ctx, l.ExternalStorage, basename, ttl)
+}
+
+// PresignedWriteURL implements the PresignedURLer interface if the wrapped
+// storage does. Writes through the URL are not limited.
+func (l *limitedStorage) PresignedWriteURL(
+	ctx context.Context, basename string, ttl time.Duration,
+) (string, error) {
+	return PresignedWriteURL(ctx, l.ExternalStorage, basename, ttl)
+}
+
+// Unwrap implements the RawClient interface if the wrapped storage does.
+// Operations made with the client are not limited.
+func (l *limitedStorage) Unwrap() any {
+	client, _ := RawClientOf(l.ExternalStorage)
+	return client
+}
+
+// AppendFile implements the Appender interface if the wrapped storage does.
+// The appended bytes are limited like those of WriteStream.
+func (l *limitedStorage) AppendFile(
+	ctx context.Context, basename string, content io.Reader,
+) error {
+	if l.lim.write == nil {
+		return AppendFile(ctx, l.ExternalStorage, basename, content)
+	}
+	w := l.limitWriter(ctx, nopWriteCloser{io.Discard})
+	err := AppendFile(ctx, l.ExternalStorage, basename, io.TeeReader(content, w))
+	return errors.CombineErrors(err, w.Close())
+}
+
+// ReadFileAtVersion implements the Versioner interface if the wrapped storage
+// does. The reads are limited like those of ReadFile.
+func (l *limitedStorage) ReadFileAtVersion(
+	ctx context.Context, basename, versionID string, offset int64,
+) (ioctx.ReadCloserCtx, int64, error) {
+	r, size, err := ReadFileAtVersion(ctx, l.ExternalStorage, basename, versionID, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return l.limitReader(r), size, nil
+}
+
+// DeleteVersion implements the Versioner interface if the wrapped storage
+// does.
+func (l *limitedStorage) DeleteVersion(ctx context.Context, basename, versionID string) error {
+	return DeleteVersion(ctx, l.ExternalStorage, basename, versionID)
+}
+
+// ValidateWritable implements the WriteValidator interface, by validating the
+// file on the wrapped storage.
+func (l *limitedStorage) ValidateWritable(ctx context.Context, basename string) error {
+	return ValidateWritable(ctx, l.ExternalStorage, basename)
+}
+
+// EstimateListCost implements the CostEstimator interface if the wrapped
+// storage does.
+func (l *limitedStorage) EstimateListCost(files int64) (Cost, error) {
+	return EstimateListCost(l.ExternalStorage, files)
+}
+
+// EstimateReadCost implements the CostEstimator interface if the wrapped
+// storage does.
+func (l *limitedStorage) EstimateReadCost(bytes int64) (Cost, error) {
+	return EstimateReadCost(l.ExternalStorage, bytes)
+}
+
+// EstimateWriteCost implements the CostEstimator interface if the wrapped
+// storage does.
+func (l *limitedStorage) EstimateWriteCost(bytes int64) (Cost, error) {
+	return EstimateWriteCost(l.ExternalStorage, bytes)
+}
+
+// ReadFileSuffix implements the SuffixReader interface.
+func (l *limitedStorage) ReadFileSuffix(
+	ctx context.Context, basename string, n int64,
+) (io.ReadCloser, int64, error) {
+	r, size, err := ReadFileSuffix(ctx, l.ExternalStorage, basename, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &ctxReadCloser{ctx: ctx, r: l.limitReader(ioctx.ReadCloserAdapter(r))}, size, nil
+}
+
+// ctxReadCloser adapts an ioctx.ReadCloserCtx to an io.ReadCloser.
+type ctxReadCloser struct {
+	ctx context.Context
+	r   ioctx.ReadCloserCtx
+}
+
+func (r *ctxReadCloser) Read(p []byte) (int, error) {
+	return r.r.Read(r.ctx, p)
+}
+
+func (r *ctxReadCloser) WriteTo(w io.Writer) (int64, error) {
+	return ioctx.WriteTo(r.ctx, r.r, w)
+}
+
+func (r *ctxReadCloser) Close() error {
+	return r.r.Close(r.ctx)
+}
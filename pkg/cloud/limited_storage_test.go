@@ -0,0 +1,59 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/stretchr/testify/require"
+)
+
+// discardStorage is an ExternalStorage whose writers discard their input.
+type discardStorage struct {
+	ExternalStorage
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriter) Close() error                { return nil }
+
+func (discardStorage) Writer(context.Context, string) (io.WriteCloser, error) {
+	return discardWriter{}, nil
+}
+
+func TestLimitedExternalStorage(t *testing.T) {
+	ctx := context.Background()
+
+	const limit = 256 << 10 // bytes per second
+	s := NewLimitedExternalStorage(discardStorage{}, 0 /* readBytesPerSec */, limit)
+
+	// The first second of transfer is allowed as a burst, so only the bytes
+	// written on top of it are limited.
+	const limitedBytes = limit / 2
+	start := timeutil.Now()
+	w, err := s.Writer(ctx, "file")
+	require.NoError(t, err)
+	buf := make([]byte, 16<<10)
+	for written := 0; written < limit+limitedBytes; written += len(buf) {
+		_, err := w.Write(buf)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	elapsed := timeutil.Since(start)
+
+	minElapsed := time.Duration(limitedBytes) * time.Second / limit
+	require.GreaterOrEqual(t, elapsed, minElapsed)
+}
@@ -0,0 +1,462 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package memstorage implements an ExternalStorage which keeps files in the
+// memory of the process, for tests which do not need durable storage.
+package memstorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+const scheme = "mem"
+
+func parseMemURL(_ cloud.ExternalStorageURIContext, uri *url.URL) (cloudpb.ExternalStorage, error) {
+	if uri.Host == "" {
+		return cloudpb.ExternalStorage{}, errors.Errorf(
+			"mem storage requires a bucket name, e.g. %s://bucket/path", scheme)
+	}
+	return cloudpb.ExternalStorage{
+		Provider: cloudpb.ExternalStorageProvider_mem,
+		MemoryConfig: cloudpb.ExternalStorage_MemoryConfig{
+			Bucket: uri.Host,
+			Prefix: uri.Path,
+		},
+	}, nil
+}
+
+// MakeMemoryStorageURI returns a valid mem URI for the given bucket and path.
+func MakeMemoryStorageURI(bucket, path string) string {
+	return fmt.Sprintf("%s://%s/%s", scheme, bucket, strings.TrimPrefix(path, "/"))
+}
+
+// memFile is a file stored in a bucket. The contents of a file are never
+// modified once it is stored, so readers can share them.
+type memFile struct {
+	data     []byte
+	modTime  time.Time
+	etag     string
+	contType string
+	metadata map[string]string
+	// expireAfterDays is the ExpireAfterDaysKey tag of the file, if it was
+	// written with WriteOptions.ExpireAfter.
+	expireAfterDays string
+}
+
+// bucket is a named collection of files, keyed by their path.
+type bucket struct {
+	syncutil.Mutex
+	files map[string]*memFile
+}
+
+// buckets holds the buckets of every mem storage of the process, so that
+// storage opened with the same bucket name share their files, as they would
+// when opened against a real object store.
+var buckets struct {
+	syncutil.Mutex
+	m map[string]*bucket
+	// generation is used to make the ETags of files unique.
+	generation int64
+}
+
+func getBucket(name string) *bucket {
+	buckets.Lock()
+	defer buckets.Unlock()
+	if buckets.m == nil {
+		buckets.m = make(map[string]*bucket)
+	}
+	b, ok := buckets.m[name]
+	if !ok {
+		b = &bucket{files: make(map[string]*memFile)}
+		buckets.m[name] = b
+	}
+	return b
+}
+
+func nextETag() string {
+	buckets.Lock()
+	defer buckets.Unlock()
+	buckets.generation++
+	return strconv.FormatInt(buckets.generation, 10)
+}
+
+// ResetForTesting removes all the buckets and their files.
+func ResetForTesting() {
+	buckets.Lock()
+	defer buckets.Unlock()
+	buckets.m = nil
+}
+
+type memStorage struct {
+	conf     cloudpb.ExternalStorage_MemoryConfig
+	ioConf   base.ExternalIODirConfig
+	settings *cluster.Settings
+	bucket   *bucket
+}
+
+var _ cloud.ExternalStorage = &memStorage{}
+var _ cloud.OptionsWriter = &memStorage{}
+var _ cloud.ConditionalWriter = &memStorage{}
+var _ cloud.DetailedLister = &memStorage{}
+var _ cloud.Copier = &memStorage{}
+var _ cloud.Renamer = &memStorage{}
+var _ cloud.Stater = &memStorage{}
+
+func makeMemStorage(
+	_ context.Context, args cloud.ExternalStorageContext, dest cloudpb.ExternalStorage,
+) (cloud.ExternalStorage, error) {
+	telemetry.Count("external-io.mem")
+	return &memStorage{
+		conf:     dest.MemoryConfig,
+		ioConf:   args.IOConf,
+		settings: args.Settings,
+		bucket:   getBucket(dest.MemoryConfig.Bucket),
+	}, nil
+}
+
+func (m *memStorage) key(basename string) string {
+	return path.Join(m.conf.Prefix, basename)
+}
+
+// get returns the named file, or an error wrapping cloud.ErrFileDoesNotExist.
+func (m *memStorage) get(basename string) (*memFile, error) {
+	key := m.key(basename)
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	f, ok := m.bucket.files[key]
+	if !ok {
+		return nil, errors.Wrapf(cloud.ErrFileDoesNotExist, "mem storage file %q does not exist", key)
+	}
+	return f, nil
+}
+
+func (m *memStorage) put(basename string, f *memFile) {
+	f.modTime = timeutil.Now()
+	f.etag = nextETag()
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	m.bucket.files[m.key(basename)] = f
+}
+
+func (m *memStorage) Close() error {
+	return nil
+}
+
+func (m *memStorage) Conf() cloudpb.ExternalStorage {
+	return cloudpb.ExternalStorage{
+		Provider:     cloudpb.ExternalStorageProvider_mem,
+		MemoryConfig: m.conf,
+	}
+}
+
+func (m *memStorage) ExternalIOConf() base.ExternalIODirConfig {
+	return m.ioConf
+}
+
+func (m *memStorage) RequiresExternalIOAccounting() bool {
+	return false
+}
+
+func (m *memStorage) Settings() *cluster.Settings {
+	return m.settings
+}
+
+func (m *memStorage) ReadFile(
+	_ context.Context, basename string, opts cloud.ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	f, err := m.get(basename)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(len(f.data))
+	if opts.Offset < 0 || opts.Offset > size {
+		return nil, 0, errors.Newf("offset %d is out of range for mem storage file of %d bytes",
+			opts.Offset, size)
+	}
+	return ioctx.ReadCloserAdapter(io.NopCloser(bytes.NewReader(f.data[opts.Offset:]))), size, nil
+}
+
+// memWriter buffers the written file, which is stored when the writer is
+// closed unless the context of the writer was canceled.
+type memWriter struct {
+	ctx      context.Context
+	s        *memStorage
+	basename string
+	opts     cloud.WriteOptions
+	buf      bytes.Buffer
+	closed   bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed mem storage writer")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	f := &memFile{
+		data:     w.buf.Bytes(),
+		contType: w.opts.ContentType,
+		metadata: w.opts.Metadata,
+	}
+	if w.opts.ExpireAfter > 0 {
+		f.expireAfterDays = cloud.ExpireAfterDays(w.opts.ExpireAfter)
+	}
+	w.s.put(w.basename, f)
+	return nil
+}
+
+func (m *memStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return m.WriterWithOptions(ctx, basename, cloud.WriteOptions{})
+}
+
+// WriterWithOptions implements the cloud.OptionsWriter interface. The
+// content type, metadata and expiration tag are stored with the file, and the
+// storage class is ignored. Files cannot be locked or verified with checksums.
+func (m *memStorage) WriterWithOptions(
+	ctx context.Context, basename string, opts cloud.WriteOptions,
+) (io.WriteCloser, error) {
+	if err := cloud.CheckNoFileLock("mem", opts); err != nil {
+		return nil, err
+	}
+	if err := cloud.CheckWriteChecksum("mem", opts); err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(opts.Metadata))
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	opts.Metadata = metadata
+	return &memWriter{ctx: ctx, s: m, basename: basename, opts: opts}, nil
+}
+
+func (m *memStorage) WriteFileIfNotExists(
+	_ context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return false, err
+	}
+	f := &memFile{data: data, modTime: timeutil.Now(), etag: nextETag()}
+	key := m.key(basename)
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	if _, ok := m.bucket.files[key]; ok {
+		return false, nil
+	}
+	m.bucket.files[key] = f
+	return true, nil
+}
+
+var _ cloud.Appender = &memStorage{}
+
+// AppendFile implements the cloud.Appender interface. The file is replaced by
+// a copy with the content appended, so appends are atomic and readers of the
+// previous contents are not affected.
+func (m *memStorage) AppendFile(_ context.Context, basename string, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	etag := nextETag()
+	key := m.key(basename)
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	f := &memFile{data: data, modTime: timeutil.Now(), etag: etag}
+	if prev, ok := m.bucket.files[key]; ok {
+		// The contents of prev may be shared by readers, so they are copied.
+		f.data = append(prev.data[:len(prev.data):len(prev.data)], data...)
+		f.contType, f.metadata, f.expireAfterDays = prev.contType, prev.metadata, prev.expireAfterDays
+	}
+	m.bucket.files[key] = f
+	return nil
+}
+
+// WriteFileIfMatch implements the cloud.ConditionalWriter interface.
+func (m *memStorage) WriteFileIfMatch(
+	_ context.Context, basename string, expectedETag string, content io.ReadSeeker,
+) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	f := &memFile{data: data, modTime: timeutil.Now(), etag: nextETag()}
+	key := m.key(basename)
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	existing, ok := m.bucket.files[key]
+	if !ok {
+		return errors.Wrapf(cloud.ErrPreconditionFailed, "mem storage file %q does not exist", key)
+	}
+	if existing.etag != expectedETag {
+		return errors.Wrapf(cloud.ErrPreconditionFailed,
+			"mem storage file %q has ETag %q, expected %q", key, existing.etag, expectedETag)
+	}
+	m.bucket.files[key] = f
+	return nil
+}
+
+// List implements the cloud.ExternalStorage interface. Like object stores,
+// the listing matches the joined prefixes as strings rather than as paths.
+func (m *memStorage) List(ctx context.Context, prefix, delimiter string, fn cloud.ListingFn) error {
+	return m.ListDetailed(ctx, prefix, delimiter, func(info cloud.ObjectInfo) error {
+		return fn(info.Name)
+	})
+}
+
+// ListDetailed implements the cloud.DetailedLister interface.
+func (m *memStorage) ListDetailed(
+	_ context.Context, prefix, delimiter string, fn cloud.ListingDetailedFn,
+) error {
+	dest := cloud.JoinPathPreservingTrailingSlash(m.conf.Prefix, prefix)
+
+	m.bucket.Lock()
+	files := make(map[string]*memFile)
+	var keys []string
+	for key, f := range m.bucket.files {
+		if strings.HasPrefix(key, dest) {
+			keys = append(keys, key)
+			files[key] = f
+		}
+	}
+	m.bucket.Unlock()
+	sort.Strings(keys)
+
+	var lastGroup string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, dest)
+		if delimiter != "" {
+			if i := strings.Index(name, delimiter); i >= 0 {
+				name = name[:i+len(delimiter)]
+				if name == lastGroup {
+					continue
+				}
+				lastGroup = name
+				if err := fn(cloud.ObjectInfo{Name: name}); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		info := files[key].info()
+		info.Name = name
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) Copy(_ context.Context, srcBasename, dstBasename string) error {
+	if err := cloud.CheckCopyBasenames(srcBasename, dstBasename); err != nil {
+		return err
+	}
+	src, err := m.get(srcBasename)
+	if err != nil {
+		return err
+	}
+	m.put(dstBasename, &memFile{
+		data:            src.data,
+		contType:        src.contType,
+		metadata:        src.metadata,
+		expireAfterDays: src.expireAfterDays,
+	})
+	return nil
+}
+
+// Rename implements the cloud.Renamer interface. The file is moved
+// under the lock of the bucket, so the rename is atomic.
+func (m *memStorage) Rename(_ context.Context, oldBasename, newBasename string) error {
+	if err := cloud.CheckCopyBasenames(oldBasename, newBasename); err != nil {
+		return err
+	}
+	oldKey, newKey := m.key(oldBasename), m.key(newBasename)
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	f, ok := m.bucket.files[oldKey]
+	if !ok {
+		return errors.Wrapf(cloud.ErrFileDoesNotExist, "mem storage file %q does not exist", oldKey)
+	}
+	delete(m.bucket.files, oldKey)
+	m.bucket.files[newKey] = f
+	return nil
+}
+
+func (m *memStorage) Delete(_ context.Context, basename string) error {
+	m.bucket.Lock()
+	defer m.bucket.Unlock()
+	delete(m.bucket.files, m.key(basename))
+	return nil
+}
+
+func (m *memStorage) Size(_ context.Context, basename string) (int64, error) {
+	f, err := m.get(basename)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(f.data)), nil
+}
+
+func (m *memStorage) Stat(_ context.Context, basename string) (cloud.ObjectInfo, error) {
+	f, err := m.get(basename)
+	if err != nil {
+		return cloud.ObjectInfo{}, err
+	}
+	return f.info(), nil
+}
+
+func (f *memFile) info() cloud.ObjectInfo {
+	info := cloud.ObjectInfo{
+		Size:        int64(len(f.data)),
+		ModTime:     f.modTime,
+		ETag:        f.etag,
+		ContentType: f.contType,
+		Extra:       make(map[string]string, len(f.metadata)),
+	}
+	for k, v := range f.metadata {
+		info.Extra[cloud.MetadataExtraPrefix+strings.ToLower(k)] = v
+	}
+	if f.expireAfterDays != "" {
+		info.Extra[cloud.ExpireAfterDaysKey] = f.expireAfterDays
+	}
+	return info
+}
+
+func init() {
+	cloud.RegisterExternalStorageProvider(cloudpb.ExternalStorageProvider_mem,
+		parseMemURL, makeMemStorage, cloud.RedactedParams(), scheme)
+}
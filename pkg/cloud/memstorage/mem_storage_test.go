@@ -0,0 +1,216 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package memstorage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudtestutils"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutMem(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetForTesting()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	user := username.RootUserName()
+	dest := MakeMemoryStorageURI("test-bucket", "backup-test")
+
+	cloudtestutils.CheckExportStore(t, dest, false, user, nil /* db */, testSettings)
+	cloudtestutils.CheckListFiles(t, dest, user, nil /* db */, testSettings)
+}
+
+func TestMemConformance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetForTesting()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	cloudtestutils.RunConformanceSuite(t, func(t *testing.T, basePath string) cloud.ExternalStorage {
+		s, err := cloud.ExternalStorageFromURI(context.Background(),
+			MakeMemoryStorageURI("conformance", basePath), base.ExternalIODirConfig{}, testSettings,
+			nil, /* blobClientFactory */
+			username.RootUserName(),
+			nil, /* db */
+			nil, /* limiters */
+			cloud.NilMetrics,
+		)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestMemSharedBucket(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetForTesting()
+
+	ctx := context.Background()
+	testSettings := cluster.MakeTestingClusterSettings()
+	open := func(uri string) cloud.ExternalStorage {
+		s, err := cloud.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			nil, /* blobClientFactory */
+			username.RootUserName(),
+			nil, /* db */
+			nil, /* limiters */
+			cloud.NilMetrics,
+		)
+		require.NoError(t, err)
+		return s
+	}
+
+	// Storage opened with the same bucket shares its files, and storage of
+	// other buckets does not.
+	writer := open(MakeMemoryStorageURI("shared", "dir"))
+	defer writer.Close()
+	require.NoError(t, cloud.WriteFile(ctx, writer, "file", bytes.NewReader([]byte("contents"))))
+
+	reader := open(MakeMemoryStorageURI("shared", "dir/file"))
+	defer reader.Close()
+	r, _, err := reader.ReadFile(ctx, "", cloud.ReadOptions{})
+	require.NoError(t, err)
+	content, err := ioctx.ReadAll(ctx, r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx))
+	require.Equal(t, "contents", string(content))
+
+	other := open(MakeMemoryStorageURI("other", "dir"))
+	defer other.Close()
+	_, err = other.Size(ctx, "file")
+	require.ErrorIs(t, err, cloud.ErrFileDoesNotExist)
+}
+
+func TestMemUploadDir(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetForTesting()
+
+	ctx := context.Background()
+	s, err := cloud.ExternalStorageFromURI(ctx, MakeMemoryStorageURI("upload", "dir"),
+		base.ExternalIODirConfig{}, cluster.MakeTestingClusterSettings(),
+		nil, /* blobClientFactory */
+		username.RootUserName(),
+		nil, /* db */
+		nil, /* limiters */
+		cloud.NilMetrics,
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	root := t.TempDir()
+	files := map[string]string{
+		"top":        "top contents",
+		"a/one":      "one contents",
+		"a/two":      "two contents",
+		"a/b/c/deep": "deep contents",
+		"a/b/empty":  "",
+	}
+	for name, content := range files {
+		localPath := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(localPath), 0755))
+		require.NoError(t, os.WriteFile(localPath, []byte(content), 0644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "empty"), 0755))
+
+	require.NoError(t, cloud.UploadDir(ctx, s, root, "scratch", 3 /* concurrency */))
+
+	var listed []string
+	require.NoError(t, s.List(ctx, "scratch/", "", func(name string) error {
+		listed = append(listed, name)
+		return nil
+	}))
+	var expected []string
+	for name, content := range files {
+		expected = append(expected, name)
+		r, _, err := s.ReadFile(ctx, "scratch/"+name, cloud.ReadOptions{})
+		require.NoError(t, err)
+		got, err := ioctx.ReadAll(ctx, r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close(ctx))
+		require.Equal(t, content, string(got))
+	}
+	require.ElementsMatch(t, expected, listed)
+
+	// A directory which can't be walked fails the upload.
+	require.Error(t, cloud.UploadDir(ctx, s, filepath.Join(root, "missing"), "scratch", 3))
+}
+
+func TestMemDiffPrefixes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetForTesting()
+
+	ctx := context.Background()
+	testSettings := cluster.MakeTestingClusterSettings()
+	open := func(uri string) cloud.ExternalStorage {
+		s, err := cloud.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			nil, /* blobClientFactory */
+			username.RootUserName(),
+			nil, /* db */
+			nil, /* limiters */
+			cloud.NilMetrics,
+		)
+		require.NoError(t, err)
+		return s
+	}
+	src := open(MakeMemoryStorageURI("src", ""))
+	defer src.Close()
+	dst := open(MakeMemoryStorageURI("dst", ""))
+	defer dst.Close()
+	write := func(es cloud.ExternalStorage, name, content string) {
+		require.NoError(t, cloud.WriteFile(ctx, es, name, bytes.NewReader([]byte(content))))
+	}
+
+	// The files of src are synced to dst, which also has files src no longer
+	// has, before some of the files of src change.
+	for _, name := range []string{"a/same", "a/resized", "b/touched", "b/same"} {
+		write(src, "backups/"+name, "contents")
+	}
+	for _, name := range []string{"a/same", "a/resized", "b/touched", "b/same", "a/deleted", "c/deleted"} {
+		write(dst, "mirror/"+name, "contents")
+	}
+	write(src, "backups/a/new", "new contents")
+	write(src, "backups/a/resized", "longer contents")
+	write(src, "backups/b/touched", "CONTENTS")
+	write(src, "backups/d/new", "new contents")
+	// Files outside of the prefixes are not compared.
+	write(src, "other/file", "contents")
+	write(dst, "other/file", "contents")
+
+	added, changed, removed, err := cloud.DiffPrefixes(ctx, src, dst, "backups/", "mirror/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/new", "d/new"}, added)
+	require.Equal(t, []string{"a/resized", "b/touched"}, changed)
+	require.Equal(t, []string{"a/deleted", "c/deleted"}, removed)
+
+	// Once dst is synced, the prefixes no longer differ.
+	for _, name := range append(added, changed...) {
+		r, _, err := src.ReadFile(ctx, "backups/"+name, cloud.ReadOptions{NoFileSize: true})
+		require.NoError(t, err)
+		require.NoError(t, cloud.WriteFile(ctx, dst, "mirror/"+name, ioctx.ReaderCtxAdapter(ctx, r)))
+		require.NoError(t, r.Close(ctx))
+	}
+	for _, name := range removed {
+		require.NoError(t, dst.Delete(ctx, "mirror/"+name))
+	}
+	added, changed, removed, err = cloud.DiffPrefixes(ctx, src, dst, "backups/", "mirror/")
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, changed)
+	require.Empty(t, removed)
+}
@@ -14,8 +14,10 @@ import (
 	"context"
 	"io"
 
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/metric/aggmetric"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 )
 
@@ -25,10 +27,15 @@ var NilMetrics = (*Metrics)(nil)
 // Metrics encapsulates the metrics tracking interactions with cloud storage
 // providers.
 type Metrics struct {
-	// ReadBytes counts the bytes read from cloud storage.
-	ReadBytes *metric.Counter
-	// WriteBytes counts the bytes written to cloud storage.
-	WriteBytes *metric.Counter
+	// ReadBytes counts the bytes read from cloud storage, with a child per
+	// provider.
+	ReadBytes *aggmetric.AggCounter
+	// WriteBytes counts the bytes written to cloud storage, with a child per
+	// provider.
+	WriteBytes *aggmetric.AggCounter
+
+	providerReadBytes  map[cloudpb.ExternalStorageProvider]*aggmetric.Counter
+	providerWriteBytes map[cloudpb.ExternalStorageProvider]*aggmetric.Counter
 }
 
 // MakeMetrics returns a new instance of Metrics.
@@ -47,10 +54,18 @@ func MakeMetrics() metric.Struct {
 		Unit:        metric.Unit_BYTES,
 		MetricType:  io_prometheus_client.MetricType_COUNTER,
 	}
-	return &Metrics{
-		ReadBytes:  metric.NewCounter(cloudReadBytes),
-		WriteBytes: metric.NewCounter(cloudWriteBytes),
+	m := &Metrics{
+		ReadBytes:          aggmetric.NewCounter(cloudReadBytes, "provider"),
+		WriteBytes:         aggmetric.NewCounter(cloudWriteBytes, "provider"),
+		providerReadBytes:  make(map[cloudpb.ExternalStorageProvider]*aggmetric.Counter),
+		providerWriteBytes: make(map[cloudpb.ExternalStorageProvider]*aggmetric.Counter),
+	}
+	for p := range cloudpb.ExternalStorageProvider_name {
+		provider := cloudpb.ExternalStorageProvider(p)
+		m.providerReadBytes[provider] = m.ReadBytes.AddChild(provider.String())
+		m.providerWriteBytes[provider] = m.WriteBytes.AddChild(provider.String())
 	}
+	return m
 }
 
 var _ metric.Struct = (*Metrics)(nil)
@@ -61,10 +76,10 @@ func (m *Metrics) MetricStruct() {}
 // MetricsRecorder is the interface that describes the methods that can be used
 // to mutate the metrics corresponding to cloud operations.
 type MetricsRecorder interface {
-	// RecordReadBytes records the bytes read.
-	RecordReadBytes(int64)
-	// RecordWriteBytes records the bytes written.
-	RecordWriteBytes(int64)
+	// RecordReadBytes records the bytes read from the provider.
+	RecordReadBytes(cloudpb.ExternalStorageProvider, int64)
+	// RecordWriteBytes records the bytes written to the provider.
+	RecordWriteBytes(cloudpb.ExternalStorageProvider, int64)
 	// Metrics returns the underlying Metrics struct.
 	Metrics() *Metrics
 }
@@ -72,19 +87,19 @@ type MetricsRecorder interface {
 var _ MetricsRecorder = &Metrics{}
 
 // RecordReadBytes implements the MetricsRecorder interface.
-func (m *Metrics) RecordReadBytes(bytes int64) {
+func (m *Metrics) RecordReadBytes(provider cloudpb.ExternalStorageProvider, bytes int64) {
 	if m == nil {
 		return
 	}
-	m.ReadBytes.Inc(bytes)
+	m.providerReadBytes[provider].Inc(bytes)
 }
 
 // RecordWriteBytes implements the MetricsRecorder interface.
-func (m *Metrics) RecordWriteBytes(bytes int64) {
+func (m *Metrics) RecordWriteBytes(provider cloudpb.ExternalStorageProvider, bytes int64) {
 	if m == nil {
 		return
 	}
-	m.WriteBytes.Inc(bytes)
+	m.providerWriteBytes[provider].Inc(bytes)
 }
 
 // Metrics implements the MetricsRecorder interface.
@@ -94,10 +109,16 @@ func (m *Metrics) Metrics() *Metrics {
 
 type metricsReadWriter struct {
 	metricsRecorder MetricsRecorder
+	provider        cloudpb.ExternalStorageProvider
 }
 
-func newMetricsReadWriter(m MetricsRecorder) ReadWriterInterceptor {
-	return &metricsReadWriter{metricsRecorder: m}
+// newMetricsReadWriter returns a ReadWriterInterceptor recording the bytes read
+// and written by the readers and writers of the provider, as they are
+// transferred, so the bytes of partial transfers are also recorded.
+func newMetricsReadWriter(
+	m MetricsRecorder, provider cloudpb.ExternalStorageProvider,
+) ReadWriterInterceptor {
+	return &metricsReadWriter{metricsRecorder: m, provider: provider}
 }
 
 // Reader implements the ReadWriterInterceptor interface.
@@ -107,6 +128,7 @@ func (m *metricsReadWriter) Reader(
 	return &metricsReader{
 		inner:           r,
 		metricsRecorder: m.metricsRecorder,
+		provider:        m.provider,
 	}
 }
 
@@ -117,6 +139,7 @@ func (m *metricsReadWriter) Writer(
 	return &metricsWriter{
 		w:               w,
 		metricsRecorder: m.metricsRecorder,
+		provider:        m.provider,
 	}
 }
 
@@ -125,12 +148,21 @@ var _ ReadWriterInterceptor = &metricsReadWriter{}
 type metricsReader struct {
 	inner           ioctx.ReadCloserCtx
 	metricsRecorder MetricsRecorder
+	provider        cloudpb.ExternalStorageProvider
 }
 
 // Read implements the ioctx.ReadCloserCtx interface.
 func (mr *metricsReader) Read(ctx context.Context, p []byte) (int, error) {
 	n, err := mr.inner.Read(ctx, p)
-	mr.metricsRecorder.RecordReadBytes(int64(n))
+	mr.metricsRecorder.RecordReadBytes(mr.provider, int64(n))
+	return n, err
+}
+
+// WriteTo implements the ioctx.WriterToCtx interface. The bytes read are
+// recorded once they are all written.
+func (mr *metricsReader) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	n, err := ioctx.WriteTo(ctx, mr.inner, w)
+	mr.metricsRecorder.RecordReadBytes(mr.provider, n)
 	return n, err
 }
 
@@ -142,12 +174,21 @@ func (mr *metricsReader) Close(ctx context.Context) error {
 type metricsWriter struct {
 	w               io.WriteCloser
 	metricsRecorder MetricsRecorder
+	provider        cloudpb.ExternalStorageProvider
 }
 
 // Write implements the WriteCloser interface.
 func (mw *metricsWriter) Write(p []byte) (int, error) {
 	n, err := mw.w.Write(p)
-	mw.metricsRecorder.RecordWriteBytes(int64(n))
+	mw.metricsRecorder.RecordWriteBytes(mw.provider, int64(n))
+	return n, err
+}
+
+// ReadFrom implements the io.ReaderFrom interface. The bytes written are
+// recorded once they are all read.
+func (mw *metricsWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := readFrom(mw.w, src)
+	mw.metricsRecorder.RecordWriteBytes(mw.provider, n)
 	return n, err
 }
 
@@ -157,3 +198,4 @@ func (mw *metricsWriter) Close() error {
 }
 
 var _ io.WriteCloser = &metricsWriter{}
+var _ io.ReaderFrom = &metricsWriter{}
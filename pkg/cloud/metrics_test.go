@@ -0,0 +1,99 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// conditionalStorage is a countingStorage which implements the
+// ConditionalWriter interface.
+type conditionalStorage struct {
+	*countingStorage
+}
+
+func (s conditionalStorage) WriteFileIfNotExists(
+	_ context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	if _, ok := s.files[basename]; ok {
+		return false, nil
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return false, err
+	}
+	s.files[basename] = data
+	return true, nil
+}
+
+func (s conditionalStorage) WriteFileIfMatch(
+	ctx context.Context, basename string, _ string, content io.ReadSeeker,
+) error {
+	_, err := s.WriteFileIfNotExists(ctx, basename, content)
+	return err
+}
+
+func TestMetricsReadBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	metrics := MakeMetrics().(*Metrics)
+	es := &esWrapper{
+		ExternalStorage: &countingStorage{files: map[string][]byte{"file": data}},
+		metricsRecorder: newMetricsReadWriter(metrics, cloudpb.ExternalStorageProvider_s3),
+	}
+
+	r, _, err := es.ReadFile(ctx, "file", ReadOptions{})
+	require.NoError(t, err)
+	read, err := ioctx.ReadAll(ctx, r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx))
+	require.Equal(t, data, read)
+
+	require.Equal(t, int64(len(data)), metrics.providerReadBytes[cloudpb.ExternalStorageProvider_s3].Value())
+	require.Equal(t, int64(len(data)), metrics.ReadBytes.Count())
+	require.Zero(t, metrics.providerReadBytes[cloudpb.ExternalStorageProvider_gs].Value())
+	require.Zero(t, metrics.WriteBytes.Count())
+
+	// The bytes of a partial read are also counted.
+	r, _, err = es.ReadFile(ctx, "file", ReadOptions{})
+	require.NoError(t, err)
+	_, err = io.ReadFull(ioctx.ReaderCtxAdapter(ctx, r), make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx))
+	require.Equal(t, int64(len(data)+10), metrics.ReadBytes.Count())
+
+	// The bytes of the range reads and conditional writes the storage
+	// implements natively are counted too.
+	es.ExternalStorage = conditionalStorage{&countingStorage{files: map[string][]byte{"file": data}}}
+	rc, err := es.ReadFileAtWithLength(ctx, "file", 10 /* offset */, 20 /* length */)
+	require.NoError(t, err)
+	read, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, data[10:30], read)
+	require.Equal(t, int64(len(data)+30), metrics.providerReadBytes[cloudpb.ExternalStorageProvider_s3].Value())
+
+	created, err := es.WriteFileIfNotExists(ctx, "new", bytes.NewReader(data))
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, int64(len(data)), metrics.providerWriteBytes[cloudpb.ExternalStorageProvider_s3].Value())
+	require.Equal(t, int64(len(data)), metrics.WriteBytes.Count())
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/errors/oserror"
 	"google.golang.org/grpc/codes"
@@ -95,6 +96,11 @@ type localFileStorage struct {
 }
 
 var _ cloud.ExternalStorage = &localFileStorage{}
+var _ cloud.ConditionalWriter = &localFileStorage{}
+var _ cloud.Renamer = &localFileStorage{}
+var _ cloud.BatchDeleter = &localFileStorage{}
+var _ cloud.Stater = &localFileStorage{}
+var _ cloud.AccessChecker = &localFileStorage{}
 
 // LocalRequiresExternalIOAccounting is the return values for
 // (*localFileStorage).RequiresExternalIOAccounting. This is exposed for
@@ -145,6 +151,24 @@ func (l *localFileStorage) Settings() *cluster.Settings {
 	return l.settings
 }
 
+var _ cloud.CostEstimator = &localFileStorage{}
+
+// EstimateListCost implements the cloud.CostEstimator interface. Local files
+// cost nothing to list, read or write.
+func (l *localFileStorage) EstimateListCost(int64) (cloud.Cost, error) {
+	return cloud.Cost{}, nil
+}
+
+// EstimateReadCost implements the cloud.CostEstimator interface.
+func (l *localFileStorage) EstimateReadCost(int64) (cloud.Cost, error) {
+	return cloud.Cost{}, nil
+}
+
+// EstimateWriteCost implements the cloud.CostEstimator interface.
+func (l *localFileStorage) EstimateWriteCost(int64) (cloud.Cost, error) {
+	return cloud.Cost{}, nil
+}
+
 func joinRelativePath(filePath string, file string) string {
 	// Joining "." to make this a relative path.
 	// This ensures path.Clean does not simplify in unexpected ways.
@@ -155,6 +179,37 @@ func (l *localFileStorage) Writer(ctx context.Context, basename string) (io.Writ
 	return l.blobClient.Writer(ctx, joinRelativePath(l.base, basename))
 }
 
+// WriteFileIfNotExists implements the cloud.ConditionalWriter interface. The
+// file is created with O_EXCL, which is only supported when the file is on
+// this node.
+func (l *localFileStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) (bool, error) {
+	return l.blobClient.WriteFileIfNotExists(ctx, joinRelativePath(l.base, basename), content)
+}
+
+var _ cloud.Appender = &localFileStorage{}
+
+// AppendFile implements the cloud.Appender interface. The file is opened with
+// O_APPEND, which is only supported when the file is on this node. Every write
+// lands at the end of the file, but the content of concurrent appends may be
+// interleaved, and an append which fails may leave part of its content in the
+// file.
+func (l *localFileStorage) AppendFile(
+	ctx context.Context, basename string, content io.Reader,
+) error {
+	return l.blobClient.AppendFile(ctx, joinRelativePath(l.base, basename), content)
+}
+
+// WriteFileIfMatch implements the cloud.ConditionalWriter interface. Local
+// files have no ETag, so conditional writes are not supported.
+func (l *localFileStorage) WriteFileIfMatch(
+	_ context.Context, _ string, _ string, _ io.ReadSeeker,
+) error {
+	return errors.UnimplementedError(errors.IssueLink{},
+		"nodelocal storage does not support conditional writes")
+}
+
 func (l *localFileStorage) ReadFile(
 	ctx context.Context, basename string, opts cloud.ReadOptions,
 ) (ioctx.ReadCloserCtx, int64, error) {
@@ -208,16 +263,93 @@ func (l *localFileStorage) List(
 	return nil
 }
 
+// Rename implements the cloud.Renamer interface. The file is renamed
+// in the filesystem of the node, through the blob service if it is on another
+// node, so it is atomic.
+func (l *localFileStorage) Rename(ctx context.Context, oldBasename, newBasename string) error {
+	if err := cloud.CheckCopyBasenames(oldBasename, newBasename); err != nil {
+		return err
+	}
+	err := l.blobClient.Rename(ctx, joinRelativePath(l.base, oldBasename),
+		joinRelativePath(l.base, newBasename))
+	if oserror.IsNotExist(err) || status.Code(err) == codes.NotFound {
+		// nolint:errwrap
+		return errors.WithMessagef(
+			errors.Wrap(cloud.ErrFileDoesNotExist, "nodelocal storage file does not exist"),
+			"%s",
+			err.Error(),
+		)
+	}
+	return err
+}
+
 func (l *localFileStorage) Delete(ctx context.Context, basename string) error {
 	return l.blobClient.Delete(ctx, joinRelativePath(l.base, basename))
 }
 
+// BatchDelete implements the cloud.BatchDeleter interface. The files are
+// deleted one at a time.
+func (l *localFileStorage) BatchDelete(
+	ctx context.Context, basenames []string,
+) ([]cloud.DeleteResult, error) {
+	return cloud.BatchDeleteWithDelete(ctx, basenames, 1, /* concurrency */
+		func(ctx context.Context, basename string) error {
+			err := l.Delete(ctx, basename)
+			// See ReadFile for the errors returned by local and remote stores.
+			if oserror.IsNotExist(err) || status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		})
+}
+
 func (l *localFileStorage) Size(ctx context.Context, basename string) (int64, error) {
-	stat, err := l.blobClient.Stat(ctx, joinRelativePath(l.base, basename))
+	info, err := l.Stat(ctx, basename)
 	if err != nil {
 		return 0, err
 	}
-	return stat.Filesize, nil
+	return info.Size, nil
+}
+
+// Stat implements the cloud.Stater interface. Only the size and
+// modification time of local files are known.
+func (l *localFileStorage) Stat(ctx context.Context, basename string) (cloud.ObjectInfo, error) {
+	stat, err := l.blobClient.Stat(ctx, joinRelativePath(l.base, basename))
+	if err != nil {
+		if oserror.IsNotExist(err) || status.Code(err) == codes.NotFound {
+			// nolint:errwrap
+			return cloud.ObjectInfo{}, errors.WithMessagef(
+				errors.Wrap(cloud.ErrFileDoesNotExist, "nodelocal storage file does not exist"),
+				"%s",
+				err.Error(),
+			)
+		}
+		return cloud.ObjectInfo{}, err
+	}
+	return cloud.ObjectInfo{
+		Size:    stat.Filesize,
+		ModTime: timeutil.Unix(0, stat.ModTimeNanos),
+	}, nil
+}
+
+// CheckAccess implements the cloud.AccessChecker interface, by writing a
+// probe file to the directory.
+func (l *localFileStorage) CheckAccess(ctx context.Context) error {
+	return cloud.CheckAccessWithProbe(ctx, l, isLocalAccessDenied)
+}
+
+var _ cloud.WriteValidator = &localFileStorage{}
+
+// ValidateWritable implements the cloud.WriteValidator interface, by writing
+// and deleting an empty probe file next to the file.
+func (l *localFileStorage) ValidateWritable(ctx context.Context, basename string) error {
+	return cloud.ValidateWritableWithProbe(ctx, l, basename, isLocalAccessDenied)
+}
+
+// isLocalAccessDenied returns whether err is an authentication or authorization
+// failure of a nodelocal operation.
+func isLocalAccessDenied(err error) bool {
+	return oserror.IsPermission(err) || status.Code(errors.UnwrapAll(err)) == codes.PermissionDenied
 }
 
 func (*localFileStorage) Close() error {
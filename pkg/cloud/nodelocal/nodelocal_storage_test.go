@@ -11,13 +11,27 @@
 package nodelocal
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/cloud"
 	"github.com/cockroachdb/cockroach/pkg/cloud/cloudtestutils"
 	"github.com/cockroachdb/cockroach/pkg/security/username"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPutLocal(t *testing.T) {
@@ -37,3 +51,172 @@ func TestPutLocal(t *testing.T) {
 		t, url, username.RootUserName(), nil /*db */, testSettings,
 	)
 }
+
+func TestLocalConformance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	testSettings.ExternalIODir = p
+	cloudtestutils.RunConformanceSuite(t, func(t *testing.T, basePath string) cloud.ExternalStorage {
+		conf, err := cloud.ExternalStorageConfFromURI("nodelocal://1/"+basePath, username.RootUserName())
+		require.NoError(t, err)
+		s, err := cloud.MakeExternalStorage(context.Background(), conf, base.ExternalIODirConfig{},
+			testSettings, blobs.TestBlobServiceClient(p), nil /* db */, nil, cloud.NilMetrics)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+// TestLocalValidateWritable verifies that validating that a file of a
+// read-only directory is writable reports that the access is denied.
+func TestLocalValidateWritable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	if os.Geteuid() == 0 {
+		skip.IgnoreLint(t, "the permissions of the directory do not apply to root")
+	}
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	require.NoError(t, os.MkdirAll(filepath.Join(p, "readonly"), 0755))
+	require.NoError(t, os.Chmod(filepath.Join(p, "readonly"), 0555))
+	defer func() { _ = os.Chmod(filepath.Join(p, "readonly"), 0755) }()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	testSettings.ExternalIODir = p
+	for _, dir := range []string{"writable", "readonly"} {
+		conf, err := cloud.ExternalStorageConfFromURI("nodelocal://1/"+dir, username.RootUserName())
+		require.NoError(t, err)
+		s, err := cloud.MakeExternalStorage(ctx, conf, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestBlobServiceClient(p), nil /* db */, nil, cloud.NilMetrics)
+		require.NoError(t, err)
+		defer s.Close()
+		if dir == "writable" {
+			require.NoError(t, cloud.ValidateWritable(ctx, s, "backup"))
+		} else {
+			cloudtestutils.CheckNotWritable(t, s, "backup")
+		}
+	}
+}
+
+// TestReadFileWithChecksum verifies that a file corrupted after it was
+// written fails checksum verification when the reader is closed.
+func TestReadFileWithChecksum(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	testSettings.ExternalIODir = p
+	conf, err := cloud.ExternalStorageConfFromURI("nodelocal://1/checksum", username.RootUserName())
+	require.NoError(t, err)
+	s, err := cloud.MakeExternalStorage(ctx, conf, base.ExternalIODirConfig{}, testSettings,
+		blobs.TestBlobServiceClient(p), nil /* db */, nil, cloud.NilMetrics)
+	require.NoError(t, err)
+	defer s.Close()
+
+	const filename = "data"
+	content := []byte("the contents of a file which will be corrupted")
+	require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader(content)))
+
+	sha := sha256.Sum256(content)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+	checksums := []struct {
+		algo     cloud.ChecksumAlgo
+		expected []byte
+	}{
+		{cloud.ChecksumSHA256, sha[:]},
+		{cloud.ChecksumCRC32C, crc},
+	}
+
+	readAll := func(algo cloud.ChecksumAlgo, expected []byte) ([]byte, error) {
+		r, err := cloud.ReadFileWithChecksum(ctx, s, filename, expected, algo)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return got, r.Close()
+	}
+
+	for _, c := range checksums {
+		got, err := readAll(c.algo, c.expected)
+		require.NoError(t, err, "%s", c.algo)
+		require.Equal(t, content, got)
+	}
+
+	t.Run("no-expected-checksum", func(t *testing.T) {
+		_, err := cloud.ReadFileWithChecksum(ctx, s, filename, nil /* expected */, cloud.ChecksumCRC32C)
+		require.Error(t, err)
+	})
+
+	t.Run("closed-early", func(t *testing.T) {
+		r, err := cloud.ReadFileWithChecksum(ctx, s, filename, sha[:], cloud.ChecksumSHA256)
+		require.NoError(t, err)
+		_, err = r.Read(make([]byte, 1))
+		require.NoError(t, err)
+		require.Error(t, r.Close())
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		corrupted := append([]byte(nil), content...)
+		corrupted[len(corrupted)/2] ^= 0xff
+		require.NoError(t, os.WriteFile(filepath.Join(p, "checksum", filename), corrupted, 0644))
+
+		for _, c := range checksums {
+			got, err := readAll(c.algo, c.expected)
+			require.ErrorIs(t, err, cloud.ErrChecksumMismatch, "%s", c.algo)
+			require.Equal(t, corrupted, got)
+		}
+	})
+}
+
+// TestWriteFileIfMatchUnsupported verifies that nodelocal storage, whose files
+// have no ETag, rejects conditional writes as unimplemented.
+func TestWriteFileIfMatchUnsupported(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	testSettings.ExternalIODir = p
+	conf, err := cloud.ExternalStorageConfFromURI("nodelocal://1/if-match", username.RootUserName())
+	require.NoError(t, err)
+	s, err := cloud.MakeExternalStorage(ctx, conf, base.ExternalIODirConfig{}, testSettings,
+		blobs.TestBlobServiceClient(p), nil /* db */, nil, cloud.NilMetrics)
+	require.NoError(t, err)
+	defer s.Close()
+
+	const filename = "data"
+	require.NoError(t, cloud.WriteFile(ctx, s, filename, bytes.NewReader([]byte("first"))))
+	err = cloud.WriteFileIfMatch(ctx, s, filename, "etag", bytes.NewReader([]byte("second")))
+	require.True(t, errors.IsUnimplementedError(err), "expected unimplemented error, got %v", err)
+	require.False(t, errors.Is(err, cloud.ErrPreconditionFailed))
+}
+
+func TestRawClientUnsupported(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	testSettings := cluster.MakeTestingClusterSettings()
+	testSettings.ExternalIODir = p
+	conf, err := cloud.ExternalStorageConfFromURI("nodelocal://1/raw", username.RootUserName())
+	require.NoError(t, err)
+	s, err := cloud.MakeExternalStorage(ctx, conf, base.ExternalIODirConfig{}, testSettings,
+		blobs.TestBlobServiceClient(p), nil /* db */, nil, cloud.NilMetrics)
+	require.NoError(t, err)
+	defer s.Close()
+
+	client, err := cloud.RawClientOf(s)
+	require.True(t, errors.IsUnimplementedError(err), "expected unimplemented error, got %v", err)
+	require.Nil(t, client)
+}
@@ -80,14 +80,53 @@ type nullWriter struct{}
 func (nullWriter) Write(p []byte) (int, error) { return len(p), nil }
 func (nullWriter) Close() error                { return nil }
 
+func (nullWriter) ResumeToken() ([]byte, int64, error) { return nil, 0, nil }
+func (nullWriter) Abort(context.Context) error         { return nil }
+
 func (n *nullSinkStorage) Writer(_ context.Context, _ string) (io.WriteCloser, error) {
 	return nullWriter{}, nil
 }
 
+func (n *nullSinkStorage) WriterWithOptions(
+	_ context.Context, _ string, _ cloud.WriteOptions,
+) (io.WriteCloser, error) {
+	return nullWriter{}, nil
+}
+
+func (n *nullSinkStorage) WriteFileIfNotExists(
+	_ context.Context, _ string, _ io.ReadSeeker,
+) (bool, error) {
+	return true, nil
+}
+
+func (n *nullSinkStorage) ResumableWriter(
+	_ context.Context, _ string, _ []byte,
+) (cloud.ResumableWriter, error) {
+	return nullWriter{}, nil
+}
+
+func (n *nullSinkStorage) WriteFileIfMatch(
+	_ context.Context, _ string, _ string, _ io.ReadSeeker,
+) error {
+	return nil
+}
+
 func (n *nullSinkStorage) List(_ context.Context, _, _ string, _ cloud.ListingFn) error {
 	return nil
 }
 
+func (n *nullSinkStorage) ListDetailed(_ context.Context, _, _ string, _ cloud.ListingDetailedFn) error {
+	return nil
+}
+
+func (n *nullSinkStorage) Copy(_ context.Context, _, _ string) error {
+	return nil
+}
+
+func (n *nullSinkStorage) Rename(_ context.Context, _, _ string) error {
+	return nil
+}
+
 func (n *nullSinkStorage) Delete(_ context.Context, _ string) error {
 	return nil
 }
@@ -96,7 +135,30 @@ func (n *nullSinkStorage) Size(_ context.Context, _ string) (int64, error) {
 	return 0, nil
 }
 
+func (n *nullSinkStorage) Stat(_ context.Context, _ string) (cloud.ObjectInfo, error) {
+	return cloud.ObjectInfo{}, nil
+}
+
+func (n *nullSinkStorage) Exists(_ context.Context, _ string) (bool, error) {
+	return false, nil
+}
+
+// CheckAccess implements the cloud.AccessChecker interface. The null sink
+// accepts every write, and a probe file could not be read back.
+func (n *nullSinkStorage) CheckAccess(_ context.Context) error {
+	return nil
+}
+
 var _ cloud.ExternalStorage = &nullSinkStorage{}
+var _ cloud.OptionsWriter = &nullSinkStorage{}
+var _ cloud.ResumableUploader = &nullSinkStorage{}
+var _ cloud.ConditionalWriter = &nullSinkStorage{}
+var _ cloud.DetailedLister = &nullSinkStorage{}
+var _ cloud.Copier = &nullSinkStorage{}
+var _ cloud.Renamer = &nullSinkStorage{}
+var _ cloud.Stater = &nullSinkStorage{}
+var _ cloud.ExistenceChecker = &nullSinkStorage{}
+var _ cloud.AccessChecker = &nullSinkStorage{}
 
 func init() {
 	cloud.RegisterExternalStorageProvider(cloudpb.ExternalStorageProvider_null,
@@ -0,0 +1,89 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/logtags"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// StorageOpTag identifies the job on behalf of which ExternalStorage
+// operations are run, so that the cloud API calls of jobs sharing a node can
+// be told apart.
+type StorageOpTag struct {
+	// JobID is the ID of the job, or 0 if the operations are not run by a job.
+	JobID int64
+	// Purpose describes what the job uses the storage for, such as "backup" or
+	// "restore".
+	Purpose string
+}
+
+type storageOpTagKey struct{}
+
+// WithStorageOpTag returns a context which tags the operations of the storage
+// returned by MakeExternalStorage which are run with it: each operation is
+// traced in a span with "job_id" and "purpose" tags, and logged with the same
+// log tags.
+func WithStorageOpTag(ctx context.Context, jobID int64, purpose string) context.Context {
+	return context.WithValue(ctx, storageOpTagKey{}, StorageOpTag{JobID: jobID, Purpose: purpose})
+}
+
+// StorageOpTagFromContext returns the tag set by WithStorageOpTag, if any.
+func StorageOpTagFromContext(ctx context.Context) (StorageOpTag, bool) {
+	tag, ok := ctx.Value(storageOpTagKey{}).(StorageOpTag)
+	return tag, ok
+}
+
+// startTaggedOp returns a context for the named operation which carries the
+// tag of ctx, if any, in a child span and log tags. The returned span is nil
+// if ctx is not tagged or not traced.
+func startTaggedOp(ctx context.Context, opName string) (context.Context, *tracing.Span) {
+	tag, ok := StorageOpTagFromContext(ctx)
+	if !ok {
+		return ctx, nil
+	}
+	ctx = logtags.AddTag(ctx, "job", tag.JobID)
+	if tag.Purpose != "" {
+		ctx = logtags.AddTag(ctx, "purpose", tag.Purpose)
+	}
+	ctx, sp := tracing.ChildSpan(ctx, "external_storage."+opName)
+	sp.SetTag("job_id", attribute.Int64Value(tag.JobID))
+	sp.SetTag("purpose", attribute.StringValue(tag.Purpose))
+	return ctx, sp
+}
+
+// spanWriter finishes the span of the writes of a writer when it is closed.
+type spanWriter struct {
+	io.WriteCloser
+	sp *tracing.Span
+}
+
+// finishSpanOnClose returns w, finishing sp when w is closed. It returns w
+// itself if sp is nil.
+func finishSpanOnClose(w io.WriteCloser, sp *tracing.Span) io.WriteCloser {
+	if sp == nil {
+		return w
+	}
+	return &spanWriter{WriteCloser: w, sp: sp}
+}
+
+func (w *spanWriter) ReadFrom(src io.Reader) (int64, error) {
+	return readFrom(w.WriteCloser, src)
+}
+
+func (w *spanWriter) Close() error {
+	defer w.sp.Finish()
+	return w.WriteCloser.Close()
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing/tracingpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageOpTag(t *testing.T) {
+	tr := tracing.NewTracer()
+	ctx, sp := tr.StartSpanCtx(context.Background(), "root", tracing.WithRecording(tracingpb.RecordingVerbose))
+	defer sp.Finish()
+
+	es := &esWrapper{
+		ExternalStorage: &countingStorage{files: map[string][]byte{"file": []byte("data")}},
+		metricsRecorder: newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown),
+	}
+
+	// Operations which are not tagged are not traced by the wrapper.
+	r, _, err := es.ReadFile(ctx, "file", ReadOptions{})
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx))
+	_, ok := sp.GetConfiguredRecording().FindSpan("external_storage.read")
+	require.False(t, ok)
+
+	tagged := WithStorageOpTag(ctx, 42, "restore")
+	tag, ok := StorageOpTagFromContext(tagged)
+	require.True(t, ok)
+	require.Equal(t, StorageOpTag{JobID: 42, Purpose: "restore"}, tag)
+
+	r, _, err = es.ReadFile(tagged, "file", ReadOptions{})
+	require.NoError(t, err)
+	require.NoError(t, r.Close(tagged))
+
+	rec, ok := sp.GetConfiguredRecording().FindSpan("external_storage.read")
+	require.True(t, ok)
+	tags := rec.FindTagGroup(tracingpb.AnonymousTagGroupName)
+	require.NotNil(t, tags)
+	jobID, ok := tags.FindTag("job_id")
+	require.True(t, ok)
+	require.Equal(t, "42", jobID)
+	purpose, ok := tags.FindTag("purpose")
+	require.True(t, ok)
+	require.Equal(t, "restore", purpose)
+}
@@ -23,6 +23,14 @@ func WithIOAccountingInterceptor(i ReadWriterInterceptor) ExternalStorageOption
 	}
 }
 
+// WithRetryConfig sets the RetryConfig used to retry the operations of the
+// external storage, instead of the one configured by the cluster settings.
+func WithRetryConfig(cfg RetryConfig) ExternalStorageOption {
+	return func(opts *ExternalStorageOptions) {
+		opts.retryConfig = &cfg
+	}
+}
+
 func WithAzureStorageTestingKnobs(knobs base.ModuleTestingKnobs) ExternalStorageOption {
 	return func(opts *ExternalStorageOptions) {
 		opts.AzureStorageTestingKnobs = knobs
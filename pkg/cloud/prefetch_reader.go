@@ -0,0 +1,166 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+)
+
+// NewPrefetchingReader returns a reader of the named file which reads it in
+// chunks of chunkSize bytes, with up to readAhead chunks read concurrently by
+// ReadFileAtWithLength ahead of the position of the reader. The chunks are
+// returned in order. Sequential scans of large files, whose throughput is
+// otherwise bound by the latency of a single stream, can use it to use more
+// of the available bandwidth, at the cost of buffering up to readAhead chunks.
+//
+// The reads stop when ctx is canceled or the reader is closed, and Close
+// waits for the reads in flight to return.
+func NewPrefetchingReader(
+	ctx context.Context, store ExternalStorage, basename string, readAhead int, chunkSize int64,
+) (io.ReadCloser, error) {
+	if readAhead <= 0 {
+		return nil, errors.Newf("read ahead must be positive: %d", readAhead)
+	}
+	if chunkSize <= 0 {
+		return nil, errors.Newf("chunk size must be positive: %d", chunkSize)
+	}
+	size, err := store.Size(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &prefetchingReader{
+		ctx:       ctx,
+		cancel:    cancel,
+		store:     store,
+		basename:  basename,
+		size:      size,
+		readAhead: readAhead,
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// prefetchedChunk is a chunk of the file being read in the background. data
+// and err are set when done is closed.
+type prefetchedChunk struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+type prefetchingReader struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	store     ExternalStorage
+	basename  string
+	size      int64
+	readAhead int
+	chunkSize int64
+
+	// next is the offset of the first chunk which is not being read yet.
+	next int64
+	// pending are the chunks being read, in order.
+	pending []*prefetchedChunk
+	// cur is the unread part of the chunk being returned.
+	cur    []byte
+	err    error
+	wg     sync.WaitGroup
+	closed bool
+}
+
+var _ io.ReadCloser = &prefetchingReader{}
+
+// fill starts reading chunks until readAhead chunks are pending or the end of
+// the file is reached.
+func (r *prefetchingReader) fill() {
+	for len(r.pending) < r.readAhead && r.next < r.size {
+		offset, length := r.next, r.chunkSize
+		if offset+length > r.size {
+			length = r.size - offset
+		}
+		r.next += length
+
+		c := &prefetchedChunk{done: make(chan struct{})}
+		r.pending = append(r.pending, c)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer close(c.done)
+			c.data, c.err = r.readChunk(offset, length)
+		}()
+	}
+}
+
+func (r *prefetchingReader) readChunk(offset, length int64) (_ []byte, err error) {
+	rc, err := ReadFileAtWithLength(r.ctx, r.store, r.basename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.CombineErrors(err, rc.Close())
+	}()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(rc, data); err != nil {
+		return nil, errors.Wrapf(err, "reading %s at offset %d", r.basename, offset)
+	}
+	return data, nil
+}
+
+func (r *prefetchingReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read from closed prefetching reader")
+	}
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+		if len(r.pending) == 0 {
+			r.err = io.EOF
+			continue
+		}
+		c := r.pending[0]
+		select {
+		case <-c.done:
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			continue
+		}
+		r.pending = r.pending[1:]
+		if c.err != nil {
+			r.err = c.err
+			continue
+		}
+		r.cur = c.data
+		// Start reading the chunk which replaces the one being returned.
+		r.fill()
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops the reads in flight and waits for them to return.
+func (r *prefetchingReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	r.wg.Wait()
+	r.pending = nil
+	r.cur = nil
+	return nil
+}
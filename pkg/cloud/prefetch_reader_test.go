@@ -0,0 +1,148 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkStorage is an ExternalStorage which serves ranges of data. The reads
+// of offsets at or after blockAfter, if set, wait until their context is
+// canceled.
+type chunkStorage struct {
+	ExternalStorage
+	data       []byte
+	blockAfter int64
+
+	mu struct {
+		syncutil.Mutex
+		active, maxActive int
+	}
+}
+
+func (s *chunkStorage) Size(context.Context, string) (int64, error) {
+	return int64(len(s.data)), nil
+}
+
+func (s *chunkStorage) ReadFileAtWithLength(
+	ctx context.Context, _ string, offset, length int64,
+) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.mu.active++
+	if s.mu.active > s.mu.maxActive {
+		s.mu.maxActive = s.mu.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.mu.active--
+		s.mu.Unlock()
+	}()
+
+	if s.blockAfter > 0 && offset >= s.blockAfter {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return io.NopCloser(bytes.NewReader(s.data[offset : offset+length])), nil
+}
+
+func (s *chunkStorage) activeReads() (active, maxActive int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.active, s.mu.maxActive
+}
+
+func TestPrefetchingReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := make([]byte, 100<<10+17)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	t.Run("matches-plain-read", func(t *testing.T) {
+		for _, size := range []int{0, 1, len(data)} {
+			for _, readAhead := range []int{1, 4} {
+				for _, chunkSize := range []int64{1 << 10, 7 << 10, 1 << 20} {
+					t.Run(fmt.Sprintf("size=%d/readAhead=%d/chunk=%d", size, readAhead, chunkSize), func(t *testing.T) {
+						s := &chunkStorage{data: data[:size]}
+						r, err := NewPrefetchingReader(ctx, s, "file", readAhead, chunkSize)
+						require.NoError(t, err)
+						got, err := io.ReadAll(r)
+						require.NoError(t, err)
+						require.NoError(t, r.Close())
+						require.True(t, bytes.Equal(data[:size], got), "prefetched bytes differ")
+
+						active, maxActive := s.activeReads()
+						require.Zero(t, active)
+						require.LessOrEqual(t, maxActive, readAhead)
+					})
+				}
+			}
+		}
+	})
+
+	t.Run("close-stops-reads", func(t *testing.T) {
+		const chunkSize = 1 << 10
+		s := &chunkStorage{data: data, blockAfter: chunkSize}
+		r, err := NewPrefetchingReader(ctx, s, "file", 8, chunkSize)
+		require.NoError(t, err)
+
+		// Reading the first chunk leaves the reads of the following chunks
+		// blocked in flight.
+		buf := make([]byte, chunkSize)
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		require.Equal(t, data[:chunkSize], buf)
+
+		require.NoError(t, r.Close())
+		active, _ := s.activeReads()
+		require.Zero(t, active)
+		_, err = r.Read(buf)
+		require.Error(t, err)
+	})
+
+	t.Run("context-cancellation", func(t *testing.T) {
+		const chunkSize = 1 << 10
+		s := &chunkStorage{data: data, blockAfter: chunkSize}
+		ctx, cancel := context.WithCancel(ctx)
+		r, err := NewPrefetchingReader(ctx, s, "file", 4, chunkSize)
+		require.NoError(t, err)
+
+		buf := make([]byte, chunkSize)
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+
+		cancel()
+		_, err = r.Read(buf)
+		require.ErrorIs(t, err, context.Canceled)
+		require.NoError(t, r.Close())
+		active, _ := s.activeReads()
+		require.Zero(t, active)
+	})
+
+	t.Run("invalid-arguments", func(t *testing.T) {
+		s := &chunkStorage{data: data}
+		_, err := NewPrefetchingReader(ctx, s, "file", 0, 1<<10)
+		require.Error(t, err)
+		_, err = NewPrefetchingReader(ctx, s, "file", 1, 0)
+		require.Error(t, err)
+	})
+}
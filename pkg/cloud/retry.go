@@ -0,0 +1,128 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/errors"
+)
+
+var retryMaxAttempts = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.retry.max_attempts",
+	"the maximum number of attempts of an external storage operation which fails with a "+
+		"retryable error; 1 disables retries",
+	3,
+	settings.PositiveInt,
+)
+
+var retryMaxBackoff = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.retry.max_backoff",
+	"the maximum delay between attempts of an external storage operation",
+	5*time.Second,
+	settings.PositiveDuration,
+)
+
+// defaultRetryInitialBackoff is the delay before the first retry of an
+// external storage operation.
+const defaultRetryInitialBackoff = 100 * time.Millisecond
+
+// RetryConfig configures the retries of the operations of an ExternalStorage
+// which fail with a retryable error. The retries are applied by the wrapper
+// returned by MakeExternalStorage around opening a file for reading or
+// writing, listing, deleting and getting the size of files, on top of any
+// retries done by the implementation.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts of an operation. An
+	// operation is not retried if it is 1 or less.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. The delay doubles
+	// with each retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// IsRetryable classifies the errors of the operations. IsRetryableError is
+	// used if it is nil.
+	IsRetryable func(error) bool
+}
+
+// RetryConfigFromSettings returns the RetryConfig configured by the
+// cloudstorage.retry cluster settings.
+func RetryConfigFromSettings(sv *settings.Values) RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    int(retryMaxAttempts.Get(sv)),
+		InitialBackoff: defaultRetryInitialBackoff,
+		MaxBackoff:     retryMaxBackoff.Get(sv),
+	}
+}
+
+// IsRetryableError returns true if err is a transient error of an external
+// storage operation: a connection error, an attempt which exceeded its
+// OpTimeouts, or an HTTP error response with a 429 or 5xx status. The errors of
+// the provider SDKs which carry the response status expose it through a
+// StatusCode method.
+func IsRetryableError(err error) bool {
+	if errors.Is(err, ErrOperationTimeout) {
+		return true
+	}
+	if errors.Is(err, ErrFileDoesNotExist) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if IsResumableHTTPError(err) {
+		return true
+	}
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode()
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// errNotRetryable marks errors of operations which cannot be retried, such as
+// a listing which already passed results to its callback.
+var errNotRetryable = errors.New("external storage operation cannot be retried")
+
+// run runs fn until it succeeds, fails with an error which is not retryable,
+// or MaxAttempts attempts have failed, and returns the last error.
+func (c RetryConfig) run(ctx context.Context, opName string, fn func(context.Context) error) error {
+	if c.MaxAttempts <= 1 {
+		return fn(ctx)
+	}
+	isRetryable := c.IsRetryable
+	if isRetryable == nil {
+		isRetryable = IsRetryableError
+	}
+
+	opts := retry.Options{
+		InitialBackoff: c.InitialBackoff,
+		MaxBackoff:     c.MaxBackoff,
+		Multiplier:     2,
+		MaxRetries:     c.MaxAttempts - 1,
+	}
+	err := ctx.Err()
+	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+		err = fn(ctx)
+		if err == nil || errors.Is(err, errNotRetryable) || !isRetryable(err) {
+			return err
+		}
+		log.VEventf(ctx, 2, "external storage %s failed on attempt %d of %d: %v",
+			opName, r.CurrentAttempt()+1, c.MaxAttempts, err)
+	}
+	return err
+}
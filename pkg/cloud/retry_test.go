@@ -0,0 +1,207 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// statusError is an error carrying an HTTP status, like the errors of the
+// provider SDKs.
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("http status %d", int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+// flakyStorage is an ExternalStorage whose operations fail with err the first
+// failures times they are called.
+type flakyStorage struct {
+	ExternalStorage
+	failures int
+	err      error
+	calls    int
+	written  []byte
+}
+
+func (s *flakyStorage) maybeFail() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyStorage) Delete(context.Context, string) error {
+	return s.maybeFail()
+}
+
+// WriteStream reads half of the stream before failing, and then the rest of
+// it into written.
+func (s *flakyStorage) WriteStream(_ context.Context, _ string, r io.Reader, size int64) error {
+	half := make([]byte, size/2)
+	if _, err := io.ReadFull(r, half); err != nil {
+		return err
+	}
+	if err := s.maybeFail(); err != nil {
+		return err
+	}
+	rest, err := io.ReadAll(r)
+	s.written = append(half, rest...)
+	return err
+}
+
+// Copy implements the Copier interface.
+func (s *flakyStorage) Copy(context.Context, string, string) error {
+	return s.maybeFail()
+}
+
+// Rename implements the Renamer interface.
+func (s *flakyStorage) Rename(context.Context, string, string) error {
+	return s.maybeFail()
+}
+
+func (s *flakyStorage) List(_ context.Context, _, _ string, fn ListingFn) error {
+	if err := fn("a"); err != nil {
+		return err
+	}
+	return s.maybeFail()
+}
+
+func TestRetryConfig(t *testing.T) {
+	ctx := context.Background()
+	cfg := RetryConfig{
+		MaxAttempts:    4,
+		InitialBackoff: time.Microsecond,
+		MaxBackoff:     time.Millisecond,
+	}
+
+	for _, tc := range []struct {
+		name          string
+		cfg           RetryConfig
+		failures      int
+		err           error
+		expectedCalls int
+		expectErr     bool
+	}{
+		{name: "succeeds-after-retries", cfg: cfg, failures: 3, err: statusError(503), expectedCalls: 4},
+		{name: "stops-at-max-attempts", cfg: cfg, failures: 10, err: statusError(503), expectedCalls: 4, expectErr: true},
+		{name: "throttled", cfg: cfg, failures: 2, err: statusError(429), expectedCalls: 3},
+		{name: "not-retryable", cfg: cfg, failures: 10, err: statusError(403), expectedCalls: 1, expectErr: true},
+		{name: "file-does-not-exist", cfg: cfg, failures: 10, err: ErrFileDoesNotExist, expectedCalls: 1, expectErr: true},
+		{name: "disabled", cfg: RetryConfig{MaxAttempts: 1}, failures: 1, err: statusError(503), expectedCalls: 1, expectErr: true},
+		{
+			name: "custom-classifier",
+			cfg: RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: time.Microsecond,
+				IsRetryable:    func(err error) bool { return errors.Is(err, ErrFileDoesNotExist) },
+			},
+			failures:      1,
+			err:           ErrFileDoesNotExist,
+			expectedCalls: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &flakyStorage{failures: tc.failures, err: tc.err}
+			es := &esWrapper{ExternalStorage: fake, retry: tc.cfg}
+			err := es.Delete(ctx, "file")
+			if tc.expectErr {
+				require.ErrorIs(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedCalls, fake.calls)
+		})
+	}
+
+	t.Run("list-after-results", func(t *testing.T) {
+		// A listing which fails after passing results to the callback is not
+		// retried, since the callback would see the results again.
+		fake := &flakyStorage{failures: 10, err: statusError(503)}
+		es := &esWrapper{ExternalStorage: fake, retry: cfg}
+		var listed []string
+		err := es.List(ctx, "", "", func(name string) error {
+			listed = append(listed, name)
+			return nil
+		})
+		require.ErrorIs(t, err, statusError(503))
+		require.Equal(t, 1, fake.calls)
+		require.Equal(t, []string{"a"}, listed)
+	})
+
+	t.Run("write-stream", func(t *testing.T) {
+		data := []byte("streamed content")
+		for _, tc := range []struct {
+			name          string
+			r             io.Reader
+			expectedCalls int
+			expectErr     bool
+		}{
+			// A stream which can seek back to where the write started is retried.
+			{name: "seekable", r: bytes.NewReader(data), expectedCalls: 2},
+			// Otherwise the bytes read by the failed attempt are lost.
+			{name: "not-seekable", r: struct{ io.Reader }{bytes.NewReader(data)}, expectedCalls: 1, expectErr: true},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				fake := &flakyStorage{failures: 1, err: statusError(503)}
+				es := &esWrapper{
+					ExternalStorage: fake,
+					retry:           cfg,
+					metricsRecorder: newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown),
+				}
+				err := WriteStream(ctx, es, "file", tc.r, int64(len(data)))
+				require.Equal(t, tc.expectedCalls, fake.calls)
+				if tc.expectErr {
+					require.ErrorIs(t, err, statusError(503))
+					return
+				}
+				require.NoError(t, err)
+				require.Equal(t, data, fake.written)
+			})
+		}
+	})
+
+	t.Run("optional-interfaces", func(t *testing.T) {
+		// The operations of the optional interfaces the storage implements
+		// natively are retried like the others, unless they are not
+		// idempotent.
+		fake := &flakyStorage{failures: 1, err: statusError(503)}
+		es := &esWrapper{ExternalStorage: fake, retry: cfg}
+		require.NoError(t, es.Copy(ctx, "file", "copy"))
+		require.Equal(t, 2, fake.calls)
+
+		fake = &flakyStorage{failures: 1, err: statusError(503)}
+		es = &esWrapper{ExternalStorage: fake, retry: cfg}
+		require.ErrorIs(t, es.Rename(ctx, "file", "renamed"), statusError(503))
+		require.Equal(t, 1, fake.calls)
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		st := cluster.MakeTestingClusterSettings()
+		retryMaxAttempts.Override(ctx, &st.SV, 7)
+		retryMaxBackoff.Override(ctx, &st.SV, time.Minute)
+		require.Equal(t, RetryConfig{
+			MaxAttempts:    7,
+			InitialBackoff: defaultRetryInitialBackoff,
+			MaxBackoff:     time.Minute,
+		}, RetryConfigFromSettings(&st.SV))
+	})
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+var readTimeout = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.read_timeout",
+	"the timeout of reading an external storage file, until its reader is closed, and of each "+
+		"attempt to read its metadata; 0 disables the timeout",
+	0,
+	settings.NonNegativeDuration,
+)
+
+var writeTimeout = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.write_timeout",
+	"the timeout of writing an external storage file, until its writer is closed, and of each "+
+		"attempt to write a stream, or to copy, rename or delete files; 0 disables the timeout",
+	0,
+	settings.NonNegativeDuration,
+)
+
+var listTimeout = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"cloudstorage.list_timeout",
+	"the timeout of each attempt to list external storage files, including the time spent "+
+		"processing the listed files; 0 disables the timeout",
+	0,
+	settings.NonNegativeDuration,
+)
+
+// ErrOperationTimeout is the mark of the errors of external storage operations
+// which exceeded the timeout configured for them by OpTimeouts. It is not set
+// if the operation failed because the context passed to it expired.
+var ErrOperationTimeout = errors.New("external storage operation timed out")
+
+// OpTimeouts are the timeouts applied by the wrapper returned by
+// MakeExternalStorage to each attempt of the operations of an ExternalStorage,
+// on top of the deadline of their context. Readers and writers read and write
+// with the context they are opened with, so their timeout covers all their
+// attempts and reads or writes, until they are closed. A timeout which is not
+// positive does not apply.
+type OpTimeouts struct {
+	// Read applies to readers, including those of range, suffix and checksum
+	// reads, and to reading the metadata of files.
+	Read time.Duration
+	// Write applies to writers, writing streams, appending to, copying,
+	// renaming and deleting files, and checking the access to the storage.
+	Write time.Duration
+	// List applies to listings, including the time spent in their callbacks.
+	List time.Duration
+}
+
+// OpTimeoutsFromSettings returns the OpTimeouts configured by the
+// cloudstorage.{read,write,list}_timeout cluster settings.
+func OpTimeoutsFromSettings(sv *settings.Values) OpTimeouts {
+	return OpTimeouts{
+		Read:  readTimeout.Get(sv),
+		Write: writeTimeout.Get(sv),
+		List:  listTimeout.Get(sv),
+	}
+}
+
+// forOp returns the timeout of each attempt of the named operation of the
+// wrapper, other than opening readers and writers.
+func (t OpTimeouts) forOp(opName string) time.Duration {
+	switch opName {
+	case "stat", "size", "exists":
+		return t.Read
+	case "write", "append", "copy", "rename", "delete", "check_access":
+		return t.Write
+	case "list":
+		return t.List
+	default:
+		return 0
+	}
+}
+
+// withTimeout returns a context which expires after timeout, if it is positive,
+// or ctx itself.
+func withTimeout(
+	ctx context.Context, timeout time.Duration,
+) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// runWithTimeout runs fn with the given timeout, if it is positive, and marks
+// its error with ErrOperationTimeout if it exceeded the timeout.
+func runWithTimeout(
+	ctx context.Context, opName string, timeout time.Duration, fn func(context.Context) error,
+) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	err := timeutil.RunWithTimeout(ctx, "external storage "+opName, timeout, fn)
+	return markTimeout(ctx, err)
+}
+
+// markTimeout marks err with ErrOperationTimeout if it is the error of an
+// operation which was stopped by its timeout, rather than by the expiry of ctx,
+// the context of the caller.
+func markTimeout(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if errors.HasType(err, (*timeutil.TimeoutError)(nil)) || errors.Is(err, context.DeadlineExceeded) {
+		return errors.Mark(err, ErrOperationTimeout)
+	}
+	return err
+}
+
+// timeoutReader is a reader whose reads are stopped by the timeout of the
+// context it was opened with, which it cancels when it is closed.
+type timeoutReader struct {
+	r ioctx.ReadCloserCtx
+	// ctx is the context of the caller, which the timeout does not apply to.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (r *timeoutReader) Read(ctx context.Context, p []byte) (int, error) {
+	n, err := r.r.Read(ctx, p)
+	return n, markTimeout(r.ctx, err)
+}
+
+func (r *timeoutReader) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	n, err := ioctx.WriteTo(ctx, r.r, w)
+	return n, markTimeout(r.ctx, err)
+}
+
+func (r *timeoutReader) Close(ctx context.Context) error {
+	defer r.cancel()
+	return markTimeout(r.ctx, r.r.Close(ctx))
+}
+
+// timeoutWriter is a writer whose writes are stopped by the timeout of the
+// context it was opened with, which it cancels when it is closed.
+type timeoutWriter struct {
+	w io.WriteCloser
+	// ctx is the context of the caller, which the timeout does not apply to.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	return n, markTimeout(w.ctx, err)
+}
+
+func (w *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := readFrom(w.w, src)
+	return n, markTimeout(w.ctx, err)
+}
+
+func (w *timeoutWriter) Close() error {
+	defer w.cancel()
+	return markTimeout(w.ctx, w.w.Close())
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloud
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/stretchr/testify/require"
+)
+
+// slowStorage is an ExternalStorage whose operations hang until their context
+// expires, like those of a hung connection.
+type slowStorage struct {
+	ExternalStorage
+	calls int
+}
+
+func (s *slowStorage) Delete(ctx context.Context, _ string) error {
+	s.calls++
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Copy implements the Copier interface.
+func (s *slowStorage) Copy(ctx context.Context, _, _ string) error {
+	s.calls++
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// ReadFileAtWithLength implements the RangeReader interface.
+func (s *slowStorage) ReadFileAtWithLength(
+	ctx context.Context, _ string, _, _ int64,
+) (io.ReadCloser, error) {
+	s.calls++
+	return &ctxReadCloser{ctx: ctx, r: &slowReader{ctx: ctx}}, nil
+}
+
+func (s *slowStorage) List(ctx context.Context, _, _ string, _ ListingFn) error {
+	s.calls++
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// slowReader hangs on reads until the context it was opened with expires.
+type slowReader struct {
+	ctx context.Context
+}
+
+func (r *slowReader) Read(context.Context, []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func (r *slowReader) Close(context.Context) error { return nil }
+
+func (s *slowStorage) ReadFile(
+	ctx context.Context, _ string, _ ReadOptions,
+) (ioctx.ReadCloserCtx, int64, error) {
+	s.calls++
+	return &slowReader{ctx: ctx}, 1, nil
+}
+
+// slowWriter hangs on close until the context it was opened with expires.
+type slowWriter struct {
+	ctx context.Context
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *slowWriter) Close() error {
+	<-w.ctx.Done()
+	return w.ctx.Err()
+}
+
+func (s *slowStorage) Writer(ctx context.Context, _ string) (io.WriteCloser, error) {
+	s.calls++
+	return &slowWriter{ctx: ctx}, nil
+}
+
+func TestOpTimeouts(t *testing.T) {
+	ctx := context.Background()
+	const timeout = 10 * time.Millisecond
+	timeouts := OpTimeouts{Read: timeout, Write: timeout, List: timeout}
+	newStorage := func(cfg RetryConfig) (*slowStorage, ExternalStorage) {
+		fake := &slowStorage{}
+		return fake, &esWrapper{
+			ExternalStorage: fake,
+			metricsRecorder: newMetricsReadWriter(NilMetrics, cloudpb.ExternalStorageProvider_Unknown),
+			retry:           cfg,
+			timeouts:        timeouts,
+		}
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		fake, es := newStorage(RetryConfig{})
+		start := timeutil.Now()
+		err := es.Delete(ctx, "file")
+		require.ErrorIs(t, err, ErrOperationTimeout)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, timeutil.Since(start), 10*time.Second)
+		require.Equal(t, 1, fake.calls)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		_, es := newStorage(RetryConfig{})
+		err := es.List(ctx, "", "", func(string) error { return nil })
+		require.ErrorIs(t, err, ErrOperationTimeout)
+	})
+
+	t.Run("read", func(t *testing.T) {
+		_, es := newStorage(RetryConfig{})
+		r, _, err := es.ReadFile(ctx, "file", ReadOptions{})
+		require.NoError(t, err)
+		_, err = r.Read(ctx, make([]byte, 1))
+		require.ErrorIs(t, err, ErrOperationTimeout)
+		require.NoError(t, r.Close(ctx))
+	})
+
+	t.Run("optional-interfaces", func(t *testing.T) {
+		// The operations of the optional interfaces the storage implements
+		// natively are bounded by the timeouts of the others.
+		_, es := newStorage(RetryConfig{})
+		require.ErrorIs(t, es.(Copier).Copy(ctx, "file", "copy"), ErrOperationTimeout)
+		r, err := es.(RangeReader).ReadFileAtWithLength(ctx, "file", 0 /* offset */, 1 /* length */)
+		require.NoError(t, err)
+		_, err = r.Read(make([]byte, 1))
+		require.ErrorIs(t, err, ErrOperationTimeout)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("write", func(t *testing.T) {
+		_, es := newStorage(RetryConfig{})
+		w, err := es.Writer(ctx, "file")
+		require.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		require.NoError(t, err)
+		require.ErrorIs(t, w.Close(), ErrOperationTimeout)
+	})
+
+	t.Run("timeouts-are-retried", func(t *testing.T) {
+		fake, es := newStorage(RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+		require.ErrorIs(t, es.Delete(ctx, "file"), ErrOperationTimeout)
+		require.Equal(t, 3, fake.calls)
+	})
+
+	t.Run("context-expiry-is-not-a-timeout", func(t *testing.T) {
+		fake, es := newStorage(RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+		es.(*esWrapper).timeouts = OpTimeouts{Write: time.Hour}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		err := es.Delete(ctx, "file")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, ErrOperationTimeout)
+		require.Equal(t, 1, fake.calls)
+	})
+}
@@ -16,6 +16,7 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/cockroach/pkg/cloud/cloudpb"
+	"github.com/cockroachdb/errors"
 )
 
 const (
@@ -46,6 +47,31 @@ func GetPrefixBeforeWildcard(p string) string {
 	return path.Dir(p[:globIndex])
 }
 
+// SplitGlobPattern splits a path into the prefix returned by
+// GetPrefixBeforeWildcard, which can be listed, and the glob pattern which
+// the listed names must match. The pattern is compiled before anything is
+// listed so that a malformed pattern returns an error rather than silently
+// matching no files. A path without glob characters is returned whole as the
+// prefix along with an empty pattern, since it names a single file.
+func SplitGlobPattern(p string) (prefix string, pattern string, _ error) {
+	prefix = GetPrefixBeforeWildcard(p)
+	pattern = p[len(prefix):]
+	if pattern == "" {
+		return prefix, "", nil
+	}
+	if strings.Contains(pattern, "**") {
+		return "", "", errors.Newf("invalid glob pattern %q: recursive matching with ** is not supported", pattern)
+	}
+	if strings.ContainsAny(pattern, "{}") {
+		return "", "", errors.Newf("invalid glob pattern %q: brace expansion is not supported", pattern)
+	}
+	// Match compiles the whole pattern even if the name does not match it.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", "", errors.Wrapf(err, "invalid glob pattern %q", pattern)
+	}
+	return prefix, pattern, nil
+}
+
 // SanitizeExternalStorageURI returns the external storage URI with with some
 // secrets redacted, for use when showing these URIs in the UI, to provide some
 // protection from shoulder-surfing. The param is still present -- just
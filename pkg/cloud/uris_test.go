@@ -59,3 +59,63 @@ func TestSanitizeExternalStorageURI(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitGlobPattern(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		path    string
+		prefix  string
+		pattern string
+		err     string
+	}{
+		{
+			name:    "valid pattern",
+			path:    "/data/2023-*/part-?.csv",
+			prefix:  "/data",
+			pattern: "/2023-*/part-?.csv",
+		},
+		{
+			name:    "character class",
+			path:    "/data/part-[0-9].csv",
+			prefix:  "/data",
+			pattern: "/part-[0-9].csv",
+		},
+		{
+			// A path without glob characters names the file itself.
+			name:   "no pattern",
+			path:   "/data/part-1.csv",
+			prefix: "/data/part-1.csv",
+		},
+		{
+			name: "unbalanced bracket",
+			path: "/data/part-[0-9.csv",
+			err:  `invalid glob pattern "/part-\[0-9.csv": syntax error in pattern`,
+		},
+		{
+			name: "trailing escape",
+			path: "/data/*.csv\\",
+			err:  `invalid glob pattern .*: syntax error in pattern`,
+		},
+		{
+			name: "recursive wildcard",
+			path: "/data/**/part.csv",
+			err:  `recursive matching with \*\* is not supported`,
+		},
+		{
+			name: "brace expansion",
+			path: "/data/*.{csv,tsv}",
+			err:  `brace expansion is not supported`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix, pattern, err := cloud.SplitGlobPattern(tc.path)
+			if tc.err != "" {
+				require.Regexp(t, tc.err, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.prefix, prefix)
+			require.Equal(t, tc.pattern, pattern)
+		})
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/security/username"
 	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/util/ioctx"
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/errors/oserror"
@@ -85,6 +87,9 @@ type fileTableStorage struct {
 }
 
 var _ cloud.ExternalStorage = &fileTableStorage{}
+var _ cloud.Renamer = &fileTableStorage{}
+var _ cloud.Stater = &fileTableStorage{}
+var _ cloud.AccessChecker = &fileTableStorage{}
 
 func makeFileTableStorage(
 	ctx context.Context, args cloud.ExternalStorageContext, dest cloudpb.ExternalStorage,
@@ -294,6 +299,68 @@ func (f *fileTableStorage) Size(ctx context.Context, basename string) (int64, er
 	return f.fs.FileSize(ctx, filepath)
 }
 
+// Stat implements the Stater interface and returns the size and
+// upload time of the file stored in the user scoped FileToTableSystem.
+func (f *fileTableStorage) Stat(ctx context.Context, basename string) (cloud.ObjectInfo, error) {
+	filepath, err := checkBaseAndJoinFilePath(f.prefix, basename)
+	if err != nil {
+		return cloud.ObjectInfo{}, err
+	}
+	info, err := f.fs.FileInfo(ctx, filepath)
+	if err != nil {
+		if oserror.IsNotExist(err) {
+			return cloud.ObjectInfo{}, errors.Wrapf(cloud.ErrFileDoesNotExist,
+				"file %s does not exist in the UserFileTableSystem", filepath)
+		}
+		return cloud.ObjectInfo{}, err
+	}
+	return cloud.ObjectInfo{Size: info.Size, ModTime: info.UploadTime}, nil
+}
+
+// CheckAccess implements the AccessChecker interface, by writing a probe
+// file to the user scoped tables.
+func (f *fileTableStorage) CheckAccess(ctx context.Context) error {
+	return cloud.CheckAccessWithProbe(ctx, f, isUserfileAccessDenied)
+}
+
+var _ cloud.WriteValidator = &fileTableStorage{}
+
+// ValidateWritable implements the cloud.WriteValidator interface, by writing
+// and deleting an empty probe file next to the file.
+func (f *fileTableStorage) ValidateWritable(ctx context.Context, basename string) error {
+	return cloud.ValidateWritableWithProbe(ctx, f, basename, isUserfileAccessDenied)
+}
+
+// isUserfileAccessDenied returns whether err is an authentication or
+// authorization failure of a userfile operation.
+func isUserfileAccessDenied(err error) bool {
+	return pgerror.GetPGCode(err) == pgcode.InsufficientPrivilege
+}
+
+// Rename implements the Renamer interface. The file is renamed in a
+// single transaction of the user scoped FileToTableSystem, so it is atomic.
+func (f *fileTableStorage) Rename(ctx context.Context, oldBasename, newBasename string) error {
+	if err := cloud.CheckCopyBasenames(oldBasename, newBasename); err != nil {
+		return err
+	}
+	oldPath, err := checkBaseAndJoinFilePath(f.prefix, oldBasename)
+	if err != nil {
+		return err
+	}
+	newPath, err := checkBaseAndJoinFilePath(f.prefix, newBasename)
+	if err != nil {
+		return err
+	}
+	if err := f.fs.RenameFile(ctx, oldPath, newPath); err != nil {
+		if oserror.IsNotExist(err) {
+			return errors.Wrapf(cloud.ErrFileDoesNotExist,
+				"file %s does not exist in the UserFileTableSystem", oldPath)
+		}
+		return err
+	}
+	return nil
+}
+
 func init() {
 	cloud.RegisterExternalStorageProvider(cloudpb.ExternalStorageProvider_userfile,
 		parseUserfileURL, makeFileTableStorage, cloud.RedactedParams(), scheme)
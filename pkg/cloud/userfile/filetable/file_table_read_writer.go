@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/cloud"
 	"github.com/cockroachdb/cockroach/pkg/security/username"
@@ -296,19 +297,74 @@ func (f *FileToTableSystem) FileSize(ctx context.Context, filename string) (int6
 	return int64(tree.MustBeDInt(rows[0])), nil
 }
 
+// FileInfo is the metadata of a file stored in the user scoped tables.
+type FileInfo struct {
+	Size int64
+	// UploadTime is the time the file was written.
+	UploadTime time.Time
+}
+
+// FileInfo returns the metadata of filename, or os.ErrNotExist if the file
+// does not exist.
+func (f *FileToTableSystem) FileInfo(ctx context.Context, filename string) (FileInfo, error) {
+	e, err := resolveInternalFileToTableExecutor(f.executor)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	getFileInfoQuery := fmt.Sprintf(`SELECT file_size, upload_time FROM %s WHERE filename=$1`,
+		f.GetFQFileTableName())
+	row, err := e.ie.QueryRowEx(ctx, "payload-table-storage-info", nil,
+		sessiondata.InternalExecutorOverride{User: f.username},
+		getFileInfoQuery, filename)
+	if err != nil {
+		return FileInfo{}, errors.Wrap(err, "failed to get info of file from the file table")
+	}
+
+	if len(row) == 0 {
+		return FileInfo{}, os.ErrNotExist
+	}
+
+	info := FileInfo{Size: int64(tree.MustBeDInt(row[0]))}
+	if row[1] != tree.DNull {
+		info.UploadTime = tree.MustBeDTimestamp(row[1]).Time
+	}
+	return info, nil
+}
+
 // ListFiles returns a list of all the files which are currently stored in the
 // user scoped tables.
-func (f *FileToTableSystem) ListFiles(
-	ctx context.Context, pattern string,
-) (retFiles []string, retErr error) {
+func (f *FileToTableSystem) ListFiles(ctx context.Context, pattern string) ([]string, error) {
+	files, _, err := f.ListFilesLimit(ctx, pattern, 0 /* limit */)
+	return files, err
+}
+
+// ListFilesLimit returns up to limit of the files which are currently stored
+// in the user scoped tables, in sorted order, and whether more files matched
+// the pattern. A limit of 0 lists all the files. Callers listing tables which
+// may hold millions of files should set a limit, since the names are
+// accumulated in memory.
+func (f *FileToTableSystem) ListFilesLimit(
+	ctx context.Context, pattern string, limit int,
+) (retFiles []string, truncated bool, retErr error) {
+	if limit < 0 {
+		return nil, false, errors.Newf("invalid file listing limit %d", limit)
+	}
 	var files []string
 	listFilesQuery := fmt.Sprintf(`SELECT filename FROM %s WHERE filename LIKE $1 ORDER BY
 filename`, f.GetFQFileTableName())
+	args := []interface{}{pattern + "%"}
+	if limit > 0 {
+		// One more file than the limit is requested to find out whether the
+		// listing is truncated.
+		listFilesQuery += ` LIMIT $2`
+		args = append(args, limit+1)
+	}
 
 	rows, err := f.executor.Query(ctx, "file-table-storage-list", listFilesQuery, f.username,
-		pattern+"%")
+		args...)
 	if err != nil {
-		return files, errors.Wrap(err, "failed to list files from file table")
+		return files, false, errors.Wrap(err, "failed to list files from file table")
 	}
 
 	// Based on the executor type we must process the outputted rows differently.
@@ -327,7 +383,7 @@ filename`, f.GetFQFileTableName())
 			files = append(files, string(tree.MustBeDString(it.Cur()[0])))
 		}
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 	case *SQLConnFileToTableExecutor:
 		defer func() {
@@ -341,16 +397,19 @@ filename`, f.GetFQFileTableName())
 			if err := rows.sqlConnExecResults.Next(vals); err == io.EOF {
 				break
 			} else if err != nil {
-				return files, errors.Wrap(err, "failed to list files from file table")
+				return files, false, errors.Wrap(err, "failed to list files from file table")
 			}
 			filename := vals[0].(string)
 			files = append(files, filename)
 		}
 	default:
-		return []string{}, errors.New("unsupported executor type in FileSize")
+		return []string{}, false, errors.New("unsupported executor type in FileSize")
 	}
 
-	return files, nil
+	if limit > 0 && len(files) > limit {
+		return files[:limit], true, nil
+	}
+	return files, false, nil
 }
 
 // DestroyUserFileSystem drops the user scoped tables effectively deleting the
@@ -451,6 +510,48 @@ func (f *FileToTableSystem) DeleteFile(ctx context.Context, filename string) err
 	return nil
 }
 
+// RenameFile atomically renames from to to, replacing to if it exists. It
+// returns os.ErrNotExist if from does not exist.
+func (f *FileToTableSystem) RenameFile(ctx context.Context, from, to string) error {
+	e, err := resolveInternalFileToTableExecutor(f.executor)
+	if err != nil {
+		return err
+	}
+
+	return e.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		execSessionDataOverride := sessiondata.InternalExecutorOverride{User: f.username}
+		row, err := txn.QueryRowEx(ctx, "rename-file-exists", txn.KV(), execSessionDataOverride,
+			fmt.Sprintf(`SELECT 1 FROM %s WHERE filename=$1`, f.GetFQFileTableName()), from)
+		if err != nil {
+			return errors.Wrap(err, "failed to look up file in the file table")
+		}
+		if len(row) == 0 {
+			return os.ErrNotExist
+		}
+		if from == to {
+			return nil
+		}
+
+		// Replace the target, if it exists.
+		if _, err := txn.ExecEx(ctx, "rename-delete-payload-table", txn.KV(),
+			execSessionDataOverride, f.getDeletePayloadQuery(), to); err != nil {
+			return errors.Wrap(err, "failed to delete from the payload table")
+		}
+		if _, err := txn.ExecEx(ctx, "rename-delete-file-table", txn.KV(),
+			execSessionDataOverride, f.getDeleteQuery(), to); err != nil {
+			return errors.Wrap(err, "failed to delete from the file table")
+		}
+
+		renameQuery := fmt.Sprintf(`UPDATE %s SET filename=$2 WHERE filename=$1`,
+			f.GetFQFileTableName())
+		if _, err := txn.ExecEx(ctx, "rename-file", txn.KV(), execSessionDataOverride,
+			renameQuery, from, to); err != nil {
+			return errors.Wrap(err, "failed to rename file in the file table")
+		}
+		return nil
+	})
+}
+
 // payloadWriter is responsible for writing the file data (payload) to the user
 // Payload table.
 type payloadWriter struct {
@@ -152,6 +152,64 @@ func TestListAndDeleteFiles(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestListFilesLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, sqlDB, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer srv.Stopper().Stop(ctx)
+	s := srv.ApplicationLayer()
+
+	executor := filetable.MakeInternalFileToTableExecutor(
+		s.InternalDB().(isql.DB),
+	)
+	fileTableReadWriter, err := filetable.NewFileToTableSystem(ctx, qualifiedTableName,
+		executor, username.RootUserName())
+	require.NoError(t, err)
+
+	// Writing the files one by one would be slow, so the listing is made of
+	// metadata entries inserted directly into the File table.
+	const numFiles = 10000
+	_, err = sqlDB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (filename, file_size, username)
+SELECT 'file' || lpad(i::STRING, 5, '0'), 0, 'root' FROM generate_series(1, $1) AS i`,
+		fileTableReadWriter.GetFQFileTableName()), numFiles)
+	require.NoError(t, err)
+
+	all, err := fileTableReadWriter.ListFiles(ctx, "file")
+	require.NoError(t, err)
+	require.Len(t, all, numFiles)
+
+	for _, tc := range []struct {
+		limit             int
+		expectedLen       int
+		expectedTruncated bool
+	}{
+		{limit: 0, expectedLen: numFiles},
+		{limit: 1, expectedLen: 1, expectedTruncated: true},
+		{limit: 100, expectedLen: 100, expectedTruncated: true},
+		{limit: numFiles - 1, expectedLen: numFiles - 1, expectedTruncated: true},
+		{limit: numFiles, expectedLen: numFiles},
+		{limit: numFiles + 1, expectedLen: numFiles},
+	} {
+		t.Run(fmt.Sprintf("limit=%d", tc.limit), func(t *testing.T) {
+			files, truncated, err := fileTableReadWriter.ListFilesLimit(ctx, "file", tc.limit)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedTruncated, truncated)
+			require.Equal(t, all[:tc.expectedLen], files)
+		})
+	}
+
+	// The pattern is applied before the limit.
+	files, truncated, err := fileTableReadWriter.ListFilesLimit(ctx, "file0001", 5)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Equal(t, []string{"file00010", "file00011", "file00012", "file00013", "file00014"}, files)
+
+	_, _, err = fileTableReadWriter.ListFilesLimit(ctx, "file", -1)
+	require.Error(t, err)
+}
+
 func TestReadWriteFile(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
@@ -160,6 +160,7 @@ func (a tenantAuthorizer) authorize(
 
 	case "/cockroach.blobs.Blob/List",
 		"/cockroach.blobs.Blob/Delete",
+		"/cockroach.blobs.Blob/Rename",
 		"/cockroach.blobs.Blob/Stat",
 		"/cockroach.blobs.Blob/GetStream",
 		"/cockroach.blobs.Blob/PutStream":
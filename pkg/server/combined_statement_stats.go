@@ -726,9 +726,9 @@ FROM (SELECT fingerprint_id,
           fingerprint_id,
           app_name) %s
 %s`,
-			CrdbInternalStmtStatsCached,
+			stmtActivityWithStatsFallback(whereClause),
 			"combined-stmts-activity-by-interval",
-			whereClause,
+			"", /* whereClause */
 			args,
 			aostClause,
 			orderAndLimit)
@@ -841,6 +841,44 @@ FROM (SELECT fingerprint_id,
 	return statements, nil
 }
 
+// stmtActivityWithStatsFallback returns a table expression with the rows of
+// the statement activity table matching the where clause and, for the
+// aggregated timestamps matching it which have no activity rows, e.g. because
+// the transfer to the activity tables did not run yet, the rows of the
+// persisted statistics table. The statistics rows are merged per fingerprint,
+// app and aggregated timestamp, so their metadata has the aggregated format of
+// the activity table.
+func stmtActivityWithStatsFallback(whereClause string) string {
+	return fmt.Sprintf(`
+(SELECT fingerprint_id, app_name, aggregated_ts, metadata, statistics
+ FROM %[1]s %[3]s
+ UNION ALL
+ SELECT fingerprint_id,
+        app_name,
+        aggregated_ts,
+        crdb_internal.merge_stats_metadata(array_agg(metadata))    AS metadata,
+        crdb_internal.merge_statement_stats(array_agg(statistics)) AS statistics
+ FROM %[2]s %[3]s
+   AND aggregated_ts NOT IN (SELECT aggregated_ts FROM %[1]s %[3]s)
+ GROUP BY fingerprint_id, app_name, aggregated_ts) AS activity`,
+		CrdbInternalStmtStatsCached, CrdbInternalStmtStatsPersisted, whereClause)
+}
+
+// txnActivityWithStatsFallback returns a table expression with the rows of the
+// transaction activity table matching the where clause and, for the
+// aggregated timestamps matching it which have no activity rows, the rows of
+// the persisted statistics table.
+func txnActivityWithStatsFallback(whereClause string) string {
+	return fmt.Sprintf(`
+(SELECT app_name, aggregated_ts, fingerprint_id, metadata, statistics
+ FROM %[1]s %[3]s
+ UNION ALL
+ SELECT app_name, aggregated_ts, fingerprint_id, metadata, statistics
+ FROM %[2]s %[3]s
+   AND aggregated_ts NOT IN (SELECT aggregated_ts FROM %[1]s %[3]s)) AS activity`,
+		CrdbInternalTxnStatsCached, CrdbInternalTxnStatsPersisted, whereClause)
+}
+
 func getIterator(
 	ctx context.Context,
 	ie *sql.InternalExecutor,
@@ -901,9 +939,9 @@ FROM (SELECT app_name,
 			ctx,
 			ie,
 			queryFormat,
-			CrdbInternalTxnStatsCached,
+			txnActivityWithStatsFallback(whereClause),
 			"combined-txns-activity-by-interval",
-			whereClause,
+			"", /* whereClause */
 			args,
 			aostClause,
 			orderAndLimit)
@@ -220,6 +220,8 @@ var crdbInternal = virtualSchema{
 		catconstants.CrdbInternalRepairableCatalogCorruptionsViewID: crdbInternalRepairableCatalogCorruptions,
 		catconstants.CrdbInternalKVProtectedTS:                      crdbInternalKVProtectedTSTable,
 		catconstants.CrdbInternalKVSessionBasedLeases:               crdbInternalSessionBasedLeases,
+		catconstants.CrdbInternalSQLActivityTransferDebugTableID:    crdbInternalSQLActivityTransferDebugTable,
+		catconstants.CrdbInternalSQLActivityLastTransferTableID:     crdbInternalSQLActivityLastTransferTable,
 	},
 	validWithNoDatabaseContext: true,
 }
@@ -8843,3 +8845,81 @@ func populateFlowTokensResponse(
 	}
 	return nil
 }
+
+var crdbInternalSQLActivityTransferDebugTable = virtualSchemaTable{
+	comment: `ranking of the sql statistics of the current aggregation interval ` +
+		`used to select the rows transferred to the activity tables`,
+	schema: `
+CREATE TABLE crdb_internal.sql_activity_transfer_debug (
+  aggregated_ts             TIMESTAMPTZ NOT NULL,
+  activity_table            STRING NOT NULL,
+  fingerprint_id            BYTES NOT NULL,
+  app_name                  STRING NOT NULL,
+  execution_count_rank      INT NOT NULL,
+  service_latency_rank      INT NOT NULL,
+  total_execution_time_rank INT NOT NULL,
+  contention_time_rank      INT NOT NULL,
+  cpu_sql_nanos_rank        INT NOT NULL,
+  p99_latency_rank          INT,
+  admitted                  BOOL NOT NULL
+);`,
+	populate: func(ctx context.Context, p *planner, _ catalog.DatabaseDescriptor, addRow func(...tree.Datum) error) error {
+		hasRoleOption, _, err := p.HasViewActivityOrViewActivityRedactedRole(ctx)
+		if err != nil {
+			return err
+		}
+		if !hasRoleOption {
+			return noViewActivityOrViewActivityRedactedRoleError(p.User())
+		}
+
+		execCfg := p.ExecCfg()
+		updater := newSqlActivityUpdater(execCfg.Settings, execCfg.InternalDB, execCfg.SQLStatsTestingKnobs, nil /* registry */, nil /* sink */)
+		return updater.forEachRankedTransferCandidate(ctx,
+			func(aggTs time.Time, activityTable string, row tree.Datums) error {
+				aggTsDatum, err := tree.MakeDTimestampTZ(aggTs, time.Microsecond)
+				if err != nil {
+					return err
+				}
+				return addRow(append(tree.Datums{aggTsDatum, tree.NewDString(activityTable)}, row...)...)
+			})
+	},
+}
+
+var crdbInternalSQLActivityLastTransferTable = virtualSchemaTable{
+	comment: `the last successful transfer of the sql statistics to the activity tables`,
+	schema: `
+CREATE TABLE crdb_internal.sql_activity_last_transfer (
+  window_end   TIMESTAMPTZ,
+  completed_at TIMESTAMPTZ
+);`,
+	populate: func(ctx context.Context, p *planner, _ catalog.DatabaseDescriptor, addRow func(...tree.Datum) error) error {
+		hasRoleOption, _, err := p.HasViewActivityOrViewActivityRedactedRole(ctx)
+		if err != nil {
+			return err
+		}
+		if !hasRoleOption {
+			return noViewActivityOrViewActivityRedactedRoleError(p.User())
+		}
+
+		var last activityLastTransfer
+		var ok bool
+		if err := p.ExecCfg().InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) (err error) {
+			last, ok, err = getActivityLastTransfer(ctx, jobs.InfoStorageForJob(txn, jobs.SqlActivityUpdaterJobID))
+			return err
+		}); err != nil {
+			return err
+		}
+		if !ok {
+			return addRow(tree.DNull, tree.DNull)
+		}
+		windowEnd, err := tree.MakeDTimestampTZ(last.WindowEnd, time.Microsecond)
+		if err != nil {
+			return err
+		}
+		completedAt, err := tree.MakeDTimestampTZ(last.CompletedAt, time.Microsecond)
+		if err != nil {
+			return err
+		}
+		return addRow(windowEnd, completedAt)
+	},
+}
@@ -442,9 +442,11 @@ func importPlanHook(
 					files = append(files, file)
 					continue
 				}
-				prefix := cloud.GetPrefixBeforeWildcard(uri.Path)
-				if len(prefix) < len(uri.Path) {
-					pattern := uri.Path[len(prefix):]
+				prefix, pattern, err := cloud.SplitGlobPattern(uri.Path)
+				if err != nil {
+					return err
+				}
+				if pattern != "" {
 					uri.Path = prefix
 					s, err := p.ExecCfg().DistSQLSrv.ExternalStorageFromURI(ctx, uri.String(), p.User())
 					if err != nil {
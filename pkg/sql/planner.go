@@ -540,6 +540,7 @@ func internalExtendedEvalCtx(
 			IndexUsageStatsController:      indexUsageStatsController,
 			ConsistencyChecker:             execCfg.ConsistencyChecker,
 			StmtDiagnosticsRequestInserter: execCfg.StmtDiagnosticsRecorder.InsertRequest,
+			SQLActivityTransferrer:         execCfg.flushAndTransferSQLActivity,
 			RangeStatsFetcher:              execCfg.RangeStatsFetcher,
 		},
 		Tracing:         &SessionTracing{},
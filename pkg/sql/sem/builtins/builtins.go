@@ -7278,6 +7278,40 @@ table's zone configuration this will return NULL.`,
 			Volatility: volatility.Volatile,
 		},
 	),
+	"crdb_internal.flush_and_transfer_sql_activity": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		tree.Overload{
+			Types:      tree.ParamTypes{},
+			ReturnType: tree.FixedReturnType(types.Jsonb),
+			Fn: func(ctx context.Context, evalCtx *eval.Context, args tree.Datums) (tree.Datum, error) {
+				isAdmin, err := evalCtx.SessionAccessor.HasAdminRole(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if !isAdmin {
+					return nil, errors.New("crdb_internal.flush_and_transfer_sql_activity() requires admin privilege")
+				}
+				if evalCtx.SQLActivityTransferrer == nil {
+					return nil, errors.AssertionFailedf("sql activity transferrer not set")
+				}
+				stmtRows, txnRows, err := evalCtx.SQLActivityTransferrer(ctx)
+				if err != nil {
+					return nil, err
+				}
+				builder := json.NewObjectBuilder(2)
+				builder.Add("statement_activity", json.FromInt64(stmtRows))
+				builder.Add("transaction_activity", json.FromInt64(txnRows))
+				return tree.NewDJSON(builder.Build()), nil
+			},
+			Info: `This function is used to flush the SQL statistics of the current node and ` +
+				`transfer them to the statement and transaction activity system tables. It returns ` +
+				`the number of rows written to each table.`,
+			Volatility: volatility.Volatile,
+		},
+	),
 	// Deletes the underlying spans backing a table, only
 	// if the user provides explicit acknowledgement of the
 	// form "I acknowledge this will irrevocably delete all revisions
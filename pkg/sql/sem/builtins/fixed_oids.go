@@ -2510,6 +2510,7 @@ var builtinOidsArray = []string{
 	2541: `information_schema._pg_interval_type(typid: oid, typmod: int4) -> string`,
 	2542: `crdb_internal.release_series(version: string) -> string`,
 	2543: `crdb_internal.fips_ready() -> bool`,
+	2544: `crdb_internal.flush_and_transfer_sql_activity() -> jsonb`,
 }
 
 var builtinOidsBySignature map[string]oid.Oid
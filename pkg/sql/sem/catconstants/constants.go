@@ -205,6 +205,8 @@ const (
 	CrdbInternalRepairableCatalogCorruptionsViewID
 	CrdbInternalKVProtectedTS
 	CrdbInternalKVSessionBasedLeases
+	CrdbInternalSQLActivityTransferDebugTableID
+	CrdbInternalSQLActivityLastTransferTableID
 	InformationSchemaID
 	InformationSchemaAdministrableRoleAuthorizationsID
 	InformationSchemaApplicableRolesID
@@ -254,6 +254,11 @@ type Context struct {
 	// bundle request.
 	StmtDiagnosticsRequestInserter StmtDiagnosticsRequestInsertFunc
 
+	// SQLActivityTransferrer is used by the
+	// crdb_internal.flush_and_transfer_sql_activity builtin to flush the SQL
+	// stats and transfer them to the activity tables.
+	SQLActivityTransferrer SQLActivityTransferFunc
+
 	// CatalogBuiltins is used by various builtins which depend on looking up
 	// catalog information. Unlike the Planner, it is available in DistSQL.
 	CatalogBuiltins CatalogBuiltins
@@ -726,6 +726,12 @@ type StmtDiagnosticsRequestInsertFunc func(
 	expiresAfter time.Duration,
 ) error
 
+// SQLActivityTransferFunc is a function embedded in EvalCtx that can be used by
+// the builtins to flush the SQL stats and transfer them to the activity tables.
+// It returns the number of rows written to the statement and transaction
+// activity tables. This function is introduced to avoid circular dependency.
+type SQLActivityTransferFunc func(ctx context.Context) (stmtRows int64, txnRows int64, err error)
+
 // AsOfSystemTime represents the result from the evaluation of AS OF SYSTEM TIME
 // clause.
 type AsOfSystemTime struct {
@@ -13,21 +13,29 @@ package sql
 import (
 	"context"
 	"fmt"
+	"math"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 )
 
@@ -49,6 +57,91 @@ var sqlStatsActivityTopCount = settings.RegisterIntSetting(
 	settings.NonNegativeInt,
 )
 
+// sqlStatsActivityTopStmtCount is the cluster setting that controls the number
+// of statements selected per column to be inserted into the
+// statement_activity table. If it is 0, sql.stats.activity.top.max is used.
+var sqlStatsActivityTopStmtCount = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.top.statements.max",
+	"the limit per column for the top number of statement statistics to be "+
+		"flushed to the activity tables; if 0, sql.stats.activity.top.max is used",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityTopTxnCount is the cluster setting that controls the number
+// of transactions selected per column to be inserted into the
+// transaction_activity table. If it is 0, sql.stats.activity.top.max is used.
+var sqlStatsActivityTopTxnCount = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.top.transactions.max",
+	"the limit per column for the top number of transaction statistics to be "+
+		"flushed to the activity tables; if 0, sql.stats.activity.top.max is used",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityTopTotalTimeCount is the cluster setting that controls the
+// number of rows selected by the total execution time column for both
+// activity tables. If it is 0, sql.stats.activity.top.max is used.
+var sqlStatsActivityTopTotalTimeCount = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.top.columns.max",
+	"the limit for the top number of statistics ranked by total execution "+
+		"time to be flushed to the activity tables; if 0, "+
+		"sql.stats.activity.top.max is used",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityTopRankingColumns is the cluster setting that controls the
+// columns the statistics are ranked by to select the top statistics. Only the
+// statistics in the top of one of these columns are inserted into the activity
+// tables.
+var sqlStatsActivityTopRankingColumns = settings.RegisterStringSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.top.ranking_columns",
+	"a comma-separated list of the columns the statistics are ranked by to select "+
+		"the top statistics flushed to the activity tables; the columns are "+
+		strings.Join(stmtActivityRankingColumns, ", ")+
+		" (transactions are not ranked by p99_latency)",
+	strings.Join(stmtActivityRankingColumns, ","),
+	settings.WithValidateString(func(_ *settings.Values, columns string) error {
+		_, err := parseActivityRankingColumns(columns)
+		return err
+	}),
+)
+
+// The secondary sort keys of the rankings of the top statistics, which order
+// the statistics with the same value of a ranking column.
+const (
+	// activityTieBreakFingerprint orders the tied statistics by fingerprint ID
+	// and app name.
+	activityTieBreakFingerprint = iota
+	// activityTieBreakLastExecuted orders the tied statements by their last
+	// execution, most recent first, and then by fingerprint ID and app name.
+	// The transaction statistics do not record their last execution, so the
+	// tied transactions are ordered by fingerprint ID and app name.
+	activityTieBreakLastExecuted
+)
+
+// sqlStatsActivityTopTieBreak is the cluster setting that controls how the
+// statistics with the same value of a ranking column are ordered, so the top
+// statistics selected from the same statistics do not change between
+// transfers. It defaults to the fingerprint ID.
+var sqlStatsActivityTopTieBreak = settings.RegisterEnumSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.top.tie_break",
+	"the secondary sort key of the statistics with the same value of a ranking column "+
+		"when selecting the top statistics flushed to the activity tables: fingerprint_id, "+
+		"or last_executed to prefer the most recently executed statements",
+	"fingerprint_id",
+	map[int64]string{
+		activityTieBreakFingerprint:  "fingerprint_id",
+		activityTieBreakLastExecuted: "last_executed",
+	},
+)
+
 // sqlStatsActivityMaxPersistedRows specifies maximum number of rows that will be
 // retained in system.statement_activity and system.transaction_activity.
 // Defaults computed 500(top limit)*6(num columns)*24(hrs)*3(days)=216000
@@ -65,8 +158,573 @@ var sqlStatsActivityMaxPersistedRows = settings.RegisterIntSetting(
 	settings.NonNegativeInt,
 	settings.WithPublic)
 
-const numberOfStmtTopColumns = 6
-const numberOfTxnTopColumns = 5
+// sqlStatsActivityTransferBatchSize is the cluster setting that controls the
+// number of fingerprints written to the activity tables per transaction. A
+// value of 0 transfers all the rows in a single pass.
+var sqlStatsActivityTransferBatchSize = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.batch_size",
+	"the number of fingerprints written to the activity tables per "+
+		"transaction; 0 transfers all rows in a single pass",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityTransferBulkThreshold is the cluster setting that controls
+// the number of top fingerprints above which the rows are written to the
+// activity tables with multi-row statements.
+var sqlStatsActivityTransferBulkThreshold = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.bulk_threshold",
+	"the number of top fingerprints above which the rows are written to the "+
+		"activity tables with multi-row statements; 0 disables bulk writes",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityTransferUnlimited is the cluster setting that makes the
+// transfer copy every statistics row into the activity tables, regardless of
+// the top limits. It is meant for test and staging clusters: with many
+// fingerprints the activity tables can become as large as the statistics
+// tables, and sql.stats.activity.persisted_rows.max still applies.
+var sqlStatsActivityTransferUnlimited = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.unlimited",
+	"if enabled, all the statement and transaction statistics are copied to "+
+		"the activity tables instead of only the top statistics; this can make "+
+		"the activity tables very large and should only be used for testing",
+	false,
+)
+
+// sqlStatsActivityTransferMinExecCount is the cluster setting that controls
+// the minimum number of executions of the fingerprints transferred to the
+// activity tables.
+var sqlStatsActivityTransferMinExecCount = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.min_exec_count",
+	"the minimum number of executions in an aggregation interval of the "+
+		"fingerprints transferred to the activity tables; fingerprints executed "+
+		"fewer times are excluded before the top statistics are ranked. It is "+
+		"not applied if sql.stats.activity.transfer.unlimited is set; "+
+		"0 transfers every fingerprint",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityIgnoredAppNames is the cluster setting that controls which
+// app names are excluded from the transfer. The statistics of the matching app
+// names are neither ranked nor written to the activity tables.
+var sqlStatsActivityIgnoredAppNames = settings.RegisterStringSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.ignored_app_names",
+	"a regular expression matching the app names whose statistics are not "+
+		"transferred to the activity tables; if empty, all the app names are transferred",
+	`^\$ internal`,
+	settings.WithValidateString(func(_ *settings.Values, pattern string) error {
+		_, err := regexp.Compile(pattern)
+		return err
+	}),
+)
+
+// sqlStatsActivityTransferMaxAppNames is the cluster setting that controls how
+// many distinct app names are kept in the activity tables. The rows of the
+// apps with the fewest executions beyond it are rolled up into rows with the
+// app name (other).
+var sqlStatsActivityTransferMaxAppNames = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.max_app_names",
+	"the maximum number of distinct app names of the activity rows of an "+
+		"aggregation interval; the rows of the apps with the fewest transaction "+
+		"executions beyond it are merged into rows with the app name (other). "+
+		"0 keeps every app name",
+	0,
+	settings.NonNegativeInt,
+)
+
+// sqlStatsActivityTransferEnabled is the cluster setting that pauses the
+// transfer of the statistics to the activity tables, e.g. during maintenance,
+// while the statistics are still collected and flushed. Unlike
+// sql.stats.activity.ui.enabled, it does not affect which tables the UI reads.
+var sqlStatsActivityTransferEnabled = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.enabled",
+	"if disabled, the statement and transaction statistics are not transferred to "+
+		"the activity tables, which keep their current rows; the statistics are still collected",
+	true,
+)
+
+// transferPaused returns whether the transfers are paused by
+// sql.stats.activity.transfer.enabled. It is checked by every transfer, full,
+// incremental or of a window, before it writes anything.
+func (u *sqlActivityUpdater) transferPaused(ctx context.Context) bool {
+	if sqlStatsActivityTransferEnabled.Get(&u.st.SV) {
+		return false
+	}
+	if log.V(1) {
+		log.Infof(ctx, "sql stats activity skipped the transfer since sql.stats.activity.transfer.enabled is disabled")
+	}
+	return true
+}
+
+// sqlStatsActivityTransferVerifyEnabled is the cluster setting that enables
+// the verification of the execution counts of the activity tables against the
+// statistics tables after each transfer.
+var sqlStatsActivityTransferVerifyEnabled = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.verify.enabled",
+	"if enabled, the execution counts of the activity tables are compared to the "+
+		"statistics tables after each transfer, and mismatches are logged and counted",
+	false,
+)
+
+// sqlStatsActivityAnonymizeQueryText is the cluster setting that removes the
+// query text from the statement_activity rows, for clusters which must not
+// persist literal query text in the observability tables.
+var sqlStatsActivityAnonymizeQueryText = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.anonymize_query_text",
+	"if enabled, the query text is blanked out in the metadata of the statement "+
+		"activity rows, which only keep the statement fingerprint ID",
+	false,
+)
+
+// sqlStatsActivityTransferIncludeHistograms is the cluster setting that copies
+// the serialized latency distributions of the statement statistics into the
+// metadata of the statement_activity rows.
+var sqlStatsActivityTransferIncludeHistograms = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.include_histograms",
+	"if enabled, the serialized latency distributions of the statement statistics "+
+		"merged into each statement activity row are copied as is into its metadata, "+
+		"which makes the rows significantly larger",
+	false,
+)
+
+// The modes of sql.stats.activity.transfer.dedup.
+const (
+	activityDedupOff = iota
+	activityDedupRemove
+	activityDedupError
+)
+
+// sqlStatsActivityTransferDedup is the cluster setting that controls the
+// detection of duplicate statement activity rows after each transfer.
+var sqlStatsActivityTransferDedup = settings.RegisterEnumSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.dedup",
+	"controls the detection of statement activity rows with the same aggregated timestamp, "+
+		"fingerprint, plan and app after each transfer: off skips it, dedup keeps the row with "+
+		"the highest execution count of each, and error fails the transfer",
+	"off",
+	map[int64]string{
+		activityDedupOff:    "off",
+		activityDedupRemove: "dedup",
+		activityDedupError:  "error",
+	},
+)
+
+// sqlStatsActivityRetentionTTL is the cluster setting that controls how long
+// rows are retained in system.statement_activity and
+// system.transaction_activity. Older rows are deleted after each transfer.
+var sqlStatsActivityRetentionTTL = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.retention_ttl",
+	"if nonzero, rows of the statement and transaction activity tables with an "+
+		"aggregated timestamp older than this duration are deleted after each transfer",
+	14*24*time.Hour, // 14 days
+	settings.NonNegativeDuration,
+)
+
+// sqlStatsActivityTransferPhaseTimeout is the cluster setting that controls
+// how long each phase of the transfer to the activity tables may run. A phase
+// which times out is resumed by the next transfer.
+var sqlStatsActivityTransferPhaseTimeout = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.phase_timeout",
+	"the maximum duration of each phase of the transfer to the activity "+
+		"tables; if 0, the phases have no timeout",
+	0,
+	settings.NonNegativeDuration,
+)
+
+// sqlStatsActivityTxnTable is the cluster setting that controls the table the
+// transaction statistics are transferred to, e.g. to write the activity to an
+// alternate observability database. The table must have the columns of
+// system.transaction_activity.
+var sqlStatsActivityTxnTable = settings.RegisterStringSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transaction_activity_table",
+	"the fully qualified name of the table the transaction statistics are "+
+		"flushed to; it must have the columns of system.transaction_activity",
+	defaultTxnActivityTable,
+	settings.WithValidateString(validateActivityTableName),
+)
+
+// sqlStatsActivityStmtTable is the cluster setting that controls the table the
+// statement statistics are transferred to. The table must have the columns of
+// system.statement_activity.
+var sqlStatsActivityStmtTable = settings.RegisterStringSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.statement_activity_table",
+	"the fully qualified name of the table the statement statistics are "+
+		"flushed to; it must have the columns of system.statement_activity",
+	defaultStmtActivityTable,
+	settings.WithValidateString(validateActivityTableName),
+)
+
+// The default activity tables, which are created by the upgrades.
+const (
+	defaultTxnActivityTable  = "system.public.transaction_activity"
+	defaultStmtActivityTable = "system.public.statement_activity"
+)
+
+// validateActivityTableName returns an error if name is not the fully
+// qualified name of a table.
+func validateActivityTableName(_ *settings.Values, name string) error {
+	tn, err := parser.ParseQualifiedTableName(name)
+	if err != nil {
+		return err
+	}
+	if !tn.ExplicitCatalog {
+		return errors.Newf("activity table name %q must be fully qualified", name)
+	}
+	return nil
+}
+
+// activityTableName returns the quoted name of the activity table configured
+// by setting.
+func activityTableName(sv *settings.Values, setting *settings.StringSetting) string {
+	tn, err := parser.ParseQualifiedTableName(setting.Get(sv))
+	if err != nil {
+		// The setting is validated, so it can only fail to parse if the
+		// validation changed since it was set.
+		return setting.Default()
+	}
+	return tn.String()
+}
+
+// activityRetentionDeleteLimit is the maximum number of rows deleted per
+// transaction when removing expired rows from the activity tables.
+const activityRetentionDeleteLimit = 1000
+
+// The phases of the transfer of an aggregated timestamp. Completed phases are
+// checkpointed so a transfer which fails resumes from the first phase which
+// did not complete.
+const (
+	activityTransferPhaseTxn  = "transaction_activity"
+	activityTransferPhaseStmt = "statement_activity"
+	// activityTransferPhaseAppNameRollup rolls up the rows of the apps beyond
+	// sql.stats.activity.transfer.max_app_names.
+	activityTransferPhaseAppNameRollup = "app_name_rollup"
+	// activityTransferPhaseCombined writes both activity tables at once when
+	// sql.stats.activity.transfer.combined.enabled is set.
+	activityTransferPhaseCombined = "combined_activity"
+)
+
+// The steps of the transfer which are not checkpointed, used to identify where
+// a transfer failed in a TransferError.
+const (
+	// activityTransferPhasePrepare counts and compacts the rows before the
+	// statistics are transferred.
+	activityTransferPhasePrepare = "prepare"
+	// activityTransferPhaseCheckpoint clears the checkpoint once all the phases
+	// completed.
+	activityTransferPhaseCheckpoint = "checkpoint"
+	// activityTransferPhaseRetention deletes the expired activity rows.
+	activityTransferPhaseRetention = "retention"
+	// activityTransferPhaseTimeRollup rolls up the activity rows older than
+	// sql.stats.activity.rollup.after.
+	activityTransferPhaseTimeRollup = "time_rollup"
+	// activityTransferPhaseDedup detects, and possibly removes, the duplicate
+	// activity rows once all the phases completed.
+	activityTransferPhaseDedup = "dedup"
+	// activityTransferPhaseOversizedRows counts, or removes, the statement
+	// activity rows which were truncated since they were too large.
+	activityTransferPhaseOversizedRows = "oversized_rows"
+	// activityTransferPhaseSink passes the activity rows to the ActivitySink of
+	// the updater once all the phases completed.
+	activityTransferPhaseSink = "sink"
+)
+
+// TransferError is returned when the transfer of the statistics to the
+// activity tables fails. It identifies the phase which failed and the window
+// of aggregated timestamps being transferred.
+type TransferError struct {
+	// Phase is the phase of the transfer which failed, e.g.
+	// "transaction_activity" or "statement_activity".
+	Phase string
+	// WindowStart and WindowEnd are the bounds of the window [start, end) of
+	// aggregated timestamps being transferred.
+	WindowStart time.Time
+	WindowEnd   time.Time
+	// Cause is the error of the phase.
+	Cause error
+}
+
+var _ error = &TransferError{}
+var _ fmt.Formatter = &TransferError{}
+var _ errors.SafeFormatter = &TransferError{}
+
+// Error is part of the error interface, which TransferError implements.
+func (e *TransferError) Error() string {
+	return fmt.Sprint(e)
+}
+
+// Unwrap returns the cause of the error.
+func (e *TransferError) Unwrap() error {
+	return e.Cause
+}
+
+// Format is part of the fmt.Formatter interface, which TransferError
+// implements.
+func (e *TransferError) Format(s fmt.State, verb rune) {
+	errors.FormatError(e, s, verb)
+}
+
+// SafeFormatError is part of the errors.SafeFormatter interface, which
+// TransferError implements.
+func (e *TransferError) SafeFormatError(p errors.Printer) (next error) {
+	p.Printf("sql activity transfer phase %s failed for window [%s, %s)",
+		redact.SafeString(e.Phase), e.WindowStart, e.WindowEnd)
+	return e.Cause
+}
+
+// wrapTransferError wraps err in a TransferError for the given phase and
+// window, unless it already is one.
+func wrapTransferError(err error, phase string, start time.Time, end time.Time) error {
+	if err == nil || errors.HasType(err, (*TransferError)(nil)) {
+		return err
+	}
+	return &TransferError{Phase: phase, WindowStart: start, WindowEnd: end, Cause: err}
+}
+
+// errActivityTransferResumable marks the errors of transfers which can be
+// resumed from their checkpoint.
+var errActivityTransferResumable = errors.New("sql activity transfer is resumable")
+
+// isResumableActivityTransferError returns whether the error is from a
+// transfer which the next transfer resumes from its checkpoint.
+func isResumableActivityTransferError(err error) bool {
+	return errors.Is(err, errActivityTransferResumable)
+}
+
+// activityTransferCheckpoint records the phases of the transfer of an
+// aggregated timestamp which completed.
+type activityTransferCheckpoint struct {
+	aggTs           time.Time
+	completedPhases []string
+}
+
+func (c activityTransferCheckpoint) isEmpty() bool {
+	return len(c.completedPhases) == 0
+}
+
+// completed returns whether the phase of the transfer of aggTs completed.
+func (c activityTransferCheckpoint) completed(aggTs time.Time, phase string) bool {
+	if !c.aggTs.Equal(aggTs) {
+		return false
+	}
+	for _, completedPhase := range c.completedPhases {
+		if completedPhase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// activityTransferProgress is the progress of the transfer of an aggregated
+// timestamp.
+type activityTransferProgress struct {
+	aggTs time.Time
+	// phase is the phase of the transfer which is running.
+	phase string
+	// rowsDone is the number of rows written to the activity tables.
+	rowsDone int64
+	// rowsEstimate is the estimated number of rows written by the transfer, or
+	// 0 if it is not known yet.
+	rowsEstimate int64
+	// done is set once the transfer completed.
+	done bool
+}
+
+// fraction returns the fraction of the transfer which completed. The rows are
+// estimated from the statistics rows of every node, so the estimate may be off
+// and the fraction stays below 1 until the transfer completes.
+func (p activityTransferProgress) fraction() float32 {
+	if p.done {
+		return 1
+	}
+	if p.rowsEstimate <= 0 {
+		return 0
+	}
+	return float32(math.Min(float64(p.rowsDone)/float64(p.rowsEstimate), 0.99))
+}
+
+// status returns a human-readable description of the progress.
+func (p activityTransferProgress) status() string {
+	if p.done {
+		return fmt.Sprintf("transferred %d rows of the statistics at %s", p.rowsDone, p.aggTs)
+	}
+	return fmt.Sprintf("transferring the statistics at %s: phase %s, %d of about %d rows",
+		p.aggTs, p.phase, p.rowsDone, p.rowsEstimate)
+}
+
+// activityTopLimits holds the number of rows selected per ranking column when
+// transferring the top statistics to the activity tables.
+type activityTopLimits struct {
+	// stmt is the limit per column for statement_activity.
+	stmt int64
+	// txn is the limit per column for transaction_activity.
+	txn int64
+	// totalTime is the limit of the total execution time column for both
+	// activity tables.
+	totalTime int64
+	// rankingColumns are the columns of stmtActivityRankingColumns the
+	// statistics are ranked by, in the same order.
+	rankingColumns []string
+	// tieBreak is the secondary sort key of the rankings, one of the
+	// activityTieBreak constants.
+	tieBreak int64
+	// minExecCount is the minimum execution count of the fingerprints which
+	// are ranked. If it is 0 all the fingerprints are ranked.
+	minExecCount int64
+}
+
+// makeActivityTopLimits reads the top limits from the cluster settings. The
+// per-table and per-column settings fall back to sql.stats.activity.top.max
+// when they are unset.
+func makeActivityTopLimits(sv *settings.Values) activityTopLimits {
+	legacy := sqlStatsActivityTopCount.Get(sv)
+	limitOrLegacy := func(limit int64) int64 {
+		if limit == 0 {
+			return legacy
+		}
+		return limit
+	}
+	rankingColumns, err := parseActivityRankingColumns(sqlStatsActivityTopRankingColumns.Get(sv))
+	if err != nil {
+		// The setting is validated when it is set, so this only happens if the
+		// columns were renamed since.
+		rankingColumns = stmtActivityRankingColumns
+	}
+	return activityTopLimits{
+		stmt:           limitOrLegacy(sqlStatsActivityTopStmtCount.Get(sv)),
+		txn:            limitOrLegacy(sqlStatsActivityTopTxnCount.Get(sv)),
+		totalTime:      limitOrLegacy(sqlStatsActivityTopTotalTimeCount.Get(sv)),
+		rankingColumns: rankingColumns,
+		tieBreak:       sqlStatsActivityTopTieBreak.Get(sv),
+		minExecCount:   sqlStatsActivityTransferMinExecCount.Get(sv),
+	}
+}
+
+// uniformActivityTopLimits returns limits using the same value for every
+// table and column, ranking the statistics by all the columns.
+func uniformActivityTopLimits(limit int64) activityTopLimits {
+	return activityTopLimits{
+		stmt:           limit,
+		txn:            limit,
+		totalTime:      limit,
+		rankingColumns: stmtActivityRankingColumns,
+	}
+}
+
+// txnRankTieBreak returns the ORDER BY terms which follow the ranking column
+// in the rankings of the merged transaction statistics, merge_stats.
+func (l activityTopLimits) txnRankTieBreak() string {
+	return ", fingerprint_id, app_name"
+}
+
+// stmtRankTieBreak returns the ORDER BY terms which follow the ranking column
+// in the rankings of the merged statement statistics, merged_stats.
+func (l activityTopLimits) stmtRankTieBreak() string {
+	if l.tieBreak == activityTieBreakLastExecuted {
+		return ", (merged_stats -> 'statistics' ->> 'lastExecAt')::TIMESTAMPTZ DESC NULLS LAST, " +
+			"fingerprint_id, app_name"
+	}
+	return ", fingerprint_id, app_name"
+}
+
+// minExecCountFilter returns the HAVING clause which excludes the
+// fingerprints executed fewer than minExecCount times from the statistics
+// grouped per fingerprint and app name, before they are ranked. It is empty
+// if every fingerprint is ranked.
+func (l activityTopLimits) minExecCountFilter() string {
+	if l.minExecCount <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n HAVING sum((statistics -> 'statistics' ->> 'cnt')::INT8) >= %d", l.minExecCount)
+}
+
+// ranksBy returns whether the statistics are ranked by the column.
+func (l activityTopLimits) ranksBy(column string) bool {
+	for _, c := range l.rankingColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRows is the maximum number of rows the top selection can insert into an
+// activity table ranked by the given columns, with the given limit per column.
+func (l activityTopLimits) maxRows(columns []string, limit int64) int64 {
+	var rows int64
+	for _, column := range columns {
+		if !l.ranksBy(column) {
+			continue
+		}
+		if column == "total_execution_time" {
+			rows += l.totalTime
+		} else {
+			rows += limit
+		}
+	}
+	return rows
+}
+
+// maxStmtRows is the maximum number of rows the top selection can insert into
+// statement_activity for a single aggregated timestamp.
+func (l activityTopLimits) maxStmtRows() int64 {
+	return l.maxRows(stmtActivityRankingColumns, l.stmt)
+}
+
+// maxTxnRows is the maximum number of rows the top selection can insert into
+// transaction_activity for a single aggregated timestamp.
+func (l activityTopLimits) maxTxnRows() int64 {
+	return l.maxRows(txnActivityRankingColumns, l.txn)
+}
+
+// parseActivityRankingColumns parses the comma-separated list of columns of
+// sql.stats.activity.top.ranking_columns, returning them in the order of
+// stmtActivityRankingColumns.
+func parseActivityRankingColumns(columns string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimSpace(column)
+		if column == "" {
+			continue
+		}
+		known := false
+		for _, c := range stmtActivityRankingColumns {
+			known = known || c == column
+		}
+		if !known {
+			return nil, errors.Newf("unknown ranking column %q; the columns are %s",
+				column, strings.Join(stmtActivityRankingColumns, ", "))
+		}
+		set[column] = true
+	}
+	if len(set) == 0 {
+		return nil, errors.New("at least one ranking column is required")
+	}
+	var parsed []string
+	for _, c := range stmtActivityRankingColumns {
+		if set[c] {
+			parsed = append(parsed, c)
+		}
+	}
+	return parsed, nil
+}
 
 // sqlActivityUpdateJob is responsible for translating the data in the
 // statement/txn statistics tables into the statement/txn _activity_
@@ -92,6 +750,60 @@ func (j *sqlActivityUpdateJob) Resume(ctx context.Context, execCtxI interface{})
 	statsFlush := execCtx.ExecCfg().InternalDB.server.sqlStats
 	metrics := execCtx.ExecCfg().JobRegistry.MetricsStruct().JobSpecificMetrics[jobspb.TypeAutoUpdateSQLActivity].(ActivityUpdaterMetrics)
 
+	// highWater is the MVCC timestamp of the newest statistics rows which
+	// have been transferred. It is persisted in the job's progress so a
+	// resumed job only transfers the statistics which changed since.
+	// checkpoint holds the completed phases of a transfer which failed, so
+	// the next transfer resumes from the first phase which did not complete.
+	// transferProgress is the progress of the running transfer, which is
+	// reported in the job's fraction completed and running status.
+	// contentHash is the content hash of the last transfer, which is skipped
+	// if its statistics did not change.
+	var highWater hlc.Timestamp
+	var checkpoint activityTransferCheckpoint
+	var transferProgress activityTransferProgress
+	var contentHash activityContentHash
+	if progress := j.job.Progress().GetUpdateSqlActivity(); progress != nil {
+		highWater = progress.HighWater
+		checkpoint = activityTransferCheckpoint{
+			aggTs:           progress.CheckpointAggregatedTs,
+			completedPhases: progress.CompletedPhases,
+		}
+		contentHash = activityContentHash{
+			aggTs: progress.ContentHashAggregatedTs,
+			hash:  progress.ContentHash,
+		}
+	}
+	progressDetails := func() jobspb.AutoUpdateSQLActivityProgress {
+		return jobspb.AutoUpdateSQLActivityProgress{
+			HighWater:               highWater,
+			CheckpointAggregatedTs:  checkpoint.aggTs,
+			CompletedPhases:         checkpoint.completedPhases,
+			Phase:                   transferProgress.phase,
+			RowsDone:                transferProgress.rowsDone,
+			RowsEstimate:            transferProgress.rowsEstimate,
+			ContentHashAggregatedTs: contentHash.aggTs,
+			ContentHash:             contentHash.hash,
+		}
+	}
+	saveProgress := func(ctx context.Context) error {
+		return j.job.NoTxn().SetProgress(ctx, progressDetails())
+	}
+	saveTransferProgress := func(ctx context.Context) error {
+		return j.job.NoTxn().Update(ctx, func(_ isql.Txn, md jobs.JobMetadata, ju *jobs.JobUpdater) error {
+			if err := md.CheckRunningOrReverting(); err != nil {
+				return err
+			}
+			md.Progress.Details = jobspb.WrapProgressDetails(progressDetails())
+			md.Progress.Progress = &jobspb.Progress_FractionCompleted{
+				FractionCompleted: transferProgress.fraction(),
+			}
+			md.Progress.RunningStatus = transferProgress.status()
+			ju.UpdateProgress(md.Progress)
+			return nil
+		})
+	}
+
 	flushDoneSignal := make(chan struct{})
 	defer func() {
 		statsFlush.SetFlushDoneSignalCh(nil)
@@ -103,10 +815,49 @@ func (j *sqlActivityUpdateJob) Resume(ctx context.Context, execCtxI interface{})
 		case <-flushDoneSignal:
 			// A flush was done. Set the timer and wait for it to complete.
 			if sqlStatsActivityFlushEnabled.Get(&settings.SV) {
-				updater := newSqlActivityUpdater(settings, execCtx.ExecCfg().InternalDB, nil)
-				if err := updater.TransferStatsToActivity(ctx); err != nil {
-					log.Warningf(ctx, "error running sql activity updater job: %v", err)
-					metrics.NumErrors.Inc(1)
+				if !waitActivityTransferJitter(ctx, stopper.ShouldQuiesce()) {
+					return nil
+				}
+				updater := newSqlActivityUpdater(settings, execCtx.ExecCfg().InternalDB, nil, nil /* registry */, nil /* sink */)
+				// The job's metrics are registered with the job registry.
+				updater.metrics = &metrics
+				updater.checkpoint = checkpoint
+				updater.onCheckpoint = func(ctx context.Context, cp activityTransferCheckpoint) error {
+					checkpoint = cp
+					return saveProgress(ctx)
+				}
+				updater.lastContentHash = contentHash
+				updater.onContentHash = func(ctx context.Context, h activityContentHash) error {
+					contentHash = h
+					return saveProgress(ctx)
+				}
+				updater.onProgress = func(ctx context.Context, p activityTransferProgress) error {
+					transferProgress = p
+					return saveTransferProgress(ctx)
+				}
+				newHighWater, err := updater.TransferStatsToActivityIncremental(ctx, highWater)
+				if errors.Is(err, ErrTransferAlreadyRunning) {
+					log.Infof(ctx, "sql activity updater job skipped the transfer: %v", err)
+					continue
+				}
+				if err != nil {
+					var transferErr *TransferError
+					if errors.As(err, &transferErr) {
+						log.Infof(ctx, "sql activity updater job failed in phase %s for window [%s, %s)",
+							redact.SafeString(transferErr.Phase), transferErr.WindowStart, transferErr.WindowEnd)
+					}
+					if isResumableActivityTransferError(err) {
+						log.Infof(ctx, "sql activity updater job did not complete: %v", err)
+					} else {
+						log.Warningf(ctx, "error running sql activity updater job: %v", err)
+					}
+					continue
+				}
+				if newHighWater != highWater {
+					highWater = newHighWater
+					if err := saveProgress(ctx); err != nil {
+						log.Warningf(ctx, "error persisting sql activity updater progress: %v", err)
+					}
 				}
 			}
 		case <-ctx.Done():
@@ -117,10 +868,49 @@ func (j *sqlActivityUpdateJob) Resume(ctx context.Context, execCtxI interface{})
 	}
 }
 
+// flushAndTransferSQLActivity flushes the SQL stats of this node and transfers
+// the statistics of the current aggregated timestamp to the activity tables. It
+// returns the number of rows written to the statement and transaction activity
+// tables. It implements eval.SQLActivityTransferFunc.
+func (cfg *ExecutorConfig) flushAndTransferSQLActivity(
+	ctx context.Context,
+) (stmtRows int64, txnRows int64, err error) {
+	if cfg.InternalDB == nil || cfg.InternalDB.server == nil {
+		return 0, 0, errors.AssertionFailedf("sql server not set")
+	}
+	// The metrics of the updater count the rows it writes.
+	updater := newSqlActivityUpdater(cfg.Settings, cfg.InternalDB, cfg.SQLStatsTestingKnobs, metric.NewRegistry(), nil /* sink */)
+	updater.flushBarrier = cfg.InternalDB.server.sqlStats.ForceFlush
+	if err := updater.TransferStatsToActivity(ctx); err != nil {
+		return 0, 0, err
+	}
+	return updater.metrics.NumStmtRowsTransferred.Count(), updater.metrics.NumTxnRowsTransferred.Count(), nil
+}
+
 // ActivityUpdaterMetrics must be public for metrics to get
 // registered
 type ActivityUpdaterMetrics struct {
-	NumErrors *metric.Counter
+	NumErrors              *metric.Counter
+	NumStmtRowsTransferred *metric.Counter
+	NumTxnRowsTransferred  *metric.Counter
+	NumRowsZeroed          *metric.Counter
+	NumVerifyMismatches    *metric.Counter
+	NumFailedWindows       *metric.Counter
+	NumSkippedNotReady     *metric.Counter
+	NumSkippedUnchanged    *metric.Counter
+	NumOversizedRows       *metric.Counter
+	TransferDuration       metric.IHistogram
+
+	// The keys admitted into the activity tables by each ranking column, and
+	// the distinct keys admitted by the last transfer.
+	NumAdmittedByExecutionCount     *metric.Counter
+	NumAdmittedByServiceLatency     *metric.Counter
+	NumAdmittedByTotalExecutionTime *metric.Counter
+	NumAdmittedByContentionTime     *metric.Counter
+	NumAdmittedByCPUSQLNanos        *metric.Counter
+	NumAdmittedByP99Latency         *metric.Counter
+	NumUniqueAdmittedRows           *metric.Gauge
+	AdmittedRowsOverlapRatio        *metric.GaugeFloat64
 }
 
 func (m ActivityUpdaterMetrics) MetricStruct() {}
@@ -134,6 +924,129 @@ func newActivityUpdaterMetrics() metric.Struct {
 			Unit:        metric.Unit_COUNT,
 			MetricType:  io_prometheus_client.MetricType_COUNTER,
 		}),
+		NumStmtRowsTransferred: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.statement.rows_transferred",
+			Help:        "Number of rows written to system.statement_activity by the sql activity updater",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumTxnRowsTransferred: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.transaction.rows_transferred",
+			Help:        "Number of rows written to system.transaction_activity by the sql activity updater",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumRowsZeroed: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.rows_zeroed",
+			Help:        "Number of statistics rows transferred with missing ranking fields treated as zero",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumVerifyMismatches: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.verify.mismatches",
+			Help:        "Number of activity fingerprints whose execution count did not match the statistics tables after a transfer",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumFailedWindows: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.transfer.failed_windows",
+			Help:        "Number of aggregated timestamps whose statistics failed to be transferred to the activity tables",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumSkippedNotReady: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.transfer.skipped_not_ready",
+			Help:        "Number of transfers skipped since the activity tables or their database were not ready to be written",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumSkippedUnchanged: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.transfer.skipped_unchanged",
+			Help:        "Number of transfers of aggregated timestamps skipped since their statistics did not change since they were last transferred",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumOversizedRows: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.transfer.oversized_rows",
+			Help:        "Number of statement activity rows truncated or skipped since they were larger than sql.stats.activity.transfer.max_row_bytes",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		TransferDuration: metric.NewHistogram(metric.HistogramOptions{
+			Mode: metric.HistogramModePreferHdrLatency,
+			Metadata: metric.Metadata{
+				Name:        "sql.stats.activity.transfer.duration",
+				Help:        "Time in nanoseconds to transfer the sql stats to the activity tables",
+				Measurement: "SQL Stats Activity",
+				Unit:        metric.Unit_NANOSECONDS,
+			},
+			Duration:     base.DefaultHistogramWindowInterval(),
+			BucketConfig: metric.IOLatencyBuckets,
+		}),
+		NumAdmittedByExecutionCount: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.execution_count",
+			Help:        "Number of statistics rows admitted into the activity tables by their rank by execution count",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumAdmittedByServiceLatency: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.service_latency",
+			Help:        "Number of statistics rows admitted into the activity tables by their rank by service latency",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumAdmittedByTotalExecutionTime: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.total_execution_time",
+			Help:        "Number of statistics rows admitted into the activity tables by their rank by total execution time",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumAdmittedByContentionTime: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.contention_time",
+			Help:        "Number of statistics rows admitted into the activity tables by their rank by contention time",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumAdmittedByCPUSQLNanos: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.cpu_sql_nanos",
+			Help:        "Number of statistics rows admitted into the activity tables by their rank by SQL CPU time",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumAdmittedByP99Latency: metric.NewCounter(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.p99_latency",
+			Help:        "Number of statistics rows admitted into the activity tables by their rank by p99 latency",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_COUNTER,
+		}),
+		NumUniqueAdmittedRows: metric.NewGauge(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.unique",
+			Help:        "Number of distinct statistics rows admitted into the activity tables by the ranking columns in the last transfer",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_COUNT,
+			MetricType:  io_prometheus_client.MetricType_GAUGE,
+		}),
+		AdmittedRowsOverlapRatio: metric.NewGaugeFloat64(metric.Metadata{
+			Name:        "sql.stats.activity.top.admitted.overlap_ratio",
+			Help:        "Ratio of the distinct statistics rows admitted into the activity tables to the sum of the rows admitted by each ranking column in the last transfer",
+			Measurement: "SQL Stats Activity",
+			Unit:        metric.Unit_CONST,
+			MetricType:  io_prometheus_client.MetricType_GAUGE,
+		}),
 	}
 }
 
@@ -165,29 +1078,447 @@ func init() {
 	)
 }
 
-// newSqlActivityUpdater returns a new instance of sqlActivityUpdater.
+// TriggerSQLActivityTransfer flushes the in-memory SQL stats of this node to
+// the system tables and transfers the statistics of the current aggregated
+// timestamp to the activity tables, returning once the transfer completes. It
+// runs regardless of the schedule of the sql activity update job and of
+// sql.stats.activity.flush.enabled. The flush is a barrier: the statements
+// which completed before it was called are transferred.
+func (s *Server) TriggerSQLActivityTransfer(ctx context.Context) error {
+	updater := newSqlActivityUpdater(s.cfg.Settings, s.cfg.InternalDB, s.cfg.SQLStatsTestingKnobs, nil /* registry */, nil /* sink */)
+	updater.flushBarrier = s.sqlStats.ForceFlush
+	return updater.TransferStatsToActivity(ctx)
+}
+
+// newSqlActivityUpdater returns a new instance of sqlActivityUpdater. If
+// registry is non-nil, a new set of ActivityUpdaterMetrics is registered with
+// it and updated by the returned updater. If sink is non-nil, the rows written
+// to the activity tables are also passed to it after each transfer.
 func newSqlActivityUpdater(
-	setting *cluster.Settings, db isql.DB, testingKnobs *sqlstats.TestingKnobs,
+	setting *cluster.Settings,
+	db isql.DB,
+	testingKnobs *sqlstats.TestingKnobs,
+	registry *metric.Registry,
+	sink ActivitySink,
 ) *sqlActivityUpdater {
-	return &sqlActivityUpdater{
-		st:           setting,
-		db:           db,
-		testingKnobs: testingKnobs,
+	if sink == nil {
+		sink = noopActivitySink{}
 	}
+	u := &sqlActivityUpdater{
+		st:                 setting,
+		db:                 db,
+		testingKnobs:       testingKnobs,
+		transferBatchSize:  sqlStatsActivityTransferBatchSize.Get(&setting.SV),
+		topLimits:          makeActivityTopLimits(&setting.SV),
+		ignoredAppNames:    sqlStatsActivityIgnoredAppNames.Get(&setting.SV),
+		anonymizeQueryText: sqlStatsActivityAnonymizeQueryText.Get(&setting.SV),
+		includeHistograms:  sqlStatsActivityTransferIncludeHistograms.Get(&setting.SV),
+		maxRowBytes:        sqlStatsActivityTransferMaxRowBytes.Get(&setting.SV),
+		maxAppNames:        sqlStatsActivityTransferMaxAppNames.Get(&setting.SV),
+		aggregateApps:      sqlStatsActivityTransferAggregateApps.Get(&setting.SV),
+		txnActivityTable:   activityTableName(&setting.SV, sqlStatsActivityTxnTable),
+		stmtActivityTable:  activityTableName(&setting.SV, sqlStatsActivityStmtTable),
+		sink:               sink,
+	}
+	if registry != nil {
+		metrics := newActivityUpdaterMetrics().(ActivityUpdaterMetrics)
+		registry.AddMetricStruct(metrics)
+		u.metrics = &metrics
+	}
+	return u
 }
 
 type sqlActivityUpdater struct {
 	st           *cluster.Settings
 	testingKnobs *sqlstats.TestingKnobs
 	db           isql.DB
+
+	// transferBatchSize is the number of fingerprints written to the activity
+	// tables per transaction. If it is 0 the transfer is done in a single pass.
+	transferBatchSize int64
+
+	// topLimits are the number of rows selected per ranking column when only
+	// the top statistics are transferred.
+	topLimits activityTopLimits
+
+	// ignoredAppNames is a regular expression matching the app names which are
+	// not transferred. If it is empty all the app names are transferred.
+	ignoredAppNames string
+
+	// anonymizeQueryText is set if the query text is blanked out in the
+	// metadata of the statement_activity rows.
+	anonymizeQueryText bool
+
+	// includeHistograms is set if the serialized latency distributions of the
+	// statement statistics are copied into the metadata of the
+	// statement_activity rows.
+	includeHistograms bool
+
+	// maxRowBytes is the size above which the metadata of the
+	// statement_activity rows is truncated. If it is 0 the rows are not
+	// limited.
+	maxRowBytes int64
+
+	// maxAppNames is the number of app names kept distinct in the activity
+	// tables, the others are rolled up into the (other) app name. If it is 0
+	// every app name is kept.
+	maxAppNames int64
+
+	// aggregateApps is set if the statistics of every app name are merged into
+	// rows with the (all) app name before they are ranked.
+	aggregateApps bool
+
+	// txnActivityTable and stmtActivityTable are the quoted names of the tables
+	// the statistics are transferred to.
+	txnActivityTable, stmtActivityTable string
+
+	// metrics, if set, are updated on every transfer.
+	metrics *ActivityUpdaterMetrics
+
+	// sink receives the rows of the activity tables after each transfer.
+	sink ActivitySink
+
+	// checkpoint holds the completed phases of a previous transfer which did
+	// not complete. The completed phases are skipped.
+	checkpoint activityTransferCheckpoint
+
+	// onCheckpoint, if set, is called whenever the checkpoint changes.
+	onCheckpoint func(context.Context, activityTransferCheckpoint) error
+
+	// progress is the progress of the running transfer.
+	progress activityTransferProgress
+
+	// onProgress, if set, is called whenever the progress changes. Its errors
+	// are logged, and do not fail the transfer.
+	onProgress func(context.Context, activityTransferProgress) error
+
+	// flushBarrier, if set, is called by TransferStatsToActivity before the
+	// statistics are read. It synchronously flushes the in-memory SQL stats to
+	// the statistics tables, so that the statements which completed before the
+	// transfer started are transferred rather than left for the next transfer.
+	flushBarrier func(context.Context)
+
+	// lastContentHash is the content hash of the last transfer, which is
+	// skipped if the hash did not change. See checkUnchanged.
+	lastContentHash activityContentHash
+
+	// onContentHash, if set, is called whenever lastContentHash changes.
+	onContentHash func(context.Context, activityContentHash) error
+
+	// tables is the set of the activity tables written by the running
+	// transfer. See TransferStatementsOnly.
+	tables activityTransferTables
 }
 
+// TransferStatsToActivity transfers the statistics of the current aggregated
+// timestamp to the activity tables, recording the outcome in the updater's
+// metrics. If the updater has a flushBarrier, the in-memory SQL stats are
+// flushed first. It runs the phases of both TransferTransactionsOnly and
+// TransferStatementsOnly, followed by the steps which span both tables.
 func (u *sqlActivityUpdater) TransferStatsToActivity(ctx context.Context) error {
+	return u.transferCurrentTables(ctx, activityTransferAllTables)
+}
+
+// TransferStatsToActivityForWindow transfers the statistics of every
+// aggregated timestamp in [start, end) to the activity tables, recording the
+// outcome in the updater's metrics. The start of the window is truncated to
+// the aggregation interval. The top statistics are selected separately for
+// each aggregated timestamp, and only the activity rows of the aggregated
+// timestamps in the window are written. The aggregated timestamps are
+// transferred independently: the failure of one is counted in the updater's
+// metrics and does not prevent the transfer of the others, and the errors of
+// all the failed ones are combined in the returned error. The aggregated
+// timestamps whose activity rows were already rolled up by
+// sql.stats.activity.rollup.after fail without being transferred. If another
+// transfer is running, it returns ErrTransferAlreadyRunning without
+// transferring anything. If the activity tables are not ready to be written, or
+// the transfers are paused by sql.stats.activity.transfer.enabled, the transfer
+// is skipped and nil is returned.
+func (u *sqlActivityUpdater) TransferStatsToActivityForWindow(
+	ctx context.Context, start time.Time, end time.Time,
+) error {
+	return u.transferTablesForWindow(ctx, start, end, activityTransferAllTables)
+}
+
+// transferTablesForWindow is like TransferStatsToActivityForWindow, but only
+// writes the given activity tables.
+func (u *sqlActivityUpdater) transferTablesForWindow(
+	ctx context.Context, start time.Time, end time.Time, tables activityTransferTables,
+) error {
+	if u.transferPaused(ctx) {
+		return nil
+	}
+	ctx, release, err := u.claimTransfer(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	u.tables = tables
+	defer func() { u.tables = activityTransferAllTables }()
+	if !u.activityTablesReady(ctx) {
+		return nil
+	}
+	transferStart := timeutil.Now()
+	err = wrapTransferError(u.checkActivityTables(ctx), activityTransferPhasePrepare, start, end)
+	if err == nil {
+		err = u.transferStatsToActivityForWindow(ctx, start, end)
+	}
+	// The retention and the rollup span both activity tables, and the last
+	// transfer must have written both.
+	if err == nil && tables.all() {
+		err = wrapTransferError(u.deleteExpiredActivity(ctx), activityTransferPhaseRetention, start, end)
+	}
+	if err == nil && tables.all() {
+		err = wrapTransferError(u.maybeRollupActivityByTime(ctx), activityTransferPhaseTimeRollup, start, end)
+	}
+	if err == nil && tables.all() {
+		// The last window ends at the end of the window, rounded up to the
+		// aggregation interval.
+		interval := persistedsqlstats.SQLStatsAggregationInterval.Get(&u.st.SV)
+		u.recordLastTransfer(ctx, end.Add(interval-1).Truncate(interval))
+	}
+	u.recordTransfer(transferStart, err)
+	return err
+}
+
+func (u *sqlActivityUpdater) transferStatsToActivityForWindow(
+	ctx context.Context, start time.Time, end time.Time,
+) error {
+	interval := persistedsqlstats.SQLStatsAggregationInterval.Get(&u.st.SV)
+	var windowErrs error
+	for aggTs := start.Truncate(interval); aggTs.Before(end); aggTs = aggTs.Add(interval) {
+		err := u.checkNotRolledUp(ctx, aggTs)
+		if err == nil {
+			err = u.transferStatsToActivity(ctx, aggTs)
+		}
+		if err != nil {
+			if u.metrics != nil {
+				u.metrics.NumFailedWindows.Inc(1)
+			}
+			windowErrs = errors.CombineErrors(windowErrs, err)
+			// The following windows would fail the same way once the transfer
+			// is canceled.
+			if ctx.Err() != nil {
+				return windowErrs
+			}
+			log.Warningf(ctx, "sql stats activity failed to transfer the statistics at %s: %v", aggTs, err)
+		}
+	}
+	return windowErrs
+}
+
+// recordTransfer records the outcome of a transfer which started at start.
+func (u *sqlActivityUpdater) recordTransfer(start time.Time, err error) {
+	if u.metrics == nil {
+		return
+	}
+	if err != nil {
+		u.metrics.NumErrors.Inc(1)
+	} else {
+		u.metrics.TransferDuration.RecordValue(timeutil.Since(start).Nanoseconds())
+	}
+}
+
+// runPhase runs a phase of the transfer of aggTs, unless the checkpoint shows
+// it already completed, and checkpoints it once it completes. The phase is
+// bounded by sql.stats.activity.transfer.phase_timeout. Batches which were
+// committed before the phase timed out are kept, and the returned error is
+// marked as resumable.
+func (u *sqlActivityUpdater) runPhase(
+	ctx context.Context, aggTs time.Time, phase string, fn func(ctx context.Context) error,
+) error {
+	if u.checkpoint.completed(aggTs, phase) {
+		log.Infof(ctx, "sql stats activity skipping completed phase %s at %s", phase, aggTs)
+		return nil
+	}
+	if !u.tables.includesPhase(phase) {
+		return nil
+	}
+
+	u.updateProgress(ctx, func(p *activityTransferProgress) {
+		p.phase = phase
+	})
+	runFn := func(ctx context.Context) error {
+		if u.testingKnobs != nil && u.testingKnobs.OnActivityTransferPhaseStart != nil {
+			if err := u.testingKnobs.OnActivityTransferPhaseStart(ctx, phase); err != nil {
+				return err
+			}
+		}
+		return fn(ctx)
+	}
+	var err error
+	if timeout := sqlStatsActivityTransferPhaseTimeout.Get(&u.st.SV); timeout > 0 {
+		err = timeutil.RunWithTimeout(ctx, "sql activity transfer "+phase, timeout, runFn)
+	} else {
+		err = runFn(ctx)
+	}
+	if err != nil {
+		if ctx.Err() == nil && errors.HasType(err, (*timeutil.TimeoutError)(nil)) {
+			err = errors.Mark(errors.Wrapf(err,
+				"phase %s timed out; the transfer will resume from this phase", phase),
+				errActivityTransferResumable)
+		}
+		return wrapTransferError(err, phase, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+
+	checkpoint := activityTransferCheckpoint{aggTs: aggTs}
+	if u.checkpoint.aggTs.Equal(aggTs) {
+		checkpoint.completedPhases = append(checkpoint.completedPhases, u.checkpoint.completedPhases...)
+	}
+	checkpoint.completedPhases = append(checkpoint.completedPhases, phase)
+	return u.setCheckpoint(ctx, checkpoint)
+}
+
+// clearCheckpoint clears the checkpoint once all the phases of a transfer
+// completed.
+func (u *sqlActivityUpdater) clearCheckpoint(ctx context.Context) error {
+	if u.checkpoint.isEmpty() {
+		return nil
+	}
+	return u.setCheckpoint(ctx, activityTransferCheckpoint{})
+}
+
+func (u *sqlActivityUpdater) setCheckpoint(
+	ctx context.Context, checkpoint activityTransferCheckpoint,
+) error {
+	u.checkpoint = checkpoint
+	if u.onCheckpoint != nil {
+		return u.onCheckpoint(ctx, checkpoint)
+	}
+	return nil
+}
+
+// updateProgress applies fn to the progress of the running transfer and
+// reports it.
+func (u *sqlActivityUpdater) updateProgress(
+	ctx context.Context, fn func(p *activityTransferProgress),
+) {
+	fn(&u.progress)
+	if u.onProgress == nil {
+		return
+	}
+	if err := u.onProgress(ctx, u.progress); err != nil {
+		log.Warningf(ctx, "sql stats activity failed to report the progress of the transfer: %v", err)
+	}
+}
+
+// estimateTransferRows returns the estimated number of rows written to the
+// activity tables by a transfer of statistics with the given row counts.
+func (u *sqlActivityUpdater) estimateTransferRows(
+	topLimits activityTopLimits, stmtRowCount int64, txnRowCount int64,
+) int64 {
+	if u.shouldTransferAll(topLimits, stmtRowCount, txnRowCount) {
+		return stmtRowCount + txnRowCount
+	}
+	stmtRows, txnRows := topLimits.maxStmtRows(), topLimits.maxTxnRows()
+	if stmtRowCount < stmtRows {
+		stmtRows = stmtRowCount
+	}
+	if txnRowCount < txnRows {
+		txnRows = txnRowCount
+	}
+	return stmtRows + txnRows
+}
+
+// recordRowsTransferred records the number of rows written to the activity
+// tables, in the metrics and the progress of the transfer.
+func (u *sqlActivityUpdater) recordRowsTransferred(ctx context.Context, stmtRows int, txnRows int) {
+	u.updateProgress(ctx, func(p *activityTransferProgress) {
+		p.rowsDone += int64(stmtRows + txnRows)
+	})
+	if u.metrics == nil {
+		return
+	}
+	u.metrics.NumStmtRowsTransferred.Inc(int64(stmtRows))
+	u.metrics.NumTxnRowsTransferred.Inc(int64(txnRows))
+}
+
+// transferStatsToActivity transfers the statistics of the given aggregated
+// timestamp to the activity tables, skipping the phases which completed
+// according to the checkpoint. The checkpoint is cleared once all the phases
+// complete.
+func (u *sqlActivityUpdater) transferStatsToActivity(ctx context.Context, aggTs time.Time) error {
+	u.startProgress(ctx, aggTs)
+	if u.testingKnobs != nil && u.testingKnobs.OnActivityTransferWindowStart != nil {
+		if err := u.testingKnobs.OnActivityTransferWindowStart(ctx, aggTs); err != nil {
+			return wrapTransferError(err, activityTransferPhasePrepare, aggTs, u.aggregationWindowEnd(aggTs))
+		}
+	}
+	var contentHash activityContentHash
+	if u.tables.all() {
+		var unchanged bool
+		var err error
+		contentHash, unchanged, err = u.checkUnchanged(ctx, aggTs)
+		if err != nil {
+			return wrapTransferError(err, activityTransferPhasePrepare, aggTs, u.aggregationWindowEnd(aggTs))
+		}
+		if unchanged {
+			u.finishProgress(ctx)
+			return nil
+		}
+	}
+	if err := u.runTransferPhases(ctx, aggTs); err != nil {
+		return wrapTransferError(err, activityTransferPhasePrepare, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err := u.maybeRollupAppNames(ctx, aggTs); err != nil {
+		return err
+	}
+	if err := u.clearCheckpoint(ctx); err != nil {
+		return wrapTransferError(err, activityTransferPhaseCheckpoint, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if !u.tables.includes(activityTransferStmtTable) {
+		u.finishProgress(ctx)
+		return nil
+	}
+	if err := u.maybeHandleOversizedActivity(ctx, aggTs); err != nil {
+		return wrapTransferError(err, activityTransferPhaseOversizedRows, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err := u.maybeDedupActivity(ctx, aggTs); err != nil {
+		return wrapTransferError(err, activityTransferPhaseDedup, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if !u.tables.all() {
+		u.finishProgress(ctx)
+		return nil
+	}
+	u.maybeVerifyActivity(ctx, aggTs)
+	u.maybeRecordRankingMetrics(ctx, aggTs)
+	if err := u.emitActivityToSink(ctx, aggTs); err != nil {
+		return wrapTransferError(err, activityTransferPhaseSink, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err := u.recordContentHash(ctx, contentHash); err != nil {
+		return wrapTransferError(err, activityTransferPhaseCheckpoint, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	u.finishProgress(ctx)
+	return nil
+}
+
+// startProgress resets the progress for the transfer of the aggregated
+// timestamp.
+func (u *sqlActivityUpdater) startProgress(ctx context.Context, aggTs time.Time) {
+	u.updateProgress(ctx, func(p *activityTransferProgress) {
+		*p = activityTransferProgress{aggTs: aggTs, phase: activityTransferPhasePrepare}
+	})
+}
+
+// finishProgress marks the transfer as completed.
+func (u *sqlActivityUpdater) finishProgress(ctx context.Context) {
+	u.updateProgress(ctx, func(p *activityTransferProgress) {
+		p.phase = ""
+		p.done = true
+	})
+}
+
+// aggregationWindowEnd returns the end of the window of the aggregated
+// timestamp.
+func (u *sqlActivityUpdater) aggregationWindowEnd(aggTs time.Time) time.Time {
+	return aggTs.Add(persistedsqlstats.SQLStatsAggregationInterval.Get(&u.st.SV))
+}
+
+func (u *sqlActivityUpdater) runTransferPhases(ctx context.Context, aggTs time.Time) error {
 	// Get the config and pass it around to avoid any issue of it changing
 	// in the middle of the execution.
 	maxRowPersistedRows := sqlStatsActivityMaxPersistedRows.Get(&u.st.SV)
-	topLimit := sqlStatsActivityTopCount.Get(&u.st.SV)
-	aggTs := u.computeAggregatedTs(&u.st.SV)
+	topLimits := u.topLimits
 
 	// The counts are using AS OF SYSTEM TIME so the values may be slightly
 	// off. This is acceptable to increase the performance.
@@ -196,33 +1527,80 @@ func (u *sqlActivityUpdater) TransferStatsToActivity(ctx context.Context) error
 		return err
 	}
 
+	u.updateProgress(ctx, func(p *activityTransferProgress) {
+		p.rowsEstimate = u.estimateTransferRows(topLimits, stmtRowCount, txnRowCount)
+	})
+
 	// No need to continue since there are no rows to transfer
 	if stmtRowCount == 0 && txnRowCount == 0 {
 		log.Infof(ctx, "sql stats activity found no rows at %s", aggTs)
 		return nil
 	}
 
+	if err := u.recordMalformedStatsRows(ctx, aggTs); err != nil {
+		return err
+	}
+
 	// Create space on the table before adding new rows to avoid
 	// going OVER the count. If the compaction fails it will not
-	// add any new rows.
-	err = u.compactActivityTables(ctx, maxRowPersistedRows-stmtRowCount)
-	if err != nil {
-		return err
+	// add any new rows. The compaction keeps both tables in sync, so it is
+	// only done when both are written.
+	if u.tables.all() {
+		err = u.compactActivityTables(ctx, maxRowPersistedRows-stmtRowCount)
+		if err != nil {
+			return err
+		}
 	}
 
-	// There are fewer rows than filtered top would return.
-	// Just transfer all the stats to avoid overhead of getting
-	// the tops.
-	if stmtRowCount < (topLimit*numberOfStmtTopColumns) && txnRowCount < (topLimit*numberOfTxnTopColumns) {
+	if u.aggregateApps {
+		return u.transferStatsAggregatedOverApps(ctx, aggTs, topLimits,
+			u.shouldTransferAll(topLimits, stmtRowCount, txnRowCount),
+			totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
+	}
+
+	// There are fewer rows than filtered top would return, or the top
+	// selection is disabled. Just transfer all the stats to avoid overhead of
+	// getting the tops.
+	if u.shouldTransferAll(topLimits, stmtRowCount, txnRowCount) {
+		if sqlStatsActivityTransferCombined.Get(&u.st.SV) && u.tables.all() {
+			return u.transferAllStatsCombined(ctx, aggTs, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
+		}
+		if u.transferBatchSize > 0 {
+			return u.transferAllStatsInBatches(ctx, aggTs, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
+		}
 		return u.transferAllStats(ctx, aggTs, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
 	}
 
 	// Only transfer the top sql.stats.activity.top.max for each of
 	// the 6 most popular columns
-	err = u.transferTopStats(ctx, aggTs, topLimit, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
+	if u.transferBatchSize > 0 {
+		return u.transferTopStatsInBatches(ctx, aggTs, topLimits, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
+	}
+	if bulkThreshold := sqlStatsActivityTransferBulkThreshold.Get(&u.st.SV); bulkThreshold > 0 {
+		return u.transferTopStatsWithBulkThreshold(ctx, aggTs, topLimits, bulkThreshold, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
+	}
+	err = u.transferTopStats(ctx, aggTs, topLimits, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds)
 	return err
 }
 
+// shouldTransferAll returns whether all the statistics of an aggregated
+// timestamp with the given row counts are transferred, rather than only the
+// top statistics.
+func (u *sqlActivityUpdater) shouldTransferAll(
+	topLimits activityTopLimits, stmtRowCount int64, txnRowCount int64,
+) bool {
+	if sqlStatsActivityTransferUnlimited.Get(&u.st.SV) {
+		return true
+	}
+	// The fingerprints executed fewer than the minimum execution count are only
+	// excluded from the ranked statistics.
+	if topLimits.minExecCount > 0 {
+		return false
+	}
+	// There are fewer rows than filtered top would return.
+	return stmtRowCount < topLimits.maxStmtRows() && txnRowCount < topLimits.maxTxnRows()
+}
+
 // transferAllStats is used to transfer all the stats FROM
 // system.statement_statistics and system.transaction_statistics
 // to system.statement_activity and system.transaction_activity
@@ -232,13 +1610,51 @@ func (u *sqlActivityUpdater) transferAllStats(
 	totalEstimatedStmtClusterExecSeconds float64,
 	totalEstimatedTxnClusterExecSeconds float64,
 ) error {
-	// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
-	_, err := u.db.Executor().ExecEx(ctx,
-		"activity-flush-txn-transfer-all",
-		nil, /* txn */
-		sessiondata.NodeUserSessionDataOverride,
-		`
-			UPSERT INTO system.public.transaction_activity 
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		txnRows, err := u.db.Executor().ExecEx(ctx,
+			"activity-flush-txn-transfer-all",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			u.txnTransferAllQuery("$1"),
+			totalEstimatedTxnClusterExecSeconds,
+			aggTs,
+			u.ignoredAppNames,
+		)
+		if err != nil {
+			return err
+		}
+		u.recordRowsTransferred(ctx, 0 /* stmtRows */, txnRows)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		stmtRows, err := u.db.Executor().ExecEx(ctx,
+			"activity-flush-stmt-transfer-all",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			u.stmtTransferAllQuery("$1"),
+			totalEstimatedStmtClusterExecSeconds,
+			aggTs,
+			u.ignoredAppNames,
+		)
+		if err != nil {
+			return err
+		}
+		u.recordRowsTransferred(ctx, stmtRows, 0 /* txnRows */)
+		return nil
+	})
+}
+
+// txnTransferAllQuery upserts all the transaction statistics of the
+// aggregated timestamp $2 whose app names do not match $3 into the
+// transaction activity table, using clusterSecondsParam as the
+// execution_total_cluster_seconds.
+// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
+func (u *sqlActivityUpdater) txnTransferAllQuery(clusterSecondsParam string) string {
+	return `
+			UPSERT INTO ` + u.txnActivityTable + ` 
 (aggregated_ts, fingerprint_id, app_name, agg_interval, metadata,
  statistics, query, execution_count, execution_total_seconds,
  execution_total_cluster_seconds, contention_time_avg_seconds, 
@@ -247,12 +1663,12 @@ func (u *sqlActivityUpdater) transferAllStats(
             fingerprint_id,
             app_name,
             max_agg_interval,
-            metadata,
+            ` + txnActivityMetadata("metadata", "statistics") + `,
             statistics,
             '' AS query,
             (statistics->'statistics'->>'cnt')::int,
             ((statistics->'statistics'->>'cnt')::float)*((statistics->'statistics'->'svcLat'->>'mean')::float),
-            $1 AS execution_total_cluster_seconds,
+            ` + clusterSecondsParam + ` AS execution_total_cluster_seconds,
             COALESCE((statistics->'execution_statistics'->'contentionTime'->>'mean')::float,0),
             COALESCE((statistics->'execution_statistics'->'cpuSQLNanos'->>'mean')::float,0),
             (statistics->'statistics'->'svcLat'->>'mean')::float,
@@ -266,26 +1682,18 @@ func (u *sqlActivityUpdater) transferAllStats(
                   merge_transaction_stats(statistics) AS statistics
            FROM system.public.transaction_statistics
            WHERE aggregated_ts = $2
-             and app_name not like '$ internal%'
+             and ($3::STRING = '' OR app_name !~ $3)
            GROUP BY app_name,
-                    fingerprint_id));
-`,
-		totalEstimatedTxnClusterExecSeconds,
-		aggTs,
-	)
-
-	if err != nil {
-		return err
-	}
+                    fingerprint_id))`
+}
 
-	// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
-	_, err = u.db.Executor().ExecEx(ctx,
-		"activity-flush-stmt-transfer-all",
-		nil, /* txn */
-		sessiondata.NodeUserSessionDataOverride,
-		`
+// stmtTransferAllQuery is the equivalent of txnTransferAllQuery for the
+// statement activity table.
+// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
+func (u *sqlActivityUpdater) stmtTransferAllQuery(clusterSecondsParam string) string {
+	return `
 			UPSERT
-INTO system.public.statement_activity (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
+INTO ` + u.stmtActivityTable + ` (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
                                        agg_interval, metadata, statistics, plan, index_recommendations, execution_count,
                                        execution_total_seconds, execution_total_cluster_seconds,
                                        contention_time_avg_seconds,
@@ -297,14 +1705,14 @@ INTO system.public.statement_activity (aggregated_ts, fingerprint_id, transactio
             plan_hash,
             app_name,
             max_agg_interval,
-            merged_metadata,
+            ` + u.stmtActivityMetadata("merged_metadata") + `,
             merged_stats,
             max_plan,
             jsonb_array_to_string_array(merged_stats -> 'index_recommendations') as idx_rec,
             (merged_stats -> 'statistics' ->> 'cnt')::int,
             ((merged_stats -> 'statistics' ->> 'cnt')::float) *
             ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
-            $1 AS execution_total_cluster_seconds,
+            ` + clusterSecondsParam + ` AS execution_total_cluster_seconds,
             COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
             COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
             (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
@@ -314,21 +1722,15 @@ INTO system.public.statement_activity (aggregated_ts, fingerprint_id, transactio
                   plan_hash,
                   app_name,
                   max(agg_interval) as max_agg_interval,
-                  merge_stats_metadata(metadata)    AS merged_metadata,
+                  ` + u.stmtLatencyHistogramsColumn("statistics") + `merge_stats_metadata(metadata) AS merged_metadata,
                   merge_statement_stats(statistics) AS merged_stats,
                   max(plan) AS max_plan
            FROM system.public.statement_statistics
            WHERE aggregated_ts = $2
-             and app_name not like '$ internal%'
+             and ($3::STRING = '' OR app_name !~ $3)
            GROUP BY app_name,
                     fingerprint_id,
-                    plan_hash));
-`,
-		totalEstimatedStmtClusterExecSeconds,
-		aggTs,
-	)
-
-	return err
+                    plan_hash))`
 }
 
 // transferTopStats is used to transfer top N stats FROM
@@ -337,7 +1739,7 @@ INTO system.public.statement_activity (aggregated_ts, fingerprint_id, transactio
 func (u *sqlActivityUpdater) transferTopStats(
 	ctx context.Context,
 	aggTs time.Time,
-	topLimit int64,
+	topLimits activityTopLimits,
 	totalEstimatedStmtClusterExecSeconds float64,
 	totalEstimatedTxnClusterExecSeconds float64,
 ) (retErr error) {
@@ -345,36 +1747,41 @@ func (u *sqlActivityUpdater) transferTopStats(
 	// Deleting and inserting the activity tables needs to be done in the same
 	// transaction. A user could try to access the table during the update. If
 	// delete was done in a separate txn the user would get no results.
-	errTxn := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
-
-		// Delete all the rows of the old data from the table for the current
-		// aggregated timestamp. This is necessary because if a customer generates
-		// a lot of fingerprints each time the upsert runs it will add all new rows
-		// instead of updating the existing one. This causes the
-		// transaction_activity to grow too large causing the UI to be slow.
-		_, err := txn.ExecEx(ctx,
-			"activity-flush-txn-transfer-tops",
-			txn.KV(), /* txn */
-			sessiondata.NodeUserSessionDataOverride,
-			`DELETE FROM system.public.transaction_activity WHERE aggregated_ts = $1;`,
-			aggTs)
-
-		if err != nil {
-			return err
-		}
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		var txnRows int
+		errTxn := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+
+			// Delete all the rows of the old data from the table for the current
+			// aggregated timestamp. This is necessary because if a customer generates
+			// a lot of fingerprints each time the upsert runs it will add all new rows
+			// instead of updating the existing one. This causes the
+			// transaction_activity to grow too large causing the UI to be slow.
+			_, err := txn.ExecEx(ctx,
+				"activity-flush-txn-transfer-tops",
+				txn.KV(), /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				`DELETE FROM `+u.txnActivityTable+` WHERE aggregated_ts = $1;`,
+				aggTs)
+
+			if err != nil {
+				return err
+			}
 
-		// Select the top 500 (controlled by sql.stats.activity.top.max) for
-		// each of execution_count, total execution time, service_latency, cpu_sql_nanos,
-		// contention_time and insert into transaction_activity table.
-		// Up to 2500 rows (sql.stats.activity.top.max * 5) may be added to
-		// transaction_activity.
-		// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
-		_, err = txn.ExecEx(ctx,
-			"activity-flush-txn-transfer-tops",
-			txn.KV(), /* txn */
-			sessiondata.NodeUserSessionDataOverride,
-			`
-UPSERT INTO system.public.transaction_activity
+			// Select the top 500 (controlled by sql.stats.activity.top.transactions.max
+			// and sql.stats.activity.top.columns.max) for each of execution_count,
+			// total execution time, service_latency, cpu_sql_nanos, contention_time
+			// (controlled by sql.stats.activity.top.ranking_columns) and insert into
+			// transaction_activity table. The ties of each column are broken by
+			// fingerprint and app name.
+			// Up to topLimits.maxTxnRows() rows, the sum of the limits of the
+			// ranking columns, may be added to transaction_activity.
+			// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
+			txnRows, err = txn.ExecEx(ctx,
+				"activity-flush-txn-transfer-tops",
+				txn.KV(), /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				`
+UPSERT INTO `+u.txnActivityTable+`
 (aggregated_ts, fingerprint_id, app_name, agg_interval, metadata,
  statistics, query, execution_count, execution_total_seconds,
  execution_total_cluster_seconds, contention_time_avg_seconds,
@@ -383,7 +1790,7 @@ UPSERT INTO system.public.transaction_activity
             fingerprint_id,
             app_name,
             agg_interval,
-            metadata,
+            `+txnActivityMetadata("metadata", "merge_stats")+`,
             merge_stats,
             ''  AS query,
             (merge_stats -> 'statistics' ->> 'cnt')::int,
@@ -404,12 +1811,12 @@ UPSERT INTO system.public.transaction_activity
                     inner join (SELECT fingerprint_id, app_name
                                 FROM (SELECT fingerprint_id, app_name,
                                            contentionTime, cpuTime,
-                                            row_number() OVER (ORDER BY (merge_stats -> 'statistics' ->> 'cnt')::int desc) AS ePos,
-                                            row_number() OVER (ORDER BY (merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc) AS sPos,
+                                            row_number() OVER (ORDER BY (merge_stats -> 'statistics' ->> 'cnt')::int desc`+topLimits.txnRankTieBreak()+`) AS ePos,
+                                            row_number() OVER (ORDER BY (merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc`+topLimits.txnRankTieBreak()+`) AS sPos,
                                             row_number() OVER (ORDER BY ((merge_stats -> 'statistics' ->> 'cnt')::float) *
-                                                ((merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc) AS tPos,
-                                            row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc) AS cPos,
-                                            row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc) AS uPos
+                                                ((merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc`+topLimits.txnRankTieBreak()+`) AS tPos,
+                                            row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc`+topLimits.txnRankTieBreak()+`) AS cPos,
+                                            row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc`+topLimits.txnRankTieBreak()+`) AS uPos
                                       FROM (SELECT fingerprint_id, app_name, merge_stats,
                                             (merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float as contentionTime,
                                             (merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float as cpuTime
@@ -417,73 +1824,83 @@ UPSERT INTO system.public.transaction_activity
                                                    merge_transaction_stats(statistics) AS merge_stats
                                             			FROM system.public.transaction_statistics
                                             			WHERE aggregated_ts = $2 and
-                                                  	app_name not like '$ internal%'
-                                            			GROUP BY app_name, fingerprint_id
+                                                  	($5::STRING = '' OR app_name !~ $5)
+                                            			GROUP BY app_name, fingerprint_id`+topLimits.minExecCountFilter()+`
 																						)
 																			)
 																)
-                                WHERE ePos < $3
-                                   or sPos < $3
-                                   or tPos < $3
-                                   or (cPos < $3 AND contentionTime > 0)
-                                   or (uPos < $3 AND cpuTime > 0)) agg
+                                WHERE `+txnTopAdmissionPredicate(topLimits, "$3", "$4")+`) agg
                                on agg.app_name = ts.app_name and agg.fingerprint_id = ts.fingerprint_id
            WHERE aggregated_ts = $2
            GROUP BY ts.aggregated_ts,
                     ts.app_name,
                     ts.fingerprint_id));;
 `,
-			totalEstimatedTxnClusterExecSeconds,
-			aggTs,
-			topLimit,
-		)
+				totalEstimatedTxnClusterExecSeconds,
+				aggTs,
+				topLimits.txn,
+				topLimits.totalTime,
+				u.ignoredAppNames,
+			)
 
-		return err
-	})
+			return err
+		})
 
-	if errTxn != nil {
-		return errTxn
+		if errTxn != nil {
+			return errTxn
+		}
+		u.recordRowsTransferred(ctx, 0 /* stmtRows */, txnRows)
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	errTxn = u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
-
-		// Delete all the rows of the old data from the table for the current
-		// aggregated timestamp. This is necessary because if a customer generates
-		// a lot of fingerprints each time the upsert runs it will add all new rows
-		// instead of updating the existing one. This causes the
-		// transaction_activity to grow too large causing the UI to be slow.
-		_, err := txn.ExecEx(ctx,
-			"activity-flush-txn-transfer-tops",
-			txn.KV(), /* txn */
-			sessiondata.NodeUserSessionDataOverride,
-			`DELETE FROM system.public.statement_activity WHERE aggregated_ts = $1;`,
-			aggTs)
-
-		if err != nil {
-			return err
-		}
+	return u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		var stmtRows int
+		errTxn := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+
+			// Delete all the rows of the old data from the table for the current
+			// aggregated timestamp. This is necessary because if a customer generates
+			// a lot of fingerprints each time the upsert runs it will add all new rows
+			// instead of updating the existing one. This causes the
+			// transaction_activity to grow too large causing the UI to be slow.
+			_, err := txn.ExecEx(ctx,
+				"activity-flush-txn-transfer-tops",
+				txn.KV(), /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				`DELETE FROM `+u.stmtActivityTable+` WHERE aggregated_ts = $1;`,
+				aggTs)
+
+			if err != nil {
+				return err
+			}
 
-		// Select the top 500 (controlled by sql.stats.activity.top.max) for each of
-		// execution_count, total execution time, service_latency, cpu_sql_nanos,
-		// contention_time, p99_latency. Also include all statements that are in the
-		// top N transactions. This is needed so the statement information is
-		// available for the ui so a user can see what is in the transaction.
-		// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
-		_, err = txn.ExecEx(ctx,
-			"activity-flush-stmt-transfer-tops",
-			txn.KV(), /* txn */
-			sessiondata.NodeUserSessionDataOverride,
-			`
+			// Select the top 500 (controlled by sql.stats.activity.top.statements.max
+			// and sql.stats.activity.top.columns.max) for each of
+			// execution_count, total execution time, service_latency, cpu_sql_nanos,
+			// contention_time, p99_latency (controlled by
+			// sql.stats.activity.top.ranking_columns). The ties of each column are
+			// broken by sql.stats.activity.top.tie_break. Up to
+			// topLimits.maxStmtRows() fingerprints may be selected. Also include all
+			// statements that are in the top N transactions. This is needed so the
+			// statement information is available for the ui so a user can see what
+			// is in the transaction.
+			// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
+			stmtRows, err = txn.ExecEx(ctx,
+				"activity-flush-stmt-transfer-tops",
+				txn.KV(), /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				`
 WITH agg_stmt_stats AS (SELECT aggregated_ts,
                                fingerprint_id,
                                app_name,
                                merge_statement_stats(statistics) AS merged_stats
                         FROM system.public.statement_statistics
                         WHERE aggregated_ts = $2
-                          and app_name not like '$ internal%'
+                          and ($5::STRING = '' OR app_name !~ $5)
                         GROUP BY aggregated_ts,
                                  app_name,
-                                 fingerprint_id),
+                                 fingerprint_id`+topLimits.minExecCountFilter()+`),
      limit_stmt_stats AS (SELECT aggregated_ts,
                                  fingerprint_id,
                                  app_name
@@ -491,22 +1908,17 @@ WITH agg_stmt_stats AS (SELECT aggregated_ts,
                                        fingerprint_id,
                                        app_name,
                                        merged_stats,
-                                       row_number() OVER (ORDER BY (merged_stats -> 'statistics' ->> 'cnt')::int desc)                AS ePos,
-                                       row_number() OVER (ORDER BY (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc) AS sPos,
+                                       row_number() OVER (ORDER BY (merged_stats -> 'statistics' ->> 'cnt')::int desc`+topLimits.stmtRankTieBreak()+`)                AS ePos,
+                                       row_number() OVER (ORDER BY (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc`+topLimits.stmtRankTieBreak()+`) AS sPos,
                                        row_number() OVER (ORDER BY
                                                ((merged_stats -> 'statistics' ->> 'cnt')::float) *
-                                               ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc)      AS tPos,
-                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc) AS cPos,
-                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc) AS uPos,
-                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0) desc) AS lPos
+                                               ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc`+topLimits.stmtRankTieBreak()+`)      AS tPos,
+                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc`+topLimits.stmtRankTieBreak()+`) AS cPos,
+                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc`+topLimits.stmtRankTieBreak()+`) AS uPos,
+                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0) desc`+topLimits.stmtRankTieBreak()+`) AS lPos
                                 FROM agg_stmt_stats)
-                          WHERE ePos < $3
-                             or sPos < $3
-                             or tPos < $3
-														 or (cPos < $3 AND ((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float > 0))
-														 or (uPos < $3 AND  ((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float > 0))
-														 or (lPos < $3 AND ((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float > 0)))
-UPSERT INTO system.public.statement_activity
+                          WHERE `+stmtTopAdmissionPredicate(topLimits, "$3", "$4")+`)
+UPSERT INTO `+u.stmtActivityTable+`
 (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
  agg_interval, metadata, statistics, plan, index_recommendations, execution_count,
  execution_total_seconds, execution_total_cluster_seconds,
@@ -519,7 +1931,7 @@ SELECT aggregated_ts,
        plan_hash,
        app_name,
        max_agg_interval,
-       metadata,
+       `+u.stmtActivityMetadata("metadata")+`,
        merged_stats,
        max_plan,
        jsonb_array_to_string_array(merged_stats -> 'index_recommendations') as idx_rec,
@@ -537,21 +1949,785 @@ FROM (SELECT ss.aggregated_ts AS aggregated_ts,
              ss.app_name,
              max(ss.agg_interval) AS max_agg_interval,
              max(ss.plan) AS max_plan,
-             merge_stats_metadata(ss.metadata) AS metadata,
+             `+u.stmtLatencyHistogramsColumn("ss.statistics")+`merge_stats_metadata(ss.metadata) AS metadata,
              merge_statement_stats(ss.statistics) AS merged_stats
       FROM system.statement_statistics ss
       INNER JOIN limit_stmt_stats using (aggregated_ts, fingerprint_id, app_name)
       GROUP BY aggregated_ts, fingerprint_id, plan_hash, app_name));
 `,
-			totalEstimatedStmtClusterExecSeconds,
+				totalEstimatedStmtClusterExecSeconds,
+				aggTs,
+				topLimits.stmt,
+				topLimits.totalTime,
+				u.ignoredAppNames,
+			)
+
+			return err
+		})
+		if errTxn != nil {
+			return errTxn
+		}
+		u.recordRowsTransferred(ctx, stmtRows, 0 /* txnRows */)
+		return nil
+	})
+}
+
+// activityTransferKeys is a set of (fingerprint_id, app_name) keys of the
+// statistics tables which are transferred to the activity tables together.
+type activityTransferKeys struct {
+	fingerprintIDs *tree.DArray
+	appNames       *tree.DArray
+}
+
+func makeActivityTransferKeys() activityTransferKeys {
+	return activityTransferKeys{
+		fingerprintIDs: tree.NewDArray(types.Bytes),
+		appNames:       tree.NewDArray(types.String),
+	}
+}
+
+func (k activityTransferKeys) len() int {
+	return k.fingerprintIDs.Len()
+}
+
+// add appends the key stored in the first two columns of the row.
+func (k activityTransferKeys) add(row tree.Datums) error {
+	if err := k.fingerprintIDs.Append(row[0]); err != nil {
+		return err
+	}
+	return k.appNames.Append(row[1])
+}
+
+// split divides the keys into batches of at most batchSize keys.
+func (k activityTransferKeys) split(batchSize int64) ([]activityTransferKeys, error) {
+	var batches []activityTransferKeys
+	for i := 0; i < k.len(); i++ {
+		if i%int(batchSize) == 0 {
+			batches = append(batches, makeActivityTransferKeys())
+		}
+		batch := batches[len(batches)-1]
+		if err := batch.add(tree.Datums{k.fingerprintIDs.Array[i], k.appNames.Array[i]}); err != nil {
+			return nil, err
+		}
+	}
+	return batches, nil
+}
+
+// last returns the last key as placeholder arguments for the next page of a
+// keyset pagination.
+func (k activityTransferKeys) last() (tree.Datum, tree.Datum) {
+	n := k.len() - 1
+	return k.fingerprintIDs.Array[n], k.appNames.Array[n]
+}
+
+// transferAllStatsInBatches is the batched equivalent of transferAllStats. It
+// pages through the keys of system.transaction_statistics and
+// system.statement_statistics using keyset pagination on
+// (aggregated_ts, fingerprint_id, app_name) and writes each page to the
+// activity tables in its own transaction.
+func (u *sqlActivityUpdater) transferAllStatsInBatches(
+	ctx context.Context,
+	aggTs time.Time,
+	totalEstimatedStmtClusterExecSeconds float64,
+	totalEstimatedTxnClusterExecSeconds float64,
+) error {
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		return u.forEachStatsKeyPage(ctx, "system.public.transaction_statistics", aggTs,
+			func(keys activityTransferKeys) error {
+				return u.upsertTxnActivityForKeys(ctx, aggTs, keys, totalEstimatedTxnClusterExecSeconds)
+			})
+	}); err != nil {
+		return err
+	}
+
+	return u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		return u.forEachStatsKeyPage(ctx, "system.public.statement_statistics", aggTs,
+			func(keys activityTransferKeys) error {
+				return u.upsertStmtActivityForKeys(ctx, aggTs, keys, totalEstimatedStmtClusterExecSeconds)
+			})
+	})
+}
+
+// forEachStatsKeyPage pages through the distinct (fingerprint_id, app_name)
+// keys of the given statistics table for the aggregated timestamp, calling fn
+// with at most transferBatchSize keys at a time.
+func (u *sqlActivityUpdater) forEachStatsKeyPage(
+	ctx context.Context, tableName string, aggTs time.Time, fn func(activityTransferKeys) error,
+) error {
+	firstPageQuery := fmt.Sprintf(`
+SELECT DISTINCT fingerprint_id, app_name
+FROM %s
+WHERE aggregated_ts = $1
+  AND ($3::STRING = '' OR app_name !~ $3)
+ORDER BY fingerprint_id, app_name
+LIMIT $2`, tableName)
+	nextPageQuery := fmt.Sprintf(`
+SELECT DISTINCT fingerprint_id, app_name
+FROM %s
+WHERE aggregated_ts = $1
+  AND ($3::STRING = '' OR app_name !~ $3)
+  AND (aggregated_ts, fingerprint_id, app_name) > ($1, $4::BYTES, $5::STRING)
+ORDER BY fingerprint_id, app_name
+LIMIT $2`, tableName)
+
+	var lastFingerprintID, lastAppName tree.Datum
+	for {
+		var rows []tree.Datums
+		var err error
+		if lastFingerprintID == nil {
+			rows, err = u.db.Executor().QueryBufferedEx(ctx,
+				"activity-flush-key-page",
+				nil, /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				firstPageQuery,
+				aggTs,
+				u.transferBatchSize,
+				u.ignoredAppNames,
+			)
+		} else {
+			rows, err = u.db.Executor().QueryBufferedEx(ctx,
+				"activity-flush-key-page",
+				nil, /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				nextPageQuery,
+				aggTs,
+				u.transferBatchSize,
+				u.ignoredAppNames,
+				lastFingerprintID,
+				lastAppName,
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		keys := makeActivityTransferKeys()
+		for _, row := range rows {
+			if err := keys.add(row); err != nil {
+				return err
+			}
+		}
+		if keys.len() == 0 {
+			return nil
+		}
+		if err := fn(keys); err != nil {
+			return err
+		}
+		if int64(keys.len()) < u.transferBatchSize {
+			return nil
+		}
+		lastFingerprintID, lastAppName = keys.last()
+	}
+}
+
+// transferTopStatsInBatches is the batched equivalent of transferTopStats. The
+// top keys are selected once for the whole aggregated timestamp so the result
+// is the same regardless of the batch size. The selected keys are then written
+// to the activity tables in batches, each batch in its own transaction, and
+// only then are the rows of the keys which were not selected deleted. Unlike
+// transferTopStats this is not atomic, but readers never see the aggregated
+// timestamp without its rows: until the deletion, they may see the rows of
+// keys which fell out of the top, or the previous rows of keys whose batch was
+// not written yet.
+func (u *sqlActivityUpdater) transferTopStatsInBatches(
+	ctx context.Context,
+	aggTs time.Time,
+	topLimits activityTopLimits,
+	totalEstimatedStmtClusterExecSeconds float64,
+	totalEstimatedTxnClusterExecSeconds float64,
+) error {
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		txnKeys, err := u.selectTopKeys(ctx, "activity-flush-txn-select-tops", selectTopTxnKeysQuery(topLimits), aggTs, topLimits.txn, topLimits.totalTime)
+		if err != nil {
+			return err
+		}
+
+		txnBatches, err := txnKeys.split(u.transferBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, batch := range txnBatches {
+			if err := u.upsertTxnActivityForKeys(ctx, aggTs, batch, totalEstimatedTxnClusterExecSeconds); err != nil {
+				return err
+			}
+		}
+		return u.deleteUnselectedActivity(ctx, "activity-flush-txn-delete-tops", u.txnActivityTable, aggTs, txnKeys)
+	}); err != nil {
+		return err
+	}
+
+	return u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		stmtKeys, err := u.selectTopKeys(ctx, "activity-flush-stmt-select-tops", selectTopStmtKeysQuery(topLimits), aggTs, topLimits.stmt, topLimits.totalTime)
+		if err != nil {
+			return err
+		}
+
+		stmtBatches, err := stmtKeys.split(u.transferBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, batch := range stmtBatches {
+			if err := u.upsertStmtActivityForKeys(ctx, aggTs, batch, totalEstimatedStmtClusterExecSeconds); err != nil {
+				return err
+			}
+		}
+		return u.deleteUnselectedActivity(ctx, "activity-flush-stmt-delete-tops", u.stmtActivityTable, aggTs, stmtKeys)
+	})
+}
+
+// deleteUnselectedActivity deletes the rows of the aggregated timestamp of the
+// activity table whose keys are not among the selected keys.
+func (u *sqlActivityUpdater) deleteUnselectedActivity(
+	ctx context.Context,
+	opName string,
+	activityTableName string,
+	aggTs time.Time,
+	selected activityTransferKeys,
+) error {
+	_, err := u.db.Executor().ExecEx(ctx,
+		opName,
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+DELETE FROM %s
+WHERE aggregated_ts = $1
+  AND (fingerprint_id, app_name) NOT IN (SELECT unnest($2::BYTES[]), unnest($3::STRING[]))`,
+			activityTableName),
+		aggTs,
+		selected.fingerprintIDs,
+		selected.appNames,
+	)
+	return err
+}
+
+// selectTopTxnKeysQuery returns the query selecting the keys of the
+// transactions which transferTopStats inserts into
+// system.transaction_activity, along with whether the key qualified under each
+// of txnActivityRankingColumns.
+func selectTopTxnKeysQuery(topLimits activityTopLimits) string {
+	return fmt.Sprintf(selectTopTxnKeysQueryFormat,
+		rankedTxnStatsQuery(topLimits, "" /* keyFilter */), txnTopAdmissionPredicate(topLimits, "$2", "$3"))
+}
+
+// selectTopTxnKeysQueryFormat is the format of the transaction key selection
+// queries. The format arguments are the query ranking the statistics, from
+// rankedTxnStatsQuery, and the admission predicate of the ranked rows.
+const selectTopTxnKeysQueryFormat = `
+SELECT fingerprint_id, app_name,
+       ePos < $2,
+       sPos < $2,
+       tPos < $3,
+       (cPos < $2 AND contentionTime > 0),
+       (uPos < $2 AND cpuTime > 0)
+FROM (%s)
+WHERE %s
+ORDER BY fingerprint_id, app_name`
+
+// rankedTxnStatsQuery returns the query ranking the merged transaction
+// statistics of the aggregated timestamp $1 by each of
+// txnActivityRankingColumns, excluding the app names matching the pattern $4.
+// The keyFilter is an additional filter on the statistics rows which are
+// ranked.
+func rankedTxnStatsQuery(topLimits activityTopLimits, keyFilter string) string {
+	return fmt.Sprintf(rankedTxnStatsQueryFormat,
+		keyFilter, topLimits.txnRankTieBreak(), topLimits.minExecCountFilter())
+}
+
+// rankedTxnStatsQueryFormat is the format of rankedTxnStatsQuery. The format
+// arguments are the additional filter on the statistics rows, the terms
+// ordering the rows with the same value of a ranking column, and the filter on
+// the execution count of the merged statistics.
+const rankedTxnStatsQueryFormat = `
+SELECT fingerprint_id, app_name,
+       contentionTime, cpuTime,
+       row_number() OVER (ORDER BY (merge_stats -> 'statistics' ->> 'cnt')::int desc%[2]s) AS ePos,
+       row_number() OVER (ORDER BY (merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc%[2]s) AS sPos,
+       row_number() OVER (ORDER BY ((merge_stats -> 'statistics' ->> 'cnt')::float) *
+           ((merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc%[2]s) AS tPos,
+       row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc%[2]s) AS cPos,
+       row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc%[2]s) AS uPos
+FROM (SELECT fingerprint_id, app_name, merge_stats,
+             (merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float as contentionTime,
+             (merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float as cpuTime
+      FROM (SELECT fingerprint_id, app_name,
+                   merge_transaction_stats(statistics) AS merge_stats
+            FROM system.public.transaction_statistics
+            WHERE aggregated_ts = $1 and
+                  ($4::STRING = '' OR app_name !~ $4)%[1]s
+            GROUP BY app_name, fingerprint_id%[3]s))`
+
+// txnTopAdmissionPredicate returns the predicate which is true for the rows
+// of rankedTxnStatsQuery which transferTopStats inserts into
+// system.transaction_activity, given the placeholders of the top limit and of
+// the total execution time top limit.
+func txnTopAdmissionPredicate(topLimits activityTopLimits, topLimit, totalTimeTopLimit string) string {
+	return topAdmissionPredicate(topLimits, txnActivityRankingColumns, false /* stmt */, topLimit, totalTimeTopLimit)
+}
+
+// selectTopStmtKeysQuery returns the query selecting the keys of the
+// statements which transferTopStats inserts into system.statement_activity,
+// along with whether the key qualified under each of
+// stmtActivityRankingColumns.
+func selectTopStmtKeysQuery(topLimits activityTopLimits) string {
+	return fmt.Sprintf(selectTopStmtKeysQueryFormat,
+		rankedStmtStatsQuery(topLimits, "" /* keyFilter */), stmtTopAdmissionPredicate(topLimits, "$2", "$3"))
+}
+
+// selectTopStmtKeysQueryFormat is the format of the statement key selection
+// queries. The format arguments are the query ranking the statistics, from
+// rankedStmtStatsQuery, and the admission predicate of the ranked rows.
+const selectTopStmtKeysQueryFormat = `
+SELECT fingerprint_id, app_name,
+       ePos < $2,
+       sPos < $2,
+       tPos < $3,
+       (cPos < $2 AND ((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float > 0)),
+       (uPos < $2 AND ((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float > 0)),
+       (lPos < $2 AND ((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float > 0))
+FROM (%s)
+WHERE %s
+ORDER BY fingerprint_id, app_name`
+
+// rankedStmtStatsQuery returns the query ranking the merged statement
+// statistics of the aggregated timestamp $1 by each of
+// stmtActivityRankingColumns, excluding the app names matching the pattern $4.
+// The keyFilter is an additional filter on the statistics rows which are
+// ranked.
+func rankedStmtStatsQuery(topLimits activityTopLimits, keyFilter string) string {
+	return fmt.Sprintf(rankedStmtStatsQueryFormat,
+		keyFilter, topLimits.stmtRankTieBreak(), topLimits.minExecCountFilter())
+}
+
+// rankedStmtStatsQueryFormat is the format of rankedStmtStatsQuery. The format
+// arguments are the additional filter on the statistics rows, the terms
+// ordering the rows with the same value of a ranking column, and the filter on
+// the execution count of the merged statistics.
+const rankedStmtStatsQueryFormat = `
+SELECT fingerprint_id,
+       app_name,
+       merged_stats,
+       row_number() OVER (ORDER BY (merged_stats -> 'statistics' ->> 'cnt')::int desc%[2]s)                AS ePos,
+       row_number() OVER (ORDER BY (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc%[2]s) AS sPos,
+       row_number() OVER (ORDER BY
+               ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+               ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc%[2]s)      AS tPos,
+       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc%[2]s) AS cPos,
+       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc%[2]s) AS uPos,
+       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0) desc%[2]s) AS lPos
+FROM (SELECT fingerprint_id,
+             app_name,
+             merge_statement_stats(statistics) AS merged_stats
+      FROM system.public.statement_statistics
+      WHERE aggregated_ts = $1
+        and ($4::STRING = '' OR app_name !~ $4)%[1]s
+      GROUP BY app_name,
+               fingerprint_id%[3]s)`
+
+// stmtTopAdmissionPredicate returns the predicate which is true for the rows
+// of rankedStmtStatsQuery which transferTopStats inserts into
+// system.statement_activity, given the placeholders of the top limit and of
+// the total execution time top limit.
+func stmtTopAdmissionPredicate(topLimits activityTopLimits, topLimit, totalTimeTopLimit string) string {
+	return topAdmissionPredicate(topLimits, stmtActivityRankingColumns, true /* stmt */, topLimit, totalTimeTopLimit)
+}
+
+// activityRankingTerms are the terms of the admission predicates of the
+// ranked statistics for each ranking column. The first format argument is the
+// top limit placeholder, and the second the total execution time top limit
+// placeholder.
+var activityRankingTerms = map[string]struct{ txn, stmt string }{
+	"execution_count": {
+		txn:  `ePos < %[1]s`,
+		stmt: `ePos < %[1]s`,
+	},
+	"service_latency": {
+		txn:  `sPos < %[1]s`,
+		stmt: `sPos < %[1]s`,
+	},
+	"total_execution_time": {
+		txn:  `tPos < %[2]s`,
+		stmt: `tPos < %[2]s`,
+	},
+	"contention_time": {
+		txn:  `(cPos < %[1]s AND contentionTime > 0)`,
+		stmt: `(cPos < %[1]s AND ((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float > 0))`,
+	},
+	"cpu_sql_nanos": {
+		txn:  `(uPos < %[1]s AND cpuTime > 0)`,
+		stmt: `(uPos < %[1]s AND ((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float > 0))`,
+	},
+	"p99_latency": {
+		stmt: `(lPos < %[1]s AND ((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float > 0))`,
+	},
+}
+
+// topAdmissionPredicate ORs the terms of the given ranking columns which the
+// statistics are ranked by. It is false if there are none.
+func topAdmissionPredicate(
+	topLimits activityTopLimits, columns []string, stmt bool, topLimit, totalTimeTopLimit string,
+) string {
+	var terms []string
+	for _, column := range columns {
+		if !topLimits.ranksBy(column) {
+			continue
+		}
+		term := activityRankingTerms[column].txn
+		if stmt {
+			term = activityRankingTerms[column].stmt
+		}
+		terms = append(terms, fmt.Sprintf(term, topLimit, totalTimeTopLimit))
+	}
+	if len(terms) == 0 {
+		return "false"
+	}
+	return strings.Join(terms, "\n   or ")
+}
+
+// txnActivityRankingColumns are the columns transactions are ranked by when
+// selecting the top transactions, in the order of selectTopTxnKeysQuery.
+var txnActivityRankingColumns = []string{
+	"execution_count",
+	"service_latency",
+	"total_execution_time",
+	"contention_time",
+	"cpu_sql_nanos",
+}
+
+// stmtActivityRankingColumns are the columns statements are ranked by when
+// selecting the top statements, in the order of selectTopStmtKeysQuery.
+var stmtActivityRankingColumns = []string{
+	"execution_count",
+	"service_latency",
+	"total_execution_time",
+	"contention_time",
+	"cpu_sql_nanos",
+	"p99_latency",
+}
+
+// queryTopKeys runs one of the top key selection queries and returns the
+// resulting rows. The number of rows is bounded by the top limit times the
+// number of ranking columns, so they are buffered in memory.
+func (u *sqlActivityUpdater) queryTopKeys(
+	ctx context.Context,
+	opName string,
+	query string,
+	aggTs time.Time,
+	topLimit int64,
+	totalTimeTopLimit int64,
+) ([]tree.Datums, error) {
+	return u.db.Executor().QueryBufferedEx(ctx,
+		opName,
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		query,
+		aggTs,
+		topLimit,
+		totalTimeTopLimit,
+		u.ignoredAppNames,
+	)
+}
+
+// selectTopKeys runs one of the top key selection queries and returns the
+// selected keys.
+func (u *sqlActivityUpdater) selectTopKeys(
+	ctx context.Context,
+	opName string,
+	query string,
+	aggTs time.Time,
+	topLimit int64,
+	totalTimeTopLimit int64,
+) (activityTransferKeys, error) {
+	keys := makeActivityTransferKeys()
+	rows, err := u.queryTopKeys(ctx, opName, query, aggTs, topLimit, totalTimeTopLimit)
+	if err != nil {
+		return keys, err
+	}
+	for _, row := range rows {
+		if err := keys.add(row); err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// txnActivityColumns are the columns of system.transaction_activity written
+// by the transfer, in the order of txnActivityForKeysQuery.
+const txnActivityColumns = `aggregated_ts, fingerprint_id, app_name, agg_interval, metadata,
+ statistics, query, execution_count, execution_total_seconds,
+ execution_total_cluster_seconds, contention_time_avg_seconds,
+ cpu_sql_avg_nanos, service_latency_avg_seconds, service_latency_p99_seconds`
+
+// txnContentionMetadataFormat is merged into the metadata of the
+// transaction_activity rows so that the contention and wait time aggregates of
+// the merged statistics %[1]s, in seconds, can be read without decoding the
+// statistics. The mean contention time is also the contention_time_avg_seconds
+// column, and sampledCount is the number of executions it was sampled from.
+const txnContentionMetadataFormat = `jsonb_build_object(
+           'contentionTime', jsonb_build_object(
+               'mean', COALESCE((%[1]s -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+               'sqDiff', COALESCE((%[1]s -> 'execution_statistics' -> 'contentionTime' ->> 'sqDiff')::float, 0),
+               'sampledCount', COALESCE((%[1]s -> 'execution_statistics' ->> 'cnt')::int, 0)),
+           'waitTime', jsonb_build_object(
+               'retryLat', COALESCE((%[1]s -> 'statistics' -> 'retryLat' ->> 'mean')::float, 0),
+               'commitLat', COALESCE((%[1]s -> 'statistics' -> 'commitLat' ->> 'mean')::float, 0),
+               'idleLat', COALESCE((%[1]s -> 'statistics' -> 'idleLat' ->> 'mean')::float, 0)))`
+
+// txnActivityMetadata returns the expression of the metadata column of the
+// transaction_activity rows, given the expressions of the merged metadata and
+// of the merged statistics of the transaction statistics.
+func txnActivityMetadata(metadata, stats string) string {
+	return metadata + ` || ` + fmt.Sprintf(txnContentionMetadataFormat, stats)
+}
+
+// txnActivityForKeysQuery merges the transaction statistics of the aggregated
+// timestamp $2 for the keys in $3 and $4 into system.transaction_activity
+// rows, using $1 as the execution_total_cluster_seconds.
+var txnActivityForKeysQuery = `
+SELECT aggregated_ts,
+       fingerprint_id,
+       app_name,
+       agg_interval,
+       ` + txnActivityMetadata("metadata", "merge_stats") + `,
+       merge_stats,
+       ''  AS query,
+       (merge_stats -> 'statistics' ->> 'cnt')::int,
+       ((merge_stats -> 'statistics' ->> 'cnt')::float) *
+       ((merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+       $1::FLOAT AS execution_total_cluster_seconds,
+       COALESCE ((merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+       COALESCE ((merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+       (merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+       0::FLOAT as service_latency_p99_seconds
+FROM (SELECT ts.aggregated_ts                     AS aggregated_ts,
+             ts.app_name,
+             ts.fingerprint_id,
+             max(ts.agg_interval)                 AS agg_interval,
+             max(ts.metadata)                     AS metadata,
+             merge_transaction_stats(statistics) AS merge_stats
+      FROM system.public.transaction_statistics ts
+               INNER JOIN (SELECT unnest($3::BYTES[])  AS fingerprint_id,
+                                  unnest($4::STRING[]) AS app_name) keys
+                          ON keys.app_name = ts.app_name AND keys.fingerprint_id = ts.fingerprint_id
+      WHERE aggregated_ts = $2
+      GROUP BY ts.aggregated_ts,
+               ts.app_name,
+               ts.fingerprint_id)`
+
+// stmtActivityColumns are the columns of system.statement_activity written by
+// the transfer, in the order of stmtActivityForKeysQuery.
+const stmtActivityColumns = `aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
+ agg_interval, metadata, statistics, plan, index_recommendations, execution_count,
+ execution_total_seconds, execution_total_cluster_seconds,
+ contention_time_avg_seconds,
+ cpu_sql_avg_nanos,
+ service_latency_avg_seconds, service_latency_p99_seconds`
+
+// stmtLatencyPercentilesMetadata is merged into the metadata of the
+// statement_activity rows so that the service latency percentiles of the
+// merged statistics merged_stats, in seconds, can be read without decoding the
+// statistics. The p99 latency is also the service_latency_p99_seconds column.
+const stmtLatencyPercentilesMetadata = `jsonb_build_object('latencyPercentiles', jsonb_build_object(
+           'p50', COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p50')::float, 0),
+           'p90', COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p90')::float, 0),
+           'p99', COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0)))`
+
+// stmtAnonymizedQueryTextMetadata is merged into the metadata of the
+// statement_activity rows when sql.stats.activity.anonymize_query_text is
+// enabled, blanking out the fields holding the query text. Only the hex
+// encoded fingerprint ID identifies the statement.
+const stmtAnonymizedQueryTextMetadata = `jsonb_build_object(
+           'query', '', 'formattedQuery', '', 'querySummary', '',
+           'fingerprintID', encode(fingerprint_id, 'hex'))`
+
+// stmtLatencyHistogramsMetadata is merged into the metadata of the
+// statement_activity rows when sql.stats.activity.transfer.include_histograms
+// is enabled. The statistics keep the latency distribution of a fingerprint as
+// its latencyInfo, which can't be merged without losing its percentiles, so
+// the one of each merged statement_statistics row is copied as is.
+const stmtLatencyHistogramsMetadata = `jsonb_build_object('latencyHistograms', latency_histograms)`
+
+// stmtActivityMetadata returns the expression of the metadata column of the
+// statement_activity rows, given the expression of the merged metadata of the
+// statistics.
+func (u *sqlActivityUpdater) stmtActivityMetadata(metadata string) string {
+	expr := metadata + ` || ` + stmtLatencyPercentilesMetadata
+	if u.anonymizeQueryText {
+		expr += ` || ` + stmtAnonymizedQueryTextMetadata
+	}
+	if u.includeHistograms {
+		expr += ` || ` + stmtLatencyHistogramsMetadata
+	}
+	if u.maxRowBytes > 0 {
+		expr = u.stmtOversizedMetadata(expr)
+	}
+	return expr
+}
+
+// stmtLatencyHistogramsColumn returns the aggregate column, followed by a
+// comma, of the latency_histograms read by stmtActivityMetadata, given the
+// expression of the statistics of the merged statement_statistics rows. It
+// is empty unless sql.stats.activity.transfer.include_histograms is enabled.
+// If stats is empty, as for rows merged from statement_activity rows, the
+// column is NULL.
+func (u *sqlActivityUpdater) stmtLatencyHistogramsColumn(stats string) string {
+	if !u.includeHistograms {
+		return ""
+	}
+	if stats == "" {
+		return `NULL::JSONB AS latency_histograms, `
+	}
+	return `jsonb_agg(` + stats + ` -> 'statistics' -> 'latencyInfo') AS latency_histograms, `
+}
+
+// stmtActivityForKeysQuery returns the query merging the statement statistics
+// of the aggregated timestamp $2 for the keys in $3 and $4 into
+// system.statement_activity rows, using $1 as the
+// execution_total_cluster_seconds.
+func (u *sqlActivityUpdater) stmtActivityForKeysQuery() string {
+	return `
+SELECT aggregated_ts,
+       fingerprint_id,
+       '0x0000000000000000'::bytes,
+       plan_hash,
+       app_name,
+       max_agg_interval,
+       ` + u.stmtActivityMetadata("metadata") + `,
+       merged_stats,
+       max_plan,
+       jsonb_array_to_string_array(merged_stats -> 'index_recommendations') as idx_rec,
+       (merged_stats -> 'statistics' ->> 'cnt')::int,
+       ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+       ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+       $1::FLOAT AS execution_total_cluster_seconds,
+       COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+       COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+       (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+       COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0)
+FROM (SELECT ss.aggregated_ts AS aggregated_ts,
+             ss.fingerprint_id,
+             ss.plan_hash,
+             ss.app_name,
+             max(ss.agg_interval) AS max_agg_interval,
+             max(ss.plan) AS max_plan,
+             ` + u.stmtLatencyHistogramsColumn("ss.statistics") + `merge_stats_metadata(ss.metadata) AS metadata,
+             merge_statement_stats(ss.statistics) AS merged_stats
+      FROM system.statement_statistics ss
+      INNER JOIN (SELECT unnest($3::BYTES[])  AS fingerprint_id,
+                         unnest($4::STRING[]) AS app_name) keys
+                 USING (fingerprint_id, app_name)
+      WHERE ss.aggregated_ts = $2
+      GROUP BY aggregated_ts, fingerprint_id, plan_hash, app_name)`
+}
+
+// upsertTxnActivityForKeys merges the transaction statistics of the given keys
+// and upserts them into system.transaction_activity in a single transaction.
+func (u *sqlActivityUpdater) upsertTxnActivityForKeys(
+	ctx context.Context,
+	aggTs time.Time,
+	keys activityTransferKeys,
+	totalEstimatedTxnClusterExecSeconds float64,
+) error {
+	var rows int
+	err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) (err error) {
+		rows, err = txn.ExecEx(ctx,
+			"activity-flush-txn-transfer-batch",
+			txn.KV(), /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`UPSERT INTO `+u.txnActivityTable+` (`+txnActivityColumns+`) (`+txnActivityForKeysQuery+`)`,
+			totalEstimatedTxnClusterExecSeconds,
 			aggTs,
-			topLimit,
+			keys.fingerprintIDs,
+			keys.appNames,
 		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	u.recordRowsTransferred(ctx, 0 /* stmtRows */, rows)
+	return nil
+}
 
+// upsertStmtActivityForKeys merges the statement statistics of the given keys
+// and upserts them into system.statement_activity in a single transaction.
+func (u *sqlActivityUpdater) upsertStmtActivityForKeys(
+	ctx context.Context,
+	aggTs time.Time,
+	keys activityTransferKeys,
+	totalEstimatedStmtClusterExecSeconds float64,
+) error {
+	var rows int
+	err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) (err error) {
+		rows, err = txn.ExecEx(ctx,
+			"activity-flush-stmt-transfer-batch",
+			txn.KV(), /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`UPSERT INTO `+u.stmtActivityTable+` (`+stmtActivityColumns+`) (`+u.stmtActivityForKeysQuery()+`)`,
+			totalEstimatedStmtClusterExecSeconds,
+			aggTs,
+			keys.fingerprintIDs,
+			keys.appNames,
+		)
 		return err
 	})
+	if err != nil {
+		return err
+	}
+	u.recordRowsTransferred(ctx, rows, 0 /* txnRows */)
+	return nil
+}
+
+// recordMalformedStatsRows logs and counts the statistics rows of the
+// aggregated timestamp which are missing one of the fields the statistics are
+// ranked by. Merging the statistics treats the missing fields as zero, so the
+// rows are still transferred.
+func (u *sqlActivityUpdater) recordMalformedStatsRows(ctx context.Context, aggTs time.Time) error {
+	it, err := u.db.Executor().QueryIteratorEx(ctx,
+		"activity-flush-malformed-rows",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`
+SELECT 'statement_statistics', fingerprint_id, app_name
+FROM system.public.statement_statistics
+WHERE aggregated_ts = $1
+  AND ($2::STRING = '' OR app_name !~ $2)
+  AND (jsonb_typeof(statistics -> 'statistics' -> 'cnt') IS DISTINCT FROM 'number'
+    OR jsonb_typeof(statistics -> 'statistics' -> 'svcLat' -> 'mean') IS DISTINCT FROM 'number')
+UNION ALL
+SELECT 'transaction_statistics', fingerprint_id, app_name
+FROM system.public.transaction_statistics
+WHERE aggregated_ts = $1
+  AND ($2::STRING = '' OR app_name !~ $2)
+  AND (jsonb_typeof(statistics -> 'statistics' -> 'cnt') IS DISTINCT FROM 'number'
+    OR jsonb_typeof(statistics -> 'statistics' -> 'svcLat' -> 'mean') IS DISTINCT FROM 'number')`,
+		aggTs,
+		u.ignoredAppNames,
+	)
+	if err != nil {
+		return err
+	}
 
-	return errTxn
+	var malformedRows int64
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		malformedRows++
+		if log.V(1) {
+			log.Infof(ctx, "sql stats activity treating missing ranking fields as zero for %s row "+
+				"with fingerprint %x and app %s at %s",
+				tree.MustBeDString(row[0]), []byte(tree.MustBeDBytes(row[1])), tree.MustBeDString(row[2]), aggTs)
+		}
+	}
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if u.metrics != nil {
+		u.metrics.NumRowsZeroed.Inc(malformedRows)
+	}
+	return nil
 }
 
 // getAostRowCountAndTotalClusterExecSeconds is used to get the row counts of
@@ -645,10 +2821,38 @@ func (u *sqlActivityUpdater) computeAggregatedTs(sv *settings.Values) time.Time
 	return aggTs
 }
 
+// checkActivityTables verifies that the activity tables configured by
+// sql.stats.activity.transaction_activity_table and
+// sql.stats.activity.statement_activity_table have the columns written by the
+// transfer, so that a misconfigured table fails the transfer before any
+// statistics are written. The default tables are created by the upgrades, so
+// they are not checked.
+func (u *sqlActivityUpdater) checkActivityTables(ctx context.Context) error {
+	for _, table := range []struct {
+		name, defaultName, columns string
+	}{
+		{u.txnActivityTable, defaultTxnActivityTable, txnActivityColumns},
+		{u.stmtActivityTable, defaultStmtActivityTable, stmtActivityColumns},
+	} {
+		if table.name == table.defaultName {
+			continue
+		}
+		if _, err := u.db.Executor().ExecEx(ctx,
+			"activity-check-table",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(`SELECT %s FROM %s LIMIT 0`, table.columns, table.name),
+		); err != nil {
+			return errors.Wrapf(err, "activity table %s does not have the expected columns", table.name)
+		}
+	}
+	return nil
+}
+
 // compactActivityTables is used delete rows FROM the activity tables
 // to keep the tables under the specified config limit.
 func (u *sqlActivityUpdater) compactActivityTables(ctx context.Context, maxRowCount int64) error {
-	rowCount, err := u.getTableRowCount(ctx, "system.statement_activity")
+	rowCount, err := u.getTableRowCount(ctx, u.stmtActivityTable)
 	if err != nil {
 		return err
 	}
@@ -665,8 +2869,8 @@ func (u *sqlActivityUpdater) compactActivityTables(ctx context.Context, maxRowCo
 		sessiondata.NodeUserSessionDataOverride,
 		`
 				DELETE
-FROM system.statement_activity
-WHERE aggregated_ts IN (SELECT DISTINCT aggregated_ts FROM (SELECT aggregated_ts FROM system.statement_activity ORDER BY aggregated_ts ASC limit $1));`,
+FROM `+u.stmtActivityTable+`
+WHERE aggregated_ts IN (SELECT DISTINCT aggregated_ts FROM (SELECT aggregated_ts FROM `+u.stmtActivityTable+` ORDER BY aggregated_ts ASC limit $1));`,
 		rowCount-maxRowCount,
 	)
 
@@ -682,13 +2886,52 @@ WHERE aggregated_ts IN (SELECT DISTINCT aggregated_ts FROM (SELECT aggregated_ts
 		sessiondata.NodeUserSessionDataOverride,
 		`
 				DELETE
-FROM system.transaction_activity
-WHERE aggregated_ts not in (SELECT distinct aggregated_ts FROM system.statement_activity);`,
+FROM `+u.txnActivityTable+`
+WHERE aggregated_ts not in (SELECT distinct aggregated_ts FROM `+u.stmtActivityTable+`);`,
 	)
 
 	return err
 }
 
+// deleteExpiredActivity deletes the rows of the activity tables with an
+// aggregated timestamp older than sql.stats.activity.retention_ttl. The rows
+// are deleted in chunks of activityRetentionDeleteLimit rows to avoid large
+// transactions.
+func (u *sqlActivityUpdater) deleteExpiredActivity(ctx context.Context) error {
+	ttl := sqlStatsActivityRetentionTTL.Get(&u.st.SV)
+	if ttl == 0 {
+		return nil
+	}
+	cutoff := u.getTimeNow().Add(-ttl)
+
+	for _, tableName := range []string{
+		u.stmtActivityTable,
+		u.txnActivityTable,
+	} {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE aggregated_ts < $1 LIMIT $2`, tableName)
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rowsDeleted, err := u.db.Executor().ExecEx(ctx,
+				"activity-retention-delete",
+				nil, /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				query,
+				cutoff,
+				activityRetentionDeleteLimit,
+			)
+			if err != nil {
+				return err
+			}
+			if rowsDeleted < activityRetentionDeleteLimit {
+				break
+			}
+		}
+	}
+	return nil
+}
+
 // getTableRowCount is used to get the row counts of both the
 // system.statement_statistics and system.transaction_statistics.
 // It also gets the total execution count for the specified aggregated
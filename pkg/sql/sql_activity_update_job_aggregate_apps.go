@@ -0,0 +1,243 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+)
+
+// sqlStatsActivityTransferAggregateApps is the cluster setting that merges the
+// statistics of every app name into a single activity row per fingerprint, for
+// users who do not need the per-app breakdown.
+var sqlStatsActivityTransferAggregateApps = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.aggregate_apps",
+	"if enabled, the statistics of a fingerprint are merged across app names before they are "+
+		"ranked, and transferred into a single activity row with the app name (all)",
+	false,
+)
+
+// allAppName is the synthetic app name of the activity rows the statistics of
+// every app are merged into when sql.stats.activity.transfer.aggregate_apps is
+// enabled.
+const allAppName = "(all)"
+
+// transferStatsAggregatedOverApps is the equivalent of transferTopStats when
+// sql.stats.activity.transfer.aggregate_apps is enabled. The statistics of
+// each fingerprint are merged across the app names which are not ignored, and
+// the merged statistics are ranked, so a fingerprint executed by many apps
+// ranks by its total. All the merged statistics are transferred if
+// shouldTransferAll. The batched and bulk transfers are not used, since the
+// merged statistics of a fingerprint span every app.
+func (u *sqlActivityUpdater) transferStatsAggregatedOverApps(
+	ctx context.Context,
+	aggTs time.Time,
+	topLimits activityTopLimits,
+	transferAll bool,
+	totalEstimatedStmtClusterExecSeconds float64,
+	totalEstimatedTxnClusterExecSeconds float64,
+) error {
+	if transferAll {
+		topLimits = uniformActivityTopLimits(math.MaxInt64)
+	}
+
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		var txnRows int
+		if err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			// The rows of a previous transfer are replaced, like in
+			// transferTopStats, so the fingerprints which fell out of the top are
+			// removed.
+			if _, err := txn.ExecEx(ctx,
+				"activity-flush-txn-transfer-all-apps",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				`DELETE FROM `+u.txnActivityTable+` WHERE aggregated_ts = $1`,
+				aggTs,
+			); err != nil {
+				return err
+			}
+			var err error
+			txnRows, err = txn.ExecEx(ctx,
+				"activity-flush-txn-transfer-all-apps",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				u.txnAggregatedOverAppsQuery(topLimits),
+				totalEstimatedTxnClusterExecSeconds,
+				aggTs,
+				topLimits.txn,
+				topLimits.totalTime,
+				u.ignoredAppNames,
+				allAppName,
+			)
+			return err
+		}); err != nil {
+			return err
+		}
+		u.recordRowsTransferred(ctx, 0 /* stmtRows */, txnRows)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		var stmtRows int
+		if err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			if _, err := txn.ExecEx(ctx,
+				"activity-flush-stmt-transfer-all-apps",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				`DELETE FROM `+u.stmtActivityTable+` WHERE aggregated_ts = $1`,
+				aggTs,
+			); err != nil {
+				return err
+			}
+			var err error
+			stmtRows, err = txn.ExecEx(ctx,
+				"activity-flush-stmt-transfer-all-apps",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				u.stmtAggregatedOverAppsQuery(topLimits),
+				totalEstimatedStmtClusterExecSeconds,
+				aggTs,
+				topLimits.stmt,
+				topLimits.totalTime,
+				u.ignoredAppNames,
+				allAppName,
+			)
+			return err
+		}); err != nil {
+			return err
+		}
+		u.recordRowsTransferred(ctx, stmtRows, 0 /* txnRows */)
+		return nil
+	})
+}
+
+// txnAggregatedOverAppsQuery returns the query merging the transaction
+// statistics of the aggregated timestamp $2 across the app names not matching
+// $5 into transaction activity rows with the app name $6, for the top $3 (and
+// $4 by total execution time) fingerprints, using $1 as the
+// execution_total_cluster_seconds.
+// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
+func (u *sqlActivityUpdater) txnAggregatedOverAppsQuery(topLimits activityTopLimits) string {
+	return `
+UPSERT INTO ` + u.txnActivityTable + ` (` + txnActivityColumns + `)
+    (SELECT aggregated_ts,
+            fingerprint_id,
+            $6 AS app_name,
+            agg_interval,
+            ` + txnActivityMetadata("metadata", "merge_stats") + `,
+            merge_stats,
+            '' AS query,
+            (merge_stats -> 'statistics' ->> 'cnt')::int,
+            ((merge_stats -> 'statistics' ->> 'cnt')::float) *
+            ((merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+            $1 AS execution_total_cluster_seconds,
+            COALESCE((merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+            COALESCE((merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+            (merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+            0 AS service_latency_p99_seconds
+     FROM (SELECT ts.aggregated_ts,
+                  ts.fingerprint_id,
+                  max(ts.agg_interval)                   AS agg_interval,
+                  max(ts.metadata)                       AS metadata,
+                  merge_transaction_stats(ts.statistics) AS merge_stats
+           FROM system.public.transaction_statistics ts
+                    INNER JOIN (SELECT fingerprint_id
+                                FROM (SELECT fingerprint_id, app_name,
+                                             contentionTime, cpuTime,
+                                             row_number() OVER (ORDER BY (merge_stats -> 'statistics' ->> 'cnt')::int desc` + topLimits.txnRankTieBreak() + `) AS ePos,
+                                             row_number() OVER (ORDER BY (merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc` + topLimits.txnRankTieBreak() + `) AS sPos,
+                                             row_number() OVER (ORDER BY ((merge_stats -> 'statistics' ->> 'cnt')::float) *
+                                                 ((merge_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc` + topLimits.txnRankTieBreak() + `) AS tPos,
+                                             row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc` + topLimits.txnRankTieBreak() + `) AS cPos,
+                                             row_number() OVER (ORDER BY COALESCE((merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc` + topLimits.txnRankTieBreak() + `) AS uPos
+                                      FROM (SELECT fingerprint_id, $6::STRING AS app_name, merge_stats,
+                                                   (merge_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float AS contentionTime,
+                                                   (merge_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float AS cpuTime
+                                            FROM (SELECT fingerprint_id,
+                                                         merge_transaction_stats(statistics) AS merge_stats
+                                                  FROM system.public.transaction_statistics
+                                                  WHERE aggregated_ts = $2
+                                                    AND ($5::STRING = '' OR app_name !~ $5)
+                                                  GROUP BY fingerprint_id` + topLimits.minExecCountFilter() + `)))
+                                WHERE ` + txnTopAdmissionPredicate(topLimits, "$3", "$4") + `) agg
+                               USING (fingerprint_id)
+           WHERE ts.aggregated_ts = $2
+             AND ($5::STRING = '' OR ts.app_name !~ $5)
+           GROUP BY ts.aggregated_ts, ts.fingerprint_id))`
+}
+
+// stmtAggregatedOverAppsQuery is like txnAggregatedOverAppsQuery, for the
+// statement statistics, which are merged into a statement activity row per
+// fingerprint and plan.
+// Any change should update cockroach/pkg/sql/opt/exec/execbuilder/testdata/observability
+func (u *sqlActivityUpdater) stmtAggregatedOverAppsQuery(topLimits activityTopLimits) string {
+	return `
+WITH agg_stmt_stats AS (SELECT aggregated_ts,
+                               fingerprint_id,
+                               $6::STRING                        AS app_name,
+                               merge_statement_stats(statistics) AS merged_stats
+                        FROM system.public.statement_statistics
+                        WHERE aggregated_ts = $2
+                          AND ($5::STRING = '' OR app_name !~ $5)
+                        GROUP BY aggregated_ts, fingerprint_id` + topLimits.minExecCountFilter() + `),
+     limit_stmt_stats AS (SELECT aggregated_ts, fingerprint_id
+                          FROM (SELECT aggregated_ts,
+                                       fingerprint_id,
+                                       merged_stats,
+                                       row_number() OVER (ORDER BY (merged_stats -> 'statistics' ->> 'cnt')::int desc` + topLimits.stmtRankTieBreak() + `) AS ePos,
+                                       row_number() OVER (ORDER BY (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float desc` + topLimits.stmtRankTieBreak() + `) AS sPos,
+                                       row_number() OVER (ORDER BY
+                                               ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+                                               ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float) desc` + topLimits.stmtRankTieBreak() + `) AS tPos,
+                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0) desc` + topLimits.stmtRankTieBreak() + `) AS cPos,
+                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0) desc` + topLimits.stmtRankTieBreak() + `) AS uPos,
+                                       row_number() OVER (ORDER BY COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0) desc` + topLimits.stmtRankTieBreak() + `) AS lPos
+                                FROM agg_stmt_stats)
+                          WHERE ` + stmtTopAdmissionPredicate(topLimits, "$3", "$4") + `)
+UPSERT INTO ` + u.stmtActivityTable + ` (` + stmtActivityColumns + `)
+    (SELECT aggregated_ts,
+            fingerprint_id,
+            '0x0000000000000000'::bytes,
+            plan_hash,
+            $6 AS app_name,
+            max_agg_interval,
+            ` + u.stmtActivityMetadata("metadata") + `,
+            merged_stats,
+            max_plan,
+            jsonb_array_to_string_array(merged_stats -> 'index_recommendations') AS idx_rec,
+            (merged_stats -> 'statistics' ->> 'cnt')::int,
+            ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+            ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+            $1 AS execution_total_cluster_seconds,
+            COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+            COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+            (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+            COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0)
+     FROM (SELECT ss.aggregated_ts,
+                  ss.fingerprint_id,
+                  ss.plan_hash,
+                  max(ss.agg_interval)                 AS max_agg_interval,
+                  max(ss.plan)                         AS max_plan,
+                  ` + u.stmtLatencyHistogramsColumn("ss.statistics") + `merge_stats_metadata(ss.metadata) AS metadata,
+                  merge_statement_stats(ss.statistics) AS merged_stats
+           FROM system.public.statement_statistics ss
+                    INNER JOIN limit_stmt_stats USING (aggregated_ts, fingerprint_id)
+           WHERE ($5::STRING = '' OR ss.app_name !~ $5)
+           GROUP BY aggregated_ts, fingerprint_id, plan_hash))`
+}
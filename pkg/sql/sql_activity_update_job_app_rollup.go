@@ -0,0 +1,207 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// otherAppName is the synthetic app name of the activity rows the statistics
+// of the apps beyond sql.stats.activity.transfer.max_app_names are rolled up
+// into.
+const otherAppName = "(other)"
+
+// rankActivityAppNamesQueryFormat returns the app names of the activity rows
+// of the aggregated timestamp $1, ordered by their transaction execution count.
+// Apps which only have statement activity rows are ranked last. The format
+// arguments are the statement and transaction activity tables.
+const rankActivityAppNamesQueryFormat = `
+SELECT app_name
+FROM (SELECT app_name, execution_count
+      FROM %[2]s
+      WHERE aggregated_ts = $1
+      UNION ALL
+      SELECT app_name, 0 AS execution_count
+      FROM %[1]s
+      WHERE aggregated_ts = $1)
+WHERE app_name != $2
+GROUP BY app_name
+ORDER BY sum(execution_count) DESC, app_name`
+
+// rollupTxnActivityQueryFormat merges the transaction activity rows of the
+// aggregated timestamp $1 and the app names $2 into a row per fingerprint with
+// the app name $3, using the transaction activity table as format argument.
+var rollupTxnActivityQueryFormat = `
+UPSERT INTO %[1]s (` + txnActivityColumns + `)
+    (SELECT aggregated_ts,
+            fingerprint_id,
+            $3 AS app_name,
+            max_agg_interval,
+            ` + txnActivityMetadata("merged_metadata", "merged_stats") + `,
+            merged_stats,
+            '' AS query,
+            (merged_stats -> 'statistics' ->> 'cnt')::int,
+            ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+            ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+            max_cluster_seconds,
+            COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+            COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+            (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+            0 AS service_latency_p99_seconds
+     FROM (SELECT aggregated_ts,
+                  fingerprint_id,
+                  max(agg_interval)                   AS max_agg_interval,
+                  max(metadata)                       AS merged_metadata,
+                  merge_transaction_stats(statistics) AS merged_stats,
+                  max(execution_total_cluster_seconds) AS max_cluster_seconds
+           FROM %[1]s
+           WHERE aggregated_ts = $1
+             AND app_name = ANY ($2)
+           GROUP BY aggregated_ts, fingerprint_id))`
+
+// rollupStmtActivityQuery returns the query merging the statement activity
+// rows of the aggregated timestamp $1 and the app names $2 into a row per
+// fingerprint and plan with the app name $3.
+func (u *sqlActivityUpdater) rollupStmtActivityQuery() string {
+	return `
+UPSERT INTO ` + u.stmtActivityTable + ` (` + stmtActivityColumns + `)
+    (SELECT aggregated_ts,
+            fingerprint_id,
+            transaction_fingerprint_id,
+            plan_hash,
+            $3 AS app_name,
+            max_agg_interval,
+            ` + u.stmtActivityMetadata("merged_metadata") + `,
+            merged_stats,
+            max_plan,
+            jsonb_array_to_string_array(merged_stats -> 'index_recommendations') AS idx_rec,
+            (merged_stats -> 'statistics' ->> 'cnt')::int,
+            ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+            ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+            max_cluster_seconds,
+            COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+            COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+            (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+            COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0)
+     FROM (SELECT aggregated_ts,
+                  fingerprint_id,
+                  transaction_fingerprint_id,
+                  plan_hash,
+                  max(agg_interval)                    AS max_agg_interval,
+                  ` + u.stmtLatencyHistogramsColumn("") + `max(metadata) AS merged_metadata,
+                  merge_statement_stats(statistics)    AS merged_stats,
+                  max(plan)                            AS max_plan,
+                  max(execution_total_cluster_seconds) AS max_cluster_seconds
+           FROM ` + u.stmtActivityTable + `
+           WHERE aggregated_ts = $1
+             AND app_name = ANY ($2)
+           GROUP BY aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash))`
+}
+
+// maybeRollupAppNames rolls up the activity rows of the aggregated timestamp
+// of the apps beyond the sql.stats.activity.transfer.max_app_names apps with
+// the most transaction executions into rows with the app name (other), so
+// that thousands of distinct app names, e.g. generated by an ORM, do not
+// multiply the rows of the top fingerprints. The execution counts of the
+// rolled up rows are summed and their statistics merged.
+//
+// The (other) rows are rebuilt from the rows of the rolled up apps on every
+// transfer, which writes the rows of every app again. There is nothing to roll
+// up when the statistics are aggregated over the app names.
+func (u *sqlActivityUpdater) maybeRollupAppNames(ctx context.Context, aggTs time.Time) error {
+	if u.maxAppNames == 0 || u.aggregateApps {
+		return nil
+	}
+	return u.runPhase(ctx, aggTs, activityTransferPhaseAppNameRollup, func(ctx context.Context) error {
+		return u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			rows, err := txn.QueryBufferedEx(ctx,
+				"activity-flush-rank-app-names",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				fmt.Sprintf(rankActivityAppNamesQueryFormat, u.stmtActivityTable, u.txnActivityTable),
+				aggTs,
+				otherAppName,
+			)
+			if err != nil {
+				return err
+			}
+			if int64(len(rows)) <= u.maxAppNames {
+				return nil
+			}
+			rolledUp := tree.NewDArray(types.String)
+			for _, row := range rows[u.maxAppNames:] {
+				if err := rolledUp.Append(row[0]); err != nil {
+					return err
+				}
+			}
+
+			// The previous (other) rows are replaced, since the rows of the apps
+			// they were rolled up from were written again.
+			for _, table := range []string{u.txnActivityTable, u.stmtActivityTable} {
+				if _, err := txn.ExecEx(ctx,
+					"activity-flush-delete-other-app-name",
+					txn.KV(),
+					sessiondata.NodeUserSessionDataOverride,
+					`DELETE FROM `+table+` WHERE aggregated_ts = $1 AND app_name = $2`,
+					aggTs,
+					otherAppName,
+				); err != nil {
+					return err
+				}
+			}
+			if _, err := txn.ExecEx(ctx,
+				"activity-flush-txn-rollup-app-names",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				fmt.Sprintf(rollupTxnActivityQueryFormat, u.txnActivityTable),
+				aggTs,
+				rolledUp,
+				otherAppName,
+			); err != nil {
+				return err
+			}
+			if _, err := txn.ExecEx(ctx,
+				"activity-flush-stmt-rollup-app-names",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				u.rollupStmtActivityQuery(),
+				aggTs,
+				rolledUp,
+				otherAppName,
+			); err != nil {
+				return err
+			}
+			for _, table := range []string{u.txnActivityTable, u.stmtActivityTable} {
+				if _, err := txn.ExecEx(ctx,
+					"activity-flush-delete-rolled-up-app-names",
+					txn.KV(),
+					sessiondata.NodeUserSessionDataOverride,
+					`DELETE FROM `+table+` WHERE aggregated_ts = $1 AND app_name = ANY ($2)`,
+					aggTs,
+					rolledUp,
+				); err != nil {
+					return err
+				}
+			}
+			log.Infof(ctx, "sql stats activity rolled up %d app names into %s at %s",
+				rolledUp.Len(), otherAppName, aggTs)
+			return nil
+		})
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+)
+
+// activityBulkInsertRows is the maximum number of rows written by a single
+// multi-row UPSERT statement of the bulk write path.
+const activityBulkInsertRows = 500
+
+// transferTopStatsWithBulkThreshold is like transferTopStats, but the rows of
+// an activity table are computed up front and written with multi-row UPSERT
+// statements when the number of selected top keys exceeds bulkThreshold. The
+// selection of the top keys is unchanged.
+func (u *sqlActivityUpdater) transferTopStatsWithBulkThreshold(
+	ctx context.Context,
+	aggTs time.Time,
+	topLimits activityTopLimits,
+	bulkThreshold int64,
+	totalEstimatedStmtClusterExecSeconds float64,
+	totalEstimatedTxnClusterExecSeconds float64,
+) error {
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		txnKeys, err := u.selectTopKeys(ctx, "activity-flush-txn-select-tops", selectTopTxnKeysQuery(topLimits), aggTs, topLimits.txn, topLimits.totalTime)
+		if err != nil {
+			return err
+		}
+		rows, err := u.writeActivityForKeys(ctx, aggTs, txnKeys, bulkThreshold, totalEstimatedTxnClusterExecSeconds,
+			u.txnActivityTable, txnActivityColumns, txnActivityForKeysQuery)
+		if err != nil {
+			return err
+		}
+		u.recordRowsTransferred(ctx, 0 /* stmtRows */, rows)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		stmtKeys, err := u.selectTopKeys(ctx, "activity-flush-stmt-select-tops", selectTopStmtKeysQuery(topLimits), aggTs, topLimits.stmt, topLimits.totalTime)
+		if err != nil {
+			return err
+		}
+		rows, err := u.writeActivityForKeys(ctx, aggTs, stmtKeys, bulkThreshold, totalEstimatedStmtClusterExecSeconds,
+			u.stmtActivityTable, stmtActivityColumns, u.stmtActivityForKeysQuery())
+		if err != nil {
+			return err
+		}
+		u.recordRowsTransferred(ctx, rows, 0 /* txnRows */)
+		return nil
+	})
+}
+
+// writeActivityForKeys replaces the rows of the activity table for the
+// aggregated timestamp with the rows computed by selectQuery for the given
+// keys, in a single transaction. If there are more than bulkThreshold keys the
+// rows are computed before the transaction and written with multi-row UPSERT
+// statements, otherwise they are written with a single UPSERT ... SELECT
+// statement. It returns the number of rows written.
+func (u *sqlActivityUpdater) writeActivityForKeys(
+	ctx context.Context,
+	aggTs time.Time,
+	keys activityTransferKeys,
+	bulkThreshold int64,
+	totalEstimatedClusterExecSeconds float64,
+	activityTableName string,
+	columns string,
+	selectQuery string,
+) (int, error) {
+	var activityRows []tree.Datums
+	bulk := int64(keys.len()) > bulkThreshold
+	if bulk {
+		var err error
+		activityRows, err = u.db.Executor().QueryBufferedEx(ctx,
+			"activity-flush-bulk-select",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			selectQuery,
+			totalEstimatedClusterExecSeconds,
+			aggTs,
+			keys.fingerprintIDs,
+			keys.appNames,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var rows int
+	err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		rows = 0
+		if _, err := txn.ExecEx(ctx,
+			"activity-flush-bulk-delete",
+			txn.KV(), /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(`DELETE FROM %s WHERE aggregated_ts = $1`, activityTableName),
+			aggTs,
+		); err != nil {
+			return err
+		}
+
+		if !bulk {
+			n, err := txn.ExecEx(ctx,
+				"activity-flush-bulk-upsert-select",
+				txn.KV(), /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				fmt.Sprintf(`UPSERT INTO %s (%s) (%s)`, activityTableName, columns, selectQuery),
+				totalEstimatedClusterExecSeconds,
+				aggTs,
+				keys.fingerprintIDs,
+				keys.appNames,
+			)
+			rows = n
+			return err
+		}
+
+		for len(activityRows) > 0 {
+			chunk := activityRows
+			if len(chunk) > activityBulkInsertRows {
+				chunk = chunk[:activityBulkInsertRows]
+			}
+			activityRows = activityRows[len(chunk):]
+
+			query, args := makeActivityBulkUpsert(activityTableName, columns, chunk)
+			n, err := txn.ExecEx(ctx,
+				"activity-flush-bulk-upsert",
+				txn.KV(), /* txn */
+				sessiondata.NodeUserSessionDataOverride,
+				query,
+				args...,
+			)
+			if err != nil {
+				return err
+			}
+			rows += n
+		}
+		return nil
+	})
+	return rows, err
+}
+
+// makeActivityBulkUpsert returns a multi-row UPSERT statement writing the
+// given rows to the activity table, along with its placeholder arguments.
+func makeActivityBulkUpsert(
+	activityTableName string, columns string, rows []tree.Datums,
+) (string, []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, `UPSERT INTO %s (%s) VALUES `, activityTableName, columns)
+	args := make([]interface{}, 0, len(rows)*len(rows[0]))
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for j, d := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			args = append(args, d)
+			fmt.Fprintf(&b, "$%d", len(args))
+		}
+		b.WriteString(")")
+	}
+	return b.String(), args
+}
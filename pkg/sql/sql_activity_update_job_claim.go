@@ -0,0 +1,224 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/cockroachdb/errors"
+)
+
+// sqlStatsActivityTransferClaimTTL is the cluster setting that controls how
+// long the claim of a transfer prevents other transfers from running.
+var sqlStatsActivityTransferClaimTTL = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.claim_ttl",
+	"the duration after which the claim of a transfer to the activity tables which was not "+
+		"released, e.g. because its node crashed, no longer prevents other transfers",
+	10*time.Minute,
+	settings.PositiveDuration,
+)
+
+// ErrTransferAlreadyRunning is returned by the transfers to the activity tables
+// which did not run because another transfer holds the claim.
+var ErrTransferAlreadyRunning = errors.New("sql activity transfer is already running")
+
+// activityTransferClaimInfoKey is the key of the claim of the transfers in the
+// system.job_info rows of the activity updater job.
+const activityTransferClaimInfoKey = "sql_activity_transfer_claim"
+
+// activityTransferMaxJitter is the maximum delay of the transfers of the
+// activity updater job after a flush, which spreads out the transfers of
+// nodes which flushed at the same time.
+const activityTransferMaxJitter = 5 * time.Second
+
+// activityTransferReleaseTimeout bounds the release of the claim of a
+// transfer, which runs even if the context of the transfer was canceled.
+const activityTransferReleaseTimeout = 10 * time.Second
+
+// errActivityTransferClaimLost is the cause of the cancellation of the context
+// of a transfer whose claim expired, or was taken by another transfer, before
+// the transfer completed.
+var errActivityTransferClaimLost = errors.New("sql activity transfer claim was lost")
+
+// activityTransferClaim is the claim of a running transfer.
+type activityTransferClaim struct {
+	ID         uuid.UUID `json:"id"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// claimTransfer claims the transfers to the activity tables, so a concurrent
+// transfer, on this node or another, fails with ErrTransferAlreadyRunning.
+// The claim is extended while the transfer runs, and the returned context,
+// which the transfer must run with, is canceled if the claim is lost anyway.
+// The claim is released by the returned function, or expires after
+// sql.stats.activity.transfer.claim_ttl.
+func (u *sqlActivityUpdater) claimTransfer(
+	ctx context.Context,
+) (_ context.Context, release func(), _ error) {
+	id := uuid.MakeV4()
+	expiration, err := u.writeTransferClaim(ctx, id, false /* extend */)
+	if err != nil {
+		return nil, nil, err
+	}
+	claimCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		u.heartbeatTransferClaim(claimCtx, id, expiration, done, cancel)
+	}()
+	return claimCtx, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+		// The claim is released even if the transfer was canceled, so the next
+		// transfer does not wait for it to expire.
+		releaseCtx, cancelRelease := context.WithTimeout(
+			context.WithoutCancel(ctx), activityTransferReleaseTimeout)
+		defer cancelRelease()
+		if err := u.releaseTransfer(releaseCtx, id); err != nil {
+			log.Warningf(ctx, "sql stats activity failed to release the transfer claim: %v", err)
+		}
+	}, nil
+}
+
+// writeTransferClaim writes the claim with the given ID, which expires after
+// sql.stats.activity.transfer.claim_ttl, and returns its expiration. If extend
+// is false the claim fails with ErrTransferAlreadyRunning if another claim is
+// held; otherwise it fails with errActivityTransferClaimLost if the claim with
+// the given ID is no longer held.
+func (u *sqlActivityUpdater) writeTransferClaim(
+	ctx context.Context, id uuid.UUID, extend bool,
+) (time.Time, error) {
+	claim := activityTransferClaim{
+		ID:         id,
+		Expiration: timeutil.Now().Add(sqlStatsActivityTransferClaimTTL.Get(&u.st.SV)),
+	}
+	value, err := json.Marshal(claim)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		infoStorage := jobs.InfoStorageForJob(txn, jobs.SqlActivityUpdaterJobID)
+		held, ok, err := getActivityTransferClaim(ctx, infoStorage)
+		if err != nil {
+			return err
+		}
+		if extend {
+			if !ok || held.ID != id || !held.Expiration.After(timeutil.Now()) {
+				return errActivityTransferClaimLost
+			}
+		} else if ok && held.Expiration.After(timeutil.Now()) {
+			return ErrTransferAlreadyRunning
+		}
+		return infoStorage.Write(ctx, activityTransferClaimInfoKey, value)
+	}); err != nil {
+		return time.Time{}, err
+	}
+	return claim.Expiration, nil
+}
+
+// heartbeatTransferClaim extends the claim with the given ID every third of
+// sql.stats.activity.transfer.claim_ttl until done is closed. If the claim is
+// lost, because another transfer took it or it expired before it could be
+// extended, it cancels the transfer with errActivityTransferClaimLost.
+func (u *sqlActivityUpdater) heartbeatTransferClaim(
+	ctx context.Context,
+	id uuid.UUID,
+	expiration time.Time,
+	done <-chan struct{},
+	cancel context.CancelCauseFunc,
+) {
+	timer := time.NewTimer(sqlStatsActivityTransferClaimTTL.Get(&u.st.SV) / 3)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		extended, err := u.writeTransferClaim(ctx, id, true /* extend */)
+		switch {
+		case err == nil:
+			expiration = extended
+		case errors.Is(err, errActivityTransferClaimLost):
+			log.Warningf(ctx, "sql stats activity canceling the transfer: %v", err)
+			cancel(err)
+			return
+		case !expiration.After(timeutil.Now()):
+			err = errors.CombineErrors(errActivityTransferClaimLost, err)
+			log.Warningf(ctx, "sql stats activity canceling the transfer: %v", err)
+			cancel(err)
+			return
+		default:
+			// The claim is still held, so the extension is retried until it
+			// expires.
+			log.Warningf(ctx, "sql stats activity failed to extend the transfer claim: %v", err)
+		}
+		timer.Reset(sqlStatsActivityTransferClaimTTL.Get(&u.st.SV) / 3)
+	}
+}
+
+// releaseTransfer releases the claim of the transfers if it is still held by
+// the claim with the given ID.
+func (u *sqlActivityUpdater) releaseTransfer(ctx context.Context, id uuid.UUID) error {
+	return u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		infoStorage := jobs.InfoStorageForJob(txn, jobs.SqlActivityUpdaterJobID)
+		held, ok, err := getActivityTransferClaim(ctx, infoStorage)
+		if err != nil || !ok || held.ID != id {
+			return err
+		}
+		return infoStorage.Delete(ctx, activityTransferClaimInfoKey)
+	})
+}
+
+// getActivityTransferClaim returns the claim of the transfers, if any.
+func getActivityTransferClaim(
+	ctx context.Context, infoStorage jobs.InfoStorage,
+) (activityTransferClaim, bool, error) {
+	var claim activityTransferClaim
+	value, ok, err := infoStorage.Get(ctx, activityTransferClaimInfoKey)
+	if err != nil || !ok {
+		return claim, false, err
+	}
+	if err := json.Unmarshal(value, &claim); err != nil {
+		return claim, false, errors.Wrap(err, "decoding the sql activity transfer claim")
+	}
+	return claim, true, nil
+}
+
+// waitActivityTransferJitter waits for a random delay of up to
+// activityTransferMaxJitter, and returns false if ctx is canceled or stopped
+// is closed first.
+func waitActivityTransferJitter(ctx context.Context, stopped <-chan struct{}) bool {
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(activityTransferMaxJitter))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-stopped:
+		return false
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+)
+
+// sqlStatsActivityTransferCombined is the cluster setting that writes both
+// activity tables with a single statement when all the statistics of an
+// aggregated timestamp are transferred.
+var sqlStatsActivityTransferCombined = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.combined.enabled",
+	"if enabled, when all the statistics of an aggregated timestamp are transferred, the statement "+
+		"and transaction activity tables are written by a single statement, so they are transferred "+
+		"from the same snapshot of the statistics",
+	false,
+)
+
+// transferAllStatsCombined is the equivalent of transferAllStats when
+// sql.stats.activity.transfer.combined.enabled is set. Both activity tables
+// are upserted by the data-modifying CTEs of a single statement, in one round
+// trip and one implicit transaction, so the statements of every transferred
+// transaction are transferred too, even if statistics are flushed during the
+// transfer. The transfer is a single checkpointed phase.
+func (u *sqlActivityUpdater) transferAllStatsCombined(
+	ctx context.Context,
+	aggTs time.Time,
+	totalEstimatedStmtClusterExecSeconds float64,
+	totalEstimatedTxnClusterExecSeconds float64,
+) error {
+	return u.runPhase(ctx, aggTs, activityTransferPhaseCombined, func(ctx context.Context) error {
+		row, err := u.db.Executor().QueryRowEx(ctx,
+			"activity-flush-transfer-all-combined",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`
+WITH txn_rows AS (`+u.txnTransferAllQuery("$1")+` RETURNING fingerprint_id),
+     stmt_rows AS (`+u.stmtTransferAllQuery("$4")+` RETURNING fingerprint_id)
+SELECT (SELECT count(*) FROM stmt_rows), (SELECT count(*) FROM txn_rows)`,
+			totalEstimatedTxnClusterExecSeconds,
+			aggTs,
+			u.ignoredAppNames,
+			totalEstimatedStmtClusterExecSeconds,
+		)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return nil
+		}
+		u.recordRowsTransferred(ctx, int(tree.MustBeDInt(row[0])), int(tree.MustBeDInt(row[1])))
+		return nil
+	})
+}
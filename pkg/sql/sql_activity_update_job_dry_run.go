@@ -0,0 +1,288 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+)
+
+// TransferPlan describes what TransferStatsToActivity would write to the
+// activity tables for the current aggregated timestamp.
+type TransferPlan struct {
+	// AggregatedTs is the aggregated timestamp the plan was computed for.
+	AggregatedTs time.Time
+	// TransferAll is true if all the statistics would be transferred, rather
+	// than only the top statistics of each ranking column.
+	TransferAll bool
+	// StmtRowCount is the number of rows that would be inserted into
+	// system.statement_activity.
+	StmtRowCount int64
+	// TxnRowCount is the number of rows that would be inserted into
+	// system.transaction_activity.
+	TxnRowCount int64
+	// EstimatedBytes is an estimate of the number of bytes of statistics,
+	// metadata and plans that would be written to the activity tables.
+	EstimatedBytes int64
+	// Candidates contains one entry per (fingerprint_id, app_name) key that
+	// would be transferred.
+	Candidates []TransferCandidate
+}
+
+// TransferCandidate is a (fingerprint_id, app_name) key of the statistics
+// tables that would be transferred to an activity table.
+type TransferCandidate struct {
+	// Table is the activity table the key would be transferred to.
+	Table         string
+	FingerprintID []byte
+	AppName       string
+	// RankingColumns are the ranking columns the key qualified under. It is
+	// empty if all the statistics would be transferred.
+	RankingColumns []string
+}
+
+// DryRunTransferStatsToActivity runs the same selection queries as
+// TransferStatsToActivity and returns a description of what would be
+// transferred, without writing to the activity tables.
+func (u *sqlActivityUpdater) DryRunTransferStatsToActivity(
+	ctx context.Context,
+) (TransferPlan, error) {
+	topLimits := u.topLimits
+	aggTs := u.computeAggregatedTs(&u.st.SV)
+	plan := TransferPlan{AggregatedTs: aggTs}
+
+	stmtRowCount, txnRowCount, _, _, err := u.getAostRowCountAndTotalClusterExecSeconds(ctx, aggTs)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	if stmtRowCount == 0 && txnRowCount == 0 {
+		return plan, nil
+	}
+
+	var txnRows, stmtRows []tree.Datums
+	plan.TransferAll = u.shouldTransferAll(topLimits, stmtRowCount, txnRowCount)
+	if plan.TransferAll {
+		txnRows, err = u.queryAllKeys(ctx, "system.public.transaction_statistics", aggTs)
+		if err != nil {
+			return TransferPlan{}, err
+		}
+		stmtRows, err = u.queryAllKeys(ctx, "system.public.statement_statistics", aggTs)
+		if err != nil {
+			return TransferPlan{}, err
+		}
+	} else {
+		txnRows, err = u.queryTopKeys(ctx, "activity-dry-run-txn-select-tops", selectTopTxnKeysQuery(topLimits), aggTs, topLimits.txn, topLimits.totalTime)
+		if err != nil {
+			return TransferPlan{}, err
+		}
+		stmtRows, err = u.queryTopKeys(ctx, "activity-dry-run-stmt-select-tops", selectTopStmtKeysQuery(topLimits), aggTs, topLimits.stmt, topLimits.totalTime)
+		if err != nil {
+			return TransferPlan{}, err
+		}
+	}
+
+	txnKeys, err := addTransferCandidates(&plan, "transaction_activity", txnRows, txnActivityRankingColumns, topLimits)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	stmtKeys, err := addTransferCandidates(&plan, "statement_activity", stmtRows, stmtActivityRankingColumns, topLimits)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+
+	var txnBytes, stmtBytes int64
+	plan.TxnRowCount, txnBytes, err = u.estimateActivityRows(ctx, "activity-dry-run-txn-estimate", `
+SELECT count_rows()::INT, COALESCE(sum(row_bytes), 0)::INT
+FROM (SELECT max(octet_length(ts.statistics::STRING)) +
+             max(octet_length(ts.metadata::STRING)) AS row_bytes
+      FROM system.public.transaction_statistics ts
+               INNER JOIN (SELECT unnest($2::BYTES[])  AS fingerprint_id,
+                                  unnest($3::STRING[]) AS app_name) keys
+                          USING (fingerprint_id, app_name)
+      WHERE ts.aggregated_ts = $1
+      GROUP BY fingerprint_id, app_name)`, aggTs, txnKeys)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	plan.StmtRowCount, stmtBytes, err = u.estimateActivityRows(ctx, "activity-dry-run-stmt-estimate", `
+SELECT count_rows()::INT, COALESCE(sum(row_bytes), 0)::INT
+FROM (SELECT max(octet_length(ss.statistics::STRING)) +
+             max(octet_length(ss.metadata::STRING)) +
+             COALESCE(max(octet_length(ss.plan::STRING)), 0) AS row_bytes
+      FROM system.public.statement_statistics ss
+               INNER JOIN (SELECT unnest($2::BYTES[])  AS fingerprint_id,
+                                  unnest($3::STRING[]) AS app_name) keys
+                          USING (fingerprint_id, app_name)
+      WHERE ss.aggregated_ts = $1
+      GROUP BY fingerprint_id, plan_hash, app_name)`, aggTs, stmtKeys)
+	if err != nil {
+		return TransferPlan{}, err
+	}
+	plan.EstimatedBytes = txnBytes + stmtBytes
+	return plan, nil
+}
+
+// queryAllKeys returns the distinct (fingerprint_id, app_name) keys of the
+// given statistics table which transferAllStats would transfer.
+func (u *sqlActivityUpdater) queryAllKeys(
+	ctx context.Context, tableName string, aggTs time.Time,
+) ([]tree.Datums, error) {
+	return u.db.Executor().QueryBufferedEx(ctx,
+		"activity-dry-run-select-all",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT DISTINCT fingerprint_id, app_name
+FROM %s
+WHERE aggregated_ts = $1
+  AND ($2::STRING = '' OR app_name !~ $2)
+ORDER BY fingerprint_id, app_name`, tableName),
+		aggTs,
+		u.ignoredAppNames,
+	)
+}
+
+// addTransferCandidates adds a TransferCandidate to the plan for each of the
+// rows returned by a key selection query, and returns the keys of the rows.
+// Any columns after the key are booleans indicating whether the key qualified
+// under the corresponding ranking column, which is only reported if the
+// statistics are ranked by it.
+func addTransferCandidates(
+	plan *TransferPlan,
+	table string,
+	rows []tree.Datums,
+	rankingColumns []string,
+	topLimits activityTopLimits,
+) (activityTransferKeys, error) {
+	keys := makeActivityTransferKeys()
+	for _, row := range rows {
+		if err := keys.add(row); err != nil {
+			return keys, err
+		}
+		candidate := TransferCandidate{
+			Table:         table,
+			FingerprintID: []byte(tree.MustBeDBytes(row[0])),
+			AppName:       string(tree.MustBeDString(row[1])),
+		}
+		for i, qualified := range row[2:] {
+			if b, ok := qualified.(*tree.DBool); ok && bool(*b) && topLimits.ranksBy(rankingColumns[i]) {
+				candidate.RankingColumns = append(candidate.RankingColumns, rankingColumns[i])
+			}
+		}
+		plan.Candidates = append(plan.Candidates, candidate)
+	}
+	return keys, nil
+}
+
+// estimateActivityRows runs an estimation query for the given keys, returning
+// the number of rows and bytes that would be written to an activity table.
+func (u *sqlActivityUpdater) estimateActivityRows(
+	ctx context.Context, opName string, query string, aggTs time.Time, keys activityTransferKeys,
+) (rowCount int64, estimatedBytes int64, err error) {
+	if keys.len() == 0 {
+		return 0, 0, nil
+	}
+	row, err := u.db.Executor().QueryRowEx(ctx,
+		opName,
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		query,
+		aggTs,
+		keys.fingerprintIDs,
+		keys.appNames,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	if row == nil {
+		return 0, 0, nil
+	}
+	return int64(tree.MustBeDInt(row[0])), int64(tree.MustBeDInt(row[1])), nil
+}
+
+// rankTxnCandidatesQuery returns the query of the rank of every transaction
+// key by each of txnActivityRankingColumns, followed by a NULL p99 latency rank
+// and whether transferTopStats admits the key.
+func rankTxnCandidatesQuery(topLimits activityTopLimits) string {
+	return `
+SELECT fingerprint_id, app_name, ePos, sPos, tPos, cPos, uPos, NULL::INT8,
+       COALESCE(` + txnTopAdmissionPredicate(topLimits, "$2", "$3") + `, false)
+FROM (` + rankedTxnStatsQuery(topLimits, "" /* keyFilter */) + `)
+ORDER BY fingerprint_id, app_name`
+}
+
+// rankStmtCandidatesQuery returns the query of the rank of every statement key
+// by each of stmtActivityRankingColumns, followed by whether transferTopStats
+// admits the key.
+func rankStmtCandidatesQuery(topLimits activityTopLimits) string {
+	return `
+SELECT fingerprint_id, app_name, ePos, sPos, tPos, cPos, uPos, lPos,
+       COALESCE(` + stmtTopAdmissionPredicate(topLimits, "$2", "$3") + `, false)
+FROM (` + rankedStmtStatsQuery(topLimits, "" /* keyFilter */) + `)
+ORDER BY fingerprint_id, app_name`
+}
+
+// forEachRankedTransferCandidate calls fn for every key of the statistics
+// tables of the current aggregated timestamp with the activity table the key
+// is transferred to. The row holds the fingerprint_id and app_name of the key,
+// its rank by each of stmtActivityRankingColumns (the p99 latency rank is NULL
+// for transactions), and whether TransferStatsToActivity admits the key.
+func (u *sqlActivityUpdater) forEachRankedTransferCandidate(
+	ctx context.Context, fn func(aggTs time.Time, activityTable string, row tree.Datums) error,
+) error {
+	topLimits := u.topLimits
+	aggTs := u.computeAggregatedTs(&u.st.SV)
+
+	stmtRowCount, txnRowCount, _, _, err := u.getAostRowCountAndTotalClusterExecSeconds(ctx, aggTs)
+	if err != nil {
+		return err
+	}
+	// When all the statistics are transferred every key is admitted,
+	// regardless of its rank.
+	transferAll := u.shouldTransferAll(topLimits, stmtRowCount, txnRowCount)
+
+	for _, ranking := range []struct {
+		activityTable string
+		opName        string
+		query         string
+		topLimit      int64
+	}{
+		{"transaction_activity", "activity-debug-txn-rank", rankTxnCandidatesQuery(topLimits), topLimits.txn},
+		{"statement_activity", "activity-debug-stmt-rank", rankStmtCandidatesQuery(topLimits), topLimits.stmt},
+	} {
+		rows, err := u.db.Executor().QueryBufferedEx(ctx,
+			ranking.opName,
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			ranking.query,
+			aggTs,
+			ranking.topLimit,
+			topLimits.totalTime,
+			u.ignoredAppNames,
+		)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if transferAll {
+				row[len(row)-1] = tree.DBoolTrue
+			}
+			if err := fn(aggTs, ranking.activityTable, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// activityCandidateKeyFilter restricts the top key selection queries to the
+// candidate keys passed in $5 and $6.
+const activityCandidateKeyFilter = `
+                    AND (fingerprint_id, app_name) IN (SELECT unnest($5::BYTES[]), unnest($6::STRING[]))`
+
+// selectCandidateTopTxnKeysQuery returns selectTopTxnKeysQuery restricted to
+// the candidate keys.
+func selectCandidateTopTxnKeysQuery(topLimits activityTopLimits) string {
+	return fmt.Sprintf(selectTopTxnKeysQueryFormat,
+		rankedTxnStatsQuery(topLimits, activityCandidateKeyFilter), txnTopAdmissionPredicate(topLimits, "$2", "$3"))
+}
+
+// selectCandidateTopStmtKeysQuery returns selectTopStmtKeysQuery restricted to
+// the candidate keys.
+func selectCandidateTopStmtKeysQuery(topLimits activityTopLimits) string {
+	return fmt.Sprintf(selectTopStmtKeysQueryFormat,
+		rankedStmtStatsQuery(topLimits, activityCandidateKeyFilter), stmtTopAdmissionPredicate(topLimits, "$2", "$3"))
+}
+
+// TransferStatsToActivityIncremental is like TransferStatsToActivity, but only
+// processes the statistics rows written after highWater. It returns the new
+// high-water timestamp, which should be passed to the next call. If highWater
+// is empty all the statistics of the current aggregated timestamp are
+// transferred.
+//
+// The top statistics are re-ranked across the union of the keys which are
+// already in the activity tables and the keys which changed since highWater,
+// so the keys which fall out of the top are removed and only the changed keys
+// are rewritten. If another transfer is running, it returns
+// ErrTransferAlreadyRunning and highWater without transferring anything. If the
+// activity tables are not ready to be written, or the transfers are paused by
+// sql.stats.activity.transfer.enabled, the transfer is skipped and highWater is
+// returned without an error.
+func (u *sqlActivityUpdater) TransferStatsToActivityIncremental(
+	ctx context.Context, highWater hlc.Timestamp,
+) (hlc.Timestamp, error) {
+	if u.transferPaused(ctx) {
+		return highWater, nil
+	}
+	ctx, release, err := u.claimTransfer(ctx)
+	if err != nil {
+		return highWater, err
+	}
+	defer release()
+	if !u.activityTablesReady(ctx) {
+		return highWater, nil
+	}
+	start := timeutil.Now()
+	aggTs := u.computeAggregatedTs(&u.st.SV)
+	newHighWater, err := u.transferStatsToActivityIncremental(ctx, aggTs, highWater)
+	if err != nil {
+		err = wrapTransferError(err, activityTransferPhasePrepare, aggTs, u.aggregationWindowEnd(aggTs))
+	} else {
+		err = wrapTransferError(u.deleteExpiredActivity(ctx), activityTransferPhaseRetention, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err == nil {
+		err = wrapTransferError(u.maybeRollupActivityByTime(ctx), activityTransferPhaseTimeRollup, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err == nil {
+		u.recordLastTransfer(ctx, u.aggregationWindowEnd(aggTs))
+	}
+	u.recordTransfer(start, err)
+	return newHighWater, err
+}
+
+func (u *sqlActivityUpdater) transferStatsToActivityIncremental(
+	ctx context.Context, aggTs time.Time, highWater hlc.Timestamp,
+) (hlc.Timestamp, error) {
+	if err := u.checkActivityTables(ctx); err != nil {
+		return highWater, err
+	}
+
+	// The high water is read before the transfer, so rows written during the
+	// transfer are processed again by the next transfer.
+	newHighWater, err := u.getStatsHighWater(ctx, aggTs)
+	if err != nil {
+		return highWater, err
+	}
+
+	// The incremental merge re-ranks the keys, so the statistics are
+	// transferred in full when the top selection is disabled. The app names
+	// are rolled up from the rows of every app, so they are also transferred
+	// in full when the app names are limited or aggregated.
+	if highWater.IsEmpty() || newHighWater.IsEmpty() || sqlStatsActivityTransferUnlimited.Get(&u.st.SV) ||
+		u.maxAppNames > 0 || u.aggregateApps {
+		if err := u.transferStatsToActivity(ctx, aggTs); err != nil {
+			return highWater, err
+		}
+		return newHighWater, nil
+	}
+
+	if newHighWater.LessEq(highWater) {
+		log.Infof(ctx, "sql stats activity found no changes since %s", highWater)
+		return highWater, nil
+	}
+	// The statistics may not have changed since the last transfer even though
+	// they changed since highWater, e.g. if the last transfer was a full one.
+	contentHash, unchanged, err := u.checkUnchanged(ctx, aggTs)
+	if err != nil {
+		return highWater, err
+	}
+	if unchanged {
+		return newHighWater, nil
+	}
+
+	maxRowPersistedRows := sqlStatsActivityMaxPersistedRows.Get(&u.st.SV)
+	topLimits := u.topLimits
+	u.startProgress(ctx, aggTs)
+	stmtRowCount, txnRowCount, totalEstimatedStmtClusterExecSeconds, totalEstimatedTxnClusterExecSeconds, err := u.getAostRowCountAndTotalClusterExecSeconds(ctx, aggTs)
+	if err != nil {
+		return highWater, err
+	}
+	// Only the keys which changed are rewritten, so the estimate is an upper
+	// bound.
+	u.updateProgress(ctx, func(p *activityTransferProgress) {
+		p.rowsEstimate = u.estimateTransferRows(topLimits, stmtRowCount, txnRowCount)
+	})
+	if err := u.recordMalformedStatsRows(ctx, aggTs); err != nil {
+		return highWater, err
+	}
+	if err := u.compactActivityTables(ctx, maxRowPersistedRows-stmtRowCount); err != nil {
+		return highWater, err
+	}
+
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseTxn, func(ctx context.Context) error {
+		return u.mergeChangedActivity(ctx, aggTs, highWater,
+			"system.public.transaction_statistics", u.txnActivityTable,
+			selectCandidateTopTxnKeysQuery(topLimits), topLimits.txn, topLimits.totalTime,
+			func(keys activityTransferKeys) error {
+				return u.upsertTxnActivityForKeys(ctx, aggTs, keys, totalEstimatedTxnClusterExecSeconds)
+			})
+	}); err != nil {
+		return highWater, err
+	}
+
+	if err := u.runPhase(ctx, aggTs, activityTransferPhaseStmt, func(ctx context.Context) error {
+		return u.mergeChangedActivity(ctx, aggTs, highWater,
+			"system.public.statement_statistics", u.stmtActivityTable,
+			selectCandidateTopStmtKeysQuery(topLimits), topLimits.stmt, topLimits.totalTime,
+			func(keys activityTransferKeys) error {
+				return u.upsertStmtActivityForKeys(ctx, aggTs, keys, totalEstimatedStmtClusterExecSeconds)
+			})
+	}); err != nil {
+		return highWater, err
+	}
+	if err := u.clearCheckpoint(ctx); err != nil {
+		return highWater, wrapTransferError(err, activityTransferPhaseCheckpoint, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err := u.maybeHandleOversizedActivity(ctx, aggTs); err != nil {
+		return highWater, wrapTransferError(err, activityTransferPhaseOversizedRows, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err := u.maybeDedupActivity(ctx, aggTs); err != nil {
+		return highWater, wrapTransferError(err, activityTransferPhaseDedup, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	u.maybeVerifyActivity(ctx, aggTs)
+	u.maybeRecordRankingMetrics(ctx, aggTs)
+	if err := u.emitActivityToSink(ctx, aggTs); err != nil {
+		return highWater, wrapTransferError(err, activityTransferPhaseSink, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	if err := u.recordContentHash(ctx, contentHash); err != nil {
+		return highWater, wrapTransferError(err, activityTransferPhaseCheckpoint, aggTs, u.aggregationWindowEnd(aggTs))
+	}
+	u.finishProgress(ctx)
+
+	return newHighWater, nil
+}
+
+// mergeChangedActivity merges the keys of the statistics table which changed
+// since highWater into the activity table. The top keys are selected among the
+// changed keys and the keys already in the activity table, the activity rows of
+// the keys which were not selected are deleted, and upsert is called with the
+// selected keys which changed.
+func (u *sqlActivityUpdater) mergeChangedActivity(
+	ctx context.Context,
+	aggTs time.Time,
+	highWater hlc.Timestamp,
+	statsTableName string,
+	activityTableName string,
+	selectTopQuery string,
+	topLimit int64,
+	totalTimeTopLimit int64,
+	upsert func(activityTransferKeys) error,
+) error {
+	changedRows, err := u.db.Executor().QueryBufferedEx(ctx,
+		"activity-flush-select-changed",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT DISTINCT fingerprint_id, app_name
+FROM %s
+WHERE aggregated_ts = $1
+  AND ($3::STRING = '' OR app_name !~ $3)
+  AND crdb_internal_mvcc_timestamp > $2
+ORDER BY fingerprint_id, app_name`, statsTableName),
+		aggTs,
+		eval.TimestampToDecimalDatum(highWater),
+		u.ignoredAppNames,
+	)
+	if err != nil {
+		return err
+	}
+	if len(changedRows) == 0 {
+		return nil
+	}
+
+	existingRows, err := u.db.Executor().QueryBufferedEx(ctx,
+		"activity-flush-select-existing",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT DISTINCT fingerprint_id, app_name
+FROM %s
+WHERE aggregated_ts = $1
+ORDER BY fingerprint_id, app_name`, activityTableName),
+		aggTs,
+	)
+	if err != nil {
+		return err
+	}
+
+	candidates := makeActivityTransferKeys()
+	changed := make(map[string]struct{}, len(changedRows))
+	for _, row := range changedRows {
+		changed[activityKeyString(row)] = struct{}{}
+		if err := candidates.add(row); err != nil {
+			return err
+		}
+	}
+	for _, row := range existingRows {
+		if _, ok := changed[activityKeyString(row)]; ok {
+			continue
+		}
+		if err := candidates.add(row); err != nil {
+			return err
+		}
+	}
+
+	selectedRows, err := u.db.Executor().QueryBufferedEx(ctx,
+		"activity-flush-select-candidate-tops",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		selectTopQuery,
+		aggTs,
+		topLimit,
+		totalTimeTopLimit,
+		u.ignoredAppNames,
+		candidates.fingerprintIDs,
+		candidates.appNames,
+	)
+	if err != nil {
+		return err
+	}
+
+	selected := makeActivityTransferKeys()
+	selectedChanged := makeActivityTransferKeys()
+	for _, row := range selectedRows {
+		if err := selected.add(row); err != nil {
+			return err
+		}
+		if _, ok := changed[activityKeyString(row)]; ok {
+			if err := selectedChanged.add(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Remove the activity rows of the keys which are no longer in the top.
+	if err := u.deleteUnselectedActivity(ctx, "activity-flush-delete-dropped", activityTableName, aggTs, selected); err != nil {
+		return err
+	}
+
+	if selectedChanged.len() == 0 {
+		return nil
+	}
+	return upsert(selectedChanged)
+}
+
+// getStatsHighWater returns the largest MVCC timestamp of the statistics rows
+// of the aggregated timestamp, or an empty timestamp if there are none.
+func (u *sqlActivityUpdater) getStatsHighWater(
+	ctx context.Context, aggTs time.Time,
+) (hlc.Timestamp, error) {
+	row, err := u.db.Executor().QueryRowEx(ctx,
+		"activity-flush-high-water",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`
+SELECT max(ts)
+FROM (SELECT max(crdb_internal_mvcc_timestamp) AS ts
+      FROM system.public.statement_statistics
+      WHERE aggregated_ts = $1
+      UNION ALL
+      SELECT max(crdb_internal_mvcc_timestamp) AS ts
+      FROM system.public.transaction_statistics
+      WHERE aggregated_ts = $1)`,
+		aggTs,
+	)
+	if err != nil {
+		return hlc.Timestamp{}, err
+	}
+	if row == nil || row[0] == tree.DNull {
+		return hlc.Timestamp{}, nil
+	}
+	return hlc.DecimalToHLC(&tree.MustBeDDecimal(row[0]).Decimal)
+}
+
+// activityKeyString returns a map key for the (fingerprint_id, app_name) key
+// stored in the first two columns of the row.
+func activityKeyString(row tree.Datums) string {
+	return string(tree.MustBeDBytes(row[0])) + "\x00" + string(tree.MustBeDString(row[1]))
+}
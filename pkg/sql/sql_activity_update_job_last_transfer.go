@@ -0,0 +1,76 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// activityLastTransferInfoKey is the key of the last successful transfer in
+// the system.job_info rows of the activity updater job.
+const activityLastTransferInfoKey = "sql_activity_last_transfer"
+
+// activityLastTransfer describes the last successful transfer to the activity
+// tables, which is shown by crdb_internal.sql_activity_last_transfer.
+type activityLastTransfer struct {
+	// WindowEnd is the end of the last aggregation window the transfer wrote
+	// the activity of.
+	WindowEnd time.Time `json:"window_end"`
+	// CompletedAt is when the transfer completed.
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// recordLastTransfer records the completion of a successful transfer of the
+// windows ending at windowEnd. A transfer of windows older than the recorded
+// one, e.g. the transfer of a past window, does not move the recorded window
+// end back. Failing to record the transfer is logged, and does not fail it.
+func (u *sqlActivityUpdater) recordLastTransfer(ctx context.Context, windowEnd time.Time) {
+	if err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		infoStorage := jobs.InfoStorageForJob(txn, jobs.SqlActivityUpdaterJobID)
+		last, ok, err := getActivityLastTransfer(ctx, infoStorage)
+		if err != nil {
+			return err
+		}
+		if ok && last.WindowEnd.After(windowEnd) {
+			windowEnd = last.WindowEnd
+		}
+		value, err := json.Marshal(activityLastTransfer{WindowEnd: windowEnd, CompletedAt: timeutil.Now()})
+		if err != nil {
+			return err
+		}
+		return infoStorage.Write(ctx, activityLastTransferInfoKey, value)
+	}); err != nil {
+		log.Warningf(ctx, "sql stats activity failed to record the last transfer: %v", err)
+	}
+}
+
+// getActivityLastTransfer returns the last successful transfer, if any.
+func getActivityLastTransfer(
+	ctx context.Context, infoStorage jobs.InfoStorage,
+) (activityLastTransfer, bool, error) {
+	var last activityLastTransfer
+	value, ok, err := infoStorage.Get(ctx, activityLastTransferInfoKey)
+	if err != nil || !ok {
+		return last, false, err
+	}
+	if err := json.Unmarshal(value, &last); err != nil {
+		return last, false, errors.Wrap(err, "decoding the last sql activity transfer")
+	}
+	return last, true, nil
+}
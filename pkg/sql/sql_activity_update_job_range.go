@@ -0,0 +1,172 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/errors"
+)
+
+// CombinedActivity is the statement and transaction activity of the
+// aggregation windows intersecting a time range.
+type CombinedActivity struct {
+	// Statements are the rows of system.statement_activity, combined per
+	// window and statement fingerprint.
+	Statements []CombinedActivityRow
+	// Transactions are the rows of system.transaction_activity, combined per
+	// window and transaction fingerprint.
+	Transactions []CombinedActivityRow
+	// Truncated is set if the statements or the transactions were limited to
+	// the first rows intersecting the range.
+	Truncated bool
+}
+
+// CombinedActivityRow is the activity of a fingerprint in an aggregation
+// window, combining the rows of all its app names and, for statements, plan
+// hashes.
+type CombinedActivityRow struct {
+	AggregatedTs          time.Time
+	FingerprintID         []byte
+	ExecutionCount        int64
+	ExecutionTotalSeconds float64
+	// Metadata is the merged metadata of the rows. For transactions, it is
+	// the metadata of one of the rows, which all have the same statement
+	// fingerprint IDs.
+	Metadata json.JSON
+	// Statistics are the merged statistics of the rows.
+	Statistics json.JSON
+}
+
+// combinedStmtActivityForRangeQueryFormat combines the rows of the statement
+// activity table, the format argument, of the windows intersecting [$1, $2)
+// per window and fingerprint, returning the first $3 of them.
+const combinedStmtActivityForRangeQueryFormat = `
+SELECT aggregated_ts,
+       fingerprint_id,
+       sum(execution_count)::INT,
+       sum(execution_total_seconds)::FLOAT,
+       crdb_internal.merge_aggregated_stmt_metadata(array_agg(metadata)),
+       merge_statement_stats(statistics)
+FROM %s
+WHERE aggregated_ts < $2
+  AND aggregated_ts + agg_interval > $1
+GROUP BY aggregated_ts, fingerprint_id
+ORDER BY aggregated_ts, fingerprint_id
+LIMIT $3`
+
+// combinedTxnActivityForRangeQueryFormat combines the rows of the transaction
+// activity table, the format argument, of the windows intersecting [$1, $2)
+// per window and fingerprint, returning the first $3 of them.
+const combinedTxnActivityForRangeQueryFormat = `
+SELECT aggregated_ts,
+       fingerprint_id,
+       sum(execution_count)::INT,
+       sum(execution_total_seconds)::FLOAT,
+       max(metadata),
+       merge_transaction_stats(statistics)
+FROM %s
+WHERE aggregated_ts < $2
+  AND aggregated_ts + agg_interval > $1
+GROUP BY aggregated_ts, fingerprint_id
+ORDER BY aggregated_ts, fingerprint_id
+LIMIT $3`
+
+// CombinedActivityForRange returns the statement and transaction activity of
+// every aggregation window intersecting [start, end), ordered by window and
+// fingerprint. The rows are buffered, so at most limit statements and limit
+// transactions are returned, the first ones in that order, and Truncated is
+// set if there were more; a range spanning many windows can be read in
+// shorter ranges instead.
+func (u *sqlActivityUpdater) CombinedActivityForRange(
+	ctx context.Context, start time.Time, end time.Time, limit int,
+) (CombinedActivity, error) {
+	if !start.Before(end) {
+		return CombinedActivity{}, errors.Newf(
+			"invalid activity range: start %s is not before end %s", start, end)
+	}
+	if limit <= 0 {
+		return CombinedActivity{}, errors.Newf("invalid activity row limit: %d", limit)
+	}
+	var activity CombinedActivity
+	var stmtsTruncated, txnsTruncated bool
+	var err error
+	activity.Statements, stmtsTruncated, err = u.queryCombinedActivity(ctx,
+		"activity-range-stmt", fmt.Sprintf(combinedStmtActivityForRangeQueryFormat, u.stmtActivityTable),
+		start, end, limit)
+	if err != nil {
+		return CombinedActivity{}, err
+	}
+	activity.Transactions, txnsTruncated, err = u.queryCombinedActivity(ctx,
+		"activity-range-txn", fmt.Sprintf(combinedTxnActivityForRangeQueryFormat, u.txnActivityTable),
+		start, end, limit)
+	if err != nil {
+		return CombinedActivity{}, err
+	}
+	activity.Truncated = stmtsTruncated || txnsTruncated
+	return activity, nil
+}
+
+// queryCombinedActivity runs a combined activity query over [start, end),
+// returning at most limit rows and whether there were more.
+func (u *sqlActivityUpdater) queryCombinedActivity(
+	ctx context.Context, opName string, query string, start time.Time, end time.Time, limit int,
+) (rows []CombinedActivityRow, truncated bool, err error) {
+	it, err := u.db.Executor().QueryIteratorEx(ctx,
+		opName,
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		query,
+		start,
+		end,
+		limit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		if len(rows) == limit {
+			truncated = true
+			break
+		}
+		row := it.Cur()
+		rows = append(rows, CombinedActivityRow{
+			AggregatedTs:          tree.MustBeDTimestampTZ(row[0]).Time,
+			FingerprintID:         []byte(tree.MustBeDBytes(row[1])),
+			ExecutionCount:        int64(tree.MustBeDInt(row[2])),
+			ExecutionTotalSeconds: float64(tree.MustBeDFloat(row[3])),
+			Metadata:              tree.MustBeDJSON(row[4]).JSON,
+			Statistics:            tree.MustBeDJSON(row[5]).JSON,
+		})
+	}
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	return rows, truncated, err
+}
+
+// CombinedActivityForRange returns the statement and transaction activity of
+// every aggregation window intersecting [start, end), combined per window and
+// fingerprint, up to limit rows of each. See
+// sqlActivityUpdater.CombinedActivityForRange.
+func (s *Server) CombinedActivityForRange(
+	ctx context.Context, start time.Time, end time.Time, limit int,
+) (CombinedActivity, error) {
+	updater := newSqlActivityUpdater(s.cfg.Settings, s.cfg.InternalDB, s.cfg.SQLStatsTestingKnobs, nil /* registry */, nil /* sink */)
+	return updater.CombinedActivityForRange(ctx, start, end, limit)
+}
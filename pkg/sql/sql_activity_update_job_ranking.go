@@ -0,0 +1,120 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+// activityRankingAdmissions are the numbers of statistics keys the top
+// selection of an aggregated timestamp admits into the activity tables.
+type activityRankingAdmissions struct {
+	// byColumn is the number of keys admitted by each ranking column. A key
+	// ranked in the top of several columns is counted by each of them.
+	byColumn map[string]int64
+	// unique is the number of distinct keys admitted.
+	unique int64
+}
+
+// overlapRatio returns the ratio of the distinct keys admitted to the sum of
+// the keys admitted by each ranking column. It is 1 when the columns admit
+// disjoint keys, and approaches 1/n, for n ranking columns, as they admit the
+// same keys, in which case sql.stats.activity.top.max could be raised without
+// admitting many more keys. It is 1 when no key is admitted.
+func (a activityRankingAdmissions) overlapRatio() float64 {
+	var sum int64
+	for _, count := range a.byColumn {
+		sum += count
+	}
+	if sum == 0 {
+		return 1
+	}
+	return float64(a.unique) / float64(sum)
+}
+
+// maybeRecordRankingMetrics records in the updater's metrics how many keys of
+// the aggregated timestamp each ranking column admits into the activity
+// tables, how many distinct keys they admit together, and their overlap ratio,
+// to help tune sql.stats.activity.top.max. It runs the top selection queries again, so it
+// is only done by updaters with metrics, and not when the top selection is
+// disabled. Errors are logged, and do not fail the transfer.
+func (u *sqlActivityUpdater) maybeRecordRankingMetrics(ctx context.Context, aggTs time.Time) {
+	if u.metrics == nil || sqlStatsActivityTransferUnlimited.Get(&u.st.SV) {
+		return
+	}
+	admissions, err := u.countRankingAdmissions(ctx, aggTs, u.topLimits)
+	if err != nil {
+		log.Warningf(ctx, "sql stats activity failed to count the keys admitted by each ranking column at %s: %v",
+			aggTs, err)
+		return
+	}
+	counters := u.metrics.rankingColumnCounters()
+	for column, count := range admissions.byColumn {
+		counters[column].Inc(count)
+	}
+	u.metrics.NumUniqueAdmittedRows.Update(admissions.unique)
+	ratio := admissions.overlapRatio()
+	u.metrics.AdmittedRowsOverlapRatio.Update(ratio)
+	if log.V(1) {
+		log.Infof(ctx, "sql stats activity admitted %d distinct keys at %s, an overlap ratio of %.2f of the keys admitted by each ranking column",
+			admissions.unique, aggTs, ratio)
+	}
+}
+
+// countRankingAdmissions runs the top key selection queries of both activity
+// tables and counts the keys they admit.
+func (u *sqlActivityUpdater) countRankingAdmissions(
+	ctx context.Context, aggTs time.Time, topLimits activityTopLimits,
+) (activityRankingAdmissions, error) {
+	admissions := activityRankingAdmissions{byColumn: make(map[string]int64)}
+	for _, selection := range []struct {
+		opName         string
+		query          string
+		topLimit       int64
+		rankingColumns []string
+	}{
+		{"activity-flush-txn-count-tops", selectTopTxnKeysQuery(topLimits), topLimits.txn, txnActivityRankingColumns},
+		{"activity-flush-stmt-count-tops", selectTopStmtKeysQuery(topLimits), topLimits.stmt, stmtActivityRankingColumns},
+	} {
+		rows, err := u.queryTopKeys(ctx, selection.opName, selection.query, aggTs, selection.topLimit, topLimits.totalTime)
+		if err != nil {
+			return activityRankingAdmissions{}, err
+		}
+		admissions.unique += int64(len(rows))
+		for _, row := range rows {
+			for i, qualified := range row[2:] {
+				column := selection.rankingColumns[i]
+				if b, ok := qualified.(*tree.DBool); ok && bool(*b) && topLimits.ranksBy(column) {
+					admissions.byColumn[column]++
+				}
+			}
+		}
+	}
+	return admissions, nil
+}
+
+// rankingColumnCounters returns the counters of the keys admitted by each
+// ranking column.
+func (m *ActivityUpdaterMetrics) rankingColumnCounters() map[string]*metric.Counter {
+	return map[string]*metric.Counter{
+		"execution_count":      m.NumAdmittedByExecutionCount,
+		"service_latency":      m.NumAdmittedByServiceLatency,
+		"total_execution_time": m.NumAdmittedByTotalExecutionTime,
+		"contention_time":      m.NumAdmittedByContentionTime,
+		"cpu_sql_nanos":        m.NumAdmittedByCPUSQLNanos,
+		"p99_latency":          m.NumAdmittedByP99Latency,
+	}
+}
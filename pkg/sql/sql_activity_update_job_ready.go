@@ -0,0 +1,56 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// isActivityTableNotReadyError returns true if err is the error of a query of
+// an activity table whose database, schema or table does not exist yet, or is
+// offline, e.g. while it is being restored or migrated.
+func isActivityTableNotReadyError(err error) bool {
+	switch pgerror.GetPGCode(err) {
+	case pgcode.UndefinedTable, pgcode.UndefinedSchema, pgcode.UndefinedDatabase,
+		pgcode.ObjectNotInPrerequisiteState:
+		return true
+	}
+	return false
+}
+
+// activityTablesReady returns false, after logging a warning and counting the
+// skipped transfer in the metrics, if the database or the activity tables the
+// statistics are transferred to are not ready to be written, so that the
+// transfer is skipped until they are rather than failing. Errors which don't
+// show that the tables are not ready are left to the transfer.
+func (u *sqlActivityUpdater) activityTablesReady(ctx context.Context) bool {
+	for _, table := range []string{u.txnActivityTable, u.stmtActivityTable} {
+		if _, err := u.db.Executor().ExecEx(ctx,
+			"activity-check-table-ready",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(`SELECT 1 FROM %s LIMIT 0`, table),
+		); err != nil && isActivityTableNotReadyError(err) {
+			log.Warningf(ctx, "sql stats activity skipped the transfer since activity table %s is not ready: %v", table, err)
+			if u.metrics != nil {
+				u.metrics.NumSkippedNotReady.Inc(1)
+			}
+			return false
+		}
+	}
+	return true
+}
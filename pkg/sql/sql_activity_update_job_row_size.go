@@ -0,0 +1,142 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// sqlStatsActivityTransferMaxRowBytes is the cluster setting that controls the
+// size above which the statement activity rows are handled according to
+// sql.stats.activity.transfer.oversized_rows, so that the huge query text of a
+// fingerprint does not exceed the row size limits and fail the transfer.
+var sqlStatsActivityTransferMaxRowBytes = settings.RegisterIntSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.max_row_bytes",
+	"the estimated size in bytes of the metadata, statistics and plan of a statement "+
+		"activity row above which the row is truncated or skipped according to "+
+		"sql.stats.activity.transfer.oversized_rows; 0 disables the limit",
+	0,
+	settings.NonNegativeInt,
+)
+
+// The modes of sql.stats.activity.transfer.oversized_rows.
+const (
+	activityOversizedRowsTruncate = iota
+	activityOversizedRowsSkip
+)
+
+// sqlStatsActivityTransferOversizedRows is the cluster setting that controls
+// what happens to the statement activity rows larger than
+// sql.stats.activity.transfer.max_row_bytes.
+var sqlStatsActivityTransferOversizedRows = settings.RegisterEnumSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.oversized_rows",
+	"controls the statement activity rows larger than sql.stats.activity.transfer.max_row_bytes: "+
+		"truncate shortens their query text and drops their formatted query and latency "+
+		"histograms, and skip removes them from the activity tables",
+	"truncate",
+	map[int64]string{
+		activityOversizedRowsTruncate: "truncate",
+		activityOversizedRowsSkip:     "skip",
+	},
+)
+
+// stmtOversizedMetadataFormat is the expression of the metadata column of the
+// statement_activity rows when sql.stats.activity.transfer.max_row_bytes is
+// set, given the expression of the metadata %[1]s, the maximum size of the row
+// %[2]d and the length the query text of oversized rows is truncated to %[3]d.
+// Oversized rows are marked as truncated, which also identifies the rows which
+// are removed in the skip mode.
+const stmtOversizedMetadataFormat = `CASE WHEN octet_length((%[1]s)::STRING) + octet_length(merged_stats::STRING) +
+                     COALESCE(octet_length(max_plan::STRING), 0) > %[2]d
+           THEN ((%[1]s) - 'latencyHistograms') || jsonb_build_object(
+             'query', COALESCE(left((%[1]s) ->> 'query', %[3]d), ''),
+             'formattedQuery', '',
+             'truncated', true)
+           ELSE %[1]s END`
+
+// stmtOversizedMetadata returns the expression of the metadata column of the
+// statement_activity rows which truncates the metadata of the oversized rows,
+// given the expression of their metadata.
+func (u *sqlActivityUpdater) stmtOversizedMetadata(metadata string) string {
+	// The query text is left a quarter of the row, so that the statistics and
+	// the plan are likely to fit in the rest.
+	return fmt.Sprintf(stmtOversizedMetadataFormat, metadata, u.maxRowBytes, u.maxRowBytes/4)
+}
+
+const countTruncatedStmtActivityQueryFormat = `
+SELECT count(*) FROM %s
+WHERE aggregated_ts = $1 AND (metadata ->> 'truncated')::BOOL`
+
+const deleteTruncatedStmtActivityQueryFormat = `
+DELETE FROM %s
+WHERE aggregated_ts = $1 AND (metadata ->> 'truncated')::BOOL`
+
+// maybeHandleOversizedActivity counts, or removes according to
+// sql.stats.activity.transfer.oversized_rows, the statement activity rows of
+// the aggregated timestamp which were truncated since they were larger than
+// sql.stats.activity.transfer.max_row_bytes.
+func (u *sqlActivityUpdater) maybeHandleOversizedActivity(
+	ctx context.Context, aggTs time.Time,
+) error {
+	if u.maxRowBytes == 0 {
+		return nil
+	}
+	var rows int64
+	action := "truncated"
+	if sqlStatsActivityTransferOversizedRows.Get(&u.st.SV) == activityOversizedRowsSkip {
+		action = "skipped"
+		deleted, err := u.db.Executor().ExecEx(ctx,
+			"activity-flush-skip-oversized",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(deleteTruncatedStmtActivityQueryFormat, u.stmtActivityTable),
+			aggTs,
+		)
+		if err != nil {
+			return err
+		}
+		rows = int64(deleted)
+	} else {
+		row, err := u.db.Executor().QueryRowEx(ctx,
+			"activity-flush-count-oversized",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(countTruncatedStmtActivityQueryFormat, u.stmtActivityTable),
+			aggTs,
+		)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return errors.New("unable to count the truncated statement activity rows")
+		}
+		rows = int64(tree.MustBeDInt(row[0]))
+	}
+	if rows == 0 {
+		return nil
+	}
+	log.Warningf(ctx, "sql stats activity %s %d statement activity rows larger than %d bytes at %s",
+		action, rows, u.maxRowBytes, aggTs)
+	if u.metrics != nil {
+		u.metrics.NumOversizedRows.Inc(rows)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
+)
+
+// activityTransferTables is the set of the activity tables written by a
+// transfer. The zero value is every activity table.
+type activityTransferTables uint8
+
+const (
+	activityTransferStmtTable activityTransferTables = 1 << iota
+	activityTransferTxnTable
+
+	activityTransferAllTables = activityTransferStmtTable | activityTransferTxnTable
+)
+
+// includes returns whether the set includes the table.
+func (t activityTransferTables) includes(table activityTransferTables) bool {
+	return t == 0 || t&table != 0
+}
+
+// all returns whether the set includes every activity table.
+func (t activityTransferTables) all() bool {
+	return t == 0 || t == activityTransferAllTables
+}
+
+// includesPhase returns whether the phase of the transfer is run when only the
+// tables of the set are written. The phases which write both activity tables,
+// such as the app name rollup, are only run when every table is written.
+func (t activityTransferTables) includesPhase(phase string) bool {
+	switch phase {
+	case activityTransferPhaseStmt:
+		return t.includes(activityTransferStmtTable)
+	case activityTransferPhaseTxn:
+		return t.includes(activityTransferTxnTable)
+	default:
+		return t.all()
+	}
+}
+
+// TransferStatementsOnly is like TransferStatsToActivity, but only transfers
+// the statement statistics to the statement activity table, e.g. to refresh it
+// quickly during an incident without the transfer of the transaction
+// statistics. The statements are ranked as by TransferStatsToActivity. The
+// steps which span both activity tables, such as the compaction, the
+// retention, the app name rollup, the verification and the sink, are skipped,
+// and the transfer is not recorded as the last transfer.
+func (u *sqlActivityUpdater) TransferStatementsOnly(ctx context.Context) error {
+	return u.transferCurrentTables(ctx, activityTransferStmtTable)
+}
+
+// TransferTransactionsOnly is the equivalent of TransferStatementsOnly for the
+// transaction activity table.
+func (u *sqlActivityUpdater) TransferTransactionsOnly(ctx context.Context) error {
+	return u.transferCurrentTables(ctx, activityTransferTxnTable)
+}
+
+// transferCurrentTables transfers the statistics of the current aggregated
+// timestamp to the given activity tables.
+func (u *sqlActivityUpdater) transferCurrentTables(
+	ctx context.Context, tables activityTransferTables,
+) error {
+	if u.flushBarrier != nil {
+		u.flushBarrier(ctx)
+	}
+	aggTs := u.computeAggregatedTs(&u.st.SV)
+	interval := persistedsqlstats.SQLStatsAggregationInterval.Get(&u.st.SV)
+	return u.transferTablesForWindow(ctx, aggTs, aggTs.Add(interval), tables)
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+)
+
+// ActivitySink receives the rows of the activity tables written by the
+// transfers, e.g. to stream them to an external observability pipeline. After
+// each transfer of an aggregated timestamp, the sink is passed all the rows of
+// the activity tables for that aggregated timestamp, as JSON objects keyed by
+// column name.
+type ActivitySink interface {
+	// WriteStatements receives the rows of system.statement_activity for the
+	// aggregated timestamp.
+	WriteStatements(ctx context.Context, aggTs time.Time, rows []json.JSON) error
+	// WriteTransactions receives the rows of system.transaction_activity for
+	// the aggregated timestamp.
+	WriteTransactions(ctx context.Context, aggTs time.Time, rows []json.JSON) error
+}
+
+// noopActivitySink is the ActivitySink of the updaters which are not given
+// one. It discards the rows.
+type noopActivitySink struct{}
+
+var _ ActivitySink = noopActivitySink{}
+
+// WriteStatements implements the ActivitySink interface.
+func (noopActivitySink) WriteStatements(context.Context, time.Time, []json.JSON) error {
+	return nil
+}
+
+// WriteTransactions implements the ActivitySink interface.
+func (noopActivitySink) WriteTransactions(context.Context, time.Time, []json.JSON) error {
+	return nil
+}
+
+// emitActivityToSink passes the rows of the activity tables for the aggregated
+// timestamp to the updater's sink. The activity tables are not read if the
+// sink is the no-op sink.
+func (u *sqlActivityUpdater) emitActivityToSink(ctx context.Context, aggTs time.Time) error {
+	if _, ok := u.sink.(noopActivitySink); ok {
+		return nil
+	}
+	txnRows, err := u.queryActivityRowsAsJSON(ctx, aggTs, u.txnActivityTable,
+		"fingerprint_id, app_name")
+	if err != nil {
+		return err
+	}
+	if err := u.sink.WriteTransactions(ctx, aggTs, txnRows); err != nil {
+		return err
+	}
+	stmtRows, err := u.queryActivityRowsAsJSON(ctx, aggTs, u.stmtActivityTable,
+		"fingerprint_id, transaction_fingerprint_id, plan_hash, app_name")
+	if err != nil {
+		return err
+	}
+	return u.sink.WriteStatements(ctx, aggTs, stmtRows)
+}
+
+// queryActivityRowsAsJSON returns the rows of the activity table for the
+// aggregated timestamp as JSON objects, in the given order.
+func (u *sqlActivityUpdater) queryActivityRowsAsJSON(
+	ctx context.Context, aggTs time.Time, tableName string, orderBy string,
+) (rows []json.JSON, err error) {
+	it, err := u.db.Executor().QueryIteratorEx(ctx,
+		"activity-flush-sink",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT to_jsonb(a) FROM `+tableName+` AS a WHERE aggregated_ts = $1 ORDER BY `+orderBy,
+		aggTs,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		rows = append(rows, tree.MustBeDJSON(it.Cur()[0]).JSON)
+	}
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	return rows, err
+}
@@ -12,9 +12,12 @@ package sql
 
 import (
 	"context"
+	gosql "database/sql"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
@@ -32,14 +36,18 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
 	"github.com/cockroachdb/cockroach/pkg/upgrade/upgradebase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	jsonUtil "github.com/cockroachdb/cockroach/pkg/util/json"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -90,7 +98,7 @@ func TestSqlActivityUpdateJob(t *testing.T) {
 
 	execCfg := ts.ExecutorConfig().(ExecutorConfig)
 	st := cluster.MakeTestingClusterSettings()
-	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs)
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs, nil /* registry */, nil /* sink */)
 
 	require.NoError(t, updater.TransferStatsToActivity(ctx))
 
@@ -277,7 +285,28 @@ func TestSqlActivityUpdateTopLimitJob(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs)
+	// Use asymmetric limits for the transactions and the total execution time
+	// column. The statements fall back to sql.stats.activity.top.max.
+	const txnTopLimit = 2
+	const totalTimeTopLimit = 4
+	err = su.Set(ctx, "sql.stats.activity.top.transactions.max", settings.EncodedValue{
+		Value: settings.EncodeInt(int64(txnTopLimit)),
+		Type:  "i",
+	})
+	require.NoError(t, err)
+	err = su.Set(ctx, "sql.stats.activity.top.columns.max", settings.EncodedValue{
+		Value: settings.EncodeInt(int64(totalTimeTopLimit)),
+		Type:  "i",
+	})
+	require.NoError(t, err)
+
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs, nil /* registry */, nil /* sink */)
+	require.Equal(t, activityTopLimits{
+		stmt:           topLimit,
+		txn:            txnTopLimit,
+		totalTime:      totalTimeTopLimit,
+		rankingColumns: stmtActivityRankingColumns,
+	}, updater.topLimits)
 
 	db.Exec(t, "SET tracing = true;")
 
@@ -370,111 +399,2751 @@ func TestSqlActivityUpdateTopLimitJob(t *testing.T) {
 			}
 		}
 
-		// Update the transaction stats
-		db.Exec(t, `UPDATE system.public.transaction_statistics
-			SET statistics =  jsonb_set(jsonb_set(statistics, '{statistics, cnt}', to_jsonb($1::INT)),
-			    '{statistics, svcLat, mean}', to_jsonb($2::FLOAT))
-			    WHERE app_name = $3;`, 10000, 1, "topTransaction")
+		// Update the transaction stats
+		db.Exec(t, `UPDATE system.public.transaction_statistics
+			SET statistics =  jsonb_set(jsonb_set(statistics, '{statistics, cnt}', to_jsonb($1::INT)),
+			    '{statistics, svcLat, mean}', to_jsonb($2::FLOAT))
+			    WHERE app_name = $3;`, 10000, 1, "topTransaction")
+
+		// Help check for primary key conflicts.
+		duplicateRowHelper(t, db, getAppName(0))
+
+		// Run the updater to add rows to the activity tables.
+		// This will use the transfer all scenarios with there only
+		// being a few rows.
+		err = updater.TransferStatsToActivity(ctx)
+		require.NoError(t, err)
+
+		var httpStmtsResp serverpb.StatementsResponse
+
+		// Hit query endpoint.
+		urlPath := fmt.Sprintf("combinedstmts?start=%d", stubTime.Unix())
+		require.NoError(t, srvtestutils.GetStatusJSONProtoWithAdminOption(srv, urlPath, &httpStmtsResp, false))
+		require.Equal(t, "crdb_internal.statement_activity", httpStmtsResp.StmtsSourceTable)
+		require.Equal(t, "crdb_internal.transaction_activity", httpStmtsResp.TxnsSourceTable)
+
+		// Number of top columns to select from, with the total execution time
+		// column using its own limit.
+		maxStmtRows := topLimit*5 + totalTimeTopLimit
+		maxTxnRows := txnTopLimit*4 + totalTimeTopLimit
+		row := db.QueryRow(t,
+			`SELECT count_rows() FROM system.public.transaction_activity WHERE app_name LIKE 'TestSqlActivityUpdateTopLimitJob%'`)
+		var count int
+		row.Scan(&count)
+		require.LessOrEqual(t, count, maxTxnRows, "transaction_activity after transfer: actual:%d, max:%d", count, maxTxnRows)
+
+		row = db.QueryRow(t,
+			`SELECT count_rows() FROM system.public.statement_activity WHERE app_name LIKE 'TestSqlActivityUpdateTopLimitJob%'`)
+		row.Scan(&count)
+		require.LessOrEqual(t, count, maxStmtRows, "statement_activity after transfer: actual:%d, max:%d", count, maxStmtRows)
+
+		row = db.QueryRow(t, `SELECT count_rows() FROM system.public.transaction_activity`)
+		row.Scan(&count)
+		require.LessOrEqual(t, count, maxTxnRows, "transaction_activity after transfer: actual:%d, max:%d", count, maxTxnRows)
+
+		// Verify that if the transaction is in the transaction_activity table that
+		// all the stmts for that transaction are in the statement_activity table.
+		// This is necessary for the UI on the transaction details page to show
+		// the necessary information.
+		var stmtIDs [2]string
+		rows := db.Query(t, `SELECT json_array_elements_text(metadata->'stmtFingerprintIDs') FROM system.public.transaction_activity where app_name = 'topTransaction' AND json_array_length(metadata->'stmtFingerprintIDs') = 2`)
+		defer rows.Close()
+		stmtIdCnt := 0
+		for rows.Next() {
+			require.Less(t, stmtIdCnt, 2)
+			require.NoError(t, rows.Scan(&stmtIDs[stmtIdCnt]))
+			stmtIdCnt++
+		}
+
+		require.Equal(t, 2, stmtIdCnt, "transaction_activity should have 2 stmts ids: actual:%d", stmtIdCnt)
+		// Don't check if the statements are on statements_activity
+		// because we no longer force them to be there.
+
+		var txnTotalClusterExecutionSeconds float64
+		row = db.QueryRow(t, `SELECT sum(
+             (statistics -> 'statistics' -> 'svcLat' ->> 'mean')::FLOAT *
+             (statistics -> 'statistics' ->> 'cnt')::FLOAT
+          ) FROM system.public.transaction_statistics`)
+		row.Scan(&txnTotalClusterExecutionSeconds)
+		require.Greater(t, txnTotalClusterExecutionSeconds, float64(0), "transaction_statistics txnTotalClusterExecutionSeconds should be greater than 0: %d", txnTotalClusterExecutionSeconds)
+		require.Equal(t, httpStmtsResp.TxnsTotalRuntimeSecs, float32(txnTotalClusterExecutionSeconds))
+
+		var stmtTotalClusterExecutionSeconds float64
+		row = db.QueryRow(t, `SELECT sum(
+             (statistics -> 'statistics' -> 'svcLat' ->> 'mean')::FLOAT *
+             (statistics -> 'statistics' ->> 'cnt')::FLOAT
+          ) FROM system.public.statement_statistics`)
+		row.Scan(&stmtTotalClusterExecutionSeconds)
+		require.Greater(t, stmtTotalClusterExecutionSeconds, float64(0), "statement_statistics stmtTotalClusterExecutionSeconds should be greater than 0: %d", stmtTotalClusterExecutionSeconds)
+		require.Equal(t, httpStmtsResp.StmtsTotalRuntimeSecs, float32(stmtTotalClusterExecutionSeconds))
+
+		func() {
+			var txnTotalClusterExecutionSecondsActivityTbl float64
+			rows := db.Query(t, `SELECT distinct(execution_total_cluster_seconds) FROM system.public.transaction_activity`)
+			require.NoError(t, rows.Err())
+			defer rows.Close()
+			distinctCount := 0
+			for rows.Next() {
+				distinctCount++
+				require.NoError(t, rows.Scan(&txnTotalClusterExecutionSecondsActivityTbl))
+				require.Equal(t, txnTotalClusterExecutionSeconds, txnTotalClusterExecutionSecondsActivityTbl)
+			}
+			require.Equal(t, 1, distinctCount)
+		}()
+
+		func() {
+			var stmtTotalClusterExecutionSecondsActivityTbl float64
+			rows := db.Query(t, `SELECT distinct(execution_total_cluster_seconds) FROM system.public.statement_activity`)
+			require.NoError(t, rows.Err())
+			defer rows.Close()
+			distinctCount := 0
+			for rows.Next() {
+				distinctCount++
+				require.NoError(t, rows.Scan(&stmtTotalClusterExecutionSecondsActivityTbl))
+				require.Equal(t, stmtTotalClusterExecutionSeconds, stmtTotalClusterExecutionSecondsActivityTbl)
+			}
+
+			require.Equal(t, 1, distinctCount)
+		}()
+
+	}
+}
+
+// TestSqlActivityUpdateRankingColumns verifies that only the columns of
+// sql.stats.activity.top.ranking_columns are used to select the top
+// statistics.
+func TestSqlActivityUpdateRankingColumns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const topLimit = 3
+	const numApps = topLimit*6 + 10
+	appNamePrefix := "TestSqlActivityUpdateRankingColumns"
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s%d", appNamePrefix, i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.max", settings.EncodeInt(topLimit)))
+	require.Error(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.ranking_columns", "execution_count,bogus"))
+	require.Error(t, setActivitySetting(ctx, st, "sql.stats.activity.top.ranking_columns", ""))
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.ranking_columns", "service_latency, execution_count"))
+
+	updater := srv.newUpdater(st)
+	require.Equal(t, []string{"execution_count", "service_latency"}, updater.topLimits.rankingColumns)
+	maxRows := int64(topLimit * 2)
+	require.Equal(t, maxRows, updater.topLimits.maxStmtRows())
+	require.Equal(t, maxRows, updater.topLimits.maxTxnRows())
+
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	for _, table := range []string{"system.public.statement_activity", "system.public.transaction_activity"} {
+		var count int64
+		db.QueryRow(t, fmt.Sprintf("SELECT count_rows() FROM %s WHERE app_name LIKE $1", table),
+			appNamePrefix+"%").Scan(&count)
+		require.NotZero(t, count, table)
+		require.LessOrEqual(t, count, maxRows, table)
+	}
+}
+
+// TestSqlActivityUpdateRankingMetrics verifies that the transfer counts the
+// keys admitted by each ranking column and the distinct keys they admit.
+func TestSqlActivityUpdateRankingMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const topLimit = 3
+	const numApps = topLimit*6 + 10
+	appNamePrefix := "TestSqlActivityUpdateRankingMetrics"
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s%d", appNamePrefix, i))
+		for j := 0; j <= i%4; j++ {
+			db.Exec(t, "SELECT 1;")
+		}
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.max", settings.EncodeInt(topLimit)))
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+	require.False(t, updater.shouldTransferAll(updater.topLimits, numApps, numApps))
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	var sum int64
+	for column, counter := range updater.metrics.rankingColumnCounters() {
+		count := counter.Count()
+		require.LessOrEqual(t, count, int64(2*topLimit), column)
+		sum += count
+	}
+	require.NotZero(t, updater.metrics.NumAdmittedByExecutionCount.Count())
+	unique := updater.metrics.NumUniqueAdmittedRows.Value()
+	require.NotZero(t, unique)
+	// A key ranked in the top of several columns is counted by each of them.
+	require.GreaterOrEqual(t, sum, unique)
+	ratio := updater.metrics.AdmittedRowsOverlapRatio.Value()
+	require.Greater(t, ratio, 0.0)
+	require.LessOrEqual(t, ratio, 1.0)
+	require.InDelta(t, float64(unique)/float64(sum), ratio, 1e-9)
+
+	// Every admitted key was transferred.
+	var txnCount, stmtCount int64
+	db.QueryRow(t, "SELECT count(DISTINCT (fingerprint_id, app_name)) FROM system.public.transaction_activity").Scan(&txnCount)
+	db.QueryRow(t, "SELECT count(DISTINCT (fingerprint_id, app_name)) FROM system.public.statement_activity").Scan(&stmtCount)
+	require.Equal(t, txnCount+stmtCount, unique)
+}
+
+// TestActivityRankingAdmissionsOverlapRatio verifies that the overlap ratio
+// of the ranking columns is 1 when they admit disjoint keys, and decreases as
+// they admit the same keys.
+func TestActivityRankingAdmissionsOverlapRatio(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		name      string
+		admission activityRankingAdmissions
+		expected  float64
+	}{
+		{
+			name:      "none",
+			admission: activityRankingAdmissions{byColumn: map[string]int64{}},
+			expected:  1,
+		},
+		{
+			name: "disjoint",
+			admission: activityRankingAdmissions{
+				byColumn: map[string]int64{"execution_count": 2, "service_latency": 3},
+				unique:   5,
+			},
+			expected: 1,
+		},
+		{
+			name: "overlapping",
+			admission: activityRankingAdmissions{
+				byColumn: map[string]int64{"execution_count": 3, "service_latency": 3},
+				unique:   4,
+			},
+			expected: 4.0 / 6.0,
+		},
+		{
+			name: "identical",
+			admission: activityRankingAdmissions{
+				byColumn: map[string]int64{"execution_count": 3, "service_latency": 3},
+				unique:   3,
+			},
+			expected: 0.5,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ratio := tc.admission.overlapRatio()
+			require.InDelta(t, tc.expected, ratio, 1e-9)
+			require.Greater(t, ratio, 0.0)
+			require.LessOrEqual(t, ratio, 1.0)
+		})
+	}
+}
+
+// TestSqlActivityUpdateTopTieBreak verifies that the statistics which tie on
+// the ranking columns are selected deterministically, according to
+// sql.stats.activity.top.tie_break.
+func TestSqlActivityUpdateTopTieBreak(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateTopTieBreak"
+	srv.runApp(t, appName, "SELECT 1;")
+	srv.flush(ctx)
+
+	// Copy the statistics of the statement to fingerprints 1 to numTies of
+	// another app, like the fingerprints of ORM generated queries. The copies
+	// have the highest execution count, so they tie at the top of the ranking,
+	// and fingerprint g was last executed g seconds after the aggregated
+	// timestamp.
+	const numTies = 10
+	const tieAppName = appName + "Ties"
+	db.Exec(t, `
+INSERT INTO system.statement_statistics (aggregated_ts, fingerprint_id, transaction_fingerprint_id, app_name,
+                                         node_id, agg_interval, plan_hash, metadata, statistics)
+SELECT aggregated_ts, decode(lpad(to_hex(g), 16, '0'), 'hex'), transaction_fingerprint_id, $2,
+       node_id, agg_interval, plan_hash, metadata,
+       jsonb_set(jsonb_set(statistics, '{statistics,cnt}', '1000000'::JSONB),
+                 '{statistics,lastExecAt}', to_jsonb(aggregated_ts + g * INTERVAL '1 second'))
+FROM (SELECT * FROM system.statement_statistics
+      WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _' LIMIT 1),
+     generate_series(1, $3) AS g`, appName, tieAppName, numTies)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.max", settings.EncodeInt(3)))
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.ranking_columns", "execution_count"))
+
+	// selectedTies transfers the statistics and returns the fingerprints of the
+	// copies which were selected.
+	selectedTies := func() []string {
+		updater := srv.newUpdater(st)
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+		var selected []string
+		for _, row := range db.QueryStr(t, `
+SELECT encode(fingerprint_id, 'hex')
+FROM system.public.statement_activity
+WHERE app_name = $1
+ORDER BY fingerprint_id`, tieAppName) {
+			selected = append(selected, row[0])
+		}
+		require.NotEmpty(t, selected)
+		require.Less(t, len(selected), numTies)
+		return selected
+	}
+	ties := func(from, to int) []string {
+		var fingerprints []string
+		for g := from; g <= to; g++ {
+			fingerprints = append(fingerprints, fmt.Sprintf("%016x", g))
+		}
+		return fingerprints
+	}
+
+	// By default, the ties are broken by the lowest fingerprint ID, and
+	// repeated transfers select the same fingerprints.
+	selected := selectedTies()
+	require.Equal(t, ties(1, len(selected)), selected)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, selected, selectedTies())
+	}
+
+	// The most recently executed statements are preferred with last_executed.
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.tie_break", settings.EncodeInt(activityTieBreakLastExecuted)))
+	selected = selectedTies()
+	require.Equal(t, ties(numTies-len(selected)+1, numTies), selected)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, selected, selectedTies())
+	}
+}
+
+// TestSqlActivityUpdateBatchedTransfer verifies that transferring the stats in
+// batches produces the same activity tables as a single-shot transfer, for
+// both the transfer all and the transfer top scenarios.
+func TestSqlActivityUpdateBatchedTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	skip.UnderStressRace(t, "test is too slow to run under race")
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const topLimit = 3
+	const numApps = topLimit*6 + 10
+	appNamePrefix := "TestSqlActivityUpdateBatchedTransfer"
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s%d", appNamePrefix, i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	// Give every app distinct ranking values so the top selection has no ties
+	// and is deterministic across transfers.
+	for i := 0; i < numApps; i++ {
+		for _, table := range []string{"system.public.statement_statistics", "system.public.transaction_statistics"} {
+			db.Exec(t, fmt.Sprintf(`UPDATE %s
+			SET statistics =  jsonb_set(jsonb_set(statistics, '{statistics, cnt}', to_jsonb($1::INT)),
+			    '{statistics, svcLat, mean}', to_jsonb($2::FLOAT))
+			    WHERE app_name = $3;`, table), i+1, float64(i+1), fmt.Sprintf("%s%d", appNamePrefix, i))
+		}
+	}
+
+	activityContent := func() [][]string {
+		var content [][]string
+		content = append(content, db.QueryStr(t, `
+SELECT aggregated_ts, fingerprint_id, app_name, statistics, metadata, execution_total_cluster_seconds
+FROM system.public.transaction_activity
+ORDER BY aggregated_ts, fingerprint_id, app_name`)...)
+		content = append(content, db.QueryStr(t, `
+SELECT aggregated_ts, fingerprint_id, plan_hash, app_name, statistics, metadata, execution_total_cluster_seconds
+FROM system.public.statement_activity
+ORDER BY aggregated_ts, fingerprint_id, plan_hash, app_name`)...)
+		return content
+	}
+
+	for _, tc := range []struct {
+		name     string
+		topLimit int64
+		// selectsTop is whether the top keys are selected, in which case the
+		// rows of the keys which are not selected are deleted.
+		selectsTop bool
+	}{
+		{name: "transfer-all", topLimit: 500},
+		{name: "transfer-top", topLimit: topLimit, selectsTop: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := cluster.MakeTestingClusterSettings()
+			require.NoError(t, setActivitySetting(ctx, st,
+				"sql.stats.activity.top.max", settings.EncodeInt(tc.topLimit)))
+
+			db.Exec(t, "DELETE FROM system.public.transaction_activity")
+			db.Exec(t, "DELETE FROM system.public.statement_activity")
+			updater := srv.newUpdater(st)
+			require.Zero(t, updater.transferBatchSize)
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+			expected := activityContent()
+			require.NotEmpty(t, expected)
+
+			db.Exec(t, "DELETE FROM system.public.transaction_activity")
+			db.Exec(t, "DELETE FROM system.public.statement_activity")
+			require.NoError(t, setActivitySetting(ctx, st,
+				"sql.stats.activity.transfer.batch_size", settings.EncodeInt(2)))
+			updater = srv.newUpdater(st)
+			require.Equal(t, int64(2), updater.transferBatchSize)
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+			require.Equal(t, expected, activityContent())
+
+			// A batched transfer over the rows of a previous transfer never
+			// leaves the aggregated timestamp without rows, and deletes the rows
+			// of the keys which are not selected once the batches are written.
+			if tc.selectsTop {
+				db.Exec(t, `INSERT INTO system.public.statement_activity (`+stmtActivityColumns+`)
+SELECT `+strings.Replace(stmtActivityColumns, "app_name", "'stale'", 1)+`
+FROM system.public.statement_activity
+LIMIT 1`)
+			}
+			countRows := func(table string) (count int) {
+				db.QueryRow(t, "SELECT count(*) FROM "+table+" WHERE aggregated_ts = $1", srv.now()).Scan(&count)
+				return count
+			}
+			var batches int
+			updater.onProgress = func(context.Context, activityTransferProgress) error {
+				batches++
+				require.NotZero(t, countRows("system.public.transaction_activity"))
+				require.NotZero(t, countRows("system.public.statement_activity"))
+				return nil
+			}
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+			require.Greater(t, batches, 2)
+			require.Equal(t, expected, activityContent())
+		})
+	}
+}
+
+// TestSqlActivityUpdateProgress verifies that the progress of a batched
+// transfer advances monotonically to completion.
+func TestSqlActivityUpdateProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const numApps = 10
+	appNamePrefix := "TestSqlActivityUpdateProgress"
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s%d", appNamePrefix, i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.batch_size", settings.EncodeInt(2)))
+	updater := srv.newUpdater(st)
+	var reported []activityTransferProgress
+	updater.onProgress = func(_ context.Context, p activityTransferProgress) error {
+		reported = append(reported, p)
+		return nil
+	}
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	// Every batch is reported, and the fraction never decreases.
+	require.Greater(t, len(reported), numApps/2)
+	var fractions []float32
+	var phases []string
+	for i, p := range reported {
+		require.Equal(t, srv.now(), p.aggTs)
+		fractions = append(fractions, p.fraction())
+		if i > 0 {
+			require.GreaterOrEqual(t, p.fraction(), reported[i-1].fraction(), "fractions: %v", fractions)
+			require.GreaterOrEqual(t, p.rowsDone, reported[i-1].rowsDone)
+		}
+		if len(phases) == 0 || phases[len(phases)-1] != p.phase {
+			phases = append(phases, p.phase)
+		}
+	}
+	require.Equal(t, []string{
+		activityTransferPhasePrepare, activityTransferPhaseTxn, activityTransferPhaseStmt, "",
+	}, phases)
+
+	last := reported[len(reported)-1]
+	require.True(t, last.done)
+	require.Equal(t, float32(1), last.fraction())
+	require.Less(t, reported[len(reported)-2].fraction(), float32(1))
+	var stmtRows, txnRows int64
+	db.QueryRow(t, "SELECT count(*) FROM system.public.statement_activity").Scan(&stmtRows)
+	db.QueryRow(t, "SELECT count(*) FROM system.public.transaction_activity").Scan(&txnRows)
+	require.Equal(t, stmtRows+txnRows, last.rowsDone)
+	require.Contains(t, last.status(), fmt.Sprintf("transferred %d rows", last.rowsDone))
+}
+
+// TestSqlActivityUpdateBulkTransfer verifies that writing the top statistics
+// with multi-row statements produces the same activity rows as the default
+// transfer.
+func TestSqlActivityUpdateBulkTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	skip.UnderStressRace(t, "test is too slow to run under race")
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const topLimit = 50
+	const numApps = topLimit*6 + 10
+	appNamePrefix := "TestSqlActivityUpdateBulkTransfer"
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s%d", appNamePrefix, i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	// Give every app distinct ranking values so the top selection has no ties
+	// and is deterministic across transfers.
+	for _, table := range []string{"system.public.statement_statistics", "system.public.transaction_statistics"} {
+		db.Exec(t, fmt.Sprintf(`UPDATE %s
+		SET statistics = jsonb_set(jsonb_set(statistics, '{statistics, cnt}', to_jsonb(substr(app_name, $1)::INT + 1)),
+		    '{statistics, svcLat, mean}', to_jsonb(substr(app_name, $1)::FLOAT + 1))
+		    WHERE app_name LIKE $2`, table), len(appNamePrefix)+1, appNamePrefix+"%")
+	}
+
+	activityContent := func() [][]string {
+		var content [][]string
+		content = append(content, db.QueryStr(t, `
+SELECT aggregated_ts, fingerprint_id, app_name, agg_interval, metadata, statistics, query,
+       execution_count, execution_total_seconds, execution_total_cluster_seconds,
+       contention_time_avg_seconds, cpu_sql_avg_nanos, service_latency_avg_seconds,
+       service_latency_p99_seconds
+FROM system.public.transaction_activity
+ORDER BY aggregated_ts, fingerprint_id, app_name`)...)
+		content = append(content, db.QueryStr(t, `
+SELECT aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
+       agg_interval, metadata, statistics, plan, index_recommendations, execution_count,
+       execution_total_seconds, execution_total_cluster_seconds, contention_time_avg_seconds,
+       cpu_sql_avg_nanos, service_latency_avg_seconds, service_latency_p99_seconds
+FROM system.public.statement_activity
+ORDER BY aggregated_ts, fingerprint_id, plan_hash, app_name`)...)
+		return content
+	}
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.max", settings.EncodeInt(topLimit)))
+
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	expected := activityContent()
+	require.Greater(t, len(expected), topLimit)
+
+	for _, tc := range []struct {
+		name          string
+		bulkThreshold int64
+	}{
+		// All the top keys are written with multi-row statements.
+		{name: "bulk", bulkThreshold: 1},
+		// The number of top keys is below the threshold.
+		{name: "below-threshold", bulkThreshold: numApps * 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db.Exec(t, "DELETE FROM system.public.transaction_activity")
+			db.Exec(t, "DELETE FROM system.public.statement_activity")
+			require.NoError(t, setActivitySetting(ctx, st,
+				"sql.stats.activity.transfer.bulk_threshold", settings.EncodeInt(tc.bulkThreshold)))
+			updater := srv.newUpdater(st)
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+			require.Equal(t, expected, activityContent())
+		})
+	}
+}
+
+// TestSqlActivityUpdateUnlimitedTransfer verifies that all the statistics are
+// transferred when sql.stats.activity.transfer.unlimited is set, even
+// if there are more than the top limits.
+func TestSqlActivityUpdateUnlimitedTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const topLimit = 1
+	const numApps = topLimit*6 + 10
+	appNamePrefix := "TestSqlActivityUpdateUnlimitedTransfer"
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s%d", appNamePrefix, i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.max", settings.EncodeInt(topLimit)))
+
+	countApps := func() int {
+		var count int
+		db.QueryRow(t, "SELECT count(DISTINCT app_name) FROM system.public.statement_activity WHERE app_name LIKE $1",
+			appNamePrefix+"%").Scan(&count)
+		return count
+	}
+
+	// Only the top statistics are transferred by default.
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Less(t, countApps(), numApps)
+
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.unlimited", settings.EncodeBool(true)))
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, numApps, countApps())
+
+	plan, err := updater.DryRunTransferStatsToActivity(ctx)
+	require.NoError(t, err)
+	require.True(t, plan.TransferAll)
+}
+
+// TestSqlActivityUpdateTransferDisabled verifies that nothing is transferred
+// to the activity tables when sql.stats.activity.transfer.enabled is disabled,
+// while the statistics are still flushed to the statistics tables.
+func TestSqlActivityUpdateTransferDisabled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	srv.runApp(t, "TestSqlActivityUpdateTransferDisabled", "SELECT 1;")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.enabled", settings.EncodeBool(false)))
+
+	countRows := func(table string) int {
+		var count int
+		db.QueryRow(t, fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = 'TestSqlActivityUpdateTransferDisabled'",
+			table)).Scan(&count)
+		return count
+	}
+
+	// The job transfers through TransferStatsToActivityIncremental, which is
+	// paused like the full and window transfers.
+	updater := srv.newUpdater(st)
+	highWater, err := updater.TransferStatsToActivityIncremental(ctx, hlc.Timestamp{})
+	require.NoError(t, err)
+	require.True(t, highWater.IsEmpty())
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.NoError(t, updater.TransferStatsToActivityForWindow(ctx, srv.now(), srv.now().Add(time.Hour)))
+	require.NotZero(t, countRows("system.public.statement_statistics"))
+	require.NotZero(t, countRows("system.public.transaction_statistics"))
+	require.Zero(t, countRows("system.public.statement_activity"))
+	require.Zero(t, countRows("system.public.transaction_activity"))
+
+	// The transfer resumes once the setting is enabled again.
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.enabled", settings.EncodeBool(true)))
+	highWater, err = updater.TransferStatsToActivityIncremental(ctx, highWater)
+	require.NoError(t, err)
+	require.False(t, highWater.IsEmpty())
+	require.NotZero(t, countRows("system.public.statement_activity"))
+	require.NotZero(t, countRows("system.public.transaction_activity"))
+}
+
+// TestSqlActivityUpdateIgnoredAppNames verifies that the statistics of the app
+// names matching sql.stats.activity.transfer.ignored_app_names are not
+// transferred.
+func TestSqlActivityUpdateIgnoredAppNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const ignoredApp = "TestSqlActivityUpdateIgnoredAppNames-ignored"
+	const keptApp = "TestSqlActivityUpdateIgnoredAppNames-kept"
+	for _, appName := range []string{ignoredApp, keptApp} {
+		db.Exec(t, "SET SESSION application_name=$1", appName)
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.Error(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.ignored_app_names", "("))
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.ignored_app_names", `^\$ internal|-ignored$`))
+
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	for _, table := range []string{"system.public.statement_activity", "system.public.transaction_activity"} {
+		var ignoredCount, keptCount, internalCount int
+		db.QueryRow(t, fmt.Sprintf(`
+SELECT count(*) FILTER (WHERE app_name = $1),
+       count(*) FILTER (WHERE app_name = $2),
+       count(*) FILTER (WHERE app_name LIKE '$ internal%%')
+FROM %s`, table), ignoredApp, keptApp).Scan(&ignoredCount, &keptCount, &internalCount)
+		require.Zero(t, ignoredCount, table)
+		require.NotZero(t, keptCount, table)
+		require.Zero(t, internalCount, table)
+	}
+}
+
+// TestSqlActivityUpdateMaxAppNames verifies that the activity rows of the apps
+// beyond sql.stats.activity.transfer.max_app_names are rolled up into rows
+// with the app name (other), which sum their execution counts, while the apps
+// with the most executions keep their own rows.
+func TestSqlActivityUpdateMaxAppNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	// The top apps execute the most transactions, and the many small apps
+	// simulate an ORM generating an app name per connection.
+	const appPrefix = "TestSqlActivityUpdateMaxAppNames"
+	topApps := []string{appPrefix + "-top-0", appPrefix + "-top-1"}
+	for _, appName := range topApps {
+		db.Exec(t, "SET SESSION application_name=$1", appName)
+		for i := 0; i < 10; i++ {
+			db.Exec(t, "SELECT 1;")
+			db.Exec(t, "SELECT 1, 2;")
+		}
+	}
+	const smallApps = 20
+	for i := 0; i < smallApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("%s-small-%d", appPrefix, i))
+		db.Exec(t, "SELECT 1;")
+	}
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st, "sql.stats.activity.transfer.max_app_names", "2"))
+
+	updater := srv.newUpdater(st)
+	// The rollup is idempotent: transferring again rebuilds the same rows.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+	}
+
+	for _, tc := range []struct {
+		activityTable, statsTable string
+	}{
+		{"system.public.statement_activity", "system.public.statement_statistics"},
+		{"system.public.transaction_activity", "system.public.transaction_statistics"},
+	} {
+		t.Run(tc.activityTable, func(t *testing.T) {
+			// The top apps keep their own rows and execution counts.
+			for _, appName := range topApps {
+				var activityCnt, statsCnt int
+				db.QueryRow(t, fmt.Sprintf(`SELECT COALESCE(sum(execution_count), 0) FROM %s WHERE app_name = $1`,
+					tc.activityTable), appName).Scan(&activityCnt)
+				db.QueryRow(t, fmt.Sprintf(`SELECT COALESCE(sum((statistics->'statistics'->>'cnt')::INT), 0)
+FROM %s WHERE app_name = $1`, tc.statsTable), appName).Scan(&statsCnt)
+				require.NotZero(t, activityCnt, appName)
+				require.Equal(t, statsCnt, activityCnt, appName)
+			}
+
+			// The small apps are merged into the (other) rows, which have a
+			// single row per fingerprint and the summed execution counts.
+			var smallAppRows, otherRows, otherFingerprints, otherCnt int
+			db.QueryRow(t, fmt.Sprintf(`
+SELECT count(*) FILTER (WHERE app_name LIKE $1),
+       count(*) FILTER (WHERE app_name = '(other)'),
+       count(DISTINCT fingerprint_id) FILTER (WHERE app_name = '(other)'),
+       COALESCE(sum(execution_count) FILTER (WHERE app_name = '(other)'), 0)
+FROM %s`, tc.activityTable), appPrefix+"-small-%").Scan(&smallAppRows, &otherRows, &otherFingerprints, &otherCnt)
+			require.Zero(t, smallAppRows)
+			require.NotZero(t, otherRows)
+			if tc.activityTable == "system.public.transaction_activity" {
+				require.Equal(t, otherFingerprints, otherRows)
+			}
+
+			var totalActivityCnt, totalStatsCnt int
+			db.QueryRow(t, fmt.Sprintf(`SELECT sum(execution_count) FROM %s`,
+				tc.activityTable)).Scan(&totalActivityCnt)
+			db.QueryRow(t, fmt.Sprintf(`SELECT sum((statistics->'statistics'->>'cnt')::INT)
+FROM %s WHERE app_name NOT LIKE '$ internal%%'`, tc.statsTable)).Scan(&totalStatsCnt)
+			require.Equal(t, totalStatsCnt, totalActivityCnt)
+			require.GreaterOrEqual(t, otherCnt, smallApps)
+		})
+	}
+}
+
+// TestSqlActivityUpdateAggregateApps verifies that the statistics of a
+// fingerprint executed by several apps are merged into a single activity row
+// with the app name (all) when sql.stats.activity.transfer.aggregate_apps is
+// enabled.
+func TestSqlActivityUpdateAggregateApps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appPrefix = "TestSqlActivityUpdateAggregateApps"
+	execCounts := map[string]int{appPrefix + "-a": 3, appPrefix + "-b": 5}
+	for appName, n := range execCounts {
+		db.Exec(t, "SET SESSION application_name=$1", appName)
+		for i := 0; i < n; i++ {
+			db.Exec(t, "SELECT 'aggregate_apps', 1")
+		}
+	}
+	db.Exec(t, "RESET application_name")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	sqlStatsActivityTransferAggregateApps.Override(ctx, &st.SV, true)
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	// The fingerprint has a single row, with the counts of both apps summed.
+	const query = "SELECT _, _"
+	var fingerprintID []byte
+	db.QueryRow(t, `SELECT DISTINCT fingerprint_id FROM system.statement_statistics
+WHERE app_name LIKE $1 AND metadata ->> 'query' = $2`, appPrefix+"%", query).Scan(&fingerprintID)
+	require.Equal(t, [][]string{{"(all)", "8"}},
+		db.QueryStr(t, `SELECT app_name, execution_count::STRING FROM system.statement_activity
+WHERE fingerprint_id = $1`, fingerprintID))
+
+	// Every activity row is aggregated over the apps, and no count is lost.
+	for _, tc := range []struct {
+		activityTable, statsTable string
+	}{
+		{"system.public.statement_activity", "system.public.statement_statistics"},
+		{"system.public.transaction_activity", "system.public.transaction_statistics"},
+	} {
+		var appNames []string
+		for _, row := range db.QueryStr(t, fmt.Sprintf(`SELECT DISTINCT app_name FROM %s`, tc.activityTable)) {
+			appNames = append(appNames, row[0])
+		}
+		require.Equal(t, []string{"(all)"}, appNames, tc.activityTable)
+
+		var activityCnt, statsCnt int
+		db.QueryRow(t, fmt.Sprintf(`SELECT sum(execution_count) FROM %s`, tc.activityTable)).Scan(&activityCnt)
+		db.QueryRow(t, fmt.Sprintf(`SELECT sum((statistics->'statistics'->>'cnt')::INT)
+FROM %s WHERE app_name NOT LIKE '$ internal%%'`, tc.statsTable)).Scan(&statsCnt)
+		require.Equal(t, statsCnt, activityCnt, tc.activityTable)
+	}
+}
+
+// TestSqlActivityUpdateMinExecCount verifies that the fingerprints executed
+// fewer times than sql.stats.activity.transfer.min_exec_count are not
+// transferred, by both the single pass and the batched transfers.
+func TestSqlActivityUpdateMinExecCount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	// Every statement of the low count app is executed fewer times than the
+	// minimum execution count, and the SELECT of the high count app more.
+	const minExecCount = 5
+	const lowApp = "TestSqlActivityUpdateMinExecCount-low"
+	const highApp = "TestSqlActivityUpdateMinExecCount-high"
+	db.Exec(t, "SET SESSION application_name=$1", lowApp)
+	for i := 0; i < minExecCount-1; i++ {
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", highApp)
+	for i := 0; i < 2*minExecCount; i++ {
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.min_exec_count", settings.EncodeInt(minExecCount)))
+
+	for _, batchSize := range []int64{0, 2} {
+		t.Run(fmt.Sprintf("batch_size=%d", batchSize), func(t *testing.T) {
+			require.NoError(t, setActivitySetting(ctx, st,
+				"sql.stats.activity.transfer.batch_size", settings.EncodeInt(batchSize)))
+			// The top transfers replace the rows of the aggregated timestamp.
+			updater := srv.newUpdater(st)
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+			for _, table := range []string{"system.public.statement_activity", "system.public.transaction_activity"} {
+				var lowCount, highCount int
+				db.QueryRow(t, fmt.Sprintf(`
+SELECT count(*) FILTER (WHERE app_name = $1),
+       count(*) FILTER (WHERE app_name = $2 AND execution_count >= $3)
+FROM %s`, table), lowApp, highApp, minExecCount).Scan(&lowCount, &highCount)
+				require.Zero(t, lowCount, table)
+				require.NotZero(t, highCount, table)
+			}
+
+			// Every transferred fingerprint was executed at least the minimum
+			// number of times.
+			var belowMin int
+			db.QueryRow(t, `
+SELECT count(*)
+FROM (SELECT fingerprint_id, app_name
+      FROM system.public.statement_activity
+      GROUP BY fingerprint_id, app_name
+      HAVING sum(execution_count) < $1)`, minExecCount).Scan(&belowMin)
+			require.Zero(t, belowMin)
+		})
+	}
+}
+
+// TestSqlActivityUpdateAlternateTables verifies that the statistics are
+// transferred to the activity tables configured by
+// sql.stats.activity.transaction_activity_table and
+// sql.stats.activity.statement_activity_table, and that a configured table
+// without the columns of the activity tables fails the transfer.
+func TestSqlActivityUpdateAlternateTables(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	db.Exec(t, "CREATE DATABASE observability")
+	db.Exec(t, "CREATE TABLE observability.public.txn_activity (LIKE system.public.transaction_activity INCLUDING ALL)")
+	db.Exec(t, "CREATE TABLE observability.public.stmt_activity (LIKE system.public.statement_activity INCLUDING ALL)")
+	db.Exec(t, "CREATE TABLE observability.public.bad_activity (aggregated_ts TIMESTAMPTZ PRIMARY KEY)")
+
+	const appName = "TestSqlActivityUpdateAlternateTables"
+	srv.runApp(t, appName, "SELECT 1;")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	setTable := func(name, table string) error {
+		return setActivitySetting(ctx, st, name, table)
+	}
+	require.Error(t, setTable("sql.stats.activity.transaction_activity_table", "txn_activity"))
+	require.NoError(t, setTable("sql.stats.activity.transaction_activity_table", "observability.public.txn_activity"))
+	require.NoError(t, setTable("sql.stats.activity.statement_activity_table", "observability.public.stmt_activity"))
+
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	countRows := func(table string) (count int) {
+		db.QueryRow(t, fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName).Scan(&count)
+		return count
+	}
+	require.NotZero(t, countRows("observability.public.txn_activity"))
+	require.NotZero(t, countRows("observability.public.stmt_activity"))
+	require.Zero(t, countRows("system.public.transaction_activity"))
+	require.Zero(t, countRows("system.public.statement_activity"))
+
+	// A table without the columns of the activity tables is rejected before
+	// any statistics are written.
+	db.Exec(t, "DELETE FROM observability.public.txn_activity WHERE true")
+	require.NoError(t, setTable("sql.stats.activity.statement_activity_table", "observability.public.bad_activity"))
+	updater = srv.newUpdater(st)
+	err := updater.TransferStatsToActivity(ctx)
+	require.ErrorContains(t, err, "does not have the expected columns")
+	require.Zero(t, countRows("observability.public.txn_activity"))
+}
+
+// TestSqlActivityUpdateTablesNotReady verifies that the transfer is skipped,
+// rather than failing, while the database of the configured activity tables
+// does not exist yet, and that it proceeds once the tables are created.
+func TestSqlActivityUpdateTablesNotReady(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateTablesNotReady"
+	srv.runApp(t, appName, "SELECT 1;")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	for name, table := range map[string]string{
+		"sql.stats.activity.transaction_activity_table": "observability.public.txn_activity",
+		"sql.stats.activity.statement_activity_table":   "observability.public.stmt_activity",
+	} {
+		require.NoError(t, setActivitySetting(ctx, st, name, table))
+	}
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+
+	// The observability database does not exist yet, so the transfers are
+	// logged no-ops.
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	highWater := hlc.Timestamp{WallTime: 1}
+	newHighWater, err := updater.TransferStatsToActivityIncremental(ctx, highWater)
+	require.NoError(t, err)
+	require.Equal(t, highWater, newHighWater)
+	require.Equal(t, int64(2), updater.metrics.NumSkippedNotReady.Count())
+	require.Zero(t, updater.metrics.NumFailedWindows.Count())
+
+	db.Exec(t, "CREATE DATABASE observability")
+	db.Exec(t, "CREATE TABLE observability.public.txn_activity (LIKE system.public.transaction_activity INCLUDING ALL)")
+	db.Exec(t, "CREATE TABLE observability.public.stmt_activity (LIKE system.public.statement_activity INCLUDING ALL)")
+
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, int64(2), updater.metrics.NumSkippedNotReady.Count())
+	for _, table := range []string{"observability.public.txn_activity", "observability.public.stmt_activity"} {
+		var count int
+		db.QueryRow(t, fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName).Scan(&count)
+		require.NotZero(t, count, table)
+	}
+}
+
+// TestSqlActivityUpdateIndexRecommendations verifies that the index
+// recommendations of the statements are transferred to the activity tables, by
+// both the top and the unlimited transfers.
+func TestSqlActivityUpdateIndexRecommendations(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateIndexRecommendations"
+	db.Exec(t, "CREATE DATABASE idxrectest")
+	db.Exec(t, "USE idxrectest")
+	db.Exec(t, "CREATE TABLE t (k INT PRIMARY KEY, v INT)")
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	// Recommendations are only generated for statements which were executed
+	// at least 5 times.
+	for i := 0; i < 7; i++ {
+		db.Exec(t, "SELECT * FROM t WHERE v > 123")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	const expectedRecs = "{\"creation : CREATE INDEX ON idxrectest.public.t (v);\"}"
+	var statsRecs string
+	db.QueryRow(t, `SELECT index_recommendations FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT * FROM t WHERE v > _'`,
+		appName).Scan(&statsRecs)
+	require.Equal(t, expectedRecs, statsRecs)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+
+	for _, unlimited := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unlimited=%t", unlimited), func(t *testing.T) {
+			require.NoError(t, setActivitySetting(ctx, st,
+				"sql.stats.activity.transfer.unlimited", settings.EncodeBool(unlimited)))
+			db.Exec(t, "DELETE FROM system.public.statement_activity")
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+			var activityRecs string
+			db.QueryRow(t, `SELECT index_recommendations FROM system.public.statement_activity
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT * FROM t WHERE v > _'`,
+				appName).Scan(&activityRecs)
+			require.Equal(t, expectedRecs, activityRecs)
+		})
+	}
+}
+
+// TestSqlActivityUpdateLatencyPercentiles verifies that the service latency
+// percentiles of the statements are transferred to the metadata of
+// statement_activity.
+func TestSqlActivityUpdateLatencyPercentiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateLatencyPercentiles"
+	srv.runApp(t, appName, "SELECT 1;")
+	srv.flush(ctx)
+
+	// Use known percentiles, which are not above the max latency.
+	db.Exec(t, `UPDATE system.public.statement_statistics
+SET statistics = jsonb_set(statistics, '{statistics, latencyInfo}',
+    '{"min": 0.5, "max": 4, "p50": 1, "p90": 2, "p99": 3}'::JSONB)
+WHERE app_name = $1`, appName)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+
+	for _, unlimited := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unlimited=%t", unlimited), func(t *testing.T) {
+			require.NoError(t, setActivitySetting(ctx, st,
+				"sql.stats.activity.transfer.unlimited", settings.EncodeBool(unlimited)))
+			db.Exec(t, "DELETE FROM system.public.statement_activity")
+			require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+			var p50, p90, p99, p99Column float64
+			db.QueryRow(t, `
+SELECT (metadata -> 'latencyPercentiles' ->> 'p50')::FLOAT,
+       (metadata -> 'latencyPercentiles' ->> 'p90')::FLOAT,
+       (metadata -> 'latencyPercentiles' ->> 'p99')::FLOAT,
+       service_latency_p99_seconds
+FROM system.public.statement_activity
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appName).Scan(&p50, &p90, &p99, &p99Column)
+			require.Equal(t, []float64{1, 2, 3, 3}, []float64{p50, p90, p99, p99Column})
+		})
+	}
+}
+
+// TestTriggerSQLActivityTransfer verifies that TriggerSQLActivityTransfer
+// flushes the in-memory stats and transfers them to the activity tables.
+func TestTriggerSQLActivityTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	// Start the cluster.
+	// Disable the job so the activity tables are only written by the trigger.
+	ctx := context.Background()
+	srv, sqlDB, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Insecure: true,
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: sqlstats.CreateTestingKnobs(),
+			UpgradeManager: &upgradebase.TestingKnobs{
+				DontUseJobs:                       true,
+				SkipUpdateSQLActivityJobBootstrap: true,
+			}}})
+	defer srv.Stopper().Stop(context.Background())
+	defer sqlDB.Close()
+	ts := srv.ApplicationLayer()
+
+	db := sqlutils.MakeSQLRunner(sqlDB)
+	const appName = "TestTriggerSQLActivityTransfer"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 1;")
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+
+	countActivity := func(table string) int {
+		var count int
+		db.QueryRow(t, fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName).Scan(&count)
+		return count
+	}
+	require.Zero(t, countActivity("system.public.statement_activity"))
+	require.Zero(t, countActivity("system.public.transaction_activity"))
+
+	require.NoError(t, ts.SQLServer().(*Server).TriggerSQLActivityTransfer(ctx))
+	require.NotZero(t, countActivity("system.public.statement_activity"))
+	require.NotZero(t, countActivity("system.public.transaction_activity"))
+}
+
+// TestSqlActivityUpdateFlushBarrier verifies that a transfer with a flush
+// barrier transfers the statements which completed before it started, even if
+// they were not flushed yet and a regular flush would be skipped.
+func TestSqlActivityUpdateFlushBarrier(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	provider := srv.sqlStats()
+
+	// The time is stubbed, so every flush after the first is too soon.
+	persistedsqlstats.MinimumInterval.Override(ctx, &srv.ClusterSettings().SV, time.Hour)
+	provider.Flush(ctx)
+
+	const appName = "TestSqlActivityUpdateFlushBarrier"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 'flush_barrier'")
+	db.Exec(t, "RESET application_name")
+
+	st := cluster.MakeTestingClusterSettings()
+	countActivity := func() int {
+		var count int
+		db.QueryRow(t, `SELECT count(*) FROM system.statement_activity
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appName).Scan(&count)
+		return count
+	}
+
+	// Without the barrier, the statement is not flushed yet.
+	provider.Flush(ctx)
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Zero(t, countActivity())
+
+	updater.flushBarrier = provider.ForceFlush
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, 1, countActivity())
+}
+
+// TestSqlActivityUpdateSkipUnchanged verifies that a transfer whose statistics
+// did not change since the previous transfer does not write to the activity
+// tables, and that it writes again once new statistics are flushed.
+func TestSqlActivityUpdateSkipUnchanged(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	provider := srv.sqlStats()
+
+	const appName = "TestSqlActivityUpdateSkipUnchanged"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 'skip_unchanged'")
+	db.Exec(t, "RESET application_name")
+	provider.ForceFlush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	sqlStatsActivityTransferSkipUnchanged.Override(ctx, &st.SV, true)
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+
+	// lastWrite returns the MVCC timestamps of the last writes to the activity
+	// tables.
+	lastWrite := func() [][]string {
+		return db.QueryStr(t, `
+SELECT (SELECT max(crdb_internal_mvcc_timestamp) FROM system.public.statement_activity),
+       (SELECT max(crdb_internal_mvcc_timestamp) FROM system.public.transaction_activity)`)
+	}
+	countActivity := func(query string) int {
+		var count int
+		db.QueryRow(t, `SELECT count(*) FROM system.statement_activity
+WHERE app_name = $1 AND metadata ->> 'query' = $2`, appName, query).Scan(&count)
+		return count
+	}
+
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, 1, countActivity("SELECT _"))
+	require.Zero(t, updater.metrics.NumSkippedUnchanged.Count())
+	written := lastWrite()
+	stmtRows := updater.metrics.NumStmtRowsTransferred.Count()
+	txnRows := updater.metrics.NumTxnRowsTransferred.Count()
+
+	// No statistics were flushed, so the second transfer writes nothing.
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, int64(1), updater.metrics.NumSkippedUnchanged.Count())
+	require.Equal(t, stmtRows, updater.metrics.NumStmtRowsTransferred.Count())
+	require.Equal(t, txnRows, updater.metrics.NumTxnRowsTransferred.Count())
+	require.Equal(t, written, lastWrite())
+
+	// Once new statistics are flushed, the transfer writes them.
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 'skip_unchanged', 1")
+	db.Exec(t, "RESET application_name")
+	provider.ForceFlush(ctx)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, int64(1), updater.metrics.NumSkippedUnchanged.Count())
+	require.Equal(t, 1, countActivity("SELECT _, _"))
+	require.NotEqual(t, written, lastWrite())
+
+	// The incremental transfers of the job skip the unchanged statistics too,
+	// even when they changed since the high water they are passed.
+	written = lastWrite()
+	staleHighWater := hlc.Timestamp{WallTime: 1}
+	_, err := updater.TransferStatsToActivityIncremental(ctx, staleHighWater)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), updater.metrics.NumSkippedUnchanged.Count())
+	require.Equal(t, written, lastWrite())
+
+	// The incremental transfer of new statistics records their hash, so the
+	// next one is skipped.
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 'skip_unchanged', 1, 2")
+	db.Exec(t, "RESET application_name")
+	provider.ForceFlush(ctx)
+	_, err = updater.TransferStatsToActivityIncremental(ctx, staleHighWater)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), updater.metrics.NumSkippedUnchanged.Count())
+	require.Equal(t, 1, countActivity("SELECT _, _, _"))
+	written = lastWrite()
+	_, err = updater.TransferStatsToActivityIncremental(ctx, staleHighWater)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), updater.metrics.NumSkippedUnchanged.Count())
+	require.Equal(t, written, lastWrite())
+
+	// A change of any activity setting, even one which does not affect the
+	// fields of the updater, makes the next transfer write the statistics.
+	sqlStatsActivityTransferDedup.Override(ctx, &st.SV, activityDedupRemove)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, int64(3), updater.metrics.NumSkippedUnchanged.Count())
+	require.NotEqual(t, written, lastWrite())
+	written = lastWrite()
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, int64(4), updater.metrics.NumSkippedUnchanged.Count())
+	require.Equal(t, written, lastWrite())
+}
+
+// TestSqlActivityUpdateCombined verifies that the combined transfer writes both
+// activity tables, and that the statements of every transferred transaction
+// are transferred for the same window.
+func TestSqlActivityUpdateCombined(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateCombined"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 1")
+	for i := 0; i < 3; i++ {
+		tx := db.Begin(t)
+		_, err := tx.Exec("SELECT 'combined'")
+		require.NoError(t, err)
+		_, err = tx.Exec("SELECT 'combined', 1")
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+	}
+	db.Exec(t, "RESET application_name")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	sqlStatsActivityTransferCombined.Override(ctx, &st.SV, true)
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.NotZero(t, updater.metrics.NumStmtRowsTransferred.Count())
+	require.NotZero(t, updater.metrics.NumTxnRowsTransferred.Count())
+
+	var stmtCount, txnCount int
+	db.QueryRow(t, "SELECT count(*) FROM system.statement_activity WHERE app_name = $1", appName).Scan(&stmtCount)
+	db.QueryRow(t, "SELECT count(*) FROM system.transaction_activity WHERE app_name = $1", appName).Scan(&txnCount)
+	require.NotZero(t, stmtCount)
+	require.NotZero(t, txnCount)
+
+	// Every statement of the transferred transactions has a statement activity
+	// row for the same aggregated timestamp.
+	db.CheckQueryResults(t, `
+SELECT count(*) FROM (
+  SELECT ta.aggregated_ts, ta.app_name, json_array_elements_text(ta.metadata->'stmtFingerprintIDs') AS stmt_id
+  FROM system.transaction_activity ta
+) txn_stmts
+WHERE NOT EXISTS (
+  SELECT 1 FROM system.statement_activity sa
+  WHERE sa.aggregated_ts = txn_stmts.aggregated_ts
+    AND sa.app_name = txn_stmts.app_name
+    AND encode(sa.fingerprint_id, 'hex') = txn_stmts.stmt_id
+)`, [][]string{{"0"}})
+	db.CheckQueryResults(t, `
+SELECT count(*) FROM system.transaction_activity
+WHERE app_name = 'TestSqlActivityUpdateCombined' AND json_array_length(metadata->'stmtFingerprintIDs') = 2`,
+		[][]string{{"1"}})
+}
+
+// TestSqlActivityUpdateVerifyAcrossNodes verifies that the execution counts of
+// the activity tables match the statistics flushed by every node of a
+// multi-node cluster, and that the verification detects mismatches.
+func TestSqlActivityUpdateVerifyAcrossNodes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	skip.UnderStressRace(t, "test is too slow to run under race")
+
+	stubTime := timeutil.Now().Truncate(time.Hour)
+	sqlStatsKnobs := sqlstats.CreateTestingKnobs()
+	sqlStatsKnobs.StubTimeNow = func() time.Time { return stubTime }
+
+	// Disable the job since it is called manually from a new instance to avoid
+	// any race conditions.
+	ctx := context.Background()
+	const numNodes = 3
+	tc := testcluster.StartTestCluster(t, numNodes, base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{
+			Insecure: true,
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: sqlStatsKnobs,
+				UpgradeManager: &upgradebase.TestingKnobs{
+					DontUseJobs:                       true,
+					SkipUpdateSQLActivityJobBootstrap: true,
+				}}},
+	})
+	defer tc.Stopper().Stop(ctx)
+
+	const appName = "TestSqlActivityUpdateVerifyAcrossNodes"
+	const execsPerNode = 5
+	for i := 0; i < numNodes; i++ {
+		db := sqlutils.MakeSQLRunner(tc.ServerConn(i))
+		db.Exec(t, "SET SESSION application_name=$1", appName)
+		for j := 0; j < execsPerNode; j++ {
+			db.Exec(t, "SELECT 1;")
+		}
+		db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	}
+	for i := 0; i < numNodes; i++ {
+		tc.ApplicationLayer(i).SQLServer().(*Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	}
+
+	db := sqlutils.MakeSQLRunner(tc.ServerConn(0))
+	execCfg := tc.ApplicationLayer(0).ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.verify.enabled", settings.EncodeBool(true)))
+	registry := metric.NewRegistry()
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs, registry, nil /* sink */)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Zero(t, updater.metrics.NumVerifyMismatches.Count())
+
+	// The statement was executed on every node, and its activity row sums the
+	// statistics of all of them.
+	var statsNodes, activityCount int
+	db.QueryRow(t, `
+SELECT count(DISTINCT node_id)
+FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appName).Scan(&statsNodes)
+	require.Equal(t, numNodes, statsNodes)
+	db.QueryRow(t, `
+SELECT sum(execution_count)::INT8
+FROM system.public.statement_activity
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appName).Scan(&activityCount)
+	require.Equal(t, numNodes*execsPerNode, activityCount)
+
+	// Double counting an activity row is reported as a mismatch.
+	db.Exec(t, `
+UPDATE system.public.statement_activity
+SET execution_count = execution_count * 2
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appName)
+	mismatches, err := updater.verifyActivityCounts(ctx, stubTime)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), mismatches)
+}
+
+// fakeActivitySink is an ActivitySink recording the rows it is passed.
+type fakeActivitySink struct {
+	aggTs      []time.Time
+	stmtRows   []string
+	txnRows    []string
+	writeCalls int
+}
+
+var _ ActivitySink = &fakeActivitySink{}
+
+func (s *fakeActivitySink) WriteStatements(
+	_ context.Context, aggTs time.Time, rows []jsonUtil.JSON,
+) error {
+	s.aggTs = append(s.aggTs, aggTs)
+	s.writeCalls++
+	for _, row := range rows {
+		s.stmtRows = append(s.stmtRows, row.String())
+	}
+	return nil
+}
+
+func (s *fakeActivitySink) WriteTransactions(
+	_ context.Context, aggTs time.Time, rows []jsonUtil.JSON,
+) error {
+	s.aggTs = append(s.aggTs, aggTs)
+	s.writeCalls++
+	for _, row := range rows {
+		s.txnRows = append(s.txnRows, row.String())
+	}
+	return nil
+}
+
+// TestSqlActivityUpdateSink verifies that the ActivitySink of the updater
+// receives the rows written to the activity tables.
+func TestSqlActivityUpdateSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	srv.runApp(t, "TestSqlActivityUpdateSink", "SELECT 1;", "SELECT 1, 2;")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	sink := &fakeActivitySink{}
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, nil /* registry */, sink)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	activityRows := func(query string) []string {
+		var rows []string
+		for _, row := range db.QueryStr(t, query, srv.now()) {
+			rows = append(rows, row[0])
+		}
+		return rows
+	}
+	require.Equal(t, 2, sink.writeCalls)
+	require.Equal(t, []time.Time{srv.now(), srv.now()}, sink.aggTs)
+	require.NotEmpty(t, sink.stmtRows)
+	require.NotEmpty(t, sink.txnRows)
+	require.Equal(t, activityRows(`
+SELECT to_jsonb(a)::STRING
+FROM system.public.statement_activity AS a
+WHERE aggregated_ts = $1
+ORDER BY fingerprint_id, transaction_fingerprint_id, plan_hash, app_name`), sink.stmtRows)
+	require.Equal(t, activityRows(`
+SELECT to_jsonb(a)::STRING
+FROM system.public.transaction_activity AS a
+WHERE aggregated_ts = $1
+ORDER BY fingerprint_id, app_name`), sink.txnRows)
+}
+
+// TestSqlActivityUpdateAnonymizeQueryText verifies that the query text is
+// blanked out in the statement_activity rows when
+// sql.stats.activity.anonymize_query_text is enabled, and that the rows can
+// still be found by fingerprint.
+func TestSqlActivityUpdateAnonymizeQueryText(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateAnonymizeQueryText"
+	db.Exec(t, "CREATE TABLE anonymized_accounts (id INT PRIMARY KEY, owner STRING)")
+	srv.runApp(t, appName,
+		"INSERT INTO anonymized_accounts VALUES (4242, 'secret-owner-name')",
+		"SELECT * FROM anonymized_accounts WHERE owner = 'secret-owner-name' AND id = 4242")
+	srv.flush(ctx)
+
+	var fingerprintID []byte
+	db.QueryRow(t, `
+SELECT fingerprint_id FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' LIKE 'SELECT%anonymized_accounts%'`,
+		appName).Scan(&fingerprintID)
+
+	transfer := func(anonymize bool) {
+		st := cluster.MakeTestingClusterSettings()
+		require.NoError(t, setActivitySetting(ctx, st,
+			"sql.stats.activity.anonymize_query_text", settings.EncodeBool(anonymize)))
+		updater := srv.newUpdater(st)
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+	}
+	queryText := func() string {
+		var query string
+		db.QueryRow(t, `
+SELECT metadata ->> 'query' FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+			srv.now(), fingerprintID, appName).Scan(&query)
+		return query
+	}
+
+	// Without anonymization the query text is copied to the activity table.
+	transfer(false /* anonymize */)
+	require.Contains(t, queryText(), "anonymized_accounts")
+
+	transfer(true /* anonymize */)
+	require.Empty(t, queryText())
+
+	// No query text nor literal values remain in the rows of the app, which
+	// keep the fingerprint ID.
+	rows := db.QueryStr(t, `
+SELECT to_jsonb(a)::STRING,
+       metadata ->> 'fingerprintID',
+       encode(fingerprint_id, 'hex'),
+       metadata ->> 'query',
+       metadata ->> 'formattedQuery',
+       metadata ->> 'querySummary'
+FROM system.public.statement_activity AS a
+WHERE aggregated_ts = $1 AND app_name = $2`, srv.now(), appName)
+	require.NotEmpty(t, rows)
+	for _, row := range rows {
+		for _, text := range []string{"anonymized_accounts", "secret-owner-name"} {
+			require.NotContains(t, row[0], text)
+		}
+		require.Equal(t, row[2], row[1])
+		require.Equal(t, []string{"", "", ""}, row[3:])
+	}
+}
+
+// TestSqlActivityUpdateIncludeHistograms verifies that the serialized latency
+// distributions of the statement statistics are copied as is into the metadata
+// of the statement_activity rows when
+// sql.stats.activity.transfer.include_histograms is enabled.
+func TestSqlActivityUpdateIncludeHistograms(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateIncludeHistograms"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	for i := 0; i < 10; i++ {
+		db.Exec(t, "SELECT pg_sleep($1::FLOAT / 1000)", i)
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	var fingerprintID []byte
+	db.QueryRow(t, `
+SELECT DISTINCT fingerprint_id FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' LIKE 'SELECT pg_sleep%'`,
+		appName).Scan(&fingerprintID)
+
+	transfer := func(include bool) {
+		st := cluster.MakeTestingClusterSettings()
+		require.NoError(t, setActivitySetting(ctx, st,
+			"sql.stats.activity.transfer.include_histograms", settings.EncodeBool(include)))
+		updater := srv.newUpdater(st)
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+	}
+
+	// The histograms are not copied by default.
+	transfer(false /* include */)
+	require.Equal(t, [][]string{{"false"}}, db.QueryStr(t, `
+SELECT bool_or(metadata ? 'latencyHistograms') FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+		srv.now(), fingerprintID, appName))
+
+	transfer(true /* include */)
+	source := db.QueryStr(t, `
+SELECT (statistics -> 'statistics' -> 'latencyInfo')::STRING
+FROM system.public.statement_statistics
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+		srv.now(), fingerprintID, appName)
+	copied := db.QueryStr(t, `
+SELECT h::STRING
+FROM system.public.statement_activity AS a,
+     jsonb_array_elements(a.metadata -> 'latencyHistograms') AS h
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+		srv.now(), fingerprintID, appName)
+	require.NotEmpty(t, source)
+	require.ElementsMatch(t, source, copied)
+	for _, row := range copied {
+		require.Contains(t, row[0], `"p99"`)
+	}
+}
+
+// TestSqlActivityUpdatePlanGist verifies that the plan gists and the sampled
+// plan of the statement statistics are carried to the statement activity, so
+// that the statements of the activity tables link to their plans.
+func TestSqlActivityUpdatePlanGist(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdatePlanGist"
+	db.Exec(t, "CREATE TABLE t (k INT PRIMARY KEY, v INT, INDEX (v))")
+	srv.runApp(t, appName, "SELECT k FROM t WHERE v = 1")
+	srv.flush(ctx)
+
+	var fingerprintID []byte
+	var gist, plan string
+	db.QueryRow(t, `
+SELECT fingerprint_id, statistics -> 'statistics' -> 'planGists' ->> 0, plan::STRING
+FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT k FROM t WHERE v = _'`,
+		appName).Scan(&fingerprintID, &gist, &plan)
+	require.NotEmpty(t, gist)
+	// The gist decodes to the plan of the statement.
+	var decoded []string
+	for _, row := range db.QueryStr(t, `SELECT crdb_internal.decode_plan_gist($1)`, gist) {
+		decoded = append(decoded, row[0])
+	}
+	require.Contains(t, strings.Join(decoded, "\n"), "t@t_v_idx")
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	require.Equal(t, [][]string{{gist, plan}}, db.QueryStr(t, `
+SELECT statistics -> 'statistics' -> 'planGists' ->> 0, plan::STRING
+FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+		srv.now(), fingerprintID, appName))
+}
+
+// TestSqlActivityUpdateMaxRowBytes verifies that the statement activity rows
+// larger than sql.stats.activity.transfer.max_row_bytes are truncated or
+// skipped according to sql.stats.activity.transfer.oversized_rows, and that
+// the transfer completes either way.
+func TestSqlActivityUpdateMaxRowBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	// The alias makes the query text of the fingerprint much larger than the
+	// limit, while the other statements of the app fit in it.
+	const maxRowBytes = 16 << 10
+	alias := strings.Repeat("x", 2*maxRowBytes)
+	const appName = "TestSqlActivityUpdateMaxRowBytes"
+	srv.runApp(t, appName, fmt.Sprintf("SELECT 1 AS %s", alias), "SELECT 1")
+	srv.flush(ctx)
+
+	fingerprintID := func(queryPattern string) (id []byte) {
+		db.QueryRow(t, `
+SELECT DISTINCT fingerprint_id FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' LIKE $2`,
+			appName, queryPattern).Scan(&id)
+		return id
+	}
+	oversizedID := fingerprintID("SELECT _ AS xxx%")
+	smallID := fingerprintID("SELECT _")
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	transfer := func(mode string) *sqlActivityUpdater {
+		st := cluster.MakeTestingClusterSettings()
+		require.NoError(t, setActivitySetting(ctx, st,
+			"sql.stats.activity.transfer.max_row_bytes", fmt.Sprint(maxRowBytes)))
+		require.NoError(t, setActivitySetting(ctx, st,
+			"sql.stats.activity.transfer.oversized_rows", mode))
+		updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+		return updater
+	}
+	activityQuery := func(id []byte) []string {
+		var query []string
+		for _, row := range db.QueryStr(t, `
+SELECT metadata ->> 'query' FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+			srv.now(), id, appName) {
+			query = append(query, row[0])
+		}
+		return query
+	}
+
+	updater := transfer("truncate")
+	require.NotZero(t, updater.metrics.NumOversizedRows.Count())
+	truncated := activityQuery(oversizedID)
+	require.NotEmpty(t, truncated)
+	for _, query := range truncated {
+		require.LessOrEqual(t, len(query), maxRowBytes/4)
+		require.True(t, strings.HasPrefix(query, "SELECT _ AS xxx"), query)
+	}
+	require.Equal(t, [][]string{{"true", ""}}, db.QueryStr(t, `
+SELECT DISTINCT (metadata ->> 'truncated')::BOOL, metadata ->> 'formattedQuery'
+FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND fingerprint_id = $2 AND app_name = $3`,
+		srv.now(), oversizedID, appName))
+	require.Equal(t, []string{"SELECT _"}, activityQuery(smallID))
+
+	updater = transfer("skip")
+	require.NotZero(t, updater.metrics.NumOversizedRows.Count())
+	require.Empty(t, activityQuery(oversizedID))
+	require.Equal(t, []string{"SELECT _"}, activityQuery(smallID))
+}
+
+// TestSqlActivityUpdateDedup verifies that the duplicate statement activity
+// rows of a plan of a fingerprint and app are detected after the transfer, and
+// either fail it or are removed according to sql.stats.activity.transfer.dedup.
+// The rows of the other plans of the statement are not duplicates.
+func TestSqlActivityUpdateDedup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	// The statement runs in two transactions.
+	const appName = "TestSqlActivityUpdateDedup"
+	placeholderTxnFingerprintID := make([]byte, 8)
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	for i := 0; i < 2; i++ {
+		db.Exec(t, "SELECT 1;")
+	}
+	tx, err := srv.sqlDB.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("SELECT 1;")
+	require.NoError(t, err)
+	_, err = tx.Exec("SELECT 2;")
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	setDedup := func(mode int64) {
+		require.NoError(t, setActivitySetting(ctx, st,
+			"sql.stats.activity.transfer.dedup", settings.EncodeInt(mode)))
+	}
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	var planHash []byte
+	db.QueryRow(t, `
+SELECT plan_hash
+FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND app_name = $2 AND metadata ->> 'query' = 'SELECT _'`,
+		srv.now(), appName).Scan(&planHash)
+
+	// insertRow copies the transferred activity row of the statement with the
+	// given plan hash and transaction fingerprint and an execution count of 1.
+	insertRow := func(planHash, txnFingerprintID []byte) {
+		db.Exec(t, `
+INSERT INTO system.public.statement_activity
+SELECT aggregated_ts, fingerprint_id, $3, $4, app_name,
+       agg_interval, metadata, statistics, plan, index_recommendations,
+       1, execution_total_seconds, execution_total_cluster_seconds,
+       contention_time_avg_seconds, cpu_sql_avg_nanos, service_latency_avg_seconds,
+       service_latency_p99_seconds
+FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND app_name = $2 AND metadata ->> 'query' = 'SELECT _'
+  AND transaction_fingerprint_id = $5`,
+			srv.now(), appName, txnFingerprintID, planHash, placeholderTxnFingerprintID)
+	}
+	countRows := func() (rows, executions int) {
+		db.QueryRow(t, `
+SELECT count(*), sum(execution_count)
+FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND app_name = $2 AND metadata ->> 'query' = 'SELECT _'`,
+			srv.now(), appName).Scan(&rows, &executions)
+		return rows, executions
+	}
+	// The executions of both transactions are transferred into one row.
+	rows, executions := countRows()
+	require.Equal(t, 1, rows)
+	require.Equal(t, 3, executions)
+
+	// Another plan of the statement is not a duplicate, and survives the dedup.
+	insertRow([]byte("other plan"), placeholderTxnFingerprintID)
+	setDedup(activityDedupError)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	setDedup(activityDedupRemove)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	rows, executions = countRows()
+	require.Equal(t, 2, rows)
+	require.Equal(t, 4, executions)
+	setDedup(activityDedupOff)
+
+	// insertDuplicate copies the activity row of the plan of the statement
+	// under another transaction fingerprint, as a concurrent writer would.
+	insertDuplicate := func() {
+		insertRow(planHash, []byte("other txn"))
+	}
+
+	// The duplicate is left in place, and the transfer fails, if dedup is off
+	// or in the error mode.
+	insertDuplicate()
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	rows, _ = countRows()
+	require.Equal(t, 3, rows)
+
+	setDedup(activityDedupError)
+	err = updater.TransferStatsToActivity(ctx)
+	var dupErr *DuplicateActivityError
+	require.True(t, errors.As(err, &dupErr), "%+v", err)
+	require.True(t, errors.HasType(err, (*TransferError)(nil)), "%+v", err)
+	require.Equal(t, int64(1), dupErr.Keys)
+	rows, _ = countRows()
+	require.Equal(t, 3, rows)
+
+	// The dedup mode keeps the row of the plan with the highest execution
+	// count, and the row of the other plan.
+	setDedup(activityDedupRemove)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	rows, executions = countRows()
+	require.Equal(t, 2, rows)
+	require.Equal(t, 4, executions)
+}
+
+// TestFlushAndTransferSQLActivityBuiltin verifies that
+// crdb_internal.flush_and_transfer_sql_activity flushes the stats, transfers
+// them to the activity tables and returns the number of rows written.
+func TestFlushAndTransferSQLActivityBuiltin(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	srv.runApp(t, "TestFlushAndTransferSQLActivityBuiltin", "SELECT 1;", "SELECT 1, 2;")
+
+	var result string
+	db.QueryRow(t, "SELECT crdb_internal.flush_and_transfer_sql_activity()").Scan(&result)
+	var counts map[string]int
+	require.NoError(t, json.Unmarshal([]byte(result), &counts))
+
+	var stmtRows, txnRows int
+	db.QueryRow(t, "SELECT count(*) FROM system.public.statement_activity").Scan(&stmtRows)
+	db.QueryRow(t, "SELECT count(*) FROM system.public.transaction_activity").Scan(&txnRows)
+	require.NotZero(t, stmtRows)
+	require.NotZero(t, txnRows)
+	require.Equal(t, map[string]int{
+		"statement_activity":   stmtRows,
+		"transaction_activity": txnRows,
+	}, counts)
+
+	// The builtin requires the admin role.
+	db.Exec(t, "CREATE USER testuser")
+	testuserConn := srv.SQLConn(t, serverutils.User("testuser"))
+	_, err := testuserConn.Exec("SELECT crdb_internal.flush_and_transfer_sql_activity()")
+	require.ErrorContains(t, err, "requires admin privilege")
+}
+
+// TestSqlActivityUpdateIncrementalTransfer verifies that an incremental
+// transfer only rewrites the activity rows of the statistics which changed
+// since the previous transfer.
+func TestSqlActivityUpdateIncrementalTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+
+	activityVersions := func(appName string) [][]string {
+		var versions [][]string
+		versions = append(versions, db.QueryStr(t, `
+SELECT fingerprint_id, crdb_internal_mvcc_timestamp
+FROM system.public.transaction_activity
+WHERE app_name = $1
+ORDER BY fingerprint_id`, appName)...)
+		versions = append(versions, db.QueryStr(t, `
+SELECT fingerprint_id, plan_hash, crdb_internal_mvcc_timestamp
+FROM system.public.statement_activity
+WHERE app_name = $1
+ORDER BY fingerprint_id, plan_hash`, appName)...)
+		return versions
+	}
+
+	const firstApp = "TestSqlActivityUpdateIncrementalTransferFirst"
+	const secondApp = "TestSqlActivityUpdateIncrementalTransferSecond"
+
+	// The first transfer has no high water and transfers everything.
+	srv.runApp(t, firstApp, "SELECT 1;")
+	srv.flush(ctx)
+	highWater, err := updater.TransferStatsToActivityIncremental(ctx, hlc.Timestamp{})
+	require.NoError(t, err)
+	require.False(t, highWater.IsEmpty())
+	firstVersions := activityVersions(firstApp)
+	require.NotEmpty(t, firstVersions)
+	require.Empty(t, activityVersions(secondApp))
+
+	// The second transfer only processes the second app's statistics.
+	srv.runApp(t, secondApp, "SELECT 1;")
+	srv.flush(ctx)
+	newHighWater, err := updater.TransferStatsToActivityIncremental(ctx, highWater)
+	require.NoError(t, err)
+	require.True(t, highWater.Less(newHighWater))
+	require.Equal(t, firstVersions, activityVersions(firstApp))
+	require.NotEmpty(t, activityVersions(secondApp))
+
+	// Nothing changed since the last transfer, so the high water stays the same.
+	sameHighWater, err := updater.TransferStatsToActivityIncremental(ctx, newHighWater)
+	require.NoError(t, err)
+	require.Equal(t, newHighWater, sameHighWater)
+}
+
+// TestSqlActivityUpdateRetention verifies that the activity rows older than
+// sql.stats.activity.retention_ttl are deleted by the updater.
+func TestSqlActivityUpdateRetention(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	srv.runApp(t, "TestSqlActivityUpdateRetention", "SELECT 1;")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	// Copy the transferred rows to an aggregated timestamp past the default
+	// retention, and to one within it.
+	expired := srv.now().Add(-15 * 24 * time.Hour)
+	retained := srv.now().Add(-13 * 24 * time.Hour)
+	for _, aggTs := range []time.Time{expired, retained} {
+		db.Exec(t, `
+INSERT INTO system.public.transaction_activity
+SELECT $1, fingerprint_id, app_name, agg_interval, metadata, statistics, query,
+       execution_count, execution_total_seconds, execution_total_cluster_seconds,
+       contention_time_avg_seconds, cpu_sql_avg_nanos, service_latency_avg_seconds,
+       service_latency_p99_seconds
+FROM system.public.transaction_activity
+WHERE aggregated_ts = $2`, aggTs, srv.now())
+		db.Exec(t, `
+INSERT INTO system.public.statement_activity
+SELECT $1, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
+       agg_interval, metadata, statistics, plan, index_recommendations,
+       execution_count, execution_total_seconds, execution_total_cluster_seconds,
+       contention_time_avg_seconds, cpu_sql_avg_nanos, service_latency_avg_seconds,
+       service_latency_p99_seconds
+FROM system.public.statement_activity
+WHERE aggregated_ts = $2`, aggTs, srv.now())
+	}
+
+	countRows := func(aggTs time.Time) (txnCount, stmtCount int) {
+		db.QueryRow(t, `SELECT count(*) FROM system.public.transaction_activity WHERE aggregated_ts = $1`, aggTs).Scan(&txnCount)
+		db.QueryRow(t, `SELECT count(*) FROM system.public.statement_activity WHERE aggregated_ts = $1`, aggTs).Scan(&stmtCount)
+		return txnCount, stmtCount
+	}
+	txnCount, stmtCount := countRows(expired)
+	require.NotZero(t, txnCount)
+	require.NotZero(t, stmtCount)
+
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	txnCount, stmtCount = countRows(expired)
+	require.Zero(t, txnCount)
+	require.Zero(t, stmtCount)
+	for _, aggTs := range []time.Time{retained, srv.now()} {
+		txnCount, stmtCount = countRows(aggTs)
+		require.NotZero(t, txnCount)
+		require.NotZero(t, stmtCount)
+	}
+}
+
+// TestSqlActivityUpdateForWindow verifies that transferring a specific
+// window only populates the activity rows of that window.
+func TestSqlActivityUpdateForWindow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	firstHour := timeutil.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	secondHour := firstHour.Add(time.Hour)
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+	srv.setTime(firstHour)
+
+	// Flush the stats of a different app in each hour.
+	for _, hour := range []time.Time{firstHour, secondHour} {
+		srv.setTime(hour)
+		srv.runApp(t, "TestSqlActivityUpdateForWindow", "SELECT 1;")
+		srv.flush(ctx)
+	}
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivityForWindow(ctx, firstHour, firstHour.Add(time.Hour)))
+
+	aggregatedTimestamps := func(table string) []time.Time {
+		var aggTimestamps []time.Time
+		rows := db.Query(t, fmt.Sprintf(`SELECT DISTINCT aggregated_ts FROM %s ORDER BY aggregated_ts`, table))
+		defer rows.Close()
+		for rows.Next() {
+			var aggTs time.Time
+			require.NoError(t, rows.Scan(&aggTs))
+			aggTimestamps = append(aggTimestamps, aggTs.UTC())
+		}
+		require.NoError(t, rows.Err())
+		return aggTimestamps
+	}
+	require.Equal(t, []time.Time{firstHour.UTC()}, aggregatedTimestamps("system.public.transaction_activity"))
+	require.Equal(t, []time.Time{firstHour.UTC()}, aggregatedTimestamps("system.public.statement_activity"))
+
+	// Transferring the current window only adds the rows of the second hour.
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, []time.Time{firstHour.UTC(), secondHour.UTC()}, aggregatedTimestamps("system.public.transaction_activity"))
+	require.Equal(t, []time.Time{firstHour.UTC(), secondHour.UTC()}, aggregatedTimestamps("system.public.statement_activity"))
+}
+
+// TestSqlActivityLastTransfer verifies that crdb_internal.sql_activity_last_transfer
+// shows the end of the last window transferred to the activity tables.
+func TestSqlActivityLastTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	firstHour := timeutil.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+	srv.setTime(firstHour)
+
+	lastTransfer := func() (windowEnd, completedAt gosql.NullTime) {
+		db.QueryRow(t, "SELECT window_end, completed_at FROM crdb_internal.sql_activity_last_transfer").
+			Scan(&windowEnd, &completedAt)
+		return windowEnd, completedAt
+	}
+
+	// There was no transfer yet.
+	windowEnd, completedAt := lastTransfer()
+	require.False(t, windowEnd.Valid)
+	require.False(t, completedAt.Valid)
+
+	srv.runApp(t, "TestSqlActivityLastTransfer", "SELECT 1;")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	windowEnd, completedAt = lastTransfer()
+	require.Equal(t, firstHour.Add(time.Hour).UTC(), windowEnd.Time.UTC())
+	require.True(t, completedAt.Valid)
+
+	// The transfer of the next window advances the window end.
+	secondHour := firstHour.Add(time.Hour)
+	srv.setTime(secondHour)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	windowEnd, _ = lastTransfer()
+	require.Equal(t, secondHour.Add(time.Hour).UTC(), windowEnd.Time.UTC())
+
+	// Transferring a past window does not move it back.
+	require.NoError(t, updater.TransferStatsToActivityForWindow(ctx, firstHour, firstHour.Add(time.Hour)))
+	windowEnd, _ = lastTransfer()
+	require.Equal(t, secondHour.Add(time.Hour).UTC(), windowEnd.Time.UTC())
+}
+
+// TestSqlActivityUpdateWindowErrorIsolation verifies that the failure of the
+// transfer of one aggregated timestamp of a window does not prevent the
+// transfer of the others.
+func TestSqlActivityUpdateWindowErrorIsolation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	firstHour := timeutil.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+	hours := []time.Time{firstHour, firstHour.Add(time.Hour), firstHour.Add(2 * time.Hour)}
+	failedHour := hours[1]
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+	srv.setTime(firstHour)
+
+	for _, hour := range hours {
+		srv.setTime(hour)
+		srv.runApp(t, "TestSqlActivityUpdateWindowErrorIsolation", "SELECT 1;")
+		srv.flush(ctx)
+	}
+
+	injectedErr := errors.New("injected window failure")
+	windowKnobs := *srv.knobs
+	windowKnobs.OnActivityTransferWindowStart = func(ctx context.Context, aggTs time.Time) error {
+		if aggTs.Equal(failedHour) {
+			return injectedErr
+		}
+		return nil
+	}
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, &windowKnobs, metric.NewRegistry(), nil /* sink */)
+	err := updater.TransferStatsToActivityForWindow(ctx, firstHour, firstHour.Add(3*time.Hour))
+	require.True(t, errors.Is(err, injectedErr))
+	var transferErr *TransferError
+	require.True(t, errors.As(err, &transferErr))
+	require.Equal(t, failedHour, transferErr.WindowStart)
+	require.Equal(t, int64(1), updater.metrics.NumFailedWindows.Count())
+	require.Equal(t, int64(1), updater.metrics.NumErrors.Count())
+
+	// The windows before and after the failed one were transferred.
+	for _, table := range []string{"system.public.transaction_activity", "system.public.statement_activity"} {
+		var aggTimestamps []time.Time
+		rows := db.Query(t, fmt.Sprintf(`SELECT DISTINCT aggregated_ts FROM %s ORDER BY aggregated_ts`, table))
+		for rows.Next() {
+			var aggTs time.Time
+			require.NoError(t, rows.Scan(&aggTs))
+			aggTimestamps = append(aggTimestamps, aggTs.UTC())
+		}
+		require.NoError(t, rows.Err())
+		rows.Close()
+		require.Equal(t, []time.Time{hours[0].UTC(), hours[2].UTC()}, aggTimestamps, table)
+	}
+}
+
+// TestSqlActivityCombinedActivityForRange verifies that the activity of every
+// window intersecting a range is returned, combined per window and
+// fingerprint.
+func TestSqlActivityCombinedActivityForRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	firstHour := timeutil.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+	hours := []time.Time{firstHour, firstHour.Add(time.Hour), firstHour.Add(2 * time.Hour)}
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+	srv.setTime(firstHour)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+
+	// Execute the same statement from two apps in each hour, so each window
+	// has two activity rows for its fingerprint.
+	appNames := []string{"TestSqlActivityCombinedActivityForRange1", "TestSqlActivityCombinedActivityForRange2"}
+	for _, hour := range hours {
+		srv.setTime(hour)
+		for _, appName := range appNames {
+			db.Exec(t, "SET SESSION application_name=$1", appName)
+			db.Exec(t, "SELECT 1;")
+		}
+		db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+		srv.flush(ctx)
+		require.NoError(t, updater.TransferStatsToActivityForWindow(ctx, hour, hour.Add(time.Hour)))
+	}
+
+	var fingerprintID []byte
+	db.QueryRow(t, `
+SELECT DISTINCT fingerprint_id FROM system.public.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appNames[0]).Scan(&fingerprintID)
+	var activityRows int
+	db.QueryRow(t, `
+SELECT count(*) FROM system.public.statement_activity
+WHERE aggregated_ts = $1 AND fingerprint_id = $2`, hours[0], fingerprintID).Scan(&activityRows)
+	require.Equal(t, len(appNames), activityRows)
+
+	// The range starts in the middle of the first window and ends at the
+	// start of the last one, which is excluded.
+	activity, err := updater.CombinedActivityForRange(ctx, hours[0].Add(30*time.Minute), hours[2], 1000 /* limit */)
+	require.NoError(t, err)
+	require.False(t, activity.Truncated)
+
+	for _, rows := range [][]CombinedActivityRow{activity.Statements, activity.Transactions} {
+		windows := make(map[time.Time]struct{})
+		keys := make(map[string]struct{})
+		for _, row := range rows {
+			windows[row.AggregatedTs.UTC()] = struct{}{}
+			key := fmt.Sprintf("%s/%x", row.AggregatedTs.UTC(), row.FingerprintID)
+			require.NotContains(t, keys, key)
+			keys[key] = struct{}{}
+		}
+		require.Equal(t, map[time.Time]struct{}{hours[0]: {}, hours[1]: {}}, windows)
+	}
+
+	var selectWindows []time.Time
+	for _, row := range activity.Statements {
+		if string(row.FingerprintID) != string(fingerprintID) {
+			continue
+		}
+		selectWindows = append(selectWindows, row.AggregatedTs.UTC())
+		require.Equal(t, int64(len(appNames)), row.ExecutionCount)
+		stats, err := row.Statistics.FetchValKey("statistics")
+		require.NoError(t, err)
+		require.NotNil(t, stats)
+	}
+	require.Equal(t, hours[:2], selectWindows)
+
+	// The limit returns the first rows of each table.
+	limited, err := updater.CombinedActivityForRange(ctx, hours[0].Add(30*time.Minute), hours[2], 1 /* limit */)
+	require.NoError(t, err)
+	require.True(t, limited.Truncated)
+	for i, rows := range [][2][]CombinedActivityRow{
+		{activity.Statements, limited.Statements},
+		{activity.Transactions, limited.Transactions},
+	} {
+		require.Len(t, rows[1], 1, i)
+		require.Equal(t, rows[0][0].AggregatedTs, rows[1][0].AggregatedTs, i)
+		require.Equal(t, rows[0][0].FingerprintID, rows[1][0].FingerprintID, i)
+	}
+
+	// A range which does not start before its end, or a limit which is not
+	// positive, is rejected.
+	_, err = updater.CombinedActivityForRange(ctx, hours[1], hours[1], 1000 /* limit */)
+	require.Error(t, err)
+	_, err = updater.CombinedActivityForRange(ctx, hours[0], hours[2], 0 /* limit */)
+	require.Error(t, err)
+}
+
+// TestSqlActivityUpdatePhaseTimeout verifies that a transfer whose phases
+// time out is resumed from its checkpoint and eventually completes.
+func TestSqlActivityUpdatePhaseTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	for i := 0; i < 5; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("TestSqlActivityUpdatePhaseTimeout%d", i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	activityContent := func() [][]string {
+		var content [][]string
+		content = append(content, db.QueryStr(t, `
+SELECT aggregated_ts, fingerprint_id, app_name, statistics
+FROM system.public.transaction_activity
+ORDER BY aggregated_ts, fingerprint_id, app_name`)...)
+		content = append(content, db.QueryStr(t, `
+SELECT aggregated_ts, fingerprint_id, plan_hash, app_name, statistics
+FROM system.public.statement_activity
+ORDER BY aggregated_ts, fingerprint_id, plan_hash, app_name`)...)
+		return content
+	}
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	expected := activityContent()
+	require.NotEmpty(t, expected)
+	db.Exec(t, "DELETE FROM system.public.transaction_activity")
+	db.Exec(t, "DELETE FROM system.public.statement_activity")
+
+	// The first attempt of every phase blocks until the phase times out, so
+	// each transfer completes at most one more phase than the previous one.
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.transfer.phase_timeout", settings.EncodeDuration(100*time.Millisecond)))
+	attempts := make(map[string]int)
+	phaseKnobs := *srv.knobs
+	phaseKnobs.OnActivityTransferPhaseStart = func(ctx context.Context, phase string) error {
+		attempts[phase]++
+		if attempts[phase] == 1 {
+			<-ctx.Done()
+		}
+		return nil
+	}
+
+	var checkpoints []activityTransferCheckpoint
+	updater = newSqlActivityUpdater(st, execCfg.InternalDB, &phaseKnobs, nil /* registry */, nil /* sink */)
+	updater.onCheckpoint = func(_ context.Context, checkpoint activityTransferCheckpoint) error {
+		checkpoints = append(checkpoints, checkpoint)
+		return nil
+	}
+	var failedTransfers int
+	for {
+		err := updater.TransferStatsToActivity(ctx)
+		if err == nil {
+			break
+		}
+		require.True(t, isResumableActivityTransferError(err), "%v", err)
+		failedTransfers++
+		require.Less(t, failedTransfers, 3, "transfer did not make progress")
+	}
+
+	require.Equal(t, 2, failedTransfers)
+	require.Equal(t, map[string]int{
+		activityTransferPhaseTxn:  2,
+		activityTransferPhaseStmt: 2,
+	}, attempts)
+	require.Equal(t, []activityTransferCheckpoint{
+		{aggTs: srv.now(), completedPhases: []string{activityTransferPhaseTxn}},
+		{aggTs: srv.now(), completedPhases: []string{activityTransferPhaseTxn, activityTransferPhaseStmt}},
+		{},
+	}, checkpoints)
+	require.Equal(t, expected, activityContent())
+}
+
+// TestSqlActivityUpdateSingleFlight verifies that only one of two concurrent
+// transfers runs, and the other returns ErrTransferAlreadyRunning.
+func TestSqlActivityUpdateSingleFlight(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, _ := startActivityTestServer(t)
+	defer srv.stop()
+
+	srv.runApp(t, "TestSqlActivityUpdateSingleFlight", "SELECT 1;")
+	srv.flush(ctx)
+
+	// Each updater counts the phases it ran. The first phase of the transfers
+	// blocks until both transfers started, so they overlap.
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	var phases [2]int64
+	var started sync.WaitGroup
+	started.Add(2)
+	proceed := make(chan struct{})
+	updaters := make([]*sqlActivityUpdater, len(phases))
+	for i := range updaters {
+		i := i
+		knobs := *srv.knobs
+		knobs.OnActivityTransferPhaseStart = func(ctx context.Context, phase string) error {
+			if atomic.AddInt64(&phases[i], 1) == 1 {
+				started.Done()
+				<-proceed
+			}
+			return nil
+		}
+		updaters[i] = newSqlActivityUpdater(st, execCfg.InternalDB, &knobs, nil /* registry */, nil /* sink */)
+	}
+
+	errs := make(chan error, len(updaters))
+	for _, updater := range updaters {
+		updater := updater
+		go func() {
+			err := updater.TransferStatsToActivity(ctx)
+			if errors.Is(err, ErrTransferAlreadyRunning) {
+				// The transfer which did not run never reaches a phase.
+				started.Done()
+			}
+			errs <- err
+		}()
+	}
+	started.Wait()
+	close(proceed)
+
+	var ran, skipped int
+	for range updaters {
+		if err := <-errs; errors.Is(err, ErrTransferAlreadyRunning) {
+			skipped++
+		} else {
+			require.NoError(t, err)
+			ran++
+		}
+	}
+	require.Equal(t, 1, ran)
+	require.Equal(t, 1, skipped)
+	// Exactly one of the updaters ran the phases of the transfer.
+	require.True(t, (atomic.LoadInt64(&phases[0]) == 0) != (atomic.LoadInt64(&phases[1]) == 0),
+		"phases run by the updaters: %v", phases)
+
+	// The claim is released once the transfer completes.
+	require.NoError(t, updaters[0].TransferStatsToActivity(ctx))
+}
+
+// TestSqlActivityUpdateClaimHeartbeat verifies that the claim of a transfer is
+// extended while the transfer runs, that the transfer is canceled if the claim
+// is lost, and that the claim is released even if the transfer was canceled.
+func TestSqlActivityUpdateClaimHeartbeat(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, _ := startActivityTestServer(t)
+	defer srv.stop()
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	const ttl = time.Second
+	sqlStatsActivityTransferClaimTTL.Override(ctx, &st.SV, ttl)
+	updater := srv.newUpdater(st)
+
+	getClaim := func() (claim activityTransferClaim, ok bool) {
+		require.NoError(t, execCfg.InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) (err error) {
+			claim, ok, err = getActivityTransferClaim(ctx, jobs.InfoStorageForJob(txn, jobs.SqlActivityUpdaterJobID))
+			return err
+		}))
+		return claim, ok
+	}
+
+	// The claim of a canceled transfer is released.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	_, release, err := updater.claimTransfer(canceledCtx)
+	require.NoError(t, err)
+	cancel()
+	release()
+	_, ok := getClaim()
+	require.False(t, ok)
+
+	// The claim outlives its TTL while the transfer runs.
+	claimCtx, release, err := updater.claimTransfer(ctx)
+	require.NoError(t, err)
+	time.Sleep(2 * ttl)
+	claim, ok := getClaim()
+	require.True(t, ok)
+	require.True(t, claim.Expiration.After(timeutil.Now()), "claim expired at %s", claim.Expiration)
+	require.NoError(t, claimCtx.Err())
+	_, _, err = updater.claimTransfer(ctx)
+	require.True(t, errors.Is(err, ErrTransferAlreadyRunning), "unexpected error: %v", err)
+
+	// Another transfer takes the claim, e.g. because this one could not extend
+	// it in time, which cancels this one.
+	taken := activityTransferClaim{ID: uuid.MakeV4(), Expiration: timeutil.Now().Add(time.Hour)}
+	value, err := json.Marshal(taken)
+	require.NoError(t, err)
+	require.NoError(t, execCfg.InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		return jobs.InfoStorageForJob(txn, jobs.SqlActivityUpdaterJobID).Write(ctx, activityTransferClaimInfoKey, value)
+	}))
+	select {
+	case <-claimCtx.Done():
+	case <-time.After(testutils.DefaultSucceedsSoonDuration):
+		t.Fatal("the transfer was not canceled after its claim was lost")
+	}
+	require.True(t, errors.Is(context.Cause(claimCtx), errActivityTransferClaimLost))
+
+	// Releasing the lost claim leaves the claim of the other transfer.
+	release()
+	claim, ok = getClaim()
+	require.True(t, ok)
+	require.Equal(t, taken.ID, claim.ID)
+}
+
+// TestSqlActivityUpdateTransferError verifies that a failure of a phase of the
+// transfer is returned as a TransferError identifying the phase and window.
+func TestSqlActivityUpdateTransferError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, _ := startActivityTestServer(t)
+	defer srv.stop()
+
+	srv.runApp(t, "TestSqlActivityUpdateTransferError", "SELECT 1;")
+	srv.flush(ctx)
+
+	injectedErr := errors.New("injected transfer failure")
+	phaseKnobs := *srv.knobs
+	phaseKnobs.OnActivityTransferPhaseStart = func(ctx context.Context, phase string) error {
+		if phase == activityTransferPhaseTxn {
+			return injectedErr
+		}
+		return nil
+	}
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, &phaseKnobs, nil /* registry */, nil /* sink */)
+	err := updater.TransferStatsToActivity(ctx)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, injectedErr))
+
+	var transferErr *TransferError
+	require.True(t, errors.As(err, &transferErr))
+	require.Equal(t, activityTransferPhaseTxn, transferErr.Phase)
+	require.Equal(t, srv.now(), transferErr.WindowStart)
+	require.Equal(t, srv.now().Add(persistedsqlstats.SQLStatsAggregationInterval.Get(&st.SV)), transferErr.WindowEnd)
+	require.Contains(t, err.Error(), "sql activity transfer phase transaction_activity failed")
+
+	// The incremental transfer reports the same phase.
+	_, err = updater.TransferStatsToActivityIncremental(ctx, hlc.Timestamp{})
+	require.True(t, errors.As(err, &transferErr))
+	require.Equal(t, activityTransferPhaseTxn, transferErr.Phase)
+}
+
+// TestSqlActivityUpdateDryRun verifies that a dry run does not write to the
+// activity tables and that it reports the rows the transfer inserts.
+func TestSqlActivityUpdateDryRun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const topLimit = 2
+	const numApps = topLimit*6 + 5
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("TestSqlActivityUpdateDryRun%d", i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, setActivitySetting(ctx, st,
+		"sql.stats.activity.top.max", settings.EncodeInt(topLimit)))
+	updater := srv.newUpdater(st)
+
+	plan, err := updater.DryRunTransferStatsToActivity(ctx)
+	require.NoError(t, err)
+	require.Equal(t, srv.now(), plan.AggregatedTs)
+	require.False(t, plan.TransferAll)
+	require.Greater(t, plan.StmtRowCount, int64(0))
+	require.Greater(t, plan.TxnRowCount, int64(0))
+	require.Greater(t, plan.EstimatedBytes, int64(0))
+	require.NotEmpty(t, plan.Candidates)
+	for _, candidate := range plan.Candidates {
+		require.NotEmpty(t, candidate.RankingColumns, "candidate: %+v", candidate)
+	}
+
+	verifyActivityTablesAreEmpty(t, db)
 
-		// Help check for primary key conflicts.
-		duplicateRowHelper(t, db, getAppName(0))
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
 
-		// Run the updater to add rows to the activity tables.
-		// This will use the transfer all scenarios with there only
-		// being a few rows.
-		err = updater.TransferStatsToActivity(ctx)
-		require.NoError(t, err)
+	var count int64
+	db.QueryRow(t, "SELECT count_rows() FROM system.public.statement_activity").Scan(&count)
+	require.Equal(t, plan.StmtRowCount, count)
+	db.QueryRow(t, "SELECT count_rows() FROM system.public.transaction_activity").Scan(&count)
+	require.Equal(t, plan.TxnRowCount, count)
+}
 
-		var httpStmtsResp serverpb.StatementsResponse
+// TestSqlActivityTransferDebugTable verifies that the keys admitted by
+// crdb_internal.sql_activity_transfer_debug are the ones transferred to the
+// activity tables.
+func TestSqlActivityTransferDebugTable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
 
-		// Hit query endpoint.
-		urlPath := fmt.Sprintf("combinedstmts?start=%d", stubTime.Unix())
-		require.NoError(t, srvtestutils.GetStatusJSONProtoWithAdminOption(srv, urlPath, &httpStmtsResp, false))
-		require.Equal(t, "crdb_internal.statement_activity", httpStmtsResp.StmtsSourceTable)
-		require.Equal(t, "crdb_internal.transaction_activity", httpStmtsResp.TxnsSourceTable)
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
 
-		maxRows := topLimit * 6 // Number of top columns to select from.
-		row := db.QueryRow(t,
-			`SELECT count_rows() FROM system.public.transaction_activity WHERE app_name LIKE 'TestSqlActivityUpdateTopLimitJob%'`)
-		var count int
-		row.Scan(&count)
-		require.LessOrEqual(t, count, maxRows, "transaction_activity after transfer: actual:%d, max:%d", count, maxRows)
+	const topLimit = 3
+	db.Exec(t, "SET CLUSTER SETTING sql.stats.activity.top.max = $1", topLimit)
 
-		row = db.QueryRow(t,
-			`SELECT count_rows() FROM system.public.statement_activity WHERE app_name LIKE 'TestSqlActivityUpdateTopLimitJob%'`)
-		row.Scan(&count)
-		require.LessOrEqual(t, count, maxRows, "statement_activity after transfer: actual:%d, max:%d", count, maxRows)
+	const numApps = topLimit*6 + 10
+	for i := 0; i < numApps; i++ {
+		db.Exec(t, "SET SESSION application_name=$1", fmt.Sprintf("TestSqlActivityTransferDebugTable%d", i))
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	countAdmitted := func(activityTable string) (admitted int, candidates int) {
+		db.QueryRow(t, `
+SELECT count(*) FILTER (WHERE admitted), count(*)
+FROM crdb_internal.sql_activity_transfer_debug
+WHERE activity_table = $1`, activityTable).Scan(&admitted, &candidates)
+		return admitted, candidates
+	}
+	txnAdmitted, txnCandidates := countAdmitted("transaction_activity")
+	stmtAdmitted, stmtCandidates := countAdmitted("statement_activity")
+	require.Less(t, txnAdmitted, txnCandidates)
+	require.Less(t, stmtAdmitted, stmtCandidates)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	updater := newSqlActivityUpdater(execCfg.Settings, execCfg.InternalDB, srv.knobs, nil /* registry */, nil /* sink */)
+	require.Equal(t, uniformActivityTopLimits(topLimit), updater.topLimits)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
 
-		row = db.QueryRow(t, `SELECT count_rows() FROM system.public.transaction_activity`)
-		row.Scan(&count)
-		require.LessOrEqual(t, count, maxRows, "transaction_activity after transfer: actual:%d, max:%d", count, maxRows)
+	var txnTransferred, stmtTransferred int
+	db.QueryRow(t, `
+SELECT count(DISTINCT (fingerprint_id, app_name))
+FROM system.public.transaction_activity`).Scan(&txnTransferred)
+	db.QueryRow(t, `
+SELECT count(DISTINCT (fingerprint_id, app_name))
+FROM system.public.statement_activity`).Scan(&stmtTransferred)
+	require.Equal(t, txnAdmitted, txnTransferred)
+	require.Equal(t, stmtAdmitted, stmtTransferred)
+}
 
-		// Verify that if the transaction is in the transaction_activity table that
-		// all the stmts for that transaction are in the statement_activity table.
-		// This is necessary for the UI on the transaction details page to show
-		// the necessary information.
-		var stmtIDs [2]string
-		rows := db.Query(t, `SELECT json_array_elements_text(metadata->'stmtFingerprintIDs') FROM system.public.transaction_activity where app_name = 'topTransaction' AND json_array_length(metadata->'stmtFingerprintIDs') = 2`)
-		defer rows.Close()
-		stmtIdCnt := 0
-		for rows.Next() {
-			require.Less(t, stmtIdCnt, 2)
-			require.NoError(t, rows.Scan(&stmtIDs[stmtIdCnt]))
-			stmtIdCnt++
-		}
+// TestSqlActivityUpdateMalformedStatistics verifies that statistics rows
+// missing ranking fields are transferred with the fields treated as zero,
+// without affecting the other rows.
+func TestSqlActivityUpdateMalformedStatistics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
 
-		require.Equal(t, 2, stmtIdCnt, "transaction_activity should have 2 stmts ids: actual:%d", stmtIdCnt)
-		// Don't check if the statements are on statements_activity
-		// because we no longer force them to be there.
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const healthyApp = "TestSqlActivityUpdateMalformedStatisticsHealthy"
+	const missingMeanApp = "TestSqlActivityUpdateMalformedStatisticsMissingMean"
+	const nullCountApp = "TestSqlActivityUpdateMalformedStatisticsNullCount"
+	for _, appName := range []string{healthyApp, missingMeanApp, nullCountApp} {
+		db.Exec(t, "SET SESSION application_name=$1", appName)
+		db.Exec(t, "SELECT 1;")
+	}
+	db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+	srv.flush(ctx)
+
+	healthyContent := func() [][]string {
+		var content [][]string
+		content = append(content, db.QueryStr(t, `
+SELECT fingerprint_id, statistics, execution_count, service_latency_avg_seconds
+FROM system.public.transaction_activity
+WHERE app_name = $1
+ORDER BY fingerprint_id`, healthyApp)...)
+		content = append(content, db.QueryStr(t, `
+SELECT fingerprint_id, plan_hash, statistics, execution_count, service_latency_avg_seconds
+FROM system.public.statement_activity
+WHERE app_name = $1
+ORDER BY fingerprint_id, plan_hash`, healthyApp)...)
+		return content
+	}
 
-		var txnTotalClusterExecutionSeconds float64
-		row = db.QueryRow(t, `SELECT sum(
-             (statistics -> 'statistics' -> 'svcLat' ->> 'mean')::FLOAT *
-             (statistics -> 'statistics' ->> 'cnt')::FLOAT
-          ) FROM system.public.transaction_statistics`)
-		row.Scan(&txnTotalClusterExecutionSeconds)
-		require.Greater(t, txnTotalClusterExecutionSeconds, float64(0), "transaction_statistics txnTotalClusterExecutionSeconds should be greater than 0: %d", txnTotalClusterExecutionSeconds)
-		require.Equal(t, httpStmtsResp.TxnsTotalRuntimeSecs, float32(txnTotalClusterExecutionSeconds))
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	registry := metric.NewRegistry()
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, registry, nil /* sink */)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	expected := healthyContent()
+	require.NotEmpty(t, expected)
+	require.Zero(t, updater.metrics.NumRowsZeroed.Count())
+
+	// Remove the service latency mean of one app and null out the count of
+	// another.
+	var malformedRows int64
+	for _, table := range []string{"system.public.statement_statistics", "system.public.transaction_statistics"} {
+		res := db.Exec(t, fmt.Sprintf(`UPDATE %s
+		SET statistics = statistics #- '{statistics, svcLat, mean}'
+		WHERE app_name = $1`, table), missingMeanApp)
+		rows, err := res.RowsAffected()
+		require.NoError(t, err)
+		malformedRows += rows
 
-		var stmtTotalClusterExecutionSeconds float64
-		row = db.QueryRow(t, `SELECT sum(
-             (statistics -> 'statistics' -> 'svcLat' ->> 'mean')::FLOAT *
-             (statistics -> 'statistics' ->> 'cnt')::FLOAT
-          ) FROM system.public.statement_statistics`)
-		row.Scan(&stmtTotalClusterExecutionSeconds)
-		require.Greater(t, stmtTotalClusterExecutionSeconds, float64(0), "statement_statistics stmtTotalClusterExecutionSeconds should be greater than 0: %d", stmtTotalClusterExecutionSeconds)
-		require.Equal(t, httpStmtsResp.StmtsTotalRuntimeSecs, float32(stmtTotalClusterExecutionSeconds))
+		res = db.Exec(t, fmt.Sprintf(`UPDATE %s
+		SET statistics = jsonb_set(statistics, '{statistics, cnt}', 'null'::JSONB)
+		WHERE app_name = $1`, table), nullCountApp)
+		rows, err = res.RowsAffected()
+		require.NoError(t, err)
+		malformedRows += rows
+	}
+	require.Greater(t, malformedRows, int64(0))
 
-		func() {
-			var txnTotalClusterExecutionSecondsActivityTbl float64
-			rows := db.Query(t, `SELECT distinct(execution_total_cluster_seconds) FROM system.public.transaction_activity`)
-			require.NoError(t, rows.Err())
-			defer rows.Close()
-			distinctCount := 0
-			for rows.Next() {
-				distinctCount++
-				require.NoError(t, rows.Scan(&txnTotalClusterExecutionSecondsActivityTbl))
-				require.Equal(t, txnTotalClusterExecutionSeconds, txnTotalClusterExecutionSecondsActivityTbl)
-			}
-			require.Equal(t, 1, distinctCount)
-		}()
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	require.Equal(t, malformedRows, updater.metrics.NumRowsZeroed.Count())
+	require.Zero(t, updater.metrics.NumErrors.Count())
+	require.Equal(t, expected, healthyContent())
+
+	var missingMeanLatency float64
+	db.QueryRow(t, `
+SELECT max(service_latency_avg_seconds)
+FROM system.public.statement_activity
+WHERE app_name = $1`, missingMeanApp).Scan(&missingMeanLatency)
+	require.Zero(t, missingMeanLatency)
+
+	var nullCountExecutions int64
+	db.QueryRow(t, `
+SELECT max(execution_count)
+FROM system.public.statement_activity
+WHERE app_name = $1`, nullCountApp).Scan(&nullCountExecutions)
+	require.Zero(t, nullCountExecutions)
+}
 
-		func() {
-			var stmtTotalClusterExecutionSecondsActivityTbl float64
-			rows := db.Query(t, `SELECT distinct(execution_total_cluster_seconds) FROM system.public.statement_activity`)
-			require.NoError(t, rows.Err())
-			defer rows.Close()
-			distinctCount := 0
-			for rows.Next() {
-				distinctCount++
-				require.NoError(t, rows.Scan(&stmtTotalClusterExecutionSecondsActivityTbl))
-				require.Equal(t, stmtTotalClusterExecutionSeconds, stmtTotalClusterExecutionSecondsActivityTbl)
-			}
+// TestSqlActivityUpdaterMetrics verifies that the updater records the rows it
+// transfers and the transfer duration in the metrics of the registry it is
+// constructed with.
+func TestSqlActivityUpdaterMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
 
-			require.Equal(t, 1, distinctCount)
-		}()
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
 
-	}
+	srv.runApp(t, "TestSqlActivityUpdaterMetrics", "SELECT 1;")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	registry := metric.NewRegistry()
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, registry, nil /* sink */)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	counters := make(map[string]int64)
+	registry.Each(func(name string, val interface{}) {
+		if c, ok := val.(*metric.Counter); ok {
+			counters[name] = c.Count()
+		}
+	})
+
+	var stmtCount, txnCount int64
+	db.QueryRow(t, "SELECT count_rows() FROM system.public.statement_activity").Scan(&stmtCount)
+	db.QueryRow(t, "SELECT count_rows() FROM system.public.transaction_activity").Scan(&txnCount)
+	require.Greater(t, stmtCount, int64(0))
+	require.Equal(t, stmtCount, counters["sql.stats.activity.statement.rows_transferred"])
+	require.Equal(t, txnCount, counters["sql.stats.activity.transaction.rows_transferred"])
+	require.Zero(t, counters["jobs.metrics.task_failed"])
+	require.Zero(t, counters["sql.stats.activity.rows_zeroed"])
+
+	count, _ := updater.metrics.TransferDuration.Total()
+	require.Equal(t, int64(1), count)
 }
 
 func TestSqlActivityJobRunsAfterStatsFlush(t *testing.T) {
@@ -530,6 +3199,48 @@ func TestSqlActivityJobRunsAfterStatsFlush(t *testing.T) {
 	}, 1*time.Minute)
 }
 
+// TestSqlActivityJobReportsProgress verifies that the job reports the progress
+// of its transfers in its fraction completed and running status.
+func TestSqlActivityJobReportsProgress(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	// Start the cluster.
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	srv, db, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Insecure: true,
+		Settings: st,
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs:    sqlstats.CreateTestingKnobs(),
+			JobsTestingKnobs: jobs.NewTestingKnobsWithShortIntervals(),
+		},
+	})
+	defer srv.Stopper().Stop(context.Background())
+	defer db.Close()
+
+	_, err := db.ExecContext(ctx, "SET CLUSTER SETTING sql.stats.flush.interval = '100ms'")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "SET SESSION application_name=$1", "TestSqlActivityJobReportsProgress")
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, "SELECT 1;")
+	require.NoError(t, err)
+
+	testutils.SucceedsWithin(t, func() error {
+		var fraction float64
+		var status string
+		if err := db.QueryRowContext(ctx, `
+SELECT fraction_completed, COALESCE(running_status, '')
+FROM crdb_internal.jobs WHERE job_id = $1`, jobs.SqlActivityUpdaterJobID).Scan(&fraction, &status); err != nil {
+			return err
+		}
+		if fraction != 1 || !strings.HasPrefix(status, "transferred") {
+			return errors.Newf("fraction completed: %f, running status: %q", fraction, status)
+		}
+		return nil
+	}, 1*time.Minute)
+}
+
 // TestTransactionActivityMetadata verifies the metadata JSON column of system.transaction_activity are
 // what we expect it to be. This test was added to address #103618.
 func TestTransactionActivityMetadata(t *testing.T) {
@@ -556,7 +3267,7 @@ func TestTransactionActivityMetadata(t *testing.T) {
 
 	execCfg := ts.ExecutorConfig().(ExecutorConfig)
 	st := cluster.MakeTestingClusterSettings()
-	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs)
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs, nil /* registry */, nil /* sink */)
 
 	db := sqlutils.MakeSQLRunner(sqlDB)
 	db.Exec(t, "SET SESSION application_name = 'test_txn_activity_table'")
@@ -584,7 +3295,7 @@ func TestTransactionActivityMetadata(t *testing.T) {
 
 	// Flush and transfer top stats.
 	ts.SQLServer().(*Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
-	require.NoError(t, updater.transferTopStats(ctx, stubTime, 100, 100, 100))
+	require.NoError(t, updater.transferTopStats(ctx, stubTime, uniformActivityTopLimits(100), 100, 100))
 
 	// Ensure that the metadata column contains the populated 'stmtFingerprintIDs' field.
 	db.QueryRow(t, "SELECT metadata FROM system.public.transaction_activity LIMIT 1").Scan(&metadataJSON)
@@ -592,6 +3303,95 @@ func TestTransactionActivityMetadata(t *testing.T) {
 	require.NotEmpty(t, metadata.StmtFingerprintIDs)
 }
 
+// TestTransactionActivityContention verifies that the contention and wait
+// time aggregates of contended transactions are transferred to
+// system.transaction_activity, and that the transactions can be ranked by
+// their contention time.
+func TestTransactionActivityContention(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestTransactionActivityContention"
+	// The contention time is an execution statistic, which is only collected
+	// for sampled executions.
+	db.Exec(t, "SET CLUSTER SETTING sql.txn_stats.sample_rate = 1")
+	db.Exec(t, "CREATE TABLE t (k INT PRIMARY KEY, v INT)")
+	db.Exec(t, "INSERT INTO t VALUES (1, 0)")
+
+	// The blocker holds the lock on the row while the waiter updates it, so
+	// the transaction of the waiter is contended.
+	blockerConn, err := srv.sqlDB.Conn(ctx)
+	require.NoError(t, err)
+	defer blockerConn.Close()
+	blocker := sqlutils.MakeSQLRunner(blockerConn)
+	waiter := sqlutils.MakeSQLRunner(srv.SQLConn(t))
+	blocker.Exec(t, "SET application_name = $1", appName)
+	waiter.Exec(t, "SET application_name = $1", appName)
+
+	blocker.Exec(t, "BEGIN")
+	blocker.Exec(t, "UPDATE t SET v = 1 WHERE k = 1")
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		waiter.Exec(t, "UPDATE t SET v = 2 WHERE k = 1")
+	}()
+	time.Sleep(500 * time.Millisecond)
+	blocker.Exec(t, "COMMIT")
+	<-waiterDone
+
+	srv.flush(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+
+	var metadata struct {
+		ContentionTime struct {
+			Mean         float64 `json:"mean"`
+			SampledCount int64   `json:"sampledCount"`
+		} `json:"contentionTime"`
+		WaitTime struct {
+			CommitLat float64 `json:"commitLat"`
+		} `json:"waitTime"`
+	}
+	verifyContention := func(t *testing.T) {
+		var contentionTime float64
+		var metadataJSON string
+		db.QueryRow(t, `
+SELECT contention_time_avg_seconds, metadata
+FROM system.public.transaction_activity
+WHERE app_name = $1
+ORDER BY contention_time_avg_seconds DESC
+LIMIT 1`, appName).Scan(&contentionTime, &metadataJSON)
+		require.Greater(t, contentionTime, float64(0))
+		require.NoError(t, json.Unmarshal([]byte(metadataJSON), &metadata))
+		require.Equal(t, contentionTime, metadata.ContentionTime.Mean)
+		require.NotZero(t, metadata.ContentionTime.SampledCount)
+		require.Greater(t, metadata.WaitTime.CommitLat, float64(0))
+	}
+
+	t.Run("transfer-all", func(t *testing.T) {
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+		verifyContention(t)
+	})
+
+	t.Run("rank-by-contention-time", func(t *testing.T) {
+		// Only the most contended transaction is transferred, since the
+		// positions of the ranking start at 1.
+		topLimits := uniformActivityTopLimits(2)
+		topLimits.rankingColumns = []string{"contention_time"}
+		require.NoError(t, updater.transferTopStats(ctx, srv.now(), topLimits, 100, 100))
+		verifyContention(t)
+
+		var count int
+		db.QueryRow(t, "SELECT count(*) FROM system.public.transaction_activity").Scan(&count)
+		require.Equal(t, 1, count)
+	})
+}
+
 // Verify the cluster setting ignores activity tables when disabled
 // 1. Changes app name and execute 2 queries (select _, change app name)
 // 2. Check results include the app which should be from activity tables
@@ -623,7 +3423,7 @@ func TestActivityStatusCombineAPI(t *testing.T) {
 
 	execCfg := ts.ExecutorConfig().(ExecutorConfig)
 	st := cluster.MakeTestingClusterSettings()
-	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs)
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, sqlStatsKnobs, nil /* registry */, nil /* sink */)
 
 	db := sqlutils.MakeSQLRunner(sqlDB)
 	// Generate a random app name each time to avoid conflicts
@@ -728,6 +3528,148 @@ func TestActivityStatusCombineAPI(t *testing.T) {
 	require.Greater(t, resp.TxnsTotalRuntimeSecs, float32(0))
 }
 
+// TestActivityStatusCombineAPIFallback verifies that the combined statements
+// API serves the statistics of the windows which were flushed but not
+// transferred to the activity tables yet.
+func TestActivityStatusCombineAPIFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	currentHour := timeutil.Now().Truncate(time.Hour)
+	previousHour := currentHour.Add(-time.Hour)
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+	srv.setTime(previousHour)
+
+	st := cluster.MakeTestingClusterSettings()
+	updater := srv.newUpdater(st)
+
+	// Generate a random app name each time to avoid conflicts
+	transferredAppName := "test_status_api_transferred" + uuid.FastMakeV4().String()
+	flushedAppName := "test_status_api_flushed" + uuid.FastMakeV4().String()
+
+	// The statistics of the previous hour are transferred to the activity
+	// tables, so they hold data for the start of the requested range.
+	srv.runApp(t, transferredAppName, "SELECT 1;")
+	srv.flush(ctx)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	// The statistics of the current hour are only flushed.
+	srv.setTime(currentHour)
+	srv.runApp(t, flushedAppName, "SELECT 1, 2;")
+	srv.flush(ctx)
+
+	var activityRows int
+	db.QueryRow(t, "SELECT count(*) FROM system.public.statement_activity WHERE aggregated_ts = $1",
+		currentHour).Scan(&activityRows)
+	require.Zero(t, activityRows)
+
+	var resp serverpb.StatementsResponse
+	require.NoError(t, getStatusJSONProto(srv.server, "combinedstmts", &resp, previousHour, currentHour))
+	require.Greater(t, getStmtAppNameCount(resp, transferredAppName), 0)
+	require.Greater(t, getTxnAppNameCnt(resp, transferredAppName), 0)
+	require.Greater(t, getStmtAppNameCount(resp, flushedAppName), 0)
+	require.Greater(t, getTxnAppNameCnt(resp, flushedAppName), 0)
+}
+
+// activityTestServer is a test server for the tests of the activity updater.
+// The time of its SQL stats is stubbed, and the update job is disabled since
+// the tests call the updater manually from a new instance to avoid any race
+// conditions.
+type activityTestServer struct {
+	serverutils.ApplicationLayerInterface
+	server serverutils.TestServerInterface
+	sqlDB  *gosql.DB
+	db     *sqlutils.SQLRunner
+	knobs  *sqlstats.TestingKnobs
+	// stubTime is the time.Time returned by the stubbed clock of the SQL
+	// stats.
+	stubTime atomic.Value
+}
+
+// startActivityTestServer starts an activity test server, whose stubbed clock
+// is at the start of the current hour. The root user is granted the node role
+// to be able to write to the system tables. The returned server must be
+// stopped by the caller.
+func startActivityTestServer(t *testing.T) (*activityTestServer, *sqlutils.SQLRunner) {
+	s := &activityTestServer{knobs: sqlstats.CreateTestingKnobs()}
+	s.stubTime.Store(timeutil.Now().Truncate(time.Hour))
+	s.knobs.StubTimeNow = s.now
+
+	var sqlDB *gosql.DB
+	s.server, sqlDB, _ = serverutils.StartServer(t, base.TestServerArgs{
+		Insecure: true,
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: s.knobs,
+			UpgradeManager: &upgradebase.TestingKnobs{
+				DontUseJobs:                       true,
+				SkipUpdateSQLActivityJobBootstrap: true,
+			}}})
+	s.ApplicationLayerInterface = s.server.ApplicationLayer()
+	s.sqlDB = sqlDB
+	s.db = sqlutils.MakeSQLRunner(sqlDB)
+
+	// Give permission to write to sys tables.
+	s.db.Exec(t, "INSERT INTO system.users VALUES ('node', NULL, true, 3)")
+	s.db.Exec(t, "GRANT node TO root")
+	return s, s.db
+}
+
+// stop closes the connection of the server and stops it.
+func (s *activityTestServer) stop() {
+	_ = s.sqlDB.Close()
+	s.server.Stopper().Stop(context.Background())
+}
+
+// now returns the time of the stubbed clock.
+func (s *activityTestServer) now() time.Time {
+	return s.stubTime.Load().(time.Time)
+}
+
+// setTime moves the stubbed clock to the given time.
+func (s *activityTestServer) setTime(now time.Time) {
+	s.stubTime.Store(now)
+}
+
+// runApp executes the statements with the given application name, then
+// switches to an application name that is not checked by the tests.
+func (s *activityTestServer) runApp(t *testing.T, appName string, stmts ...string) {
+	s.db.Exec(t, "SET SESSION application_name=$1", appName)
+	for _, stmt := range stmts {
+		s.db.Exec(t, stmt)
+	}
+	s.db.Exec(t, "SET SESSION application_name=$1", "randomIgnore")
+}
+
+// sqlStats returns the persisted SQL stats of the server.
+func (s *activityTestServer) sqlStats() *persistedsqlstats.PersistedSQLStats {
+	return s.SQLServer().(*Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+}
+
+// flush flushes the in-memory SQL stats of the server to the system tables.
+func (s *activityTestServer) flush(ctx context.Context) {
+	s.sqlStats().Flush(ctx)
+}
+
+// newUpdater returns an activity updater of the server with the given
+// settings, and without a registry or sink.
+func (s *activityTestServer) newUpdater(st *cluster.Settings) *sqlActivityUpdater {
+	execCfg := s.ExecutorConfig().(ExecutorConfig)
+	return newSqlActivityUpdater(st, execCfg.InternalDB, s.knobs, nil /* registry */, nil /* sink */)
+}
+
+// setActivitySetting sets the setting with the given name to the encoded
+// value, using the type of the setting.
+func setActivitySetting(ctx context.Context, st *cluster.Settings, name, encoded string) error {
+	key := settings.InternalKey(name)
+	s, ok := settings.LookupForLocalAccessByKey(key, true /* forSystemTenant */)
+	if !ok {
+		return errors.Newf("unknown setting %s", name)
+	}
+	return st.MakeUpdater().Set(ctx, key, settings.EncodedValue{Value: encoded, Type: s.Typ()})
+}
+
 // duplicateRowHelper duplicates a single row in each statistics table, but slightly
 // changes non-primary key fields to make sure it doesn't cause a conflict that
 // breaks upsert because multiple rows have same primary key.
@@ -775,7 +3717,7 @@ func verifyActivityTableContentHelper(t *testing.T, db *sqlutils.SQLRunner, appN
 			ta.cpu_sql_avg_nanos = ts.cpu_sql_nanos AND      
 			ta.service_latency_avg_seconds = ts.service_latency AND
 			ta.statistics = ts.statistics AND
-			ta.metadata = ts.metadata`, table)
+			ta.metadata - 'contentionTime' - 'waitTime' = ts.metadata`, table)
 		row := db.QueryRow(t, query, appName)
 		var count int
 		row.Scan(&count)
@@ -805,7 +3747,7 @@ func verifyActivityTableContentHelper(t *testing.T, db *sqlutils.SQLRunner, appN
 		FROM (select fingerprint_id, app_name, crdb_internal.merge_stats_metadata(array_agg(metadata)) AS metadata FROM system.public.statement_statistics GROUP BY fingerprint_id, app_name) ss
 		INNER JOIN	(SELECT * FROM %s) sa using (fingerprint_id, app_name)
 		WHERE app_name = $1 AND
-		      sa.metadata = ss.metadata`, table)
+		      sa.metadata - 'latencyPercentiles' = ss.metadata`, table)
 		row = db.QueryRow(t, query, appName)
 		row.Scan(&count)
 		require.Equal(t, 1, count, "%s after transfer metadata: expect:1, actual:%d, query: %s", table, count, query)
@@ -925,3 +3867,153 @@ func getStatusJSONProto(
 	url := fmt.Sprintf("/_status/%s?start=%d&end=%d", path, startTime.Unix(), endTime.Unix())
 	return serverutils.GetJSONProto(ts, url, response)
 }
+
+// TestSqlActivityUpdateSelectiveTables verifies that TransferStatementsOnly and
+// TransferTransactionsOnly only write their own activity table.
+func TestSqlActivityUpdateSelectiveTables(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateSelectiveTables"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 1")
+	db.Exec(t, "RESET application_name")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	// The combined transfer writes both tables, so it is not used by the
+	// selective transfers.
+	sqlStatsActivityTransferCombined.Override(ctx, &st.SV, true)
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+
+	countRows := func(table string) (count int) {
+		db.QueryRow(t, "SELECT count(*) FROM "+table+" WHERE app_name = $1", appName).Scan(&count)
+		return count
+	}
+	clearActivity := func() {
+		db.Exec(t, "DELETE FROM system.statement_activity WHERE true")
+		db.Exec(t, "DELETE FROM system.transaction_activity WHERE true")
+	}
+
+	t.Run("statements", func(t *testing.T) {
+		clearActivity()
+		require.NoError(t, updater.TransferStatementsOnly(ctx))
+		require.NotZero(t, countRows("system.statement_activity"))
+		require.Zero(t, countRows("system.transaction_activity"))
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		clearActivity()
+		require.NoError(t, updater.TransferTransactionsOnly(ctx))
+		require.Zero(t, countRows("system.statement_activity"))
+		require.NotZero(t, countRows("system.transaction_activity"))
+	})
+
+	t.Run("all", func(t *testing.T) {
+		clearActivity()
+		require.NoError(t, updater.TransferStatsToActivity(ctx))
+		require.NotZero(t, countRows("system.statement_activity"))
+		require.NotZero(t, countRows("system.transaction_activity"))
+	})
+}
+
+// TestSqlActivityUpdateRollupByTime verifies that the hourly activity rows
+// older than sql.stats.activity.rollup.after are rolled up into a daily row,
+// with their counts summed and their means weighted by their counts.
+func TestSqlActivityUpdateRollupByTime(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	srv, db := startActivityTestServer(t)
+	defer srv.stop()
+
+	const appName = "TestSqlActivityUpdateRollupByTime"
+	db.Exec(t, "SET SESSION application_name=$1", appName)
+	db.Exec(t, "SELECT 1")
+	db.Exec(t, "RESET application_name")
+	srv.flush(ctx)
+
+	execCfg := srv.ExecutorConfig().(ExecutorConfig)
+	st := cluster.MakeTestingClusterSettings()
+	updater := newSqlActivityUpdater(st, execCfg.InternalDB, srv.knobs, metric.NewRegistry(), nil /* sink */)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+
+	// copyDay copies the activity rows of the statement into the 24 hours of
+	// the day, with i+1 executions and a mean service latency of i+1 seconds in
+	// hour i.
+	copyDay := func(day time.Time) {
+		for _, table := range []struct{ name, columns string }{
+			{"system.transaction_activity", txnActivityColumns},
+			{"system.statement_activity", stmtActivityColumns},
+		} {
+			copied := strings.Replace(table.columns, "aggregated_ts", "$1::TIMESTAMPTZ + h * INTERVAL '1 hour'", 1)
+			copied = strings.Replace(copied, "statistics,", `jsonb_set(jsonb_set(statistics,
+  '{statistics,cnt}', to_jsonb(h + 1)),
+  '{statistics,svcLat,mean}', to_jsonb((h + 1)::FLOAT8)),`, 1)
+			db.Exec(t, `INSERT INTO `+table.name+` (`+table.columns+`)
+SELECT `+copied+`
+FROM `+table.name+`, generate_series(0, 23) AS h
+WHERE app_name = $2 AND aggregated_ts = $3`, day, appName, srv.now())
+		}
+	}
+	countRows := func(table string, day time.Time) (count int) {
+		db.QueryRow(t, "SELECT count(*) FROM "+table+" WHERE app_name = $1 AND aggregated_ts >= $2 AND aggregated_ts < $3",
+			appName, day, day.Add(24*time.Hour)).Scan(&count)
+		return count
+	}
+	// checkRolledUp checks that the rows of the day were rolled up into a
+	// single row. The sum of the executions of the hours is 300, and the sum of
+	// the squares of their execution counts, weighing their means, is 4900.
+	checkRolledUp := func(day time.Time) {
+		for _, table := range []string{"system.transaction_activity", "system.statement_activity"} {
+			require.Equal(t, 1, countRows(table, day), table)
+			require.Equal(t, [][]string{{"true", "86400", "300", "300", "16.333", "4900"}}, db.QueryStr(t, `
+SELECT aggregated_ts = $2, extract(epoch FROM agg_interval)::INT, execution_count,
+       (statistics -> 'statistics' ->> 'cnt')::INT,
+       round((statistics -> 'statistics' -> 'svcLat' ->> 'mean')::FLOAT8, 3),
+       round(execution_total_seconds::FLOAT8)
+FROM `+table+`
+WHERE app_name = $1 AND aggregated_ts >= $2 AND aggregated_ts < $3`, appName, day, day.Add(24*time.Hour)))
+		}
+	}
+
+	// The rows of the day before yesterday are rolled up by the full transfer.
+	day := srv.now().Truncate(24 * time.Hour).Add(-48 * time.Hour)
+	copyDay(day)
+	require.Equal(t, 24, countRows("system.transaction_activity", day))
+	require.Equal(t, 24, countRows("system.statement_activity", day))
+	sqlStatsActivityRollupAfter.Override(ctx, &st.SV, 24*time.Hour)
+	require.NoError(t, updater.TransferStatsToActivity(ctx))
+	checkRolledUp(day)
+
+	// The rows of the two days before are rolled up by the incremental
+	// transfer of the job, each into its own row.
+	earlierDay := day.Add(-24 * time.Hour)
+	earliestDay := earlierDay.Add(-24 * time.Hour)
+	copyDay(earlierDay)
+	copyDay(earliestDay)
+	require.Equal(t, 24, countRows("system.statement_activity", earlierDay))
+	_, err := updater.TransferStatsToActivityIncremental(ctx, hlc.Timestamp{})
+	require.NoError(t, err)
+	checkRolledUp(earliestDay)
+	checkRolledUp(earlierDay)
+	checkRolledUp(day)
+
+	// A window transfer into a day which was rolled up fails rather than
+	// replacing the rolled up row.
+	err = updater.TransferStatsToActivityForWindow(ctx, day.Add(time.Hour), day.Add(2*time.Hour))
+	require.True(t, errors.Is(err, errActivityRolledUp), "%+v", err)
+	checkRolledUp(day)
+
+	// The rows of the current hour are kept.
+	var current int
+	db.QueryRow(t, "SELECT count(*) FROM system.statement_activity WHERE app_name = $1 AND aggregated_ts = $2",
+		appName, srv.now()).Scan(&current)
+	require.NotZero(t, current)
+}
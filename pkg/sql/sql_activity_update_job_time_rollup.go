@@ -0,0 +1,296 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// sqlStatsActivityRollupAfter is the cluster setting that controls the age
+// beyond which the activity rows are rolled up into rows of
+// sql.stats.activity.rollup.interval, e.g. to keep hourly activity for recent
+// data but daily activity for older data.
+var sqlStatsActivityRollupAfter = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.rollup.after",
+	"if nonzero, the rows of the statement and transaction activity tables of the "+
+		"aggregation intervals which ended before this duration ago are rolled up into rows of "+
+		"sql.stats.activity.rollup.interval after each transfer",
+	0,
+	settings.NonNegativeDuration,
+)
+
+// sqlStatsActivityRollupInterval is the cluster setting that controls the
+// aggregation interval of the rolled up activity rows.
+var sqlStatsActivityRollupInterval = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.rollup.interval",
+	"the aggregation interval of the activity rows rolled up after sql.stats.activity.rollup.after",
+	24*time.Hour,
+	settings.PositiveDuration,
+)
+
+// activityRollupBucket is the expression of the start of the rollup interval,
+// of $2 seconds, of the aggregated timestamp of an activity row. The
+// intervals are aligned on the Unix epoch.
+const activityRollupBucket = `to_timestamp(floor(extract(epoch FROM aggregated_ts) / $2::FLOAT8) * $2::FLOAT8)`
+
+// activityRollupBucketsQueryFormat returns the start of the rollup intervals,
+// of $2 seconds, which ended before $1 and hold activity rows which were not
+// rolled up yet, i.e. whose aggregation interval is shorter than the rollup
+// interval. The format arguments are the transaction and statement activity
+// tables.
+const activityRollupBucketsQueryFormat = `
+SELECT bucket
+FROM (SELECT ` + activityRollupBucket + ` AS bucket
+      FROM %[1]s
+      WHERE agg_interval < $2::FLOAT8 * INTERVAL '1 second'
+      UNION
+      SELECT ` + activityRollupBucket + ` AS bucket
+      FROM %[2]s
+      WHERE agg_interval < $2::FLOAT8 * INTERVAL '1 second')
+WHERE bucket + $2::FLOAT8 * INTERVAL '1 second' <= $1
+ORDER BY bucket`
+
+// activityRollupRowsFormat selects the activity rows of the rollup interval,
+// of $2 seconds, starting at $1 which were not rolled up yet, along with the
+// start of their rollup interval and the execution_total_cluster_seconds of
+// the rollup interval, which is the sum of the one of each aggregated
+// timestamp. The format argument is the activity table.
+const activityRollupRowsFormat = `
+WITH rollup_rows AS (SELECT *, $1::TIMESTAMPTZ AS bucket
+                     FROM %[1]s
+                     WHERE aggregated_ts >= $1
+                       AND aggregated_ts < $1 + $2::FLOAT8 * INTERVAL '1 second'
+                       AND agg_interval < $2::FLOAT8 * INTERVAL '1 second'),
+     cluster_seconds AS (SELECT bucket, sum(secs) AS secs
+                         FROM (SELECT bucket, aggregated_ts, max(execution_total_cluster_seconds) AS secs
+                               FROM rollup_rows
+                               GROUP BY bucket, aggregated_ts)
+                         GROUP BY bucket)`
+
+// rollupTxnActivityByTimeQueryFormat merges the transaction activity rows
+// selected by activityRollupRowsFormat into a row per rollup interval,
+// fingerprint and app name. The statistics are merged, which sums their
+// counts and weighs their means by their counts. The format argument is the
+// transaction activity table.
+var rollupTxnActivityByTimeQueryFormat = activityRollupRowsFormat + `
+UPSERT INTO %[1]s (` + txnActivityColumns + `)
+    (SELECT bucket,
+            fingerprint_id,
+            app_name,
+            $2::FLOAT8 * INTERVAL '1 second',
+            ` + txnActivityMetadata("merged_metadata", "merged_stats") + `,
+            merged_stats,
+            '' AS query,
+            (merged_stats -> 'statistics' ->> 'cnt')::int,
+            ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+            ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+            secs,
+            COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+            COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+            (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+            0 AS service_latency_p99_seconds
+     FROM (SELECT bucket,
+                  fingerprint_id,
+                  app_name,
+                  max(metadata)                       AS merged_metadata,
+                  merge_transaction_stats(statistics) AS merged_stats
+           FROM rollup_rows
+           GROUP BY bucket, fingerprint_id, app_name)
+              INNER JOIN cluster_seconds USING (bucket))`
+
+// rollupStmtActivityByTimeQuery returns the equivalent of
+// rollupTxnActivityByTimeQueryFormat for the statement activity table.
+func (u *sqlActivityUpdater) rollupStmtActivityByTimeQuery() string {
+	return fmt.Sprintf(activityRollupRowsFormat, u.stmtActivityTable) + `
+UPSERT INTO ` + u.stmtActivityTable + ` (` + stmtActivityColumns + `)
+    (SELECT bucket,
+            fingerprint_id,
+            transaction_fingerprint_id,
+            plan_hash,
+            app_name,
+            $2::FLOAT8 * INTERVAL '1 second',
+            ` + u.stmtActivityMetadata("merged_metadata") + `,
+            merged_stats,
+            max_plan,
+            jsonb_array_to_string_array(merged_stats -> 'index_recommendations') AS idx_rec,
+            (merged_stats -> 'statistics' ->> 'cnt')::int,
+            ((merged_stats -> 'statistics' ->> 'cnt')::float) *
+            ((merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float),
+            secs,
+            COALESCE((merged_stats -> 'execution_statistics' -> 'contentionTime' ->> 'mean')::float, 0),
+            COALESCE((merged_stats -> 'execution_statistics' -> 'cpuSQLNanos' ->> 'mean')::float, 0),
+            (merged_stats -> 'statistics' -> 'svcLat' ->> 'mean')::float,
+            COALESCE((merged_stats -> 'statistics' -> 'latencyInfo' ->> 'p99')::float, 0)
+     FROM (SELECT bucket,
+                  fingerprint_id,
+                  transaction_fingerprint_id,
+                  plan_hash,
+                  app_name,
+                  ` + u.stmtLatencyHistogramsColumn("") + `max(metadata) AS merged_metadata,
+                  merge_statement_stats(statistics) AS merged_stats,
+                  max(plan)                         AS max_plan
+           FROM rollup_rows
+           GROUP BY bucket, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name)
+              INNER JOIN cluster_seconds USING (bucket))`
+}
+
+// deleteRolledUpActivityQueryFormat deletes the activity rows selected by
+// activityRollupRowsFormat once they were rolled up. The rolled up rows are
+// not deleted since their aggregation interval is the rollup interval. The
+// format argument is the activity table.
+const deleteRolledUpActivityQueryFormat = `
+DELETE FROM %[1]s
+WHERE aggregated_ts >= $1
+  AND aggregated_ts < $1 + $2::FLOAT8 * INTERVAL '1 second'
+  AND agg_interval < $2::FLOAT8 * INTERVAL '1 second'`
+
+// countRolledUpActivityQueryFormat returns the number of rolled up activity
+// rows of the rollup interval, of $2 seconds, starting at $1. The format
+// arguments are the transaction and statement activity tables.
+const countRolledUpActivityQueryFormat = `
+SELECT (SELECT count(*)
+        FROM %[1]s
+        WHERE aggregated_ts = $1 AND agg_interval >= $2::FLOAT8 * INTERVAL '1 second') +
+       (SELECT count(*)
+        FROM %[2]s
+        WHERE aggregated_ts = $1 AND agg_interval >= $2::FLOAT8 * INTERVAL '1 second')`
+
+// errActivityRolledUp is returned by the window transfers of the aggregated
+// timestamps whose activity rows were already rolled up.
+var errActivityRolledUp = errors.New("the activity of the aggregated timestamp was already rolled up")
+
+// maybeRollupActivityByTime rolls up the activity rows of the rollup
+// intervals, of sql.stats.activity.rollup.interval, which ended more than
+// sql.stats.activity.rollup.after ago into a row per rollup interval and key,
+// e.g. the 24 hourly rows of a fingerprint into a daily row. The execution
+// counts of the rolled up rows are summed, and their means are recomputed
+// weighted by their counts. Each rollup interval is rolled up in its own
+// transaction. Only complete rollup intervals are rolled up, and the window
+// transfers refuse to write into them afterwards (see checkNotRolledUp), so a
+// rolled up row is never merged with rows of the same interval later.
+func (u *sqlActivityUpdater) maybeRollupActivityByTime(ctx context.Context) error {
+	after := sqlStatsActivityRollupAfter.Get(&u.st.SV)
+	if after == 0 {
+		return nil
+	}
+	cutoff := u.getTimeNow().Add(-after)
+	intervalSeconds := sqlStatsActivityRollupInterval.Get(&u.st.SV).Seconds()
+	rows, err := u.db.Executor().QueryBufferedEx(ctx,
+		"activity-rollup-buckets",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(activityRollupBucketsQueryFormat, u.txnActivityTable, u.stmtActivityTable),
+		cutoff,
+		intervalSeconds,
+	)
+	if err != nil {
+		return err
+	}
+	var rolledUp int
+	for _, row := range rows {
+		bucket := tree.MustBeDTimestampTZ(row[0]).Time
+		n, err := u.rollupActivityBucket(ctx, bucket, intervalSeconds)
+		if err != nil {
+			return err
+		}
+		rolledUp += n
+	}
+	if rolledUp > 0 {
+		log.Infof(ctx, "sql stats activity rolled up %d rows older than %s into intervals of %.0fs",
+			rolledUp, cutoff, intervalSeconds)
+	}
+	return nil
+}
+
+// rollupActivityBucket rolls up the activity rows of the rollup interval
+// starting at bucket, and returns the number of rows which were rolled up.
+func (u *sqlActivityUpdater) rollupActivityBucket(
+	ctx context.Context, bucket time.Time, intervalSeconds float64,
+) (rolledUp int, _ error) {
+	err := u.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		rolledUp = 0
+		if _, err := txn.ExecEx(ctx,
+			"activity-rollup-txn-by-time",
+			txn.KV(),
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(rollupTxnActivityByTimeQueryFormat, u.txnActivityTable),
+			bucket,
+			intervalSeconds,
+		); err != nil {
+			return err
+		}
+		if _, err := txn.ExecEx(ctx,
+			"activity-rollup-stmt-by-time",
+			txn.KV(),
+			sessiondata.NodeUserSessionDataOverride,
+			u.rollupStmtActivityByTimeQuery(),
+			bucket,
+			intervalSeconds,
+		); err != nil {
+			return err
+		}
+		for _, table := range []string{u.txnActivityTable, u.stmtActivityTable} {
+			rows, err := txn.ExecEx(ctx,
+				"activity-rollup-delete-rolled-up",
+				txn.KV(),
+				sessiondata.NodeUserSessionDataOverride,
+				fmt.Sprintf(deleteRolledUpActivityQueryFormat, table),
+				bucket,
+				intervalSeconds,
+			)
+			if err != nil {
+				return err
+			}
+			rolledUp += rows
+		}
+		return nil
+	})
+	return rolledUp, err
+}
+
+// checkNotRolledUp returns errActivityRolledUp if the activity rows of the
+// rollup interval of aggTs were already rolled up. Transferring aggTs again
+// would write rows which are rolled up over the rolled up row, replacing the
+// statistics of the other aggregated timestamps of the interval.
+func (u *sqlActivityUpdater) checkNotRolledUp(ctx context.Context, aggTs time.Time) error {
+	interval := sqlStatsActivityRollupInterval.Get(&u.st.SV)
+	bucket := time.Unix(0, 0).UTC().Add(aggTs.Sub(time.Unix(0, 0)).Truncate(interval))
+	row, err := u.db.Executor().QueryRowEx(ctx,
+		"activity-count-rolled-up",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(countRolledUpActivityQueryFormat, u.txnActivityTable, u.stmtActivityTable),
+		bucket,
+		interval.Seconds(),
+	)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return errors.New("unable to count the rolled up activity rows")
+	}
+	if tree.MustBeDInt(row[0]) > 0 {
+		return errors.Wrapf(errActivityRolledUp, "transferring the statistics at %s into the interval at %s",
+			aggTs, bucket)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// sqlStatsActivityTransferSkipUnchanged is the cluster setting that skips the
+// transfer of an aggregated timestamp whose statistics did not change since
+// they were last transferred, so that a job running more often than the
+// statistics are flushed does not rewrite identical activity rows.
+var sqlStatsActivityTransferSkipUnchanged = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.activity.transfer.skip_unchanged.enabled",
+	"if enabled, the transfer of an aggregated timestamp is skipped when its statistics "+
+		"and the transfer settings did not change since it was last transferred",
+	false,
+)
+
+// activityContentHash is the hash of the statistics of an aggregated
+// timestamp and of the settings they were transferred with.
+type activityContentHash struct {
+	aggTs time.Time
+	hash  uint64
+}
+
+// isEmpty returns whether no hash was computed.
+func (h activityContentHash) isEmpty() bool {
+	return h.aggTs.IsZero()
+}
+
+// statsContentQuery returns the row counts and largest MVCC timestamps of the
+// statistics rows of the aggregated timestamp $1. Flushes upsert the rows they
+// change, so the MVCC timestamps change whenever the statistics do, and the
+// counts change when rows are removed.
+const statsContentQuery = `
+SELECT (SELECT count(*) FROM system.public.statement_statistics WHERE aggregated_ts = $1),
+       (SELECT max(crdb_internal_mvcc_timestamp) FROM system.public.statement_statistics WHERE aggregated_ts = $1),
+       (SELECT count(*) FROM system.public.transaction_statistics WHERE aggregated_ts = $1),
+       (SELECT max(crdb_internal_mvcc_timestamp) FROM system.public.transaction_statistics WHERE aggregated_ts = $1)`
+
+// activitySettingKeys holds the keys of the sql.stats.activity settings. See
+// activitySettings.
+var activitySettingKeys struct {
+	once sync.Once
+	keys []settings.InternalKey
+}
+
+// activitySettings returns the keys of the sql.stats.activity settings, which
+// include every setting determining the activity rows written by the
+// transfers.
+func activitySettings() []settings.InternalKey {
+	activitySettingKeys.once.Do(func() {
+		for _, key := range settings.Keys(false /* forSystemTenant */) {
+			if strings.HasPrefix(string(key), "sql.stats.activity.") {
+				activitySettingKeys.keys = append(activitySettingKeys.keys, key)
+			}
+		}
+	})
+	return activitySettingKeys.keys
+}
+
+// computeContentHash returns the hash of the statistics of the aggregated
+// timestamp and of the settings which determine the activity rows they are
+// transferred to, which are the fields of the updater and every
+// sql.stats.activity setting, so that a transfer is not skipped after any of
+// them changed. It is cheap to compute since it does not read the statistics
+// themselves, only their row counts and MVCC timestamps.
+func (u *sqlActivityUpdater) computeContentHash(
+	ctx context.Context, aggTs time.Time,
+) (activityContentHash, error) {
+	row, err := u.db.Executor().QueryRowEx(ctx,
+		"activity-flush-content-hash",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		statsContentQuery,
+		aggTs,
+	)
+	if err != nil {
+		return activityContentHash{}, err
+	}
+	h := fnv.New64a()
+	for _, d := range row {
+		_, _ = fmt.Fprintf(h, "%s\x00", d)
+	}
+	_, _ = fmt.Fprintf(h, "%+v\x00%s\x00%t\x00%d\x00%t\x00%t\x00%d\x00%s\x00%s\x00",
+		u.topLimits, u.ignoredAppNames, u.aggregateApps, u.maxAppNames, u.anonymizeQueryText,
+		u.includeHistograms, u.maxRowBytes, u.txnActivityTable, u.stmtActivityTable)
+	for _, key := range activitySettings() {
+		if s, ok := settings.LookupForLocalAccessByKey(key, false /* forSystemTenant */); ok {
+			_, _ = fmt.Fprintf(h, "%s=%s\x00", key, s.Encoded(&u.st.SV))
+		}
+	}
+	return activityContentHash{aggTs: aggTs, hash: h.Sum64()}, nil
+}
+
+// checkUnchanged returns the content hash of the aggregated timestamp, and
+// whether it matches the hash of its last transfer, in which case the
+// transfer can be skipped. The hash is empty if
+// sql.stats.activity.transfer.skip_unchanged.enabled is not set. The hash is
+// computed before the statistics are read, so statistics flushed during the
+// transfer change the hash of the next one.
+func (u *sqlActivityUpdater) checkUnchanged(
+	ctx context.Context, aggTs time.Time,
+) (_ activityContentHash, unchanged bool, _ error) {
+	if !sqlStatsActivityTransferSkipUnchanged.Get(&u.st.SV) {
+		return activityContentHash{}, false, nil
+	}
+	hash, err := u.computeContentHash(ctx, aggTs)
+	if err != nil {
+		return activityContentHash{}, false, err
+	}
+	if hash != u.lastContentHash {
+		return hash, false, nil
+	}
+	log.Infof(ctx, "sql stats activity skipped the transfer at %s since its statistics did not change", aggTs)
+	if u.metrics != nil {
+		u.metrics.NumSkippedUnchanged.Inc(1)
+	}
+	return hash, true, nil
+}
+
+// recordContentHash records the content hash of a completed transfer, unless
+// it is empty.
+func (u *sqlActivityUpdater) recordContentHash(
+	ctx context.Context, hash activityContentHash,
+) error {
+	if hash.isEmpty() || hash == u.lastContentHash {
+		return nil
+	}
+	u.lastContentHash = hash
+	if u.onContentHash != nil {
+		return u.onContentHash(ctx, hash)
+	}
+	return nil
+}
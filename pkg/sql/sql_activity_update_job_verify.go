@@ -0,0 +1,207 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// verifyActivityCountsQueryFormat returns the (fingerprint_id, app_name) keys
+// of the activity tables whose summed execution count for the aggregated
+// timestamp $1 differs from the summed execution count of the statistics rows
+// of every node. Only the keys which were transferred are compared. The format
+// arguments are the statement and transaction activity tables.
+const verifyActivityCountsQueryFormat = `
+SELECT 'statement_activity', fingerprint_id, app_name, activity_cnt, stats_cnt
+FROM (SELECT fingerprint_id, app_name, sum(execution_count)::INT8 AS activity_cnt
+      FROM %[1]s
+      WHERE aggregated_ts = $1
+      GROUP BY fingerprint_id, app_name)
+         INNER JOIN (SELECT fingerprint_id, app_name,
+                            sum((statistics -> 'statistics' ->> 'cnt')::INT8)::INT8 AS stats_cnt
+                     FROM system.public.statement_statistics
+                     WHERE aggregated_ts = $1
+                     GROUP BY fingerprint_id, app_name)
+                    USING (fingerprint_id, app_name)
+WHERE activity_cnt IS DISTINCT FROM stats_cnt
+UNION ALL
+SELECT 'transaction_activity', fingerprint_id, app_name, activity_cnt, stats_cnt
+FROM (SELECT fingerprint_id, app_name, sum(execution_count)::INT8 AS activity_cnt
+      FROM %[2]s
+      WHERE aggregated_ts = $1
+      GROUP BY fingerprint_id, app_name)
+         INNER JOIN (SELECT fingerprint_id, app_name,
+                            sum((statistics -> 'statistics' ->> 'cnt')::INT8)::INT8 AS stats_cnt
+                     FROM system.public.transaction_statistics
+                     WHERE aggregated_ts = $1
+                     GROUP BY fingerprint_id, app_name)
+                    USING (fingerprint_id, app_name)
+WHERE activity_cnt IS DISTINCT FROM stats_cnt`
+
+// maybeVerifyActivity verifies the execution counts of the activity tables for
+// the aggregated timestamp if sql.stats.activity.transfer.verify.enabled is
+// set. The verification does not fail the transfer: mismatches are logged and
+// counted, and errors running the verification are logged.
+func (u *sqlActivityUpdater) maybeVerifyActivity(ctx context.Context, aggTs time.Time) {
+	if !sqlStatsActivityTransferVerifyEnabled.Get(&u.st.SV) {
+		return
+	}
+	mismatches, err := u.verifyActivityCounts(ctx, aggTs)
+	if err != nil {
+		log.Warningf(ctx, "sql stats activity failed to verify the transfer at %s: %v", aggTs, err)
+		return
+	}
+	if u.metrics != nil {
+		u.metrics.NumVerifyMismatches.Inc(mismatches)
+	}
+}
+
+// verifyActivityCounts compares the execution count of every fingerprint of
+// the activity tables for the aggregated timestamp to the execution counts of
+// the statistics tables, which hold a row per node, and returns the number of
+// fingerprints which differ. A mismatch means the statistics of some nodes
+// were counted more than once, or not at all. Statistics flushed after the
+// transfer also cause mismatches, until the next transfer.
+func (u *sqlActivityUpdater) verifyActivityCounts(
+	ctx context.Context, aggTs time.Time,
+) (mismatches int64, err error) {
+	it, err := u.db.Executor().QueryIteratorEx(ctx,
+		"activity-flush-verify",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(verifyActivityCountsQueryFormat, u.stmtActivityTable, u.txnActivityTable),
+		aggTs,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		mismatches++
+		log.Warningf(ctx, "sql stats activity %s row with fingerprint %x and app %s at %s "+
+			"has an execution count of %s, but the statistics sum to %s",
+			tree.MustBeDString(row[0]), []byte(tree.MustBeDBytes(row[1])), tree.MustBeDString(row[2]),
+			aggTs, row[3], row[4])
+	}
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	return mismatches, err
+}
+
+// countDuplicateStmtActivityQueryFormat returns the number of (fingerprint_id,
+// plan_hash, app_name) keys of the statement activity table, the format
+// argument, with more than one row for the aggregated timestamp $1. The
+// transfer writes a single row per key, with a placeholder
+// transaction_fingerprint_id, so a key with more rows is counted more than
+// once; the rows of the different plans of a statement are not duplicates. The
+// transaction activity table is keyed by (aggregated_ts, fingerprint_id,
+// app_name), so it cannot hold duplicates.
+const countDuplicateStmtActivityQueryFormat = `
+SELECT count(*)
+FROM (SELECT fingerprint_id, plan_hash, app_name
+      FROM %[1]s
+      WHERE aggregated_ts = $1
+      GROUP BY fingerprint_id, plan_hash, app_name
+      HAVING count(*) > 1)`
+
+// dedupStmtActivityQueryFormat deletes every row of the statement activity
+// table, the format argument, for the aggregated timestamp $1 but the one with
+// the highest execution count of each (fingerprint_id, plan_hash, app_name)
+// key.
+const dedupStmtActivityQueryFormat = `
+DELETE
+FROM %[1]s
+WHERE aggregated_ts = $1
+  AND (fingerprint_id, transaction_fingerprint_id, plan_hash, app_name) IN
+      (SELECT fingerprint_id, transaction_fingerprint_id, plan_hash, app_name
+       FROM (SELECT fingerprint_id, transaction_fingerprint_id, plan_hash, app_name,
+                    row_number() OVER (PARTITION BY fingerprint_id, plan_hash, app_name
+                        ORDER BY execution_count DESC, transaction_fingerprint_id) AS rn
+             FROM %[1]s
+             WHERE aggregated_ts = $1)
+       WHERE rn > 1)`
+
+// DuplicateActivityError is returned by the transfer when
+// sql.stats.activity.transfer.dedup is set to error and the statement activity
+// table holds more than one row for some plans of fingerprints and apps.
+type DuplicateActivityError struct {
+	// AggregatedTs is the aggregated timestamp of the duplicate rows.
+	AggregatedTs time.Time
+	// Keys is the number of (fingerprint_id, plan_hash, app_name) keys with
+	// more than one row.
+	Keys int64
+}
+
+var _ error = &DuplicateActivityError{}
+
+// Error is part of the error interface, which DuplicateActivityError
+// implements.
+func (e *DuplicateActivityError) Error() string {
+	return fmt.Sprintf("%d statement activity plans have duplicate rows at %s",
+		e.Keys, e.AggregatedTs)
+}
+
+// maybeDedupActivity detects the statement activity rows of the aggregated
+// timestamp which share a fingerprint, plan and app according to
+// sql.stats.activity.transfer.dedup. Duplicates are expected when concurrent
+// writers stored the rows of a plan under different transaction fingerprints;
+// they double count the statement in the UI. In the dedup mode the row
+// with the highest execution count of each is kept, and in the error mode a
+// DuplicateActivityError is returned.
+func (u *sqlActivityUpdater) maybeDedupActivity(ctx context.Context, aggTs time.Time) error {
+	mode := sqlStatsActivityTransferDedup.Get(&u.st.SV)
+	if mode == activityDedupOff {
+		return nil
+	}
+	row, err := u.db.Executor().QueryRowEx(ctx,
+		"activity-flush-count-duplicates",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(countDuplicateStmtActivityQueryFormat, u.stmtActivityTable),
+		aggTs,
+	)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return errors.New("unable to count the duplicate statement activity rows")
+	}
+	keys := int64(tree.MustBeDInt(row[0]))
+	if keys == 0 {
+		return nil
+	}
+	if mode == activityDedupError {
+		return &DuplicateActivityError{AggregatedTs: aggTs, Keys: keys}
+	}
+	deleted, err := u.db.Executor().ExecEx(ctx,
+		"activity-flush-dedup",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(dedupStmtActivityQueryFormat, u.stmtActivityTable),
+		aggTs,
+	)
+	if err != nil {
+		return err
+	}
+	log.Warningf(ctx, "sql stats activity removed %d duplicate rows of %d plans at %s",
+		deleted, keys, aggTs)
+	return nil
+}
@@ -33,13 +33,25 @@ import (
 // Flush flushes in-memory sql stats into a system table. Any errors encountered
 // during the flush will be logged as warning.
 func (s *PersistedSQLStats) Flush(ctx context.Context) {
+	s.flush(ctx, false /* force */)
+}
+
+// ForceFlush is like Flush, but flushes regardless of
+// sql.stats.flush.minimum_interval. The flush is synchronous, so the stats of
+// the statements which completed before it was called are in the system tables
+// once it returns, unless the flush is disabled or fails.
+func (s *PersistedSQLStats) ForceFlush(ctx context.Context) {
+	s.flush(ctx, true /* force */)
+}
+
+func (s *PersistedSQLStats) flush(ctx context.Context, force bool) {
 	now := s.getTimeNow()
 
 	allowDiscardWhenDisabled := DiscardInMemoryStatsWhenFlushDisabled.Get(&s.cfg.Settings.SV)
 	minimumFlushInterval := MinimumInterval.Get(&s.cfg.Settings.SV)
 
 	enabled := SQLStatsFlushEnabled.Get(&s.cfg.Settings.SV)
-	flushingTooSoon := now.Before(s.lastFlushStarted.Add(minimumFlushInterval))
+	flushingTooSoon := !force && now.Before(s.lastFlushStarted.Add(minimumFlushInterval))
 
 	// Handle wiping in-memory stats here, we only wipe in-memory stats under 2
 	// circumstances:
@@ -425,7 +425,8 @@ func (jf jsonFields) decodeJSON(js json.JSON) (err error) {
 		if err != nil {
 			return err
 		}
-		if field != nil {
+		// Fields which are absent or null are left as their zero value.
+		if field != nil && field.Type() != json.NullJSONType {
 			err = jf[i].val.decodeJSON(field)
 			if err != nil {
 				return err
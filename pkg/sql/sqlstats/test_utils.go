@@ -10,7 +10,10 @@
 
 package sqlstats
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // TestingKnobs provides hooks and knobs for unit tests.
 type TestingKnobs struct {
@@ -42,6 +45,17 @@ type TestingKnobs struct {
 	// SkipZoneConfigBootstrap used for backup tests where we want to skip
 	// the Zone Config TTL setup.
 	SkipZoneConfigBootstrap bool
+
+	// OnActivityTransferPhaseStart is a callback that is triggered when a phase
+	// of the sql activity transfer starts. The context is the one of the phase,
+	// which is canceled when the phase times out. If it returns an error the
+	// phase fails with that error.
+	OnActivityTransferPhaseStart func(ctx context.Context, phase string) error
+
+	// OnActivityTransferWindowStart is a callback that is triggered when the
+	// sql activity transfer of an aggregated timestamp starts. If it returns an
+	// error the transfer of that aggregated timestamp fails with that error.
+	OnActivityTransferWindowStart func(ctx context.Context, aggTs time.Time) error
 }
 
 // ModuleTestingKnobs implements base.ModuleTestingKnobs interface.
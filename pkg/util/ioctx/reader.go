@@ -47,6 +47,12 @@ func (r ioReaderAdapter) Read(_ context.Context, p []byte) (n int, err error) {
 	return r.r.Read(p)
 }
 
+// WriteTo implements the WriterToCtx interface. It uses the WriteTo method of
+// the io.Reader if it implements io.WriterTo.
+func (r ioReaderAdapter) WriteTo(_ context.Context, w io.Writer) (n int64, err error) {
+	return io.Copy(w, r.r)
+}
+
 // ReaderCtxAdapter turn a ReaderCtx into an io.Reader by capturing a context at
 // construction time and using it for all the Read calls.
 func ReaderCtxAdapter(ctx context.Context, r ReaderCtx) io.Reader {
@@ -64,12 +70,40 @@ type readerCtxAdapter struct {
 }
 
 var _ io.Reader = readerCtxAdapter{}
+var _ io.WriterTo = readerCtxAdapter{}
 
 // Read implements io.Reader.
 func (r readerCtxAdapter) Read(p []byte) (n int, err error) {
 	return r.r.Read(r.ctx, p)
 }
 
+// WriteTo implements io.WriterTo, so that io.Copy uses the WriteTo of the
+// ReaderCtx if it implements WriterToCtx.
+func (r readerCtxAdapter) WriteTo(w io.Writer) (n int64, err error) {
+	return WriteTo(r.ctx, r.r, w)
+}
+
+// WriterToCtx is like io.WriterTo, but the WriteTo() method takes in a ctx.
+// It is implemented by the readers which can write their content to a writer
+// without copying it through an intermediate buffer, or which forward to a
+// reader which can.
+type WriterToCtx interface {
+	WriteTo(ctx context.Context, w io.Writer) (n int64, err error)
+}
+
+// WriteTo writes the content of r to w until EOF or an error, like io.Copy. It
+// uses the WriteTo method of r if it implements WriterToCtx, and otherwise
+// copies through a buffer, or through the ReadFrom method of w if it
+// implements io.ReaderFrom.
+func WriteTo(ctx context.Context, r ReaderCtx, w io.Writer) (n int64, err error) {
+	if wt, ok := r.(WriterToCtx); ok {
+		return wt.WriteTo(ctx, w)
+	}
+	// Hide the WriteTo method of the adapter, which would call back into
+	// WriteTo.
+	return io.Copy(w, struct{ io.Reader }{ReaderCtxAdapter(ctx, r)})
+}
+
 // ReadCloserCtx groups the Read and Close methods. It's similar to
 // io.ReadCloser, except the operations take a ctx.
 //
@@ -80,6 +114,7 @@ type ReadCloserCtx interface {
 }
 
 var _ ReadCloserCtx = ioReadCloserAdapter{}
+var _ WriterToCtx = ioReadCloserAdapter{}
 
 // ReadCloserAdapter turns an io.ReadCloser into a ReadCloserCtx by ignoring the
 // ctx passed to all the methods.
@@ -98,6 +133,12 @@ func (r ioReadCloserAdapter) Read(_ context.Context, p []byte) (n int, err error
 	return r.r.Read(p)
 }
 
+// WriteTo is part of the WriterToCtx interface. It uses the WriteTo method of
+// the io.ReadCloser if it implements io.WriterTo.
+func (r ioReadCloserAdapter) WriteTo(_ context.Context, w io.Writer) (n int64, err error) {
+	return io.Copy(w, r.r)
+}
+
 // Close is part of the ReadCloserCtx interface.
 func (r ioReadCloserAdapter) Close(context.Context) error {
 	return r.r.Close()
@@ -141,5 +182,10 @@ type nopCloser struct {
 	ReaderCtx
 }
 
+// WriteTo is part of the WriterToCtx interface.
+func (n nopCloser) WriteTo(ctx context.Context, w io.Writer) (int64, error) {
+	return WriteTo(ctx, n.ReaderCtx, w)
+}
+
 // Close is part of the ReadClosedCtx interface.
 func (nopCloser) Close(ctx context.Context) error { return nil }